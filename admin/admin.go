@@ -0,0 +1,753 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package admin provides an HTTP handler for operating a running
+// server: listing connected users, inspecting connections,
+// disconnecting, revoking or unbinding users, changing digest thresholds,
+// reading delivery latencies, resource usage, CPU pool queues and message sink statistics, querying delivery states, unread counts, cached messages, quota usage, analytics, forward audit trails and subscriptions, syncing subscriptions
+// to the push service, publishing configuration assets and injecting messages. Every request
+// should carry the API key in the X-Uniqush-Api-Key header. The
+// changes may be written to an audit log; see AuditLog.
+//
+// In a cluster, disconnecting, kicking and injecting messages reach
+// the user's connections on every node. Listing users, inspecting
+// connections, changing digest thresholds, reading latencies,
+// resource usage and message sink statistics only see the node serving
+// the request.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/analytics"
+	"github.com/uniqush/uniqush-conn/asset"
+	"github.com/uniqush/uniqush-conn/audit"
+	"github.com/uniqush/uniqush-conn/latency"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/resource"
+	"github.com/uniqush/uniqush-conn/sink"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ApiKeyHeader = "X-Uniqush-Api-Key"
+
+// Center is implemented by msgcenter.MessageCenter.
+type Center interface {
+	AllServices() []string
+
+	// Node-local.
+	ConnectedUsers(service string) []string
+	ConnStats(service, username string) []*server.ConnStats
+	SetDigestThreshold(service, username string, threshold int) int
+	Latency(service string) map[string]*latency.Snapshot
+	Resources(service string) *resource.Usage
+	MessageSinkStats(service string) *sink.Stats
+
+	// Cluster-wide. Revocations, token bindings and subscriptions
+	// are only shared by the nodes if they use the same stores.
+	Disconnect(service, username string) int
+	Kick(service, username, connId string) int
+	Revoke(service, username, token string) error
+	Unrevoke(service, username string) error
+	Unbind(service, username string) error
+	NrUndelivered(service, username string) (n int, err error)
+	Unread(service, username string) (n int, err error)
+	DeliveryState(service, username, id string) (state *msgcache.DeliveryState, err error)
+	QueryCache(service, username string, p *msgcache.Predicate) (msgs []*proto.MessageContainer, err error)
+	Subscriptions(service, username string) (subs []map[string]string, err error)
+	SyncSubscriptions(service, username string) (n int, err error)
+	QuotaUsage(service, username string, day time.Time) (usage *msgcenter.QuotaUsage, err error)
+	Analytics(service string, from, to time.Time, resolution string) (points []*analytics.Point, err error)
+	ForwardAudit(service string, q *audit.Query) (records []*audit.Record, err error)
+	SendMessage(service, username string, msg *proto.Message, extra map[string]string, ttl time.Duration) []*msgcenter.Result
+
+	// The assets are pushed to the clients on the node serving the
+	// request, and found by the other nodes sharing the asset store.
+	PublishAsset(service, name string, data []byte) (a *asset.Asset, err error)
+	Assets(service string) (assets []*asset.Asset, err error)
+	AppliedAssets(service, username string) (versions map[string]map[string]uint64, err error)
+}
+
+type handler struct {
+	center   Center
+	apiKey   string
+	auditLog AuditLog
+	mux      *http.ServeMux
+}
+
+// NewHandler returns a handler serving the admin API under /admin/.
+// All requests are rejected if apiKey is empty.
+func NewHandler(center Center, apiKey string) http.Handler {
+	return NewHandlerWithAuditLog(center, apiKey, nil)
+}
+
+// NewHandlerWithAuditLog is like NewHandler, but every POST request,
+// i.e. every change, is written to the audit log before it is made,
+// even the ones without the API key.
+func NewHandlerWithAuditLog(center Center, apiKey string, auditLog AuditLog) http.Handler {
+	ret := new(handler)
+	ret.center = center
+	ret.apiKey = apiKey
+	ret.auditLog = auditLog
+	ret.mux = http.NewServeMux()
+	ret.mux.HandleFunc("/admin/services.json", ret.services)
+	ret.mux.HandleFunc("/admin/users.json", ret.users)
+	ret.mux.HandleFunc("/admin/conns.json", ret.conns)
+	ret.mux.HandleFunc("/admin/disconnect.json", ret.disconnect)
+	ret.mux.HandleFunc("/admin/kick.json", ret.kick)
+	ret.mux.HandleFunc("/admin/unrevoke.json", ret.unrevoke)
+	ret.mux.HandleFunc("/admin/unbind.json", ret.unbind)
+	ret.mux.HandleFunc("/admin/digest-threshold.json", ret.digestThreshold)
+	ret.mux.HandleFunc("/admin/send.json", ret.send)
+	ret.mux.HandleFunc("/admin/undelivered.json", ret.undelivered)
+	ret.mux.HandleFunc("/admin/delivery-state.json", ret.deliveryState)
+	ret.mux.HandleFunc("/admin/unread.json", ret.unread)
+	ret.mux.HandleFunc("/admin/cached.json", ret.cached)
+	ret.mux.HandleFunc("/admin/latency.json", ret.latency)
+	ret.mux.HandleFunc("/admin/resources.json", ret.resources)
+	ret.mux.HandleFunc("/admin/cpu-pool.json", ret.cpuPool)
+	ret.mux.HandleFunc("/admin/message-sink.json", ret.messageSink)
+	ret.mux.HandleFunc("/admin/usage.json", ret.usage)
+	ret.mux.HandleFunc("/admin/analytics.json", ret.analytics)
+	ret.mux.HandleFunc("/admin/forwards.json", ret.forwards)
+	ret.mux.HandleFunc("/admin/subscriptions.json", ret.subscriptions)
+	ret.mux.HandleFunc("/admin/sync-subscriptions.json", ret.syncSubscriptions)
+	ret.mux.HandleFunc("/admin/publish-asset.json", ret.publishAsset)
+	ret.mux.HandleFunc("/admin/assets.json", ret.assets)
+	ret.mux.HandleFunc("/admin/applied-assets.json", ret.appliedAssets)
+	return ret
+}
+
+func (self *handler) authorized(r *http.Request) bool {
+	if len(self.apiKey) == 0 {
+		return false
+	}
+	key := r.Header.Get(ApiKeyHeader)
+	return subtle.ConstantTimeCompare([]byte(key), []byte(self.apiKey)) == 1
+}
+
+func (self *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	authorized := self.authorized(r)
+	if self.auditLog != nil && r.Method == "POST" {
+		if !authorized {
+			// The attempts are worth knowing about too.
+			if action, err := newAction(r); err == nil {
+				action.Denied = true
+				self.auditLog.Append(action)
+			}
+		} else if !self.audit(w, r) {
+			return
+		}
+	}
+	if !authorized {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	self.mux.ServeHTTP(w, r)
+}
+
+// audit tells if the request is written to the audit log. The
+// request is answered if it is not.
+func (self *handler) audit(w http.ResponseWriter, r *http.Request) bool {
+	action, err := newAction(r)
+	if err != nil {
+		badRequest(w, err)
+		return false
+	}
+	err = self.auditLog.Append(action)
+	if err != nil {
+		http.Error(w, "cannot write the audit log", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func badRequest(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func serviceAndUser(r *http.Request, needUser bool) (service, username string, err error) {
+	service = r.FormValue("service")
+	username = r.FormValue("username")
+	if len(service) == 0 {
+		err = fmt.Errorf("no service")
+		return
+	}
+	if needUser && len(username) == 0 {
+		err = fmt.Errorf("no username")
+		return
+	}
+	return
+}
+
+type countResponse struct {
+	NrConns int `json:"nrConns"`
+}
+
+func (self *handler) services(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, self.center.AllServices())
+}
+
+func (self *handler) users(w http.ResponseWriter, r *http.Request) {
+	service, _, err := serviceAndUser(r, false)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	writeJson(w, self.center.ConnectedUsers(service))
+}
+
+func (self *handler) conns(w http.ResponseWriter, r *http.Request) {
+	service, username, err := serviceAndUser(r, true)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	writeJson(w, self.center.ConnStats(service, username))
+}
+
+func (self *handler) disconnect(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	service, username, err := serviceAndUser(r, true)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	n := self.center.Disconnect(service, username)
+	writeJson(w, &countResponse{n})
+}
+
+// kick closes the connections of the user, or the one given by connid,
+// after telling the clients that they are revoked. With revoke=1, the
+// token given by token, or all tokens of the user if it is empty,
+// will be rejected from now on.
+func (self *handler) kick(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	service, username, err := serviceAndUser(r, true)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	if r.FormValue("revoke") == "1" {
+		err = self.center.Revoke(service, username, r.FormValue("token"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	n := self.center.Kick(service, username, r.FormValue("connid"))
+	writeJson(w, &countResponse{n})
+}
+
+func (self *handler) unrevoke(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	service, username, err := serviceAndUser(r, true)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	err = self.center.Unrevoke(service, username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, struct{}{})
+}
+
+// unbind lets the tokens of the user be used from another device or
+// network, e.g. after the user replaces the phone.
+func (self *handler) unbind(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	service, username, err := serviceAndUser(r, true)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	err = self.center.Unbind(service, username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, struct{}{})
+}
+
+func (self *handler) digestThreshold(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	service, username, err := serviceAndUser(r, true)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	threshold, err := strconv.Atoi(r.FormValue("threshold"))
+	if err != nil {
+		badRequest(w, fmt.Errorf("bad threshold"))
+		return
+	}
+	n := self.center.SetDigestThreshold(service, username, threshold)
+	writeJson(w, &countResponse{n})
+}
+
+type undeliveredResponse struct {
+	NrUndelivered int `json:"nrUndelivered"`
+}
+
+func (self *handler) undelivered(w http.ResponseWriter, r *http.Request) {
+	service, username, err := serviceAndUser(r, true)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	n, err := self.center.NrUndelivered(service, username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, &undeliveredResponse{n})
+}
+
+type unreadResponse struct {
+	Unread int `json:"unread"`
+}
+
+// unread tells the number of unread messages of the user, if the
+// service counts them.
+func (self *handler) unread(w http.ResponseWriter, r *http.Request) {
+	service, username, err := serviceAndUser(r, true)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	n, err := self.center.Unread(service, username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, &unreadResponse{n})
+}
+
+// deliveryState tells when the message given by id was cached,
+// delivered, acked and read. It is null if the message was never
+// cached, or its state has expired.
+func (self *handler) deliveryState(w http.ResponseWriter, r *http.Request) {
+	service, username, err := serviceAndUser(r, true)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	id := r.FormValue("id")
+	if len(id) == 0 {
+		badRequest(w, fmt.Errorf("no id"))
+		return
+	}
+	state, err := self.center.DeliveryState(service, username, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, state)
+}
+
+// cached returns the cached messages whose headers have the values
+// given by the header parameters, like header=type:invite. Only the
+// unread ones are returned if unread is true. The messages are paged
+// by limit, and by after, the sequence number of the last message of
+// the previous page.
+func (self *handler) cached(w http.ResponseWriter, r *http.Request) {
+	service, username, err := serviceAndUser(r, true)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	p := new(msgcache.Predicate)
+	for _, h := range r.Form["header"] {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			badRequest(w, fmt.Errorf("bad header: %v", h))
+			return
+		}
+		if p.Headers == nil {
+			p.Headers = make(map[string]string, 1)
+		}
+		p.Headers[kv[0]] = kv[1]
+	}
+	if v := r.FormValue("unread"); len(v) > 0 {
+		p.Unread, err = strconv.ParseBool(v)
+		if err != nil {
+			badRequest(w, fmt.Errorf("bad unread"))
+			return
+		}
+	}
+	if v := r.FormValue("after"); len(v) > 0 {
+		p.After, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			badRequest(w, fmt.Errorf("bad after"))
+			return
+		}
+	}
+	if v := r.FormValue("limit"); len(v) > 0 {
+		p.Limit, err = strconv.Atoi(v)
+		if err != nil || p.Limit < 0 {
+			badRequest(w, fmt.Errorf("bad limit"))
+			return
+		}
+	}
+	msgs, err := self.center.QueryCache(service, username, p)
+	if err == msgcache.ErrNotIndexed {
+		badRequest(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if msgs == nil {
+		msgs = []*proto.MessageContainer{}
+	}
+	writeJson(w, msgs)
+}
+
+func (self *handler) latency(w http.ResponseWriter, r *http.Request) {
+	service, _, err := serviceAndUser(r, false)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	writeJson(w, self.center.Latency(service))
+}
+
+// resources tells what the service holds on this node and how many
+// times it has hit its limits.
+func (self *handler) resources(w http.ResponseWriter, r *http.Request) {
+	service, _, err := serviceAndUser(r, false)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	writeJson(w, self.center.Resources(service))
+}
+
+// cpuPool tells how the jobs wait for the CPU pool of this node. It
+// writes null if the node has no pool.
+func (self *handler) cpuPool(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, proto.CurrentCPUPool().Stats())
+}
+
+// messageSink tells how many messages of the service the sink has
+// written, failed to write and dropped on this node. It writes null
+// if the service has no sink.
+func (self *handler) messageSink(w http.ResponseWriter, r *http.Request) {
+	service, _, err := serviceAndUser(r, false)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	writeJson(w, self.center.MessageSinkStats(service))
+}
+
+// usage tells what the user, if given, and the service have sent
+// in the day given as "2006-01-02", or today if it is not given.
+func (self *handler) usage(w http.ResponseWriter, r *http.Request) {
+	service, username, err := serviceAndUser(r, false)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	day := time.Now()
+	if d := r.FormValue("day"); len(d) > 0 {
+		day, err = time.Parse("2006-01-02", d)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+	}
+	usage, err := self.center.QuotaUsage(service, username, day)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, usage)
+}
+
+// analytics returns the counters of the service per hour, or per day
+// if resolution is "day", between from and to given in RFC 3339. They
+// default to the last 24 hours, or the last 7 days.
+func (self *handler) analytics(w http.ResponseWriter, r *http.Request) {
+	service, _, err := serviceAndUser(r, false)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	resolution := r.FormValue("resolution")
+	span := 23 * time.Hour
+	switch resolution {
+	case "", analytics.RESOLUTION_HOUR:
+		resolution = analytics.RESOLUTION_HOUR
+	case analytics.RESOLUTION_DAY:
+		span = 6 * 24 * time.Hour
+	default:
+		badRequest(w, analytics.ErrBadResolution)
+		return
+	}
+	to := time.Now()
+	if t := r.FormValue("to"); len(t) > 0 {
+		to, err = time.Parse(time.RFC3339, t)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+	}
+	from := to.Add(-span)
+	if t := r.FormValue("from"); len(t) > 0 {
+		from, err = time.Parse(time.RFC3339, t)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+	}
+	points, err := self.center.Analytics(service, from, to, resolution)
+	if err == analytics.ErrTooManyPoints {
+		badRequest(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, points)
+}
+
+// forwards returns the most recent forward requests received by the
+// user, or sent if direction is "sent", between from and to given in
+// RFC 3339. At most limit records are returned.
+func (self *handler) forwards(w http.ResponseWriter, r *http.Request) {
+	service, username, err := serviceAndUser(r, true)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	q := &audit.Query{Username: username, Direction: r.FormValue("direction")}
+	if t := r.FormValue("from"); len(t) > 0 {
+		q.From, err = time.Parse(time.RFC3339, t)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+	}
+	if t := r.FormValue("to"); len(t) > 0 {
+		q.To, err = time.Parse(time.RFC3339, t)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+	}
+	if l := r.FormValue("limit"); len(l) > 0 {
+		q.Limit, err = strconv.Atoi(l)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+	}
+	records, err := self.center.ForwardAudit(service, q)
+	if err == audit.ErrBadDirection {
+		badRequest(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, records)
+}
+
+func (self *handler) subscriptions(w http.ResponseWriter, r *http.Request) {
+	service, username, err := serviceAndUser(r, true)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	subs, err := self.center.Subscriptions(service, username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, subs)
+}
+
+type syncResponse struct {
+	NrSubscriptions int `json:"nrSubscriptions"`
+}
+
+// syncSubscriptions sends the recorded subscriptions of the user, or of
+// every user of the service if username is empty, to the push service.
+func (self *handler) syncSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	service, username, err := serviceAndUser(r, false)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	n, err := self.center.SyncSubscriptions(service, username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, &syncResponse{n})
+}
+
+type publishAssetRequest struct {
+	Service string `json:"service"`
+	Name    string `json:"name"`
+	Data    []byte `json:"data"`
+}
+
+// publishAsset stores a new version of the asset and pushes it to the
+// connected clients. The response is the published version.
+func (self *handler) publishAsset(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	defer r.Body.Close()
+	req := new(publishAssetRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	if len(req.Service) == 0 || len(req.Name) == 0 {
+		badRequest(w, fmt.Errorf("no service or name"))
+		return
+	}
+	a, err := self.center.PublishAsset(req.Service, req.Name, req.Data)
+	if err == asset.ErrTooLarge {
+		badRequest(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, a)
+}
+
+func (self *handler) assets(w http.ResponseWriter, r *http.Request) {
+	service, _, err := serviceAndUser(r, false)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	assets, err := self.center.Assets(service)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if assets == nil {
+		assets = []*asset.Asset{}
+	}
+	writeJson(w, assets)
+}
+
+// appliedAssets tells the versions of the assets applied by the
+// devices of the user, e.g. to follow a rollout.
+func (self *handler) appliedAssets(w http.ResponseWriter, r *http.Request) {
+	service, username, err := serviceAndUser(r, true)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	versions, err := self.center.AppliedAssets(service, username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, versions)
+}
+
+type sendRequest struct {
+	Service  string            `json:"service"`
+	Username string            `json:"username"`
+	Header   map[string]string `json:"header,omitempty"`
+	Body     []byte            `json:"body,omitempty"`
+	TTL      string            `json:"ttl,omitempty"`
+}
+
+type sendResponse struct {
+	Results []*msgcenter.Result `json:"results"`
+}
+
+func (self *handler) send(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	defer r.Body.Close()
+	req := new(sendRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	if len(req.Service) == 0 || len(req.Username) == 0 {
+		badRequest(w, fmt.Errorf("no service or username"))
+		return
+	}
+	ttl := 24 * time.Hour
+	if len(req.TTL) > 0 {
+		ttl, err = time.ParseDuration(req.TTL)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+	}
+	msg, extra, err := msgcenter.SplitHeader(req.Header, req.Body)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	res := self.center.SendMessage(req.Service, req.Username, msg, extra, ttl)
+	writeJson(w, &sendResponse{res})
+}
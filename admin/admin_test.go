@@ -0,0 +1,523 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/uniqush/uniqush-conn/analytics"
+	"github.com/uniqush/uniqush-conn/asset"
+	"github.com/uniqush/uniqush-conn/audit"
+	"github.com/uniqush/uniqush-conn/latency"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/quota"
+	"github.com/uniqush/uniqush-conn/resource"
+	"github.com/uniqush/uniqush-conn/sink"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeCenter struct {
+	threshold    int
+	disconnected string
+	kicked       string
+	revoked      string
+	unbound      string
+	synced       string
+	msg          *proto.Message
+	extra        map[string]string
+	assets       asset.Store
+}
+
+func (self *fakeCenter) AllServices() []string {
+	return []string{"service"}
+}
+
+func (self *fakeCenter) ConnectedUsers(service string) []string {
+	return []string{"alice", "bob"}
+}
+
+func (self *fakeCenter) ConnStats(service, username string) []*server.ConnStats {
+	return []*server.ConnStats{&server.ConnStats{Service: service, Username: username}}
+}
+
+func (self *fakeCenter) Disconnect(service, username string) int {
+	self.disconnected = username
+	return 1
+}
+
+func (self *fakeCenter) Kick(service, username, connId string) int {
+	self.kicked = username + "/" + connId
+	return 1
+}
+
+func (self *fakeCenter) Revoke(service, username, token string) error {
+	self.revoked = username + "/" + token
+	return nil
+}
+
+func (self *fakeCenter) Unrevoke(service, username string) error {
+	self.revoked = ""
+	return nil
+}
+
+func (self *fakeCenter) Unbind(service, username string) error {
+	self.unbound = username
+	return nil
+}
+
+func (self *fakeCenter) SetDigestThreshold(service, username string, threshold int) int {
+	self.threshold = threshold
+	return 1
+}
+
+func (self *fakeCenter) NrUndelivered(service, username string) (n int, err error) {
+	return 3, nil
+}
+
+func (self *fakeCenter) Unread(service, username string) (n int, err error) {
+	return 2, nil
+}
+
+func (self *fakeCenter) DeliveryState(service, username, id string) (state *msgcache.DeliveryState, err error) {
+	if id != "delivered" {
+		return
+	}
+	state = &msgcache.DeliveryState{Cached: time.Unix(1, 0), Delivered: time.Unix(2, 0)}
+	return
+}
+
+func (self *fakeCenter) QueryCache(service, username string, p *msgcache.Predicate) (msgs []*proto.MessageContainer, err error) {
+	for k := range p.Headers {
+		if k != "type" {
+			err = msgcache.ErrNotIndexed
+			return
+		}
+	}
+	mc := &proto.MessageContainer{Id: "1", Message: &proto.Message{Header: map[string]string{"type": "invite"}}}
+	// The message has been read.
+	if p.Match(mc, true) {
+		msgs = append(msgs, mc)
+	}
+	return
+}
+
+func (self *fakeCenter) Latency(service string) map[string]*latency.Snapshot {
+	tr := latency.NewTracker()
+	tr.RecordLatency(latency.STAGE_QUEUE, time.Second)
+	return tr.Snapshot()
+}
+
+func (self *fakeCenter) Resources(service string) *resource.Usage {
+	g := resource.NewGroup(resource.Limits{MaxConns: 1})
+	g.AcquireConn()
+	g.AcquireConn()
+	return g.Usage()
+}
+
+func (self *fakeCenter) MessageSinkStats(service string) *sink.Stats {
+	if service != "service" {
+		return nil
+	}
+	return &sink.Stats{Queued: 3, Written: 2, Dropped: 1, Pending: 1}
+}
+
+func (self *fakeCenter) Subscriptions(service, username string) (subs []map[string]string, err error) {
+	subs = []map[string]string{{"pushservicetype": "gcm", "regid": username}}
+	return
+}
+
+func (self *fakeCenter) SyncSubscriptions(service, username string) (n int, err error) {
+	self.synced = service + "/" + username
+	return 2, nil
+}
+
+func (self *fakeCenter) QuotaUsage(service, username string, day time.Time) (usage *msgcenter.QuotaUsage, err error) {
+	usage = &msgcenter.QuotaUsage{
+		Day:     quota.Day(day),
+		Service: &quota.Usage{Messages: 10, Bytes: 1000},
+		Limits:  quota.Limits{MessagesPerUser: 5},
+	}
+	if len(username) > 0 {
+		usage.User = &quota.Usage{Messages: 2, Bytes: 200}
+	}
+	return
+}
+
+func (self *fakeCenter) Analytics(service string, from, to time.Time, resolution string) (points []*analytics.Point, err error) {
+	store := analytics.NewMemoryStore()
+	store.Add(service, analytics.Period(from, resolution), &analytics.Counters{Messages: 4, Bytes: 400}, []string{"alice"})
+	rec := analytics.NewRecorder(store, time.Hour)
+	defer rec.Stop()
+	return rec.Query(service, from, to, resolution)
+}
+
+func (self *fakeCenter) ForwardAudit(service string, q *audit.Query) (records []*audit.Record, err error) {
+	store := audit.NewMemoryStore(0)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		store.Record(&audit.Record{Time: now.Add(time.Duration(i-3) * time.Minute), Sender: "bob", SenderService: service, Receiver: q.Username, ReceiverService: service, Size: 100, Status: "ok"})
+	}
+	q.Service = service
+	return store.Query(q)
+}
+
+func (self *fakeCenter) SendMessage(service, username string, msg *proto.Message, extra map[string]string, ttl time.Duration) []*msgcenter.Result {
+	self.msg = msg
+	self.extra = extra
+	return []*msgcenter.Result{&msgcenter.Result{ConnId: "conn", Visible: true}}
+}
+
+func (self *fakeCenter) PublishAsset(service, name string, data []byte) (a *asset.Asset, err error) {
+	return self.assets.Publish(service, name, data)
+}
+
+func (self *fakeCenter) Assets(service string) (assets []*asset.Asset, err error) {
+	return self.assets.Latest(service)
+}
+
+func (self *fakeCenter) AppliedAssets(service, username string) (versions map[string]map[string]uint64, err error) {
+	return self.assets.Applied(service, username)
+}
+
+func do(h http.Handler, method, path, key string, body []byte) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, path, bytes.NewReader(body))
+	if len(key) > 0 {
+		r.Header.Set(ApiKeyHeader, key)
+	}
+	if method == "POST" && body == nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestApiKey(t *testing.T) {
+	h := NewHandler(&fakeCenter{}, "secret")
+	if w := do(h, "GET", "/admin/services.json", "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("should be forbidden without key: %v", w.Code)
+	}
+	if w := do(h, "GET", "/admin/services.json", "wrong", nil); w.Code != http.StatusForbidden {
+		t.Errorf("should be forbidden with wrong key: %v", w.Code)
+	}
+	if w := do(h, "GET", "/admin/services.json", "secret", nil); w.Code != http.StatusOK {
+		t.Errorf("should be allowed: %v", w.Code)
+	}
+	h = NewHandler(&fakeCenter{}, "")
+	if w := do(h, "GET", "/admin/services.json", "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("should be forbidden without configured key: %v", w.Code)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	h := NewHandler(&fakeCenter{}, "secret")
+	w := do(h, "GET", "/admin/users.json?service=service", "secret", nil)
+	var users []string
+	json.Unmarshal(w.Body.Bytes(), &users)
+	if len(users) != 2 || users[0] != "alice" {
+		t.Errorf("bad users: %v", w.Body.String())
+	}
+	w = do(h, "GET", "/admin/users.json", "secret", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("should require service: %v", w.Code)
+	}
+}
+
+func TestDisconnectAndThreshold(t *testing.T) {
+	center := &fakeCenter{}
+	h := NewHandler(center, "secret")
+	q := url.Values{"service": {"service"}, "username": {"alice"}}
+	if w := do(h, "GET", "/admin/disconnect.json?"+q.Encode(), "secret", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("should require POST: %v", w.Code)
+	}
+	do(h, "POST", "/admin/disconnect.json?"+q.Encode(), "secret", nil)
+	if center.disconnected != "alice" {
+		t.Errorf("alice should be disconnected")
+	}
+	q.Set("threshold", "512")
+	do(h, "POST", "/admin/digest-threshold.json?"+q.Encode(), "secret", nil)
+	if center.threshold != 512 {
+		t.Errorf("bad threshold: %v", center.threshold)
+	}
+}
+
+func TestKickAndRevoke(t *testing.T) {
+	center := &fakeCenter{}
+	h := NewHandler(center, "secret")
+	q := url.Values{"service": {"service"}, "username": {"alice"}, "connid": {"conn"}}
+	do(h, "POST", "/admin/kick.json?"+q.Encode(), "secret", nil)
+	if center.kicked != "alice/conn" || center.revoked != "" {
+		t.Errorf("bad kick: %v %v", center.kicked, center.revoked)
+	}
+	q = url.Values{"service": {"service"}, "username": {"bob"}, "revoke": {"1"}, "token": {"stolen"}}
+	w := do(h, "POST", "/admin/kick.json?"+q.Encode(), "secret", nil)
+	if center.kicked != "bob/" || center.revoked != "bob/stolen" {
+		t.Errorf("bad revoke: %v %v", center.kicked, center.revoked)
+	}
+	var resp countResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.NrConns != 1 {
+		t.Errorf("bad response: %v", w.Body.String())
+	}
+	do(h, "POST", "/admin/unrevoke.json?"+q.Encode(), "secret", nil)
+	if center.revoked != "" {
+		t.Errorf("bob should be unrevoked")
+	}
+	do(h, "POST", "/admin/unbind.json?"+q.Encode(), "secret", nil)
+	if center.unbound != "bob" {
+		t.Errorf("bob should be unbound")
+	}
+}
+
+func TestDeliveryState(t *testing.T) {
+	h := NewHandler(&fakeCenter{}, "secret")
+	q := url.Values{"service": {"service"}, "username": {"alice"}}
+	w := do(h, "GET", "/admin/undelivered.json?"+q.Encode(), "secret", nil)
+	var resp undeliveredResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.NrUndelivered != 3 {
+		t.Errorf("bad response: %v", w.Body.String())
+	}
+	w = do(h, "GET", "/admin/unread.json?"+q.Encode(), "secret", nil)
+	var unread unreadResponse
+	json.Unmarshal(w.Body.Bytes(), &unread)
+	if unread.Unread != 2 {
+		t.Errorf("bad response: %v", w.Body.String())
+	}
+	if w = do(h, "GET", "/admin/delivery-state.json?"+q.Encode(), "secret", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("should require id: %v", w.Code)
+	}
+	q.Set("id", "delivered")
+	w = do(h, "GET", "/admin/delivery-state.json?"+q.Encode(), "secret", nil)
+	var state msgcache.DeliveryState
+	json.Unmarshal(w.Body.Bytes(), &state)
+	if !state.IsDelivered() {
+		t.Errorf("bad state: %v", w.Body.String())
+	}
+	q.Set("id", "unknown")
+	w = do(h, "GET", "/admin/delivery-state.json?"+q.Encode(), "secret", nil)
+	if w.Body.String() != "null\n" {
+		t.Errorf("bad state: %v", w.Body.String())
+	}
+}
+
+func TestCached(t *testing.T) {
+	h := NewHandler(&fakeCenter{}, "secret")
+	q := url.Values{"service": {"service"}, "username": {"alice"}, "header": {"type:invite"}}
+	w := do(h, "GET", "/admin/cached.json?"+q.Encode(), "secret", nil)
+	var msgs []*proto.MessageContainer
+	json.Unmarshal(w.Body.Bytes(), &msgs)
+	if len(msgs) != 1 || msgs[0].Id != "1" {
+		t.Errorf("bad messages: %v", w.Body.String())
+	}
+	q.Set("unread", "true")
+	w = do(h, "GET", "/admin/cached.json?"+q.Encode(), "secret", nil)
+	if w.Body.String() != "[]\n" {
+		t.Errorf("bad messages: %v", w.Body.String())
+	}
+	q.Set("header", "room:1")
+	if w = do(h, "GET", "/admin/cached.json?"+q.Encode(), "secret", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("should reject a field which is not indexed: %v", w.Code)
+	}
+	q.Set("header", "type")
+	if w = do(h, "GET", "/admin/cached.json?"+q.Encode(), "secret", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("should reject a bad header: %v", w.Code)
+	}
+	q.Set("header", "type:invite")
+	q.Set("limit", "-1")
+	if w = do(h, "GET", "/admin/cached.json?"+q.Encode(), "secret", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("should reject a bad limit: %v", w.Code)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	center := &fakeCenter{}
+	h := NewHandler(center, "secret")
+	q := url.Values{"service": {"service"}, "username": {"alice"}}
+	w := do(h, "GET", "/admin/subscriptions.json?"+q.Encode(), "secret", nil)
+	var subs []map[string]string
+	json.Unmarshal(w.Body.Bytes(), &subs)
+	if len(subs) != 1 || subs[0]["regid"] != "alice" {
+		t.Errorf("bad subscriptions: %v", w.Body.String())
+	}
+	if w = do(h, "GET", "/admin/sync-subscriptions.json?service=service", "secret", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("sync should require POST: %v", w.Code)
+	}
+	w = do(h, "POST", "/admin/sync-subscriptions.json?service=service", "secret", nil)
+	var resp syncResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.NrSubscriptions != 2 || center.synced != "service/" {
+		t.Errorf("bad response: %v; synced %q", w.Body.String(), center.synced)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	h := NewHandler(&fakeCenter{}, "secret")
+	w := do(h, "GET", "/admin/latency.json?service=service", "secret", nil)
+	var stages map[string]*latency.Snapshot
+	json.Unmarshal(w.Body.Bytes(), &stages)
+	if s, ok := stages[latency.STAGE_QUEUE]; !ok || s.Count != 1 || s.Mean != time.Second {
+		t.Errorf("bad latency: %v", w.Body.String())
+	}
+}
+
+func TestResources(t *testing.T) {
+	h := NewHandler(&fakeCenter{}, "secret")
+	w := do(h, "GET", "/admin/resources.json?service=service", "secret", nil)
+	var usage resource.Usage
+	json.Unmarshal(w.Body.Bytes(), &usage)
+	if usage.Conns != 1 || usage.RejectedConns != 1 || usage.Limits.MaxConns != 1 {
+		t.Errorf("bad usage: %v", w.Body.String())
+	}
+}
+
+func TestCPUPool(t *testing.T) {
+	h := NewHandler(&fakeCenter{}, "secret")
+	w := do(h, "GET", "/admin/cpu-pool.json", "secret", nil)
+	if body := strings.TrimSpace(w.Body.String()); body != "null" {
+		t.Errorf("bad response without a pool: %v", body)
+	}
+	pool := proto.NewCPUPool(2, 4)
+	defer pool.Close()
+	proto.SetCPUPool(pool)
+	defer proto.SetCPUPool(nil)
+	pool.Run(proto.CPU_HANDSHAKE, func() {})
+	w = do(h, "GET", "/admin/cpu-pool.json", "secret", nil)
+	var stats proto.CPUPoolStats
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	if stats.NrWorkers != 2 || stats.Handshake == nil || stats.Handshake.NrDone != 1 {
+		t.Errorf("bad stats: %v", w.Body.String())
+	}
+}
+
+func TestMessageSink(t *testing.T) {
+	h := NewHandler(&fakeCenter{}, "secret")
+	w := do(h, "GET", "/admin/message-sink.json?service=service", "secret", nil)
+	var stats sink.Stats
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	if stats.Queued != 3 || stats.Written != 2 || stats.Dropped != 1 || stats.Pending != 1 {
+		t.Errorf("bad stats: %v", w.Body.String())
+	}
+	w = do(h, "GET", "/admin/message-sink.json?service=other", "secret", nil)
+	if body := strings.TrimSpace(w.Body.String()); body != "null" {
+		t.Errorf("bad response without a sink: %v", body)
+	}
+}
+
+func TestQuotaUsage(t *testing.T) {
+	h := NewHandler(&fakeCenter{}, "secret")
+	w := do(h, "GET", "/admin/usage.json?service=service&username=alice&day=2026-01-02", "secret", nil)
+	var usage msgcenter.QuotaUsage
+	json.Unmarshal(w.Body.Bytes(), &usage)
+	if usage.Day.Day() != 2 || usage.User == nil || usage.User.Messages != 2 || usage.Service.Messages != 10 || usage.Limits.MessagesPerUser != 5 {
+		t.Errorf("bad usage: %v", w.Body.String())
+	}
+	if w = do(h, "GET", "/admin/usage.json?service=service&day=yesterday", "secret", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("should reject a bad day: %v", w.Code)
+	}
+}
+
+func TestAnalytics(t *testing.T) {
+	h := NewHandler(&fakeCenter{}, "secret")
+	w := do(h, "GET", "/admin/analytics.json?service=service&resolution=day&from=2026-01-01T10:00:00Z&to=2026-01-03T00:00:00Z", "secret", nil)
+	var points []*analytics.Point
+	json.Unmarshal(w.Body.Bytes(), &points)
+	if len(points) != 3 || points[0].Start.Day() != 1 || points[0].Messages != 4 || points[0].AvgMessageSize != 100 ||
+		points[0].ActiveUsers != 1 || points[1].Messages != 0 {
+		t.Errorf("bad analytics: %v", w.Body.String())
+	}
+	w = do(h, "GET", "/admin/analytics.json?service=service", "secret", nil)
+	if json.Unmarshal(w.Body.Bytes(), &points); len(points) != 24 {
+		t.Errorf("should return the last 24 hours: %v", len(points))
+	}
+	if w = do(h, "GET", "/admin/analytics.json?service=service&resolution=week", "secret", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("should reject a bad resolution: %v", w.Code)
+	}
+}
+
+func TestForwardAudit(t *testing.T) {
+	h := NewHandler(&fakeCenter{}, "secret")
+	w := do(h, "GET", "/admin/forwards.json?service=service&username=alice&limit=2", "secret", nil)
+	var records []*audit.Record
+	json.Unmarshal(w.Body.Bytes(), &records)
+	if len(records) != 2 || records[0].Sender != "bob" || records[0].Size != 100 || !records[0].Time.After(records[1].Time) {
+		t.Errorf("bad records: %v", w.Body.String())
+	}
+	if w = do(h, "GET", "/admin/forwards.json?service=service&username=alice&direction=both", "secret", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("should reject a bad direction: %v", w.Code)
+	}
+	if w = do(h, "GET", "/admin/forwards.json?service=service", "secret", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("should require a username: %v", w.Code)
+	}
+}
+
+func TestInjectMessage(t *testing.T) {
+	center := &fakeCenter{}
+	h := NewHandler(center, "secret")
+	body := []byte(`{"service":"service","username":"alice","header":{"title":"hello","notif.msg":"hi"}}`)
+	w := do(h, "POST", "/admin/send.json", "secret", body)
+	if w.Code != http.StatusOK {
+		t.Errorf("bad status: %v %v", w.Code, w.Body.String())
+		return
+	}
+	if center.msg == nil || center.msg.Header["title"] != "hello" || center.extra["notif.msg"] != "hi" {
+		t.Errorf("bad message: %v %v", center.msg, center.extra)
+	}
+}
+
+func TestPublishAsset(t *testing.T) {
+	center := &fakeCenter{assets: asset.NewMemoryStore()}
+	h := NewHandler(center, "secret")
+	if w := do(h, "GET", "/admin/publish-asset.json", "secret", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("should require POST: %v", w.Code)
+	}
+	body := []byte(`{"service":"service","name":"flags","data":"eyJkYXJrIjp0cnVlfQ=="}`)
+	do(h, "POST", "/admin/publish-asset.json", "secret", body)
+	w := do(h, "POST", "/admin/publish-asset.json", "secret", body)
+	var a asset.Asset
+	json.Unmarshal(w.Body.Bytes(), &a)
+	if a.Name != "flags" || a.Version != 2 || string(a.Data) != `{"dark":true}` {
+		t.Errorf("bad response: %v", w.Body.String())
+	}
+	if w = do(h, "POST", "/admin/publish-asset.json", "secret", []byte(`{"service":"service"}`)); w.Code != http.StatusBadRequest {
+		t.Errorf("should require name: %v", w.Code)
+	}
+
+	w = do(h, "GET", "/admin/assets.json?service=service", "secret", nil)
+	var assets []*asset.Asset
+	json.Unmarshal(w.Body.Bytes(), &assets)
+	if len(assets) != 1 || assets[0].Version != 2 {
+		t.Errorf("bad response: %v", w.Body.String())
+	}
+
+	center.assets.SetApplied("service", "alice", "phone", "flags", 1)
+	w = do(h, "GET", "/admin/applied-assets.json?service=service&username=alice", "secret", nil)
+	var versions map[string]map[string]uint64
+	json.Unmarshal(w.Body.Bytes(), &versions)
+	if versions["phone"]["flags"] != 1 {
+		t.Errorf("bad response: %v", w.Body.String())
+	}
+}
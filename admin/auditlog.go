@@ -0,0 +1,197 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package admin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ActorHeader names the operator behind a request, for the audit log.
+// The API key is shared, so it is up to the tools calling the API to
+// set it.
+const ActorHeader = "X-Uniqush-Actor"
+
+// Action is an administrative request, as written to the audit log.
+type Action struct {
+	Time time.Time `json:"time"`
+
+	// Actor is the ActorHeader of the request, and Addr the address
+	// it is sent from.
+	Actor string `json:"actor,omitempty"`
+	Addr  string `json:"addr"`
+
+	// Action is the name of the endpoint, e.g. "kick".
+	Action string            `json:"action"`
+	Params map[string]string `json:"params,omitempty"`
+
+	// Denied is set if the request does not carry the API key.
+	Denied bool `json:"denied,omitempty"`
+}
+
+// AuditLog records every change made through the admin API. Append()
+// is called before the change is made; the change is refused if it
+// fails.
+type AuditLog interface {
+	Append(action *Action) error
+}
+
+type writerAuditLog struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewWriterAuditLog writes the actions to w, one JSON object per line.
+func NewWriterAuditLog(w io.Writer) AuditLog {
+	return &writerAuditLog{w: w}
+}
+
+// NewFileAuditLog appends the actions to the file, one JSON object per
+// line. The file is created if it does not exist.
+func NewFileAuditLog(filename string) (log AuditLog, err error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	log = NewWriterAuditLog(f)
+	return
+}
+
+func (self *writerAuditLog) Append(action *Action) error {
+	data, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, err = self.w.Write(data)
+	return err
+}
+
+// OpenAuditLog returns the audit log named by spec: "syslog", or
+// "syslog:" followed by a tag, for NewSyslogAuditLog, or the name of
+// a file for NewFileAuditLog.
+func OpenAuditLog(spec string) (log AuditLog, err error) {
+	if spec == "syslog" || strings.HasPrefix(spec, "syslog:") {
+		tag := strings.TrimPrefix(strings.TrimPrefix(spec, "syslog"), ":")
+		if len(tag) == 0 {
+			tag = "uniqush-conn-admin"
+		}
+		return NewSyslogAuditLog(tag)
+	}
+	return NewFileAuditLog(spec)
+}
+
+type syslogAuditLog struct {
+	w *syslog.Writer
+}
+
+// NewSyslogAuditLog sends the actions to the local syslog daemon as
+// notices of the auth facility, tagged with tag.
+func NewSyslogAuditLog(tag string) (log AuditLog, err error) {
+	w, err := syslog.New(syslog.LOG_NOTICE|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return
+	}
+	log = &syslogAuditLog{w}
+	return
+}
+
+func (self *syslogAuditLog) Append(action *Action) error {
+	data, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+	return self.w.Notice(string(data))
+}
+
+// Tokens are never logged as they are.
+func redact(token string) string {
+	if len(token) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(token)))
+}
+
+// newAction reads the parameters of r. The body of a message sent by
+// send.json is read and put back for the handler.
+func newAction(r *http.Request) (action *Action, err error) {
+	action = &Action{
+		Time:   time.Now(),
+		Actor:  r.Header.Get(ActorHeader),
+		Addr:   r.RemoteAddr,
+		Action: strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/"), ".json"),
+		Params: make(map[string]string, 4),
+	}
+	switch r.URL.Path {
+	case "/admin/send.json":
+		var body []byte
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		// The message itself is not logged, only who it is for.
+		req := new(sendRequest)
+		if json.Unmarshal(body, req) == nil {
+			action.Params["service"] = req.Service
+			action.Params["username"] = req.Username
+			action.Params["ttl"] = req.TTL
+			action.Params["size"] = strconv.Itoa(len(req.Body))
+		}
+	case "/admin/publish-asset.json":
+		var body []byte
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		// Nor is the content of the asset.
+		req := new(publishAssetRequest)
+		if json.Unmarshal(body, req) == nil {
+			action.Params["service"] = req.Service
+			action.Params["name"] = req.Name
+			action.Params["size"] = strconv.Itoa(len(req.Data))
+		}
+	}
+	err = r.ParseForm()
+	if err != nil {
+		return
+	}
+	for name, values := range r.Form {
+		action.Params[name] = strings.Join(values, ",")
+	}
+	if token, ok := action.Params["token"]; ok {
+		action.Params["token"] = redact(token)
+	}
+	return
+}
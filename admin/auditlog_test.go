@@ -0,0 +1,118 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package admin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/uniqush/uniqush-conn/asset"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type failingAuditLog struct{}
+
+func (self failingAuditLog) Append(action *Action) error {
+	return errors.New("disk full")
+}
+
+func readActions(t *testing.T, buf *bytes.Buffer) (actions []*Action) {
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		action := new(Action)
+		if err := json.Unmarshal(scanner.Bytes(), action); err != nil {
+			t.Fatalf("bad line %q: %v", scanner.Text(), err)
+		}
+		actions = append(actions, action)
+	}
+	return
+}
+
+func TestAuditLog(t *testing.T) {
+	buf := new(bytes.Buffer)
+	center := &fakeCenter{assets: asset.NewMemoryStore()}
+	h := NewHandlerWithAuditLog(center, "secret", NewWriterAuditLog(buf))
+
+	do(h, "GET", "/admin/services.json", "secret", nil)
+	q := url.Values{"service": {"service"}, "username": {"bob"}, "revoke": {"1"}, "token": {"stolen"}}
+	r, _ := http.NewRequest("POST", "/admin/kick.json", strings.NewReader(q.Encode()))
+	r.Header.Set(ApiKeyHeader, "secret")
+	r.Header.Set(ActorHeader, "carol")
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = "10.0.0.1:1234"
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if center.revoked != "bob/stolen" {
+		t.Errorf("the handler should still read the form: %v", center.revoked)
+	}
+	body := []byte(`{"service":"service","username":"alice","body":"c2VjcmV0","ttl":"1h"}`)
+	do(h, "POST", "/admin/send.json", "secret", body)
+	if center.msg == nil || string(center.msg.Body) != "secret" {
+		t.Errorf("the handler should still read the body: %v", center.msg)
+	}
+	do(h, "POST", "/admin/publish-asset.json", "secret", []byte(`{"service":"service","name":"flags","data":"c2VjcmV0"}`))
+	if a, _ := center.assets.Get("service", "flags"); a == nil || string(a.Data) != "secret" {
+		t.Errorf("the asset should be published: %v", a)
+	}
+	do(h, "POST", "/admin/disconnect.json?service=service&username=eve", "wrong", nil)
+	if center.disconnected != "" {
+		t.Errorf("eve should not be disconnected")
+	}
+
+	actions := readActions(t, buf)
+	if len(actions) != 4 {
+		t.Fatalf("expected 4 actions; got %v", len(actions))
+	}
+	kick := actions[0]
+	if kick.Action != "kick" || kick.Actor != "carol" || kick.Addr != "10.0.0.1:1234" || kick.Time.IsZero() ||
+		kick.Params["username"] != "bob" || kick.Params["revoke"] != "1" || kick.Denied {
+		t.Errorf("bad kick: %+v", kick)
+	}
+	if tok := kick.Params["token"]; !strings.HasPrefix(tok, "sha256:") || strings.Contains(tok, "stolen") {
+		t.Errorf("the token should be redacted: %v", tok)
+	}
+	send := actions[1]
+	if send.Action != "send" || send.Params["username"] != "alice" || send.Params["ttl"] != "1h" || send.Params["size"] != "6" {
+		t.Errorf("bad send: %+v", send)
+	}
+	if publish := actions[2]; publish.Action != "publish-asset" || publish.Params["name"] != "flags" || publish.Params["size"] != "6" {
+		t.Errorf("bad publish: %+v", publish)
+	}
+	if strings.Contains(buf.String(), "c2VjcmV0") {
+		t.Errorf("the message and the asset should not be logged")
+	}
+	if denied := actions[3]; denied.Action != "disconnect" || !denied.Denied || denied.Params["username"] != "eve" {
+		t.Errorf("bad denied action: %+v", denied)
+	}
+}
+
+func TestAuditLogFailure(t *testing.T) {
+	center := &fakeCenter{}
+	h := NewHandlerWithAuditLog(center, "secret", failingAuditLog{})
+	w := do(h, "POST", "/admin/disconnect.json?service=service&username=bob", "secret", nil)
+	if w.Code != http.StatusInternalServerError || center.disconnected != "" {
+		t.Errorf("an action not logged should be refused: %v %v", w.Code, center.disconnected)
+	}
+	if w := do(h, "GET", "/admin/services.json", "secret", nil); w.Code != http.StatusOK {
+		t.Errorf("reading should not need the log: %v", w.Code)
+	}
+}
@@ -0,0 +1,323 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package analytics counts, per service and per hour and day, the
+// messages delivered, the digests sent, the messages retrieved, the
+// distinct active users and the bytes delivered. Hours and days are
+// in UTC.
+//
+// A user is active in a period if they connected, or were sent
+// anything, during it.
+package analytics
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/logger"
+	"sync"
+	"time"
+)
+
+const (
+	RESOLUTION_HOUR = "hour"
+	RESOLUTION_DAY  = "day"
+)
+
+const (
+	DefaultFlushInterval = 10 * time.Second
+	maxPoints            = 31 * 24
+)
+
+var (
+	ErrBadResolution = errors.New("analytics: unknown resolution")
+	ErrTooManyPoints = errors.New("analytics: too many points")
+)
+
+type Counters struct {
+	Messages    int64 `json:"messages"`
+	Digests     int64 `json:"digests"`
+	Retrievals  int64 `json:"retrievals"`
+	Bytes       int64 `json:"bytes"`
+	ActiveUsers int64 `json:"activeUsers"`
+
+	// AvgMessageSize is only set by Query.
+	AvgMessageSize float64 `json:"avgMessageSize"`
+}
+
+// Point is the counters of the period beginning at Start.
+type Point struct {
+	Start time.Time `json:"start"`
+	Counters
+}
+
+// Store keeps the counters of every period of every service.
+type Store interface {
+	// Add adds delta to the counters of the period, and the users
+	// to its active users. ActiveUsers of delta is ignored.
+	Add(service, period string, delta *Counters, users []string) error
+	Counters(service, period string) (c *Counters, err error)
+}
+
+// Start returns the beginning of the period of t.
+func Start(t time.Time, resolution string) (start time.Time, err error) {
+	t = t.UTC()
+	switch resolution {
+	case RESOLUTION_HOUR:
+		start = t.Truncate(time.Hour)
+	case RESOLUTION_DAY:
+		y, m, d := t.Date()
+		start = time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	default:
+		err = ErrBadResolution
+	}
+	return
+}
+
+// Period returns the name of the period of t in the stores.
+func Period(t time.Time, resolution string) string {
+	if resolution == RESOLUTION_HOUR {
+		return t.UTC().Format("2006010215")
+	}
+	return t.UTC().Format("20060102")
+}
+
+type pending struct {
+	service string
+	period  string
+	delta   Counters
+	users   map[string]bool
+}
+
+// Recorder sums what is recorded in memory, and adds it to the store
+// every flush interval, so that the store is not written for every
+// message.
+type Recorder struct {
+	store    Store
+	interval time.Duration
+	logger   logger.Logger
+
+	lock    sync.Mutex
+	pending map[string]*pending
+	done    chan bool
+	stopped chan bool
+}
+
+// NewRecorder returns a recorder flushing to the store every
+// interval, or DefaultFlushInterval if it is not positive.
+func NewRecorder(store Store, interval time.Duration) *Recorder {
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+	ret := new(Recorder)
+	ret.store = store
+	ret.interval = interval
+	ret.logger = logger.OrNop(nil)
+	ret.pending = make(map[string]*pending, 16)
+	ret.done = make(chan bool)
+	ret.stopped = make(chan bool)
+	go ret.run()
+	return ret
+}
+
+func (self *Recorder) SetLogger(l logger.Logger) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.logger = logger.OrNop(l)
+}
+
+func (self *Recorder) run() {
+	defer close(self.stopped)
+	ticker := time.NewTicker(self.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.Flush()
+		case <-self.done:
+			self.Flush()
+			return
+		}
+	}
+}
+
+// Stop flushes what is recorded and stops flushing.
+func (self *Recorder) Stop() {
+	self.lock.Lock()
+	select {
+	case <-self.done:
+	default:
+		close(self.done)
+	}
+	self.lock.Unlock()
+	<-self.stopped
+}
+
+// record adds to the hour and the day of now, changing the pending
+// counters with fn.
+func (self *Recorder) record(service, username string, fn func(c *Counters)) {
+	now := time.Now()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, period := range [2]string{Period(now, RESOLUTION_HOUR), Period(now, RESOLUTION_DAY)} {
+		key := service + "\n" + period
+		p, ok := self.pending[key]
+		if !ok {
+			p = &pending{service: service, period: period, users: make(map[string]bool, 16)}
+			self.pending[key] = p
+		}
+		if fn != nil {
+			fn(&p.delta)
+		}
+		if len(username) > 0 {
+			p.users[username] = true
+		}
+	}
+}
+
+// RecordActive marks the user active, e.g. when they connect.
+func (self *Recorder) RecordActive(service, username string) {
+	self.record(service, username, nil)
+}
+
+// RecordMessage counts a message of size bytes delivered to the user.
+func (self *Recorder) RecordMessage(service, username string, size int) {
+	self.record(service, username, func(c *Counters) {
+		c.Messages++
+		c.Bytes += int64(size)
+	})
+}
+
+// RecordDigests counts n digests sent to the user.
+func (self *Recorder) RecordDigests(service, username string, n int) {
+	self.record(service, username, func(c *Counters) {
+		c.Digests += int64(n)
+	})
+}
+
+// RecordRetrieval counts a cached message retrieved by the user.
+func (self *Recorder) RecordRetrieval(service, username string) {
+	self.record(service, username, func(c *Counters) {
+		c.Retrievals++
+	})
+}
+
+// Flush adds what is recorded to the store. What cannot be added is
+// dropped, and the last error is returned.
+func (self *Recorder) Flush() (err error) {
+	self.lock.Lock()
+	batch := self.pending
+	self.pending = make(map[string]*pending, len(batch))
+	l := self.logger
+	self.lock.Unlock()
+	for _, p := range batch {
+		users := make([]string, 0, len(p.users))
+		for u := range p.users {
+			users = append(users, u)
+		}
+		if e := self.store.Add(p.service, p.period, &p.delta, users); e != nil {
+			l.Warn("cannot add analytics counters", "service", p.service, "period", p.period, "err", e)
+			err = e
+		}
+	}
+	return
+}
+
+// Query returns the counters of the periods from the one of from to
+// the one of to, included. What has not been flushed is not counted.
+func (self *Recorder) Query(service string, from, to time.Time, resolution string) (points []*Point, err error) {
+	start, err := Start(from, resolution)
+	if err != nil {
+		return
+	}
+	end, err := Start(to, resolution)
+	if err != nil {
+		return
+	}
+	points = make([]*Point, 0, 24)
+	for t := start; !t.After(end); t = next(t, resolution) {
+		if len(points) >= maxPoints {
+			points = nil
+			err = ErrTooManyPoints
+			return
+		}
+		var c *Counters
+		c, err = self.store.Counters(service, Period(t, resolution))
+		if err != nil {
+			points = nil
+			return
+		}
+		p := &Point{Start: t, Counters: *c}
+		if p.Messages > 0 {
+			p.AvgMessageSize = float64(p.Bytes) / float64(p.Messages)
+		}
+		points = append(points, p)
+	}
+	return
+}
+
+func next(t time.Time, resolution string) time.Time {
+	if resolution == RESOLUTION_HOUR {
+		return t.Add(time.Hour)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+type memStore struct {
+	lock     sync.Mutex
+	counters map[string]*Counters
+	users    map[string]map[string]bool
+}
+
+// NewMemoryStore returns a Store which counts the events of this node
+// only. The counters of the past periods are never dropped.
+func NewMemoryStore() Store {
+	ret := new(memStore)
+	ret.counters = make(map[string]*Counters, 64)
+	ret.users = make(map[string]map[string]bool, 64)
+	return ret
+}
+
+func (self *memStore) Add(service, period string, delta *Counters, users []string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := service + "\n" + period
+	c, ok := self.counters[key]
+	if !ok {
+		c = new(Counters)
+		self.counters[key] = c
+		self.users[key] = make(map[string]bool, len(users))
+	}
+	c.Messages += delta.Messages
+	c.Digests += delta.Digests
+	c.Retrievals += delta.Retrievals
+	c.Bytes += delta.Bytes
+	active := self.users[key]
+	for _, u := range users {
+		active[u] = true
+	}
+	c.ActiveUsers = int64(len(active))
+	return nil
+}
+
+func (self *memStore) Counters(service, period string) (c *Counters, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	c = new(Counters)
+	if v, ok := self.counters[service+"\n"+period]; ok {
+		*c = *v
+	}
+	return
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package analytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	store := NewMemoryStore()
+	rec := NewRecorder(store, time.Hour)
+	rec.RecordActive("service", "alice")
+	rec.RecordMessage("service", "alice", 100)
+	rec.RecordMessage("service", "bob", 300)
+	rec.RecordDigests("service", "bob", 2)
+	rec.RecordRetrieval("service", "bob")
+	rec.RecordMessage("other", "carol", 10)
+	if err := rec.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rec.RecordActive("service", "alice")
+	rec.RecordActive("service", "dave")
+	rec.Stop()
+
+	now := time.Now()
+	for _, resolution := range []string{RESOLUTION_HOUR, RESOLUTION_DAY} {
+		points, err := rec.Query("service", now, now, resolution)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != 1 {
+			t.Fatalf("%v points", len(points))
+		}
+		p := points[0]
+		if p.Messages != 2 || p.Bytes != 400 || p.Digests != 2 || p.Retrievals != 1 || p.ActiveUsers != 3 || p.AvgMessageSize != 200 {
+			t.Errorf("bad %v counters: %+v", resolution, p.Counters)
+		}
+		if start, _ := Start(now, resolution); !p.Start.Equal(start) {
+			t.Errorf("bad start: %v", p.Start)
+		}
+	}
+	points, _ := rec.Query("other", now, now, RESOLUTION_DAY)
+	if len(points) != 1 || points[0].Messages != 1 || points[0].ActiveUsers != 1 {
+		t.Errorf("bad counters of the other service: %+v", points[0].Counters)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	store := NewMemoryStore()
+	rec := NewRecorder(store, time.Hour)
+	defer rec.Stop()
+	from := time.Date(2026, 3, 1, 22, 30, 0, 0, time.UTC)
+	store.Add("service", Period(from, RESOLUTION_HOUR), &Counters{Messages: 1}, nil)
+	store.Add("service", Period(from.Add(2*time.Hour), RESOLUTION_HOUR), &Counters{Messages: 3}, nil)
+	points, err := rec.Query("service", from, from.Add(2*time.Hour), RESOLUTION_HOUR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 3 || points[0].Messages != 1 || points[1].Messages != 0 || points[2].Messages != 3 || points[2].Start.Day() != 2 {
+		t.Errorf("bad points: %+v", points)
+	}
+	if _, err = rec.Query("service", from, from.AddDate(1, 0, 0), RESOLUTION_HOUR); err != ErrTooManyPoints {
+		t.Errorf("should limit the points: %v", err)
+	}
+	if _, err = rec.Query("service", from, from, "week"); err != ErrBadResolution {
+		t.Errorf("should reject the resolution: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package analytics
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/redispool"
+	"time"
+)
+
+// The counters of an hour are kept for a week and a day, and the ones
+// of a day for a bit more than a year.
+const (
+	hourRetention = 8 * 24 * time.Hour
+	dayRetention  = 400 * 24 * time.Hour
+)
+
+type redisStore struct {
+	pool *redis.Pool
+}
+
+// NewRedisStore keeps the counters of each period in a redis hash,
+// and its active users in a HyperLogLog, so that their number is an
+// estimate, within about 1%.
+func NewRedisStore(addr, password string, db int) Store {
+	pool := redispool.New(addr, password, db)
+
+	ret := new(redisStore)
+	ret.pool = pool
+	return ret
+}
+
+func redisCountersKey(service, period string) string {
+	return fmt.Sprintf("analytics:%v:%v", service, period)
+}
+
+func redisUsersKey(service, period string) string {
+	return fmt.Sprintf("analytics:%v:%v:users", service, period)
+}
+
+func retention(period string) time.Duration {
+	if len(period) > len("20060102") {
+		return hourRetention
+	}
+	return dayRetention
+}
+
+func (self *redisStore) Add(service, period string, delta *Counters, users []string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	key := redisCountersKey(service, period)
+	usersKey := redisUsersKey(service, period)
+	ttl := int64(retention(period) / time.Second)
+	conn.Send("MULTI")
+	conn.Send("HINCRBY", key, "messages", delta.Messages)
+	conn.Send("HINCRBY", key, "digests", delta.Digests)
+	conn.Send("HINCRBY", key, "retrievals", delta.Retrievals)
+	conn.Send("HINCRBY", key, "bytes", delta.Bytes)
+	conn.Send("EXPIRE", key, ttl)
+	if len(users) > 0 {
+		args := make([]interface{}, 0, len(users)+1)
+		args = append(args, usersKey)
+		for _, u := range users {
+			args = append(args, u)
+		}
+		conn.Send("PFADD", args...)
+		conn.Send("EXPIRE", usersKey, ttl)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (self *redisStore) Counters(service, period string) (c *Counters, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("HMGET", redisCountersKey(service, period), "messages", "digests", "retrievals", "bytes")
+	conn.Send("PFCOUNT", redisUsersKey(service, period))
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return
+	}
+	if len(reply) < 2 {
+		err = fmt.Errorf("bad reply from redis")
+		return
+	}
+	fields, err := redis.Values(reply[0], nil)
+	if err != nil {
+		return
+	}
+	c = new(Counters)
+	for i, dst := range []*int64{&c.Messages, &c.Digests, &c.Retrievals, &c.Bytes} {
+		if i >= len(fields) || fields[i] == nil {
+			continue
+		}
+		*dst, err = redis.Int64(fields[i], nil)
+		if err != nil {
+			c = nil
+			return
+		}
+	}
+	c.ActiveUsers, err = redis.Int64(reply[1], nil)
+	if err != nil {
+		c = nil
+	}
+	return
+}
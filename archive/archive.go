@@ -0,0 +1,285 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package archive streams a copy of the messages delivered to the
+// users of some services to an external sink, e.g. an object storage
+// or a Kafka topic, for retention.
+package archive
+
+import (
+	"github.com/uniqush/uniqush-conn/backoff"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/proto"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Record is an archived message.
+type Record struct {
+	// Time is when the message was delivered, in nanoseconds since the epoch.
+	Time      int64  `json:"time"`
+	Service   string `json:"service"`
+	Username  string `json:"username"`
+	MessageId string `json:"msgId,omitempty"`
+
+	// Only set if the message is from a user.
+	Sender        string `json:"sender,omitempty"`
+	SenderService string `json:"senderService,omitempty"`
+
+	Msg *proto.Message `json:"msg"`
+}
+
+// Sink stores the archived messages.
+type Sink interface {
+	// Write stores a batch of records. It is retried if it fails.
+	Write(records []*Record) error
+}
+
+const (
+	defaultBatchSize     = 256
+	defaultFlushInterval = 5 * time.Second
+	defaultQueueSize     = 64 * 1024
+	listenQueueSize      = 4096
+)
+
+// Archiver writes the messages delivered by a message center to a
+// sink, in batches. It never slows the delivery down: the messages
+// are queued, and dropped once the queue is full, e.g. when the sink
+// is down. Dropped() tells how many are lost.
+type Archiver struct {
+	sink          Sink
+	services      map[string]bool
+	batchSize     int
+	flushInterval time.Duration
+	queueSize     int
+	retries       int
+	backoff       time.Duration
+	logger        logger.Logger
+
+	dropped  uint64
+	queue    chan *msgcenter.Event
+	stop     chan bool
+	stopped  chan bool
+	stopOnce sync.Once
+}
+
+// NewArchiver archives the messages delivered to the users of the
+// services, or of all services if none is given.
+func NewArchiver(sink Sink, services ...string) *Archiver {
+	ret := new(Archiver)
+	ret.sink = sink
+	ret.services = make(map[string]bool, len(services))
+	for _, s := range services {
+		ret.services[s] = true
+	}
+	ret.batchSize = defaultBatchSize
+	ret.flushInterval = defaultFlushInterval
+	ret.queueSize = defaultQueueSize
+	ret.retries = 3
+	ret.backoff = time.Second
+	ret.logger = logger.Nop()
+	ret.stop = make(chan bool)
+	ret.stopped = make(chan bool)
+	return ret
+}
+
+// SetBatch sets the largest batch written at once, and how long a
+// message may wait for its batch to fill. It should be called before
+// Listen.
+func (self *Archiver) SetBatch(size int, interval time.Duration) {
+	if size > 0 {
+		self.batchSize = size
+	}
+	if interval > 0 {
+		self.flushInterval = interval
+	}
+}
+
+// SetQueueSize sets the number of messages waiting to be written,
+// beyond which they are dropped. It should be called before Listen.
+func (self *Archiver) SetQueueSize(n int) {
+	if n > 0 {
+		self.queueSize = n
+	}
+}
+
+// SetRetries sets how many times a batch which cannot be written is
+// tried again before it is dropped, and the wait before the first try.
+func (self *Archiver) SetRetries(retries int, backoff time.Duration) {
+	self.retries = retries
+	self.backoff = backoff
+}
+
+func (self *Archiver) SetLogger(l logger.Logger) {
+	self.logger = logger.OrNop(l).With("archiver", "")
+}
+
+// Dropped returns the number of messages which could not be archived.
+func (self *Archiver) Dropped() uint64 {
+	return atomic.LoadUint64(&self.dropped)
+}
+
+func (self *Archiver) drop(n int) {
+	atomic.AddUint64(&self.dropped, uint64(n))
+}
+
+func (self *Archiver) Sink() Sink {
+	return self.sink
+}
+
+// Archives tells if the messages of the service are archived.
+func (self *Archiver) Archives(service string) bool {
+	return len(self.services) == 0 || self.services[service]
+}
+
+func (self *Archiver) accepts(evt *msgcenter.Event) bool {
+	if evt.Type != msgcenter.EVENT_DELIVER || evt.Message == nil {
+		return false
+	}
+	return self.Archives(evt.Service)
+}
+
+// Listen archives the messages of the source until Stop() is called.
+func (self *Archiver) Listen(source msgcenter.EventSource) {
+	// The message center drops the events the queue has no room for,
+	// so it is large enough to absorb a burst between two reads.
+	self.queue = make(chan *msgcenter.Event, listenQueueSize)
+	source.Listen(self.queue)
+	go func() {
+		defer close(self.stopped)
+		defer source.Unlisten(self.queue)
+		self.run()
+	}()
+}
+
+// Stop writes the queued messages, and returns once they are written
+// or dropped.
+func (self *Archiver) Stop() {
+	self.stopOnce.Do(func() {
+		close(self.stop)
+	})
+	if self.queue != nil {
+		<-self.stopped
+	}
+}
+
+func (self *Archiver) run() {
+	var pending []*Record
+	writing := false
+	written := make(chan bool)
+	flush := func() {
+		if writing || len(pending) == 0 {
+			return
+		}
+		n := len(pending)
+		if n > self.batchSize {
+			n = self.batchSize
+		}
+		batch := pending[:n:n]
+		pending = pending[n:]
+		writing = true
+		go func() {
+			self.write(batch)
+			written <- true
+		}()
+	}
+	add := func(evt *msgcenter.Event) {
+		if !self.accepts(evt) {
+			return
+		}
+		if len(pending) >= self.queueSize {
+			self.drop(1)
+			return
+		}
+		pending = append(pending, &Record{
+			Time:          time.Now().UnixNano(),
+			Service:       evt.Service,
+			Username:      evt.Username,
+			MessageId:     evt.MessageId,
+			Sender:        evt.Sender,
+			SenderService: evt.SenderService,
+			Msg:           evt.Message,
+		})
+	}
+	ticker := time.NewTicker(self.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case evt := <-self.queue:
+			add(evt)
+			if len(pending) >= self.batchSize {
+				flush()
+			}
+		case <-written:
+			writing = false
+			if len(pending) >= self.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-self.stop:
+			for drained := false; !drained; {
+				select {
+				case evt := <-self.queue:
+					add(evt)
+				default:
+					drained = true
+				}
+			}
+			if writing {
+				<-written
+			}
+			for len(pending) > 0 {
+				n := len(pending)
+				if n > self.batchSize {
+					n = self.batchSize
+				}
+				self.write(pending[:n])
+				pending = pending[n:]
+			}
+			return
+		}
+	}
+}
+
+// write retries a failed write, and drops the batch if it keeps failing.
+func (self *Archiver) write(batch []*Record) {
+	wait := self.backoff
+	for i := 0; ; i++ {
+		err := self.sink.Write(batch)
+		if err == nil {
+			return
+		}
+		if i >= self.retries {
+			self.logger.Warn("cannot archive messages", "nrMessages", len(batch), "err", err)
+			self.drop(len(batch))
+			return
+		}
+		select {
+		case <-time.After(wait):
+		case <-self.stop:
+			// Try once more before giving up.
+			if self.sink.Write(batch) != nil {
+				self.drop(len(batch))
+			}
+			return
+		}
+		wait = backoff.Next(wait)
+	}
+}
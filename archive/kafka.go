@@ -0,0 +1,44 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package archive
+
+import (
+	"github.com/uniqush/uniqush-conn/kafkarest"
+	"net/http"
+)
+
+// KafkaRestSink produces every record to a Kafka topic through a
+// Kafka REST proxy (API v2). The key of a record is the service and
+// the username, separated by ':', so that the messages of a user stay
+// in order within a partition.
+type KafkaRestSink struct {
+	// URL of the REST proxy, e.g. "http://localhost:8082".
+	URL   string
+	Topic string
+
+	// Client defaults to kafkarest.DefaultClient.
+	Client *http.Client
+}
+
+func (self *KafkaRestSink) Write(records []*Record) error {
+	recs := make([]*kafkarest.Record, len(records))
+	for i, r := range records {
+		recs[i] = &kafkarest.Record{Key: r.Service + ":" + r.Username, Value: r}
+	}
+	return kafkarest.Produce(self.Client, self.URL, self.Topic, recs)
+}
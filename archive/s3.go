@@ -0,0 +1,185 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package archive
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Sink writes every batch as an object of JSON lines, one record per
+// line, to a bucket of an S3-compatible object storage. The name of
+// the object is the prefix, the UTC date and hour of the batch
+// ("2006/01/02/15/"), and a unique name.
+type S3Sink struct {
+	// Endpoint is the URL of the storage, e.g. "https://s3.amazonaws.com".
+	// The bucket is addressed by path.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+
+	// Client defaults to an http.Client timing out after 30 seconds.
+	Client *http.Client
+}
+
+var defaultS3Client = &http.Client{Timeout: 30 * time.Second}
+
+const maxReplySize = 4096
+
+func (self *S3Sink) objectName(now time.Time) string {
+	var id [8]byte
+	io.ReadFull(rand.Reader, id[:])
+	return fmt.Sprintf("%v%v%v-%x.json", self.Prefix, now.Format("2006/01/02/15/"),
+		now.Format("20060102T150405Z"), id[:])
+}
+
+func (self *S3Sink) Write(records []*Record) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UTC()
+	u, err := url.Parse(strings.TrimRight(self.Endpoint, "/") + "/" +
+		self.Bucket + "/" + self.objectName(now))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	signV4(req, body.Bytes(), self.Region, self.AccessKey, self.SecretKey, now)
+	client := self.Client
+	if client == nil {
+		client = defaultS3Client
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxReplySize))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("s3: %v", resp.Status)
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// signV4 signs req with the AWS signature version 4, which most
+// S3-compatible storages accept.
+func signV4(req *http.Request, body []byte, region, accessKey, secretKey string, now time.Time) {
+	date := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k != "authorization" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k, _ := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders bytes.Buffer
+	for _, k := range names {
+		fmt.Fprintf(&canonHeaders, "%v:%v\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+	canonReq := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" +
+		sha256Hex([]byte(canonReq))
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		accessKey, scope, signedHeaders, sig))
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k, _ := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, queryEscape(k)+"="+queryEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func queryEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package asset keeps the configuration assets pushed to the clients,
+// like feature flags, emoji packs or routing tables, along with the
+// versions applied by each device of the users.
+package asset
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxSize is the largest content of an asset. The assets are sent
+// whole to every connected client, they are meant to be small.
+const MaxSize = 64 * 1024
+
+var ErrTooLarge = errors.New("asset too large")
+var ErrNoName = errors.New("asset without name")
+
+// Asset is a version of a named blob.
+type Asset struct {
+	Name        string    `json:"name"`
+	Version     uint64    `json:"version"`
+	Data        []byte    `json:"data"`
+	PublishedAt time.Time `json:"publishedAt"`
+}
+
+// Store keeps the latest version of every asset of a service. The
+// first version of an asset is 1, and every Publish adds one.
+type Store interface {
+	// Publish replaces the content of the asset with a new version.
+	Publish(service, name string, data []byte) (a *Asset, err error)
+
+	// Get returns nil if there is no such asset.
+	Get(service, name string) (a *Asset, err error)
+
+	// Latest returns the latest version of every asset of the
+	// service, ordered by name.
+	Latest(service string) (assets []*Asset, err error)
+
+	// Versions returns the number of the latest version of every
+	// asset of the service, by name, without their contents.
+	Versions(service string) (versions map[string]uint64, err error)
+
+	// SetApplied records that the device of the user has applied the
+	// version of the asset. An older version than the recorded one
+	// changes nothing.
+	SetApplied(service, username, device, name string, version uint64) error
+
+	// Applied returns the latest versions applied by the devices of
+	// the user, by device and then by name.
+	Applied(service, username string) (versions map[string]map[string]uint64, err error)
+}
+
+func checkAsset(name string, data []byte) error {
+	if len(name) == 0 {
+		return ErrNoName
+	}
+	if len(data) > MaxSize {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+type memStore struct {
+	lock    sync.Mutex
+	assets  map[string]map[string]*Asset
+	applied map[string]map[string]map[string]uint64
+}
+
+// NewMemoryStore returns a Store which keeps the assets and the
+// applied versions in memory, where they are lost on restart. The
+// other nodes of a cluster do not see the assets it publishes.
+func NewMemoryStore() Store {
+	ret := new(memStore)
+	ret.assets = make(map[string]map[string]*Asset, 4)
+	ret.applied = make(map[string]map[string]map[string]uint64, 100)
+	return ret
+}
+
+func userKey(service, username string) string {
+	return service + "\n" + username
+}
+
+func (self *memStore) Publish(service, name string, data []byte) (a *Asset, err error) {
+	err = checkAsset(name, data)
+	if err != nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	assets, ok := self.assets[service]
+	if !ok {
+		assets = make(map[string]*Asset, 4)
+		self.assets[service] = assets
+	}
+	a = &Asset{
+		Name:        name,
+		Data:        append([]byte(nil), data...),
+		PublishedAt: time.Now(),
+	}
+	if last, ok := assets[name]; ok {
+		a.Version = last.Version
+	}
+	a.Version++
+	assets[name] = a
+	return
+}
+
+func (self *memStore) Get(service, name string) (a *Asset, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	a = self.assets[service][name]
+	return
+}
+
+func (self *memStore) Latest(service string) (assets []*Asset, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, a := range self.assets[service] {
+		assets = append(assets, a)
+	}
+	sort.Sort(byName(assets))
+	return
+}
+
+func (self *memStore) Versions(service string) (versions map[string]uint64, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	versions = make(map[string]uint64, len(self.assets[service]))
+	for name, a := range self.assets[service] {
+		versions[name] = a.Version
+	}
+	return
+}
+
+func (self *memStore) SetApplied(service, username, device, name string, version uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	k := userKey(service, username)
+	devices, ok := self.applied[k]
+	if !ok {
+		devices = make(map[string]map[string]uint64, 2)
+		self.applied[k] = devices
+	}
+	versions, ok := devices[device]
+	if !ok {
+		versions = make(map[string]uint64, 4)
+		devices[device] = versions
+	}
+	if versions[name] < version {
+		versions[name] = version
+	}
+	return nil
+}
+
+func (self *memStore) Applied(service, username string) (versions map[string]map[string]uint64, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	devices := self.applied[userKey(service, username)]
+	versions = make(map[string]map[string]uint64, len(devices))
+	for device, applied := range devices {
+		versions[device] = make(map[string]uint64, len(applied))
+		for name, v := range applied {
+			versions[device][name] = v
+		}
+	}
+	return
+}
+
+type byName []*Asset
+
+func (self byName) Len() int           { return len(self) }
+func (self byName) Less(i, j int) bool { return self[i].Name < self[j].Name }
+func (self byName) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package asset
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+func getRedisStore() Store {
+	db := 6
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	c.Do("SELECT", db)
+	c.Do("FLUSHDB")
+	c.Close()
+	return NewRedisStore("", "", db)
+}
+
+func testPublish(store Store, t *testing.T, name, data string, version uint64) {
+	a, err := store.Publish("srv", name, []byte(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if a.Name != name || a.Version != version || string(a.Data) != data {
+		t.Errorf("bad asset: %+v", a)
+	}
+}
+
+func testStore(store Store, t *testing.T) {
+	if a, err := store.Get("srv", "flags"); a != nil || err != nil {
+		t.Errorf("should be no asset: %+v %v", a, err)
+	}
+	testPublish(store, t, "flags", `{"dark":false}`, 1)
+	testPublish(store, t, "flags", `{"dark":true}`, 2)
+	testPublish(store, t, "emoji", "pack", 1)
+	if _, err := store.Publish("srv", "", nil); err != ErrNoName {
+		t.Errorf("should be rejected: %v", err)
+	}
+	if _, err := store.Publish("srv", "big", make([]byte, MaxSize+1)); err != ErrTooLarge {
+		t.Errorf("should be rejected: %v", err)
+	}
+
+	a, err := store.Get("srv", "flags")
+	if err != nil || a == nil || a.Version != 2 || string(a.Data) != `{"dark":true}` {
+		t.Errorf("bad asset: %+v %v", a, err)
+	}
+	assets, err := store.Latest("srv")
+	if err != nil || len(assets) != 2 {
+		t.Fatalf("bad assets: %v %v", assets, err)
+	}
+	if assets[0].Name != "emoji" || assets[1].Name != "flags" || assets[1].Version != 2 {
+		t.Errorf("bad order: %+v %+v", assets[0], assets[1])
+	}
+	if versions, err := store.Versions("srv"); err != nil || len(versions) != 2 || versions["flags"] != 2 || versions["emoji"] != 1 {
+		t.Errorf("bad versions: %v %v", versions, err)
+	}
+	if assets, _ := store.Latest("other"); len(assets) != 0 {
+		t.Errorf("other service has assets: %v", assets)
+	}
+
+	store.SetApplied("srv", "alice", "phone", "flags", 2)
+	// An older client changes nothing.
+	store.SetApplied("srv", "alice", "phone", "flags", 1)
+	store.SetApplied("srv", "alice", "phone", "emoji", 1)
+	// Another device of the user has not caught up.
+	store.SetApplied("srv", "alice", "tablet", "flags", 1)
+	versions, err := store.Applied("srv", "alice")
+	if err != nil || len(versions) != 2 || len(versions["phone"]) != 2 ||
+		versions["phone"]["flags"] != 2 || versions["phone"]["emoji"] != 1 || versions["tablet"]["flags"] != 1 {
+		t.Errorf("bad applied versions: %v %v", versions, err)
+	}
+	if versions, _ := store.Applied("srv", "bob"); len(versions) != 0 {
+		t.Errorf("bob applied: %v", versions)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(NewMemoryStore(), t)
+}
+
+func TestRedisStore(t *testing.T) {
+	testStore(getRedisStore(), t)
+}
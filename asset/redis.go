@@ -0,0 +1,222 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package asset
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/redispool"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The versions applied by the devices of a user are forgotten once
+// none of them has applied any for appliedTTL, e.g. the ones of the
+// connections of clients without a device id.
+const appliedTTL = 30 * 24 * time.Hour
+
+type redisStore struct {
+	pool *redis.Pool
+}
+
+// NewRedisStore keeps the versions of each asset in a redis sorted
+// set scored by version, so that concurrent publishers never replace
+// a newer version with an older one. The older versions are trimmed
+// once a newer one is added.
+func NewRedisStore(addr, password string, db int) Store {
+	pool := redispool.New(addr, password, db)
+
+	ret := new(redisStore)
+	ret.pool = pool
+	return ret
+}
+
+func namesKey(service string) string {
+	return fmt.Sprintf("assets:%v", service)
+}
+
+func versionKey(service string) string {
+	return fmt.Sprintf("asset-versions:%v", service)
+}
+
+func assetKey(service, name string) string {
+	return fmt.Sprintf("asset:%v:%v", service, name)
+}
+
+func appliedKey(service, username string) string {
+	return fmt.Sprintf("asset-applied:%v:%v", service, username)
+}
+
+func (self *redisStore) Publish(service, name string, data []byte) (a *Asset, err error) {
+	err = checkAsset(name, data)
+	if err != nil {
+		return
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+	v, err := redis.Uint64(conn.Do("HINCRBY", versionKey(service), name, 1))
+	if err != nil {
+		return
+	}
+	a = &Asset{
+		Name:        name,
+		Version:     v,
+		Data:        append([]byte(nil), data...),
+		PublishedAt: time.Now(),
+	}
+	value, err := json.Marshal(a)
+	if err != nil {
+		a = nil
+		return
+	}
+	key := assetKey(service, name)
+	conn.Send("MULTI")
+	conn.Send("ZADD", key, v, value)
+	conn.Send("ZREMRANGEBYSCORE", key, "-inf", v-1)
+	conn.Send("SADD", namesKey(service), name)
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		a = nil
+	}
+	return
+}
+
+func (self *redisStore) get(conn redis.Conn, service, name string) (a *Asset, err error) {
+	values, err := redis.Values(conn.Do("ZREVRANGEBYSCORE", assetKey(service, name), "+inf", "-inf", "LIMIT", 0, 1))
+	if err != nil || len(values) == 0 {
+		return
+	}
+	data, err := redis.Bytes(values[0], nil)
+	if err != nil {
+		return
+	}
+	a = new(Asset)
+	err = json.Unmarshal(data, a)
+	if err != nil {
+		a = nil
+	}
+	return
+}
+
+func (self *redisStore) Get(service, name string) (a *Asset, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	return self.get(conn, service, name)
+}
+
+func (self *redisStore) Latest(service string) (assets []*Asset, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	names, err := redis.Strings(conn.Do("SMEMBERS", namesKey(service)))
+	if err != nil {
+		return
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var a *Asset
+		a, err = self.get(conn, service, name)
+		if err != nil {
+			assets = nil
+			return
+		}
+		if a != nil {
+			assets = append(assets, a)
+		}
+	}
+	return
+}
+
+func (self *redisStore) Versions(service string) (versions map[string]uint64, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	return hashOfVersions(conn.Do("HGETALL", versionKey(service)))
+}
+
+// The field of a version applied by a device in appliedKey.
+func appliedField(device, name string) string {
+	return device + "\n" + name
+}
+
+func (self *redisStore) SetApplied(service, username, device, name string, version uint64) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	key := appliedKey(service, username)
+	field := appliedField(device, name)
+	last, err := redis.Uint64(conn.Do("HGET", key, field))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if last >= version {
+		return nil
+	}
+	conn.Send("MULTI")
+	conn.Send("HSET", key, field, version)
+	conn.Send("PEXPIRE", key, int64(appliedTTL/time.Millisecond))
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (self *redisStore) Applied(service, username string) (versions map[string]map[string]uint64, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	fields, err := hashOfVersions(conn.Do("HGETALL", appliedKey(service, username)))
+	if err != nil {
+		return
+	}
+	versions = make(map[string]map[string]uint64, 2)
+	for field, v := range fields {
+		i := strings.Index(field, "\n")
+		if i < 0 {
+			continue
+		}
+		device, name := field[:i], field[i+1:]
+		if versions[device] == nil {
+			versions[device] = make(map[string]uint64, 4)
+		}
+		versions[device][name] = v
+	}
+	return
+}
+
+// hashOfVersions reads the reply of HGETALL on a hash of versions.
+func hashOfVersions(r interface{}, err error) (versions map[string]uint64, e error) {
+	reply, err := redis.Values(r, err)
+	if err != nil {
+		e = err
+		return
+	}
+	versions = make(map[string]uint64, len(reply)/2)
+	for i := 0; i+1 < len(reply); i += 2 {
+		name, err := redis.String(reply[i], nil)
+		if err != nil {
+			e = err
+			versions = nil
+			return
+		}
+		v, err := redis.Uint64(reply[i+1], nil)
+		if err != nil {
+			e = err
+			versions = nil
+			return
+		}
+		versions[name] = v
+	}
+	return
+}
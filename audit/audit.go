@@ -0,0 +1,191 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package audit keeps a trail of the forward requests: who sent how
+// many bytes to whom, when, and what became of the request, so that
+// the abuse of the user-to-user messages can be investigated.
+package audit
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrBadDirection = errors.New("the direction should be sent or received")
+var ErrBadQuery = errors.New("the query should have a service and a username")
+
+// Record is a forward request.
+type Record struct {
+	Time            time.Time `json:"time"`
+	Sender          string    `json:"sender"`
+	SenderService   string    `json:"senderService"`
+	Receiver        string    `json:"receiver"`
+	ReceiverService string    `json:"receiverService"`
+
+	// Size is the size of the message in bytes.
+	Size int `json:"size"`
+
+	// Status is the result of the request, one of proto.FWD_*.
+	// A shadow-dropped request is "ok", as its sender is told.
+	Status    string `json:"status"`
+	MessageId string `json:"msgId,omitempty"`
+
+	// Verdict is the action of the abuse scorer, if the request
+	// has been scored. A scored request is recorded once scored.
+	Verdict string `json:"verdict,omitempty"`
+}
+
+const (
+	DIRECTION_SENT     = "sent"
+	DIRECTION_RECEIVED = "received"
+)
+
+const (
+	DEFAULT_LIMIT = 100
+	MAX_LIMIT     = 1000
+)
+
+// DefaultRetention is how long the records are kept if the store is
+// not told otherwise.
+const DefaultRetention = 30 * 24 * time.Hour
+
+// Query selects the records of the requests sent, or received, by a
+// user between From and To.
+type Query struct {
+	Service  string
+	Username string
+
+	// Direction is DIRECTION_SENT, or DIRECTION_RECEIVED if empty.
+	Direction string
+
+	// To is now if it is zero.
+	From time.Time
+	To   time.Time
+
+	// Limit is the number of records returned, the most recent
+	// first. It is DEFAULT_LIMIT if not set, and at most MAX_LIMIT.
+	Limit int
+}
+
+// normalize checks the query and fills its defaults.
+func (self *Query) normalize() (q *Query, err error) {
+	if len(self.Service) == 0 || len(self.Username) == 0 {
+		err = ErrBadQuery
+		return
+	}
+	ret := *self
+	switch ret.Direction {
+	case "":
+		ret.Direction = DIRECTION_RECEIVED
+	case DIRECTION_SENT, DIRECTION_RECEIVED:
+	default:
+		err = ErrBadDirection
+		return
+	}
+	if ret.To.IsZero() {
+		ret.To = time.Now()
+	}
+	if ret.Limit <= 0 {
+		ret.Limit = DEFAULT_LIMIT
+	} else if ret.Limit > MAX_LIMIT {
+		ret.Limit = MAX_LIMIT
+	}
+	q = &ret
+	return
+}
+
+// Store keeps the records for its retention. Every record can be
+// found both in the requests sent by the sender and in the ones
+// received by the receiver.
+type Store interface {
+	Record(rec *Record) error
+	Query(q *Query) (records []*Record, err error)
+}
+
+type memStore struct {
+	lock      sync.Mutex
+	retention time.Duration
+
+	// Ordered by time.
+	records map[string][]*Record
+}
+
+// NewMemoryStore returns a Store which keeps the records of the
+// requests received by this node in memory for retention, or
+// DefaultRetention if it is zero.
+func NewMemoryStore(retention time.Duration) Store {
+	ret := new(memStore)
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	ret.retention = retention
+	ret.records = make(map[string][]*Record, 100)
+	return ret
+}
+
+func userKey(direction, service, username string) string {
+	return direction + "\n" + service + "\n" + username
+}
+
+// add should be called with the lock held.
+func (self *memStore) add(key string, rec *Record, expiry time.Time) {
+	records := self.records[key]
+	i := 0
+	for i < len(records) && records[i].Time.Before(expiry) {
+		i++
+	}
+	records = append(records[i:], rec)
+	// Keep the records in order if they are recorded out of order.
+	for j := len(records) - 1; j > 0 && records[j].Time.Before(records[j-1].Time); j-- {
+		records[j], records[j-1] = records[j-1], records[j]
+	}
+	self.records[key] = records
+}
+
+func (self *memStore) Record(rec *Record) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	expiry := time.Now().Add(-self.retention)
+	self.add(userKey(DIRECTION_SENT, rec.SenderService, rec.Sender), rec, expiry)
+	self.add(userKey(DIRECTION_RECEIVED, rec.ReceiverService, rec.Receiver), rec, expiry)
+	return nil
+}
+
+func (self *memStore) Query(q *Query) (records []*Record, err error) {
+	q, err = q.normalize()
+	if err != nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	expiry := time.Now().Add(-self.retention)
+	all := self.records[userKey(q.Direction, q.Service, q.Username)]
+	records = make([]*Record, 0, q.Limit)
+	for i := len(all) - 1; i >= 0 && len(records) < q.Limit; i-- {
+		t := all[i].Time
+		if t.Before(q.From) || t.Before(expiry) {
+			break
+		}
+		if t.After(q.To) {
+			continue
+		}
+		rec := *all[i]
+		records = append(records, &rec)
+	}
+	return
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package audit
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+	"time"
+)
+
+func getRedisStore(retention time.Duration) Store {
+	db := 10
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	c.Do("SELECT", db)
+	c.Do("FLUSHDB")
+	c.Close()
+	return NewRedisStore("", "", db, retention)
+}
+
+func record(sender, receiver string, t time.Time) *Record {
+	return &Record{
+		Time:            t,
+		Sender:          sender,
+		SenderService:   "srv",
+		Receiver:        receiver,
+		ReceiverService: "srv",
+		Size:            100,
+		Status:          "ok",
+	}
+}
+
+func testStore(store Store, t *testing.T) {
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := store.Record(record("alice", "bob", now.Add(time.Duration(i-5)*time.Minute))); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	store.Record(record("bob", "alice", now.Add(-30*time.Second)))
+
+	records, err := store.Query(&Query{Service: "srv", Username: "alice", Direction: DIRECTION_SENT})
+	if err != nil || len(records) != 5 {
+		t.Fatalf("bad records sent by alice: %v %v", records, err)
+	}
+	if !records[0].Time.After(records[1].Time) || records[0].Receiver != "bob" || records[0].Size != 100 {
+		t.Errorf("the most recent record should be first: %+v", records[0])
+	}
+	records, err = store.Query(&Query{Service: "srv", Username: "bob"})
+	if err != nil || len(records) != 5 || records[0].Sender != "alice" {
+		t.Errorf("bad records received by bob: %v %v", records, err)
+	}
+	records, err = store.Query(&Query{Service: "srv", Username: "alice"})
+	if err != nil || len(records) != 1 || records[0].Sender != "bob" {
+		t.Errorf("bad records received by alice: %v %v", records, err)
+	}
+
+	q := &Query{Service: "srv", Username: "alice", Direction: DIRECTION_SENT, From: now.Add(-4*time.Minute - time.Second), To: now.Add(-2*time.Minute + time.Second)}
+	if records, err = store.Query(q); err != nil || len(records) != 3 {
+		t.Errorf("bad records in the range: %v %v", records, err)
+	}
+	q.Limit = 2
+	if records, err = store.Query(q); err != nil || len(records) != 2 || records[1].Time.Before(now.Add(-3*time.Minute-time.Second)) {
+		t.Errorf("bad limited records: %v %v", records, err)
+	}
+
+	if _, err = store.Query(&Query{Service: "srv", Username: "alice", Direction: "both"}); err != ErrBadDirection {
+		t.Errorf("should reject a bad direction: %v", err)
+	}
+	if _, err = store.Query(&Query{Service: "srv"}); err != ErrBadQuery {
+		t.Errorf("should reject a query without username: %v", err)
+	}
+}
+
+func testRetention(store Store, t *testing.T) {
+	now := time.Now()
+	store.Record(record("alice", "bob", now.Add(-2*time.Hour)))
+	store.Record(record("alice", "bob", now))
+	records, err := store.Query(&Query{Service: "srv", Username: "alice", Direction: DIRECTION_SENT})
+	if err != nil || len(records) != 1 {
+		t.Errorf("the old record should be dropped: %v %v", records, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(NewMemoryStore(0), t)
+}
+
+func TestRedisStore(t *testing.T) {
+	testStore(getRedisStore(0), t)
+}
+
+func TestMemoryStoreRetention(t *testing.T) {
+	testRetention(NewMemoryStore(time.Hour), t)
+}
+
+func TestRedisStoreRetention(t *testing.T) {
+	testRetention(getRedisStore(time.Hour), t)
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/redispool"
+	"time"
+)
+
+type redisStore struct {
+	pool      *redis.Pool
+	retention time.Duration
+}
+
+// NewRedisStore keeps the records of each user in a sorted set by
+// time, for retention, or DefaultRetention if it is zero.
+func NewRedisStore(addr, password string, db int, retention time.Duration) Store {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+
+	pool := redispool.New(addr, password, db)
+
+	ret := new(redisStore)
+	ret.pool = pool
+	ret.retention = retention
+	return ret
+}
+
+func auditKey(direction, service, username string) string {
+	return fmt.Sprintf("audit:%v:%v:%v", direction, service, username)
+}
+
+// score is in microseconds, which a float64 holds exactly.
+func score(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+func (self *redisStore) Record(rec *Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+	expiry := score(time.Now().Add(-self.retention))
+	ms := int64(self.retention / time.Millisecond)
+	keys := []string{
+		auditKey(DIRECTION_SENT, rec.SenderService, rec.Sender),
+		auditKey(DIRECTION_RECEIVED, rec.ReceiverService, rec.Receiver),
+	}
+	conn.Send("MULTI")
+	for _, key := range keys {
+		conn.Send("ZADD", key, score(rec.Time), data)
+		conn.Send("ZREMRANGEBYSCORE", key, "-inf", fmt.Sprintf("(%v", expiry))
+		// The records of an inactive user expire with the last one.
+		conn.Send("PEXPIRE", key, ms)
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (self *redisStore) Query(q *Query) (records []*Record, err error) {
+	q, err = q.normalize()
+	if err != nil {
+		return
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+	from := score(q.From)
+	if expiry := score(time.Now().Add(-self.retention)); from < expiry {
+		from = expiry
+	}
+	reply, err := redis.Values(conn.Do("ZREVRANGEBYSCORE", auditKey(q.Direction, q.Service, q.Username),
+		score(q.To), from, "LIMIT", 0, q.Limit))
+	if err != nil {
+		return
+	}
+	records = make([]*Record, 0, len(reply))
+	for _, r := range reply {
+		var data []byte
+		data, err = redis.Bytes(r, nil)
+		if err != nil {
+			return
+		}
+		rec := new(Record)
+		err = json.Unmarshal(data, rec)
+		if err != nil {
+			return
+		}
+		records = append(records, rec)
+	}
+	return
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package backoff computes the waits between the retries of the writes
+// to a backend, like a web hook or a Kafka REST proxy, which keep
+// failing. The wait is doubled after every retry, up to Max.
+package backoff
+
+import (
+	"time"
+)
+
+// Max is the longest wait between two retries.
+const Max = time.Minute
+
+// Next returns the wait after d.
+func Next(d time.Duration) time.Duration {
+	d *= 2
+	if d > Max || d <= 0 {
+		d = Max
+	}
+	return d
+}
+
+// Nth returns the wait before the nth retry, given the wait before the
+// first one.
+func Nth(first time.Duration, n int) time.Duration {
+	d := first
+	for i := 1; i < n && d < Max; i++ {
+		d *= 2
+	}
+	if d > Max {
+		d = Max
+	}
+	return d
+}
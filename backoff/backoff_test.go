@@ -0,0 +1,40 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	if d := Next(time.Second); d != 2*time.Second {
+		t.Errorf("bad wait: %v", d)
+	}
+	if d := Next(40 * time.Second); d != Max {
+		t.Errorf("bad wait: %v", d)
+	}
+	for n, expected := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second} {
+		if d := Nth(time.Second, n); d != expected {
+			t.Errorf("bad wait before retry %v: %v", n, d)
+		}
+	}
+	if d := Nth(time.Second, 100); d != Max {
+		t.Errorf("bad wait: %v", d)
+	}
+}
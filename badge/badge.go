@@ -0,0 +1,110 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package badge counts the unread messages of every user, so that the
+// apps could show the badges without counting the cached messages.
+package badge
+
+import (
+	"sync"
+	"time"
+)
+
+// Store keeps the ids of the unread messages of each user until they
+// are read or expire. Counting a message twice, or removing it twice,
+// changes nothing.
+type Store interface {
+	// Add counts the message as unread until expiresAt, and returns
+	// the number of unread messages then, as Count does. A zero
+	// expiresAt never expires.
+	Add(service, username, id string, expiresAt time.Time) (n int, err error)
+
+	// Remove stops counting the message, e.g. once it is acked, read
+	// or deleted.
+	Remove(service, username, id string) error
+
+	// Count returns the number of unread messages which have not
+	// expired.
+	Count(service, username string) (n int, err error)
+}
+
+type memStore struct {
+	lock  sync.Mutex
+	users map[string]map[string]time.Time
+}
+
+// NewMemoryStore returns a Store which counts the unread messages of
+// the users connected to this node only, since the other nodes keep
+// their own counts.
+func NewMemoryStore() Store {
+	ret := new(memStore)
+	ret.users = make(map[string]map[string]time.Time, 100)
+	return ret
+}
+
+func userKey(service, username string) string {
+	return service + "\n" + username
+}
+
+func (self *memStore) Add(service, username, id string, expiresAt time.Time) (n int, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	k := userKey(service, username)
+	ids, ok := self.users[k]
+	if !ok {
+		ids = make(map[string]time.Time, 4)
+		self.users[k] = ids
+	}
+	ids[id] = expiresAt
+	return self.count(k), nil
+}
+
+func (self *memStore) Remove(service, username, id string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	k := userKey(service, username)
+	if ids, ok := self.users[k]; ok {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(self.users, k)
+		}
+	}
+	return nil
+}
+
+func (self *memStore) Count(service, username string) (n int, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.count(userKey(service, username)), nil
+}
+
+// count drops the expired messages of the user and counts the others.
+func (self *memStore) count(k string) (n int) {
+	now := time.Now()
+	ids := self.users[k]
+	for id, expiresAt := range ids {
+		if !expiresAt.IsZero() && !expiresAt.After(now) {
+			delete(ids, id)
+			continue
+		}
+		n++
+	}
+	if n == 0 {
+		delete(self.users, k)
+	}
+	return
+}
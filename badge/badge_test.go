@@ -0,0 +1,95 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package badge
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+	"time"
+)
+
+func getRedisStore() Store {
+	db := 6
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	c.Do("SELECT", db)
+	c.Do("FLUSHDB")
+	c.Close()
+	return NewRedisStore("", "", db)
+}
+
+func testCount(store Store, t *testing.T, service, username string, expected int) {
+	n, err := store.Count(service, username)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if n != expected {
+		t.Errorf("%v:%v has %v unread messages, not %v", service, username, n, expected)
+	}
+}
+
+func testStore(store Store, t *testing.T) {
+	testCount(store, t, "srv", "alice", 0)
+	expiresAt := time.Now().Add(500 * time.Millisecond)
+	store.Add("srv", "alice", "1", time.Time{})
+	store.Add("srv", "alice", "2", expiresAt)
+	store.Add("srv", "alice", "3", time.Time{})
+	// Counted once.
+	if n, err := store.Add("srv", "alice", "3", time.Time{}); n != 3 || err != nil {
+		t.Errorf("bad count: %v %v", n, err)
+	}
+	store.Add("srv", "bob", "1", time.Time{})
+	testCount(store, t, "srv", "alice", 3)
+	testCount(store, t, "other", "alice", 0)
+
+	if err := store.Remove("srv", "alice", "1"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	store.Remove("srv", "alice", "1")
+	testCount(store, t, "srv", "alice", 2)
+
+	time.Sleep(time.Second)
+	testCount(store, t, "srv", "alice", 1)
+	testCount(store, t, "srv", "bob", 1)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(NewMemoryStore(), t)
+}
+
+func TestRedisStore(t *testing.T) {
+	testStore(getRedisStore(), t)
+}
+
+func TestRedisStoreExpires(t *testing.T) {
+	store := getRedisStore()
+	now := time.Now()
+	store.Add("srv", "carol", "1", now.Add(time.Hour))
+	// An earlier expiry does not shorten the one of the set.
+	store.Add("srv", "carol", "2", now.Add(time.Minute))
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	defer c.Close()
+	c.Do("SELECT", 6)
+	ttl, err := redis.Int64(c.Do("PTTL", unreadKey("srv", "carol")))
+	if err != nil || ttl < int64(50*time.Minute/time.Millisecond) {
+		t.Errorf("bad ttl: %v %v", ttl, err)
+	}
+	store.Add("srv", "carol", "3", time.Time{})
+	if ttl, _ := redis.Int64(c.Do("PTTL", unreadKey("srv", "carol"))); ttl != -1 {
+		t.Errorf("should never expire: %v", ttl)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package badge
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/redispool"
+	"time"
+)
+
+type redisStore struct {
+	pool *redis.Pool
+}
+
+// NewRedisStore keeps the unread messages of each user in a redis
+// sorted set, scored by their expiration times in milliseconds. The
+// set expires with the last of its messages, unless one of them never
+// expires. It needs redis 7 or later.
+func NewRedisStore(addr, password string, db int) Store {
+	pool := redispool.New(addr, password, db)
+
+	ret := new(redisStore)
+	ret.pool = pool
+	return ret
+}
+
+func unreadKey(service, username string) string {
+	return fmt.Sprintf("unread:%v:%v", service, username)
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (self *redisStore) Add(service, username, id string, expiresAt time.Time) (n int, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	key := unreadKey(service, username)
+	conn.Send("MULTI")
+	if expiresAt.IsZero() {
+		conn.Send("ZADD", key, "+inf", id)
+		conn.Send("PERSIST", key)
+	} else {
+		at := millis(expiresAt)
+		conn.Send("ZADD", key, at, id)
+		// Set the expiry of a new set, or push it back. A set without
+		// one has a message which never expires.
+		conn.Send("PEXPIREAT", key, at, "NX")
+		conn.Send("PEXPIREAT", key, at, "GT")
+	}
+	conn.Send("ZREMRANGEBYSCORE", key, "-inf", millis(time.Now()))
+	conn.Send("ZCARD", key)
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return
+	}
+	if len(reply) == 0 {
+		err = redis.ErrNil
+		return
+	}
+	n, err = redis.Int(reply[len(reply)-1], nil)
+	return
+}
+
+func (self *redisStore) Remove(service, username, id string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("ZREM", unreadKey(service, username), id)
+	return err
+}
+
+func (self *redisStore) Count(service, username string) (n int, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	key := unreadKey(service, username)
+	// Drop the expired messages first.
+	_, err = conn.Do("ZREMRANGEBYSCORE", key, "-inf", millis(time.Now()))
+	if err != nil {
+		return
+	}
+	n, err = redis.Int(conn.Do("ZCARD", key))
+	return
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package binding ties the tokens of the users to the device, or to
+// the network, they are first used from, so that a leaked token is
+// rejected anywhere else. All nodes of a cluster should share the same
+// store so that a token bound on one node is checked by every node.
+package binding
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoDevice = errors.New("no device id")
+var ErrNoAddress = errors.New("no IP address")
+
+// Policy tells what the tokens of a service are bound to. A zero
+// Policy binds nothing.
+type Policy struct {
+	// Device binds the tokens to the device id sent by the client at
+	// authentication. Clients sending none are rejected.
+	Device bool
+
+	// IPv4Prefix and IPv6Prefix, if positive, bind the tokens to the
+	// network of the client: the address of the client with that
+	// many leading bits kept. 24 and 64 accept a client moving
+	// within its network of its ISP.
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+// Binds tells if the policy binds anything.
+func (self *Policy) Binds() bool {
+	return self != nil && (self.Device || self.IPv4Prefix > 0 || self.IPv6Prefix > 0)
+}
+
+// Key returns what a token used by the device from addr is bound to.
+// It is empty if the policy binds nothing. addr may have a port.
+func (self *Policy) Key(addr, device string) (key string, err error) {
+	if !self.Binds() {
+		return
+	}
+	var parts []string
+	if self.Device {
+		if len(device) == 0 {
+			err = ErrNoDevice
+			return
+		}
+		parts = append(parts, "device="+device)
+	}
+	if self.IPv4Prefix > 0 || self.IPv6Prefix > 0 {
+		var network string
+		network, err = self.network(addr)
+		if err != nil {
+			return
+		}
+		if len(network) > 0 {
+			parts = append(parts, "net="+network)
+		}
+	}
+	key = strings.Join(parts, " ")
+	return
+}
+
+// network is the prefix of addr kept by the policy, or empty if the
+// policy does not bind the family of addr.
+func (self *Policy) network(addr string) (network string, err error) {
+	host := addr
+	if h, _, e := net.SplitHostPort(addr); e == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		err = ErrNoAddress
+		return
+	}
+	prefix, bits := self.IPv6Prefix, 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		prefix, bits = self.IPv4Prefix, 32
+	}
+	if prefix <= 0 {
+		return
+	}
+	if prefix > bits {
+		prefix = bits
+	}
+	mask := net.CIDRMask(prefix, bits)
+	n := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	network = n.String()
+	return
+}
+
+// The bindings of a user are forgotten once none of the tokens of the
+// user has been used for bindingTTL. The tokens are tied again to
+// where they are used next.
+const bindingTTL = 30 * 24 * time.Hour
+
+type Store interface {
+	// Bind() ties the token of the user to key, unless it is already
+	// tied to another one, and tells if the token is tied to key.
+	// The bindings of the user are kept for bindingTTL from then.
+	Bind(service, username, token, key string) (bool, error)
+
+	// Unbind() frees all tokens of the user. They are tied again to
+	// where they are used next.
+	Unbind(service, username string) error
+}
+
+// Tokens are never stored as they are.
+func tokenHash(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+type userBindings struct {
+	// token hash -> key
+	tokens map[string]string
+	usedAt time.Time
+}
+
+type memStore struct {
+	lock sync.Mutex
+	// (service, username) -> bindings
+	users map[string]*userBindings
+}
+
+// NewMemoryStore returns a Store which binds the tokens to their keys
+// in memory. The bindings are lost when the process exits, and the
+// tokens may be bound again to other keys then.
+func NewMemoryStore() Store {
+	ret := new(memStore)
+	ret.users = make(map[string]*userBindings, 16)
+	return ret
+}
+
+func userKey(service, username string) string {
+	return service + "\n" + username
+}
+
+func (self *memStore) Bind(service, username, token, key string) (bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ukey := userKey(service, username)
+	now := time.Now()
+	user, ok := self.users[ukey]
+	if !ok || now.Sub(user.usedAt) > bindingTTL {
+		user = &userBindings{tokens: make(map[string]string, 2)}
+		self.users[ukey] = user
+	}
+	user.usedAt = now
+	h := tokenHash(token)
+	bound, ok := user.tokens[h]
+	if !ok {
+		user.tokens[h] = key
+		return true, nil
+	}
+	return bound == key, nil
+}
+
+func (self *memStore) Unbind(service, username string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.users, userKey(service, username))
+	return nil
+}
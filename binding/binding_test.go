@@ -0,0 +1,114 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package binding
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+	"time"
+)
+
+func getRedisStore() Store {
+	db := 4
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	c.Do("SELECT", db)
+	c.Do("FLUSHDB")
+	c.Close()
+	return NewRedisStore("", "", db)
+}
+
+func testStore(store Store, t *testing.T) {
+	check := func(username, token, key string, expected bool) {
+		ok, err := store.Bind("srv", username, token, key)
+		if err != nil || ok != expected {
+			t.Errorf("%v/%v at %v: expected %v; got %v (%v)", username, token, key, expected, ok, err)
+		}
+	}
+	check("alice", "token", "device=a", true)
+	check("alice", "token", "device=a", true)
+	check("alice", "token", "device=b", false)
+	check("alice", "other", "device=b", true)
+	check("bob", "token", "device=b", true)
+
+	if err := store.Unbind("srv", "alice"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	check("alice", "token", "device=b", true)
+	check("alice", "token", "device=a", false)
+	check("bob", "token", "device=a", false)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(NewMemoryStore(), t)
+}
+
+func TestRedisStore(t *testing.T) {
+	testStore(getRedisStore(), t)
+}
+
+func TestMemoryStoreExpires(t *testing.T) {
+	store := NewMemoryStore()
+	if ok, err := store.Bind("srv", "alice", "token", "device=a"); err != nil || !ok {
+		t.Fatalf("cannot bind: %v %v", ok, err)
+	}
+	store.(*memStore).users[userKey("srv", "alice")].usedAt = time.Now().Add(-bindingTTL - time.Minute)
+	if ok, err := store.Bind("srv", "alice", "token", "device=b"); err != nil || !ok {
+		t.Errorf("the binding does not expire: %v %v", ok, err)
+	}
+}
+
+func TestRedisStoreExpires(t *testing.T) {
+	store := getRedisStore()
+	if ok, err := store.Bind("srv", "alice", "token", "device=a"); err != nil || !ok {
+		t.Fatalf("cannot bind: %v %v", ok, err)
+	}
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	defer c.Close()
+	c.Do("SELECT", 4)
+	ttl, err := redis.Int64(c.Do("PTTL", bindingKey("srv", "alice")))
+	if err != nil || ttl <= 0 || ttl > int64(bindingTTL/time.Millisecond) {
+		t.Errorf("bad ttl: %v %v", ttl, err)
+	}
+}
+
+func TestPolicyKey(t *testing.T) {
+	tests := []struct {
+		policy Policy
+		addr   string
+		device string
+		key    string
+		err    error
+	}{
+		{Policy{}, "10.0.0.1:1234", "", "", nil},
+		{Policy{Device: true}, "10.0.0.1:1234", "phone", "device=phone", nil},
+		{Policy{Device: true}, "10.0.0.1:1234", "", "", ErrNoDevice},
+		{Policy{IPv4Prefix: 24}, "10.0.0.1:1234", "", "net=10.0.0.0/24", nil},
+		{Policy{IPv4Prefix: 24}, "10.0.0.200", "", "net=10.0.0.0/24", nil},
+		{Policy{IPv4Prefix: 40}, "10.0.0.1:1234", "", "net=10.0.0.1/32", nil},
+		{Policy{IPv4Prefix: 24}, "[2001:db8::1]:1234", "", "", nil},
+		{Policy{IPv6Prefix: 64}, "[2001:db8::1]:1234", "", "net=2001:db8::/64", nil},
+		{Policy{IPv6Prefix: 64}, "pipe", "", "", ErrNoAddress},
+		{Policy{Device: true, IPv4Prefix: 16}, "10.1.2.3:1234", "phone", "device=phone net=10.1.0.0/16", nil},
+	}
+	for _, tt := range tests {
+		key, err := tt.policy.Key(tt.addr, tt.device)
+		if key != tt.key || err != tt.err {
+			t.Errorf("%+v %v %q: expected %q, %v; got %q, %v", tt.policy, tt.addr, tt.device, tt.key, tt.err, key, err)
+		}
+	}
+}
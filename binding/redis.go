@@ -0,0 +1,83 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package binding
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/redispool"
+	"time"
+)
+
+type redisStore struct {
+	pool *redis.Pool
+}
+
+// NewRedisStore keeps the bindings in redis. What the tokens of a user
+// are bound to is kept in a hash keyed by the hashes of the tokens,
+// which expires bindingTTL after any of them is last used.
+func NewRedisStore(addr, password string, db int) Store {
+	pool := redispool.New(addr, password, db)
+
+	ret := new(redisStore)
+	ret.pool = pool
+	return ret
+}
+
+func bindingKey(service, username string) string {
+	return fmt.Sprintf("binding:%v:%v", service, username)
+}
+
+func (self *redisStore) Bind(service, username, token, key string) (bool, error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	h := tokenHash(token)
+	k := bindingKey(service, username)
+	// Whoever sets it first wins, even with two nodes racing.
+	conn.Send("MULTI")
+	conn.Send("HSETNX", k, h, key)
+	conn.Send("PEXPIRE", k, int64(bindingTTL/time.Millisecond))
+	conn.Send("HGET", k, h)
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	if len(reply) != 3 {
+		return false, fmt.Errorf("bad reply from redis")
+	}
+	bound, err := redis.String(reply[2], nil)
+	if err != nil {
+		return false, err
+	}
+	return bound == key, nil
+}
+
+func (self *redisStore) Unbind(service, username string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", bindingKey(service, username))
+	return err
+}
+
+// Ping tells whether redis could be reached.
+func (self *redisStore) Ping() error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
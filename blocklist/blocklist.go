@@ -0,0 +1,103 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package blocklist keeps, for every user, the senders from whom
+// the user does not want to receive forwarded messages.
+package blocklist
+
+import "sync"
+
+// Store is consulted in the forward path. The owner is identified by
+// (service, username); the blocked sender by (senderService, sender).
+type Store interface {
+	Block(service, username, senderService, sender string) error
+	Unblock(service, username, senderService, sender string) error
+	IsBlocked(service, username, senderService, sender string) (bool, error)
+	Blocked(service, username string) (senders []*Sender, err error)
+}
+
+type Sender struct {
+	Service  string `json:"service"`
+	Username string `json:"username"`
+}
+
+type memStore struct {
+	lock  sync.RWMutex
+	lists map[string]map[Sender]bool
+}
+
+// NewMemoryStore returns a Store which keeps the block lists in
+// memory. They are lost when the process exits.
+func NewMemoryStore() Store {
+	ret := new(memStore)
+	ret.lists = make(map[string]map[Sender]bool, 100)
+	return ret
+}
+
+func ownerKey(service, username string) string {
+	return service + "\n" + username
+}
+
+func (self *memStore) Block(service, username, senderService, sender string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := ownerKey(service, username)
+	list, ok := self.lists[key]
+	if !ok {
+		list = make(map[Sender]bool, 4)
+		self.lists[key] = list
+	}
+	list[Sender{Service: senderService, Username: sender}] = true
+	return nil
+}
+
+func (self *memStore) Unblock(service, username, senderService, sender string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := ownerKey(service, username)
+	list, ok := self.lists[key]
+	if !ok {
+		return nil
+	}
+	delete(list, Sender{Service: senderService, Username: sender})
+	if len(list) == 0 {
+		delete(self.lists, key)
+	}
+	return nil
+}
+
+func (self *memStore) IsBlocked(service, username, senderService, sender string) (bool, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	list, ok := self.lists[ownerKey(service, username)]
+	if !ok {
+		return false, nil
+	}
+	return list[Sender{Service: senderService, Username: sender}], nil
+}
+
+func (self *memStore) Blocked(service, username string) (senders []*Sender, err error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	list := self.lists[ownerKey(service, username)]
+	senders = make([]*Sender, 0, len(list))
+	for s := range list {
+		sender := s
+		senders = append(senders, &sender)
+	}
+	return
+}
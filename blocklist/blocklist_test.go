@@ -0,0 +1,90 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package blocklist
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+func getRedisStore() Store {
+	db := 3
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	c.Do("SELECT", db)
+	c.Do("FLUSHDB")
+	c.Close()
+	return NewRedisStore("", "", db)
+}
+
+func testStore(store Store, t *testing.T) {
+	blocked, err := store.IsBlocked("srv", "alice", "srv", "bob")
+	if err != nil || blocked {
+		t.Errorf("bob should not be blocked: %v", err)
+	}
+	if err := store.Block("srv", "alice", "srv", "bob"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := store.Block("srv", "alice", "other", "eve"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	blocked, err = store.IsBlocked("srv", "alice", "srv", "bob")
+	if err != nil || !blocked {
+		t.Errorf("bob should be blocked: %v", err)
+	}
+	// Block lists are per service.
+	blocked, err = store.IsBlocked("srv", "alice", "other", "bob")
+	if err != nil || blocked {
+		t.Errorf("other:bob should not be blocked: %v", err)
+	}
+	blocked, err = store.IsBlocked("srv", "bob", "srv", "alice")
+	if err != nil || blocked {
+		t.Errorf("block lists should not be symmetric: %v", err)
+	}
+
+	senders, err := store.Blocked("srv", "alice")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(senders) != 2 {
+		t.Errorf("Wrong number of blocked senders: %v", len(senders))
+	}
+	for _, s := range senders {
+		if !(s.Service == "srv" && s.Username == "bob") && !(s.Service == "other" && s.Username == "eve") {
+			t.Errorf("Unknown sender: %+v", s)
+		}
+	}
+
+	if err := store.Unblock("srv", "alice", "srv", "bob"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	blocked, err = store.IsBlocked("srv", "alice", "srv", "bob")
+	if err != nil || blocked {
+		t.Errorf("bob should be unblocked: %v", err)
+	}
+	if err := store.Unblock("srv", "nobody", "srv", "bob"); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(NewMemoryStore(), t)
+}
+
+func TestRedisStore(t *testing.T) {
+	testStore(getRedisStore(), t)
+}
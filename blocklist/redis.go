@@ -0,0 +1,86 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package blocklist
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/redispool"
+	"strings"
+)
+
+type redisStore struct {
+	pool *redis.Pool
+}
+
+// NewRedisStore keeps the block list of each user in a redis set.
+func NewRedisStore(addr, password string, db int) Store {
+	pool := redispool.New(addr, password, db)
+
+	ret := new(redisStore)
+	ret.pool = pool
+	return ret
+}
+
+func blockListKey(service, username string) string {
+	return fmt.Sprintf("blocklist:%v:%v", service, username)
+}
+
+// Service names never contain ':', so the first one separates
+// the service from the username.
+func senderMember(service, username string) string {
+	return fmt.Sprintf("%v:%v", service, username)
+}
+
+func (self *redisStore) Block(service, username, senderService, sender string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SADD", blockListKey(service, username), senderMember(senderService, sender))
+	return err
+}
+
+func (self *redisStore) Unblock(service, username, senderService, sender string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SREM", blockListKey(service, username), senderMember(senderService, sender))
+	return err
+}
+
+func (self *redisStore) IsBlocked(service, username, senderService, sender string) (bool, error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	return redis.Bool(conn.Do("SISMEMBER", blockListKey(service, username), senderMember(senderService, sender)))
+}
+
+func (self *redisStore) Blocked(service, username string) (senders []*Sender, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	members, err := redis.Strings(conn.Do("SMEMBERS", blockListKey(service, username)))
+	if err != nil {
+		return
+	}
+	senders = make([]*Sender, 0, len(members))
+	for _, m := range members {
+		elems := strings.SplitN(m, ":", 2)
+		if len(elems) != 2 {
+			continue
+		}
+		senders = append(senders, &Sender{Service: elems[0], Username: elems[1]})
+	}
+	return
+}
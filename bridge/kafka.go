@@ -0,0 +1,353 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package bridge connects the message center to a Kafka cluster: the
+// messages read from a topic are delivered to the users, and the
+// messages the users forward to each other are produced to another
+// topic.
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/backoff"
+	"github.com/uniqush/uniqush-conn/kafkarest"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/proto"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Deliverer is implemented by msgcenter.MessageCenter.
+type Deliverer interface {
+	DeliverMessage(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) ([]*msgcenter.Result, error)
+}
+
+// InboundMessage is the value of a record read from the inbound topic.
+// It is the request accepted by the /send HTTP API.
+type InboundMessage struct {
+	Service  string `json:"service"`
+	Username string `json:"username"`
+	// Receiver is an alias of Username.
+	Receiver string            `json:"receiver,omitempty"`
+	Header   map[string]string `json:"header,omitempty"`
+	// Headers are merged into Header.
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    []byte            `json:"body,omitempty"`
+	// TTL defaults to 24 hours.
+	TTL    string `json:"ttl,omitempty"`
+	Public bool   `json:"public,omitempty"`
+}
+
+// Forward is the value of a record produced to the forward topic. Its
+// key is the receiver's service and name, separated by ':'.
+type Forward struct {
+	// Time is when the message was forwarded, in nanoseconds since the epoch.
+	Time            int64          `json:"time"`
+	SenderService   string         `json:"senderService"`
+	Sender          string         `json:"sender"`
+	ReceiverService string         `json:"receiverService"`
+	Receiver        string         `json:"receiver"`
+	Msg             *proto.Message `json:"msg"`
+}
+
+const (
+	forwardQueueSize = 4096
+	forwardBatchSize = 256
+)
+
+// KafkaBridge talks to Kafka through a Kafka REST proxy (API v2).
+//
+// The inbound records are committed once they are delivered, or
+// rejected, so that they are delivered at least once. A record which
+// is not a valid InboundMessage, or which cannot be delivered, is
+// logged and skipped.
+//
+// The forwarded messages are produced in batches, retried with a
+// backoff if the proxy fails, and dropped if they keep failing. The
+// message center drops the forwarded messages the bridge has no room
+// for, so that the proxy never slows the users down.
+type KafkaBridge struct {
+	proxy        string
+	forwardTopic string
+	services     map[string]bool
+	consumer     *kafkarest.Consumer
+	client       *http.Client
+	retries      int
+	backoff      time.Duration
+	logger       logger.Logger
+
+	nrDelivered uint64
+	nrRejected  uint64
+	nrDropped   uint64
+
+	stop     chan bool
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// NewKafkaBridge reads the messages to deliver from the inbound topic,
+// as a member of the consumer group, and produces the messages
+// forwarded by the users of the services (or of all services if none
+// is given) to the forward topic. Either topic may be empty.
+func NewKafkaBridge(proxy, group, inboundTopic, forwardTopic string, services ...string) *KafkaBridge {
+	ret := new(KafkaBridge)
+	ret.proxy = proxy
+	ret.forwardTopic = forwardTopic
+	if len(inboundTopic) > 0 {
+		ret.consumer = &kafkarest.Consumer{URL: proxy, Group: group, Topic: inboundTopic}
+	}
+	ret.services = make(map[string]bool, len(services))
+	for _, s := range services {
+		ret.services[s] = true
+	}
+	ret.retries = 3
+	ret.backoff = time.Second
+	ret.logger = logger.Nop()
+	ret.stop = make(chan bool)
+	return ret
+}
+
+// SetClient sets the HTTP client talking to the proxy. It should time
+// out after the proxy's consumer.request.timeout.ms.
+func (self *KafkaBridge) SetClient(client *http.Client) {
+	self.client = client
+	if self.consumer != nil {
+		self.consumer.Client = client
+	}
+}
+
+// SetRetries sets the number of retries of a failed produce, and the
+// wait before the first one, which is also the wait before polling
+// again after an error.
+func (self *KafkaBridge) SetRetries(retries int, backoff time.Duration) {
+	self.retries = retries
+	self.backoff = backoff
+}
+
+func (self *KafkaBridge) SetLogger(l logger.Logger) {
+	self.logger = logger.OrNop(l).With("kafka", self.proxy)
+}
+
+// Forwards tells if the messages forwarded by the users of the
+// service are produced.
+func (self *KafkaBridge) Forwards(service string) bool {
+	return len(self.forwardTopic) > 0 && (len(self.services) == 0 || self.services[service])
+}
+
+// Delivered returns the number of inbound messages delivered.
+func (self *KafkaBridge) Delivered() uint64 {
+	return atomic.LoadUint64(&self.nrDelivered)
+}
+
+// Rejected returns the number of inbound records skipped.
+func (self *KafkaBridge) Rejected() uint64 {
+	return atomic.LoadUint64(&self.nrRejected)
+}
+
+// Dropped returns the number of forwarded messages which could not be
+// produced.
+func (self *KafkaBridge) Dropped() uint64 {
+	return atomic.LoadUint64(&self.nrDropped)
+}
+
+// Start delivers the inbound messages with center, and produces the
+// forwarded messages published by source, until Stop is called.
+func (self *KafkaBridge) Start(center Deliverer, source msgcenter.EventSource) {
+	if self.consumer != nil {
+		self.wg.Add(1)
+		go func() {
+			defer self.wg.Done()
+			self.consume(center)
+		}()
+	}
+	if len(self.forwardTopic) > 0 {
+		ch := make(chan *msgcenter.Event, forwardQueueSize)
+		source.Listen(ch)
+		self.wg.Add(1)
+		go func() {
+			defer self.wg.Done()
+			defer source.Unlisten(ch)
+			self.forward(ch)
+		}()
+	}
+}
+
+// Stop returns once the records being processed are committed, and
+// the queued forwarded messages are produced or dropped.
+func (self *KafkaBridge) Stop() {
+	self.stopOnce.Do(func() {
+		close(self.stop)
+	})
+	self.wg.Wait()
+}
+
+// sleep returns false if the bridge is stopped before d elapses.
+func (self *KafkaBridge) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-self.stop:
+		return false
+	}
+}
+
+func (self *KafkaBridge) stopped() bool {
+	select {
+	case <-self.stop:
+		return true
+	default:
+	}
+	return false
+}
+
+func (self *KafkaBridge) consume(center Deliverer) {
+	defer self.consumer.Close()
+	for !self.stopped() {
+		records, err := self.consumer.Poll()
+		if err == kafkarest.ErrConsumerGone {
+			err = self.consumer.Open()
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			self.logger.Warn("cannot read inbound messages", "err", err)
+			if !self.sleep(self.backoff) {
+				return
+			}
+			continue
+		}
+		for _, r := range records {
+			err = self.deliver(center, r.Value)
+			if err != nil {
+				atomic.AddUint64(&self.nrRejected, 1)
+				self.logger.Warn("cannot deliver inbound message", "partition", r.Partition, "offset", r.Offset, "err", err)
+				continue
+			}
+			atomic.AddUint64(&self.nrDelivered, 1)
+		}
+		err = self.consumer.Commit(records)
+		if err != nil {
+			// The records will be delivered again.
+			self.logger.Warn("cannot commit inbound messages", "err", err)
+		}
+	}
+}
+
+func (self *KafkaBridge) deliver(center Deliverer, value []byte) error {
+	var req InboundMessage
+	err := json.Unmarshal(value, &req)
+	if err != nil {
+		return fmt.Errorf("invalid message: %v", err)
+	}
+	if len(req.Username) == 0 {
+		req.Username = req.Receiver
+	}
+	if len(req.Headers) > 0 {
+		if req.Header == nil {
+			req.Header = make(map[string]string, len(req.Headers))
+		}
+		for k, v := range req.Headers {
+			req.Header[k] = v
+		}
+	}
+	ttl := 24 * time.Hour
+	if len(req.TTL) > 0 {
+		ttl, err = time.ParseDuration(req.TTL)
+		if err != nil {
+			return err
+		}
+	}
+	msg, extra, err := msgcenter.SplitHeader(req.Header, req.Body)
+	if err != nil {
+		return err
+	}
+	msg.Public = req.Public
+	_, err = center.DeliverMessage(req.Service, req.Username, &proto.MessageContainer{Message: msg}, extra, ttl)
+	return err
+}
+
+func (self *KafkaBridge) forward(ch <-chan *msgcenter.Event) {
+	batch := make([]*kafkarest.Record, 0, forwardBatchSize)
+	add := func(evt *msgcenter.Event) {
+		if evt.Type != msgcenter.EVENT_FORWARD || evt.Message == nil || !self.Forwards(evt.Service) {
+			return
+		}
+		batch = append(batch, &kafkarest.Record{
+			Key: evt.ReceiverService + ":" + evt.Receiver,
+			Value: &Forward{
+				Time:            time.Now().UnixNano(),
+				SenderService:   evt.Service,
+				Sender:          evt.Username,
+				ReceiverService: evt.ReceiverService,
+				Receiver:        evt.Receiver,
+				Msg:             evt.Message,
+			},
+		})
+	}
+	for {
+		stopping := false
+		select {
+		case evt := <-ch:
+			add(evt)
+		case <-self.stop:
+			stopping = true
+		}
+		for drained := false; !drained && len(batch) < forwardBatchSize; {
+			select {
+			case evt := <-ch:
+				add(evt)
+			default:
+				drained = true
+			}
+		}
+		if len(batch) > 0 {
+			self.produce(batch)
+			batch = batch[:0]
+		}
+		if stopping && len(ch) == 0 {
+			return
+		}
+	}
+}
+
+func (self *KafkaBridge) produce(batch []*kafkarest.Record) {
+	wait := self.backoff
+	for i := 0; ; i++ {
+		err := kafkarest.Produce(self.client, self.proxy, self.forwardTopic, batch)
+		if err == nil {
+			return
+		}
+		if i >= self.retries {
+			self.logger.Warn("cannot produce forwarded messages", "nrMessages", len(batch), "err", err)
+			atomic.AddUint64(&self.nrDropped, uint64(len(batch)))
+			return
+		}
+		if !self.sleep(wait) {
+			// Try once more before giving up.
+			if kafkarest.Produce(self.client, self.proxy, self.forwardTopic, batch) != nil {
+				atomic.AddUint64(&self.nrDropped, uint64(len(batch)))
+			}
+			return
+		}
+		wait = backoff.Next(wait)
+	}
+}
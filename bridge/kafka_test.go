@@ -0,0 +1,245 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/proto"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSource struct {
+	lock sync.Mutex
+	ch   chan<- *msgcenter.Event
+}
+
+func (self *fakeSource) Listen(ch chan<- *msgcenter.Event) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ch = ch
+}
+
+func (self *fakeSource) Unlisten(ch chan<- *msgcenter.Event) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ch = nil
+}
+
+func (self *fakeSource) publish(evt *msgcenter.Event) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ch <- evt
+}
+
+type delivered struct {
+	service  string
+	username string
+	msg      *proto.Message
+	ttl      time.Duration
+}
+
+type fakeCenter struct {
+	ch chan *delivered
+}
+
+func (self *fakeCenter) DeliverMessage(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) ([]*msgcenter.Result, error) {
+	if service != "service" {
+		return nil, errors.New("no such service")
+	}
+	self.ch <- &delivered{service, username, mc.Message, ttl}
+	return nil, nil
+}
+
+// fakeProxy is a Kafka REST proxy with one partition per topic.
+type fakeProxy struct {
+	srv       *httptest.Server
+	lock      sync.Mutex
+	topics    map[string][]json.RawMessage
+	keys      map[string][]string
+	committed int64
+	instances int
+	failing   int
+}
+
+func newFakeProxy() *fakeProxy {
+	ret := new(fakeProxy)
+	ret.topics = make(map[string][]json.RawMessage)
+	ret.keys = make(map[string][]string)
+	ret.committed = -1
+	ret.srv = httptest.NewServer(ret)
+	return ret
+}
+
+func (self *fakeProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	path := r.URL.Path
+	switch {
+	case r.Method == "POST" && strings.HasPrefix(path, "/topics/"):
+		if self.failing > 0 {
+			self.failing--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var req struct {
+			Records []struct {
+				Key   string          `json:"key"`
+				Value json.RawMessage `json:"value"`
+			} `json:"records"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		topic := path[len("/topics/"):]
+		for _, rec := range req.Records {
+			self.topics[topic] = append(self.topics[topic], rec.Value)
+			self.keys[topic] = append(self.keys[topic], rec.Key)
+		}
+		w.Write([]byte(`{"offsets":[]}`))
+	case r.Method == "POST" && path == "/consumers/group":
+		self.instances++
+		json.NewEncoder(w).Encode(map[string]string{
+			"instance_id": "c",
+			"base_uri":    self.srv.URL + "/consumers/group/instances/c",
+		})
+	case path == "/consumers/group/instances/c/subscription":
+		w.WriteHeader(http.StatusNoContent)
+	case path == "/consumers/group/instances/c/records":
+		var records []map[string]interface{}
+		for i, v := range self.topics["in"] {
+			if int64(i) > self.committed {
+				records = append(records, map[string]interface{}{
+					"topic": "in", "partition": 0, "offset": i, "value": v,
+				})
+			}
+		}
+		if len(records) == 0 {
+			self.lock.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			self.lock.Lock()
+		}
+		json.NewEncoder(w).Encode(records)
+	case path == "/consumers/group/instances/c/offsets":
+		var req struct {
+			Offsets []struct {
+				Offset int64 `json:"offset"`
+			} `json:"offsets"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		for _, o := range req.Offsets {
+			self.committed = o.Offset
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "DELETE":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (self *fakeProxy) push(topic, value string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.topics[topic] = append(self.topics[topic], json.RawMessage(value))
+}
+
+func (self *fakeProxy) records(topic string) ([]json.RawMessage, []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.topics[topic], self.keys[topic]
+}
+
+func TestKafkaInbound(t *testing.T) {
+	proxy := newFakeProxy()
+	defer proxy.srv.Close()
+	proxy.push("in", `{"service":"service","username":"user","header":{"title":"hi"},"body":"aGVsbG8=","ttl":"1h"}`)
+	proxy.push("in", `"not a message"`)
+	proxy.push("in", `{"service":"nosuchservice","username":"user"}`)
+	proxy.push("in", `{"service":"service","receiver":"user2","headers":{"a":"b"}}`)
+
+	center := &fakeCenter{make(chan *delivered, 10)}
+	b := NewKafkaBridge(proxy.srv.URL, "group", "in", "")
+	b.SetRetries(0, 10*time.Millisecond)
+	b.Start(center, new(fakeSource))
+
+	var msgs []*delivered
+	for len(msgs) < 2 {
+		select {
+		case d := <-center.ch:
+			msgs = append(msgs, d)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%v messages delivered", len(msgs))
+		}
+	}
+	b.Stop()
+	if d := msgs[0]; d.username != "user" || d.ttl != time.Hour || string(d.msg.Body) != "hello" || d.msg.Header["title"] != "hi" {
+		t.Errorf("bad message: %+v", d)
+	}
+	if d := msgs[1]; d.username != "user2" || d.ttl != 24*time.Hour || d.msg.Header["a"] != "b" {
+		t.Errorf("bad message: %+v", d)
+	}
+	if b.Delivered() != 2 || b.Rejected() != 2 {
+		t.Errorf("%v delivered, %v rejected", b.Delivered(), b.Rejected())
+	}
+	if proxy.committed != 3 {
+		t.Errorf("committed %v", proxy.committed)
+	}
+}
+
+func TestKafkaForward(t *testing.T) {
+	proxy := newFakeProxy()
+	defer proxy.srv.Close()
+	proxy.failing = 1
+
+	source := new(fakeSource)
+	b := NewKafkaBridge(proxy.srv.URL, "", "", "out", "service")
+	b.SetRetries(3, 10*time.Millisecond)
+	b.Start(nil, source)
+
+	source.publish(&msgcenter.Event{Type: msgcenter.EVENT_CONNECT, Service: "service", Username: "user"})
+	source.publish(&msgcenter.Event{
+		Type: msgcenter.EVENT_FORWARD, Service: "other", Username: "user",
+		Receiver: "user2", ReceiverService: "service", Message: &proto.Message{Body: []byte("no")},
+	})
+	source.publish(&msgcenter.Event{
+		Type: msgcenter.EVENT_FORWARD, Service: "service", Username: "user",
+		Receiver: "user2", ReceiverService: "other", Message: &proto.Message{Body: []byte("hello")},
+	})
+	b.Stop()
+
+	values, keys := proxy.records("out")
+	if len(values) != 1 || keys[0] != "other:user2" {
+		t.Fatalf("bad records: %v %v", len(values), keys)
+	}
+	var fwd Forward
+	err := json.Unmarshal(values[0], &fwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fwd.Sender != "user" || fwd.SenderService != "service" || fwd.Receiver != "user2" || string(fwd.Msg.Body) != "hello" {
+		t.Errorf("bad forward: %+v", fwd)
+	}
+	if b.Dropped() != 0 {
+		t.Errorf("%v dropped", b.Dropped())
+	}
+}
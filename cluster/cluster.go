@@ -0,0 +1,117 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package cluster lets several uniqush-conn nodes share one user space.
+// Each node records the connections it holds in a Locator. When a
+// message is sent to a user, the node which receives the request
+// finds out which nodes the user is connected to and hands the
+// message to them through a Transport.
+//
+// All nodes in a cluster should share the same message cache so that
+// a message cached on one node could be retrieved on another.
+package cluster
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+	"time"
+)
+
+var ErrBadNode = errors.New("bad node address")
+
+// Result is the result of delivering a message to one connection
+// on a remote node.
+type Result struct {
+	Err     string `json:"err,omitempty"`
+	ConnId  string `json:"connId,omitempty"`
+	Visible bool   `json:"visible"`
+
+	// Node is only set if the connection is not on the node
+	// replying, e.g. for the messages sent from the feed.
+	Node string `json:"node,omitempty"`
+}
+
+// Locator keeps track of the nodes on which users are connected.
+type Locator interface {
+	Register(node, service, username, connId string) error
+	Unregister(node, service, username, connId string) error
+
+	// Locate() returns the nodes on which the user has
+	// at least one connection.
+	Locate(service, username string) (nodes []string, err error)
+
+	// Purge() removes all connections registered by the node.
+	// A node should purge its stale records when it starts.
+	Purge(node string) error
+}
+
+// Transport sends a message to another node, which delivers
+// it to its local connections of the user.
+type Transport interface {
+	Deliver(node, service, username string, mc *proto.MessageContainer, extra map[string]string) (res []*Result, err error)
+
+	// Disconnect() asks another node to close the connections
+	// of the user, or only the one whose id is connId if it is not
+	// empty. It returns the number of closed connections.
+	Disconnect(node, service, username, connId string, revoke bool) (n int, err error)
+}
+
+// Multicaster is implemented by the Transports which can send a
+// message to several nodes at once. The results and the errors are
+// keyed by node.
+type Multicaster interface {
+	DeliverToNodes(nodes []string, service, username string, mc *proto.MessageContainer, extra map[string]string) (res map[string][]*Result, errs map[string]error)
+}
+
+// Endpoint is implemented by the Transports which receive the
+// requests of other nodes themselves, instead of through a handler
+// mounted on the HTTP server of the node.
+type Endpoint interface {
+	Serve(node string, recv Receiver) error
+}
+
+// Receiver delivers a message sent from another node to the
+// local connections of the user. The message should neither be
+// cached nor routed again.
+type Receiver interface {
+	DeliverLocal(service, username string, mc *proto.MessageContainer, extra map[string]string) []*Result
+
+	// DisconnectLocal() closes the local connections of the user.
+	// Revoked connections are told so before being closed.
+	DisconnectLocal(service, username, connId string, revoke bool) int
+}
+
+// Feed is implemented by the Transports which can hand a message to
+// whichever delivery-only node is free. A delivery-only node has no
+// client of its own: it caches the messages taken from the feed,
+// delivers them to the nodes the users are connected to and pushes
+// them to the offline users. Each message is taken by one node.
+type Feed interface {
+	// Publish returns once a node has sent the message. It sets the
+	// Id of mc to the one the message is cached with.
+	Publish(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) (res []*Result, err error)
+
+	// ServeFeed takes a share of the messages published to the feed,
+	// and sends them through sender.
+	ServeFeed(sender Sender) error
+}
+
+// Sender sends a message taken from the feed as if it was sent to
+// this node, setting the Id of mc.
+type Sender interface {
+	SendFromFeed(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) (res []*Result, err error)
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DeliverPath is the path on which a node receives
+// messages from other nodes.
+const DeliverPath = "/cluster/deliver.json"
+
+// DisconnectPath is the path on which a node is asked to
+// close the connections of a user.
+const DisconnectPath = "/cluster/disconnect.json"
+
+type deliverRequest struct {
+	Service  string                  `json:"service"`
+	Username string                  `json:"username"`
+	Message  *proto.MessageContainer `json:"msg"`
+	Extra    map[string]string       `json:"extra,omitempty"`
+}
+
+type deliverResponse struct {
+	Results []*Result `json:"results,omitempty"`
+}
+
+type disconnectRequest struct {
+	Service  string `json:"service"`
+	Username string `json:"username"`
+	ConnId   string `json:"connId,omitempty"`
+	Revoke   bool   `json:"revoke,omitempty"`
+}
+
+type disconnectResponse struct {
+	NrConns int `json:"nrConns"`
+}
+
+type httpTransport struct {
+	client *http.Client
+}
+
+// TimeoutDialler returns a dial function for http.Transport which
+// sets a deadline of ns on every connection. ns <= 0 means no deadline.
+func TimeoutDialler(ns time.Duration) func(net, addr string) (c net.Conn, err error) {
+	return func(netw, addr string) (net.Conn, error) {
+		c, err := net.Dial(netw, addr)
+		if err != nil {
+			return nil, err
+		}
+		if ns.Seconds() > 0.0 {
+			c.SetDeadline(time.Now().Add(ns))
+		}
+		return c, nil
+	}
+}
+
+// NewHttpTransport returns a Transport which posts messages
+// to the HTTP address of other nodes. The node name is its
+// HTTP address, i.e. host:port.
+func NewHttpTransport(timeout time.Duration) Transport {
+	ret := new(httpTransport)
+	ret.client = &http.Client{
+		Transport: &http.Transport{
+			Dial: TimeoutDialler(timeout),
+			// The deadline is set per connection.
+			DisableKeepAlives: true,
+		},
+	}
+	return ret
+}
+
+func (self *httpTransport) post(node, path string, req, resp interface{}) error {
+	if len(node) == 0 {
+		return ErrBadNode
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("http://%v%v", node, path)
+	r, err := self.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("node %v: %v", node, r.Status)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+func (self *httpTransport) Deliver(node, service, username string, mc *proto.MessageContainer, extra map[string]string) (res []*Result, err error) {
+	req := &deliverRequest{
+		Service:  service,
+		Username: username,
+		Message:  mc,
+		Extra:    extra,
+	}
+	dresp := new(deliverResponse)
+	err = self.post(node, DeliverPath, req, dresp)
+	if err != nil {
+		return
+	}
+	res = dresp.Results
+	return
+}
+
+func (self *httpTransport) Disconnect(node, service, username, connId string, revoke bool) (n int, err error) {
+	req := &disconnectRequest{
+		Service:  service,
+		Username: username,
+		ConnId:   connId,
+		Revoke:   revoke,
+	}
+	dresp := new(disconnectResponse)
+	err = self.post(node, DisconnectPath, req, dresp)
+	if err != nil {
+		return
+	}
+	n = dresp.NrConns
+	return
+}
+
+type httpHandler struct {
+	recv Receiver
+}
+
+// NewHttpHandler returns a handler which should be mounted on
+// DeliverPath and DisconnectPath to serve requests from other nodes.
+func NewHttpHandler(recv Receiver) http.Handler {
+	ret := new(httpHandler)
+	ret.recv = recv
+	return ret
+}
+
+func (self *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.URL.Path == DisconnectPath {
+		self.disconnect(w, r)
+		return
+	}
+	req := new(deliverRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil || req.Message == nil || req.Message.Message == nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	resp := new(deliverResponse)
+	resp.Results = self.recv.DeliverLocal(req.Service, req.Username, req.Message, req.Extra)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (self *httpHandler) disconnect(w http.ResponseWriter, r *http.Request) {
+	req := new(disconnectRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil || len(req.Service) == 0 || len(req.Username) == 0 {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	resp := new(disconnectResponse)
+	resp.NrConns = self.recv.DisconnectLocal(req.Service, req.Username, req.ConnId, req.Revoke)
+	json.NewEncoder(w).Encode(resp)
+}
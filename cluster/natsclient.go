@@ -0,0 +1,537 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cluster
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNatsClosed     = errors.New("nats connection closed")
+	ErrNatsTimeout    = errors.New("nats request timed out")
+	ErrPayloadTooBig  = errors.New("nats payload too big")
+	errNatsDropped    = errors.New("nats connection dropped")
+	errNatsBadMessage = errors.New("nats: bad message")
+)
+
+const (
+	natsDefaultPort   = "4222"
+	natsDialTimeout   = 5 * time.Second
+	natsMaxReconnWait = 5 * time.Second
+
+	// A write which does not complete in time drops the connection,
+	// so that a stuck server does not block the publishers forever.
+	natsWriteTimeout = 5 * time.Second
+
+	// The client pings the server every natsPingInterval, and drops
+	// the connection once natsMaxPingsOut pings are not answered.
+	natsPingInterval = 30 * time.Second
+	natsMaxPingsOut  = 2
+)
+
+type natsHandler func(subject, reply string, data []byte)
+
+type natsSub struct {
+	subject string
+	queue   string
+	handler natsHandler
+}
+
+func (self *natsSub) write(w io.Writer, sid int) {
+	if len(self.queue) > 0 {
+		fmt.Fprintf(w, "SUB %v %v %v\r\n", self.subject, self.queue, sid)
+	} else {
+		fmt.Fprintf(w, "SUB %v %v\r\n", self.subject, sid)
+	}
+}
+
+// natsConn is a client of the NATS protocol, just enough to publish,
+// subscribe and make requests. It reconnects, and subscribes again,
+// when the connection to the server is lost, or does not answer its
+// pings.
+type natsConn struct {
+	addr     string
+	user     string
+	password string
+	token    string
+	name     string
+
+	// The connection is upgraded to TLS if tlsConfig is not nil, or
+	// if the server requires it.
+	tlsConfig    *tls.Config
+	pingInterval time.Duration
+
+	lock       sync.Mutex
+	conn       net.Conn
+	w          *bufio.Writer
+	pingsOut   int
+	maxPayload int
+	closed     bool
+	reconning  bool
+	subs       map[int]*natsSub
+	nextSid    int
+	inbox      string
+	inboxSid   int
+	requests   map[string]chan []byte
+
+	// wlock serializes the writes to w. It may be taken with lock
+	// held, but lock is never taken with it held, so that a slow
+	// write does not block the reads.
+	wlock sync.Mutex
+}
+
+func randomToken() string {
+	var b [12]byte
+	io.ReadFull(rand.Reader, b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// newNatsConn does not connect until the first publish or subscription.
+// rawurl is "nats://[user:password@]host[:port]", or
+// "nats://token@host[:port]". The scheme "tls" connects over TLS.
+func newNatsConn(rawurl, name string) (ret *natsConn, err error) {
+	if !strings.Contains(rawurl, "://") {
+		rawurl = "nats://" + rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "nats" && u.Scheme != "tcp" && u.Scheme != "tls" {
+		err = fmt.Errorf("nats: unsupported scheme %v", u.Scheme)
+		return
+	}
+	ret = new(natsConn)
+	if u.Scheme == "tls" {
+		ret.tlsConfig = new(tls.Config)
+	}
+	ret.pingInterval = natsPingInterval
+	ret.addr = u.Host
+	if len(u.Port()) == 0 {
+		ret.addr = net.JoinHostPort(u.Hostname(), natsDefaultPort)
+	}
+	if u.User != nil {
+		if p, ok := u.User.Password(); ok {
+			ret.user = u.User.Username()
+			ret.password = p
+		} else {
+			ret.token = u.User.Username()
+		}
+	}
+	ret.name = name
+	ret.subs = make(map[int]*natsSub, 4)
+	ret.requests = make(map[string]chan []byte, 16)
+	ret.inbox = "_INBOX." + randomToken()
+	return
+}
+
+// connectLocked dials the server and subscribes again. It should be
+// called with the lock held.
+func (self *natsConn) connectLocked() error {
+	if self.closed {
+		return ErrNatsClosed
+	}
+	if self.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", self.addr, natsDialTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(natsDialTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("nats: unexpected greeting %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		MaxPayload  int  `json:"max_payload"`
+		TLSRequired bool `json:"tls_required"`
+	}
+	json.Unmarshal([]byte(line[5:]), &info)
+	if self.tlsConfig != nil || info.TLSRequired {
+		conf := new(tls.Config)
+		if self.tlsConfig != nil {
+			conf = self.tlsConfig.Clone()
+		}
+		if len(conf.ServerName) == 0 {
+			conf.ServerName, _, _ = net.SplitHostPort(self.addr)
+		}
+		tc := tls.Client(conn, conf)
+		if err = tc.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tc
+		r = bufio.NewReader(conn)
+	}
+
+	opts := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"lang":     "go",
+		"name":     self.name,
+	}
+	if len(self.user) > 0 {
+		opts["user"] = self.user
+		opts["pass"] = self.password
+	}
+	if len(self.token) > 0 {
+		opts["auth_token"] = self.token
+	}
+	data, _ := json.Marshal(opts)
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "CONNECT %s\r\nPING\r\n", data)
+	err = w.Flush()
+	if err == nil {
+		line, err = r.ReadString('\n')
+	}
+	if err == nil && !strings.HasPrefix(line, "PONG") {
+		err = fmt.Errorf("nats: %v", strings.TrimSpace(line))
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	self.conn = conn
+	self.w = w
+	self.pingsOut = 0
+	self.maxPayload = info.MaxPayload
+	err = self.writeTo(conn, w, func(w *bufio.Writer) {
+		for sid, sub := range self.subs {
+			sub.write(w, sid)
+		}
+	})
+	if err != nil {
+		self.dropLocked(conn)
+		return err
+	}
+	go self.read(conn, r)
+	go self.ping(conn, w)
+	return nil
+}
+
+// writeTo writes to w, the writer of conn, with a deadline. The
+// caller drops conn if it fails.
+func (self *natsConn) writeTo(conn net.Conn, w *bufio.Writer, f func(w *bufio.Writer)) error {
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(natsWriteTimeout))
+	f(w)
+	return w.Flush()
+}
+
+// write writes to the current connection, without the lock held, and
+// drops the connection if it fails.
+func (self *natsConn) write(f func(w *bufio.Writer)) error {
+	self.lock.Lock()
+	conn, w := self.conn, self.w
+	self.lock.Unlock()
+	if conn == nil {
+		return errNatsDropped
+	}
+	err := self.writeTo(conn, w, f)
+	if err != nil {
+		self.lock.Lock()
+		self.dropLocked(conn)
+		self.lock.Unlock()
+	}
+	return err
+}
+
+// ping pings the server until conn is dropped, and drops it if the
+// server does not answer.
+func (self *natsConn) ping(conn net.Conn, w *bufio.Writer) {
+	ticker := time.NewTicker(self.pingInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		self.lock.Lock()
+		if self.conn != conn {
+			self.lock.Unlock()
+			return
+		}
+		self.pingsOut++
+		if self.pingsOut > natsMaxPingsOut {
+			self.dropLocked(conn)
+			self.lock.Unlock()
+			return
+		}
+		self.lock.Unlock()
+		err := self.writeTo(conn, w, func(w *bufio.Writer) {
+			w.WriteString("PING\r\n")
+		})
+		if err != nil {
+			self.lock.Lock()
+			self.dropLocked(conn)
+			self.lock.Unlock()
+			return
+		}
+	}
+}
+
+// dropLocked forgets conn, and reconnects in the background if
+// there are subscriptions to keep.
+func (self *natsConn) dropLocked(conn net.Conn) {
+	if self.conn != conn {
+		return
+	}
+	conn.Close()
+	self.conn = nil
+	self.w = nil
+	if self.closed || self.reconning || len(self.subs) == 0 {
+		return
+	}
+	self.reconning = true
+	go self.reconnect()
+}
+
+func (self *natsConn) reconnect() {
+	wait := 100 * time.Millisecond
+	for {
+		time.Sleep(wait)
+		self.lock.Lock()
+		err := self.connectLocked()
+		if err == nil || self.closed {
+			self.reconning = false
+			self.lock.Unlock()
+			return
+		}
+		self.lock.Unlock()
+		wait *= 2
+		if wait > natsMaxReconnWait {
+			wait = natsMaxReconnWait
+		}
+	}
+}
+
+func (self *natsConn) read(conn net.Conn, r *bufio.Reader) {
+	err := self.readLoop(conn, r)
+	if err != nil {
+		self.lock.Lock()
+		self.dropLocked(conn)
+		self.lock.Unlock()
+	}
+}
+
+func (self *natsConn) readLoop(conn net.Conn, r *bufio.Reader) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		op := line
+		args := ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			op = line[:i]
+			args = line[i+1:]
+		}
+		switch strings.ToUpper(op) {
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			f := strings.Fields(args)
+			if len(f) != 3 && len(f) != 4 {
+				return errNatsBadMessage
+			}
+			size, err := strconv.Atoi(f[len(f)-1])
+			if err != nil || size < 0 {
+				return errNatsBadMessage
+			}
+			data := make([]byte, size+2)
+			_, err = io.ReadFull(r, data)
+			if err != nil {
+				return err
+			}
+			sid, _ := strconv.Atoi(f[1])
+			reply := ""
+			if len(f) == 4 {
+				reply = f[2]
+			}
+			self.dispatch(f[0], sid, reply, data[:size])
+		case "PING":
+			self.lock.Lock()
+			w := self.w
+			current := self.conn == conn
+			self.lock.Unlock()
+			if current {
+				err := self.writeTo(conn, w, func(w *bufio.Writer) {
+					w.WriteString("PONG\r\n")
+				})
+				if err != nil {
+					return err
+				}
+			}
+		case "PONG":
+			self.lock.Lock()
+			if self.conn == conn {
+				self.pingsOut = 0
+			}
+			self.lock.Unlock()
+		case "-ERR":
+			return fmt.Errorf("nats: %v", args)
+		}
+	}
+}
+
+func (self *natsConn) dispatch(subject string, sid int, reply string, data []byte) {
+	self.lock.Lock()
+	if sid == self.inboxSid && strings.HasPrefix(subject, self.inbox+".") {
+		ch := self.requests[subject[len(self.inbox)+1:]]
+		self.lock.Unlock()
+		if ch != nil {
+			select {
+			case ch <- data:
+			default:
+			}
+		}
+		return
+	}
+	sub := self.subs[sid]
+	self.lock.Unlock()
+	if sub != nil {
+		go sub.handler(subject, reply, data)
+	}
+}
+
+func (self *natsConn) subscribeLocked(subject, queue string, handler natsHandler) (sid int, err error) {
+	err = self.connectLocked()
+	if err != nil {
+		return
+	}
+	self.nextSid++
+	sid = self.nextSid
+	sub := &natsSub{subject, queue, handler}
+	self.subs[sid] = sub
+	err = self.writeTo(self.conn, self.w, func(w *bufio.Writer) {
+		sub.write(w, sid)
+	})
+	if err != nil {
+		self.dropLocked(self.conn)
+		err = nil
+	}
+	return
+}
+
+// subscribe calls handler, in its own goroutine, for every message
+// published to subject. If queue is not empty, a message is only
+// given to one of the subscribers sharing the queue.
+func (self *natsConn) subscribe(subject, queue string, handler natsHandler) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, err := self.subscribeLocked(subject, queue, handler)
+	return err
+}
+
+// publish writes the message without the lock held, so that the
+// replies and the messages of the subscriptions are dispatched while
+// the write is blocked.
+func (self *natsConn) publish(subject, reply string, data []byte) error {
+	self.lock.Lock()
+	err := self.connectLocked()
+	maxPayload := self.maxPayload
+	self.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if maxPayload > 0 && len(data) > maxPayload {
+		return ErrPayloadTooBig
+	}
+	return self.write(func(w *bufio.Writer) {
+		if len(reply) > 0 {
+			fmt.Fprintf(w, "PUB %v %v %v\r\n", subject, reply, len(data))
+		} else {
+			fmt.Fprintf(w, "PUB %v %v\r\n", subject, len(data))
+		}
+		w.Write(data)
+		w.WriteString("\r\n")
+	})
+}
+
+// request publishes data to subject, and returns the replies received
+// within the timeout, up to n of them.
+func (self *natsConn) request(subject string, data []byte, n int, timeout time.Duration) (replies [][]byte, err error) {
+	token := randomToken()
+	ch := make(chan []byte, n)
+	self.lock.Lock()
+	if self.inboxSid == 0 {
+		// Replies are not handled by dispatch until inboxSid is set.
+		self.inboxSid, err = self.subscribeLocked(self.inbox+".*", "", nil)
+		if err != nil {
+			self.inboxSid = 0
+			self.lock.Unlock()
+			return
+		}
+	}
+	self.requests[token] = ch
+	self.lock.Unlock()
+	defer func() {
+		self.lock.Lock()
+		delete(self.requests, token)
+		self.lock.Unlock()
+	}()
+
+	err = self.publish(subject, self.inbox+"."+token, data)
+	if err != nil {
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for len(replies) < n {
+		select {
+		case r := <-ch:
+			replies = append(replies, r)
+		case <-timer.C:
+			if len(replies) == 0 {
+				err = ErrNatsTimeout
+			}
+			return
+		}
+	}
+	return
+}
+
+func (self *natsConn) close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	if self.conn != nil {
+		self.conn.Close()
+		self.conn = nil
+		self.w = nil
+	}
+}
@@ -0,0 +1,470 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cluster
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeNatsClient struct {
+	lock sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+	subs map[string]string
+}
+
+// fakeNatsServer speaks just enough of the NATS protocol for
+// natsConn. Queue groups are ignored. If tlsConfig is not nil, it
+// requires TLS. It does not answer the pings while muted.
+type fakeNatsServer struct {
+	ln      net.Listener
+	lock    sync.Mutex
+	clients map[*fakeNatsClient]bool
+	muted   int32
+
+	// Protected by lock.
+	tlsConfig *tls.Config
+}
+
+func newFakeNatsServer(t *testing.T) *fakeNatsServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := &fakeNatsServer{ln: ln, clients: make(map[*fakeNatsClient]bool)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ret.serve(conn)
+		}
+	}()
+	return ret
+}
+
+func (self *fakeNatsServer) url() string {
+	return "nats://" + self.ln.Addr().String()
+}
+
+func subjectMatches(pattern, subject string) bool {
+	p := strings.Split(pattern, ".")
+	s := strings.Split(subject, ".")
+	for i, tok := range p {
+		if tok == ">" {
+			return len(s) > i
+		}
+		if i >= len(s) || (tok != "*" && tok != s[i]) {
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
+
+func (self *fakeNatsServer) serve(conn net.Conn) {
+	c := &fakeNatsClient{conn: conn, w: bufio.NewWriter(conn), subs: make(map[string]string)}
+	self.lock.Lock()
+	self.clients[c] = true
+	self.lock.Unlock()
+	defer func() {
+		self.lock.Lock()
+		delete(self.clients, c)
+		self.lock.Unlock()
+		conn.Close()
+	}()
+	self.lock.Lock()
+	tlsConfig := self.tlsConfig
+	self.lock.Unlock()
+	if tlsConfig == nil {
+		c.w.WriteString("INFO {\"max_payload\":4096}\r\n")
+		c.w.Flush()
+	} else {
+		c.w.WriteString("INFO {\"max_payload\":4096,\"tls_required\":true}\r\n")
+		c.w.Flush()
+		tc := tls.Server(conn, tlsConfig)
+		if tc.Handshake() != nil {
+			return
+		}
+		c.lock.Lock()
+		c.conn = tc
+		c.w = bufio.NewWriter(tc)
+		c.lock.Unlock()
+		conn = tc
+	}
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "PING":
+			if atomic.LoadInt32(&self.muted) != 0 {
+				continue
+			}
+			c.lock.Lock()
+			c.w.WriteString("PONG\r\n")
+			c.w.Flush()
+			c.lock.Unlock()
+		case "SUB":
+			c.lock.Lock()
+			c.subs[f[len(f)-1]] = f[1]
+			c.lock.Unlock()
+		case "PUB":
+			size, _ := strconv.Atoi(f[len(f)-1])
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			reply := ""
+			if len(f) == 4 {
+				reply = f[2] + " "
+			}
+			self.publish(f[1], reply, data[:size])
+		}
+	}
+}
+
+func (self *fakeNatsServer) publish(subject, reply string, data []byte) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for c, _ := range self.clients {
+		c.lock.Lock()
+		for sid, pattern := range c.subs {
+			if subjectMatches(pattern, subject) {
+				fmt.Fprintf(c.w, "MSG %v %v %v%v\r\n", subject, sid, reply, len(data))
+				c.w.Write(data)
+				c.w.WriteString("\r\n")
+				c.w.Flush()
+			}
+		}
+		c.lock.Unlock()
+	}
+}
+
+// kick closes all client connections.
+func (self *fakeNatsServer) kick() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for c, _ := range self.clients {
+		c.conn.Close()
+	}
+}
+
+type fakeReceiver struct {
+	node         string
+	nrDelivered  int32
+	nrDisconnect int32
+}
+
+func (self *fakeReceiver) DeliverLocal(service, username string, mc *proto.MessageContainer, extra map[string]string) []*Result {
+	atomic.AddInt32(&self.nrDelivered, 1)
+	return []*Result{&Result{ConnId: self.node + ":" + username, Visible: true}}
+}
+
+func (self *fakeReceiver) DisconnectLocal(service, username, connId string, revoke bool) int {
+	atomic.AddInt32(&self.nrDisconnect, 1)
+	return 2
+}
+
+func newTestNode(t *testing.T, url, node string) (*NatsTransport, *fakeReceiver) {
+	tr, err := NewNatsTransport(url, "", 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := &fakeReceiver{node: node}
+	if node != "" {
+		err = tr.Serve(node, recv)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tr, recv
+}
+
+func testMessage() *proto.MessageContainer {
+	return &proto.MessageContainer{Id: "1", Message: &proto.Message{Body: []byte("hello")}}
+}
+
+func TestNatsTransport(t *testing.T) {
+	srv := newFakeNatsServer(t)
+	defer srv.ln.Close()
+	var _ Endpoint = &NatsTransport{}
+	var _ Multicaster = &NatsTransport{}
+
+	t1, r1 := newTestNode(t, srv.url(), "node1:8080")
+	defer t1.Close()
+	t2, r2 := newTestNode(t, srv.url(), "node2:8080")
+	defer t2.Close()
+	t3, r3 := newTestNode(t, srv.url(), "node3:8080")
+	defer t3.Close()
+
+	res, err := t1.Deliver("node2:8080", "service", "user", testMessage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].ConnId != "node2:8080:user" {
+		t.Errorf("bad results: %+v", res)
+	}
+	if r2.nrDelivered != 1 || r3.nrDelivered != 0 || r1.nrDelivered != 0 {
+		t.Errorf("delivered to the wrong nodes")
+	}
+
+	n, err := t1.Disconnect("node3:8080", "service", "user", "", false)
+	if err != nil || n != 2 || atomic.LoadInt32(&r3.nrDisconnect) != 1 {
+		t.Errorf("bad disconnect: %v %v", n, err)
+	}
+
+	_, err = t1.Deliver("nosuchnode", "service", "user", testMessage(), nil)
+	if err != ErrNatsTimeout {
+		t.Errorf("should time out: %v", err)
+	}
+
+	mres, errs := t1.DeliverToNodes([]string{"node2:8080", "node3:8080", "nosuchnode"}, "service", "user", testMessage(), nil)
+	if len(mres["node2:8080"]) != 1 || len(mres["node3:8080"]) != 1 {
+		t.Errorf("bad multicast results: %+v", mres)
+	}
+	if len(errs) != 1 || errs["nosuchnode"] == nil {
+		t.Errorf("bad multicast errors: %v", errs)
+	}
+	if atomic.LoadInt32(&r1.nrDelivered) != 0 {
+		t.Errorf("multicast delivered to a node not asked for")
+	}
+}
+
+type fakeSender struct {
+	ttl time.Duration
+}
+
+func (self *fakeSender) SendFromFeed(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) (res []*Result, err error) {
+	if username == "nobody" {
+		err = errors.New("cannot cache")
+		return
+	}
+	self.ttl = ttl
+	mc.Id = "cached"
+	res = []*Result{&Result{ConnId: "node2:" + username, Visible: true}}
+	return
+}
+
+func TestNatsFeed(t *testing.T) {
+	srv := newFakeNatsServer(t)
+	defer srv.ln.Close()
+	var _ Feed = &NatsTransport{}
+
+	t2, r2 := newTestNode(t, srv.url(), "")
+	defer t2.Close()
+	sender := new(fakeSender)
+	if err := t2.ServeFeed(sender); err != nil {
+		t.Fatal(err)
+	}
+	t1, _ := newTestNode(t, srv.url(), "node1")
+	defer t1.Close()
+
+	mc := &proto.MessageContainer{Message: &proto.Message{Body: []byte("hello")}}
+	res, err := t1.Publish("service", "user", mc, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.Id != "cached" || len(res) != 1 || res[0].ConnId != "node2:user" || sender.ttl != time.Hour {
+		t.Errorf("bad feed: %v %+v %v", mc.Id, res, sender.ttl)
+	}
+	if atomic.LoadInt32(&r2.nrDelivered) != 0 {
+		t.Errorf("the feed delivered to the local connections")
+	}
+	_, err = t1.Publish("service", "nobody", testMessage(), nil, time.Hour)
+	if err == nil || err.Error() != "cannot cache" {
+		t.Errorf("bad error: %v", err)
+	}
+}
+
+func TestNatsReconnect(t *testing.T) {
+	srv := newFakeNatsServer(t)
+	defer srv.ln.Close()
+	t1, _ := newTestNode(t, srv.url(), "")
+	defer t1.Close()
+	t2, _ := newTestNode(t, srv.url(), "node2")
+	defer t2.Close()
+
+	_, err := t1.Deliver("node2", "service", "user", testMessage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.kick()
+	for i := 0; i < 50; i++ {
+		_, err = t1.Deliver("node2", "service", "user", testMessage(), nil)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("not reconnected: %v", err)
+	}
+}
+
+func TestNatsPayloadTooBig(t *testing.T) {
+	srv := newFakeNatsServer(t)
+	defer srv.ln.Close()
+	t1, _ := newTestNode(t, srv.url(), "")
+	defer t1.Close()
+	mc := &proto.MessageContainer{Message: &proto.Message{Body: make([]byte, 8192)}}
+	_, err := t1.Deliver("node2", "service", "user", mc, nil)
+	if err != ErrPayloadTooBig {
+		t.Errorf("should be too big: %v", err)
+	}
+}
+
+// selfSignedTLS returns the config of a server with a self-signed
+// certificate for 127.0.0.1, and the one of a client trusting it.
+func selfSignedTLS(t *testing.T) (srv, cli *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "nats"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	srv = &tls.Config{Certificates: []tls.Certificate{tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}}
+	cli = &tls.Config{RootCAs: roots}
+	return
+}
+
+func TestNatsTLS(t *testing.T) {
+	srv := newFakeNatsServer(t)
+	defer srv.ln.Close()
+	srvConf, cliConf := selfSignedTLS(t)
+	srv.lock.Lock()
+	srv.tlsConfig = srvConf
+	srv.lock.Unlock()
+
+	t1, err := NewNatsTransport(strings.Replace(srv.url(), "nats://", "tls://", 1), "", 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer t1.Close()
+	// The certificate is not trusted by the system.
+	if _, err = t1.Deliver("node2", "service", "user", testMessage(), nil); err == nil {
+		t.Errorf("should not trust the server")
+	}
+	t1.SetTLSConfig(cliConf)
+	t2, err := NewNatsTransport(srv.url(), "", 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer t2.Close()
+	// The server requires TLS.
+	t2.SetTLSConfig(cliConf)
+	if err = t2.Serve("node2", &fakeReceiver{node: "node2"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := t1.Deliver("node2", "service", "user", testMessage(), nil)
+	if err != nil || len(res) != 1 {
+		t.Errorf("bad results: %v %v", res, err)
+	}
+}
+
+func TestNatsPing(t *testing.T) {
+	srv := newFakeNatsServer(t)
+	defer srv.ln.Close()
+	t1, _ := newTestNode(t, srv.url(), "")
+	defer t1.Close()
+	t2, err := NewNatsTransport(srv.url(), "", 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer t2.Close()
+	t2.conn.pingInterval = 20 * time.Millisecond
+	if err = t2.Serve("node2", &fakeReceiver{node: "node2"}); err != nil {
+		t.Fatal(err)
+	}
+	t2.conn.lock.Lock()
+	conn := t2.conn.conn
+	t2.conn.lock.Unlock()
+
+	// The pings are answered.
+	time.Sleep(100 * time.Millisecond)
+	t2.conn.lock.Lock()
+	kept := t2.conn.conn == conn
+	t2.conn.lock.Unlock()
+	if !kept {
+		t.Fatalf("the connection is dropped")
+	}
+
+	atomic.StoreInt32(&srv.muted, 1)
+	dropped := false
+	for i := 0; i < 50 && !dropped; i++ {
+		time.Sleep(20 * time.Millisecond)
+		t2.conn.lock.Lock()
+		dropped = t2.conn.conn != conn
+		t2.conn.lock.Unlock()
+	}
+	if !dropped {
+		t.Fatalf("the connection is kept without pongs")
+	}
+	atomic.StoreInt32(&srv.muted, 0)
+	for i := 0; i < 100; i++ {
+		_, err = t1.Deliver("node2", "service", "user", testMessage(), nil)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("not reconnected: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cluster
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/redispool"
+	"strings"
+)
+
+type redisLocator struct {
+	pool *redis.Pool
+}
+
+func NewRedisLocator(addr, password string, db int) Locator {
+	pool := redispool.New(addr, password, db)
+
+	ret := new(redisLocator)
+	ret.pool = pool
+	return ret
+}
+
+func connsKey(service, username string) string {
+	return fmt.Sprintf("cluster:conns:%v:%v", service, username)
+}
+
+func nodeKey(node string) string {
+	return fmt.Sprintf("cluster:node:%v", node)
+}
+
+func nodeMember(service, username, connId string) string {
+	return fmt.Sprintf("%v:%v:%v", service, username, connId)
+}
+
+func (self *redisLocator) Register(node, service, username, connId string) error {
+	if len(node) == 0 {
+		return ErrBadNode
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HSET", connsKey(service, username), connId, node)
+	conn.Send("SADD", nodeKey(node), nodeMember(service, username, connId))
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (self *redisLocator) Unregister(node, service, username, connId string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HDEL", connsKey(service, username), connId)
+	conn.Send("SREM", nodeKey(node), nodeMember(service, username, connId))
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (self *redisLocator) Locate(service, username string) (nodes []string, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	reply, err := redis.Values(conn.Do("HGETALL", connsKey(service, username)))
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool, len(reply)/2)
+	nodes = make([]string, 0, len(reply)/2)
+	for i := 1; i < len(reply); i += 2 {
+		node, e := redis.String(reply[i], nil)
+		if e != nil {
+			err = e
+			nodes = nil
+			return
+		}
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		nodes = append(nodes, node)
+	}
+	return
+}
+
+func (self *redisLocator) Purge(node string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	members, err := redis.Strings(conn.Do("SMEMBERS", nodeKey(node)))
+	if err != nil {
+		return err
+	}
+	conn.Send("MULTI")
+	for _, m := range members {
+		elems := strings.SplitN(m, ":", 3)
+		if len(elems) != 3 {
+			continue
+		}
+		conn.Send("HDEL", connsKey(elems[0], elems[1]), elems[2])
+	}
+	conn.Send("DEL", nodeKey(node))
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// Ping tells whether redis could be reached.
+func (self *redisLocator) Ping() error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cluster
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"testing"
+)
+
+func getLocator() Locator {
+	db := 1
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	c.Do("SELECT", db)
+	c.Do("FLUSHDB")
+	c.Close()
+	return NewRedisLocator("", "", db)
+}
+
+func TestRegisterThenLocate(t *testing.T) {
+	loc := getLocator()
+	srv := "srv"
+	usr := "usr"
+
+	loc.Register("node1:8088", srv, usr, "conn1")
+	loc.Register("node2:8088", srv, usr, "conn2")
+	loc.Register("node2:8088", srv, usr, "conn3")
+
+	nodes, err := loc.Locate(srv, usr)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	sort.Strings(nodes)
+	if len(nodes) != 2 || nodes[0] != "node1:8088" || nodes[1] != "node2:8088" {
+		t.Errorf("bad nodes: %v", nodes)
+	}
+
+	loc.Unregister("node1:8088", srv, usr, "conn1")
+	nodes, err = loc.Locate(srv, usr)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if len(nodes) != 1 || nodes[0] != "node2:8088" {
+		t.Errorf("bad nodes: %v", nodes)
+	}
+
+	err = loc.Purge("node2:8088")
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	nodes, err = loc.Locate(srv, usr)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if len(nodes) != 0 {
+		t.Errorf("nodes should be purged: %v", nodes)
+	}
+}
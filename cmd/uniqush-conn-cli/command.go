@@ -0,0 +1,281 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrUnknownCommand = errors.New("unknown command; try help")
+var ErrBadArgs = errors.New("bad arguments; try help")
+
+const helpText = `Commands:
+  send <text>                 send a message to the server
+  fwd [service:]user <text>   forward a message to another user
+  header [key=value ...]      set the header of the following messages; clear it if empty
+  visible on|off              set the visibility
+  get <id> [id ...]           retrieve cached messages
+  cached [id ...]             request all cached messages except the given ones
+  seq <from> [to]             request cached messages by sequence number
+  ack <id>                    acknowledge a message
+  read <id>                   mark a message as read
+  sub key=value ...           subscribe to the push service
+  unsub key=value ...         unsubscribe from the push service
+  block [service:]user        drop the messages forwarded by the user
+  unblock [service:]user      accept the messages forwarded by the user again
+  config <digest> <compress> [field ...]
+                              change the digest and compression thresholds
+  help
+  quit
+`
+
+type session struct {
+	conn   client.Conn
+	ttl    time.Duration
+	header map[string]string
+	out    io.Writer
+}
+
+func newSession(conn client.Conn, ttl time.Duration, out io.Writer) *session {
+	ret := new(session)
+	ret.conn = conn
+	ret.ttl = ttl
+	ret.out = out
+	return ret
+}
+
+func (self *session) newMessage(text string) *proto.Message {
+	msg := new(proto.Message)
+	if len(self.header) > 0 {
+		msg.Header = make(map[string]string, len(self.header))
+		for k, v := range self.header {
+			msg.Header[k] = v
+		}
+	}
+	if len(text) > 0 {
+		msg.Body = []byte(text)
+	}
+	return msg
+}
+
+func parseParams(args []string) (params map[string]string, err error) {
+	params = make(map[string]string, len(args))
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			err = ErrBadArgs
+			return
+		}
+		params[kv[0]] = kv[1]
+	}
+	return
+}
+
+// splitCommand returns the command, its first n arguments
+// and the text following them.
+func splitCommand(line string, n int) (name string, args []string, text string) {
+	text = strings.TrimSpace(line)
+	for i := 0; i <= n && len(text) > 0; i++ {
+		field := text
+		text = ""
+		if j := strings.IndexAny(field, " \t"); j >= 0 {
+			field, text = field[:j], strings.TrimSpace(field[j:])
+		}
+		if i == 0 {
+			name = field
+		} else {
+			args = append(args, field)
+		}
+	}
+	return
+}
+
+// execute runs a line typed by the user. quit is true if
+// the user wants to leave.
+func (self *session) execute(line string) (quit bool, err error) {
+	name, _, _ := splitCommand(line, 0)
+	switch name {
+	case "":
+		return
+	case "quit", "exit":
+		quit = true
+		return
+	case "help":
+		fmt.Fprint(self.out, helpText)
+		return
+	case "send":
+		_, _, text := splitCommand(line, 0)
+		msg := self.newMessage(text)
+		if msg.IsEmpty() {
+			err = ErrBadArgs
+			return
+		}
+		err = self.conn.SendMessageToServer(msg)
+		return
+	case "fwd":
+		_, args, text := splitCommand(line, 1)
+		if len(args) != 1 {
+			err = ErrBadArgs
+			return
+		}
+		service := self.conn.Service()
+		receiver := args[0]
+		if i := strings.Index(receiver, ":"); i >= 0 {
+			service = receiver[:i]
+			receiver = receiver[i+1:]
+		}
+		msg := self.newMessage(text)
+		if len(receiver) == 0 || msg.IsEmpty() {
+			err = ErrBadArgs
+			return
+		}
+		err = self.conn.SendMessageToUser(service, receiver, msg, self.ttl)
+		return
+	}
+
+	fields := strings.Fields(line)
+	args := fields[1:]
+	switch name {
+	case "header":
+		self.header, err = parseParams(args)
+	case "visible":
+		if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+			err = ErrBadArgs
+			return
+		}
+		err = self.conn.SetVisibility(args[0] == "on")
+	case "get":
+		if len(args) == 0 {
+			err = ErrBadArgs
+			return
+		}
+		err = self.conn.RequestMessage(args...)
+	case "ack", "read":
+		if len(args) != 1 {
+			err = ErrBadArgs
+			return
+		}
+		switch name {
+		case "ack":
+			err = self.conn.Ack(args[0])
+		case "read":
+			err = self.conn.MarkRead(args[0])
+		}
+	case "cached":
+		err = self.conn.RequestAllCachedMessages(args...)
+	case "seq":
+		if len(args) < 1 || len(args) > 2 {
+			err = ErrBadArgs
+			return
+		}
+		var from, to uint64
+		from, err = strconv.ParseUint(args[0], 10, 64)
+		if err == nil && len(args) == 2 {
+			to, err = strconv.ParseUint(args[1], 10, 64)
+		}
+		if err != nil {
+			err = ErrBadArgs
+			return
+		}
+		err = self.conn.RequestMessagesBySeq(from, to)
+	case "sub", "unsub":
+		var params map[string]string
+		params, err = parseParams(args)
+		if err != nil || len(params) == 0 {
+			err = ErrBadArgs
+			return
+		}
+		if name == "sub" {
+			err = self.conn.Subscribe(params)
+		} else {
+			err = self.conn.Unsubscribe(params)
+		}
+	case "block", "unblock":
+		if len(args) != 1 {
+			err = ErrBadArgs
+			return
+		}
+		service := ""
+		user := args[0]
+		if i := strings.Index(user, ":"); i >= 0 {
+			service = user[:i]
+			user = user[i+1:]
+		}
+		if len(user) == 0 {
+			err = ErrBadArgs
+			return
+		}
+		if name == "block" {
+			err = self.conn.Block(user, service)
+		} else {
+			err = self.conn.Unblock(user, service)
+		}
+	case "config":
+		if len(args) < 2 {
+			err = ErrBadArgs
+			return
+		}
+		var digest, compress int
+		digest, err = strconv.Atoi(args[0])
+		if err == nil {
+			compress, err = strconv.Atoi(args[1])
+		}
+		if err != nil {
+			err = ErrBadArgs
+			return
+		}
+		err = self.conn.Config(digest, compress, args[2:]...)
+	default:
+		err = ErrUnknownCommand
+	}
+	return
+}
+
+func printMessage(out io.Writer, mc *proto.MessageContainer) {
+	fmt.Fprintf(out, "< [id=%v][seq=%v]", mc.Id, mc.Seq)
+	if len(mc.Sender) > 0 {
+		fmt.Fprintf(out, "[sender=%v:%v]", mc.SenderService, mc.Sender)
+	}
+	if mc.Message != nil {
+		for k, v := range mc.Message.Header {
+			fmt.Fprintf(out, "[%v=%v]", k, v)
+		}
+		if len(mc.Message.Body) > 0 {
+			fmt.Fprintf(out, " %v", string(mc.Message.Body))
+		}
+	}
+	fmt.Fprintln(out)
+}
+
+func printDigest(out io.Writer, digest *client.Digest) {
+	fmt.Fprintf(out, "< digest [id=%v][seq=%v][size=%v]", digest.MsgId, digest.Seq, digest.Size)
+	if len(digest.Sender) > 0 {
+		fmt.Fprintf(out, "[sender=%v:%v]", digest.SenderService, digest.Sender)
+	}
+	for k, v := range digest.Info {
+		fmt.Fprintf(out, "[%v=%v]", k, v)
+	}
+	fmt.Fprintln(out)
+}
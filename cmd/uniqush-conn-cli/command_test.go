@@ -0,0 +1,128 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"testing"
+	"time"
+)
+
+// fakeConn records the calls. Calling any other method panics.
+type fakeConn struct {
+	client.Conn
+	calls []string
+}
+
+func (self *fakeConn) Service() string {
+	return "service"
+}
+
+func (self *fakeConn) record(format string, v ...interface{}) error {
+	self.calls = append(self.calls, fmt.Sprintf(format, v...))
+	return nil
+}
+
+func (self *fakeConn) SendMessageToServer(msg *proto.Message) error {
+	return self.record("server %v %s", msg.Header, msg.Body)
+}
+
+func (self *fakeConn) SendMessageToUser(service, receiver string, msg *proto.Message, ttl time.Duration) error {
+	return self.record("fwd %v %v %v %s %v", service, receiver, msg.Header, msg.Body, ttl)
+}
+
+func (self *fakeConn) SetVisibility(v bool) error {
+	return self.record("visible %v", v)
+}
+
+func (self *fakeConn) RequestMessagesBySeq(from, to uint64) error {
+	return self.record("seq %v %v", from, to)
+}
+
+func (self *fakeConn) Subscribe(params map[string]string) error {
+	return self.record("sub %v", params)
+}
+
+func (self *fakeConn) Block(username, service string) error {
+	return self.record("block %q %q", service, username)
+}
+
+func (self *fakeConn) Unblock(username, service string) error {
+	return self.record("unblock %q %q", service, username)
+}
+
+func (self *fakeConn) Config(digestThreshold, compressThreshold int, digestFields ...string) error {
+	return self.record("config %v %v %v", digestThreshold, compressThreshold, digestFields)
+}
+
+func TestExecute(t *testing.T) {
+	conn := new(fakeConn)
+	sess := newSession(conn, time.Hour, new(bytes.Buffer))
+	lines := []string{
+		"send hello world",
+		"header title=hi",
+		"fwd  alice  how are you",
+		"fwd other:bob hey",
+		"header",
+		"visible off",
+		"seq 3",
+		"sub pushservicetype=gcm regid=x",
+		"block eve",
+		"unblock other:eve",
+		"config 512 -1 title",
+		"",
+	}
+	expected := []string{
+		"server map[] hello world",
+		"fwd service alice map[title:hi] how are you 1h0m0s",
+		"fwd other bob map[title:hi] hey 1h0m0s",
+		"visible false",
+		"seq 3 0",
+		"sub map[pushservicetype:gcm regid:x]",
+		"block \"\" \"eve\"",
+		"unblock \"other\" \"eve\"",
+		"config 512 -1 [title]",
+	}
+	for _, line := range lines {
+		quit, err := sess.execute(line)
+		if err != nil || quit {
+			t.Errorf("%v: quit=%v err=%v", line, quit, err)
+		}
+	}
+	if len(conn.calls) != len(expected) {
+		t.Fatalf("bad calls: %q", conn.calls)
+	}
+	for i, call := range conn.calls {
+		if call != expected[i] {
+			t.Errorf("expected %q; got %q", expected[i], call)
+		}
+	}
+
+	bad := []string{"send", "fwd alice", "visible maybe", "seq x", "sub x", "block", "block srv:", "config 1", "foo"}
+	for _, line := range bad {
+		if _, err := sess.execute(line); err == nil {
+			t.Errorf("%v should fail", line)
+		}
+	}
+	if quit, _ := sess.execute("quit"); !quit {
+		t.Errorf("quit should quit")
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// uniqush-conn-cli is an interactive client for debugging a
+// uniqush-conn server. Commands are read from stdin, one per line.
+//
+// Usage:
+//
+//	uniqush-conn-cli [flags] [address]
+package main
+
+import (
+	"bufio"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+)
+
+func loadRSAPublicKey(keyFileName string) (rsapub *rsa.PublicKey, err error) {
+	keyData, err := ioutil.ReadFile(keyFileName)
+	if err != nil {
+		return
+	}
+	b, _ := pem.Decode(keyData)
+	if b == nil {
+		err = fmt.Errorf("No key in the file")
+		return
+	}
+	key, err := x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		return
+	}
+	rsapub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		err = fmt.Errorf("Not an RSA public key")
+		return
+	}
+	return
+}
+
+var argvPubKey = flag.String("key", "pub.pem", "public key file")
+var argvService = flag.String("s", "service", "service")
+var argvUsername = flag.String("u", "username", "username")
+var argvPassword = flag.String("p", "", "password")
+var argvDigestThrd = flag.Int("d", 512, "digest threshold")
+var argvCompressThrd = flag.Int("c", 1024, "compress threshold")
+var argvTimeout = flag.Duration("timeout", 3*time.Second, "handshake timeout")
+var argvTTL = flag.Duration("ttl", time.Hour, "TTL of forwarded messages")
+var argvRetrieve = flag.Bool("retrieve", true, "retrieve the message on receiving a digest")
+var argvWait = flag.Duration("wait", time.Second, "time to keep receiving after stdin is closed")
+var argvVerbose = flag.Bool("v", false, "dump every command sent or received to stderr")
+
+func receive(conn client.Conn, out io.Writer, done chan<- bool) {
+	defer close(done)
+	for {
+		mc, err := conn.ReceiveMessage()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+			return
+		}
+		printMessage(out, mc)
+	}
+}
+
+func receiveDigests(conn client.Conn, out io.Writer, digestChan <-chan *client.Digest) {
+	for digest := range digestChan {
+		printDigest(out, digest)
+		if *argvRetrieve {
+			conn.RequestMessage(digest.MsgId)
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	pk, err := loadRSAPublicKey(*argvPubKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Key error: %v\n", err)
+		os.Exit(1)
+	}
+	addr := "127.0.0.1:8964"
+	if flag.NArg() > 0 {
+		addr = flag.Arg(0)
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Network error: %v\n", err)
+		os.Exit(1)
+	}
+	conn, err := client.Dial(c, pk, *argvService, *argvUsername, *argvPassword, *argvTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Login error: %v\n", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	if *argvVerbose {
+		conn.SetLogger(logger.NewWriterLogger(os.Stderr, logger.LEVEL_DEBUG))
+	}
+	err = conn.Config(*argvDigestThrd, *argvCompressThrd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Connected to %v as %v:%v (connId=%v)\n", addr, conn.Service(), conn.Username(), conn.ConnId())
+
+	digestChan := make(chan *client.Digest)
+	conn.SetDigestChannel(digestChan)
+	done := make(chan bool)
+	go receive(conn, os.Stdout, done)
+	go receiveDigests(conn, os.Stdout, digestChan)
+
+	sess := newSession(conn, *argvTTL, os.Stdout)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		quit, err := sess.execute(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		if quit {
+			return
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(*argvWait):
+	}
+}
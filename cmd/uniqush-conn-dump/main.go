@@ -0,0 +1,311 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// uniqush-conn-dump decodes the commands of the connections captured
+// in a pcap file, or by a proxy tapping both directions of a
+// connection into two files. The session keys are read from the key
+// log written by a server with the key-log option, or given as lines
+// of such a log.
+//
+// Usage:
+//
+//	uniqush-conn-dump -keylog keys.log -pcap capture.pcap [-port 8964]
+//	uniqush-conn-dump -keys "UNIQUSH ..." -client c2s.bin -server s2c.bin
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/proto"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var argvKeyLog = flag.String("keylog", "", "key log written by the server")
+var argvKeys = flag.String("keys", "", "session keys, as a line of a key log")
+var argvPcap = flag.String("pcap", "", "pcap file")
+var argvPort = flag.Int("port", 8964, "port of the server in the pcap file")
+var argvClient = flag.String("client", "", "bytes sent by the client, as tapped by a proxy")
+var argvServer = flag.String("server", "", "bytes sent by the server, as tapped by a proxy")
+var argvDict = flag.String("dict", "", "compression dictionary of the service, as id=file")
+var argvBody = flag.Int("body", 256, "bytes of the message bodies to print; negative for all")
+var argvToken = flag.Bool("token", false, "print the tokens of the auth commands")
+var argvVerbose = flag.Bool("v", false, "log the length of every command to stderr")
+
+// entry is a command, or the error which stopped the decoding of
+// its direction.
+type entry struct {
+	at         time.Time
+	fromServer bool
+	cmd        *proto.Command
+	err        error
+}
+
+// countingReader counts the bytes read.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (self *countingReader) Read(p []byte) (n int, err error) {
+	n, err = self.r.Read(p)
+	self.n += n
+	return
+}
+
+// skipProxyHeader returns the length of the PROXY protocol header at
+// the head of data, if any.
+func skipProxyHeader(data []byte) int {
+	if bytes.HasPrefix(data, []byte("PROXY ")) {
+		if i := bytes.Index(data, []byte("\r\n")); i > 0 {
+			return i + 2
+		}
+		return 0
+	}
+	sig := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	if bytes.HasPrefix(data, sig) && len(data) >= 16 {
+		n := 16 + int(data[14])<<8 + int(data[15])
+		if n <= len(data) {
+			return n
+		}
+	}
+	return 0
+}
+
+// side is one direction of a connection being decoded.
+type side struct {
+	s       *stream
+	skipped int
+	counter *countingReader
+	r       *bufio.Reader
+}
+
+func newSide(s *stream, skipped int) *side {
+	ret := &side{s: s, skipped: skipped}
+	ret.counter = &countingReader{r: bytes.NewReader(s.data[skipped:])}
+	ret.r = bufio.NewReader(ret.counter)
+	return ret
+}
+
+// at() returns when the bytes read so far were captured.
+func (self *side) at() time.Time {
+	return self.s.timeAt(self.skipped + self.counter.n - self.r.Buffered())
+}
+
+func (self *side) readCommands(cmdio *proto.CommandIO, fromServer bool) (entries []*entry) {
+	for {
+		cmd, err := cmdio.ReadCommand()
+		if err == io.EOF {
+			return
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("truncated command")
+		}
+		entries = append(entries, &entry{at: self.at(), fromServer: fromServer, cmd: cmd, err: err})
+		if err != nil {
+			return
+		}
+	}
+}
+
+func decodeConn(c *tcpConn, keys map[string]*proto.SessionKeys, dict *proto.Dictionary, l logger.Logger) (entries []*entry, err error) {
+	client := newSide(c.fromClient, skipProxyHeader(c.fromClient.data))
+	server := newSide(c.fromServer, 0)
+	sk, err := proto.SkipKeyExchange(server.r, client.r, keys)
+	if err != nil {
+		return
+	}
+	for i, s := range []*side{client, server} {
+		fromServer := i == 1
+		cmdio := sk.CommandReader(s.r, fromServer)
+		if dict != nil {
+			cmdio.SetDictionary(dict)
+		}
+		if l != nil {
+			cmdio.SetLogger(l.With("fromServer", fromServer))
+		}
+		entries = append(entries, s.readCommands(cmdio, fromServer)...)
+	}
+	// The commands of a proxy tap have no time, and are kept by side.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].at.Before(entries[j].at)
+	})
+	return
+}
+
+// printable() is the command to print, without the token of an auth
+// command and with the body cut.
+func printable(cmd *proto.Command) *proto.Command {
+	ret := *cmd
+	if cmd.Type == proto.CMD_AUTH && len(cmd.Params) > 2 && !*argvToken {
+		ret.Params = append([]string(nil), cmd.Params...)
+		ret.Params[2] = "<token>"
+	}
+	if msg := cmd.Message; msg != nil && *argvBody >= 0 && len(msg.Body) > *argvBody {
+		m := *msg
+		m.Body = msg.Body[:*argvBody]
+		ret.Message = &m
+	}
+	return &ret
+}
+
+func printEntries(out io.Writer, entries []*entry) {
+	for _, e := range entries {
+		dir := "C->S"
+		if e.fromServer {
+			dir = "S->C"
+		}
+		at := ""
+		if !e.at.IsZero() {
+			at = e.at.Format("15:04:05.000000 ")
+		}
+		if e.err != nil {
+			fmt.Fprintf(out, "%v%v error: %v\n", at, dir, e.err)
+			continue
+		}
+		fmt.Fprintf(out, "%v%v %v\n", at, dir, printable(e.cmd))
+		if e.cmd.Message != nil && *argvBody >= 0 && len(e.cmd.Message.Body) > *argvBody {
+			fmt.Fprintf(out, "\t(%v bytes of body)\n", len(e.cmd.Message.Body))
+		}
+	}
+}
+
+func readKeys() (keys map[string]*proto.SessionKeys, err error) {
+	keys = make(map[string]*proto.SessionKeys, 16)
+	if len(*argvKeyLog) > 0 {
+		var f *os.File
+		f, err = os.Open(*argvKeyLog)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		keys, err = proto.ReadKeyLog(f)
+		if err != nil {
+			return
+		}
+	}
+	if len(*argvKeys) > 0 {
+		var more map[string]*proto.SessionKeys
+		more, err = proto.ReadKeyLog(strings.NewReader(*argvKeys))
+		if err != nil {
+			return
+		}
+		for k, v := range more {
+			keys[k] = v
+		}
+	}
+	return
+}
+
+func readDictionary() (dict *proto.Dictionary, err error) {
+	if len(*argvDict) == 0 {
+		return
+	}
+	kv := strings.SplitN(*argvDict, "=", 2)
+	if len(kv) != 2 {
+		err = fmt.Errorf("the dictionary should be given as id=file")
+		return
+	}
+	data, err := ioutil.ReadFile(kv[1])
+	if err != nil {
+		return
+	}
+	dict = proto.NewDictionary(kv[0], data)
+	return
+}
+
+func readConns() (conns []*tcpConn, err error) {
+	if len(*argvPcap) > 0 {
+		var f *os.File
+		f, err = os.Open(*argvPcap)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		var r *pcapReader
+		r, err = newPcapReader(f, uint16(*argvPort))
+		if err != nil {
+			return
+		}
+		return r.readAll()
+	}
+	if len(*argvClient) == 0 || len(*argvServer) == 0 {
+		err = fmt.Errorf("give either a pcap file, or both directions of a proxy tap")
+		return
+	}
+	c := &tcpConn{client: *argvClient, server: *argvServer}
+	for _, f := range []string{*argvClient, *argvServer} {
+		var data []byte
+		data, err = ioutil.ReadFile(f)
+		if err != nil {
+			return
+		}
+		s := &stream{data: data}
+		if c.fromClient == nil {
+			c.fromClient = s
+		} else {
+			c.fromServer = s
+		}
+	}
+	conns = []*tcpConn{c}
+	return
+}
+
+func main() {
+	flag.Parse()
+	keys, err := readKeys()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Key error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(keys) == 0 {
+		fmt.Fprintf(os.Stderr, "Key error: no session keys\n")
+		os.Exit(1)
+	}
+	dict, err := readDictionary()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Dictionary error: %v\n", err)
+		os.Exit(1)
+	}
+	conns, err := readConns()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Capture error: %v\n", err)
+		os.Exit(1)
+	}
+	var l logger.Logger
+	if *argvVerbose {
+		l = logger.NewWriterLogger(os.Stderr, logger.LEVEL_DEBUG)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, c := range conns {
+		fmt.Fprintf(out, "== %v -> %v\n", c.client, c.server)
+		entries, err := decodeConn(c, keys, dict, l)
+		if err != nil {
+			fmt.Fprintf(out, "cannot decode: %v\n", err)
+			continue
+		}
+		printEntries(out, entries)
+	}
+}
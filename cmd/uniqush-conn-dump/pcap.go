@@ -0,0 +1,310 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+)
+
+var errPcapng = errors.New("pcapng is not supported; convert the capture with: editcap -F pcap in.pcapng out.pcap")
+var errNotPcap = errors.New("not a pcap file")
+
+// The link types of the captures which can be read.
+const (
+	LINKTYPE_NULL      = 0
+	LINKTYPE_ETHERNET  = 1
+	LINKTYPE_RAW       = 101
+	LINKTYPE_LINUX_SLL = 113
+)
+
+// segment is the payload of a TCP segment.
+type segment struct {
+	seq  uint32
+	data []byte
+	at   time.Time
+}
+
+// stream is one direction of a TCP connection.
+type stream struct {
+	segments []*segment
+	isn      uint32
+	synSeen  bool
+
+	// Filled by assemble().
+	data []byte
+	// The capture times of the segments, by their ends in data.
+	ends  []int
+	times []time.Time
+}
+
+// assemble() orders the segments and drops the retransmitted bytes.
+// The bytes from lost segments are missing.
+func (self *stream) assemble() {
+	if len(self.segments) == 0 {
+		return
+	}
+	start := self.segments[0].seq
+	if self.synSeen {
+		start = self.isn + 1
+	}
+	// Offsets relative to the start survive the wrapping of seq.
+	offset := func(seg *segment) int64 {
+		return int64(int32(seg.seq - start))
+	}
+	sort.SliceStable(self.segments, func(i, j int) bool {
+		return offset(self.segments[i]) < offset(self.segments[j])
+	})
+	for _, seg := range self.segments {
+		off := offset(seg)
+		end := off + int64(len(seg.data))
+		if end <= int64(len(self.data)) || off < 0 {
+			continue
+		}
+		if off > int64(len(self.data)) {
+			// A hole: the following bytes cannot be decoded.
+			break
+		}
+		self.data = append(self.data, seg.data[int64(len(self.data))-off:]...)
+		self.ends = append(self.ends, len(self.data))
+		self.times = append(self.times, seg.at)
+	}
+}
+
+// timeAt() returns when the byte before offset was captured.
+func (self *stream) timeAt(offset int) time.Time {
+	i := sort.SearchInts(self.ends, offset)
+	if i >= len(self.times) {
+		i = len(self.times) - 1
+	}
+	if i < 0 {
+		return time.Time{}
+	}
+	return self.times[i]
+}
+
+// tcpConn is a connection to the server, captured from its first
+// segment.
+type tcpConn struct {
+	client     string
+	server     string
+	startsAt   time.Time
+	fromClient *stream
+	fromServer *stream
+}
+
+type flowKey struct {
+	src, dst string
+}
+
+// pcapReader reads the segments of the connections to a port.
+type pcapReader struct {
+	r        *bufio.Reader
+	order    binary.ByteOrder
+	nano     bool
+	linkType uint32
+	port     uint16
+
+	conns  map[flowKey]*tcpConn
+	sorted []*tcpConn
+}
+
+func newPcapReader(r io.Reader, port uint16) (ret *pcapReader, err error) {
+	ret = new(pcapReader)
+	ret.r = bufio.NewReader(r)
+	ret.port = port
+	ret.conns = make(map[flowKey]*tcpConn, 16)
+	hdr := make([]byte, 24)
+	if _, err = io.ReadFull(ret.r, hdr); err != nil {
+		return
+	}
+	switch magic := binary.LittleEndian.Uint32(hdr); magic {
+	case 0xa1b2c3d4:
+		ret.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		ret.order, ret.nano = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		ret.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		ret.order, ret.nano = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		err = errPcapng
+		return
+	default:
+		err = errNotPcap
+		return
+	}
+	ret.linkType = ret.order.Uint32(hdr[20:])
+	switch ret.linkType {
+	case LINKTYPE_NULL, LINKTYPE_ETHERNET, LINKTYPE_RAW, LINKTYPE_LINUX_SLL:
+	default:
+		err = fmt.Errorf("unsupported link type %v", ret.linkType)
+	}
+	return
+}
+
+// readAll() reads the capture and returns the connections in the
+// order they started.
+func (self *pcapReader) readAll() (conns []*tcpConn, err error) {
+	hdr := make([]byte, 16)
+	for {
+		_, err = io.ReadFull(self.r, hdr)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		sec := int64(self.order.Uint32(hdr))
+		frac := int64(self.order.Uint32(hdr[4:]))
+		if !self.nano {
+			frac *= 1000
+		}
+		pkt := make([]byte, self.order.Uint32(hdr[8:]))
+		if _, err = io.ReadFull(self.r, pkt); err != nil {
+			return
+		}
+		self.packet(pkt, time.Unix(sec, frac))
+	}
+	for _, c := range self.sorted {
+		c.fromClient.assemble()
+		c.fromServer.assemble()
+	}
+	conns = self.sorted
+	return
+}
+
+// packet() strips the link layer.
+func (self *pcapReader) packet(pkt []byte, at time.Time) {
+	switch self.linkType {
+	case LINKTYPE_NULL:
+		if len(pkt) < 4 {
+			return
+		}
+		pkt = pkt[4:]
+	case LINKTYPE_ETHERNET:
+		if len(pkt) < 14 {
+			return
+		}
+		etherType := binary.BigEndian.Uint16(pkt[12:])
+		pkt = pkt[14:]
+		// 802.1Q tags
+		for etherType == 0x8100 && len(pkt) >= 4 {
+			etherType = binary.BigEndian.Uint16(pkt[2:])
+			pkt = pkt[4:]
+		}
+	case LINKTYPE_LINUX_SLL:
+		if len(pkt) < 16 {
+			return
+		}
+		pkt = pkt[16:]
+	}
+	self.ip(pkt, at)
+}
+
+func (self *pcapReader) ip(pkt []byte, at time.Time) {
+	if len(pkt) < 1 {
+		return
+	}
+	var src, dst net.IP
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 || pkt[9] != 6 {
+			return
+		}
+		ihl := int(pkt[0]&0x0F) * 4
+		total := int(binary.BigEndian.Uint16(pkt[2:]))
+		if ihl < 20 || total < ihl || len(pkt) < total {
+			return
+		}
+		src, dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		pkt = pkt[ihl:total]
+	case 6:
+		// Extension headers are not followed.
+		if len(pkt) < 40 || pkt[6] != 6 {
+			return
+		}
+		payloadLen := int(binary.BigEndian.Uint16(pkt[4:]))
+		if len(pkt) < 40+payloadLen {
+			return
+		}
+		src, dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		pkt = pkt[40 : 40+payloadLen]
+	default:
+		return
+	}
+	self.tcp(src, dst, pkt, at)
+}
+
+func (self *pcapReader) tcp(srcIP, dstIP net.IP, pkt []byte, at time.Time) {
+	if len(pkt) < 20 {
+		return
+	}
+	srcPort := binary.BigEndian.Uint16(pkt)
+	dstPort := binary.BigEndian.Uint16(pkt[2:])
+	seq := binary.BigEndian.Uint32(pkt[4:])
+	dataOffset := int(pkt[12]>>4) * 4
+	syn := pkt[13]&0x02 != 0
+	if dataOffset < 20 || len(pkt) < dataOffset {
+		return
+	}
+	src := net.JoinHostPort(srcIP.String(), fmt.Sprint(srcPort))
+	dst := net.JoinHostPort(dstIP.String(), fmt.Sprint(dstPort))
+	var c *tcpConn
+	var s *stream
+	switch self.port {
+	case dstPort:
+		c = self.conn(src, dst, at, syn)
+		s = c.fromClient
+	case srcPort:
+		c = self.conn(dst, src, at, false)
+		s = c.fromServer
+	default:
+		return
+	}
+	if syn {
+		s.isn = seq
+		s.synSeen = true
+	}
+	if data := pkt[dataOffset:]; len(data) > 0 {
+		s.segments = append(s.segments, &segment{seq: seq, data: data, at: at})
+	}
+}
+
+// conn() starts another connection if the client reuses the address
+// of a previous one.
+func (self *pcapReader) conn(client, server string, at time.Time, syn bool) *tcpConn {
+	key := flowKey{client, server}
+	c, ok := self.conns[key]
+	if ok && syn && len(c.fromClient.segments) > 0 {
+		ok = false
+	}
+	if !ok {
+		c = &tcpConn{client: client, server: server, startsAt: at, fromClient: new(stream), fromServer: new(stream)}
+		self.conns[key] = c
+		self.sorted = append(self.sorted, c)
+	}
+	return c
+}
@@ -0,0 +1,252 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"github.com/uniqush/uniqush-conn/proto"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tappedConn keeps what is written to the connection.
+type tappedConn struct {
+	net.Conn
+	lock    sync.Mutex
+	written bytes.Buffer
+}
+
+func (self *tappedConn) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	self.written.Write(p)
+	self.lock.Unlock()
+	return self.Conn.Write(p)
+}
+
+// capture() runs a key exchange, then the client sends an auth
+// command and the server replies.
+func capture(t *testing.T) (fromClient, fromServer []byte, keys map[string]*proto.SessionKeys) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := new(bytes.Buffer)
+	proto.SetKeyLog(log)
+	defer proto.SetKeyLog(nil)
+
+	s, c := net.Pipe()
+	server := &tappedConn{Conn: s}
+	client := &tappedConn{Conn: c}
+	done := make(chan error)
+	go func() {
+		defer close(done)
+		ks, err := proto.ServerKeyExchange(priv, server)
+		if err != nil {
+			done <- err
+			return
+		}
+		cmdio := ks.ServerCommandIO(server)
+		if _, err := cmdio.ReadCommand(); err != nil {
+			done <- err
+			return
+		}
+		authok := &proto.AuthOK{ConnId: "1"}
+		done <- cmdio.WriteCommand(authok.Command(), false)
+	}()
+	ks, err := proto.ClientKeyExchange(&priv.PublicKey, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmdio := ks.ClientCommandIO(client)
+	auth := &proto.Auth{Service: "service", Username: "user", Token: "secret"}
+	if err := cmdio.WriteCommand(auth.Command(), true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cmdio.ReadCommand(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	keys, err = proto.ReadKeyLog(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.written.Bytes(), server.written.Bytes(), keys
+}
+
+type testPacket struct {
+	fromClient bool
+	seq        uint32
+	syn        bool
+	data       []byte
+}
+
+// writePcap() writes the packets between 10.0.0.1:5555 and
+// 10.0.0.2:8964 over Ethernet, one millisecond apart.
+func writePcap(packets []*testPacket) []byte {
+	buf := new(bytes.Buffer)
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr, 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], LINKTYPE_ETHERNET)
+	buf.Write(hdr)
+	for i, p := range packets {
+		pkt := make([]byte, 14+20+20, 14+20+20+len(p.data))
+		binary.BigEndian.PutUint16(pkt[12:], 0x0800)
+		ip := pkt[14:]
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(40+len(p.data)))
+		ip[9] = 6
+		client, server := []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}
+		tcp := ip[20:]
+		if p.fromClient {
+			copy(ip[12:], client)
+			copy(ip[16:], server)
+			binary.BigEndian.PutUint16(tcp, 5555)
+			binary.BigEndian.PutUint16(tcp[2:], 8964)
+		} else {
+			copy(ip[12:], server)
+			copy(ip[16:], client)
+			binary.BigEndian.PutUint16(tcp, 8964)
+			binary.BigEndian.PutUint16(tcp[2:], 5555)
+		}
+		binary.BigEndian.PutUint32(tcp[4:], p.seq)
+		tcp[12] = 5 << 4
+		if p.syn {
+			tcp[13] = 0x02
+		}
+		pkt = append(pkt, p.data...)
+
+		rec := make([]byte, 16)
+		binary.LittleEndian.PutUint32(rec, 1000)
+		binary.LittleEndian.PutUint32(rec[4:], uint32(i*1000))
+		binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+		binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+		buf.Write(rec)
+		buf.Write(pkt)
+	}
+	return buf.Bytes()
+}
+
+// segments() cuts data into segments of n bytes, starting at seq.
+func segments(data []byte, n int, seq uint32, fromClient bool) (packets []*testPacket) {
+	for len(data) > 0 {
+		l := n
+		if l > len(data) {
+			l = len(data)
+		}
+		packets = append(packets, &testPacket{fromClient: fromClient, seq: seq, data: data[:l]})
+		seq += uint32(l)
+		data = data[l:]
+	}
+	return
+}
+
+func TestDecodePcap(t *testing.T) {
+	fromClient, fromServer, keys := capture(t)
+
+	// The sequence numbers of the server wrap.
+	cisn, sisn := uint32(1000), uint32(0xFFFFFF00)
+	cs := segments(fromClient, 100, cisn+1, true)
+	ss := segments(fromServer, 100, sisn+1, false)
+	packets := []*testPacket{
+		{fromClient: true, seq: cisn, syn: true},
+		{fromClient: false, seq: sisn, syn: true},
+	}
+	// The server's packets come reordered and retransmitted.
+	packets = append(packets, ss[1], ss[0], ss[1])
+	packets = append(packets, cs...)
+	packets = append(packets, ss[2:]...)
+
+	r, err := newPcapReader(bytes.NewReader(writePcap(packets)), 8964)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns, err := r.readAll()
+	if err != nil || len(conns) != 1 {
+		t.Fatalf("bad conns: %v %v", conns, err)
+	}
+	c := conns[0]
+	if c.client != "10.0.0.1:5555" || c.server != "10.0.0.2:8964" {
+		t.Errorf("bad addresses: %v %v", c.client, c.server)
+	}
+	if !bytes.Equal(c.fromClient.data, fromClient) || !bytes.Equal(c.fromServer.data, fromServer) {
+		t.Fatalf("bad streams")
+	}
+
+	entries, err := decodeConn(c, keys, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("bad entries: %v", entries)
+	}
+	auth, authok := entries[0], entries[1]
+	if auth.fromServer || auth.err != nil || auth.cmd.Type != proto.CMD_AUTH || auth.cmd.Params[2] != "secret" {
+		t.Errorf("bad auth: %+v", auth)
+	}
+	if !authok.fromServer || authok.err != nil || authok.cmd.Type != proto.CMD_AUTHOK {
+		t.Errorf("bad authok: %+v", authok)
+	}
+	if !auth.at.Before(authok.at) || auth.at.Before(time.Unix(1000, 0)) {
+		t.Errorf("bad times: %v %v", auth.at, authok.at)
+	}
+	if p := printable(auth.cmd); p.Params[2] != "<token>" || auth.cmd.Params[2] != "secret" {
+		t.Errorf("bad printed auth: %v", p)
+	}
+}
+
+func TestDecodeTap(t *testing.T) {
+	fromClient, fromServer, keys := capture(t)
+	proxy := []byte("PROXY TCP4 10.0.0.1 10.0.0.2 5555 8964\r\n")
+	c := &tcpConn{
+		fromClient: &stream{data: append(proxy, fromClient...)},
+		fromServer: &stream{data: fromServer},
+	}
+	entries, err := decodeConn(c, keys, nil, nil)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("bad entries: %v %v", entries, err)
+	}
+	if entries[0].cmd.Type != proto.CMD_AUTH || entries[1].cmd.Type != proto.CMD_AUTHOK {
+		t.Errorf("bad commands: %v %v", entries[0].cmd, entries[1].cmd)
+	}
+
+	// A truncated stream
+	c.fromServer = &stream{data: fromServer[:len(fromServer)-1]}
+	entries, err = decodeConn(c, keys, nil, nil)
+	if err != nil || len(entries) != 2 || entries[1].err == nil {
+		t.Errorf("bad entries: %v %v", entries, err)
+	}
+}
+
+func TestNotPcap(t *testing.T) {
+	if _, err := newPcapReader(bytes.NewReader([]byte{0x0a, 0x0d, 0x0d, 0x0a, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}), 8964); err != errPcapng {
+		t.Errorf("should be pcapng: %v", err)
+	}
+	if _, err := newPcapReader(bytes.NewReader(make([]byte, 24)), 8964); err != errNotPcap {
+		t.Errorf("should not be pcap: %v", err)
+	}
+}
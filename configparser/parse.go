@@ -18,29 +18,196 @@
 package configparser
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/kylelemons/go-gypsy/yaml"
+	"github.com/uniqush/uniqush-conn/analytics"
+	"github.com/uniqush/uniqush-conn/archive"
+	"github.com/uniqush/uniqush-conn/asset"
+	"github.com/uniqush/uniqush-conn/audit"
+	"github.com/uniqush/uniqush-conn/badge"
+	"github.com/uniqush/uniqush-conn/binding"
+	"github.com/uniqush/uniqush-conn/blocklist"
+	"github.com/uniqush/uniqush-conn/bridge"
+	"github.com/uniqush/uniqush-conn/cluster"
+	"github.com/uniqush/uniqush-conn/dedup"
 	"github.com/uniqush/uniqush-conn/evthandler"
 	"github.com/uniqush/uniqush-conn/evthandler/webhook"
+	"github.com/uniqush/uniqush-conn/federation"
+	"github.com/uniqush/uniqush-conn/listener"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/media"
+	"github.com/uniqush/uniqush-conn/mqtt"
 	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/server"
 	"github.com/uniqush/uniqush-conn/push"
+	"github.com/uniqush/uniqush-conn/quota"
+	"github.com/uniqush/uniqush-conn/resource"
+	"github.com/uniqush/uniqush-conn/revocation"
+	"github.com/uniqush/uniqush-conn/scheduler"
+	"github.com/uniqush/uniqush-conn/session"
+	"github.com/uniqush/uniqush-conn/sink"
+	"github.com/uniqush/uniqush-conn/sse"
+	"github.com/uniqush/uniqush-conn/subscription"
+	"github.com/uniqush/uniqush-conn/transform"
+	"github.com/uniqush/uniqush-conn/validate"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
 	HandshakeTimeout time.Duration
 	HttpAddr         string
+	GrpcAddr         string
 	Auth             server.Authenticator
 	ErrorHandler     evthandler.ErrorHandler
+	Cluster          *ClusterConfig
+	Federation       *federation.Relay
+	Revocation       revocation.Store
+	Binding          binding.Store
+	AdminAddr        string
+	AdminKey         string
+	Logger           logger.Logger
 	filename         string
 	srvConfig        map[string]*msgcenter.ServiceConfig
 	defaultConfig    *msgcenter.ServiceConfig
+
+	// AdminAuditLog, if not empty, records the changes made through
+	// the admin API, and the messages sent and the campaigns scheduled
+	// through the HTTP and gRPC APIs. See admin.OpenAuditLog.
+	AdminAuditLog string
+
+	// HandshakeLimits bounds the handshakes. Its Timeout is not set;
+	// HandshakeTimeout is used.
+	HandshakeLimits server.HandshakeLimits
+
+	// HandshakeWorkers, if positive, bounds the concurrent handshakes.
+	// Otherwise each connection is authenticated in its own goroutine.
+	HandshakeWorkers int
+
+	// KeyLog, if not empty, is the file to which the session keys of
+	// the connections are appended, for uniqush-conn-dump. Anyone
+	// reading it can decrypt the connections.
+	KeyLog string
+
+	// CPUWorkers, if positive, run the compression and the handshake
+	// crypto of all connections. At most CPUQueueLen jobs of each
+	// kind wait for them.
+	CPUWorkers  int
+	CPUQueueLen int
+
+	// Scheduler stores the campaigns, which are checked every
+	// SchedulerInterval. Campaigns cannot be scheduled without it.
+	Scheduler         scheduler.Store
+	SchedulerInterval time.Duration
+
+	// Webhooks post the events of all services.
+	Webhooks []*webhook.Dispatcher
+
+	// Archivers copy the delivered messages to external sinks.
+	Archivers []*archive.Archiver
+
+	// KafkaBridge delivers the messages read from Kafka, and produces
+	// the forwarded messages to Kafka.
+	KafkaBridge *bridge.KafkaBridge
+
+	// MqttGateway, if not nil, accepts MQTT devices.
+	MqttGateway *MqttGatewayConfig
+
+	// Sse, if not nil, serves the clients which can only use HTTP.
+	Sse *SseConfig
+
+	// Media, if not nil, accepts the blobs uploaded by the clients.
+	Media *MediaConfig
+
+	// Listeners accept client connections. If empty, the server
+	// listens on the port given in the command line.
+	Listeners []*listener.Spec
+
+	// srvPatterns are the services whose names contain wildcards,
+	// the most specific, i.e. the longest, one first.
+	srvPatterns []*servicePattern
+}
+
+type servicePattern struct {
+	pattern string
+	config  *msgcenter.ServiceConfig
 }
 
+type byLength []*servicePattern
+
+func (self byLength) Len() int      { return len(self) }
+func (self byLength) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self byLength) Less(i, j int) bool {
+	if len(self[i].pattern) != len(self[j].pattern) {
+		return len(self[i].pattern) > len(self[j].pattern)
+	}
+	return self[i].pattern < self[j].pattern
+}
+
+// MqttGatewayConfig is the gateway listening on Addr, over TLS if
+// CertFile is set. The public key
+// of the gateway is set by the caller. If its ServerAddr is empty, it
+// should be the address of the server's own TCP listener. All devices
+// connect to the server from the gateway's address, which should not
+// be limited by the handshake limits per address.
+type MqttGatewayConfig struct {
+	Addr     string
+	CertFile string
+	KeyFile  string
+	Gateway  *mqtt.Gateway
+}
+
+// SseConfig is the SSE endpoint served on Addr, over TLS if CertFile
+// is set. Its public key and ServerAddr are set like the ones of the
+// MQTT gateway.
+type SseConfig struct {
+	Addr     string
+	CertFile string
+	KeyFile  string
+	Endpoint *sse.Endpoint
+}
+
+// MediaConfig is the media endpoint served on Addr, over TLS if
+// CertFile is set. The uploads are kept in Dir. The store and the
+// authenticator of the endpoint are set by the caller. The incomplete
+// uploads are removed after IncompleteTTL, and all of them after TTL,
+// if they are set; see media.Janitor.
+type MediaConfig struct {
+	Addr          string
+	CertFile      string
+	KeyFile       string
+	Dir           string
+	IncompleteTTL time.Duration
+	TTL           time.Duration
+	Endpoint      *media.Endpoint
+}
+
+type ClusterConfig struct {
+	Node      string
+	Locator   cluster.Locator
+	Transport cluster.Transport
+
+	// DeliveryOnly nodes have no client listener. They send the
+	// messages taken from the feed of the transport.
+	DeliveryOnly bool
+
+	// FeedCampaigns hands the campaigns due on this node to the
+	// delivery-only nodes.
+	FeedCampaigns bool
+}
+
+// AllServices returns the services configured by their names.
+// Services configured by patterns are not included.
 func (self *Config) AllServices() []string {
 	ret := make([]string, 0, len(self.srvConfig))
 	for srv, _ := range self.srvConfig {
@@ -53,6 +220,11 @@ func (self *Config) ReadConfig(srv string) *msgcenter.ServiceConfig {
 	if ret, ok := self.srvConfig[srv]; ok {
 		return ret
 	}
+	for _, p := range self.srvPatterns {
+		if msgcenter.MatchService(p.pattern, srv) {
+			return p.config
+		}
+	}
 	return self.defaultConfig
 }
 
@@ -79,6 +251,14 @@ func parseString(node yaml.Node) (str string, err error) {
 	return
 }
 
+func parseBool(node yaml.Node) (b bool, err error) {
+	str, err := parseString(node)
+	if err != nil {
+		return
+	}
+	return strconv.ParseBool(str)
+}
+
 func parseDuration(node yaml.Node) (t time.Duration, err error) {
 	if scalar, ok := node.(yaml.Scalar); ok {
 		t, err = time.ParseDuration(string(scalar))
@@ -197,6 +377,16 @@ func parseForwardRequestHandler(node yaml.Node, timeout time.Duration) (h evthan
 	return
 }
 
+func parseAbuseScorer(node yaml.Node, timeout time.Duration) (h evthandler.AbuseScorer, err error) {
+	hd := new(webhook.AbuseScorer)
+	err = setWebHook(hd, node, timeout)
+	if err != nil {
+		return
+	}
+	h = hd
+	return
+}
+
 func parseLogoutHandler(node yaml.Node, timeout time.Duration) (h evthandler.LogoutHandler, err error) {
 	hd := new(webhook.LogoutHandler)
 	err = setWebHook(hd, node, timeout)
@@ -207,6 +397,43 @@ func parseLogoutHandler(node yaml.Node, timeout time.Duration) (h evthandler.Log
 	return
 }
 
+func parseDeadLetterHandler(node yaml.Node, timeout time.Duration) (h evthandler.DeadLetterHandler, err error) {
+	hd := new(webhook.DeadLetterHandler)
+	err = setWebHook(hd, node, timeout)
+	if err != nil {
+		return
+	}
+	h = hd
+	return
+}
+
+// parseMessageSink reads the web hook the messages are posted to, the
+// number of messages which may wait for it and the number of workers
+// posting them.
+func parseMessageSink(node yaml.Node, timeout time.Duration) (q *sink.Queue, err error) {
+	hd := new(webhook.MessageSink)
+	err = setWebHook(hd, node, timeout)
+	if err != nil {
+		return
+	}
+	fields := node.(yaml.Map)
+	var size, workers int
+	for name, value := range fields {
+		switch name {
+		case "queue":
+			size, err = parseInt(value)
+		case "workers":
+			workers, err = parseInt(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			return
+		}
+	}
+	q = sink.NewQueue(hd, size, workers)
+	return
+}
+
 func parseLoginHandler(node yaml.Node, timeout time.Duration) (h evthandler.LoginHandler, err error) {
 	hd := new(webhook.LoginHandler)
 	err = setWebHook(hd, node, timeout)
@@ -279,11 +506,48 @@ func parseUniqushPush(node yaml.Node, timeout time.Duration) (p push.Push, err e
 	return
 }
 
-func parseCache(node yaml.Node) (cache msgcache.Cache, err error) {
+func parsePushPayload(node yaml.Node) (mapping *push.PayloadMapping, err error) {
+	kv, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("push payload mapping should be a map")
+		return
+	}
+	mapping = new(push.PayloadMapping)
+	for name, value := range kv {
+		var tmpl **server.DigestTemplate
+		switch name {
+		case "title":
+			tmpl = &mapping.Title
+		case "body":
+			tmpl = &mapping.Body
+		case "badge":
+			tmpl = &mapping.Badge
+		case "collapse-key":
+			fallthrough
+		case "collapse_key":
+			tmpl = &mapping.CollapseKey
+		default:
+			err = fmt.Errorf("unknown payload field %v", name)
+		}
+		var str string
+		if err == nil {
+			str, err = parseString(value)
+		}
+		if err == nil {
+			*tmpl, err = server.ParseDigestTemplate(str)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			mapping = nil
+			return
+		}
+	}
+	return
+}
+
+func parseRedisInfo(node yaml.Node) (addr, password string, db int, err error) {
 	if fields, ok := node.(yaml.Map); ok {
 		engine := "redis"
-		addr := ""
-		password := ""
 		name := "0"
 
 		for k, v := range fields {
@@ -306,150 +570,1872 @@ func parseCache(node yaml.Node) (cache msgcache.Cache, err error) {
 			err = fmt.Errorf("database %v is not supported", engine)
 			return
 		}
-		db := 0
 		db, err = strconv.Atoi(name)
 		if err != nil || db < 0 {
 			err = fmt.Errorf("invalid database name: %v", name)
 			return
 		}
-		cache = msgcache.NewRedisMessageCache(addr, password, db)
 	} else {
 		err = fmt.Errorf("database info should be a map")
 	}
 	return
 }
 
-func parseService(service string, node yaml.Node, defaultConfig *msgcenter.ServiceConfig) (config *msgcenter.ServiceConfig, err error) {
-	if node == nil {
-		config = defaultConfig
+func parseCache(node yaml.Node) (cache msgcache.Cache, err error) {
+	addr, password, db, err := parseRedisInfo(node)
+	if err != nil {
 		return
 	}
-	fields, ok := node.(yaml.Map)
+	var ids msgcache.IdGenerator
+	if fields, ok := node.(yaml.Map); ok {
+		if v, ok := fields["ids"]; ok {
+			var name string
+			name, err = parseString(v)
+			if err != nil {
+				err = fmt.Errorf("[field=ids] %v", err)
+				return
+			}
+			switch name {
+			case "random":
+				ids = msgcache.RandomIds()
+			case "sortable":
+				ids = msgcache.SortableIds()
+			default:
+				err = fmt.Errorf("[field=ids] unknown id generator: %v", name)
+				return
+			}
+		}
+	}
+	cache = msgcache.NewRedisMessageCacheWithIds(addr, password, db, ids)
+	return
+}
+
+func parseStringList(node yaml.Node) (strs []string, err error) {
+	list, ok := node.(yaml.List)
 	if !ok {
-		err = fmt.Errorf("[service=%v] Service information should be a map", service)
+		err = fmt.Errorf("should be a list")
 		return
 	}
-	timeout := 3 * time.Second
-
-	if t, ok := fields["timeout"]; ok {
-		timeout, err = parseDuration(t)
+	strs = make([]string, 0, len(list))
+	for _, n := range list {
+		var str string
+		str, err = parseString(n)
 		if err != nil {
-			err = fmt.Errorf("[service=%v][field=timeout] %v", service, err)
 			return
 		}
+		strs = append(strs, str)
 	}
+	return
+}
 
-	config = new(msgcenter.ServiceConfig)
+func parseBlockList(node yaml.Node) (store blocklist.Store, err error) {
+	addr, password, db, err := parseRedisInfo(node)
+	if err != nil {
+		return
+	}
+	store = blocklist.NewRedisStore(addr, password, db)
+	return
+}
 
-	if defaultConfig != nil {
-		*config = *defaultConfig
+func parseDedup(node yaml.Node) (store dedup.Store, err error) {
+	addr, password, db, err := parseRedisInfo(node)
+	if err != nil {
+		return
+	}
+	store = dedup.NewRedisStore(addr, password, db)
+	return
+}
+
+func parseBadges(node yaml.Node) (store badge.Store, err error) {
+	addr, password, db, err := parseRedisInfo(node)
+	if err != nil {
+		return
 	}
+	store = badge.NewRedisStore(addr, password, db)
+	return
+}
 
-	for name, value := range fields {
+func parseAssets(node yaml.Node) (store asset.Store, err error) {
+	addr, password, db, err := parseRedisInfo(node)
+	if err != nil {
+		return
+	}
+	store = asset.NewRedisStore(addr, password, db)
+	return
+}
+
+func parseSessionStore(node yaml.Node) (store session.Store, err error) {
+	addr, password, db, err := parseRedisInfo(node)
+	if err != nil {
+		return
+	}
+	store = session.NewRedisStore(addr, password, db)
+	return
+}
+
+func parseQuota(node yaml.Node) (enforcer *quota.Enforcer, err error) {
+	addr, password, db, err := parseRedisInfo(node)
+	if err != nil {
+		return
+	}
+	var limits quota.Limits
+	for name, value := range node.(yaml.Map) {
+		var limit *int64
 		switch name {
-		case "msg":
-			config.MessageHandler, err = parseMessageHandler(value, timeout)
-		case "logout":
-			config.LogoutHandler, err = parseLogoutHandler(value, timeout)
-		case "login":
-			config.LoginHandler, err = parseLoginHandler(value, timeout)
-		case "fwd":
-			config.ForwardRequestHandler, err = parseForwardRequestHandler(value, timeout)
-		case "push":
-			config.PushHandler, err = parsePushHandler(value, timeout)
-		case "subscribe":
-			config.SubscribeHandler, err = parseSubscribeHandler(value, timeout)
-		case "unsubscribe":
-			config.UnsubscribeHandler, err = parseUnsubscribeHandler(value, timeout)
-		case "uniqush-push":
+		case "messages-per-user":
 			fallthrough
-		case "uniqush_push":
-			config.PushService, err = parseUniqushPush(value, timeout)
+		case "messages_per_user":
+			limit = &limits.MessagesPerUser
+		case "bytes-per-user":
+			fallthrough
+		case "bytes_per_user":
+			limit = &limits.BytesPerUser
+		case "messages-per-service":
+			fallthrough
+		case "messages_per_service":
+			limit = &limits.MessagesPerService
+		case "bytes-per-service":
+			fallthrough
+		case "bytes_per_service":
+			limit = &limits.BytesPerService
+		default:
+			continue
+		}
+		var n int
+		n, err = parseInt(value)
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			return
+		}
+		*limit = int64(n)
+	}
+	enforcer = quota.NewEnforcer(quota.NewRedisStore(addr, password, db), limits)
+	return
+}
+
+func parseResources(node yaml.Node) (limits resource.Limits, err error) {
+	kv, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("resources should be a map")
+		return
+	}
+	for name, value := range kv {
+		var n int
+		switch name {
 		case "max-conns":
 			fallthrough
 		case "max_conns":
-			config.MaxNrConns, err = parseInt(value)
-		case "max-online-users":
+			limits.MaxConns, err = parseInt(value)
+		case "max-goroutines":
 			fallthrough
-		case "max_online_users":
-			config.MaxNrUsers, err = parseInt(value)
-		case "max-conns-per-user":
+		case "max_goroutines":
+			limits.MaxGoroutines, err = parseInt(value)
+		case "max-queued-goroutines":
 			fallthrough
-		case "max_conns_per_user":
-			config.MaxNrConnsPerUser, err = parseInt(value)
-		case "db":
-			config.MsgCache, err = parseCache(value)
-		case "err":
-			config.ErrorHandler, err = parseErrorHandler(value, timeout)
+		case "max_queued_goroutines":
+			limits.MaxQueuedGoroutines, err = parseInt(value)
+		case "max-cache-memory":
+			fallthrough
+		case "max_cache_memory":
+			n, err = parseInt(value)
+			limits.MaxCacheMemory = int64(n)
 		}
 		if err != nil {
-			err = fmt.Errorf("[service=%v][field=%v] %v", service, name, err)
-			config = nil
+			err = fmt.Errorf("[field=%v] %v", name, err)
 			return
 		}
 	}
 	return
 }
 
-func checkConfig(config *Config) error {
-	if config.Auth == nil {
-		return fmt.Errorf("No authentication url")
+// parseForwardAudit reads the store of the audit trail, in redis
+// unless the engine is "memory", and how long it keeps the records.
+func parseForwardAudit(node yaml.Node) (store audit.Store, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("forward audit should be a map")
+		return
 	}
-	return nil
+	var retention time.Duration
+	engine := "redis"
+	for name, value := range fields {
+		switch name {
+		case "engine":
+			engine, err = parseString(value)
+		case "retention":
+			retention, err = parseDuration(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			return
+		}
+	}
+	if engine == "memory" {
+		store = audit.NewMemoryStore(retention)
+		return
+	}
+	addr, password, db, err := parseRedisInfo(node)
+	if err != nil {
+		return
+	}
+	store = audit.NewRedisStore(addr, password, db, retention)
+	return
 }
 
-func Parse(filename string) (config *Config, err error) {
-	file, err := yaml.ReadFile(filename)
-	if err != nil {
+// parseAnalytics reads the store of the counters, in redis unless
+// the engine is memory, and how often they are flushed to it.
+func parseAnalytics(node yaml.Node) (rec *analytics.Recorder, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("analytics should be a map")
 		return
 	}
-	root := file.Root
-	config = new(Config)
-	config.filename = filename
-	switch t := root.(type) {
-	case yaml.Map:
-		config.srvConfig = make(map[string]*msgcenter.ServiceConfig, len(t))
-		if dc, ok := t["default"]; ok {
-			config.defaultConfig, err = parseService("default", dc, nil)
+	var interval time.Duration
+	engine := "redis"
+	for name, value := range fields {
+		switch name {
+		case "engine":
+			engine, err = parseString(value)
+		case "flush-interval":
+			fallthrough
+		case "flush_interval":
+			interval, err = parseDuration(value)
 		}
 		if err != nil {
-			config = nil
+			err = fmt.Errorf("[field=%v] %v", name, err)
 			return
 		}
-		for srv, node := range t {
-			switch srv {
-			case "auth":
-				config.Auth, err = parseAuthHandler(node, 3*time.Second)
-				if err != nil {
-					err = fmt.Errorf("auth: %v", err)
-					return
-				}
-				continue
-			case "err":
-				config.ErrorHandler, err = parseErrorHandler(node, 3*time.Second)
-				if err != nil {
-					err = fmt.Errorf("global error handler: %v", err)
-					return
-				}
-				continue
-			case "http-addr":
-				fallthrough
-			case "http_addr":
-				config.HttpAddr, err = parseString(node)
-				if err != nil {
-					err = fmt.Errorf("Bad HTTP bind address: %v", err)
-					return
-				}
-				continue
-			case "handshake-timeout":
-				fallthrough
-			case "handshake_timeout":
-				config.HandshakeTimeout, err = parseDuration(node)
+	}
+	var store analytics.Store
+	if engine == "memory" {
+		store = analytics.NewMemoryStore()
+	} else {
+		var addr, password string
+		var db int
+		addr, password, db, err = parseRedisInfo(node)
+		if err != nil {
+			return
+		}
+		store = analytics.NewRedisStore(addr, password, db)
+	}
+	rec = analytics.NewRecorder(store, interval)
+	return
+}
+
+// parseDigestRules reads a list of rules, each with a header, an
+// optional value and a threshold, which is a number of bytes,
+// "always" or "never".
+func parseDigestRules(node yaml.Node) (policy server.DigestPolicy, err error) {
+	list, ok := node.(yaml.List)
+	if !ok {
+		err = fmt.Errorf("digest rules should be a list")
+		return
+	}
+	policy = make(server.DigestPolicy, 0, len(list))
+	for i, n := range list {
+		fields, ok := n.(yaml.Map)
+		if !ok {
+			err = fmt.Errorf("[rule=%v] digest rule should be a map", i)
+			return
+		}
+		rule := new(server.DigestRule)
+		var threshold string
+		for name, value := range fields {
+			switch name {
+			case "header":
+				rule.Header, err = parseString(value)
+			case "value":
+				rule.Value, err = parseString(value)
+			case "threshold":
+				threshold, err = parseString(value)
+			}
+			if err != nil {
+				err = fmt.Errorf("[rule=%v] [field=%v] %v", i, name, err)
+				return
+			}
+		}
+		if len(rule.Header) == 0 {
+			err = fmt.Errorf("[rule=%v] [field=header] digest rule should have a header", i)
+			return
+		}
+		switch threshold {
+		case "always":
+			rule.Threshold = server.DIGEST_ALWAYS
+		case "never":
+			rule.Threshold = server.DIGEST_NEVER
+		default:
+			rule.Threshold, err = strconv.Atoi(threshold)
+			if err != nil {
+				err = fmt.Errorf("[rule=%v] [field=threshold] bad threshold: %v", i, threshold)
+				return
+			}
+		}
+		policy = append(policy, rule)
+	}
+	return
+}
+
+func parseHandshakeLimits(node yaml.Node) (limits server.HandshakeLimits, err error) {
+	kv, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("handshake limits should be a map")
+		return
+	}
+	for name, value := range kv {
+		switch name {
+		case "key-exchange-timeout":
+			fallthrough
+		case "key_exchange_timeout":
+			limits.KeyExchangeTimeout, err = parseDuration(value)
+		case "max-auth-bytes":
+			fallthrough
+		case "max_auth_bytes":
+			limits.MaxAuthBytes, err = parseInt(value)
+		case "max-per-addr":
+			fallthrough
+		case "max_per_addr":
+			var n int
+			n, err = parseInt(value)
+			if err == nil && n > 0 {
+				limits.Guard = server.NewHandshakeGuard(n)
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			return
+		}
+	}
+	return
+}
+
+func parseCPUPool(node yaml.Node) (workers, queueLen int, err error) {
+	kv, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("cpu pool should be a map")
+		return
+	}
+	for name, value := range kv {
+		switch name {
+		case "workers":
+			workers, err = parseInt(value)
+		case "queue":
+			queueLen, err = parseInt(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			return
+		}
+	}
+	return
+}
+
+func parseSubscriptionStore(node yaml.Node) (store subscription.Store, err error) {
+	addr, password, db, err := parseRedisInfo(node)
+	if err != nil {
+		return
+	}
+	store = subscription.NewRedisStore(addr, password, db)
+	return
+}
+
+func parseRevocation(node yaml.Node) (store revocation.Store, err error) {
+	addr, password, db, err := parseRedisInfo(node)
+	if err != nil {
+		return
+	}
+	store = revocation.NewRedisStore(addr, password, db)
+	return
+}
+
+func parseBindingStore(node yaml.Node) (store binding.Store, err error) {
+	addr, password, db, err := parseRedisInfo(node)
+	if err != nil {
+		return
+	}
+	store = binding.NewRedisStore(addr, password, db)
+	return
+}
+
+func parseTokenBinding(node yaml.Node) (policy *binding.Policy, err error) {
+	kv, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("token binding should be a map")
+		return
+	}
+	policy = new(binding.Policy)
+	for name, value := range kv {
+		switch name {
+		case "device":
+			policy.Device, err = parseBool(value)
+		case "ipv4-prefix":
+			fallthrough
+		case "ipv4_prefix":
+			policy.IPv4Prefix, err = parseInt(value)
+		case "ipv6-prefix":
+			fallthrough
+		case "ipv6_prefix":
+			policy.IPv6Prefix, err = parseInt(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			policy = nil
+			return
+		}
+	}
+	if policy.IPv4Prefix < 0 || policy.IPv4Prefix > 32 || policy.IPv6Prefix < 0 || policy.IPv6Prefix > 128 {
+		err = fmt.Errorf("bad network prefix")
+		policy = nil
+	}
+	return
+}
+
+func parseMemoryLimit(node yaml.Node) (limit *server.MemoryLimit, err error) {
+	kv, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("memory limit should be a map")
+		return
+	}
+	limit = new(server.MemoryLimit)
+	limit.Policy = server.MEMORY_POLICY_CACHE
+	for name, value := range kv {
+		switch name {
+		case "bytes":
+			var n int
+			n, err = parseInt(value)
+			limit.Bytes = int64(n)
+		case "policy":
+			limit.Policy, err = parseString(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			limit = nil
+			return
+		}
+	}
+	switch {
+	case limit.Bytes <= 0:
+		err = fmt.Errorf("no number of bytes")
+	case limit.Policy != server.MEMORY_POLICY_CACHE && limit.Policy != server.MEMORY_POLICY_DISCONNECT:
+		err = fmt.Errorf("unknown policy %v", limit.Policy)
+	}
+	if err != nil {
+		limit = nil
+	}
+	return
+}
+
+func parseSlowConsumer(node yaml.Node) (policy *server.SlowConsumerPolicy, err error) {
+	kv, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("slow consumer policy should be a map")
+		return
+	}
+	policy = new(server.SlowConsumerPolicy)
+	policy.Action = server.SLOW_CONSUMER_DIGEST
+	for name, value := range kv {
+		switch name {
+		case "latency":
+			policy.Latency, err = parseDuration(value)
+		case "queue-depth":
+			fallthrough
+		case "queue_depth":
+			policy.QueueDepth, err = parseInt(value)
+		case "window":
+			policy.Window, err = parseDuration(value)
+		case "action":
+			policy.Action, err = parseString(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			policy = nil
+			return
+		}
+	}
+	switch policy.Action {
+	case server.SLOW_CONSUMER_DIGEST, server.SLOW_CONSUMER_DEPRIORITIZE, server.SLOW_CONSUMER_DISCONNECT:
+	default:
+		err = fmt.Errorf("unknown action %v", policy.Action)
+	}
+	if err == nil && policy.Latency <= 0 && policy.QueueDepth <= 0 {
+		err = fmt.Errorf("neither latency nor queue depth")
+	}
+	if err != nil {
+		policy = nil
+	}
+	return
+}
+
+func parseScheduler(node yaml.Node) (store scheduler.Store, interval time.Duration, err error) {
+	addr, password, db, err := parseRedisInfo(node)
+	if err != nil {
+		return
+	}
+	interval = time.Second
+	if v, ok := node.(yaml.Map)["interval"]; ok {
+		interval, err = parseDuration(v)
+		if err != nil {
+			err = fmt.Errorf("[field=interval] %v", err)
+			return
+		}
+	}
+	store = scheduler.NewRedisStore(addr, password, db)
+	return
+}
+
+func parseCluster(node yaml.Node) (c *ClusterConfig, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("cluster info should be a map")
+		return
+	}
+	c = new(ClusterConfig)
+	timeout := 3 * time.Second
+	if t, ok := fields["timeout"]; ok {
+		timeout, err = parseDuration(t)
+		if err != nil {
+			err = fmt.Errorf("[field=timeout] %v", err)
+			return
+		}
+	}
+	if n, ok := fields["node"]; ok {
+		c.Node, err = parseString(n)
+		if err != nil {
+			err = fmt.Errorf("[field=node] %v", err)
+			return
+		}
+	}
+	if db, ok := fields["db"]; ok {
+		var addr, password string
+		var n int
+		addr, password, n, err = parseRedisInfo(db)
+		if err != nil {
+			err = fmt.Errorf("[field=db] %v", err)
+			return
+		}
+		c.Locator = cluster.NewRedisLocator(addr, password, n)
+	} else {
+		err = fmt.Errorf("cluster should have db")
+		return
+	}
+	for name, value := range fields {
+		switch name {
+		case "delivery-only":
+			fallthrough
+		case "delivery_only":
+			c.DeliveryOnly, err = parseBool(value)
+		case "feed-campaigns":
+			fallthrough
+		case "feed_campaigns":
+			c.FeedCampaigns, err = parseBool(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			return
+		}
+	}
+	transport := "http"
+	if t, ok := fields["transport"]; ok {
+		transport, err = parseString(t)
+		if err != nil {
+			err = fmt.Errorf("[field=transport] %v", err)
+			return
+		}
+	}
+	switch transport {
+	case "http":
+		c.Transport = cluster.NewHttpTransport(timeout)
+	case "nats":
+		c.Transport, err = parseNatsTransport(fields["nats"], timeout)
+		if err != nil {
+			err = fmt.Errorf("[field=nats] %v", err)
+			return
+		}
+	default:
+		err = fmt.Errorf("[field=transport] unknown transport: %v", transport)
+	}
+	return
+}
+
+func parseNatsTransport(node yaml.Node, timeout time.Duration) (t *cluster.NatsTransport, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("nats should be a map")
+		return
+	}
+	url, err := parseString(fields["url"])
+	if err != nil || len(url) == 0 {
+		err = fmt.Errorf("[field=url] nats should have url")
+		return
+	}
+	var prefix, user, password, token string
+	var useTLS bool
+	var roots *x509.CertPool
+	for name, value := range fields {
+		switch name {
+		case "subject-prefix":
+			fallthrough
+		case "subject_prefix":
+			prefix, err = parseString(value)
+		case "user":
+			user, err = parseString(value)
+		case "password":
+			password, err = parseString(value)
+		case "token":
+			token, err = parseString(value)
+		case "tls":
+			useTLS, err = parseBool(value)
+		case "ca":
+			roots, err = parseRoots(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			return
+		}
+	}
+	t, err = cluster.NewNatsTransport(url, prefix, timeout)
+	if err != nil {
+		return
+	}
+	t.SetCredentials(user, password, token)
+	if useTLS || roots != nil {
+		t.SetTLSConfig(&tls.Config{RootCAs: roots})
+	}
+	return
+}
+
+func parseLogger(node yaml.Node) (l logger.Logger, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("log info should be a map")
+		return
+	}
+	level := logger.LEVEL_INFO
+	if lv, ok := fields["level"]; ok {
+		var str string
+		str, err = parseString(lv)
+		if err != nil {
+			err = fmt.Errorf("[field=level] %v", err)
+			return
+		}
+		level, err = logger.ParseLevel(str)
+		if err != nil {
+			err = fmt.Errorf("[field=level] %v", err)
+			return
+		}
+	}
+	out := os.Stderr
+	if fn, ok := fields["file"]; ok {
+		var filename string
+		filename, err = parseString(fn)
+		if err != nil {
+			err = fmt.Errorf("[field=file] %v", err)
+			return
+		}
+		out, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			err = fmt.Errorf("[field=file] %v", err)
+			return
+		}
+	}
+	l = logger.NewWriterLogger(out, level)
+	return
+}
+
+func parseAdmin(node yaml.Node) (addr, key, auditLog string, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("admin info should be a map")
+		return
+	}
+	addr, err = parseString(fields["addr"])
+	if err != nil || len(addr) == 0 {
+		err = fmt.Errorf("[field=addr] bad address")
+		return
+	}
+	key, err = parseString(fields["key"])
+	if err != nil || len(key) == 0 {
+		err = fmt.Errorf("[field=key] admin API should be protected by a key")
+		return
+	}
+	if v, ok := fields["audit-log"]; ok {
+		auditLog, err = parseString(v)
+	} else if v, ok := fields["audit_log"]; ok {
+		auditLog, err = parseString(v)
+	}
+	if err != nil {
+		err = fmt.Errorf("[field=audit-log] %v", err)
+	}
+	return
+}
+
+func parseDictionary(node yaml.Node) (dict *proto.Dictionary, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("dictionary info should be a map")
+		return
+	}
+	id, err := parseString(fields["id"])
+	if err != nil || len(id) == 0 || strings.Contains(id, ",") {
+		err = fmt.Errorf("[field=id] bad dictionary id")
+		return
+	}
+	file, err := parseString(fields["file"])
+	if err != nil || len(file) == 0 {
+		err = fmt.Errorf("[field=file] no dictionary file")
+		return
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	dict = proto.NewDictionary(id, data)
+	return
+}
+
+func parseSettings(node yaml.Node) (settings *proto.Settings, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("settings should be a map")
+		return
+	}
+	// The same as the defaults of the server.
+	settings = &proto.Settings{
+		DigestThreshold:   1024,
+		CompressThreshold: 1024,
+	}
+	for name, value := range fields {
+		switch name {
+		case "digest-threshold":
+			settings.DigestThreshold, err = parseInt(value)
+		case "compress-threshold":
+			settings.CompressThreshold, err = parseInt(value)
+		case "ping-interval":
+			settings.PingInterval, err = parseDuration(value)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			settings = nil
+			return
+		}
+	}
+	return
+}
+
+func parseListener(node yaml.Node) (spec *listener.Spec, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("listener info should be a map")
+		return
+	}
+	spec = new(listener.Spec)
+	spec.Addr, err = parseString(fields["addr"])
+	if err != nil || len(spec.Addr) == 0 {
+		err = fmt.Errorf("[field=addr] bad address")
+		return
+	}
+	for name, value := range fields {
+		switch name {
+		case "type":
+			spec.Type, err = parseString(value)
+		case "name":
+			spec.Name, err = parseString(value)
+		case "cert":
+			spec.CertFile, err = parseString(value)
+		case "key":
+			spec.KeyFile, err = parseString(value)
+		case "path":
+			spec.Path, err = parseString(value)
+		case "network":
+			spec.Network, err = parseString(value)
+		case "proxy-protocol":
+			fallthrough
+		case "proxy_protocol":
+			spec.ProxyProtocol, err = parseBool(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			return
+		}
+	}
+	switch spec.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		err = fmt.Errorf("[field=network] unknown network: %v", spec.Network)
+		return
+	}
+	switch spec.Type {
+	case "", listener.TYPE_TCP, listener.TYPE_WEBSOCKET:
+	case listener.TYPE_TLS:
+		if len(spec.CertFile) == 0 || len(spec.KeyFile) == 0 {
+			err = fmt.Errorf("TLS listener needs cert and key")
+		}
+	default:
+		err = fmt.Errorf("[field=type] unknown listener type: %v", spec.Type)
+	}
+	return
+}
+
+func parseDispatcher(node yaml.Node) (d *webhook.Dispatcher, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("webhook should be a map")
+		return
+	}
+	url, err := parseString(fields["url"])
+	if err != nil || len(url) == 0 {
+		err = fmt.Errorf("[field=url] webhook should have url")
+		return
+	}
+	secret, err := parseString(fields["secret"])
+	if err != nil {
+		err = fmt.Errorf("[field=secret] %v", err)
+		return
+	}
+	var types []string
+	if v, ok := fields["events"]; ok {
+		list, ok := v.(yaml.List)
+		if !ok {
+			err = fmt.Errorf("[field=events] events should be a list")
+			return
+		}
+		for _, n := range list {
+			var t string
+			t, err = parseString(n)
+			if err != nil {
+				err = fmt.Errorf("[field=events] %v", err)
+				return
+			}
+			types = append(types, t)
+		}
+	}
+	d = webhook.NewDispatcher(url, secret, types...)
+	if v, ok := fields["timeout"]; ok {
+		var timeout time.Duration
+		timeout, err = parseDuration(v)
+		if err != nil {
+			err = fmt.Errorf("[field=timeout] %v", err)
+			return
+		}
+		d.SetTimeout(timeout)
+	}
+	retries := 3
+	backoff := time.Second
+	if v, ok := fields["retries"]; ok {
+		retries, err = parseInt(v)
+		if err != nil {
+			err = fmt.Errorf("[field=retries] %v", err)
+			return
+		}
+	}
+	if v, ok := fields["backoff"]; ok {
+		backoff, err = parseDuration(v)
+		if err != nil {
+			err = fmt.Errorf("[field=backoff] %v", err)
+			return
+		}
+	}
+	d.SetRetries(retries, backoff)
+	return
+}
+
+func parseDispatchers(node yaml.Node) (ds []*webhook.Dispatcher, err error) {
+	list, ok := node.(yaml.List)
+	if !ok {
+		err = fmt.Errorf("webhooks should be a list")
+		return
+	}
+	ds = make([]*webhook.Dispatcher, 0, len(list))
+	for i, n := range list {
+		var d *webhook.Dispatcher
+		d, err = parseDispatcher(n)
+		if err != nil {
+			err = fmt.Errorf("[webhook=%v] %v", i, err)
+			return
+		}
+		ds = append(ds, d)
+	}
+	return
+}
+
+func parseArchiveSink(fields yaml.Map) (sink archive.Sink, err error) {
+	str := func(names ...string) (v string) {
+		for _, name := range names {
+			if n, ok := fields[name]; ok && err == nil {
+				v, err = parseString(n)
+				if err != nil {
+					err = fmt.Errorf("[field=%v] %v", name, err)
+				}
+				return
+			}
+		}
+		return
+	}
+	kind, err := parseString(fields["sink"])
+	if err != nil {
+		err = fmt.Errorf("[field=sink] %v", err)
+		return
+	}
+	switch kind {
+	case "s3":
+		s3 := &archive.S3Sink{
+			Endpoint:  str("endpoint"),
+			Region:    str("region"),
+			Bucket:    str("bucket"),
+			Prefix:    str("prefix"),
+			AccessKey: str("access-key", "access_key"),
+			SecretKey: str("secret-key", "secret_key"),
+		}
+		if err != nil {
+			return
+		}
+		if len(s3.Endpoint) == 0 || len(s3.Bucket) == 0 {
+			err = fmt.Errorf("s3 sink should have endpoint and bucket")
+			return
+		}
+		if len(s3.Region) == 0 {
+			s3.Region = "us-east-1"
+		}
+		sink = s3
+	case "kafka-rest":
+		fallthrough
+	case "kafka_rest":
+		kafka := &archive.KafkaRestSink{
+			URL:   str("url"),
+			Topic: str("topic"),
+		}
+		if err != nil {
+			return
+		}
+		if len(kafka.URL) == 0 || len(kafka.Topic) == 0 {
+			err = fmt.Errorf("kafka-rest sink should have url and topic")
+			return
+		}
+		sink = kafka
+	default:
+		err = fmt.Errorf("[field=sink] unknown sink: %v", kind)
+	}
+	return
+}
+
+func parseArchiver(node yaml.Node) (a *archive.Archiver, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("archiver should be a map")
+		return
+	}
+	sink, err := parseArchiveSink(fields)
+	if err != nil {
+		return
+	}
+	var services []string
+	if v, ok := fields["services"]; ok {
+		list, ok := v.(yaml.List)
+		if !ok {
+			err = fmt.Errorf("[field=services] services should be a list")
+			return
+		}
+		for _, n := range list {
+			var srv string
+			srv, err = parseString(n)
+			if err != nil {
+				err = fmt.Errorf("[field=services] %v", err)
+				return
+			}
+			services = append(services, srv)
+		}
+	}
+	a = archive.NewArchiver(sink, services...)
+	var batchSize int
+	var interval time.Duration
+	retries := 3
+	backoff := time.Second
+	for name, value := range fields {
+		switch name {
+		case "batch-size":
+			fallthrough
+		case "batch_size":
+			batchSize, err = parseInt(value)
+		case "flush-interval":
+			fallthrough
+		case "flush_interval":
+			interval, err = parseDuration(value)
+		case "queue-size":
+			fallthrough
+		case "queue_size":
+			var n int
+			n, err = parseInt(value)
+			a.SetQueueSize(n)
+		case "retries":
+			retries, err = parseInt(value)
+		case "backoff":
+			backoff, err = parseDuration(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			return
+		}
+	}
+	a.SetBatch(batchSize, interval)
+	a.SetRetries(retries, backoff)
+	return
+}
+
+func parseArchivers(node yaml.Node) (as []*archive.Archiver, err error) {
+	list, ok := node.(yaml.List)
+	if !ok {
+		err = fmt.Errorf("archivers should be a list")
+		return
+	}
+	as = make([]*archive.Archiver, 0, len(list))
+	for i, n := range list {
+		var a *archive.Archiver
+		a, err = parseArchiver(n)
+		if err != nil {
+			err = fmt.Errorf("[archiver=%v] %v", i, err)
+			return
+		}
+		as = append(as, a)
+	}
+	return
+}
+
+func parseKafkaBridge(node yaml.Node) (b *bridge.KafkaBridge, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("kafka bridge should be a map")
+		return
+	}
+	var proxy, inbound, forward string
+	group := "uniqush-conn"
+	var services []string
+	var timeout time.Duration
+	retries := 3
+	backoff := time.Second
+	for name, value := range fields {
+		switch name {
+		case "url":
+			proxy, err = parseString(value)
+		case "group":
+			group, err = parseString(value)
+		case "inbound-topic":
+			fallthrough
+		case "inbound_topic":
+			inbound, err = parseString(value)
+		case "forward-topic":
+			fallthrough
+		case "forward_topic":
+			forward, err = parseString(value)
+		case "services":
+			list, ok := value.(yaml.List)
+			if !ok {
+				err = fmt.Errorf("services should be a list")
+				break
+			}
+			for _, n := range list {
+				var srv string
+				srv, err = parseString(n)
+				if err != nil {
+					break
+				}
+				services = append(services, srv)
+			}
+		case "timeout":
+			timeout, err = parseDuration(value)
+		case "retries":
+			retries, err = parseInt(value)
+		case "backoff":
+			backoff, err = parseDuration(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			return
+		}
+	}
+	if len(proxy) == 0 {
+		err = fmt.Errorf("[field=url] kafka bridge should have url")
+		return
+	}
+	if len(inbound) == 0 && len(forward) == 0 {
+		err = fmt.Errorf("kafka bridge should have inbound-topic or forward-topic")
+		return
+	}
+	b = bridge.NewKafkaBridge(proxy, group, inbound, forward, services...)
+	if timeout > 0 {
+		b.SetClient(&http.Client{Timeout: timeout})
+	}
+	b.SetRetries(retries, backoff)
+	return
+}
+
+func parseMqttGateway(node yaml.Node) (c *MqttGatewayConfig, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("mqtt gateway should be a map")
+		return
+	}
+	c = &MqttGatewayConfig{Gateway: new(mqtt.Gateway)}
+	gw := c.Gateway
+	for name, value := range fields {
+		switch name {
+		case "addr":
+			c.Addr, err = parseString(value)
+		case "cert":
+			c.CertFile, err = parseString(value)
+		case "key":
+			c.KeyFile, err = parseString(value)
+		case "server":
+			gw.ServerAddr, err = parseString(value)
+		case "default-service":
+			fallthrough
+		case "default_service":
+			gw.DefaultService, err = parseString(value)
+		case "timeout":
+			gw.Timeout, err = parseDuration(value)
+		case "forward-ttl":
+			fallthrough
+		case "forward_ttl":
+			gw.ForwardTTL, err = parseDuration(value)
+		case "max-packet":
+			fallthrough
+		case "max_packet":
+			gw.MaxPacket, err = parseInt(value)
+		case "proxy-protocol":
+			fallthrough
+		case "proxy_protocol":
+			gw.ProxyProtocol, err = parseBool(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			return
+		}
+	}
+	if len(c.Addr) == 0 {
+		err = fmt.Errorf("[field=addr] mqtt gateway should have addr")
+		return
+	}
+	if (len(c.CertFile) == 0) != (len(c.KeyFile) == 0) {
+		err = fmt.Errorf("[field=cert] mqtt gateway should have both cert and key, or neither")
+	}
+	return
+}
+
+func parseSse(node yaml.Node) (c *SseConfig, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("sse should be a map")
+		return
+	}
+	c = &SseConfig{Endpoint: new(sse.Endpoint)}
+	ep := c.Endpoint
+	for name, value := range fields {
+		switch name {
+		case "addr":
+			c.Addr, err = parseString(value)
+		case "cert":
+			c.CertFile, err = parseString(value)
+		case "key":
+			c.KeyFile, err = parseString(value)
+		case "server":
+			ep.ServerAddr, err = parseString(value)
+		case "prefix":
+			ep.Prefix, err = parseString(value)
+		case "timeout":
+			ep.Timeout, err = parseDuration(value)
+		case "idle-timeout":
+			fallthrough
+		case "idle_timeout":
+			ep.IdleTimeout, err = parseDuration(value)
+		case "forward-ttl":
+			fallthrough
+		case "forward_ttl":
+			ep.ForwardTTL, err = parseDuration(value)
+		case "allow-origin":
+			fallthrough
+		case "allow_origin":
+			ep.AllowOrigin, err = parseString(value)
+		case "proxy-protocol":
+			fallthrough
+		case "proxy_protocol":
+			ep.ProxyProtocol, err = parseBool(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			return
+		}
+	}
+	if len(c.Addr) == 0 {
+		err = fmt.Errorf("[field=addr] sse should have addr")
+		return
+	}
+	if (len(c.CertFile) == 0) != (len(c.KeyFile) == 0) {
+		err = fmt.Errorf("[field=cert] sse should have both cert and key, or neither")
+	}
+	return
+}
+
+func parseMedia(node yaml.Node) (c *MediaConfig, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("media should be a map")
+		return
+	}
+	c = &MediaConfig{Endpoint: new(media.Endpoint)}
+	ep := c.Endpoint
+	for name, value := range fields {
+		var n int
+		switch name {
+		case "addr":
+			c.Addr, err = parseString(value)
+		case "cert":
+			c.CertFile, err = parseString(value)
+		case "key":
+			c.KeyFile, err = parseString(value)
+		case "dir":
+			c.Dir, err = parseString(value)
+		case "prefix":
+			ep.Prefix, err = parseString(value)
+		case "max-size":
+			fallthrough
+		case "max_size":
+			n, err = parseInt(value)
+			ep.MaxSize = int64(n)
+		case "max-chunk-size":
+			fallthrough
+		case "max_chunk_size":
+			n, err = parseInt(value)
+			ep.MaxChunkSize = int64(n)
+		case "user-quota":
+			fallthrough
+		case "user_quota":
+			n, err = parseInt(value)
+			ep.UserQuota = int64(n)
+		case "incomplete-ttl":
+			fallthrough
+		case "incomplete_ttl":
+			c.IncompleteTTL, err = parseDuration(value)
+		case "ttl":
+			c.TTL, err = parseDuration(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			return
+		}
+	}
+	if len(c.Addr) == 0 {
+		err = fmt.Errorf("[field=addr] media should have addr")
+		return
+	}
+	if len(c.Dir) == 0 {
+		err = fmt.Errorf("[field=dir] media should have dir")
+		return
+	}
+	if (len(c.CertFile) == 0) != (len(c.KeyFile) == 0) {
+		err = fmt.Errorf("[field=cert] media should have both cert and key, or neither")
+	}
+	return
+}
+
+// parseTransformers reads a list of transformers. Every transformer
+// is a map with its name and its parameters.
+func parseTransformers(node yaml.Node) (chain transform.Chain, err error) {
+	list, ok := node.(yaml.List)
+	if !ok {
+		err = fmt.Errorf("transforms should be a list")
+		return
+	}
+	chain = make(transform.Chain, 0, len(list))
+	for i, n := range list {
+		fields, ok := n.(yaml.Map)
+		if !ok {
+			err = fmt.Errorf("[transform=%v] transform should be a map", i)
+			return
+		}
+		var name string
+		params := make(map[string]string, len(fields))
+		for k, v := range fields {
+			var str string
+			str, err = parseString(v)
+			if err != nil {
+				err = fmt.Errorf("[transform=%v] [field=%v] %v", i, k, err)
+				return
+			}
+			if k == "name" {
+				name = str
+				continue
+			}
+			params[k] = str
+		}
+		var t transform.Transformer
+		t, err = transform.New(name, params)
+		if err != nil {
+			err = fmt.Errorf("[transform=%v] %v", i, err)
+			return
+		}
+		chain = append(chain, t)
+	}
+	return
+}
+
+// parseValidators reads a list of validators. Every validator is
+// a map with its name and its parameters.
+func parseValidators(node yaml.Node) (chain validate.Chain, err error) {
+	list, ok := node.(yaml.List)
+	if !ok {
+		err = fmt.Errorf("validators should be a list")
+		return
+	}
+	chain = make(validate.Chain, 0, len(list))
+	for i, n := range list {
+		fields, ok := n.(yaml.Map)
+		if !ok {
+			err = fmt.Errorf("[validator=%v] validator should be a map", i)
+			return
+		}
+		var name string
+		params := make(map[string]string, len(fields))
+		for k, v := range fields {
+			var str string
+			str, err = parseString(v)
+			if err != nil {
+				err = fmt.Errorf("[validator=%v] [field=%v] %v", i, k, err)
+				return
+			}
+			if k == "name" {
+				name = str
+				continue
+			}
+			params[k] = str
+		}
+		var v validate.Validator
+		v, err = validate.New(name, params)
+		if err != nil {
+			err = fmt.Errorf("[validator=%v] %v", i, err)
+			return
+		}
+		chain = append(chain, v)
+	}
+	return
+}
+
+func parseListeners(node yaml.Node) (specs []*listener.Spec, err error) {
+	list, ok := node.(yaml.List)
+	if !ok {
+		err = fmt.Errorf("listeners should be a list")
+		return
+	}
+	specs = make([]*listener.Spec, 0, len(list))
+	for i, n := range list {
+		var spec *listener.Spec
+		spec, err = parseListener(n)
+		if err != nil {
+			err = fmt.Errorf("[listener=%v] %v", i, err)
+			return
+		}
+		specs = append(specs, spec)
+	}
+	return
+}
+
+func parsePeer(domain string, node yaml.Node) (peer *federation.Peer, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("peer info should be a map")
+		return
+	}
+	peer = new(federation.Peer)
+	peer.Domain = domain
+	peer.Addr, err = parseString(fields["addr"])
+	if err != nil || len(peer.Addr) == 0 {
+		err = fmt.Errorf("[field=addr] bad address")
+		return
+	}
+	peer.Key, err = parseString(fields["key"])
+	if err != nil || len(peer.Key) == 0 {
+		err = fmt.Errorf("[field=key] peer should have a key")
+		return
+	}
+	return
+}
+
+func parseFederation(node yaml.Node) (relay *federation.Relay, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("federation info should be a map")
+		return
+	}
+	domain, err := parseString(fields["domain"])
+	if err != nil || len(domain) == 0 {
+		err = fmt.Errorf("[field=domain] should have a domain")
+		return
+	}
+	timeout := 3 * time.Second
+	if t, ok := fields["timeout"]; ok {
+		timeout, err = parseDuration(t)
+		if err != nil {
+			err = fmt.Errorf("[field=timeout] %v", err)
+			return
+		}
+	}
+	var peers []*federation.Peer
+	if pn, ok := fields["peers"]; ok {
+		pm, ok := pn.(yaml.Map)
+		if !ok {
+			err = fmt.Errorf("[field=peers] should be a map")
+			return
+		}
+		for d, v := range pm {
+			var peer *federation.Peer
+			peer, err = parsePeer(d, v)
+			if err != nil {
+				err = fmt.Errorf("[peer=%v] %v", d, err)
+				return
+			}
+			peers = append(peers, peer)
+		}
+	}
+	relay = federation.NewRelay(domain, peers, timeout)
+	// The certificates of the peers are checked against the system
+	// roots, or the ones in the ca file.
+	if ca, ok := fields["ca"]; ok {
+		var roots *x509.CertPool
+		roots, err = parseRoots(ca)
+		if err != nil {
+			err = fmt.Errorf("[field=ca] %v", err)
+			return
+		}
+		relay.SetTLSConfig(&tls.Config{RootCAs: roots})
+	}
+	return
+}
+
+// parseRoots reads the certificates of a PEM file.
+func parseRoots(node yaml.Node) (roots *x509.CertPool, err error) {
+	file, err := parseString(node)
+	if err != nil || len(file) == 0 {
+		err = fmt.Errorf("bad ca file")
+		return
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	roots = x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		err = fmt.Errorf("no certificate in %v", file)
+	}
+	return
+}
+
+func parseService(service string, node yaml.Node, defaultConfig *msgcenter.ServiceConfig) (config *msgcenter.ServiceConfig, err error) {
+	if node == nil {
+		config = defaultConfig
+		return
+	}
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("[service=%v] Service information should be a map", service)
+		return
+	}
+	timeout := 3 * time.Second
+
+	if t, ok := fields["timeout"]; ok {
+		timeout, err = parseDuration(t)
+		if err != nil {
+			err = fmt.Errorf("[service=%v][field=timeout] %v", service, err)
+			return
+		}
+	}
+
+	config = new(msgcenter.ServiceConfig)
+
+	if defaultConfig != nil {
+		*config = *defaultConfig
+	}
+
+	for name, value := range fields {
+		switch name {
+		case "msg":
+			config.MessageHandler, err = parseMessageHandler(value, timeout)
+		case "logout":
+			config.LogoutHandler, err = parseLogoutHandler(value, timeout)
+		case "login":
+			config.LoginHandler, err = parseLoginHandler(value, timeout)
+		case "fwd":
+			config.ForwardRequestHandler, err = parseForwardRequestHandler(value, timeout)
+		case "push":
+			config.PushHandler, err = parsePushHandler(value, timeout)
+		case "abuse-scorer":
+			fallthrough
+		case "abuse_scorer":
+			config.AbuseScorer, err = parseAbuseScorer(value, timeout)
+		case "subscribe":
+			config.SubscribeHandler, err = parseSubscribeHandler(value, timeout)
+		case "unsubscribe":
+			config.UnsubscribeHandler, err = parseUnsubscribeHandler(value, timeout)
+		case "uniqush-push":
+			fallthrough
+		case "uniqush_push":
+			config.PushService, err = parseUniqushPush(value, timeout)
+		case "push-payload":
+			fallthrough
+		case "push_payload":
+			config.PushPayload, err = parsePushPayload(value)
+		case "silent-push":
+			fallthrough
+		case "silent_push":
+			config.SilentPush, err = parseBool(value)
+		case "silent-push-cooldown":
+			fallthrough
+		case "silent_push_cooldown":
+			config.SilentPushCooldown, err = parseDuration(value)
+		case "max-conns":
+			fallthrough
+		case "max_conns":
+			config.MaxNrConns, err = parseInt(value)
+		case "max-online-users":
+			fallthrough
+		case "max_online_users":
+			config.MaxNrUsers, err = parseInt(value)
+		case "max-conns-per-user":
+			fallthrough
+		case "max_conns_per_user":
+			config.MaxNrConnsPerUser, err = parseInt(value)
+		case "max-bandwidth":
+			fallthrough
+		case "max_bandwidth":
+			config.MaxBandwidth, err = parseInt(value)
+		case "max-bandwidth-per-conn":
+			fallthrough
+		case "max_bandwidth_per_conn":
+			config.MaxBandwidthPerConn, err = parseInt(value)
+		case "db":
+			config.MsgCache, err = parseCache(value)
+		case "indexed-headers":
+			fallthrough
+		case "indexed_headers":
+			config.IndexedHeaders, err = parseStringList(value)
+		case "blocklist":
+			config.BlockList, err = parseBlockList(value)
+		case "dedup":
+			config.Dedup, err = parseDedup(value)
+		case "badges":
+			config.Badges, err = parseBadges(value)
+		case "assets":
+			config.Assets, err = parseAssets(value)
+		case "asset-refresh":
+			fallthrough
+		case "asset_refresh":
+			config.AssetRefresh, err = parseDuration(value)
+		case "dedup-window":
+			fallthrough
+		case "dedup_window":
+			config.DedupWindow, err = parseDuration(value)
+		case "max-forward-delay":
+			fallthrough
+		case "max_forward_delay":
+			config.MaxForwardDelay, err = parseDuration(value)
+		case "sessions":
+			config.SessionStore, err = parseSessionStore(value)
+		case "quota":
+			config.Quota, err = parseQuota(value)
+		case "resources":
+			config.Resources, err = parseResources(value)
+		case "analytics":
+			config.Analytics, err = parseAnalytics(value)
+		case "forward-audit":
+			fallthrough
+		case "forward_audit":
+			config.ForwardAudit, err = parseForwardAudit(value)
+		case "transforms":
+			config.Transformer, err = parseTransformers(value)
+		case "validators":
+			config.Validator, err = parseValidators(value)
+		case "subscriptions":
+			config.SubscriptionStore, err = parseSubscriptionStore(value)
+		case "plaintext-public":
+			fallthrough
+		case "plaintext_public":
+			config.PlaintextPublic, err = parseBool(value)
+		case "token-binding":
+			fallthrough
+		case "token_binding":
+			config.TokenBinding, err = parseTokenBinding(value)
+		case "conn-memory-limit":
+			fallthrough
+		case "conn_memory_limit":
+			config.ConnMemoryLimit, err = parseMemoryLimit(value)
+		case "slow-consumer":
+			fallthrough
+		case "slow_consumer":
+			config.SlowConsumer, err = parseSlowConsumer(value)
+		case "adaptive-compression":
+			fallthrough
+		case "adaptive_compression":
+			config.AdaptiveCompression, err = parseBool(value)
+		case "body-hash":
+			fallthrough
+		case "body_hash":
+			config.BodyHash, err = parseBool(value)
+		case "compression-dictionary":
+			fallthrough
+		case "compression_dictionary":
+			config.CompressionDictionary, err = parseDictionary(value)
+		case "retry-forwards":
+			fallthrough
+		case "retry_forwards":
+			config.RetryForwards, err = parseBool(value)
+		case "latency-header":
+			fallthrough
+		case "latency_header":
+			config.LatencyHeader, err = parseBool(value)
+		case "recommended-settings":
+			fallthrough
+		case "recommended_settings":
+			config.RecommendedSettings, err = parseSettings(value)
+		case "digest-template":
+			fallthrough
+		case "digest_template":
+			var str string
+			str, err = parseString(value)
+			if err == nil {
+				config.DigestTemplate, err = server.ParseDigestTemplate(str)
+			}
+		case "digest-rules":
+			fallthrough
+		case "digest_rules":
+			config.DigestPolicy, err = parseDigestRules(value)
+		case "err":
+			config.ErrorHandler, err = parseErrorHandler(value, timeout)
+		case "dead-letter":
+			fallthrough
+		case "dead_letter":
+			config.DeadLetterHandler, err = parseDeadLetterHandler(value, timeout)
+		case "message-sink":
+			fallthrough
+		case "message_sink":
+			config.MessageSink, err = parseMessageSink(value, timeout)
+		case "dead-letter-interval":
+			fallthrough
+		case "dead_letter_interval":
+			config.DeadLetterInterval, err = parseDuration(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[service=%v][field=%v] %v", service, name, err)
+			config = nil
+			return
+		}
+	}
+	return
+}
+
+func checkConfig(config *Config) error {
+	if config.Auth == nil {
+		return fmt.Errorf("No authentication url")
+	}
+	return nil
+}
+
+func Parse(filename string) (config *Config, err error) {
+	file, err := yaml.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	root := file.Root
+	config = new(Config)
+	config.filename = filename
+	switch t := root.(type) {
+	case yaml.Map:
+		config.srvConfig = make(map[string]*msgcenter.ServiceConfig, len(t))
+		if dc, ok := t["default"]; ok {
+			config.defaultConfig, err = parseService("default", dc, nil)
+		}
+		if err != nil {
+			config = nil
+			return
+		}
+		for srv, node := range t {
+			switch srv {
+			case "auth":
+				config.Auth, err = parseAuthHandler(node, 3*time.Second)
+				if err != nil {
+					err = fmt.Errorf("auth: %v", err)
+					return
+				}
+				continue
+			case "err":
+				config.ErrorHandler, err = parseErrorHandler(node, 3*time.Second)
+				if err != nil {
+					err = fmt.Errorf("global error handler: %v", err)
+					return
+				}
+				continue
+			case "http-addr":
+				fallthrough
+			case "http_addr":
+				config.HttpAddr, err = parseString(node)
+				if err != nil {
+					err = fmt.Errorf("Bad HTTP bind address: %v", err)
+					return
+				}
+				continue
+			case "grpc-addr":
+				fallthrough
+			case "grpc_addr":
+				config.GrpcAddr, err = parseString(node)
+				if err != nil {
+					err = fmt.Errorf("Bad gRPC bind address: %v", err)
+					return
+				}
+				continue
+			case "handshake-timeout":
+				fallthrough
+			case "handshake_timeout":
+				config.HandshakeTimeout, err = parseDuration(node)
 				if err != nil {
 					err = fmt.Errorf("bad handshake timeout: %v", err)
 					return
 				}
 				continue
+			case "handshake-workers":
+				fallthrough
+			case "handshake_workers":
+				config.HandshakeWorkers, err = parseInt(node)
+				if err != nil {
+					err = fmt.Errorf("bad number of handshake workers: %v", err)
+					return
+				}
+				continue
+			case "key-log":
+				fallthrough
+			case "key_log":
+				config.KeyLog, err = parseString(node)
+				if err != nil {
+					err = fmt.Errorf("bad key log: %v", err)
+					return
+				}
+				continue
+			case "cpu-pool":
+				fallthrough
+			case "cpu_pool":
+				config.CPUWorkers, config.CPUQueueLen, err = parseCPUPool(node)
+				if err != nil {
+					err = fmt.Errorf("cpu pool: %v", err)
+					return
+				}
+				continue
+			case "handshake-limits":
+				fallthrough
+			case "handshake_limits":
+				config.HandshakeLimits, err = parseHandshakeLimits(node)
+				if err != nil {
+					err = fmt.Errorf("handshake limits: %v", err)
+					return
+				}
+				continue
+			case "cluster":
+				config.Cluster, err = parseCluster(node)
+				if err != nil {
+					err = fmt.Errorf("cluster: %v", err)
+					return
+				}
+				continue
+			case "log":
+				config.Logger, err = parseLogger(node)
+				if err != nil {
+					err = fmt.Errorf("log: %v", err)
+					return
+				}
+				continue
+			case "listen":
+				config.Listeners, err = parseListeners(node)
+				if err != nil {
+					err = fmt.Errorf("listen: %v", err)
+					return
+				}
+				continue
+			case "admin":
+				config.AdminAddr, config.AdminKey, config.AdminAuditLog, err = parseAdmin(node)
+				if err != nil {
+					err = fmt.Errorf("admin: %v", err)
+					return
+				}
+				continue
+			case "federation":
+				config.Federation, err = parseFederation(node)
+				if err != nil {
+					err = fmt.Errorf("federation: %v", err)
+					return
+				}
+				continue
+			case "revocation":
+				config.Revocation, err = parseRevocation(node)
+				if err != nil {
+					err = fmt.Errorf("revocation: %v", err)
+					return
+				}
+				continue
+			case "binding":
+				config.Binding, err = parseBindingStore(node)
+				if err != nil {
+					err = fmt.Errorf("binding: %v", err)
+					return
+				}
+				continue
+			case "webhooks":
+				config.Webhooks, err = parseDispatchers(node)
+				if err != nil {
+					err = fmt.Errorf("webhooks: %v", err)
+					return
+				}
+				continue
+			case "archivers":
+				config.Archivers, err = parseArchivers(node)
+				if err != nil {
+					err = fmt.Errorf("archivers: %v", err)
+					return
+				}
+				continue
+			case "kafka-bridge":
+				fallthrough
+			case "kafka_bridge":
+				config.KafkaBridge, err = parseKafkaBridge(node)
+				if err != nil {
+					err = fmt.Errorf("kafka-bridge: %v", err)
+					return
+				}
+				continue
+			case "mqtt-gateway":
+				fallthrough
+			case "mqtt_gateway":
+				config.MqttGateway, err = parseMqttGateway(node)
+				if err != nil {
+					err = fmt.Errorf("mqtt-gateway: %v", err)
+					return
+				}
+				continue
+			case "sse":
+				config.Sse, err = parseSse(node)
+				if err != nil {
+					err = fmt.Errorf("sse: %v", err)
+					return
+				}
+				continue
+			case "media":
+				config.Media, err = parseMedia(node)
+				if err != nil {
+					err = fmt.Errorf("media: %v", err)
+					return
+				}
+				continue
+			case "scheduler":
+				config.Scheduler, config.SchedulerInterval, err = parseScheduler(node)
+				if err != nil {
+					err = fmt.Errorf("scheduler: %v", err)
+					return
+				}
+				continue
 			case "default":
 				// Don't need to parse the default service again.
 				continue
@@ -460,11 +2446,20 @@ func Parse(filename string) (config *Config, err error) {
 				config = nil
 				return
 			}
+			if msgcenter.IsServicePattern(srv) {
+				config.srvPatterns = append(config.srvPatterns, &servicePattern{srv, sconf})
+				continue
+			}
 			config.srvConfig[srv] = sconf
 		}
+		sort.Sort(byLength(config.srvPatterns))
 	default:
 		err = fmt.Errorf("Top level should be a map")
 	}
+	if err == nil && config.Cluster != nil && len(config.Cluster.Node) == 0 {
+		// Other nodes reach this node through its HTTP address.
+		config.Cluster.Node = config.HttpAddr
+	}
 	if err == nil {
 		err = checkConfig(config)
 	}
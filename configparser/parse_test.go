@@ -20,12 +20,33 @@ package configparser
 import (
 	"os"
 	"testing"
+	"time"
+
+	"github.com/kylelemons/go-gypsy/yaml"
+	"github.com/uniqush/uniqush-conn/archive"
+	"github.com/uniqush/uniqush-conn/binding"
+	"github.com/uniqush/uniqush-conn/cluster"
+	"github.com/uniqush/uniqush-conn/evthandler/webhook"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/transform"
+	"github.com/uniqush/uniqush-conn/validate"
 )
 
 func writeConfigFile(filename string) {
 	config := `
 http-addr: 127.0.0.1:8088
+grpc-addr: 127.0.0.1:8090
 handshake-timeout: 10s
+handshake-workers: 32
+handshake-limits:
+  key-exchange-timeout: 3s
+  max-auth-bytes: 4096
+  max-per-addr: 16
+key-log: /tmp/uniqush-keys.log
+cpu-pool:
+  workers: 4
+  queue: 256
 auth:
   default: disallow
   url: http://localhost:8080/auth
@@ -33,6 +54,99 @@ auth:
 err: 
   url: http://localhost:8080/err
   timeout: 3s
+log:
+  level: debug
+listen:
+  - addr: "[::]:8964"
+    proxy-protocol: true
+  - addr: 0.0.0.0:8965
+    type: websocket
+    path: /conn
+    name: ws
+admin:
+  addr: 127.0.0.1:8089
+  key: secret
+  audit-log: syslog:uniqush-admin
+federation:
+  domain: eu.example.com
+  timeout: 3s
+  peers:
+    us.example.com:
+      addr: us.example.com:8088
+      key: secret
+revocation:
+  engine: redis
+  addr: 127.0.0.1:6379
+  name: 4
+binding:
+  engine: redis
+  addr: 127.0.0.1:6379
+  name: 4
+webhooks:
+  - url: http://localhost:8080/events
+    secret: hush
+    events:
+      - connect
+      - disconnect
+      - ack
+    retries: 5
+    backoff: 2s
+  - url: http://localhost:8080/all
+archivers:
+  - sink: s3
+    endpoint: https://s3.example.com
+    bucket: archive
+    prefix: uniqush/
+    access-key: key
+    secret-key: secret
+    services:
+      - service1
+    batch-size: 100
+    flush-interval: 10s
+  - sink: kafka-rest
+    url: http://localhost:8082
+    topic: messages
+kafka-bridge:
+  url: http://localhost:8082
+  inbound-topic: inbound
+  forward-topic: forwards
+  services:
+    - service1
+  timeout: 10s
+mqtt-gateway:
+  addr: 127.0.0.1:1883
+  cert: mqtt-cert.pem
+  key: mqtt-key.pem
+  default-service: service
+  forward-ttl: 1h
+  proxy-protocol: true
+sse:
+  addr: 127.0.0.1:8443
+  cert: cert.pem
+  key: key.pem
+  idle-timeout: 5m
+  allow-origin: "*"
+  proxy-protocol: true
+media:
+  addr: 127.0.0.1:8444
+  dir: /var/lib/uniqush-conn/media
+  max-size: 1048576
+  max-chunk-size: 65536
+  user-quota: 10485760
+  incomplete-ttl: 1h
+  ttl: 720h
+scheduler:
+  engine: redis
+  addr: 127.0.0.1:6379
+  name: 8
+  interval: 5s
+cluster:
+  timeout: 3s
+  feed-campaigns: true
+  db:
+    engine: redis
+    addr: 127.0.0.1:6379
+    name: 2
 default:
   msg:
     url: http://localhost:8080/msg
@@ -40,6 +154,15 @@ default:
   err: 
     url: http://localhost:8080/err
     timeout: 3s
+  dead-letter:
+    url: http://localhost:8080/dead-letter
+    timeout: 3s
+  dead-letter-interval: 30s
+  message-sink:
+    url: http://localhost:8080/history
+    timeout: 3s
+    queue: 128
+    workers: 2
   login: 
     url: http://localhost:8080/login
     timeout: 3s
@@ -66,29 +189,365 @@ default:
   uniqush-push:
     addr: localhost:9898
     timeout: 3s
+  push-payload:
+    title: "{sender}"
+    body: "{title}"
+    badge: "{unread}"
+    collapse-key: "{thread}"
+  silent-push: true
+  silent-push-cooldown: 30m
   max-conns: 2048
   max-online-users: 2048
   max-conns-per-user: 10
+  max-bandwidth: 1048576
+  compression-dictionary:
+    id: chat-v1
+    file: dict.bin
+  plaintext-public: true
+  token-binding:
+    device: true
+    ipv4-prefix: 24
+    ipv6-prefix: 64
+  max-bandwidth-per-conn: 65536
+  latency-header: true
+  retry-forwards: true
+  recommended-settings:
+    digest-threshold: 512
+    ping-interval: 30s
+  digest-template: "New message from {sender}: {title}"
+  digest-rules:
+    - header: tag
+      value: media
+      threshold: always
+    - header: tag
+      value: control
+      threshold: never
+    - header: priority
+      value: low
+      threshold: 256
+  blocklist:
+    engine: redis
+    addr: 127.0.0.1:6379
+    name: 3
+  dedup:
+    engine: redis
+    addr: 127.0.0.1:6379
+    name: 6
+  dedup-window: 10m
+  badges:
+    engine: redis
+    addr: 127.0.0.1:6379
+    name: 6
+  assets:
+    engine: redis
+    addr: 127.0.0.1:6379
+    name: 6
+  asset-refresh: 30s
+  max-forward-delay: 48h
+  transforms:
+    - name: header
+      x-origin: server
+    - name: truncate
+      max-size: 4096
+    - name: redact
+      pattern: email
+  validators:
+    - name: required
+      headers: type
+    - name: format
+      type: text|image
+  sessions:
+    engine: redis
+    addr: 127.0.0.1:6379
+    name: 7
+  quota:
+    engine: redis
+    addr: 127.0.0.1:6379
+    name: 9
+    messages-per-user: 1000
+    bytes_per_service: 1048576
+  resources:
+    max-goroutines: 256
+    max-queued-goroutines: 1024
+    max_cache_memory: 67108864
+  analytics:
+    engine: memory
+    flush-interval: 1m
+  abuse-scorer:
+    url: http://localhost:8080/score
+    timeout: 1s
+  forward-audit:
+    engine: redis
+    addr: 127.0.0.1:6379
+    name: 10
+    retention: 720h
+  subscriptions:
+    engine: redis
+    addr: 127.0.0.1:6379
+    name: 5
   db:
     engine: redis
     addr: 127.0.0.1:6379
     name: 1
+    ids: sortable
+  adaptive-compression: true
+  body-hash: true
+  conn-memory-limit:
+    bytes: 4194304
+    policy: disconnect
+  slow-consumer:
+    latency: 2s
+    queue-depth: 64
+    window: 30s
+    action: deprioritize
+  indexed-headers:
+    - type
+    - room
+chat.*:
+  max-conns: 100
+chat.vip.*:
+  max-conns: 1000
     `
 	file, _ := os.Create(filename)
 	file.WriteString(config)
 	file.Close()
+	file, _ = os.Create("dict.bin")
+	file.WriteString(`{"title":"","sender":""}`)
+	file.Close()
 }
 
 func deleteConfigFile(filename string) {
 	os.Remove(filename)
+	os.Remove("dict.bin")
 }
 
 func TestParse(t *testing.T) {
 	filename := "config.yaml"
 	writeConfigFile(filename)
 	defer deleteConfigFile(filename)
-	_, err := Parse(filename)
+	config, err := Parse(filename)
 	if err != nil {
 		t.Errorf("Error: %v\n", err)
+		return
+	}
+	if config.Cluster == nil || config.Cluster.Node != config.HttpAddr || !config.Cluster.FeedCampaigns || config.Cluster.DeliveryOnly {
+		t.Errorf("Bad cluster config: %+v\n", config.Cluster)
+	}
+	if config.Federation == nil || config.Federation.Domain() != "eu.example.com" {
+		t.Errorf("Bad federation config\n")
+	}
+	if config.Revocation == nil {
+		t.Errorf("Bad revocation config\n")
+	}
+	if config.Binding == nil {
+		t.Errorf("Bad binding config\n")
+	}
+	if len(config.Webhooks) != 2 || !config.Webhooks[0].Accepts("ack") || config.Webhooks[0].Accepts("message") || !config.Webhooks[1].Accepts("message") {
+		t.Errorf("Bad webhooks\n")
+	}
+	if len(config.Archivers) != 2 || !config.Archivers[0].Archives("service1") || config.Archivers[0].Archives("service2") || !config.Archivers[1].Archives("service2") {
+		t.Errorf("Bad archivers\n")
+	} else {
+		s3, ok := config.Archivers[0].Sink().(*archive.S3Sink)
+		if !ok || s3.Bucket != "archive" || s3.Region != "us-east-1" || s3.AccessKey != "key" || s3.SecretKey != "secret" {
+			t.Errorf("Bad s3 sink: %+v\n", config.Archivers[0].Sink())
+		}
+		kafka, ok := config.Archivers[1].Sink().(*archive.KafkaRestSink)
+		if !ok || kafka.Topic != "messages" {
+			t.Errorf("Bad kafka sink: %+v\n", config.Archivers[1].Sink())
+		}
+	}
+	if b := config.KafkaBridge; b == nil || !b.Forwards("service1") || b.Forwards("service2") {
+		t.Errorf("Bad kafka bridge\n")
+	}
+	if c := config.MqttGateway; c == nil || c.Addr != "127.0.0.1:1883" || c.CertFile != "mqtt-cert.pem" || c.KeyFile != "mqtt-key.pem" ||
+		c.Gateway.DefaultService != "service" || c.Gateway.ForwardTTL != time.Hour || !c.Gateway.ProxyProtocol {
+		t.Errorf("Bad mqtt gateway\n")
+	}
+	if c := config.Sse; c == nil || c.Addr != "127.0.0.1:8443" || c.CertFile != "cert.pem" || c.KeyFile != "key.pem" ||
+		c.Endpoint.IdleTimeout != 5*time.Minute || c.Endpoint.AllowOrigin != "*" || !c.Endpoint.ProxyProtocol {
+		t.Errorf("Bad sse endpoint\n")
+	}
+	if c := config.Media; c == nil || c.Addr != "127.0.0.1:8444" || c.Dir != "/var/lib/uniqush-conn/media" ||
+		c.Endpoint.MaxSize != 1048576 || c.Endpoint.MaxChunkSize != 65536 || c.Endpoint.UserQuota != 10485760 ||
+		c.IncompleteTTL != time.Hour || c.TTL != 720*time.Hour {
+		t.Errorf("Bad media endpoint\n")
+	}
+	if config.Scheduler == nil || config.SchedulerInterval != 5*time.Second {
+		t.Errorf("Bad scheduler\n")
+	}
+	if l := config.HandshakeLimits; l.KeyExchangeTimeout != 3*time.Second || l.MaxAuthBytes != 4096 || l.Guard == nil {
+		t.Errorf("Bad handshake limits: %+v\n", l)
+	}
+	if config.HandshakeWorkers != 32 {
+		t.Errorf("Bad number of handshake workers: %v\n", config.HandshakeWorkers)
+	}
+	if config.KeyLog != "/tmp/uniqush-keys.log" {
+		t.Errorf("Bad key log: %v\n", config.KeyLog)
+	}
+	if config.CPUWorkers != 4 || config.CPUQueueLen != 256 {
+		t.Errorf("Bad cpu pool: %v %v\n", config.CPUWorkers, config.CPUQueueLen)
+	}
+	if config.GrpcAddr != "127.0.0.1:8090" {
+		t.Errorf("Bad gRPC address: %v\n", config.GrpcAddr)
+	}
+	if config.AdminAddr != "127.0.0.1:8089" || config.AdminKey != "secret" || config.AdminAuditLog != "syslog:uniqush-admin" {
+		t.Errorf("Bad admin config\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.DigestTemplate == nil {
+		t.Errorf("Bad digest template\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || len(srv.DigestPolicy) != 3 ||
+		srv.DigestPolicy[0].Value != "media" || srv.DigestPolicy[0].Threshold != server.DIGEST_ALWAYS ||
+		srv.DigestPolicy[1].Threshold != server.DIGEST_NEVER ||
+		srv.DigestPolicy[2].Header != "priority" || srv.DigestPolicy[2].Threshold != 256 {
+		t.Errorf("Bad digest rules\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.BlockList == nil {
+		t.Errorf("Bad block list\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.Transformer == nil || len(srv.Transformer.(transform.Chain)) != 3 {
+		t.Errorf("Bad transforms\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.Validator == nil {
+		t.Errorf("Bad validators\n")
+	} else if verr := srv.Validator.Validate(&validate.Context{}, &proto.Message{}); verr == nil || verr.Header != "type" {
+		t.Errorf("Bad validators: %v\n", verr)
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.SessionStore == nil {
+		t.Errorf("Bad session store\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.Quota == nil ||
+		srv.Quota.Limits().MessagesPerUser != 1000 || srv.Quota.Limits().BytesPerService != 1048576 {
+		t.Errorf("Bad quota\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.Analytics == nil {
+		t.Errorf("Bad analytics\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.AbuseScorer == nil {
+		t.Errorf("Bad abuse scorer\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.ForwardAudit == nil {
+		t.Errorf("Bad forward audit\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.Resources.MaxGoroutines != 256 || srv.Resources.MaxQueuedGoroutines != 1024 || srv.Resources.MaxCacheMemory != 67108864 {
+		t.Errorf("Bad resources\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.MaxBandwidth != 1048576 || srv.MaxBandwidthPerConn != 65536 {
+		t.Errorf("Bad bandwidth limits\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || !srv.PlaintextPublic {
+		t.Errorf("Bad plaintext-public\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.TokenBinding == nil ||
+		*srv.TokenBinding != (binding.Policy{Device: true, IPv4Prefix: 24, IPv6Prefix: 64}) {
+		t.Errorf("Bad token-binding\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.CompressionDictionary == nil || srv.CompressionDictionary.Id != "chat-v1" {
+		t.Errorf("Bad compression dictionary\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.RecommendedSettings == nil ||
+		*srv.RecommendedSettings != (proto.Settings{DigestThreshold: 512, CompressThreshold: 1024, PingInterval: 30 * time.Second}) {
+		t.Errorf("Bad recommended settings\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.DeadLetterHandler == nil || srv.DeadLetterInterval != 30*time.Second {
+		t.Errorf("Bad dead-letter handling\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.MessageSink == nil {
+		t.Errorf("Bad message sink\n")
+	} else if hd, ok := srv.MessageSink.Sink().(*webhook.MessageSink); !ok || hd.URL != "http://localhost:8080/history" {
+		t.Errorf("Bad message sink web hook\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.Dedup == nil || srv.DedupWindow != 10*time.Minute {
+		t.Errorf("Bad dedup config\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.MaxForwardDelay != 48*time.Hour {
+		t.Errorf("Bad max forward delay\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || !srv.RetryForwards {
+		t.Errorf("Bad forward retry\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || !srv.LatencyHeader {
+		t.Errorf("Bad latency header\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.SubscriptionStore == nil {
+		t.Errorf("Bad subscription store\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || !srv.AdaptiveCompression {
+		t.Errorf("Bad adaptive compression\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || !srv.BodyHash {
+		t.Errorf("Bad body hash\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.PushPayload == nil || srv.PushPayload.Title == nil || srv.PushPayload.CollapseKey == nil {
+		t.Errorf("Bad push payload\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || !srv.SilentPush || srv.SilentPushCooldown != 30*time.Minute {
+		t.Errorf("Bad silent push\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.Badges == nil {
+		t.Errorf("Bad badges\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.Assets == nil || srv.AssetRefresh != 30*time.Second {
+		t.Errorf("Bad assets\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.ConnMemoryLimit == nil || srv.ConnMemoryLimit.Bytes != 4194304 || !srv.ConnMemoryLimit.Disconnects() {
+		t.Errorf("Bad connection memory limit\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || srv.SlowConsumer == nil || srv.SlowConsumer.Latency != 2*time.Second || srv.SlowConsumer.QueueDepth != 64 || srv.SlowConsumer.Window != 30*time.Second || srv.SlowConsumer.Action != server.SLOW_CONSUMER_DEPRIORITIZE {
+		t.Errorf("Bad slow consumer policy\n")
+	}
+	if srv := config.ReadConfig("service"); srv == nil || len(srv.IndexedHeaders) != 2 || srv.IndexedHeaders[1] != "room" {
+		t.Errorf("Bad indexed headers\n")
+	}
+	if srvs := config.AllServices(); len(srvs) != 0 {
+		t.Errorf("Patterns should not be listed as services: %v\n", srvs)
+	}
+	if srv := config.ReadConfig("chat.tenant"); srv == nil || srv.MaxNrConns != 100 {
+		t.Errorf("Bad config for a service matching chat.*\n")
+	}
+	if srv := config.ReadConfig("chat.vip.tenant"); srv == nil || srv.MaxNrConns != 1000 {
+		t.Errorf("The most specific pattern should be used\n")
+	}
+	if srv := config.ReadConfig("game"); srv == nil || srv.MaxNrConns != 2048 {
+		t.Errorf("Bad default config\n")
+	}
+	if len(config.Listeners) != 2 || !config.Listeners[0].ProxyProtocol || config.Listeners[1].Type != "websocket" || config.Listeners[1].Path != "/conn" || config.Listeners[1].Name != "ws" {
+		t.Errorf("Bad listeners\n")
+	}
+	if config.Logger == nil {
+		t.Errorf("Bad log config\n")
+	}
+}
+
+func TestParseNatsCluster(t *testing.T) {
+	node := yaml.Map{
+		"transport": yaml.Scalar("nats"),
+		"db": yaml.Map{
+			"engine": yaml.Scalar("redis"),
+			"addr":   yaml.Scalar("127.0.0.1:6379"),
+		},
+		"nats": yaml.Map{
+			"url":            yaml.Scalar("nats://127.0.0.1:4222"),
+			"subject-prefix": yaml.Scalar("eu"),
+			"user":           yaml.Scalar("node"),
+			"password":       yaml.Scalar("secret"),
+			"tls":            yaml.Scalar("true"),
+		},
+		"delivery-only": yaml.Scalar("true"),
+	}
+	c, err := parseCluster(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Transport.(*cluster.NatsTransport); !ok {
+		t.Errorf("Bad transport: %T\n", c.Transport)
+	}
+	if !c.DeliveryOnly || c.FeedCampaigns {
+		t.Errorf("Bad delivery-only mode: %+v\n", c)
+	}
+	node["transport"] = yaml.Scalar("carrier-pigeon")
+	if _, err = parseCluster(node); err == nil {
+		t.Errorf("Unknown transport accepted\n")
 	}
 }
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package dedup remembers the idempotency keys of the forward
+// requests for a while, so that a request retried by the client
+// after an ambiguous failure is forwarded only once.
+package dedup
+
+import (
+	"sync"
+	"time"
+)
+
+// Store is consulted in the forward path. A key is scoped by the
+// sender, identified by (service, username).
+type Store interface {
+	// Seen records the key for window and tells if it has already
+	// been recorded within the window.
+	Seen(service, username, key string, window time.Duration) (dup bool, err error)
+
+	// Forget removes the key, e.g. when the request failed, so
+	// that it could be retried.
+	Forget(service, username, key string) error
+}
+
+type memStore struct {
+	lock sync.Mutex
+	keys map[string]time.Time
+}
+
+// NewMemoryStore returns a Store which remembers the keys seen by this
+// node only. A request retried on another node is not found to be a
+// duplicate.
+func NewMemoryStore() Store {
+	ret := new(memStore)
+	ret.keys = make(map[string]time.Time, 100)
+	return ret
+}
+
+func senderKey(service, username, key string) string {
+	return service + "\n" + username + "\n" + key
+}
+
+func (self *memStore) Seen(service, username, key string, window time.Duration) (dup bool, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	// Drop the expired keys from time to time.
+	if len(self.keys) >= 1024 {
+		for k, expire := range self.keys {
+			if !expire.After(now) {
+				delete(self.keys, k)
+			}
+		}
+	}
+	k := senderKey(service, username, key)
+	if expire, ok := self.keys[k]; ok && expire.After(now) {
+		dup = true
+		return
+	}
+	self.keys[k] = now.Add(window)
+	return
+}
+
+func (self *memStore) Forget(service, username, key string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.keys, senderKey(service, username, key))
+	return nil
+}
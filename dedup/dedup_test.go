@@ -0,0 +1,76 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package dedup
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+	"time"
+)
+
+func getRedisStore() Store {
+	db := 6
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	c.Do("SELECT", db)
+	c.Do("FLUSHDB")
+	c.Close()
+	return NewRedisStore("", "", db)
+}
+
+func testStore(store Store, t *testing.T) {
+	window := 500 * time.Millisecond
+	dup, err := store.Seen("srv", "alice", "k1", window)
+	if err != nil || dup {
+		t.Errorf("the first request is a duplicate: %v", err)
+	}
+	dup, err = store.Seen("srv", "alice", "k1", window)
+	if err != nil || !dup {
+		t.Errorf("the retry is not a duplicate: %v", err)
+	}
+	// Keys are per sender.
+	dup, err = store.Seen("srv", "bob", "k1", window)
+	if err != nil || dup {
+		t.Errorf("bob's request is a duplicate: %v", err)
+	}
+	dup, err = store.Seen("other", "alice", "k1", window)
+	if err != nil || dup {
+		t.Errorf("the request from another service is a duplicate: %v", err)
+	}
+
+	if err = store.Forget("srv", "alice", "k1"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	dup, err = store.Seen("srv", "alice", "k1", window)
+	if err != nil || dup {
+		t.Errorf("a forgotten key is a duplicate: %v", err)
+	}
+
+	time.Sleep(2 * window)
+	dup, err = store.Seen("srv", "alice", "k1", window)
+	if err != nil || dup {
+		t.Errorf("the key outlives the window: %v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(NewMemoryStore(), t)
+}
+
+func TestRedisStore(t *testing.T) {
+	testStore(getRedisStore(), t)
+}
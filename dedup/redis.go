@@ -0,0 +1,65 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package dedup
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/redispool"
+	"time"
+)
+
+type redisStore struct {
+	pool *redis.Pool
+}
+
+// NewRedisStore keeps every key in redis until its window passes.
+func NewRedisStore(addr, password string, db int) Store {
+	pool := redispool.New(addr, password, db)
+
+	ret := new(redisStore)
+	ret.pool = pool
+	return ret
+}
+
+func dedupKey(service, username, key string) string {
+	return fmt.Sprintf("dedup:%v:%v:%v", service, username, key)
+}
+
+func (self *redisStore) Seen(service, username, key string, window time.Duration) (dup bool, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	ms := int64(window / time.Millisecond)
+	if ms <= 0 {
+		ms = 1
+	}
+	reply, err := conn.Do("SET", dedupKey(service, username, key), 1, "PX", ms, "NX")
+	if err != nil {
+		return
+	}
+	// The key is not set if it exists.
+	dup = reply == nil
+	return
+}
+
+func (self *redisStore) Forget(service, username, key string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", dedupKey(service, username, key))
+	return err
+}
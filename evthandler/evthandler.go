@@ -18,6 +18,8 @@
 package evthandler
 
 import (
+	"github.com/uniqush/uniqush-conn/audit"
+	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/server"
 	"time"
@@ -40,6 +42,14 @@ type ForwardRequestHandler interface {
 	MaxTTL() time.Duration
 }
 
+// ForwardDecider may be implemented by a ForwardRequestHandler to
+// change the TTL of the requests it accepts. It is used instead of
+// ShouldForward() if implemented. A zero ttl keeps the TTL asked by
+// the sender, limited by MaxTTL().
+type ForwardDecider interface {
+	DecideForward(fwd *server.ForwardRequest) (accept bool, ttl time.Duration)
+}
+
 type ErrorHandler interface {
 	OnError(service, username, connId, addr string, err error)
 }
@@ -55,3 +65,61 @@ type UnsubscribeHandler interface {
 type PushHandler interface {
 	ShouldPush(service, username string, info map[string]string) bool
 }
+
+// DeadLetterHandler is told about the cached messages which expired
+// before they were delivered, so that they could be sent in another
+// way, e.g. by email.
+type DeadLetterHandler interface {
+	OnDeadLetter(letter *msgcache.DeadLetter)
+}
+
+// DeadLetterFunc is a function used as a DeadLetterHandler.
+type DeadLetterFunc func(letter *msgcache.DeadLetter)
+
+func (self DeadLetterFunc) OnDeadLetter(letter *msgcache.DeadLetter) {
+	self(letter)
+}
+
+// DeadLetterChannel is a channel used as a DeadLetterHandler.
+type DeadLetterChannel chan<- *msgcache.DeadLetter
+
+func (self DeadLetterChannel) OnDeadLetter(letter *msgcache.DeadLetter) {
+	self <- letter
+}
+
+// The actions of an AbuseVerdict.
+const (
+	ABUSE_ACCEPT      = "accept"
+	ABUSE_SHADOW_DROP = "shadow-drop"
+	ABUSE_FLAG        = "flag"
+)
+
+// AbuseRequest is a forward request to score.
+type AbuseRequest struct {
+	Service       string         `json:"service"`
+	Receiver      string         `json:"receiver"`
+	Sender        string         `json:"sender"`
+	SenderService string         `json:"senderService"`
+	Message       *proto.Message `json:"msg"`
+
+	// History is the requests recently sent by the sender, the most
+	// recent first, if the service keeps a forward audit trail.
+	History []*audit.Record `json:"history,omitempty"`
+}
+
+// AbuseVerdict tells what to do with a request. A shadow-dropped
+// message is recalled from the receiver, but the sender is not told.
+// A flagged message is kept and reported.
+type AbuseVerdict struct {
+	// Action is one of ABUSE_*. Empty means ABUSE_ACCEPT.
+	Action string  `json:"action"`
+	Score  float64 `json:"score,omitempty"`
+	Reason string  `json:"reason,omitempty"`
+}
+
+// AbuseScorer scores the forward requests, e.g. by asking a spam
+// detection service. It is called concurrently, once the requests
+// are delivered.
+type AbuseScorer interface {
+	Score(req *AbuseRequest) (verdict *AbuseVerdict, err error)
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/backoff"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/proto"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The headers of the requests posted by a Dispatcher.
+const (
+	EventHeader     = "X-Uniqush-Event"
+	TimestampHeader = "X-Uniqush-Timestamp"
+	SignatureHeader = "X-Uniqush-Signature"
+)
+
+// The number of events waiting to be posted. Events are dropped
+// when the queue is full, e.g. when the web hook is down and the
+// dispatcher keeps retrying.
+const dispatchQueueSize = 1024
+
+// Dispatcher posts the events of a message center, as JSON objects,
+// to a URL. Unlike the other web hooks, it never decides anything
+// for the server, so it retries a failed post with an exponential
+// backoff instead of blocking the server.
+//
+// If there is a secret, every post is signed: the SignatureHeader is
+// "sha256=" followed by the hex encoded HMAC-SHA256, keyed by the
+// secret, of the TimestampHeader, a '.' and the body.
+type Dispatcher struct {
+	url     string
+	secret  []byte
+	events  map[string]bool
+	retries int
+	backoff time.Duration
+	client  *http.Client
+	logger  logger.Logger
+
+	queue    chan *msgcenter.Event
+	stop     chan bool
+	stopOnce sync.Once
+}
+
+// NewDispatcher posts the events of the types, which are the
+// msgcenter.EVENT_* constants, to url. All events but
+// msgcenter.EVENT_DELIVER are posted if no type is given. By default,
+// a post is retried three times, at least one second apart, and times
+// out after three seconds.
+func NewDispatcher(url, secret string, types ...string) *Dispatcher {
+	ret := new(Dispatcher)
+	ret.url = url
+	if len(secret) > 0 {
+		ret.secret = []byte(secret)
+	}
+	ret.events = make(map[string]bool, len(types))
+	for _, t := range types {
+		ret.events[t] = true
+	}
+	ret.retries = 3
+	ret.backoff = time.Second
+	ret.client = &http.Client{Timeout: 3 * time.Second}
+	ret.logger = logger.Nop()
+	ret.queue = make(chan *msgcenter.Event, dispatchQueueSize)
+	ret.stop = make(chan bool)
+	return ret
+}
+
+// SetRetries sets the number of retries of a failed post, and the
+// wait before the first one. See backoff.Next.
+func (self *Dispatcher) SetRetries(retries int, backoff time.Duration) {
+	self.retries = retries
+	self.backoff = backoff
+}
+
+func (self *Dispatcher) SetTimeout(timeout time.Duration) {
+	self.client.Timeout = timeout
+}
+
+func (self *Dispatcher) SetLogger(l logger.Logger) {
+	self.logger = logger.OrNop(l).With("webhook", self.url)
+}
+
+func (self *Dispatcher) Accepts(eventType string) bool {
+	if len(self.events) == 0 {
+		// There is one per message delivered; ask for it.
+		return eventType != msgcenter.EVENT_DELIVER
+	}
+	return self.events[eventType]
+}
+
+// Listen posts the events of the source until Stop() is called.
+func (self *Dispatcher) Listen(source msgcenter.EventSource) {
+	source.Listen(self.queue)
+	go func() {
+		defer source.Unlisten(self.queue)
+		for {
+			select {
+			case <-self.stop:
+				return
+			case evt := <-self.queue:
+				if !self.Accepts(evt.Type) {
+					continue
+				}
+				if err := self.Dispatch(evt); err != nil {
+					self.logger.Warn("cannot post event", "type", evt.Type, "err", err)
+				}
+			}
+		}
+	}()
+}
+
+func (self *Dispatcher) Stop() {
+	self.stopOnce.Do(func() {
+		close(self.stop)
+	})
+}
+
+type dispatchedEvent struct {
+	Type            string            `json:"type"`
+	Time            int64             `json:"time"`
+	Service         string            `json:"service"`
+	Username        string            `json:"username"`
+	ConnId          string            `json:"connId,omitempty"`
+	Addr            string            `json:"addr,omitempty"`
+	Reason          string            `json:"reason,omitempty"`
+	MessageId       string            `json:"msgId,omitempty"`
+	Read            bool              `json:"read,omitempty"`
+	Receiver        string            `json:"receiver,omitempty"`
+	ReceiverService string            `json:"receiverService,omitempty"`
+	Sender          string            `json:"sender,omitempty"`
+	SenderService   string            `json:"senderService,omitempty"`
+	Msg             *proto.Message    `json:"msg,omitempty"`
+	Params          map[string]string `json:"params,omitempty"`
+}
+
+// Sign returns the value of the SignatureHeader.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatch posts the event, and retries if the post fails or the
+// web hook replies 429 or 5xx. Other replies are not retried.
+func (self *Dispatcher) Dispatch(evt *msgcenter.Event) error {
+	now := time.Now()
+	body, err := json.Marshal(&dispatchedEvent{
+		Type:            evt.Type,
+		Time:            now.Unix(),
+		Service:         evt.Service,
+		Username:        evt.Username,
+		ConnId:          evt.ConnId,
+		Addr:            evt.Addr,
+		Reason:          evt.Reason,
+		MessageId:       evt.MessageId,
+		Read:            evt.Read,
+		Receiver:        evt.Receiver,
+		ReceiverService: evt.ReceiverService,
+		Sender:          evt.Sender,
+		SenderService:   evt.SenderService,
+		Msg:             evt.Message,
+		Params:          evt.Params,
+	})
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	wait := self.backoff
+	for i := 0; ; i++ {
+		var retry bool
+		retry, err = self.post(evt.Type, timestamp, body)
+		if !retry || i >= self.retries {
+			return err
+		}
+		self.logger.Debug("retrying event", "type", evt.Type, "err", err, "backoff", wait)
+		select {
+		case <-self.stop:
+			return err
+		case <-time.After(wait):
+		}
+		wait = backoff.Next(wait)
+	}
+}
+
+func (self *Dispatcher) post(eventType, timestamp string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", self.url, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, eventType)
+	req.Header.Set(TimestampHeader, timestamp)
+	if len(self.secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(self.secret, timestamp, body))
+	}
+	resp, err := self.client.Do(req)
+	if err != nil {
+		retry = true
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxReplySize))
+	if resp.StatusCode/100 == 2 {
+		return
+	}
+	err = fmt.Errorf("web hook replied %v", resp.StatusCode)
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5
+	return
+}
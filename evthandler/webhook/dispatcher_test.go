@@ -0,0 +1,138 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSource struct {
+	lock sync.Mutex
+	ch   chan<- *msgcenter.Event
+}
+
+func (self *fakeSource) Listen(ch chan<- *msgcenter.Event) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ch = ch
+}
+
+func (self *fakeSource) Unlisten(ch chan<- *msgcenter.Event) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ch = nil
+}
+
+func (self *fakeSource) publish(evt *msgcenter.Event) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ch <- evt
+}
+
+type postedEvent struct {
+	header http.Header
+	body   []byte
+}
+
+func TestDispatcher(t *testing.T) {
+	posted := make(chan *postedEvent, 10)
+	var lock sync.Mutex
+	nrFailures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if nrFailures > 0 {
+			nrFailures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		posted <- &postedEvent{r.Header, body}
+	}))
+	defer srv.Close()
+
+	d := NewDispatcher(srv.URL, "secret", msgcenter.EVENT_CONNECT, msgcenter.EVENT_ACK)
+	d.SetRetries(3, 10*time.Millisecond)
+	source := new(fakeSource)
+	d.Listen(source)
+	defer d.Stop()
+
+	source.publish(&msgcenter.Event{Type: msgcenter.EVENT_MESSAGE, Service: "srv", Username: "alice"})
+	source.publish(&msgcenter.Event{Type: msgcenter.EVENT_ACK, Service: "srv", Username: "alice", ConnId: "c1", MessageId: "m1", Read: true})
+
+	var p *postedEvent
+	select {
+	case p = <-posted:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the event is not posted")
+	}
+	if p.header.Get(EventHeader) != msgcenter.EVENT_ACK {
+		t.Errorf("bad event type: %v", p.header.Get(EventHeader))
+	}
+	if sig := Sign([]byte("secret"), p.header.Get(TimestampHeader), p.body); p.header.Get(SignatureHeader) != sig {
+		t.Errorf("bad signature: %v; should be %v", p.header.Get(SignatureHeader), sig)
+	}
+	var evt dispatchedEvent
+	if err := json.Unmarshal(p.body, &evt); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if evt.Type != msgcenter.EVENT_ACK || evt.Username != "alice" || evt.MessageId != "m1" || !evt.Read || evt.Time == 0 {
+		t.Errorf("bad event: %+v", evt)
+	}
+	select {
+	case p = <-posted:
+		t.Errorf("the message event should not be posted: %s", p.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	nrPosts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nrPosts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	d := NewDispatcher(srv.URL, "")
+	d.SetRetries(2, time.Millisecond)
+	err := d.Dispatch(&msgcenter.Event{Type: msgcenter.EVENT_DISCONNECT, Service: "srv", Username: "alice"})
+	if err == nil || nrPosts != 3 {
+		t.Errorf("should be posted three times: %v %v", nrPosts, err)
+	}
+
+	nrPosts = 0
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nrPosts++
+		if r.Header.Get(SignatureHeader) != "" {
+			t.Errorf("should not be signed")
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	err = d.Dispatch(&msgcenter.Event{Type: msgcenter.EVENT_DISCONNECT, Service: "srv", Username: "alice"})
+	if err == nil || nrPosts != 1 {
+		t.Errorf("a bad request should not be retried: %v %v", nrPosts, err)
+	}
+}
@@ -20,8 +20,14 @@ package webhook
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/evthandler"
+	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/sink"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"time"
@@ -64,13 +70,24 @@ func timeoutDialler(ns time.Duration) func(net, addr string) (c net.Conn, err er
 	}
 }
 
+// The maximum size of a reply read from a web hook.
+const maxReplySize = 64 * 1024
+
 func (self *webHook) post(data interface{}) int {
+	status, _ := self.postForReply(data)
+	return status
+}
+
+// postForReply is like post, but it returns the body of the reply as well.
+// The body is nil if the default status is used.
+func (self *webHook) postForReply(data interface{}) (status int, reply []byte) {
+	status = self.Default
 	if len(self.URL) == 0 || self.URL == "none" {
-		return self.Default
+		return
 	}
 	jdata, err := json.Marshal(data)
 	if err != nil {
-		return self.Default
+		return
 	}
 	c := http.Client{
 		Transport: &http.Transport{
@@ -79,10 +96,12 @@ func (self *webHook) post(data interface{}) int {
 	}
 	resp, err := c.Post(self.URL, "application/json", bytes.NewReader(jdata))
 	if err != nil {
-		return self.Default
+		return
 	}
 	defer resp.Body.Close()
-	return resp.StatusCode
+	status = resp.StatusCode
+	reply, _ = ioutil.ReadAll(io.LimitReader(resp.Body, maxReplySize))
+	return
 }
 
 type loginEvent struct {
@@ -148,6 +167,28 @@ func (self *ErrorHandler) OnError(service, username, connId, addr string, reason
 	self.post(&errorEvent{service, username, connId, addr, reason.Error()})
 }
 
+type DeadLetterHandler struct {
+	webHook
+}
+
+func (self *DeadLetterHandler) OnDeadLetter(letter *msgcache.DeadLetter) {
+	self.post(letter)
+}
+
+// MessageSink posts every record to the web hook, which should
+// reply 200 once the record is stored.
+type MessageSink struct {
+	webHook
+}
+
+func (self *MessageSink) Persist(rec *sink.Record) error {
+	status := self.post(rec)
+	if status != 200 {
+		return fmt.Errorf("message sink replied %v", status)
+	}
+	return nil
+}
+
 type ForwardRequestHandler struct {
 	webHook
 	maxTTL time.Duration
@@ -157,6 +198,33 @@ func (self *ForwardRequestHandler) ShouldForward(fwd *server.ForwardRequest) boo
 	return self.post(fwd) == 200
 }
 
+type forwardDecision struct {
+	TTL string `json:"ttl"`
+}
+
+// DecideForward accepts the request if the web hook replies 200.
+// The reply may be a JSON object like {"ttl": "24h"} to change the
+// TTL of the forwarded message.
+func (self *ForwardRequestHandler) DecideForward(fwd *server.ForwardRequest) (accept bool, ttl time.Duration) {
+	status, reply := self.postForReply(fwd)
+	if status != 200 {
+		return
+	}
+	accept = true
+	if len(reply) == 0 {
+		return
+	}
+	var decision forwardDecision
+	if json.Unmarshal(reply, &decision) != nil || len(decision.TTL) == 0 {
+		return
+	}
+	ttl, err := time.ParseDuration(decision.TTL)
+	if err != nil || ttl < 0 {
+		ttl = 0
+	}
+	return
+}
+
 func (self *ForwardRequestHandler) SetMaxTTL(ttl time.Duration) {
 	self.maxTTL = ttl
 }
@@ -165,6 +233,36 @@ func (self *ForwardRequestHandler) MaxTTL() time.Duration {
 	return self.maxTTL
 }
 
+type AbuseScorer struct {
+	webHook
+}
+
+// Score posts the request to the web hook, which should reply 200
+// with the verdict as a JSON object like {"action": "flag",
+// "score": 0.9, "reason": "spam"}.
+func (self *AbuseScorer) Score(req *evthandler.AbuseRequest) (verdict *evthandler.AbuseVerdict, err error) {
+	status, reply := self.postForReply(req)
+	if status != 200 || reply == nil {
+		err = fmt.Errorf("abuse scorer replied %v", status)
+		return
+	}
+	v := new(evthandler.AbuseVerdict)
+	err = json.Unmarshal(reply, v)
+	if err != nil {
+		return
+	}
+	switch v.Action {
+	case "":
+		v.Action = evthandler.ABUSE_ACCEPT
+	case evthandler.ABUSE_ACCEPT, evthandler.ABUSE_SHADOW_DROP, evthandler.ABUSE_FLAG:
+	default:
+		err = fmt.Errorf("unknown abuse action %v", v.Action)
+		return
+	}
+	verdict = v
+	return
+}
+
 type authEvent struct {
 	Service  string `json:"service"`
 	Username string `json:"username"`
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/uniqush/uniqush-conn/evthandler"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/sink"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAbuseScorer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req evthandler.AbuseRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Sender {
+		case "eve":
+			w.Write([]byte(`{"action":"shadow-drop","score":0.9,"reason":"spam"}`))
+		case "bob":
+			w.Write([]byte(`{}`))
+		case "mallory":
+			w.Write([]byte(`{"action":"delete"}`))
+		default:
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	scorer := new(AbuseScorer)
+	scorer.SetURL(srv.URL)
+	scorer.SetTimeout(time.Second)
+	score := func(sender string) (*evthandler.AbuseVerdict, error) {
+		return scorer.Score(&evthandler.AbuseRequest{Sender: sender, Message: &proto.Message{Body: []byte("hi")}})
+	}
+	if v, err := score("eve"); err != nil || v.Action != evthandler.ABUSE_SHADOW_DROP || v.Score != 0.9 || v.Reason != "spam" {
+		t.Errorf("bad verdict of eve: %+v %v", v, err)
+	}
+	if v, err := score("bob"); err != nil || v.Action != evthandler.ABUSE_ACCEPT {
+		t.Errorf("an empty verdict should accept: %+v %v", v, err)
+	}
+	if _, err := score("mallory"); err == nil {
+		t.Errorf("an unknown action should fail")
+	}
+	if _, err := score("alice"); err == nil {
+		t.Errorf("a failed web hook should fail")
+	}
+}
+
+func TestMessageSink(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec sink.Record
+		json.NewDecoder(r.Body).Decode(&rec)
+		if rec.Username != "alice" || rec.Msg == nil || string(rec.Msg.Body) != "hi" {
+			http.Error(w, "bad record", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	s := new(MessageSink)
+	s.SetURL(srv.URL)
+	s.SetTimeout(time.Second)
+	if err := s.Persist(&sink.Record{Username: "alice", Msg: &proto.Message{Body: []byte("hi")}}); err != nil {
+		t.Errorf("cannot persist: %v", err)
+	}
+	if err := s.Persist(&sink.Record{Username: "bob", Msg: &proto.Message{Body: []byte("hi")}}); err == nil {
+		t.Errorf("a rejected record should fail")
+	}
+}
@@ -49,14 +49,15 @@ var argvPassword = flag.String("p", "", "password")
 var argvDigestThrd = flag.Int("d", 512, "digest threshold")
 var argvCompressThrd = flag.Int("c", 1024, "compress threshold")
 
-func messagePrinter(conn client.Conn, msgChan <-chan *proto.Message, digestChan <-chan *client.Digest) {
+func messagePrinter(conn client.Conn, msgChan <-chan *proto.MessageContainer, digestChan <-chan *client.Digest) {
 	for {
 		select {
-		case msg := <-msgChan:
-			if msg == nil {
+		case mc := <-msgChan:
+			if mc == nil {
 				return
 			}
-			fmt.Printf("- [Service=%v][Sender=%v][Id=%v]", msg.SenderService, msg.Sender, msg.Id)
+			fmt.Printf("- [Service=%v][Sender=%v][Id=%v]", mc.SenderService, mc.Sender, mc.Id)
+			msg := mc.Message
 			for k, v := range msg.Header {
 				fmt.Printf("[%v=%v]", k, v)
 			}
@@ -81,15 +82,15 @@ func messagePrinter(conn client.Conn, msgChan <-chan *proto.Message, digestChan
 	}
 }
 
-func messageReceiver(conn client.Conn, msgChan chan<- *proto.Message) {
+func messageReceiver(conn client.Conn, msgChan chan<- *proto.MessageContainer) {
 	defer conn.Close()
 	for {
-		msg, err := conn.ReadMessage()
+		mc, err := conn.ReceiveMessage()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 			return
 		}
-		msgChan <- msg
+		msgChan <- mc
 	}
 }
 
@@ -110,10 +111,10 @@ func messageSender(conn client.Conn) {
 			msg.Body = []byte(elems[1])
 			msg.Header = make(map[string]string, 1)
 			msg.Header["title"] = strings.TrimSpace(elems[1])
-			err = conn.ForwardRequest(elems[0], conn.Service(), msg, 1*time.Hour)
+			err = conn.SendMessageToUser(conn.Service(), elems[0], msg, 1*time.Hour)
 		} else {
 			msg.Body = []byte(line)
-			err = conn.SendMessage(msg)
+			err = conn.SendMessageToServer(msg)
 		}
 		if err != nil {
 			if err != io.EOF {
@@ -151,13 +152,13 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Login Error: %v\n", err)
 		return
 	}
-	err = conn.Config(*argvDigestThrd, *argvCompressThrd, nil)
+	err = conn.Config(*argvDigestThrd, *argvCompressThrd)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Config Error: %v\n", err)
 		return
 	}
 
-	msgChan := make(chan *proto.Message)
+	msgChan := make(chan *proto.MessageContainer)
 	digestChan := make(chan *client.Digest)
 	conn.SetDigestChannel(digestChan)
 	go messageReceiver(conn, msgChan)
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package federation relays forward requests between independent
+// deployments. A service of a remote deployment is named as
+// service@domain. A forward request to such a service is sent to
+// the peer serving the domain, which delivers it as if it was sent
+// by a user of service@<our domain>.
+//
+// Peers authenticate each other with a shared key: every request is
+// signed with HMAC-SHA256 over the origin domain, a timestamp, a
+// nonce and the request body. A nonce is only accepted once.
+package federation
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrUnknownPeer = errors.New("unknown peer")
+var ErrBadSignature = errors.New("bad signature")
+var ErrExpired = errors.New("request expired")
+var ErrBadService = errors.New("bad service")
+var ErrReplayed = errors.New("request replayed")
+
+type Peer struct {
+	Domain string
+	// Addr is the address of the peer, i.e. host:port, reached over
+	// HTTPS. It may be a URL instead, e.g. http://host:port to relay
+	// the requests in plaintext within a trusted network.
+	Addr string
+	// Key is shared between us and the peer.
+	Key string
+}
+
+// SplitService splits service@domain into service and domain.
+// domain is empty if the service is not qualified.
+func SplitService(service string) (srv, domain string) {
+	idx := strings.LastIndex(service, "@")
+	if idx < 0 {
+		srv = service
+		return
+	}
+	srv = service[:idx]
+	domain = service[idx+1:]
+	return
+}
+
+func sign(key, domain, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%v\n%v\n%v\n", domain, timestamp, nonce)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verify(key, domain, timestamp, nonce string, body []byte, sig string) bool {
+	expected := sign(key, domain, timestamp, nonce, body)
+	return hmac.Equal([]byte(expected), []byte(sig))
+}
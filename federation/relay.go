@@ -0,0 +1,288 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package federation
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/cluster"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ForwardPath is the path on which a deployment receives
+// forward requests from its peers.
+const ForwardPath = "/federation/forward.json"
+
+// Requests signed longer ago than this are rejected.
+const maxClockSkew = 5 * time.Minute
+
+// A nonce is remembered for as long as a request carrying it
+// could be accepted, in either direction of the clock skew.
+const nonceLifetime = 2 * maxClockSkew
+
+const maxRequestSize = 1 << 20
+
+const (
+	headerDomain    = "X-Uniqush-Domain"
+	headerTimestamp = "X-Uniqush-Timestamp"
+	headerSignature = "X-Uniqush-Signature"
+	headerNonce     = "X-Uniqush-Nonce"
+)
+
+type Relay struct {
+	domain    string
+	peers     map[string]*Peer
+	timeout   time.Duration
+	tlsConfig *tls.Config
+
+	nonceLock  sync.Mutex
+	nonces     map[string]time.Time
+	nonceSweep time.Time
+}
+
+func NewRelay(domain string, peers []*Peer, timeout time.Duration) *Relay {
+	ret := new(Relay)
+	ret.domain = domain
+	ret.timeout = timeout
+	ret.nonces = make(map[string]time.Time, 1024)
+	ret.peers = make(map[string]*Peer, len(peers))
+	for _, p := range peers {
+		ret.peers[p.Domain] = p
+	}
+	return ret
+}
+
+// SetTLSConfig sets the TLS configuration of the requests to the
+// peers, e.g. the roots their certificates are checked against. The
+// system roots are used otherwise. It should be called before any
+// request is relayed.
+func (self *Relay) SetTLSConfig(conf *tls.Config) {
+	self.tlsConfig = conf
+}
+
+// peerURL returns the URL of path on the peer.
+func peerURL(peer *Peer, path string) string {
+	if strings.Contains(peer.Addr, "://") {
+		return strings.TrimSuffix(peer.Addr, "/") + path
+	}
+	return "https://" + peer.Addr + path
+}
+
+// Domain returns the domain of our own deployment.
+func (self *Relay) Domain() string {
+	return self.domain
+}
+
+// IsRemote tells if the service belongs to another deployment.
+func (self *Relay) IsRemote(service string) bool {
+	_, domain := SplitService(service)
+	return len(domain) > 0 && domain != self.domain
+}
+
+// LocalService strips our own domain from the service.
+func (self *Relay) LocalService(service string) string {
+	srv, domain := SplitService(service)
+	if domain == self.domain {
+		return srv
+	}
+	return service
+}
+
+// Forward relays the forward request to the peer serving the
+// domain of its receiver service.
+func (self *Relay) Forward(fwdreq *server.ForwardRequest) error {
+	srv, domain := SplitService(fwdreq.ReceiverService)
+	peer, ok := self.peers[domain]
+	if !ok {
+		return ErrUnknownPeer
+	}
+	if _, d := SplitService(fwdreq.MessageContainer.SenderService); len(d) > 0 {
+		// Do not relay a request relayed from another peer.
+		return ErrBadService
+	}
+	req := *fwdreq
+	req.ReceiverService = srv
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+
+	hreq, err := http.NewRequest("POST", peerURL(peer, ForwardPath), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := fmt.Sprintf("%v", time.Now().Unix())
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set(headerDomain, self.domain)
+	hreq.Header.Set(headerTimestamp, timestamp)
+	hreq.Header.Set(headerNonce, nonce)
+	hreq.Header.Set(headerSignature, sign(peer.Key, self.domain, timestamp, nonce, body))
+
+	c := http.Client{
+		Transport: &http.Transport{
+			Dial:              cluster.TimeoutDialler(self.timeout),
+			TLSClientConfig:   self.tlsConfig,
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := c.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer %v: %v", domain, resp.Status)
+	}
+	return nil
+}
+
+// authenticate checks the request and returns the domain of the peer.
+func (self *Relay) authenticate(r *http.Request, body []byte) (domain string, err error) {
+	domain = r.Header.Get(headerDomain)
+	peer, ok := self.peers[domain]
+	if !ok {
+		err = ErrUnknownPeer
+		return
+	}
+	timestamp := r.Header.Get(headerTimestamp)
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		err = ErrExpired
+		return
+	}
+	skew := time.Now().Sub(time.Unix(t, 0))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		err = ErrExpired
+		return
+	}
+	nonce := r.Header.Get(headerNonce)
+	if len(nonce) == 0 || !verify(peer.Key, domain, timestamp, nonce, body, r.Header.Get(headerSignature)) {
+		err = ErrBadSignature
+		return
+	}
+	// Only remember the nonces of authentic requests.
+	if !self.firstSeen(domain, nonce) {
+		err = ErrReplayed
+		return
+	}
+	return
+}
+
+func newNonce() (nonce string, err error) {
+	var buf [16]byte
+	_, err = io.ReadFull(rand.Reader, buf[:])
+	if err != nil {
+		return
+	}
+	nonce = hex.EncodeToString(buf[:])
+	return
+}
+
+// firstSeen tells if the peer has never used the nonce before,
+// and remembers it.
+func (self *Relay) firstSeen(domain, nonce string) bool {
+	self.nonceLock.Lock()
+	defer self.nonceLock.Unlock()
+	now := time.Now()
+	if now.Sub(self.nonceSweep) > nonceLifetime {
+		for n, t := range self.nonces {
+			if now.Sub(t) > nonceLifetime {
+				delete(self.nonces, n)
+			}
+		}
+		self.nonceSweep = now
+	}
+	key := domain + "\n" + nonce
+	if _, ok := self.nonces[key]; ok {
+		return false
+	}
+	self.nonces[key] = now
+	return true
+}
+
+// Receiver accepts forward requests relayed from peers.
+type Receiver interface {
+	Forward(fwdreq *server.ForwardRequest)
+}
+
+type httpHandler struct {
+	relay *Relay
+	recv  Receiver
+}
+
+// NewHttpHandler returns a handler which should be mounted on
+// ForwardPath to receive forward requests from peers.
+func NewHttpHandler(relay *Relay, recv Receiver) http.Handler {
+	ret := new(httpHandler)
+	ret.relay = relay
+	ret.recv = recv
+	return ret
+}
+
+func (self *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	domain, err := self.relay.authenticate(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	fwdreq := new(server.ForwardRequest)
+	err = json.Unmarshal(body, fwdreq)
+	if err != nil || fwdreq.MessageContainer.Message == nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	// The receiver must be one of our own services, and the sender
+	// must be a service of the peer.
+	fwdreq.ReceiverService = self.relay.LocalService(fwdreq.ReceiverService)
+	if _, d := SplitService(fwdreq.ReceiverService); len(d) > 0 {
+		http.Error(w, ErrBadService.Error(), http.StatusBadRequest)
+		return
+	}
+	sender := &fwdreq.MessageContainer
+	if _, d := SplitService(sender.SenderService); len(d) > 0 || len(sender.Sender) == 0 {
+		http.Error(w, ErrBadService.Error(), http.StatusBadRequest)
+		return
+	}
+	sender.SenderService = fmt.Sprintf("%v@%v", sender.SenderService, domain)
+	// The id is assigned by our own cache.
+	sender.Id = ""
+	sender.Seq = 0
+	self.recv.Forward(fwdreq)
+	fmt.Fprintf(w, "{}\r\n")
+}
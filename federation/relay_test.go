@@ -0,0 +1,157 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package federation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type chanReceiver struct {
+	ch chan *server.ForwardRequest
+}
+
+func (self *chanReceiver) Forward(fwdreq *server.ForwardRequest) {
+	self.ch <- fwdreq
+}
+
+func getPeers(usKey string) (eu *Relay, us *Relay, recv *chanReceiver, ts *httptest.Server) {
+	recv = &chanReceiver{make(chan *server.ForwardRequest, 1)}
+	us = NewRelay("us.example.com", []*Peer{&Peer{"eu.example.com", "", "secret"}}, 3*time.Second)
+	ts = httptest.NewTLSServer(NewHttpHandler(us, recv))
+	addr := strings.TrimPrefix(ts.URL, "https://")
+	eu = NewRelay("eu.example.com", []*Peer{&Peer{"us.example.com", addr, usKey}}, 3*time.Second)
+	eu.SetTLSConfig(ts.Client().Transport.(*http.Transport).TLSClientConfig)
+	return
+}
+
+func TestRelayPlaintext(t *testing.T) {
+	recv := &chanReceiver{make(chan *server.ForwardRequest, 1)}
+	us := NewRelay("us.example.com", []*Peer{&Peer{"eu.example.com", "", "secret"}}, 3*time.Second)
+	ts := httptest.NewServer(NewHttpHandler(us, recv))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	// Without a scheme, the peer is reached over HTTPS.
+	eu := NewRelay("eu.example.com", []*Peer{&Peer{"us.example.com", addr, "secret"}}, 3*time.Second)
+	if err := eu.Forward(fwdRequest()); err == nil {
+		t.Errorf("the request should not be sent in plaintext")
+	}
+	eu = NewRelay("eu.example.com", []*Peer{&Peer{"us.example.com", ts.URL, "secret"}}, 3*time.Second)
+	if err := eu.Forward(fwdRequest()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if got := <-recv.ch; got.Receiver != "bob" {
+		t.Errorf("bad receiver: %+v", got)
+	}
+}
+
+func fwdRequest() *server.ForwardRequest {
+	fwdreq := new(server.ForwardRequest)
+	fwdreq.Receiver = "bob"
+	fwdreq.ReceiverService = "chat@us.example.com"
+	fwdreq.TTL = time.Hour
+	fwdreq.MessageContainer.Sender = "alice"
+	fwdreq.MessageContainer.SenderService = "chat"
+	fwdreq.MessageContainer.Message = &proto.Message{Body: []byte("hello")}
+	return fwdreq
+}
+
+func TestRelayForward(t *testing.T) {
+	eu, _, recv, ts := getPeers("secret")
+	defer ts.Close()
+
+	if !eu.IsRemote("chat@us.example.com") || eu.IsRemote("chat@eu.example.com") || eu.IsRemote("chat") {
+		t.Errorf("bad IsRemote()")
+	}
+	fwdreq := fwdRequest()
+	err := eu.Forward(fwdreq)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	got := <-recv.ch
+	if got.Receiver != "bob" || got.ReceiverService != "chat" || got.TTL != time.Hour {
+		t.Errorf("bad receiver: %+v", got)
+	}
+	mc := &got.MessageContainer
+	if mc.Sender != "alice" || mc.SenderService != "chat@eu.example.com" {
+		t.Errorf("bad sender: %+v", mc)
+	}
+	if !mc.Message.Eq(fwdreq.MessageContainer.Message) {
+		t.Errorf("bad message: %v", mc.Message)
+	}
+}
+
+func TestRelayForwardWithBadKey(t *testing.T) {
+	eu, _, recv, ts := getPeers("wrong")
+	defer ts.Close()
+
+	err := eu.Forward(fwdRequest())
+	if err == nil {
+		t.Errorf("should be rejected")
+	}
+	select {
+	case fwdreq := <-recv.ch:
+		t.Errorf("should not receive %+v", fwdreq)
+	default:
+	}
+}
+
+func TestRelayRejectsReplay(t *testing.T) {
+	_, _, recv, ts := getPeers("secret")
+	defer ts.Close()
+
+	body, _ := json.Marshal(fwdRequest())
+	timestamp := fmt.Sprintf("%v", time.Now().Unix())
+	post := func(nonce string) int {
+		hreq, _ := http.NewRequest("POST", ts.URL+ForwardPath, bytes.NewReader(body))
+		hreq.Header.Set(headerDomain, "eu.example.com")
+		hreq.Header.Set(headerTimestamp, timestamp)
+		hreq.Header.Set(headerNonce, nonce)
+		hreq.Header.Set(headerSignature, sign("secret", "eu.example.com", timestamp, nonce, body))
+		resp, err := ts.Client().Do(hreq)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post("nonce"); code != http.StatusOK {
+		t.Errorf("bad status: %v", code)
+	}
+	<-recv.ch
+	if code := post("nonce"); code != http.StatusForbidden {
+		t.Errorf("replayed request should be rejected: %v", code)
+	}
+	if code := post(""); code != http.StatusForbidden {
+		t.Errorf("request without nonce should be rejected: %v", code)
+	}
+	if code := post("another"); code != http.StatusOK {
+		t.Errorf("bad status: %v", code)
+	}
+	<-recv.ch
+}
@@ -0,0 +1,28 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package grpcapi exposes the message center to backend services
+// over gRPC. The service is defined in uniqush.proto.
+//
+// The server depends on google.golang.org/grpc and on the code
+// generated into ./pb, so it is only built with the grpc tag:
+//
+//	go generate github.com/uniqush/uniqush-conn/grpcapi
+//	go build -tags grpc github.com/uniqush/uniqush-conn
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/uniqush/uniqush-conn/grpcapi --go-grpc_out=. --go-grpc_opt=module=github.com/uniqush/uniqush-conn/grpcapi uniqush.proto
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package grpcapi
+
+import (
+	"github.com/uniqush/uniqush-conn/msgcenter"
+)
+
+// eventFilter matches everything if a set is empty.
+type eventFilter struct {
+	services map[string]bool
+	types    map[string]bool
+
+	// patterns are the service names containing wildcards.
+	patterns []string
+}
+
+func toSet(strs []string) map[string]bool {
+	if len(strs) == 0 {
+		return nil
+	}
+	ret := make(map[string]bool, len(strs))
+	for _, s := range strs {
+		ret[s] = true
+	}
+	return ret
+}
+
+func newEventFilter(services, types []string) *eventFilter {
+	ret := new(eventFilter)
+	names := make([]string, 0, len(services))
+	for _, srv := range services {
+		if msgcenter.IsServicePattern(srv) {
+			ret.patterns = append(ret.patterns, srv)
+		} else {
+			names = append(names, srv)
+		}
+	}
+	ret.services = toSet(names)
+	ret.types = toSet(types)
+	return ret
+}
+
+func (self *eventFilter) matchService(service string) bool {
+	if self.services[service] {
+		return true
+	}
+	for _, p := range self.patterns {
+		if msgcenter.MatchService(p, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// A forward event matches both the sender's and the receiver's service.
+func (self *eventFilter) match(evt *msgcenter.Event) bool {
+	if self.types != nil && !self.types[evt.Type] {
+		return false
+	}
+	if self.services == nil && self.patterns == nil {
+		return true
+	}
+	return self.matchService(evt.Service) || self.matchService(evt.ReceiverService)
+}
@@ -0,0 +1,45 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package grpcapi
+
+import (
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"testing"
+)
+
+func TestEventFilter(t *testing.T) {
+	fwd := &msgcenter.Event{Type: msgcenter.EVENT_FORWARD, Service: "a", ReceiverService: "b"}
+	sub := &msgcenter.Event{Type: msgcenter.EVENT_SUBSCRIBE, Service: "c"}
+
+	all := newEventFilter(nil, nil)
+	if !all.match(fwd) || !all.match(sub) {
+		t.Errorf("empty filter should match everything")
+	}
+	f := newEventFilter([]string{"b"}, nil)
+	if !f.match(fwd) || f.match(sub) {
+		t.Errorf("bad service filter")
+	}
+	f = newEventFilter([]string{"x", "[ab]*"}, nil)
+	if !f.match(fwd) || f.match(sub) {
+		t.Errorf("bad service pattern")
+	}
+	f = newEventFilter(nil, []string{msgcenter.EVENT_SUBSCRIBE})
+	if f.match(fwd) || !f.match(sub) {
+		t.Errorf("bad type filter")
+	}
+}
@@ -0,0 +1,260 @@
+//go:build grpc
+// +build grpc
+
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package grpcapi
+
+import (
+	"context"
+	"github.com/uniqush/uniqush-conn/admin"
+	"github.com/uniqush/uniqush-conn/grpcapi/pb"
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events are dropped if a subscriber falls this far behind.
+const eventBufferSize = 128
+
+type Server struct {
+	pb.UnimplementedUniqushConnServer
+	center   *msgcenter.MessageCenter
+	auditLog admin.AuditLog
+}
+
+func NewServer(center *msgcenter.MessageCenter) *Server {
+	ret := new(Server)
+	ret.center = center
+	return ret
+}
+
+// SetAuditLog writes the messages sent to the audit log of the admin
+// API before they are. A call is refused if it cannot be written. The
+// actor is the admin.ActorHeader of the metadata of the call.
+func (self *Server) SetAuditLog(log admin.AuditLog) {
+	self.auditLog = log
+}
+
+func (self *Server) Register(s *grpc.Server) {
+	pb.RegisterUniqushConnServer(s, self)
+}
+
+// ListenAndServe serves the API on addr. auditLog may be nil.
+func ListenAndServe(addr string, center *msgcenter.MessageCenter, auditLog admin.AuditLog) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer()
+	srv := NewServer(center)
+	srv.SetAuditLog(auditLog)
+	srv.Register(s)
+	return s.Serve(ln)
+}
+
+// audit writes the call to the audit log. The message itself is not
+// logged, only who it is for.
+func (self *Server) audit(ctx context.Context, action string, params map[string]string) error {
+	if self.auditLog == nil {
+		return nil
+	}
+	a := &admin.Action{
+		Time:   time.Now(),
+		Action: action,
+		Params: params,
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		a.Actor = strings.Join(md.Get(admin.ActorHeader), ",")
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		a.Addr = p.Addr.String()
+	}
+	if err := self.auditLog.Append(a); err != nil {
+		return status.Error(codes.Unavailable, "cannot write the audit log")
+	}
+	return nil
+}
+
+func parseTTL(ttl string) (time.Duration, error) {
+	if len(ttl) == 0 {
+		return 24 * time.Hour, nil
+	}
+	return time.ParseDuration(ttl)
+}
+
+func toStatusError(err error) error {
+	switch err {
+	case msgcenter.ErrBadUsername, msgcenter.ErrEmptyMessage, msgcenter.ErrReservedKey:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case msgcenter.ErrNoService:
+		return status.Error(codes.NotFound, err.Error())
+	case msgcenter.ErrCannotCache:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (self *Server) deliver(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) (*pb.SendResponse, error) {
+	res, err := self.center.DeliverMessage(service, username, mc, extra, ttl)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	resp := &pb.SendResponse{
+		Id:      mc.Id,
+		Seq:     mc.Seq,
+		Status:  msgcenter.DeliveryStatus(mc, res),
+		Results: make([]*pb.Result, 0, len(res)),
+	}
+	for _, r := range res {
+		pr := &pb.Result{ConnId: r.ConnId, Visible: r.Visible, Node: r.Node}
+		if r.Err != nil {
+			pr.Error = r.Err.Error()
+		}
+		resp.Results = append(resp.Results, pr)
+	}
+	return resp, nil
+}
+
+func (self *Server) SendMessage(ctx context.Context, req *pb.SendMessageRequest) (*pb.SendResponse, error) {
+	ttl, err := parseTTL(req.Ttl)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	msg, extra, err := msgcenter.SplitHeader(req.GetMessage().GetHeader(), req.GetMessage().GetBody())
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	for k, v := range req.PushInfo {
+		extra[k] = v
+	}
+	err = self.audit(ctx, "grpc:send-message", map[string]string{
+		"service":  req.Service,
+		"username": req.Username,
+		"ttl":      ttl.String(),
+		"size":     strconv.Itoa(len(req.GetMessage().GetBody())),
+	})
+	if err != nil {
+		return nil, err
+	}
+	mc := &proto.MessageContainer{Message: msg}
+	return self.deliver(req.Service, req.Username, mc, extra, ttl)
+}
+
+// SendToUser does not ask the forward request handler: backends
+// are trusted. The receiver's service must be served by this
+// deployment.
+func (self *Server) SendToUser(ctx context.Context, req *pb.SendToUserRequest) (*pb.SendResponse, error) {
+	if len(req.Sender) == 0 || len(req.SenderService) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "sender and sender_service are required")
+	}
+	ttl, err := parseTTL(req.Ttl)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	msg, extra, err := msgcenter.SplitHeader(req.GetMessage().GetHeader(), req.GetMessage().GetBody())
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	for k, v := range req.PushInfo {
+		extra[k] = v
+	}
+	extra["uniqush.sender"] = req.Sender
+	extra["uniqush.sender-service"] = req.SenderService
+	err = self.audit(ctx, "grpc:send-to-user", map[string]string{
+		"service":       req.ReceiverService,
+		"username":      req.Receiver,
+		"sender":        req.Sender,
+		"senderService": req.SenderService,
+		"ttl":           ttl.String(),
+		"size":          strconv.Itoa(len(req.GetMessage().GetBody())),
+	})
+	if err != nil {
+		return nil, err
+	}
+	mc := &proto.MessageContainer{
+		Message:       msg,
+		Sender:        req.Sender,
+		SenderService: req.SenderService,
+	}
+	return self.deliver(req.ReceiverService, req.Receiver, mc, extra, ttl)
+}
+
+func (self *Server) QueryPresence(ctx context.Context, req *pb.PresenceRequest) (*pb.PresenceResponse, error) {
+	resp := &pb.PresenceResponse{
+		Presences: make([]*pb.Presence, 0, len(req.Usernames)),
+	}
+	for _, username := range req.Usernames {
+		p := self.center.Presence(req.Service, username)
+		resp.Presences = append(resp.Presences, &pb.Presence{
+			Username: username,
+			Online:   p.Online,
+			Visible:  p.Visible,
+			NrConns:  int32(p.NrConns),
+			Nodes:    p.Nodes,
+		})
+	}
+	return resp, nil
+}
+
+func toPbEvent(evt *msgcenter.Event) *pb.Event {
+	ret := &pb.Event{
+		Type:            evt.Type,
+		Service:         evt.Service,
+		Username:        evt.Username,
+		ConnId:          evt.ConnId,
+		Receiver:        evt.Receiver,
+		ReceiverService: evt.ReceiverService,
+		Params:          evt.Params,
+	}
+	if evt.Message != nil {
+		ret.Message = &pb.Message{Header: evt.Message.Header, Body: evt.Message.Body}
+	}
+	return ret
+}
+
+func (self *Server) Subscribe(req *pb.SubscribeRequest, stream pb.UniqushConn_SubscribeServer) error {
+	filter := newEventFilter(req.Services, req.Types)
+	ch := make(chan *msgcenter.Event, eventBufferSize)
+	self.center.Listen(ch)
+	defer self.center.Unlisten(ch)
+
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case evt := <-ch:
+			if !filter.match(evt) {
+				continue
+			}
+			err := stream.Send(toPbEvent(evt))
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
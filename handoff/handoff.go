@@ -0,0 +1,203 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package handoff passes the live connections of a server to a new
+// process, e.g. an upgraded binary, so that the clients are not
+// disconnected. The new process is started with Exec, which passes it
+// the listening sockets as systemd would, and a Unix socket over which
+// every connection is sent with Send: its state, including its session
+// keys, and its file descriptor. The new process gets the Unix socket
+// from Inherit, and the connections from Receive.
+package handoff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/uniqush/uniqush-conn/listener"
+	"github.com/uniqush/uniqush-conn/proto/server"
+)
+
+// EnvFd is the environment variable telling the new process the file
+// descriptor of the Unix socket.
+const EnvFd = "UNIQUSH_HANDOFF_FD"
+
+// The longest state of a connection.
+const maxStateLen = 64 * 1024
+
+var ErrNoDescriptor = errors.New("no file descriptor along with the connection")
+var ErrStateTooLarge = errors.New("connection state too large")
+
+// Exec starts the binary with the arguments, and the sockets under the
+// listener as LISTEN_FDS. It returns the Unix socket over which the
+// connections should be sent to the new process. The new process
+// should call Inherit before it looks for the inherited listeners.
+func Exec(path string, args []string, ln net.Listener) (cmd *exec.Cmd, sock *net.UnixConn, err error) {
+	files, names, err := listener.Files(ln)
+	if err != nil {
+		return
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	// Every message keeps its boundaries and its descriptor.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+	local := os.NewFile(uintptr(fds[0]), "handoff")
+	remote := os.NewFile(uintptr(fds[1]), "handoff")
+	defer local.Close()
+	defer remote.Close()
+
+	env := make([]string, 0, len(os.Environ())+3)
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, "LISTEN_") || strings.HasPrefix(e, EnvFd+"=") {
+			continue
+		}
+		env = append(env, e)
+	}
+	// The listeners first, as systemd would pass them.
+	env = append(env, fmt.Sprintf("LISTEN_FDS=%v", len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		fmt.Sprintf("%v=%v", EnvFd, 3+len(files)))
+
+	c, err := net.FileConn(local)
+	if err != nil {
+		return
+	}
+	cmd = exec.Command(path, args...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(append([]*os.File{}, files...), remote)
+	err = cmd.Start()
+	if err != nil {
+		c.Close()
+		cmd = nil
+		return
+	}
+	sock = c.(*net.UnixConn)
+	return
+}
+
+// Inherit returns the Unix socket passed by Exec, or nil if the
+// process is not started by Exec. It lets listener.Inherited return
+// the listening sockets passed along with it.
+func Inherit() (sock *net.UnixConn, err error) {
+	v := os.Getenv(EnvFd)
+	if len(v) == 0 {
+		return
+	}
+	os.Unsetenv(EnvFd)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		err = fmt.Errorf("bad %v: %v", EnvFd, v)
+		return
+	}
+	syscall.CloseOnExec(fd)
+	if len(os.Getenv("LISTEN_FDS")) > 0 {
+		// Exec could not know the pid.
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	}
+	f := os.NewFile(uintptr(fd), "handoff")
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return
+	}
+	sock, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		err = fmt.Errorf("%v is not a Unix socket", EnvFd)
+	}
+	return
+}
+
+// Send passes the connection to the process on the other side of the
+// socket. f may be closed once it returns.
+func Send(sock *net.UnixConn, state *server.ConnState, f *os.File) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxStateLen {
+		return ErrStateTooLarge
+	}
+	_, _, err = sock.WriteMsgUnix(data, syscall.UnixRights(int(f.Fd())), nil)
+	return err
+}
+
+// Receive returns the next connection sent by Send. It returns io.EOF
+// once the other process has closed the socket, e.g. when it exits.
+func Receive(sock *net.UnixConn) (state *server.ConnState, conn net.Conn, err error) {
+	data := make([]byte, maxStateLen)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := sock.ReadMsgUnix(data, oob)
+	if err != nil {
+		return
+	}
+	if n == 0 && oobn == 0 {
+		err = io.EOF
+		return
+	}
+	var fds []int
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return
+	}
+	for _, m := range msgs {
+		var rights []int
+		rights, err = syscall.ParseUnixRights(&m)
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	err = nil
+	if len(fds) == 0 {
+		err = ErrNoDescriptor
+		return
+	}
+	for _, fd := range fds[1:] {
+		syscall.Close(fd)
+	}
+	f := os.NewFile(uintptr(fds[0]), "conn")
+	defer f.Close()
+	state = new(server.ConnState)
+	err = json.Unmarshal(data[:n], state)
+	if err != nil {
+		state = nil
+		return
+	}
+	conn, err = net.FileConn(f)
+	if err != nil {
+		state = nil
+	}
+	return
+}
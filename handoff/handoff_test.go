@@ -0,0 +1,110 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package handoff
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+)
+
+func socketPair(t *testing.T) (a, b *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "sock")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func tcpPair(t *testing.T) (a, b net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer ln.Close()
+	ch := make(chan net.Conn)
+	go func() {
+		c, _ := ln.Accept()
+		ch <- c
+	}()
+	a, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	b = <-ch
+	return
+}
+
+func TestSendAndReceive(t *testing.T) {
+	sender, receiver := socketPair(t)
+	defer receiver.Close()
+	client, conn := tcpPair(t)
+	defer client.Close()
+
+	state := &server.ConnState{
+		ConnId:   "conn",
+		Service:  "service",
+		Username: "username",
+		IO:       &proto.CommandIOState{WriteKey: []byte("key"), NrWritten: 42},
+	}
+	f, err := conn.(*net.TCPConn).File()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	err = Send(sender, state, f)
+	f.Close()
+	conn.Close()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	sender.Close()
+
+	recved, c, err := Receive(receiver)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer c.Close()
+	if recved.ConnId != "conn" || recved.IO.NrWritten != 42 || string(recved.IO.WriteKey) != "key" {
+		t.Errorf("bad state: %+v", recved)
+	}
+	// The connection is still open.
+	go c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(client, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("cannot read from the received connection: %v", err)
+	}
+
+	if _, _, err = Receive(receiver); err != io.EOF {
+		t.Errorf("not EOF: %v", err)
+	}
+}
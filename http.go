@@ -20,19 +20,31 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/uniqush/uniqush-conn/admin"
+	"github.com/uniqush/uniqush-conn/cluster"
+	"github.com/uniqush/uniqush-conn/federation"
 	"github.com/uniqush/uniqush-conn/msgcenter"
 	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/scheduler"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type sendMessageRequest struct {
-	Service  string            `json:"service"`
-	Username string            `json:"username"`
+	Service  string `json:"service"`
+	Username string `json:"username"`
+	// Receiver is an alias of Username.
+	Receiver string            `json:"receiver,omitempty"`
 	Header   map[string]string `json:"header,omitempty"`
-	Body     []byte            `json:"body,omitempty"`
-	TTL      string            `json:"ttl,omitempty"`
+	// Headers are merged into Header.
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    []byte            `json:"body,omitempty"`
+	TTL     string            `json:"ttl,omitempty"`
+	// Public messages may be sent in plaintext. See proto.Message.Public.
+	Public bool `json:"public,omitempty"`
 }
 
 func parseJson(input io.Reader) (req *sendMessageRequest, err error) {
@@ -41,6 +53,18 @@ func parseJson(input io.Reader) (req *sendMessageRequest, err error) {
 	err = decoder.Decode(req)
 	if err != nil {
 		req = nil
+		return
+	}
+	if len(req.Username) == 0 {
+		req.Username = req.Receiver
+	}
+	if len(req.Headers) > 0 {
+		if req.Header == nil {
+			req.Header = make(map[string]string, len(req.Headers))
+		}
+		for k, v := range req.Headers {
+			req.Header[k] = v
+		}
 	}
 	return
 }
@@ -49,16 +73,7 @@ type RequestProcessor struct {
 	center *msgcenter.MessageCenter
 }
 
-func isPrefix(prefix, str string) bool {
-	if len(str) > len(prefix) {
-		if str[:len(prefix)] == prefix {
-			return true
-		}
-	}
-	return false
-}
-
-func (self *RequestProcessor) sendMessage(req *sendMessageRequest) (errs []error, res []*msgcenter.Result) {
+func (self *RequestProcessor) sendMessage(req *sendMessageRequest) (errs []error, mc *proto.MessageContainer, res []*msgcenter.Result) {
 	ttl := 24 * time.Hour
 	if len(req.TTL) > 0 {
 		var e error
@@ -69,36 +84,28 @@ func (self *RequestProcessor) sendMessage(req *sendMessageRequest) (errs []error
 		}
 	}
 
-	msg := new(proto.Message)
-	msg.Header = make(map[string]string, len(req.Header))
-	extra := make(map[string]string, len(req.Header))
-	if len(req.Body) > 0 {
-		msg.Body = []byte(req.Body)
+	msg, extra, err := msgcenter.SplitHeader(req.Header, req.Body)
+	if err != nil {
+		errs = append(errs, err)
+		return
 	}
+	msg.Public = req.Public
 
-	for k, v := range req.Header {
-		if isPrefix("notif.", k) {
-			if isPrefix("notif.uniqush.", k) {
-				errs = append(errs, fmt.Errorf("invalid key %v: notif.uniqush.* are reserved keys", k))
-				return
-			}
-			extra[k] = v
-		} else {
-			msg.Header[k] = v
-		}
+	mc = &proto.MessageContainer{
+		Message: msg,
 	}
-	if msg.IsEmpty() {
-		errs = append(errs, fmt.Errorf("empty message"))
-		return
+	res, err = self.center.DeliverMessage(req.Service, req.Username, mc, extra, ttl)
+	if err != nil {
+		errs = append(errs, err)
 	}
-
-	res = self.center.SendMessage(req.Service, req.Username, msg, extra, ttl)
 	return
 }
 
 type HttpRequestProcessor struct {
 	RequestProcessor
-	addr string
+	addr      string
+	scheduler *scheduler.Scheduler
+	auditLog  admin.AuditLog
 }
 
 func NewHttpRequestProcessor(addr string, center *msgcenter.MessageCenter) *HttpRequestProcessor {
@@ -109,33 +116,258 @@ func NewHttpRequestProcessor(addr string, center *msgcenter.MessageCenter) *Http
 }
 
 type sendMessageResponse struct {
+	Id      string              `json:"id,omitempty"`
+	Seq     uint64              `json:"seq,omitempty"`
+	Status  string              `json:"status"`
 	Errors  []string            `json:"errors,omitempty"`
 	Results []*msgcenter.Result `json:"results,omitempty"`
 }
 
 func (self *HttpRequestProcessor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	// /send.json has always accepted any method.
+	if r.URL.Path == "/send" && r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := &sendMessageResponse{}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
 	req, err := parseJson(r.Body)
 	if err != nil {
-		fmt.Fprintf(w, "Invalid input: %v\r\n", err)
+		resp.Status = msgcenter.STATUS_DROPPED
+		resp.Errors = []string{fmt.Sprintf("Invalid input: %v", err)}
+		w.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(resp)
+		return
+	}
+	// The message itself is not logged, only who it is for.
+	params := map[string]string{
+		"service":  req.Service,
+		"username": req.Username,
+		"ttl":      req.TTL,
+		"size":     strconv.Itoa(len(req.Body)),
+	}
+	if !self.audit(w, r, "send", params) {
 		return
 	}
-	errs, res := self.sendMessage(req)
+	errs, mc, res := self.sendMessage(req)
 
-	resp := &sendMessageResponse{}
+	if mc != nil {
+		resp.Id = mc.Id
+		resp.Seq = mc.Seq
+	}
+	resp.Status = msgcenter.DeliveryStatus(mc, res)
 	resp.Results = res
 	resp.Errors = make([]string, 0, len(errs))
 	for _, e := range errs {
 		resp.Errors = append(resp.Errors, e.Error())
 	}
 
+	encoder.Encode(resp)
+	return
+}
+
+// SetScheduler enables /schedule.json, /unschedule.json and
+// /scheduled.json. It should be called before Start().
+func (self *HttpRequestProcessor) SetScheduler(s *scheduler.Scheduler) {
+	self.scheduler = s
+}
+
+// SetAuditLog writes the messages sent, and the campaigns scheduled
+// or cancelled, to the audit log of the admin API before they are. A
+// request is refused if it cannot be written. It should be called
+// before Start().
+func (self *HttpRequestProcessor) SetAuditLog(log admin.AuditLog) {
+	self.auditLog = log
+}
+
+// audit tells if the action is written to the audit log. The request
+// is answered if it is not.
+func (self *HttpRequestProcessor) audit(w http.ResponseWriter, r *http.Request, action string, params map[string]string) bool {
+	if self.auditLog == nil {
+		return true
+	}
+	err := self.auditLog.Append(&admin.Action{
+		Time:   time.Now(),
+		Actor:  r.Header.Get(admin.ActorHeader),
+		Addr:   r.RemoteAddr,
+		Action: action,
+		Params: params,
+	})
+	if err != nil {
+		http.Error(w, "cannot write the audit log", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+type scheduleRequest struct {
+	sendMessageRequest
+	Usernames []string  `json:"usernames,omitempty"`
+	Query     string    `json:"query,omitempty"`
+	SendAt    time.Time `json:"sendAt"`
+}
+
+type scheduleResponse struct {
+	Id     string   `json:"id,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (self *HttpRequestProcessor) schedule(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	encoder := json.NewEncoder(w)
+	resp := &scheduleResponse{}
+
+	req := new(scheduleRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		resp.Errors = []string{fmt.Sprintf("Invalid input: %v", err)}
+		w.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(resp)
+		return
+	}
+	c, err := req.campaign()
+	if err == nil {
+		params := map[string]string{
+			"service":   c.Service,
+			"usernames": strings.Join(c.Usernames, ","),
+			"query":     c.Query,
+			"sendAt":    c.SendAt.Format(time.RFC3339),
+			"ttl":       c.TTL.String(),
+			"size":      strconv.Itoa(len(req.Body)),
+		}
+		if !self.audit(w, r, "schedule", params) {
+			return
+		}
+		resp.Id, err = self.scheduler.Schedule(c)
+	}
+	if err != nil {
+		resp.Errors = []string{err.Error()}
+	}
 	encoder.Encode(resp)
+}
+
+func (self *scheduleRequest) campaign() (c *scheduler.Campaign, err error) {
+	ttl := 24 * time.Hour
+	if len(self.TTL) > 0 {
+		ttl, err = time.ParseDuration(self.TTL)
+		if err != nil {
+			return
+		}
+	}
+	header := self.Header
+	if len(self.Headers) > 0 {
+		header = make(map[string]string, len(self.Header)+len(self.Headers))
+		for k, v := range self.Header {
+			header[k] = v
+		}
+		for k, v := range self.Headers {
+			header[k] = v
+		}
+	}
+	msg, extra, err := msgcenter.SplitHeader(header, self.Body)
+	if err != nil {
+		return
+	}
+	c = &scheduler.Campaign{
+		Service:   self.Service,
+		Usernames: self.Usernames,
+		Query:     self.Query,
+		Message:   msg,
+		Extra:     extra,
+		TTL:       ttl,
+		SendAt:    self.SendAt,
+	}
+	for _, usr := range []string{self.Username, self.Receiver} {
+		if len(usr) > 0 {
+			c.Usernames = append(c.Usernames, usr)
+			break
+		}
+	}
 	return
 }
 
+func (self *HttpRequestProcessor) unschedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.FormValue("id")
+	if len(id) == 0 {
+		http.Error(w, "no id", http.StatusBadRequest)
+		return
+	}
+	if !self.audit(w, r, "unschedule", map[string]string{"id": id}) {
+		return
+	}
+	found, err := self.scheduler.Cancel(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "no such campaign", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": id})
+}
+
+func (self *HttpRequestProcessor) scheduled(w http.ResponseWriter, r *http.Request) {
+	campaigns, err := self.scheduler.Pending()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(campaigns)
+}
+
+// healthz is the liveness probe, and readyz the readiness probe. Both
+// answer the health of the center, with 503 if it is not live or ready.
+func (self *HttpRequestProcessor) healthz(w http.ResponseWriter, r *http.Request) {
+	health := self.center.Health()
+	writeHealth(w, health, health.Live())
+}
+
+func (self *HttpRequestProcessor) readyz(w http.ResponseWriter, r *http.Request) {
+	health := self.center.Health()
+	writeHealth(w, health, health.Ready())
+}
+
+func writeHealth(w http.ResponseWriter, health *msgcenter.Health, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
 func (self *HttpRequestProcessor) Start() error {
+	http.Handle("/send", self)
 	http.Handle("/send.json", self)
+	http.HandleFunc("/healthz", self.healthz)
+	http.HandleFunc("/readyz", self.readyz)
+	if self.scheduler != nil {
+		http.HandleFunc("/schedule.json", self.schedule)
+		http.HandleFunc("/unschedule.json", self.unschedule)
+		http.HandleFunc("/scheduled.json", self.scheduled)
+	}
+	if len(self.center.Node()) > 0 {
+		handler := cluster.NewHttpHandler(self.center)
+		http.Handle(cluster.DeliverPath, handler)
+		http.Handle(cluster.DisconnectPath, handler)
+	}
+	if relay := self.center.Federation(); relay != nil {
+		http.Handle(federation.ForwardPath, federation.NewHttpHandler(relay, self.center))
+	}
 	err := http.ListenAndServe(self.addr, nil)
 	return err
 }
@@ -0,0 +1,235 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/uniqush/uniqush-conn/admin"
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/scheduler"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type staticConfigReader struct{}
+
+func (self *staticConfigReader) ReadConfig(srv string) *msgcenter.ServiceConfig {
+	if srv != "service" {
+		return nil
+	}
+	return new(msgcenter.ServiceConfig)
+}
+
+func getRequestProcessor(t *testing.T) *HttpRequestProcessor {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	center := msgcenter.NewMessageCenter(ln, nil, nil, 3*time.Second, nil, &staticConfigReader{})
+	center.AddService("service")
+	return NewHttpRequestProcessor("", center)
+}
+
+func postSend(proc *HttpRequestProcessor, method, body string) (code int, resp *sendMessageResponse) {
+	return request(proc, method, "/send", body)
+}
+
+func request(proc *HttpRequestProcessor, method, path, body string) (code int, resp *sendMessageResponse) {
+	r, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	proc.ServeHTTP(w, r)
+	code = w.Code
+	resp = new(sendMessageResponse)
+	json.Unmarshal(w.Body.Bytes(), resp)
+	return
+}
+
+func TestSendToOfflineUser(t *testing.T) {
+	proc := getRequestProcessor(t)
+	code, resp := postSend(proc, "POST", `{"service":"service","receiver":"alice","headers":{"title":"hello"},"ttl":"1h"}`)
+	if code != http.StatusOK {
+		t.Errorf("bad status code: %v", code)
+	}
+	// There is no cache for the service, so the message is dropped.
+	if resp.Status != msgcenter.STATUS_DROPPED || len(resp.Errors) != 0 {
+		t.Errorf("bad response: %+v", resp)
+	}
+}
+
+func TestSendToUnknownService(t *testing.T) {
+	proc := getRequestProcessor(t)
+	_, resp := postSend(proc, "POST", `{"service":"nosuchservice","receiver":"alice","body":"aGVsbG8="}`)
+	if resp.Status != msgcenter.STATUS_DROPPED || len(resp.Errors) != 1 || resp.Errors[0] != msgcenter.ErrNoService.Error() {
+		t.Errorf("bad response: %+v", resp)
+	}
+}
+
+func TestSendBadRequest(t *testing.T) {
+	proc := getRequestProcessor(t)
+	if code, _ := postSend(proc, "GET", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("should require POST: %v", code)
+	}
+	if code, _ := postSend(proc, "POST", "{"); code != http.StatusBadRequest {
+		t.Errorf("should reject bad JSON: %v", code)
+	}
+	_, resp := postSend(proc, "POST", `{"service":"service","receiver":"alice"}`)
+	if len(resp.Errors) != 1 {
+		t.Errorf("should reject empty message: %+v", resp)
+	}
+}
+
+func TestSendJsonAcceptsGet(t *testing.T) {
+	proc := getRequestProcessor(t)
+	code, resp := request(proc, "GET", "/send.json", `{"service":"service","receiver":"alice","body":"aGVsbG8="}`)
+	if code != http.StatusOK || len(resp.Errors) != 0 {
+		t.Errorf("bad response: %v %+v", code, resp)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	proc := getRequestProcessor(t)
+	sched := scheduler.NewScheduler(proc.center, scheduler.NewMemoryStore())
+	proc.SetScheduler(sched)
+
+	r, _ := http.NewRequest("POST", "/schedule.json", bytes.NewBufferString(`{"service":"service","receiver":"alice","headers":{"title":"hello","notif.msg":"hi"},"sendAt":"2030-01-02T15:04:05Z"}`))
+	w := httptest.NewRecorder()
+	proc.schedule(w, r)
+	resp := new(scheduleResponse)
+	json.Unmarshal(w.Body.Bytes(), resp)
+	if w.Code != http.StatusOK || len(resp.Id) == 0 || len(resp.Errors) != 0 {
+		t.Fatalf("bad response: %v %+v", w.Code, resp)
+	}
+	pending, err := sched.Pending()
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("bad pending campaigns: %v", err)
+	}
+	c := pending[0]
+	if c.Id != resp.Id || len(c.Usernames) != 1 || c.Usernames[0] != "alice" || c.SendAt.Year() != 2030 {
+		t.Errorf("bad campaign: %+v", c)
+	}
+	if c.Message.Header["title"] != "hello" || c.Extra["notif.msg"] != "hi" || c.TTL != 24*time.Hour {
+		t.Errorf("bad campaign message: %+v %+v", c.Message, c.Extra)
+	}
+
+	r, _ = http.NewRequest("POST", "/unschedule.json?id="+resp.Id, nil)
+	w = httptest.NewRecorder()
+	proc.unschedule(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("cannot unschedule: %v", w.Code)
+	}
+	w = httptest.NewRecorder()
+	proc.unschedule(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unscheduled twice: %v", w.Code)
+	}
+}
+
+type failingAuditLog struct{}
+
+func (self failingAuditLog) Append(action *admin.Action) error {
+	return errors.New("disk full")
+}
+
+func TestAuditSendAndSchedule(t *testing.T) {
+	proc := getRequestProcessor(t)
+	sched := scheduler.NewScheduler(proc.center, scheduler.NewMemoryStore())
+	proc.SetScheduler(sched)
+	var buf bytes.Buffer
+	proc.SetAuditLog(admin.NewWriterAuditLog(&buf))
+
+	send := func(r *http.Request) {
+		r.Header.Set(admin.ActorHeader, "ops")
+		proc.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	r, _ := http.NewRequest("POST", "/send", bytes.NewBufferString(`{"service":"service","receiver":"alice","body":"aGVsbG8="}`))
+	send(r)
+	r, _ = http.NewRequest("POST", "/schedule.json", bytes.NewBufferString(`{"service":"service","receiver":"alice","body":"aGVsbG8=","sendAt":"2030-01-02T15:04:05Z"}`))
+	w := httptest.NewRecorder()
+	proc.schedule(w, r)
+	resp := new(scheduleResponse)
+	json.Unmarshal(w.Body.Bytes(), resp)
+	r, _ = http.NewRequest("POST", "/unschedule.json?id="+resp.Id, nil)
+	proc.unschedule(httptest.NewRecorder(), r)
+
+	decoder := json.NewDecoder(&buf)
+	for _, expected := range []string{"send", "schedule", "unschedule"} {
+		action := new(admin.Action)
+		if err := decoder.Decode(action); err != nil {
+			t.Fatalf("%v is not audited: %v", expected, err)
+		}
+		if action.Action != expected || (expected == "send" && (action.Actor != "ops" || action.Params["username"] != "alice")) {
+			t.Errorf("bad action: %+v", action)
+		}
+	}
+
+	// Nothing is sent unless it is audited.
+	proc.SetAuditLog(failingAuditLog{})
+	r, _ = http.NewRequest("POST", "/send", bytes.NewBufferString(`{"service":"service","receiver":"alice","body":"aGVsbG8="}`))
+	w = httptest.NewRecorder()
+	proc.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("sent without being audited: %v", w.Code)
+	}
+}
+
+func probe(proc *HttpRequestProcessor, handler http.HandlerFunc) (code int, health *msgcenter.Health) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	health = new(msgcenter.Health)
+	json.Unmarshal(w.Body.Bytes(), health)
+	return w.Code, health
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	proc := getRequestProcessor(t)
+	if code, _ := probe(proc, proc.healthz); code != http.StatusServiceUnavailable {
+		t.Errorf("live before listening: %v", code)
+	}
+	go proc.center.Start()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		code, health := probe(proc, proc.readyz)
+		if code == http.StatusOK {
+			if !health.Listening || health.Handshakes == nil || health.Handshakes.NrBusyWorkers != 0 {
+				t.Errorf("bad health: %+v", health)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not ready: %v %+v", code, health)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := proc.center.Drain(0); n != 0 {
+		t.Errorf("%v connections closed", n)
+	}
+	code, health := probe(proc, proc.readyz)
+	if code != http.StatusServiceUnavailable || !health.Draining || health.Listening {
+		t.Errorf("ready while draining: %v %+v", code, health)
+	}
+	if code, _ = probe(proc, proc.healthz); code != http.StatusOK {
+		t.Errorf("not live while draining: %v", code)
+	}
+}
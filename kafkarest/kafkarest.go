@@ -0,0 +1,220 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package kafkarest produces to and consumes from Kafka topics through
+// a Kafka REST proxy (API v2), with JSON embedded records.
+package kafkarest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	contentType  = "application/vnd.kafka.v2+json"
+	jsonType     = "application/vnd.kafka.json.v2+json"
+	maxReplySize = 4096
+)
+
+// ErrConsumerGone is returned if the proxy has dropped the consumer,
+// e.g. after it has been idle for too long. The consumer should be
+// opened again.
+var ErrConsumerGone = errors.New("kafka consumer instance not found")
+
+// DefaultClient times out after 30 seconds, longer than a poll.
+var DefaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// Record is a record to produce. Value is marshaled as JSON.
+type Record struct {
+	Key   string      `json:"key,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+// ConsumedRecord is a record read from a topic.
+type ConsumedRecord struct {
+	Topic     string          `json:"topic"`
+	Key       json.RawMessage `json:"key"`
+	Value     json.RawMessage `json:"value"`
+	Partition int             `json:"partition"`
+	Offset    int64           `json:"offset"`
+}
+
+func orDefault(client *http.Client) *http.Client {
+	if client == nil {
+		return DefaultClient
+	}
+	return client
+}
+
+func do(client *http.Client, method, u, ctype string, body interface{}, reply interface{}) (status int, err error) {
+	var input io.Reader
+	if body != nil {
+		var data []byte
+		data, err = json.Marshal(body)
+		if err != nil {
+			return
+		}
+		input = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u, input)
+	if err != nil {
+		return
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", ctype)
+	}
+	req.Header.Set("Accept", jsonType+", "+contentType)
+	resp, err := orDefault(client).Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	status = resp.StatusCode
+	if status/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxReplySize))
+		err = fmt.Errorf("kafka: %v: %s", resp.Status, bytes.TrimSpace(msg))
+		return
+	}
+	if reply == nil || status == http.StatusNoContent {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxReplySize))
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(reply)
+	return
+}
+
+// Produce appends the records to the topic. url is the address of
+// the proxy, e.g. "http://localhost:8082".
+func Produce(client *http.Client, proxy, topic string, records []*Record) error {
+	u := strings.TrimRight(proxy, "/") + "/topics/" + url.PathEscape(topic)
+	_, err := do(client, "POST", u, jsonType, map[string]interface{}{"records": records}, nil)
+	return err
+}
+
+// Consumer reads the records of a topic as a member of a consumer
+// group. Offsets are only committed by Commit, so that a record is
+// read again if the consumer stops before having processed it.
+type Consumer struct {
+	URL   string
+	Group string
+	Topic string
+
+	// Name of the consumer instance. The proxy names it if empty.
+	Name string
+
+	// Client defaults to DefaultClient.
+	Client *http.Client
+
+	baseURI string
+}
+
+// Open creates the consumer instance and subscribes it to the topic.
+func (self *Consumer) Open() error {
+	u := strings.TrimRight(self.URL, "/") + "/consumers/" + url.PathEscape(self.Group)
+	req := map[string]string{
+		"format":             "json",
+		"auto.offset.reset":  "earliest",
+		"auto.commit.enable": "false",
+	}
+	if len(self.Name) > 0 {
+		req["name"] = self.Name
+	}
+	var reply struct {
+		InstanceId string `json:"instance_id"`
+		BaseURI    string `json:"base_uri"`
+	}
+	_, err := do(self.Client, "POST", u, contentType, req, &reply)
+	if err != nil {
+		return err
+	}
+	if len(reply.BaseURI) == 0 {
+		return fmt.Errorf("kafka: no consumer instance created")
+	}
+	self.baseURI = reply.BaseURI
+	status, err := do(self.Client, "POST", self.baseURI+"/subscription", contentType,
+		map[string][]string{"topics": []string{self.Topic}}, nil)
+	return self.gone(status, err)
+}
+
+func (self *Consumer) gone(status int, err error) error {
+	if status == http.StatusNotFound {
+		self.baseURI = ""
+		return ErrConsumerGone
+	}
+	return err
+}
+
+// Poll returns the next records, or none if none arrive within the
+// timeout of the proxy.
+func (self *Consumer) Poll() (records []*ConsumedRecord, err error) {
+	if len(self.baseURI) == 0 {
+		err = ErrConsumerGone
+		return
+	}
+	status, err := do(self.Client, "GET", self.baseURI+"/records", "", nil, &records)
+	err = self.gone(status, err)
+	return
+}
+
+// Commit commits the offsets of the records, which have been processed.
+// The proxy commits the offset following the last record of every
+// partition.
+func (self *Consumer) Commit(records []*ConsumedRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if len(self.baseURI) == 0 {
+		return ErrConsumerGone
+	}
+	type offset struct {
+		Topic     string `json:"topic"`
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+	}
+	last := make(map[int]int64, 4)
+	for _, r := range records {
+		if o, ok := last[r.Partition]; !ok || r.Offset > o {
+			last[r.Partition] = r.Offset
+		}
+	}
+	offsets := make([]offset, 0, len(last))
+	for p, o := range last {
+		offsets = append(offsets, offset{self.Topic, p, o})
+	}
+	status, err := do(self.Client, "POST", self.baseURI+"/offsets", contentType,
+		map[string][]offset{"offsets": offsets}, nil)
+	return self.gone(status, err)
+}
+
+// Close deletes the consumer instance. Its partitions are given to
+// the other members of the group.
+func (self *Consumer) Close() error {
+	if len(self.baseURI) == 0 {
+		return nil
+	}
+	_, err := do(self.Client, "DELETE", self.baseURI, contentType, nil, nil)
+	self.baseURI = ""
+	return err
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package latency keeps histograms of how long the messages of a
+// service take to go through each stage of the delivery.
+package latency
+
+import (
+	"sync"
+	"time"
+)
+
+// The stages of a delivery.
+const (
+	// From the time a message is cached to the time it is sent.
+	// For an offline user, it is the time waiting in the cache.
+	STAGE_QUEUE = "queue"
+
+	// From the time a message is sent to the time it is acked.
+	STAGE_ACK = "ack"
+
+	// From the time a message is cached to the time it is acked.
+	STAGE_TOTAL = "total"
+)
+
+// The upper bounds of the buckets. The last bucket has no upper bound.
+var bounds = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+	24 * time.Hour,
+}
+
+// Histogram counts the latencies falling into each bucket.
+// It is safe for concurrent use.
+type Histogram struct {
+	lock   sync.Mutex
+	counts []int64
+	count  int64
+	sum    time.Duration
+	max    time.Duration
+}
+
+func NewHistogram() *Histogram {
+	ret := new(Histogram)
+	ret.counts = make([]int64, len(bounds)+1)
+	return ret
+}
+
+func (self *Histogram) Observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := 0
+	for i < len(bounds) && d > bounds[i] {
+		i++
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.counts[i]++
+	self.count++
+	self.sum += d
+	if d > self.max {
+		self.max = d
+	}
+}
+
+// Bucket counts the latencies no longer than Le. The last bucket
+// has an empty Le and counts the rest.
+type Bucket struct {
+	Le    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+type Snapshot struct {
+	Count   int64         `json:"count"`
+	Mean    time.Duration `json:"mean"`
+	Max     time.Duration `json:"max"`
+	Buckets []*Bucket     `json:"buckets"`
+}
+
+func (self *Histogram) Snapshot() *Snapshot {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ret := new(Snapshot)
+	ret.Count = self.count
+	ret.Max = self.max
+	if self.count > 0 {
+		ret.Mean = self.sum / time.Duration(self.count)
+	}
+	ret.Buckets = make([]*Bucket, len(self.counts))
+	for i, n := range self.counts {
+		b := &Bucket{Count: n}
+		if i < len(bounds) {
+			b.Le = bounds[i].String()
+		}
+		ret.Buckets[i] = b
+	}
+	return ret
+}
+
+// Tracker keeps one histogram per stage.
+type Tracker struct {
+	lock   sync.Mutex
+	stages map[string]*Histogram
+}
+
+func NewTracker() *Tracker {
+	ret := new(Tracker)
+	ret.stages = make(map[string]*Histogram, 3)
+	return ret
+}
+
+func (self *Tracker) RecordLatency(stage string, d time.Duration) {
+	self.lock.Lock()
+	h, ok := self.stages[stage]
+	if !ok {
+		h = NewHistogram()
+		self.stages[stage] = h
+	}
+	self.lock.Unlock()
+	h.Observe(d)
+}
+
+// Snapshot returns the histograms of the stages which have been recorded.
+func (self *Tracker) Snapshot() map[string]*Snapshot {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ret := make(map[string]*Snapshot, len(self.stages))
+	for stage, h := range self.stages {
+		ret[stage] = h.Snapshot()
+	}
+	return ret
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package latency
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram()
+	h.Observe(500 * time.Microsecond)
+	h.Observe(time.Millisecond)
+	h.Observe(3 * time.Second)
+	h.Observe(48 * time.Hour)
+
+	s := h.Snapshot()
+	if s.Count != 4 || s.Max != 48*time.Hour {
+		t.Errorf("bad snapshot: %+v", s)
+	}
+	if s.Buckets[0].Le != "1ms" || s.Buckets[0].Count != 2 {
+		t.Errorf("bad first bucket: %+v", s.Buckets[0])
+	}
+	if s.Buckets[7].Le != "5s" || s.Buckets[7].Count != 1 {
+		t.Errorf("bad bucket: %+v", s.Buckets[7])
+	}
+	last := s.Buckets[len(s.Buckets)-1]
+	if last.Le != "" || last.Count != 1 {
+		t.Errorf("bad last bucket: %+v", last)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tr := NewTracker()
+	tr.RecordLatency(STAGE_QUEUE, time.Second)
+	tr.RecordLatency(STAGE_QUEUE, 3*time.Second)
+	tr.RecordLatency(STAGE_ACK, time.Millisecond)
+
+	s := tr.Snapshot()
+	if len(s) != 2 || s[STAGE_QUEUE].Count != 2 || s[STAGE_QUEUE].Mean != 2*time.Second {
+		t.Errorf("bad snapshot: %+v", s)
+	}
+	if _, ok := s[STAGE_TOTAL]; ok {
+		t.Errorf("unrecorded stage in the snapshot")
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/uniqush/uniqush-conn/listener"
+	"net"
+)
+
+func closeAll(lns []net.Listener) {
+	for _, ln := range lns {
+		ln.Close()
+	}
+}
+
+// listen returns the sockets passed by systemd if there are any.
+// An inherited socket is served as the listener in the config with
+// the same name, or the same address if the listener has no name, or
+// as a plain TCP listener. Otherwise, it binds the
+// listeners in the config, or the port if there is none.
+func listen(specs []*listener.Spec, port int) (ln net.Listener, err error) {
+	inherited, names, err := listener.Inherited()
+	if err != nil {
+		return
+	}
+	lns := make([]net.Listener, 0, len(specs)+len(inherited))
+	if len(inherited) > 0 {
+		for i, l := range inherited {
+			for _, spec := range specs {
+				if spec.FdName() == names[i] {
+					l, err = listener.Wrap(l, spec)
+					break
+				}
+			}
+			if err != nil {
+				closeAll(lns)
+				closeAll(inherited[i:])
+				return
+			}
+			lns = append(lns, l)
+		}
+		return listener.Multi(lns...), nil
+	}
+	if len(specs) == 0 {
+		specs = []*listener.Spec{&listener.Spec{Addr: fmt.Sprintf("0.0.0.0:%v", port)}}
+	}
+	for _, spec := range specs {
+		var l net.Listener
+		l, err = listener.Listen(spec)
+		if err != nil {
+			closeAll(lns)
+			return
+		}
+		lns = append(lns, l)
+	}
+	return listener.Multi(lns...), nil
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+var ErrNotTransferable = errors.New("the connection cannot be passed to another process")
+
+type filer interface {
+	File() (f *os.File, err error)
+}
+
+// File returns a duplicate of the file descriptor of the connection,
+// e.g. to pass it to another process. Only a plain TCP connection,
+// whose PROXY protocol header has been read and consumed if it has
+// one, can be passed: the state of the TLS and WebSocket layers would
+// be lost.
+func (self *transportConn) File() (f *os.File, err error) {
+	c := self.Conn
+	if pc, ok := c.(*proxyConn); ok {
+		if atomic.LoadInt32(&pc.headerRead) == 0 || len(pc.rest) > 0 {
+			err = ErrNotTransferable
+			return
+		}
+		c = pc.Conn
+	}
+	fc, ok := c.(filer)
+	if !ok {
+		err = ErrNotTransferable
+		return
+	}
+	return fc.File()
+}
+
+// Files returns duplicates of the file descriptors of the sockets
+// under the listener, which may be returned from Multi, along with
+// their names, so that another process gets them from Inherited.
+func Files(ln net.Listener) (files []*os.File, names []string, err error) {
+	lns := []net.Listener{ln}
+	if ml, ok := ln.(*multiListener); ok {
+		lns = ml.lns
+	}
+	for _, l := range lns {
+		name := ""
+		if tl, ok := l.(*transportListener); ok {
+			l, name = tl.raw, tl.name
+		}
+		var f *os.File
+		if fl, ok := l.(filer); ok {
+			f, err = fl.File()
+		} else {
+			err = fmt.Errorf("listener %v cannot be passed to another process", l.Addr())
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, err
+		}
+		files = append(files, f)
+		names = append(names, name)
+	}
+	return
+}
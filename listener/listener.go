@@ -0,0 +1,317 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package listener builds the listeners accepting client connections:
+// plain TCP, TLS and WebSocket ones, either bound by the server or
+// inherited from systemd through LISTEN_FDS.
+package listener
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	TYPE_TCP       = "tcp"
+	TYPE_TLS       = "tls"
+	TYPE_WEBSOCKET = "websocket"
+)
+
+var ErrClosed = errors.New("listener closed")
+
+// Spec describes a listener in the config file.
+type Spec struct {
+	// Type is one of TYPE_*. Empty means TYPE_TCP.
+	Type string
+	Addr string
+
+	// Network is "tcp4" or "tcp6" to bind only one IP version.
+	// Empty means "tcp", which binds both if Addr is like "[::]:8964".
+	Network string
+
+	// ProxyProtocol is true if the listener is behind a proxy sending
+	// PROXY protocol headers. The clients' addresses are read from them.
+	ProxyProtocol bool
+
+	// Name is matched against LISTEN_FDNAMES to pick the inherited
+	// socket serving this listener.
+	Name string
+
+	// CertFile and KeyFile are required by TLS listeners.
+	CertFile string
+	KeyFile  string
+
+	// Path is the URL path of the WebSocket endpoint. Empty means "/".
+	Path string
+}
+
+// Conn is implemented by the connections accepted by the listeners
+// returned from Listen and Wrap.
+type Conn interface {
+	net.Conn
+
+	// Transport is one of TYPE_*.
+	Transport() string
+
+	// ClientAddr is the address of the client. It is the one told by
+	// the proxy if the listener uses the PROXY protocol.
+	ClientAddr() net.Addr
+}
+
+// Listen binds the address of the spec.
+func Listen(spec *Spec) (ln net.Listener, err error) {
+	network := spec.Network
+	if len(network) == 0 {
+		network = "tcp"
+	}
+	ln, err = net.Listen(network, spec.Addr)
+	if err != nil {
+		return
+	}
+	ret, err := Wrap(ln, spec)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Wrap adds the protocol of the spec, e.g. TLS, on top of a bound listener.
+// The accepted connections implement Conn.
+func Wrap(ln net.Listener, spec *Spec) (ret net.Listener, err error) {
+	raw := ln
+	if spec.ProxyProtocol {
+		ln = NewProxyProtocolListener(ln)
+	}
+	transport := spec.Type
+	switch transport {
+	case "", TYPE_TCP:
+		transport = TYPE_TCP
+		ret = ln
+	case TYPE_TLS:
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(spec.CertFile, spec.KeyFile)
+		if err != nil {
+			return
+		}
+		ret = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	case TYPE_WEBSOCKET:
+		ret = NewWebSocketListener(ln, spec.Path)
+	default:
+		err = fmt.Errorf("unknown listener type: %v", spec.Type)
+		return
+	}
+	ret = &transportListener{ret, transport, raw, spec.FdName()}
+	return
+}
+
+// FdName is the name of the socket of the listener when it is passed
+// to another process: its name if it has one, or its address.
+func (self *Spec) FdName() string {
+	if len(self.Name) > 0 {
+		return self.Name
+	}
+	return self.Addr
+}
+
+type transportListener struct {
+	net.Listener
+	transport string
+
+	// The bound socket under the protocol, and its name.
+	raw  net.Listener
+	name string
+}
+
+func (self *transportListener) Accept() (net.Conn, error) {
+	c, err := self.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &transportConn{c, self.transport}, nil
+}
+
+type transportConn struct {
+	net.Conn
+	transport string
+}
+
+func (self *transportConn) Transport() string {
+	return self.transport
+}
+
+func (self *transportConn) ClientAddr() net.Addr {
+	c := self.Conn
+	for {
+		switch t := c.(type) {
+		case *proxyConn:
+			return t.ClientAddr()
+		case *tls.Conn:
+			c = t.NetConn()
+		case *wsConn:
+			c = t.Conn
+		default:
+			return c.RemoteAddr()
+		}
+	}
+}
+
+// ReadHeader reads the PROXY protocol header, if the connection has
+// one under its other layers, so that ClientAddr is known.
+func (self *transportConn) ReadHeader() error {
+	c := self.Conn
+	for {
+		switch t := c.(type) {
+		case *proxyConn:
+			return t.ReadHeader()
+		case *tls.Conn:
+			c = t.NetConn()
+		case *wsConn:
+			c = t.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// The first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// Inherited returns the sockets passed by systemd socket activation,
+// along with their names in LISTEN_FDNAMES. It returns nothing if
+// the sockets are not meant for this process. The environment
+// variables are cleared so that child processes do not inherit them.
+func Inherited() (lns []net.Listener, names []string, err error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		err = nil
+		return
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		err = nil
+		return
+	}
+	fdNames := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	lns = make([]net.Listener, 0, nfds)
+	names = make([]string, 0, nfds)
+	for i := 0; i < nfds; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%v", fd))
+		var ln net.Listener
+		ln, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, nil, fmt.Errorf("inherited socket %v: %v", fd, err)
+		}
+		name := ""
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		lns = append(lns, ln)
+		names = append(names, name)
+	}
+	return
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+type multiListener struct {
+	lns     []net.Listener
+	conns   chan *acceptResult
+	done    chan bool
+	closeMe sync.Once
+}
+
+// Multi accepts connections from all of the listeners. Addr() is the
+// address of the first one.
+func Multi(lns ...net.Listener) net.Listener {
+	if len(lns) == 1 {
+		return lns[0]
+	}
+	ret := new(multiListener)
+	ret.lns = lns
+	ret.conns = make(chan *acceptResult)
+	ret.done = make(chan bool)
+	for _, ln := range lns {
+		go ret.accept(ln)
+	}
+	return ret
+}
+
+func (self *multiListener) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		select {
+		case self.conns <- &acceptResult{conn, err}:
+		case <-self.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				return
+			}
+		}
+	}
+}
+
+func (self *multiListener) Accept() (net.Conn, error) {
+	select {
+	case res := <-self.conns:
+		return res.conn, res.err
+	case <-self.done:
+		return nil, ErrClosed
+	}
+}
+
+func (self *multiListener) Close() error {
+	var err error
+	self.closeMe.Do(func() {
+		close(self.done)
+		for _, ln := range self.lns {
+			if e := ln.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+func (self *multiListener) Addr() net.Addr {
+	return self.lns[0].Addr()
+}
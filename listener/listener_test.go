@@ -0,0 +1,191 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMultiListener(t *testing.T) {
+	ln1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ln := Multi(ln1, ln2)
+	defer ln.Close()
+	if ln.Addr().String() != ln1.Addr().String() {
+		t.Errorf("bad address: %v", ln.Addr())
+	}
+	for _, addr := range []net.Addr{ln1.Addr(), ln2.Addr()} {
+		c, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		s, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		s.Close()
+		c.Close()
+	}
+	ln.Close()
+	if _, err := ln.Accept(); err != ErrClosed {
+		t.Errorf("Accept() after Close(): %v", err)
+	}
+}
+
+func TestNoInheritedSockets(t *testing.T) {
+	os.Setenv("LISTEN_PID", fmt.Sprintf("%v", os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	lns, names, err := Inherited()
+	if err != nil || len(lns) != 0 || len(names) != 0 {
+		t.Errorf("sockets of another process are inherited: %v %v %v", lns, names, err)
+	}
+}
+
+// writeClientFrame writes a masked frame, as a browser does.
+func writeClientFrame(w io.Writer, opcode byte, payload []byte) error {
+	mask := [4]byte{1, 2, 3, 4}
+	hdr := []byte{0x80 | opcode}
+	if len(payload) < 126 {
+		hdr = append(hdr, 0x80|byte(len(payload)))
+	} else {
+		hdr = append(hdr, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(payload)))
+	}
+	hdr = append(hdr, mask[:]...)
+	data := make([]byte, len(payload))
+	for i := range payload {
+		data[i] = payload[i] ^ mask[i%4]
+	}
+	_, err := w.Write(append(hdr, data...))
+	return err
+}
+
+func readServerFrame(r io.Reader) (opcode byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	opcode = hdr[0] & 0x0F
+	length := int(hdr[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	return
+}
+
+func TestWebSocketListener(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ln := NewWebSocketListener(tcpLn, "/ws")
+	defer ln.Close()
+
+	c, err := net.Dial("tcp", tcpLn.Addr().String())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(3 * time.Second))
+	fmt.Fprintf(c, "GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("bad status: %v", resp.Status)
+	}
+	// The example in RFC 6455.
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("bad accept key: %v", accept)
+	}
+
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// A stream split into frames, with a ping in between.
+	big := bytes.Repeat([]byte("x"), 300)
+	writeClientFrame(c, opBinary, []byte("hello "))
+	writeClientFrame(c, opPing, []byte("ping"))
+	writeClientFrame(c, opBinary, big)
+	want := append([]byte("hello "), big...)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("corrupted stream: %q", got)
+	}
+	opcode, payload, err := readServerFrame(br)
+	if err != nil || opcode != opPong || string(payload) != "ping" {
+		t.Errorf("bad pong: %v %q %v", opcode, payload, err)
+	}
+
+	s.Write(big)
+	opcode, payload, err = readServerFrame(br)
+	if err != nil || opcode != opBinary || !bytes.Equal(payload, big) {
+		t.Errorf("bad frame from the server: %v %v", opcode, err)
+	}
+
+	writeClientFrame(c, opClose, nil)
+	if _, err := s.Read(got); err != io.EOF {
+		t.Errorf("should be closed: %v", err)
+	}
+}
+
+func TestUnmaskedFrameIsRejected(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ws := newWsConn(server, bufio.NewReader(server))
+	defer ws.Close()
+	go client.Write([]byte{0x82, 0x01, 'x'})
+	buf := make([]byte, 1)
+	if _, err := ws.Read(buf); err != ErrBadFrame {
+		t.Errorf("unmasked frame accepted: %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrNoProxyHeader = errors.New("no PROXY protocol header")
+var ErrBadProxyHeader = errors.New("bad PROXY protocol header")
+
+// The signature of a PROXY protocol v2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The longest v1 header, including the CRLF.
+const maxProxyV1Len = 107
+
+type proxyListener struct {
+	net.Listener
+}
+
+// NewProxyProtocolListener expects every connection to start with a
+// PROXY protocol v1 or v2 header, as sent by HAProxy with send-proxy
+// or send-proxy-v2. Connections without a header fail on the first
+// Read. The header is read by the first Read, so that a slow client
+// does not block Accept; its deadline is the one set by the caller.
+func NewProxyProtocolListener(ln net.Listener) net.Listener {
+	return &proxyListener{ln}
+}
+
+func (self *proxyListener) Accept() (net.Conn, error) {
+	c, err := self.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ret := new(proxyConn)
+	ret.Conn = c
+	ret.r = bufio.NewReader(c)
+	return ret, nil
+}
+
+type proxyConn struct {
+	net.Conn
+
+	// Only used to read the header. The bytes read ahead of the
+	// header are moved to rest, so that the buffer is not kept.
+	r      *bufio.Reader
+	rest   []byte
+	once   sync.Once
+	client net.Addr
+	err    error
+
+	// Set to 1 after the header is read. Accessed atomically.
+	headerRead int32
+}
+
+func (self *proxyConn) readHeader() {
+	self.once.Do(func() {
+		self.client, self.err = readProxyHeader(self.r)
+		if n := self.r.Buffered(); n > 0 {
+			ahead, _ := self.r.Peek(n)
+			self.rest = append([]byte(nil), ahead...)
+		}
+		self.r = nil
+		atomic.StoreInt32(&self.headerRead, 1)
+	})
+}
+
+// ReadHeader reads the header if it has not been read. It lets the
+// handshake know the client address before the client sends anything
+// else.
+func (self *proxyConn) ReadHeader() error {
+	self.readHeader()
+	return self.err
+}
+
+func (self *proxyConn) Read(p []byte) (n int, err error) {
+	self.readHeader()
+	if self.err != nil {
+		return 0, self.err
+	}
+	if len(self.rest) > 0 {
+		n = copy(p, self.rest)
+		self.rest = self.rest[n:]
+		if len(self.rest) == 0 {
+			self.rest = nil
+		}
+		return
+	}
+	return self.Conn.Read(p)
+}
+
+// ClientAddr returns the source address in the header. It is the
+// address of the proxy for a LOCAL or UNKNOWN header, or if the
+// header has not been read yet.
+func (self *proxyConn) ClientAddr() net.Addr {
+	if atomic.LoadInt32(&self.headerRead) == 0 || self.client == nil {
+		return self.Conn.RemoteAddr()
+	}
+	return self.client
+}
+
+// WriteProxyHeader writes the PROXY protocol v1 header telling the
+// server behind a proxy listener that the connection is from src to
+// dst, e.g. for a gateway relaying its clients to the server. The
+// header is UNKNOWN unless src is a TCP address.
+func WriteProxyHeader(w io.Writer, src, dst net.Addr) error {
+	from, ok := src.(*net.TCPAddr)
+	if !ok || from.IP == nil {
+		_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+		return err
+	}
+	to, ok := dst.(*net.TCPAddr)
+	if !ok {
+		to = new(net.TCPAddr)
+	}
+	fam, toIP := "TCP4", to.IP.To4()
+	if from.IP.To4() == nil {
+		fam, toIP = "TCP6", to.IP.To16()
+		if to.IP.To4() != nil {
+			toIP = nil
+		}
+	}
+	if toIP == nil {
+		// The families of the addresses differ.
+		toIP = net.IPv4zero
+		if fam == "TCP6" {
+			toIP = net.IPv6unspecified
+		}
+	}
+	_, err := fmt.Fprintf(w, "PROXY %v %v %v %v %v\r\n", fam, from.IP, toIP, from.Port, to.Port)
+	return err
+}
+
+// readProxyHeader returns nil if the header has no source address.
+func readProxyHeader(r *bufio.Reader) (addr net.Addr, err error) {
+	prefix, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return
+	}
+	if bytes.Equal(prefix, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(prefix, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	err = ErrNoProxyHeader
+	return
+}
+
+func readProxyV1(r *bufio.Reader) (addr net.Addr, err error) {
+	line := make([]byte, 0, maxProxyV1Len)
+	for len(line) < maxProxyV1Len {
+		var b byte
+		b, err = r.ReadByte()
+		if err != nil {
+			return
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		err = ErrBadProxyHeader
+		return
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		err = ErrBadProxyHeader
+		return
+	}
+	ip := net.ParseIP(fields[2])
+	port, e := strconv.Atoi(fields[4])
+	if ip == nil || e != nil || port < 0 || port > 0xFFFF {
+		err = ErrBadProxyHeader
+		return
+	}
+	addr = &net.TCPAddr{IP: ip, Port: port}
+	return
+}
+
+func readProxyV2(r *bufio.Reader) (addr net.Addr, err error) {
+	var hdr [16]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	if hdr[12]>>4 != 2 {
+		err = ErrBadProxyHeader
+		return
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	// A LOCAL command, e.g. a health check from the proxy itself.
+	if hdr[12]&0x0F == 0 {
+		return
+	}
+	if hdr[12]&0x0F != 1 {
+		err = ErrBadProxyHeader
+		return
+	}
+	// Only TCP over IPv4 or IPv6 carries an address we can use.
+	switch hdr[13] {
+	case 0x11:
+		if len(payload) < 12 {
+			err = ErrBadProxyHeader
+			return
+		}
+		addr = &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:])),
+		}
+	case 0x21:
+		if len(payload) < 36 {
+			err = ErrBadProxyHeader
+			return
+		}
+		addr = &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:])),
+		}
+	}
+	return
+}
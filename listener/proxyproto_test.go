@@ -0,0 +1,158 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func proxyV2Header(cmd, fam byte, addrs []byte) []byte {
+	hdr := append([]byte{}, proxyV2Sig...)
+	hdr = append(hdr, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 10, 0, 0, 1, 0x30, 0x39, 0x23, 0x04}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(v6[32:], 443)
+	cases := []struct {
+		header string
+		addr   string
+		err    error
+	}{
+		{"PROXY TCP4 192.0.2.1 10.0.0.1 12345 8964\r\n", "192.0.2.1:12345", nil},
+		{"PROXY TCP6 2001:db8::1 ::1 443 8964\r\n", "[2001:db8::1]:443", nil},
+		{"PROXY UNKNOWN\r\n", "", nil},
+		{"PROXY TCP4 192.0.2.1 10.0.0.1 12345\r\n", "", ErrBadProxyHeader},
+		{"PROXY TCP4 bad 10.0.0.1 12345 8964\r\n", "", ErrBadProxyHeader},
+		{"GET / HTTP/1.1\r\n\r\n", "", ErrNoProxyHeader},
+		{string(proxyV2Header(1, 0x11, v4)), "192.0.2.1:12345", nil},
+		{string(proxyV2Header(1, 0x21, v6)), "[2001:db8::1]:443", nil},
+		{string(proxyV2Header(0, 0x00, nil)), "", nil},
+		{string(proxyV2Header(1, 0x11, v4[:4])), "", ErrBadProxyHeader},
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(bytes.NewReader([]byte(c.header + "payload")))
+		addr, err := readProxyHeader(r)
+		if err != c.err {
+			t.Errorf("%q: error %v, not %v", c.header, err, c.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if (addr == nil && len(c.addr) > 0) || (addr != nil && addr.String() != c.addr) {
+			t.Errorf("%q: address %v, not %q", c.header, addr, c.addr)
+		}
+		rest, _ := ioutil.ReadAll(r)
+		if string(rest) != "payload" {
+			t.Errorf("%q: the header is not consumed: %q", c.header, rest)
+		}
+	}
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	tcp := func(s string) net.Addr {
+		addr, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return addr
+	}
+	cases := []struct {
+		src, dst net.Addr
+		header   string
+	}{
+		{tcp("192.0.2.1:12345"), tcp("10.0.0.1:8964"), "PROXY TCP4 192.0.2.1 10.0.0.1 12345 8964\r\n"},
+		{tcp("[2001:db8::1]:443"), tcp("[::1]:8964"), "PROXY TCP6 2001:db8::1 ::1 443 8964\r\n"},
+		{tcp("[2001:db8::1]:443"), tcp("10.0.0.1:8964"), "PROXY TCP6 2001:db8::1 :: 443 8964\r\n"},
+		{tcp("192.0.2.1:12345"), nil, "PROXY TCP4 192.0.2.1 0.0.0.0 12345 0\r\n"},
+		{&net.UnixAddr{Name: "sock", Net: "unix"}, tcp("10.0.0.1:8964"), "PROXY UNKNOWN\r\n"},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		if err := WriteProxyHeader(&buf, c.src, c.dst); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if buf.String() != c.header {
+			t.Errorf("%v -> %v: header %q, not %q", c.src, c.dst, buf.String(), c.header)
+			continue
+		}
+		addr, err := readProxyHeader(bufio.NewReader(&buf))
+		if err != nil {
+			t.Errorf("%q: cannot read the header: %v", c.header, err)
+		} else if _, ok := c.src.(*net.TCPAddr); ok && addr.String() != c.src.String() {
+			t.Errorf("%q: address %v, not %v", c.header, addr, c.src)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ln, err := Wrap(tcpLn, &Spec{ProxyProtocol: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", tcpLn.Addr().String())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 192.0.2.1 10.0.0.1 12345 8964\r\nhello"))
+
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer s.Close()
+	conn, ok := s.(Conn)
+	if !ok {
+		t.Fatalf("accepted connection does not implement Conn")
+	}
+	if conn.Transport() != TYPE_TCP {
+		t.Errorf("bad transport: %v", conn.Transport())
+	}
+	if conn.ClientAddr().String() != conn.RemoteAddr().String() {
+		t.Errorf("client address known before the header is read: %v", conn.ClientAddr())
+	}
+	if err := s.(interface{ ReadHeader() error }).ReadHeader(); err != nil {
+		t.Errorf("cannot read the header: %v", err)
+	}
+	if conn.ClientAddr().String() != "192.0.2.1:12345" {
+		t.Errorf("bad client address after the header is read: %v", conn.ClientAddr())
+	}
+	buf := make([]byte, 5)
+	if _, err := s.Read(buf); err != nil || string(buf) != "hello" {
+		t.Errorf("bad data: %q %v", buf, err)
+	}
+	if conn.ClientAddr().String() != "192.0.2.1:12345" {
+		t.Errorf("bad client address: %v", conn.ClientAddr())
+	}
+}
@@ -0,0 +1,331 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The GUID defined by RFC 6455 to compute Sec-WebSocket-Accept.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+var ErrBadFrame = errors.New("bad websocket frame")
+
+type wsListener struct {
+	ln      net.Listener
+	conns   chan net.Conn
+	done    chan bool
+	closeMe sync.Once
+}
+
+// NewWebSocketListener serves WebSocket handshakes on the path and
+// returns the upgraded connections. Every binary or text message
+// carries a part of the byte stream, so a client sends the same bytes
+// as it would over TCP.
+func NewWebSocketListener(ln net.Listener, path string) net.Listener {
+	if len(path) == 0 {
+		path = "/"
+	}
+	ret := new(wsListener)
+	ret.ln = ln
+	ret.conns = make(chan net.Conn)
+	ret.done = make(chan bool)
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, ret.upgrade)
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go srv.Serve(ln)
+	return ret
+}
+
+func headerContains(h http.Header, key, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(key)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+websocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (self *wsListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || len(key) == 0 ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket handshake required", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot upgrade", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n")
+	if err = brw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	ws := newWsConn(conn, brw.Reader)
+	select {
+	case self.conns <- ws:
+	case <-self.done:
+		conn.Close()
+	}
+}
+
+func (self *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-self.conns:
+		return conn, nil
+	case <-self.done:
+		return nil, ErrClosed
+	}
+}
+
+func (self *wsListener) Close() error {
+	var err error
+	self.closeMe.Do(func() {
+		close(self.done)
+		err = self.ln.Close()
+	})
+	return err
+}
+
+func (self *wsListener) Addr() net.Addr {
+	return self.ln.Addr()
+}
+
+// wsConn is a net.Conn over a WebSocket connection.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// The remaining bytes of the current data frame.
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+	masked    bool
+
+	writeLock sync.Mutex
+	closed    bool
+}
+
+// The read buffer of a WebSocket connection, which is enough for
+// the header of a frame. Larger reads go to the connection directly.
+const wsReadBufferSize = 64
+
+// newWsConn replaces r, the reader of the handshake, by a smaller one,
+// since its buffer would be kept as long as the connection.
+func newWsConn(conn net.Conn, r *bufio.Reader) *wsConn {
+	ret := new(wsConn)
+	ret.Conn = conn
+	var src io.Reader = conn
+	if n := r.Buffered(); n > 0 {
+		ahead, _ := r.Peek(n)
+		src = io.MultiReader(bytes.NewReader(append([]byte(nil), ahead...)), conn)
+	}
+	ret.r = bufio.NewReaderSize(src, wsReadBufferSize)
+	return ret
+}
+
+func (self *wsConn) writeFrame(opcode byte, payload []byte) error {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	if self.closed {
+		return ErrClosed
+	}
+	var hdr [10]byte
+	hdr[0] = 0x80 | opcode
+	n := 2
+	switch l := len(payload); {
+	case l < 126:
+		hdr[1] = byte(l)
+	case l <= 0xFFFF:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+		n = 4
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+		n = 10
+	}
+	// Frames from a server are never masked.
+	buf := make([]byte, 0, n+len(payload))
+	buf = append(buf, hdr[:n]...)
+	buf = append(buf, payload...)
+	_, err := self.Conn.Write(buf)
+	if opcode == opClose {
+		self.closed = true
+	}
+	return err
+}
+
+// readHeader reads frame headers until the next data frame, answering
+// the control frames on the way.
+func (self *wsConn) readHeader() error {
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(self.r, hdr[:]); err != nil {
+			return err
+		}
+		opcode := hdr[0] & 0x0F
+		masked := hdr[1]&0x80 != 0
+		// Frames from a client must be masked.
+		if !masked {
+			return ErrBadFrame
+		}
+		length := uint64(hdr[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(self.r, ext[:]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(self.r, ext[:]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		self.masked = masked
+		self.maskPos = 0
+		if masked {
+			if _, err := io.ReadFull(self.r, self.mask[:]); err != nil {
+				return err
+			}
+		}
+		switch opcode {
+		case opContinuation, opText, opBinary:
+			self.remaining = length
+			if length > 0 {
+				return nil
+			}
+			continue
+		}
+		if length > 125 {
+			return ErrBadFrame
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(self.r, payload); err != nil {
+			return err
+		}
+		self.unmask(payload)
+		switch opcode {
+		case opClose:
+			self.writeFrame(opClose, payload)
+			return io.EOF
+		case opPing:
+			if err := self.writeFrame(opPong, payload); err != nil {
+				return err
+			}
+		case opPong:
+		default:
+			return ErrBadFrame
+		}
+	}
+}
+
+func (self *wsConn) unmask(p []byte) {
+	if !self.masked {
+		return
+	}
+	for i := range p {
+		p[i] ^= self.mask[self.maskPos&3]
+		self.maskPos++
+	}
+}
+
+func (self *wsConn) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return
+	}
+	if self.remaining == 0 {
+		if err = self.readHeader(); err != nil {
+			return
+		}
+	}
+	if uint64(len(p)) > self.remaining {
+		p = p[:self.remaining]
+	}
+	n, err = self.r.Read(p)
+	self.unmask(p[:n])
+	self.remaining -= uint64(n)
+	return
+}
+
+func (self *wsConn) Write(p []byte) (n int, err error) {
+	err = self.writeFrame(opBinary, p)
+	if err == nil {
+		n = len(p)
+	}
+	return
+}
+
+// The time to wait for the close frame to be sent.
+const closeTimeout = time.Second
+
+func (self *wsConn) Close() error {
+	self.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	self.writeFrame(opClose, nil)
+	return self.Conn.Close()
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package logger defines the logging interface used across
+// uniqush-conn. Records carry key-value fields so that they could be
+// routed to any structured logging library by implementing Logger.
+package logger
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Logger writes a record with a message and key-value pairs.
+// kv should contain an even number of elements, with keys at even
+// positions.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+
+	// With() returns a Logger which adds kv to every record.
+	With(kv ...interface{}) Logger
+}
+
+type Level int
+
+const (
+	LEVEL_DEBUG Level = iota
+	LEVEL_INFO
+	LEVEL_WARN
+	LEVEL_ERROR
+)
+
+func (self Level) String() string {
+	switch self {
+	case LEVEL_DEBUG:
+		return "debug"
+	case LEVEL_INFO:
+		return "info"
+	case LEVEL_WARN:
+		return "warn"
+	case LEVEL_ERROR:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(self))
+}
+
+func ParseLevel(str string) (level Level, err error) {
+	switch strings.ToLower(str) {
+	case "debug":
+		level = LEVEL_DEBUG
+	case "info":
+		level = LEVEL_INFO
+	case "warn", "warning":
+		level = LEVEL_WARN
+	case "error":
+		level = LEVEL_ERROR
+	default:
+		err = fmt.Errorf("unknown log level: %v", str)
+	}
+	return
+}
+
+type nopLogger struct{}
+
+func (self nopLogger) Debug(msg string, kv ...interface{}) {}
+func (self nopLogger) Info(msg string, kv ...interface{})  {}
+func (self nopLogger) Warn(msg string, kv ...interface{})  {}
+func (self nopLogger) Error(msg string, kv ...interface{}) {}
+func (self nopLogger) With(kv ...interface{}) Logger       { return self }
+
+// Nop returns a Logger which discards everything.
+func Nop() Logger {
+	return nopLogger{}
+}
+
+// OrNop returns l, or a Logger which discards everything if l is nil.
+func OrNop(l Logger) Logger {
+	if l == nil {
+		return Nop()
+	}
+	return l
+}
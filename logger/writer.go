@@ -0,0 +1,122 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type writerLogger struct {
+	lock   *sync.Mutex
+	w      io.Writer
+	level  Level
+	fields []interface{}
+}
+
+// NewWriterLogger returns a Logger which writes records at or above
+// the level to w, one record per line, in key=value format:
+//
+//	time=2013-07-01T12:00:00Z level=info msg="new connection" service=chat username=alice
+func NewWriterLogger(w io.Writer, level Level) Logger {
+	ret := new(writerLogger)
+	ret.lock = new(sync.Mutex)
+	ret.w = w
+	ret.level = level
+	return ret
+}
+
+func (self *writerLogger) Debug(msg string, kv ...interface{}) {
+	self.log(LEVEL_DEBUG, msg, kv)
+}
+
+func (self *writerLogger) Info(msg string, kv ...interface{}) {
+	self.log(LEVEL_INFO, msg, kv)
+}
+
+func (self *writerLogger) Warn(msg string, kv ...interface{}) {
+	self.log(LEVEL_WARN, msg, kv)
+}
+
+func (self *writerLogger) Error(msg string, kv ...interface{}) {
+	self.log(LEVEL_ERROR, msg, kv)
+}
+
+func (self *writerLogger) With(kv ...interface{}) Logger {
+	ret := new(writerLogger)
+	*ret = *self
+	ret.fields = make([]interface{}, 0, len(self.fields)+len(kv))
+	ret.fields = append(ret.fields, self.fields...)
+	ret.fields = append(ret.fields, kv...)
+	return ret
+}
+
+func formatValue(v interface{}) string {
+	var str string
+	switch t := v.(type) {
+	case string:
+		str = t
+	case error:
+		str = t.Error()
+	case fmt.Stringer:
+		str = t.String()
+	default:
+		str = fmt.Sprintf("%v", v)
+	}
+	if len(str) == 0 || bytes.IndexAny([]byte(str), " =\"\n\t") >= 0 {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+func writeFields(buf *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(fmt.Sprintf("%v", kv[i]))
+		buf.WriteByte('=')
+		if i+1 < len(kv) {
+			buf.WriteString(formatValue(kv[i+1]))
+		} else {
+			buf.WriteString("(MISSING)")
+		}
+	}
+}
+
+func (self *writerLogger) log(level Level, msg string, kv []interface{}) {
+	if level < self.level {
+		return
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("time=")
+	buf.WriteString(time.Now().UTC().Format(time.RFC3339))
+	buf.WriteString(" level=")
+	buf.WriteString(level.String())
+	buf.WriteString(" msg=")
+	buf.WriteString(strconv.Quote(msg))
+	writeFields(buf, self.fields)
+	writeFields(buf, kv)
+	buf.WriteByte('\n')
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.w.Write(buf.Bytes())
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWriterLoggerLevel(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := NewWriterLogger(buf, LEVEL_WARN)
+	l.Debug("debug")
+	l.Info("info")
+	if buf.Len() != 0 {
+		t.Errorf("should not write records below the level: %v", buf.String())
+	}
+	l.Warn("warn")
+	l.Error("error")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Errorf("should write two records: %v", buf.String())
+	}
+}
+
+func TestWriterLoggerFields(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := NewWriterLogger(buf, LEVEL_DEBUG)
+	l = l.With("service", "chat", "username", "alice")
+	l.Info("new connection", "connId", "abc", "err", errors.New("bad thing"), "n", 3)
+	line := buf.String()
+	for _, f := range []string{
+		"level=info",
+		`msg="new connection"`,
+		"service=chat",
+		"username=alice",
+		"connId=abc",
+		`err="bad thing"`,
+		"n=3",
+	} {
+		if !strings.Contains(line, f) {
+			t.Errorf("%v should contain %v", line, f)
+		}
+	}
+	if strings.Index(line, "service=") > strings.Index(line, "connId=") {
+		t.Errorf("fields from With() should come first: %v", line)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, lv := range []Level{LEVEL_DEBUG, LEVEL_INFO, LEVEL_WARN, LEVEL_ERROR} {
+		l, err := ParseLevel(lv.String())
+		if err != nil || l != lv {
+			t.Errorf("cannot parse %v", lv)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Errorf("should not parse unknown level")
+	}
+}
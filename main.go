@@ -18,16 +18,28 @@
 package main
 
 import (
+	"crypto"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"flag"
 	"fmt"
+	"github.com/uniqush/uniqush-conn/admin"
 	"github.com/uniqush/uniqush-conn/configparser"
+	"github.com/uniqush/uniqush-conn/handoff"
+	"github.com/uniqush/uniqush-conn/media"
 	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/scheduler"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func readPrivateKey(keyFileName string) (priv *rsa.PrivateKey, err error) {
@@ -44,25 +56,132 @@ func readPrivateKey(keyFileName string) (priv *rsa.PrivateKey, err error) {
 	return
 }
 
+// readKeys reads the current key and the previous ones, which are
+// still accepted from the clients pinning them during a rotation.
+func readKeys() (current crypto.Signer, previous []crypto.Signer, err error) {
+	current, err = readPrivateKey(*argvKeyFile)
+	if err != nil {
+		return
+	}
+	for _, f := range strings.Split(*argvPreviousKeyFiles, ",") {
+		f = strings.TrimSpace(f)
+		if len(f) == 0 {
+			continue
+		}
+		var k *rsa.PrivateKey
+		k, err = readPrivateKey(f)
+		if err != nil {
+			return
+		}
+		previous = append(previous, k)
+	}
+	return
+}
+
+// reloadKeysOnHup rereads the key files into the ring on SIGHUP.
+func reloadKeysOnHup(ring *proto.KeyRing) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		current, previous, err := readKeys()
+		if err == nil {
+			err = ring.SetKeys(current, previous...)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Key error: %v\n", err)
+		}
+	}
+}
+
+// handOffOnUsr2 starts the binary again on SIGUSR2 and hands the
+// connections off to it. The channel is closed once they are handed
+// off, and this process should then exit.
+func handOffOnUsr2(center *msgcenter.MessageCenter, ln net.Listener) <-chan bool {
+	done := make(chan bool)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	go func() {
+		for range ch {
+			exe, err := os.Executable()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Handoff error: %v\n", err)
+				continue
+			}
+			cmd, sock, err := handoff.Exec(exe, os.Args[1:], ln)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Handoff error: %v\n", err)
+				continue
+			}
+			signal.Stop(ch)
+			n, err := center.Handoff(sock, *argvHandoffTimeout)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Handoff error: %v\n", err)
+			}
+			fmt.Fprintf(os.Stderr, "%v connections handed off to process %v\n", n, cmd.Process.Pid)
+			// The new process gets EOF once this one exits.
+			close(done)
+			return
+		}
+	}()
+	return done
+}
+
+// drainOnTerm drains the center on SIGTERM, e.g. when Kubernetes
+// stops the pod. The channel is closed once it is drained, and this
+// process should then exit.
+func drainOnTerm(center *msgcenter.MessageCenter) <-chan bool {
+	done := make(chan bool)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM)
+	go func() {
+		<-ch
+		signal.Stop(ch)
+		n := center.Drain(*argvDrainTimeout)
+		fmt.Fprintf(os.Stderr, "Drained, %v connections closed\n", n)
+		close(done)
+	}()
+	return done
+}
+
+// serveHTTP serves the handler on addr, over TLS if there is a
+// certificate, and tells why it stopped.
+func serveHTTP(name, addr, certFile, keyFile string, handler http.Handler) {
+	var err error
+	if len(certFile) > 0 {
+		err = http.ListenAndServeTLS(addr, certFile, keyFile, handler)
+	} else {
+		err = http.ListenAndServe(addr, handler)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v error: %v\n", name, err)
+	}
+}
+
 var argvKeyFile = flag.String("key", "key.pem", "private key")
+var argvPreviousKeyFiles = flag.String("previous-keys", "", "comma separated previous private keys, accepted during a key rotation")
 var argvConfigFile = flag.String("config", "config.yaml", "config file path")
+var argvHandoffTimeout = flag.Duration("handoff-timeout", 10*time.Second, "how long a connection may take to be paused when it is handed off to a new process on SIGUSR2")
+var argvDrainTimeout = flag.Duration("drain-timeout", 20*time.Second, "how long the clients may take to leave on SIGTERM before they are disconnected")
+
+// startGrpc is set if the binary is built with the grpc tag.
+var startGrpc func(addr string, center *msgcenter.MessageCenter, auditLog admin.AuditLog) error
 
 // In memory of the blood on the square.
+// It is not used if the config file has listeners.
 var argvPort = flag.Int("port", 0x2304, "port number")
 
 func main() {
 	flag.Parse()
-	ln, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", *argvPort))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Network error: %v\n", err)
-		return
+	var privkey *proto.KeyRing
+	current, previous, err := readKeys()
+	if err == nil {
+		privkey, err = proto.NewKeyRing(current, previous...)
 	}
-
-	privkey, err := readPrivateKey(*argvKeyFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Key error: %v\n", err)
 		return
 	}
+	go reloadKeysOnHup(privkey)
 	config, err := configparser.Parse(*argvConfigFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
@@ -72,17 +191,208 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Config error: You should provide the auth url\n")
 		return
 	}
+	// Started by a previous process handing its connections off.
+	sock, err := handoff.Inherit()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Handoff error: %v\n", err)
+		return
+	}
+	deliveryOnly := config.Cluster != nil && config.Cluster.DeliveryOnly
+	var ln net.Listener
+	if deliveryOnly {
+		// The clients connect to the other nodes.
+		if config.MqttGateway != nil || config.Sse != nil {
+			fmt.Fprintf(os.Stderr, "Config error: a delivery-only node has no MQTT or SSE gateway\n")
+			return
+		}
+	} else {
+		ln, err = listen(config.Listeners, *argvPort)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Network error: %v\n", err)
+			return
+		}
+	}
 
+	if len(config.KeyLog) > 0 {
+		f, err := os.OpenFile(config.KeyLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Key log error: %v\n", err)
+			return
+		}
+		defer f.Close()
+		fmt.Fprintf(os.Stderr, "Warning: the session keys are logged to %v\n", config.KeyLog)
+		proto.SetKeyLog(f)
+	}
+	if config.CPUWorkers > 0 {
+		proto.SetCPUPool(proto.NewCPUPool(config.CPUWorkers, config.CPUQueueLen))
+	}
 	center := msgcenter.NewMessageCenter(ln, privkey, config.ErrorHandler, config.HandshakeTimeout, config.Auth, config)
+	center.SetLogger(config.Logger)
+	center.SetHandshakeLimits(config.HandshakeLimits)
+	center.SetHandshakeWorkers(config.HandshakeWorkers)
+	if config.Revocation != nil {
+		center.SetRevocationStore(config.Revocation)
+	}
+	if config.Binding != nil {
+		center.SetBindingStore(config.Binding)
+	}
+	if deliveryOnly {
+		center.SetDeliveryOnly()
+	}
+	if config.Cluster != nil {
+		err = center.SetCluster(config.Cluster.Node, config.Cluster.Locator, config.Cluster.Transport)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cluster error: %v\n", err)
+			return
+		}
+	}
 
+	if config.Federation != nil {
+		center.SetFederation(config.Federation)
+	}
+	var sched *scheduler.Scheduler
+	if config.Scheduler != nil {
+		sched = scheduler.NewScheduler(center, config.Scheduler)
+		sched.SetLogger(config.Logger)
+		if config.Cluster != nil && config.Cluster.FeedCampaigns {
+			sched.SetFeed(center)
+		}
+		// The services keep the scheduler once they are added.
+		center.SetForwardScheduler(sched)
+	}
 	srvs := config.AllServices()
 	for _, srv := range srvs {
 		center.AddService(srv)
 	}
+
+	for _, d := range config.Webhooks {
+		d.SetLogger(config.Logger)
+		d.Listen(center)
+	}
+	for _, a := range config.Archivers {
+		a.SetLogger(config.Logger)
+		a.Listen(center)
+		defer a.Stop()
+	}
+	if b := config.KafkaBridge; b != nil {
+		b.SetLogger(config.Logger)
+		b.Start(center, center)
+		defer b.Stop()
+	}
+	if sock != nil {
+		// The previous process exits once it is done, and releases
+		// the other ports.
+		n, err := center.Adopt(sock)
+		sock.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Handoff error: %v\n", err)
+		}
+		fmt.Fprintf(os.Stderr, "%v connections adopted\n", n)
+	}
+	if c := config.MqttGateway; c != nil {
+		gw := c.Gateway
+		gw.PublicKey, _ = privkey.Public().(*rsa.PublicKey)
+		if len(gw.ServerAddr) == 0 {
+			gw.ServerAddr = ln.Addr().String()
+		}
+		gw.Logger = config.Logger
+		if len(c.CertFile) > 0 {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "MQTT error: %v\n", err)
+				return
+			}
+			gw.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		mqttln, err := net.Listen("tcp", c.Addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Network error: %v\n", err)
+			return
+		}
+		go gw.Serve(mqttln)
+		defer gw.Close()
+	}
+	if c := config.Sse; c != nil {
+		ep := c.Endpoint
+		ep.PublicKey, _ = privkey.Public().(*rsa.PublicKey)
+		if len(ep.ServerAddr) == 0 {
+			ep.ServerAddr = ln.Addr().String()
+		}
+		ep.Logger = config.Logger
+		go serveHTTP("SSE", c.Addr, c.CertFile, c.KeyFile, ep)
+		defer ep.Close()
+	}
+	if c := config.Media; c != nil {
+		ep := c.Endpoint
+		ep.Store, err = media.NewDirStore(c.Dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Media error: %v\n", err)
+			return
+		}
+		ep.Auth = config.Auth
+		ep.Logger = config.Logger
+		if c.IncompleteTTL > 0 || c.TTL > 0 {
+			janitor := media.NewJanitor(ep.Store, c.IncompleteTTL, c.TTL)
+			janitor.SetLogger(config.Logger)
+			go janitor.Run(0)
+			defer janitor.Stop()
+		}
+		go serveHTTP("Media", c.Addr, c.CertFile, c.KeyFile, ep)
+	}
+
+	// The messages sent through the other APIs are audited too.
+	var auditLog admin.AuditLog
+	if len(config.AdminAuditLog) > 0 {
+		auditLog, err = admin.OpenAuditLog(config.AdminAuditLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Admin audit log error: %v\n", err)
+			return
+		}
+	}
+	if len(config.AdminAddr) > 0 {
+		go func() {
+			err := http.ListenAndServe(config.AdminAddr, admin.NewHandlerWithAuditLog(center, config.AdminKey, auditLog))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Admin API error: %v\n", err)
+			}
+		}()
+	}
+	if len(config.GrpcAddr) > 0 {
+		if startGrpc == nil {
+			fmt.Fprintf(os.Stderr, "Config error: gRPC is not supported by this build\n")
+			return
+		}
+		go func() {
+			err := startGrpc(config.GrpcAddr, center, auditLog)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "gRPC error: %v\n", err)
+			}
+		}()
+	}
 	proc := NewHttpRequestProcessor(config.HttpAddr, center)
+	if auditLog != nil {
+		proc.SetAuditLog(auditLog)
+	}
+	if sched != nil {
+		proc.SetScheduler(sched)
+		go sched.Run(config.SchedulerInterval)
+	}
 	go center.Start()
-	err = proc.Start()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v", err)
+	var handedOff <-chan bool
+	if !deliveryOnly {
+		handedOff = handOffOnUsr2(center, ln)
+	}
+	drained := drainOnTerm(center)
+	procErr := make(chan error, 1)
+	go func() {
+		procErr <- proc.Start()
+	}()
+	select {
+	case err = <-procErr:
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v", err)
+		}
+	case <-handedOff:
+	case <-drained:
 	}
 }
@@ -0,0 +1,354 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package media
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/backoff"
+	"github.com/uniqush/uniqush-conn/proto"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultChunkSize = 1 << 20
+	DefaultRetries   = 5
+	DefaultBackoff   = time.Second
+)
+
+// StatusError is an unexpected reply of the endpoint.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (self *StatusError) Error() string {
+	return fmt.Sprintf("media endpoint replied %v: %v", self.Code, self.Message)
+}
+
+// retryable tells if the request may succeed if it is sent again.
+func retryable(err error) bool {
+	if serr, ok := err.(*StatusError); ok {
+		return serr.Code >= 500
+	}
+	// The errors of the network.
+	return true
+}
+
+// conflict tells if the endpoint expected a chunk at another offset.
+func conflict(err error, up *Upload, id string) bool {
+	serr, ok := err.(*StatusError)
+	return ok && serr.Code == http.StatusConflict && up != nil && up.Id == id
+}
+
+// Client uploads and downloads the blobs of a user.
+type Client struct {
+	// URL is the prefix of the endpoint, e.g.
+	// "https://example.com/media/".
+	URL      string
+	Service  string
+	Username string
+	Token    string
+
+	// ChunkSize should not exceed the MaxChunkSize of the endpoint.
+	// It defaults to DefaultChunkSize.
+	ChunkSize int
+
+	// Retries is the number of consecutive failures after which
+	// the upload is given up, and Backoff the wait after the first
+	// one, doubled after every other one. They default to
+	// DefaultRetries and DefaultBackoff.
+	Retries int
+	Backoff time.Duration
+
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+func NewClient(url, service, username, token string) *Client {
+	ret := new(Client)
+	ret.URL = url
+	ret.Service = service
+	ret.Username = username
+	ret.Token = token
+	return ret
+}
+
+func (self *Client) chunkSize() int {
+	if self.ChunkSize > 0 {
+		return self.ChunkSize
+	}
+	return DefaultChunkSize
+}
+
+func (self *Client) retries() int {
+	if self.Retries > 0 {
+		return self.Retries
+	}
+	return DefaultRetries
+}
+
+func (self *Client) backoff(failures int) time.Duration {
+	d := self.Backoff
+	if d <= 0 {
+		d = DefaultBackoff
+	}
+	return backoff.Nth(d, failures)
+}
+
+func (self *Client) httpClient() *http.Client {
+	if self.HTTPClient != nil {
+		return self.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (self *Client) endpoint(name string, params url.Values) string {
+	prefix := self.URL
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + name + "?" + params.Encode()
+}
+
+// do sends the request and decodes the upload replied. A 409 Conflict
+// replies the upload as well, with a StatusError.
+func (self *Client) do(method, name string, params url.Values, body []byte) (up *Upload, err error) {
+	req, err := http.NewRequest(method, self.endpoint(name, params), bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set(ServiceHeader, self.Service)
+	req.Header.Set(UsernameHeader, self.Username)
+	req.Header.Set(TokenHeader, self.Token)
+	resp, err := self.httpClient().Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusConflict:
+		ret := new(Upload)
+		if err = json.Unmarshal(data, ret); err != nil {
+			return
+		}
+		up = ret
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		err = &StatusError{resp.StatusCode, strings.TrimSpace(string(data))}
+	}
+	return
+}
+
+// retry calls f until it succeeds, fails in a way which cannot be
+// retried, or fails too many times in a row.
+func (self *Client) retry(f func() error) (err error) {
+	for failures := 1; ; failures++ {
+		err = f()
+		if err == nil || !retryable(err) || failures > self.retries() {
+			return
+		}
+		time.Sleep(self.backoff(failures))
+	}
+}
+
+// Stat tells how much of the upload the endpoint has received.
+func (self *Client) Stat(id string) (up *Upload, err error) {
+	err = self.retry(func() (e error) {
+		up, e = self.do("GET", "upload.json", url.Values{"id": {id}}, nil)
+		return
+	})
+	return
+}
+
+// Upload sends the size bytes of the blob in chunks. The chunks which
+// fail are sent again. The id of the upload is returned once it has
+// started, even if it fails, so that it could be resumed later.
+func (self *Client) Upload(blob io.ReaderAt, size int64, contentType string) (id string, err error) {
+	params := url.Values{"size": {strconv.FormatInt(size, 10)}, "type": {contentType}}
+	var up *Upload
+	err = self.retry(func() (e error) {
+		up, e = self.do("POST", "upload.json", params, nil)
+		return
+	})
+	if err != nil {
+		return
+	}
+	id = up.Id
+	err = self.send(up, blob)
+	return
+}
+
+// Resume sends the rest of the blob of an upload which has failed,
+// e.g. because the app was stopped.
+func (self *Client) Resume(id string, blob io.ReaderAt) error {
+	up, err := self.Stat(id)
+	if err != nil {
+		return err
+	}
+	return self.send(up, blob)
+}
+
+func (self *Client) send(up *Upload, blob io.ReaderAt) error {
+	buf := make([]byte, self.chunkSize())
+	failures := 0
+	for !up.Complete() {
+		n := up.Size - up.Offset
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		chunk := buf[:n]
+		if _, err := blob.ReadAt(chunk, up.Offset); err != nil && err != io.EOF {
+			return err
+		}
+		params := url.Values{"id": {up.Id}, "offset": {strconv.FormatInt(up.Offset, 10)}}
+		next, err := self.do("PUT", "chunk.json", params, chunk)
+		if err == nil {
+			up = next
+			failures = 0
+			continue
+		}
+		if !retryable(err) && !conflict(err, next, up.Id) {
+			return err
+		}
+		failures++
+		if failures > self.retries() {
+			return err
+		}
+		if next != nil && next.Id == up.Id {
+			// The endpoint has a different offset: resume from it.
+			up = next
+			continue
+		}
+		time.Sleep(self.backoff(failures))
+		// The chunk may have been received even if the reply is lost.
+		if st, e := self.Stat(up.Id); e == nil {
+			up = st
+		}
+	}
+	return nil
+}
+
+// Download returns the content of a complete upload. It should be
+// closed once read.
+func (self *Client) Download(id string) (blob io.ReadCloser, err error) {
+	req, err := http.NewRequest("GET", self.endpoint("blob", url.Values{"id": {id}}), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set(ServiceHeader, self.Service)
+	req.Header.Set(UsernameHeader, self.Username)
+	req.Header.Set(TokenHeader, self.Token)
+	resp, err := self.httpClient().Do(req)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		err = &StatusError{resp.StatusCode, strings.TrimSpace(string(data))}
+		return
+	}
+	blob = resp.Body
+	return
+}
+
+// Forwarder is implemented by client.Conn.
+type Forwarder interface {
+	RequestForward(service, receiver string, msg *proto.Message, ttl time.Duration) (reqId string, err error)
+}
+
+// Composer sends the messages referencing the blobs it uploads.
+type Composer struct {
+	Client *Client
+	Conn   Forwarder
+}
+
+func NewComposer(client *Client, conn Forwarder) *Composer {
+	return &Composer{Client: client, Conn: conn}
+}
+
+// SendMedia uploads the blob, then forwards msg, which may be nil, to
+// the receiver referencing the blob. If the upload fails, its id may
+// be given to ResumeMedia to try again.
+func (self *Composer) SendMedia(service, receiver string, msg *proto.Message, blob io.ReaderAt, size int64, contentType string, ttl time.Duration) (uploadId, reqId string, err error) {
+	uploadId, err = self.Client.Upload(blob, size, contentType)
+	if err != nil {
+		return
+	}
+	reqId, err = self.forward(service, receiver, msg, uploadId, size, contentType, ttl)
+	return
+}
+
+// ResumeMedia finishes the upload failed in SendMedia, then forwards
+// the message.
+func (self *Composer) ResumeMedia(uploadId, service, receiver string, msg *proto.Message, blob io.ReaderAt, ttl time.Duration) (reqId string, err error) {
+	up, err := self.Client.Stat(uploadId)
+	if err != nil {
+		return
+	}
+	err = self.Client.send(up, blob)
+	if err != nil {
+		return
+	}
+	reqId, err = self.forward(service, receiver, msg, uploadId, up.Size, up.ContentType, ttl)
+	return
+}
+
+func (self *Composer) forward(service, receiver string, msg *proto.Message, id string, size int64, contentType string, ttl time.Duration) (reqId string, err error) {
+	if msg == nil {
+		msg = new(proto.Message)
+	}
+	if msg.Header == nil {
+		msg.Header = make(map[string]string, 3)
+	}
+	msg.Header[HEADER_MEDIA_ID] = id
+	msg.Header[HEADER_MEDIA_SIZE] = strconv.FormatInt(size, 10)
+	if len(contentType) > 0 {
+		msg.Header[HEADER_MEDIA_TYPE] = contentType
+	}
+	return self.Conn.RequestForward(service, receiver, msg, ttl)
+}
+
+// Reference returns the blob referenced by a message sent by a
+// Composer. ok is false if it references none.
+func Reference(msg *proto.Message) (id string, size int64, contentType string, ok bool) {
+	if msg == nil || msg.Header == nil {
+		return
+	}
+	id = msg.Header[HEADER_MEDIA_ID]
+	if !validId(id) {
+		id = ""
+		return
+	}
+	size, _ = strconv.ParseInt(msg.Header[HEADER_MEDIA_SIZE], 10, 64)
+	contentType = msg.Header[HEADER_MEDIA_TYPE]
+	ok = true
+	return
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package media
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type dirStore struct {
+	dir string
+
+	// Serializes the writes, which are rare compared to the reads
+	// of the blobs.
+	lock sync.Mutex
+
+	// The bytes of the uploads of every user, by service and
+	// username. Protected by lock.
+	usage map[string]int64
+}
+
+// NewDirStore keeps every upload in two files of the directory: its
+// content, and its description in JSON. The usage of every user is
+// read from the directory at first, and then kept in memory, so that
+// the directory should not be shared by several stores.
+func NewDirStore(dir string) (store Store, err error) {
+	err = os.MkdirAll(dir, 0750)
+	if err != nil {
+		return
+	}
+	ret := &dirStore{dir: dir, usage: make(map[string]int64, 16)}
+	err = ret.Walk(func(up *Upload) bool {
+		ret.usage[usageKey(up.Service, up.Username)] += up.Size
+		return true
+	})
+	if err != nil {
+		return
+	}
+	store = ret
+	return
+}
+
+func usageKey(service, username string) string {
+	return service + "\x00" + username
+}
+
+func (self *dirStore) dataFile(id string) string {
+	return filepath.Join(self.dir, id+".data")
+}
+
+func (self *dirStore) metaFile(id string) string {
+	return filepath.Join(self.dir, id+".json")
+}
+
+// save should be called with the lock held.
+func (self *dirStore) save(up *Upload) error {
+	data, err := json.Marshal(up)
+	if err != nil {
+		return err
+	}
+	tmp := self.metaFile(up.Id) + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0640)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, self.metaFile(up.Id))
+}
+
+func (self *dirStore) Create(service, username string, size int64, contentType string) (up *Upload, err error) {
+	id, err := newId()
+	if err != nil {
+		return
+	}
+	ret := &Upload{
+		Id:          id,
+		Service:     service,
+		Username:    username,
+		Size:        size,
+		ContentType: contentType,
+		Created:     time.Now(),
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	f, err := os.OpenFile(self.dataFile(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return
+	}
+	f.Close()
+	err = self.save(ret)
+	if err != nil {
+		os.Remove(self.dataFile(id))
+		return
+	}
+	self.usage[usageKey(service, username)] += size
+	up = ret
+	return
+}
+
+func (self *dirStore) Stat(id string) (up *Upload, err error) {
+	if !validId(id) {
+		err = ErrNotFound
+		return
+	}
+	data, err := ioutil.ReadFile(self.metaFile(id))
+	if os.IsNotExist(err) {
+		err = ErrNotFound
+		return
+	}
+	if err != nil {
+		return
+	}
+	ret := new(Upload)
+	err = json.Unmarshal(data, ret)
+	if err != nil {
+		return
+	}
+	up = ret
+	return
+}
+
+func (self *dirStore) Write(id string, offset int64, data []byte) (newOffset int64, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	up, err := self.Stat(id)
+	if err != nil {
+		return
+	}
+	newOffset = up.Offset
+	if offset != up.Offset {
+		err = ErrBadOffset
+		return
+	}
+	if offset+int64(len(data)) > up.Size {
+		err = ErrTooLarge
+		return
+	}
+	f, err := os.OpenFile(self.dataFile(id), os.O_WRONLY, 0640)
+	if err != nil {
+		return
+	}
+	// Whatever a failed write has left after the offset is overwritten.
+	_, err = f.WriteAt(data, offset)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	up.Offset += int64(len(data))
+	err = self.save(up)
+	if err != nil {
+		return
+	}
+	newOffset = up.Offset
+	return
+}
+
+func (self *dirStore) Open(id string) (blob Blob, up *Upload, err error) {
+	up, err = self.Stat(id)
+	if err != nil {
+		return
+	}
+	if !up.Complete() {
+		err = ErrIncomplete
+		up = nil
+		return
+	}
+	f, err := os.Open(self.dataFile(id))
+	if err != nil {
+		up = nil
+		return
+	}
+	// The file may be longer after a failed write.
+	blob = &limitedFile{io.NewSectionReader(f, 0, up.Size), f}
+	return
+}
+
+type limitedFile struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (self *limitedFile) Close() error {
+	return self.f.Close()
+}
+
+func (self *dirStore) Remove(id string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	up, err := self.Stat(id)
+	if err != nil {
+		return err
+	}
+	// Without its description, the upload is gone even if its
+	// content is left.
+	err = os.Remove(self.metaFile(id))
+	if err != nil {
+		return err
+	}
+	os.Remove(self.dataFile(id))
+	key := usageKey(up.Service, up.Username)
+	self.usage[key] -= up.Size
+	if self.usage[key] <= 0 {
+		delete(self.usage, key)
+	}
+	return nil
+}
+
+func (self *dirStore) Walk(fn func(up *Upload) bool) error {
+	names, err := filepath.Glob(filepath.Join(self.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		up, err := self.Stat(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err == ErrNotFound {
+			// Removed meanwhile, or not an upload.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(up) {
+			break
+		}
+	}
+	return nil
+}
+
+func (self *dirStore) Usage(service, username string) (n int64, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	n = self.usage[usageKey(service, username)]
+	return
+}
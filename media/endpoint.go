@@ -0,0 +1,305 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package media
+
+import (
+	"encoding/json"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The credentials of the user, checked by the Authenticator of the
+// server, are given in these headers of every request.
+const (
+	ServiceHeader  = "X-Uniqush-Service"
+	UsernameHeader = "X-Uniqush-Username"
+	TokenHeader    = "X-Uniqush-Token"
+)
+
+const (
+	DefaultPrefix       = "/media/"
+	DefaultMaxSize      = 100 << 20
+	DefaultMaxChunkSize = 4 << 20
+)
+
+// Endpoint is an http.Handler of the uploads. The endpoints, under the
+// prefix, are:
+//
+//	POST upload.json  size, type    starts an upload
+//	GET  upload.json  id            tells the offset of the upload
+//	PUT  chunk.json   id, offset    appends the body to the upload
+//	GET  blob         id            the content of a complete upload
+//
+// The first three reply the upload as JSON. A chunk whose offset is
+// not the one of the upload is rejected with 409 Conflict, with the
+// upload, so that the client could resume from there. Only the
+// uploader may write to and query an upload, and a blob may be read
+// by any user of the uploader's service.
+type Endpoint struct {
+	Store Store
+	Auth  server.Authenticator
+
+	// Prefix is the path of the endpoints. It defaults to DefaultPrefix.
+	Prefix string
+
+	// MaxSize and MaxChunkSize are in bytes. They default to
+	// DefaultMaxSize and DefaultMaxChunkSize.
+	MaxSize      int64
+	MaxChunkSize int64
+
+	// UserQuota is how many bytes the uploads of a user may take,
+	// see Store.Usage(). An upload exceeding it is rejected with 507
+	// Insufficient Storage. 0 means no limit.
+	UserQuota int64
+
+	Logger logger.Logger
+
+	// Serializes the uploads started under the quota.
+	quotaLock sync.Mutex
+}
+
+func (self *Endpoint) prefix() string {
+	if len(self.Prefix) == 0 {
+		return DefaultPrefix
+	}
+	if !strings.HasSuffix(self.Prefix, "/") {
+		return self.Prefix + "/"
+	}
+	return self.Prefix
+}
+
+func (self *Endpoint) maxSize() int64 {
+	if self.MaxSize > 0 {
+		return self.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+func (self *Endpoint) maxChunkSize() int64 {
+	if self.MaxChunkSize > 0 {
+		return self.MaxChunkSize
+	}
+	return DefaultMaxChunkSize
+}
+
+func (self *Endpoint) logger() logger.Logger {
+	return logger.OrNop(self.Logger).With("gateway", "media")
+}
+
+func (self *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := self.prefix()
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	service, username, ok := self.authenticate(w, r)
+	if !ok {
+		return
+	}
+	switch r.URL.Path[len(prefix):] {
+	case "upload.json":
+		if r.Method == "POST" {
+			self.create(w, r, service, username)
+		} else {
+			self.stat(w, r, service, username)
+		}
+	case "chunk.json":
+		self.write(w, r, service, username)
+	case "blob":
+		self.read(w, r, service)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (self *Endpoint) authenticate(w http.ResponseWriter, r *http.Request) (service, username string, ok bool) {
+	service = r.Header.Get(ServiceHeader)
+	username = r.Header.Get(UsernameHeader)
+	if len(service) == 0 || len(username) == 0 {
+		http.Error(w, "no service or username", http.StatusBadRequest)
+		return
+	}
+	if self.Auth == nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	pass, err := self.Auth.Authenticate(service, username, r.Header.Get(TokenHeader), r.RemoteAddr)
+	if err != nil {
+		self.logger().Warn("cannot authenticate", "service", service, "username", username, "err", err)
+		http.Error(w, "authentication unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if !pass {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	ok = true
+	return
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (self *Endpoint) storeError(w http.ResponseWriter, err error) {
+	if err == ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	self.logger().Error("store error", "err", err)
+	http.Error(w, "store unavailable", http.StatusServiceUnavailable)
+}
+
+func (self *Endpoint) create(w http.ResponseWriter, r *http.Request, service, username string) {
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || size <= 0 {
+		http.Error(w, "bad size", http.StatusBadRequest)
+		return
+	}
+	if size > self.maxSize() {
+		http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	up, err := self.createWithin(service, username, size, r.FormValue("type"))
+	if err == ErrQuotaExceeded {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		self.storeError(w, err)
+		return
+	}
+	self.logger().Debug("upload started", "service", service, "username", username, "id", up.Id, "size", size)
+	writeJson(w, http.StatusCreated, up)
+}
+
+// createWithin starts the upload unless the user would exceed the quota.
+func (self *Endpoint) createWithin(service, username string, size int64, contentType string) (up *Upload, err error) {
+	if self.UserQuota <= 0 {
+		return self.Store.Create(service, username, size, contentType)
+	}
+	self.quotaLock.Lock()
+	defer self.quotaLock.Unlock()
+	used, err := self.Store.Usage(service, username)
+	if err != nil {
+		return
+	}
+	if used+size > self.UserQuota {
+		err = ErrQuotaExceeded
+		return
+	}
+	return self.Store.Create(service, username, size, contentType)
+}
+
+// own returns the upload if it is the user's.
+func (self *Endpoint) own(w http.ResponseWriter, id, service, username string) (up *Upload, ok bool) {
+	up, err := self.Store.Stat(id)
+	if err != nil {
+		self.storeError(w, err)
+		return
+	}
+	if up.Service != service || up.Username != username {
+		http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	ok = true
+	return
+}
+
+func (self *Endpoint) stat(w http.ResponseWriter, r *http.Request, service, username string) {
+	up, ok := self.own(w, r.FormValue("id"), service, username)
+	if !ok {
+		return
+	}
+	writeJson(w, http.StatusOK, up)
+}
+
+func (self *Endpoint) write(w http.ResponseWriter, r *http.Request, service, username string) {
+	if r.Method != "PUT" {
+		http.Error(w, "PUT required", http.StatusMethodNotAllowed)
+		return
+	}
+	// The query is parsed alone, as PUT bodies are parsed as forms.
+	query := r.URL.Query()
+	offset, err := strconv.ParseInt(query.Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "bad offset", http.StatusBadRequest)
+		return
+	}
+	up, ok := self.own(w, query.Get("id"), service, username)
+	if !ok {
+		return
+	}
+	if offset != up.Offset {
+		writeJson(w, http.StatusConflict, up)
+		return
+	}
+	max := self.maxChunkSize()
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		// The client retries from the offset of the upload.
+		return
+	}
+	if int64(len(data)) > max || offset+int64(len(data)) > up.Size {
+		http.Error(w, ErrTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	up.Offset, err = self.Store.Write(up.Id, offset, data)
+	if err == ErrBadOffset {
+		// Another request has written the chunk.
+		writeJson(w, http.StatusConflict, up)
+		return
+	}
+	if err != nil {
+		self.storeError(w, err)
+		return
+	}
+	if up.Complete() {
+		self.logger().Debug("upload complete", "service", service, "username", username, "id", up.Id, "size", up.Size)
+	}
+	writeJson(w, http.StatusOK, up)
+}
+
+func (self *Endpoint) read(w http.ResponseWriter, r *http.Request, service string) {
+	blob, up, err := self.Store.Open(r.FormValue("id"))
+	if err == ErrIncomplete {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		self.storeError(w, err)
+		return
+	}
+	defer blob.Close()
+	if up.Service != service {
+		http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if len(up.ContentType) > 0 {
+		w.Header().Set("Content-Type", up.ContentType)
+	}
+	http.ServeContent(w, r, "", up.Created, blob)
+}
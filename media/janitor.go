@@ -0,0 +1,121 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package media
+
+import (
+	"github.com/uniqush/uniqush-conn/logger"
+	"sync"
+	"time"
+)
+
+// DefaultSweepInterval is how often a Janitor run by Run(0) sweeps
+// the store.
+const DefaultSweepInterval = 10 * time.Minute
+
+// Janitor removes the uploads which are not worth keeping: the
+// incomplete ones which are not resumed in time, and the ones older
+// than their TTL.
+type Janitor struct {
+	store         Store
+	incompleteTTL time.Duration
+	ttl           time.Duration
+	logger        logger.Logger
+	stop          chan bool
+	stopOnce      sync.Once
+}
+
+// NewJanitor removes the incomplete uploads incompleteTTL after they
+// are started, and every upload ttl after it is started. Zero keeps
+// them forever.
+func NewJanitor(store Store, incompleteTTL, ttl time.Duration) *Janitor {
+	ret := new(Janitor)
+	ret.store = store
+	ret.incompleteTTL = incompleteTTL
+	ret.ttl = ttl
+	ret.logger = logger.Nop()
+	ret.stop = make(chan bool)
+	return ret
+}
+
+func (self *Janitor) SetLogger(l logger.Logger) {
+	self.logger = logger.OrNop(l).With("gateway", "media")
+}
+
+func (self *Janitor) expired(up *Upload, now time.Time) bool {
+	age := now.Sub(up.Created)
+	if self.ttl > 0 && age > self.ttl {
+		return true
+	}
+	return self.incompleteTTL > 0 && !up.Complete() && age > self.incompleteTTL
+}
+
+// Sweep removes the uploads expired at now, and returns how many.
+func (self *Janitor) Sweep(now time.Time) (n int, err error) {
+	var ids []string
+	err = self.store.Walk(func(up *Upload) bool {
+		if self.expired(up, now) {
+			ids = append(ids, up.Id)
+		}
+		return true
+	})
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		e := self.store.Remove(id)
+		if e == ErrNotFound {
+			continue
+		}
+		if e != nil {
+			err = e
+			return
+		}
+		n++
+	}
+	return
+}
+
+// Run sweeps the store every interval, or DefaultSweepInterval if
+// interval is not positive, until Stop() is called.
+func (self *Janitor) Run(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case now := <-ticker.C:
+			n, err := self.Sweep(now)
+			if err != nil {
+				self.logger.Error("cannot sweep the uploads", "err", err)
+			}
+			if n > 0 {
+				self.logger.Info("uploads removed", "n", n)
+			}
+		}
+	}
+}
+
+func (self *Janitor) Stop() {
+	self.stopOnce.Do(func() {
+		close(self.stop)
+	})
+}
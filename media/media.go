@@ -0,0 +1,257 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package media uploads the large blobs, e.g. pictures and videos, out
+// of band, so that a message only carries a reference to its blob.
+//
+// The clients upload a blob over HTTP in chunks to an Endpoint, which
+// keeps it in a Store. An interrupted upload is resumed from what the
+// endpoint has received. A Client does so and retries the failed
+// chunks, and a Composer sends a message referencing a blob once it
+// is uploaded.
+package media
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("no such upload")
+var ErrBadOffset = errors.New("the chunk is not at the end of the upload")
+var ErrTooLarge = errors.New("the chunk exceeds the size of the upload")
+var ErrIncomplete = errors.New("the upload is not complete")
+var ErrQuotaExceeded = errors.New("the uploads of the user exceed the quota")
+
+// The headers of a message referencing a blob.
+const (
+	HEADER_MEDIA_ID   = "media.id"
+	HEADER_MEDIA_SIZE = "media.size"
+	HEADER_MEDIA_TYPE = "media.type"
+)
+
+// Upload is a blob being uploaded, or uploaded if Offset is Size.
+type Upload struct {
+	Id          string    `json:"id"`
+	Service     string    `json:"service"`
+	Username    string    `json:"username"`
+	Size        int64     `json:"size"`
+	Offset      int64     `json:"offset"`
+	ContentType string    `json:"type,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+func (self *Upload) Complete() bool {
+	return self.Offset >= self.Size
+}
+
+// Blob is the content of a complete upload.
+type Blob interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Store keeps the uploads. Its methods are called concurrently.
+type Store interface {
+	// Create starts an upload of size bytes.
+	Create(service, username string, size int64, contentType string) (up *Upload, err error)
+
+	// Stat returns ErrNotFound if there is no such upload.
+	Stat(id string) (up *Upload, err error)
+
+	// Write appends data to the upload. offset should be the current
+	// offset of the upload, or the error is ErrBadOffset. It returns
+	// the new offset.
+	Write(id string, offset int64, data []byte) (newOffset int64, err error)
+
+	// Open returns the content of the upload, or ErrIncomplete if
+	// it is not complete.
+	Open(id string) (blob Blob, up *Upload, err error)
+
+	// Remove deletes the upload, complete or not. It returns
+	// ErrNotFound if there is no such upload.
+	Remove(id string) error
+
+	// Walk calls fn with every upload, until fn returns false.
+	Walk(fn func(up *Upload) bool) error
+
+	// Usage returns the bytes taken by the uploads of the user,
+	// counting the incomplete ones at their full size.
+	Usage(service, username string) (n int64, err error)
+}
+
+// newId returns an unguessable id, as the id is what a receiver needs
+// to download the blob.
+func newId() (id string, err error) {
+	var b [16]byte
+	if _, err = io.ReadFull(rand.Reader, b[:]); err != nil {
+		return
+	}
+	id = hex.EncodeToString(b[:])
+	return
+}
+
+// validId tells if the id may have been returned by newId.
+func validId(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+type memUpload struct {
+	up   Upload
+	data []byte
+}
+
+type memStore struct {
+	lock    sync.Mutex
+	uploads map[string]*memUpload
+}
+
+// NewMemoryStore returns a Store which keeps the blobs in memory,
+// where they are lost on restart. It is meant for tests.
+func NewMemoryStore() Store {
+	ret := new(memStore)
+	ret.uploads = make(map[string]*memUpload, 16)
+	return ret
+}
+
+func (self *memStore) Create(service, username string, size int64, contentType string) (up *Upload, err error) {
+	id, err := newId()
+	if err != nil {
+		return
+	}
+	u := &memUpload{up: Upload{
+		Id:          id,
+		Service:     service,
+		Username:    username,
+		Size:        size,
+		ContentType: contentType,
+		Created:     time.Now(),
+	}}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.uploads[id] = u
+	ret := u.up
+	up = &ret
+	return
+}
+
+func (self *memStore) Stat(id string) (up *Upload, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	u, ok := self.uploads[id]
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	ret := u.up
+	up = &ret
+	return
+}
+
+func (self *memStore) Write(id string, offset int64, data []byte) (newOffset int64, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	u, ok := self.uploads[id]
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	newOffset = u.up.Offset
+	if offset != u.up.Offset {
+		err = ErrBadOffset
+		return
+	}
+	if offset+int64(len(data)) > u.up.Size {
+		err = ErrTooLarge
+		return
+	}
+	u.data = append(u.data, data...)
+	u.up.Offset += int64(len(data))
+	newOffset = u.up.Offset
+	return
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (self nopCloser) Close() error {
+	return nil
+}
+
+func (self *memStore) Open(id string) (blob Blob, up *Upload, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	u, ok := self.uploads[id]
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	if !u.up.Complete() {
+		err = ErrIncomplete
+		return
+	}
+	ret := u.up
+	up = &ret
+	blob = nopCloser{bytes.NewReader(u.data)}
+	return
+}
+
+func (self *memStore) Remove(id string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.uploads[id]; !ok {
+		return ErrNotFound
+	}
+	delete(self.uploads, id)
+	return nil
+}
+
+func (self *memStore) Walk(fn func(up *Upload) bool) error {
+	self.lock.Lock()
+	ups := make([]*Upload, 0, len(self.uploads))
+	for _, u := range self.uploads {
+		up := u.up
+		ups = append(ups, &up)
+	}
+	self.lock.Unlock()
+	for _, up := range ups {
+		if !fn(up) {
+			break
+		}
+	}
+	return nil
+}
+
+func (self *memStore) Usage(service, username string) (n int64, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, u := range self.uploads {
+		if u.up.Service == service && u.up.Username == username {
+			n += u.up.Size
+		}
+	}
+	return
+}
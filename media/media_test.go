@@ -0,0 +1,341 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package media
+
+import (
+	"bytes"
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenAuth accepts the users whose token is their name.
+type tokenAuth struct{}
+
+func (self tokenAuth) Authenticate(srv, usr, token, addr string) (bool, error) {
+	return token == usr, nil
+}
+
+func testStore(t *testing.T, store Store) {
+	up, err := store.Create("service", "alice", 5, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validId(up.Id) || up.Offset != 0 || up.Complete() {
+		t.Fatalf("bad upload: %+v", up)
+	}
+	if _, _, err = store.Open(up.Id); err != ErrIncomplete {
+		t.Errorf("opened an incomplete upload: %v", err)
+	}
+	offset, err := store.Write(up.Id, 0, []byte("hel"))
+	if err != nil || offset != 3 {
+		t.Fatalf("offset %v: %v", offset, err)
+	}
+	if offset, err = store.Write(up.Id, 0, []byte("hel")); err != ErrBadOffset || offset != 3 {
+		t.Errorf("wrote at a bad offset: %v %v", offset, err)
+	}
+	if _, err = store.Write(up.Id, 3, []byte("lo!")); err != ErrTooLarge {
+		t.Errorf("wrote past the size: %v", err)
+	}
+	if _, err = store.Write(up.Id, 3, []byte("lo")); err != nil {
+		t.Fatal(err)
+	}
+	st, err := store.Stat(up.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Complete() || st.Username != "alice" || st.ContentType != "text/plain" {
+		t.Errorf("bad upload: %+v", st)
+	}
+	blob, _, err := store.Open(up.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	data, err := ioutil.ReadAll(blob)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("read %q: %v", data, err)
+	}
+	if _, err = store.Stat("0123456789abcdef0123456789abcdef"); err != ErrNotFound {
+		t.Errorf("found a missing upload: %v", err)
+	}
+	if _, err = store.Stat("../etc/passwd"); err != ErrNotFound {
+		t.Errorf("found a bad id: %v", err)
+	}
+}
+
+// testSweep runs a janitor on the store, with an incomplete upload
+// of alice, a complete one of bob, and an old one of bob.
+func testSweep(t *testing.T, store Store) {
+	incomplete, err := store.Create("service", "alice", 5, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete, err := store.Create("service", "bob", 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Write(complete.Id, 0, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := store.Usage("service", "alice"); err != nil || n != 5 {
+		t.Errorf("alice uses %v bytes: %v", n, err)
+	}
+	janitor := NewJanitor(store, time.Hour, 24*time.Hour)
+	if n, err := janitor.Sweep(time.Now()); err != nil || n != 0 {
+		t.Errorf("removed %v uploads: %v", n, err)
+	}
+	if n, err := janitor.Sweep(time.Now().Add(2 * time.Hour)); err != nil || n != 1 {
+		t.Errorf("removed %v uploads: %v", n, err)
+	}
+	if _, err = store.Stat(incomplete.Id); err != ErrNotFound {
+		t.Errorf("the incomplete upload is kept: %v", err)
+	}
+	if n, err := store.Usage("service", "alice"); err != nil || n != 0 {
+		t.Errorf("alice uses %v bytes: %v", n, err)
+	}
+	if _, err = store.Stat(complete.Id); err != nil {
+		t.Errorf("the complete upload is removed: %v", err)
+	}
+	if n, err := janitor.Sweep(time.Now().Add(25 * time.Hour)); err != nil || n != 1 {
+		t.Errorf("removed %v uploads: %v", n, err)
+	}
+	if n, err := store.Usage("service", "bob"); err != nil || n != 0 {
+		t.Errorf("bob uses %v bytes: %v", n, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+	testSweep(t, NewMemoryStore())
+}
+
+func TestDirStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+
+	// The usage is read from the directory again.
+	store, err = NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := store.Usage("service", "alice"); err != nil || n != 5 {
+		t.Errorf("alice uses %v bytes: %v", n, err)
+	}
+
+	sweepDir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sweepDir)
+	store, err = NewDirStore(sweepDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSweep(t, store)
+}
+
+// flakyTransport drops the reply of every other chunk, after the
+// endpoint has received it.
+type flakyTransport struct {
+	lock   sync.Mutex
+	chunks int
+}
+
+func (self *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil || !strings.HasSuffix(req.URL.Path, "chunk.json") {
+		return resp, err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.chunks++
+	if self.chunks%2 == 1 {
+		resp.Body.Close()
+		return nil, errors.New("connection reset")
+	}
+	return resp, nil
+}
+
+func testServer(store Store) *httptest.Server {
+	ep := &Endpoint{Store: store, Auth: tokenAuth{}, MaxChunkSize: 16}
+	return httptest.NewServer(ep)
+}
+
+func testClient(srv *httptest.Server, username string) *Client {
+	c := NewClient(srv.URL+DefaultPrefix, "service", username, username)
+	c.ChunkSize = 10
+	c.Backoff = time.Millisecond
+	return c
+}
+
+func TestUploadDownload(t *testing.T) {
+	srv := testServer(NewMemoryStore())
+	defer srv.Close()
+	blob := []byte("the quick brown fox jumps over the lazy dog")
+
+	alice := testClient(srv, "alice")
+	alice.HTTPClient = &http.Client{Transport: new(flakyTransport)}
+	id, err := alice.Upload(bytes.NewReader(blob), int64(len(blob)), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob := testClient(srv, "bob")
+	r, err := bob.Download(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(data, blob) {
+		t.Errorf("downloaded %q: %v", data, err)
+	}
+
+	// Only the uploader may see how much is uploaded.
+	if _, err = bob.Stat(id); err == nil {
+		t.Errorf("bob can stat alice's upload")
+	}
+	bob.Token = "wrong"
+	if _, err = bob.Download(id); err == nil {
+		t.Errorf("downloaded with a bad token")
+	}
+	other := testClient(srv, "bob")
+	other.Service = "other"
+	if _, err = other.Download(id); err == nil {
+		t.Errorf("downloaded from another service")
+	}
+}
+
+func TestResume(t *testing.T) {
+	store := NewMemoryStore()
+	srv := testServer(store)
+	defer srv.Close()
+	blob := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	// The upload was stopped after a few chunks.
+	up, err := store.Create("service", "alice", int64(len(blob)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Write(up.Id, 0, blob[:13]); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := testClient(srv, "alice")
+	if err = alice.Resume(up.Id, bytes.NewReader(blob)); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := store.Open(up.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(data, blob) {
+		t.Errorf("uploaded %q", data)
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	ep := &Endpoint{Store: NewMemoryStore(), Auth: tokenAuth{}, MaxSize: 10}
+	srv := httptest.NewServer(ep)
+	defer srv.Close()
+	alice := testClient(srv, "alice")
+	_, err := alice.Upload(bytes.NewReader(make([]byte, 11)), 11, "")
+	if serr, ok := err.(*StatusError); !ok || serr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("uploaded too large a blob: %v", err)
+	}
+
+	// The chunks larger than the endpoint accepts are not retried.
+	srv2 := testServer(NewMemoryStore())
+	defer srv2.Close()
+	alice = testClient(srv2, "alice")
+	alice.ChunkSize = 20
+	_, err = alice.Upload(bytes.NewReader(make([]byte, 40)), 40, "")
+	if serr, ok := err.(*StatusError); !ok || serr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("uploaded too large a chunk: %v", err)
+	}
+}
+
+func TestUserQuota(t *testing.T) {
+	ep := &Endpoint{Store: NewMemoryStore(), Auth: tokenAuth{}, UserQuota: 30}
+	srv := httptest.NewServer(ep)
+	defer srv.Close()
+	alice := testClient(srv, "alice")
+	if _, err := alice.Upload(bytes.NewReader(make([]byte, 20)), 20, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err := alice.Upload(bytes.NewReader(make([]byte, 20)), 20, "")
+	if serr, ok := err.(*StatusError); !ok || serr.Code != http.StatusInsufficientStorage {
+		t.Errorf("uploaded past the quota: %v", err)
+	}
+	// The quota is per user.
+	if _, err := testClient(srv, "bob").Upload(bytes.NewReader(make([]byte, 20)), 20, ""); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+}
+
+type forwarder struct {
+	service, receiver string
+	msg               *proto.Message
+}
+
+func (self *forwarder) RequestForward(service, receiver string, msg *proto.Message, ttl time.Duration) (reqId string, err error) {
+	self.service = service
+	self.receiver = receiver
+	self.msg = msg
+	return "req", nil
+}
+
+func TestComposer(t *testing.T) {
+	srv := testServer(NewMemoryStore())
+	defer srv.Close()
+	conn := new(forwarder)
+	composer := NewComposer(testClient(srv, "alice"), conn)
+	blob := []byte("a picture of a cat")
+	msg := &proto.Message{Body: []byte("look")}
+	id, reqId, err := composer.SendMedia("service", "bob", msg, bytes.NewReader(blob), int64(len(blob)), "image/png", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqId != "req" || conn.receiver != "bob" || string(conn.msg.Body) != "look" {
+		t.Errorf("bad forward: %v %+v", reqId, conn)
+	}
+	ref, size, contentType, ok := Reference(conn.msg)
+	if !ok || ref != id || size != int64(len(blob)) || contentType != "image/png" {
+		t.Errorf("bad reference: %v %v %v %v", ref, size, contentType, ok)
+	}
+	if _, _, _, ok = Reference(&proto.Message{Body: []byte("text")}); ok {
+		t.Errorf("a text message references a blob")
+	}
+}
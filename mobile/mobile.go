@@ -0,0 +1,514 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package mobile wraps the client for gomobile bind, so that Android
+// and iOS apps can use it without reimplementing the protocol. Its
+// exported API only uses the types gomobile supports: there are no
+// channels, maps or unsigned integers; the events are delivered to a
+// Listener instead, and lists are comma separated strings.
+package mobile
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrBadPublicKey = errors.New("not a PEM encoded RSA public key")
+var ErrAuthFail = errors.New("authentication failed")
+var ErrStarted = errors.New("the connection is already started")
+
+// Listener receives the events of a connection. Its methods are called
+// from one goroutine, in the order of the events.
+type Listener interface {
+	OnMessage(msg *Message)
+	OnDigest(digest *Digest)
+
+	// OnForwardResult tells the result of RequestForward. status is
+	// one of the FWD_* constants of the proto package.
+	OnForwardResult(reqId, status, msgId string)
+
+	// OnClosed is called once, with the error which closed the
+	// connection, or nil if it was closed by Close.
+	OnClosed(err error)
+}
+
+// CheckpointListener may be implemented by a Listener to receive the
+// checkpoints of the replays of the cached messages. A replay which is
+// interrupted may be resumed by ResumeCachedMessages with the last one.
+type CheckpointListener interface {
+	OnCheckpoint(seq int64, done bool)
+}
+
+// MultiForwardListener may be implemented by a Listener to receive
+// the result of RequestMultiForward for each receiver. Otherwise they
+// are told to OnForwardResult.
+type MultiForwardListener interface {
+	OnMultiForwardResult(reqId, receiver, status, msgId string)
+}
+
+// EditListener may be implemented by a Listener to receive the edits
+// and the recalls of the messages forwarded to the user.
+type EditListener interface {
+	// OnEdit tells the new message, whose Id is the one it replaces.
+	OnEdit(msg *Message)
+	OnRecall(sender, senderService, msgId string)
+}
+
+// Message is a message received, or to be sent.
+type Message struct {
+	Id            string
+	Sender        string
+	SenderService string
+	Seq           int64
+
+	// SenderConn is the connection of the sender to which the
+	// replies are routed, if the sender asked for it. See Reply.
+	SenderConn string
+
+	// ExpiresAt is when the message expires, in seconds since the
+	// epoch by the clock of the device, or 0 if it never expires.
+	ExpiresAt int64
+
+	msg *proto.Message
+}
+
+func NewMessage() *Message {
+	return &Message{msg: new(proto.Message)}
+}
+
+func newMessage(mc *proto.MessageContainer) *Message {
+	ret := &Message{
+		Id:            mc.Id,
+		Sender:        mc.Sender,
+		SenderService: mc.SenderService,
+		Seq:           int64(mc.Seq),
+		SenderConn:    mc.SenderConn,
+		msg:           mc.Message,
+	}
+	if mc.ExpiresAt > 0 {
+		ret.ExpiresAt = (mc.ExpiresAt + int64(time.Second) - 1) / int64(time.Second)
+	}
+	if ret.msg == nil {
+		ret.msg = new(proto.Message)
+	}
+	return ret
+}
+
+func (self *Message) Body() []byte {
+	return self.msg.Body
+}
+
+func (self *Message) SetBody(body []byte) {
+	self.msg.Body = body
+}
+
+// Header returns the value of the header, or an empty string.
+func (self *Message) Header(key string) string {
+	return self.msg.Header[key]
+}
+
+func (self *Message) SetHeader(key, value string) {
+	if self.msg.Header == nil {
+		self.msg.Header = make(map[string]string, 4)
+	}
+	self.msg.Header[key] = value
+}
+
+// HeaderKeys returns the sorted keys of the headers, separated by commas.
+func (self *Message) HeaderKeys() string {
+	return joinKeys(self.msg.Header)
+}
+
+// ThreadId is the conversation of the message, or an empty string.
+func (self *Message) ThreadId() string {
+	return self.msg.ThreadId
+}
+
+func (self *Message) SetThreadId(threadId string) {
+	self.msg.ThreadId = threadId
+}
+
+// IsHeadersOnly tells if the body was stripped by the server.
+func (self *Message) IsHeadersOnly() bool {
+	return self.msg.IsHeadersOnly()
+}
+
+func joinKeys(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// Digest tells a message which is not pushed, because it is too large.
+// Retrieve it with Conn.RequestMessage.
+type Digest struct {
+	MsgId         string
+	Sender        string
+	SenderService string
+	Size          int
+	Seq           int64
+	ThreadId      string
+
+	info map[string]string
+}
+
+// Info returns the value of a digest field, or an empty string.
+func (self *Digest) Info(key string) string {
+	return self.info[key]
+}
+
+// InfoKeys returns the sorted digest fields, separated by commas.
+func (self *Digest) InfoKeys() string {
+	return joinKeys(self.info)
+}
+
+// Params are the parameters of a subscription.
+type Params struct {
+	params map[string]string
+}
+
+func NewParams() *Params {
+	return &Params{params: make(map[string]string, 4)}
+}
+
+func (self *Params) Set(key, value string) {
+	self.params[key] = value
+}
+
+// parsePublicKey reads a PEM encoded PKIX RSA public key.
+func parsePublicKey(pemData string) (pub *rsa.PublicKey, err error) {
+	b, _ := pem.Decode([]byte(pemData))
+	if b == nil {
+		err = ErrBadPublicKey
+		return
+	}
+	key, err := x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		return
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		err = ErrBadPublicKey
+	}
+	return
+}
+
+// Conn is a connection to the server. Call Start to receive from it.
+type Conn struct {
+	conn client.Conn
+
+	lock    sync.Mutex
+	started bool
+	closed  bool
+}
+
+// Dial connects to the server at addr, whose public key is pubKeyPEM,
+// and authenticates the user. timeoutMillis bounds the handshake.
+func Dial(addr, pubKeyPEM, service, username, token string, timeoutMillis int64) (conn *Conn, err error) {
+	pub, err := parsePublicKey(pubKeyPEM)
+	if err != nil {
+		return
+	}
+	timeout := time.Duration(timeoutMillis) * time.Millisecond
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return
+	}
+	cc, err := client.Dial(c, pub, service, username, token, timeout)
+	if err == nil && cc == nil {
+		err = ErrAuthFail
+	}
+	if err != nil {
+		c.Close()
+		return
+	}
+	conn = newConn(cc)
+	return
+}
+
+func newConn(c client.Conn) *Conn {
+	return &Conn{conn: c}
+}
+
+func (self *Conn) Service() string {
+	return self.conn.Service()
+}
+
+func (self *Conn) Username() string {
+	return self.conn.Username()
+}
+
+func (self *Conn) ConnId() string {
+	return self.conn.ConnId()
+}
+
+// Start receives the messages, digests and forward results in a
+// goroutine, and gives them to l until the connection is closed.
+func (self *Conn) Start(l Listener) error {
+	self.lock.Lock()
+	if self.started {
+		self.lock.Unlock()
+		return ErrStarted
+	}
+	self.started = true
+	self.lock.Unlock()
+
+	// The events are queued, so that the receiving goroutine does not
+	// wait for the listener, and delivered by a single goroutine.
+	events := make(chan func(), 64)
+	digests := make(chan *client.Digest)
+	results := make(chan *client.ForwardResult)
+	self.conn.SetDigestChannel(digests)
+	self.conn.SetForwardResultChannel(results)
+	var edits chan *client.Edit
+	el, ok := l.(EditListener)
+	if ok {
+		edits = make(chan *client.Edit)
+		self.conn.SetEditChannel(edits)
+	}
+	if cl, ok := l.(CheckpointListener); ok {
+		// Called by ReceiveMessage(), like the messages are queued.
+		self.conn.SetCheckpointHandler(func(seq uint64, done bool) {
+			events <- func() {
+				cl.OnCheckpoint(int64(seq), done)
+			}
+		})
+	}
+	quit := make(chan bool)
+	forwarded := make(chan bool)
+	go func() {
+		defer close(forwarded)
+		for {
+			select {
+			case d := <-digests:
+				events <- func() {
+					l.OnDigest(&Digest{
+						MsgId:         d.MsgId,
+						Sender:        d.Sender,
+						SenderService: d.SenderService,
+						Size:          d.Size,
+						Seq:           int64(d.Seq),
+						ThreadId:      d.ThreadId,
+						info:          d.Info,
+					})
+				}
+			case r := <-results:
+				events <- func() {
+					if ml, ok := l.(MultiForwardListener); ok && len(r.Receiver) > 0 {
+						ml.OnMultiForwardResult(r.RequestId, r.Receiver, r.Status, r.MsgId)
+						return
+					}
+					l.OnForwardResult(r.RequestId, r.Status, r.MsgId)
+				}
+			case e := <-edits:
+				events <- func() {
+					if e.Recalled() {
+						el.OnRecall(e.Sender, e.SenderService, e.Id)
+						return
+					}
+					el.OnEdit(newMessage(&proto.MessageContainer{
+						Id:            e.Id,
+						Sender:        e.Sender,
+						SenderService: e.SenderService,
+						Message:       e.Message,
+					}))
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	go func() {
+		for ev := range events {
+			ev()
+		}
+	}()
+	go func() {
+		for {
+			mc, err := self.conn.ReceiveMessage()
+			if err != nil {
+				close(quit)
+				<-forwarded
+				self.lock.Lock()
+				if self.closed {
+					err = nil
+				}
+				self.lock.Unlock()
+				events <- func() {
+					l.OnClosed(err)
+				}
+				close(events)
+				return
+			}
+			if mc == nil {
+				continue
+			}
+			events <- func() {
+				l.OnMessage(newMessage(mc))
+			}
+		}
+	}()
+	return nil
+}
+
+func (self *Conn) Close() error {
+	self.lock.Lock()
+	self.closed = true
+	self.lock.Unlock()
+	return self.conn.Close()
+}
+
+func ttl(seconds int64) time.Duration {
+	return time.Duration(seconds) * time.Second
+}
+
+// SendMessageToUser forwards the message to the receiver. A ttlSeconds
+// of 0 lets the server decide.
+func (self *Conn) SendMessageToUser(service, receiver string, msg *Message, ttlSeconds int64) error {
+	return self.conn.SendMessageToUser(service, receiver, msg.msg, ttl(ttlSeconds))
+}
+
+// RequestForward is like SendMessageToUser, but the result is told to
+// Listener.OnForwardResult with the returned request id.
+func (self *Conn) RequestForward(service, receiver string, msg *Message, ttlSeconds int64) (string, error) {
+	return self.conn.RequestForward(service, receiver, msg.msg, ttl(ttlSeconds))
+}
+
+// RequestMultiForward is like RequestForward, but sends the message
+// once to the comma separated receivers of the service.
+func (self *Conn) RequestMultiForward(service, receivers string, msg *Message, ttlSeconds int64) (string, error) {
+	return self.conn.RequestMultiForward(service, splitList(receivers), msg.msg, ttl(ttlSeconds), "")
+}
+
+// RequestForwardAt is like RequestForward, but the message is
+// delivered at atUnix, in seconds since the Unix epoch.
+func (self *Conn) RequestForwardAt(service, receiver string, msg *Message, ttlSeconds, atUnix int64) (string, error) {
+	return self.conn.RequestForwardAt(service, receiver, msg.msg, ttl(ttlSeconds), time.Unix(atUnix, 0))
+}
+
+// RequestStickyForward is like RequestForward, but the replies of
+// the receiver are only delivered to this connection.
+func (self *Conn) RequestStickyForward(service, receiver string, msg *Message, ttlSeconds int64) (string, error) {
+	return self.conn.RequestStickyForward(service, receiver, msg.msg, ttl(ttlSeconds))
+}
+
+// Reply forwards msg to the sender of to, like RequestForward. It is
+// only delivered to the connection which sent to if the sender asked
+// for it.
+func (self *Conn) Reply(to *Message, msg *Message, ttlSeconds int64) (string, error) {
+	mc := &proto.MessageContainer{
+		Sender:        to.Sender,
+		SenderService: to.SenderService,
+		SenderConn:    to.SenderConn,
+	}
+	return self.conn.Reply(mc, msg.msg, ttl(ttlSeconds))
+}
+
+// EditMessage replaces the message whose id was told to
+// Listener.OnForwardResult. The result is told there too.
+func (self *Conn) EditMessage(service, receiver, msgId string, msg *Message) (string, error) {
+	return self.conn.EditMessage(service, receiver, msgId, msg.msg)
+}
+
+// RecallMessage deletes the message for everyone, like EditMessage.
+func (self *Conn) RecallMessage(service, receiver, msgId string) (string, error) {
+	return self.conn.RecallMessage(service, receiver, msgId)
+}
+
+// SendSignal forwards an ephemeral message, like a typing indicator,
+// which is dropped if the receiver is offline.
+func (self *Conn) SendSignal(service, receiver string, msg *Message) error {
+	return self.conn.SendSignal(service, receiver, msg.msg)
+}
+
+func (self *Conn) SendMessageToServer(msg *Message) error {
+	return self.conn.SendMessageToServer(msg.msg)
+}
+
+func splitList(list string) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	ret := strings.Split(list, ",")
+	for i, s := range ret {
+		ret[i] = strings.TrimSpace(s)
+	}
+	return ret
+}
+
+// Config sets the thresholds and the comma separated digest fields.
+func (self *Conn) Config(digestThreshold, compressThreshold int, digestFields string) error {
+	return self.conn.Config(digestThreshold, compressThreshold, splitList(digestFields)...)
+}
+
+// RequestMessage retrieves the cached messages of the comma separated ids.
+func (self *Conn) RequestMessage(ids string) error {
+	return self.conn.RequestMessage(splitList(ids)...)
+}
+
+// RequestAllCachedMessages retrieves the cached messages, except the
+// comma separated ids.
+func (self *Conn) RequestAllCachedMessages(excludes string) error {
+	return self.conn.RequestAllCachedMessages(splitList(excludes)...)
+}
+
+// ResumeCachedMessages is like RequestAllCachedMessages, but only
+// retrieves the messages after the checkpoint.
+func (self *Conn) ResumeCachedMessages(after int64, excludes string) error {
+	return self.conn.ResumeCachedMessages(uint64(after), splitList(excludes)...)
+}
+
+func (self *Conn) RequestMessagesBySeq(from, to int64) error {
+	return self.conn.RequestMessagesBySeq(uint64(from), uint64(to))
+}
+
+// RequestThread retrieves the cached messages of a conversation.
+func (self *Conn) RequestThread(threadId string) error {
+	return self.conn.RequestThread(threadId)
+}
+
+func (self *Conn) SetVisibility(v bool) error {
+	return self.conn.SetVisibility(v)
+}
+
+func (self *Conn) Subscribe(params *Params) error {
+	return self.conn.Subscribe(params.params)
+}
+
+func (self *Conn) Unsubscribe(params *Params) error {
+	return self.conn.Unsubscribe(params.params)
+}
+
+func (self *Conn) Ack(id string) error {
+	return self.conn.Ack(id)
+}
+
+func (self *Conn) MarkRead(id string) error {
+	return self.conn.MarkRead(id)
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package mobile
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/testsupport"
+	"testing"
+	"time"
+)
+
+type chanListener struct {
+	msgs   chan *Message
+	closed chan error
+}
+
+func (self *chanListener) OnMessage(msg *Message) {
+	self.msgs <- msg
+}
+
+func (self *chanListener) OnDigest(digest *Digest) {
+}
+
+func (self *chanListener) OnForwardResult(reqId, status, msgId string) {
+}
+
+func (self *chanListener) OnClosed(err error) {
+	self.closed <- err
+}
+
+func TestListener(t *testing.T) {
+	auth := testsupport.NewFakeAuth()
+	auth.Allow("service", "user", "token")
+	servConn, cliConn, err := testsupport.Pipe(auth, "service", "user", "token")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	conn := newConn(cliConn)
+	l := &chanListener{make(chan *Message, 1), make(chan error, 1)}
+	if err := conn.Start(l); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := conn.Start(l); err != ErrStarted {
+		t.Errorf("should be ErrStarted: %v", err)
+	}
+
+	msg := &proto.Message{
+		Header: map[string]string{"title": "hello", "from": "server"},
+		Body:   []byte("world"),
+	}
+	go servConn.SendMessage(msg, "1", nil)
+	select {
+	case m := <-l.msgs:
+		if m.Id != "1" || m.Header("title") != "hello" || string(m.Body()) != "world" {
+			t.Errorf("bad message: %+v", m)
+		}
+		if m.HeaderKeys() != "from,title" {
+			t.Errorf("bad header keys: %q", m.HeaderKeys())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no message")
+	}
+
+	conn.Close()
+	select {
+	case err := <-l.closed:
+		if err != nil {
+			t.Errorf("closed with error: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("OnClosed is not called")
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	der, err := x509.MarshalPKIXPublicKey(&testsupport.Key().PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	pub, err := parsePublicKey(string(data))
+	if err != nil || pub.N.Cmp(testsupport.Key().N) != 0 {
+		t.Errorf("bad key: %v", err)
+	}
+	if _, err := parsePublicKey("not a key"); err != ErrBadPublicKey {
+		t.Errorf("should be ErrBadPublicKey: %v", err)
+	}
+}
@@ -0,0 +1,545 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package mqtt is an MQTT 3.1.1 front-end to a uniqush-conn server, so
+// that off-the-shelf devices may connect to a service.
+//
+// Every MQTT session is a connection of the gateway to the server, on
+// behalf of the device. The MQTT username is the service and the
+// username, separated by ':', and the password is the token
+// authenticating the user. The username may be alone if the gateway
+// has a default service.
+//
+// The topics are:
+//
+//	inbox                              the messages to the user, without their headers
+//	inbox/json                         the messages to the user, as JSON Messages
+//	server                             a message to the server
+//	server/json                        the same, as a JSON Message
+//	forward/<service>/<username>       a message to another user
+//	forward/<service>/<username>/json  the same, as a JSON Message
+//
+// A device subscribes to inbox or inbox/json, with QoS 0 or 1, and
+// publishes to the others. A cached message published with QoS 1 is
+// acked to the server once the device acks it, and with QoS 0 once it
+// is written. The messages cached while the device was away are
+// retrieved when it connects. Messages arriving before the first
+// subscription wait for it, up to a limit. QoS 2 is not supported.
+package mqtt
+
+import (
+	"bufio"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/listener"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TOPIC_INBOX      = "inbox"
+	TOPIC_INBOX_JSON = "inbox/json"
+	TOPIC_SERVER     = "server"
+	TOPIC_FORWARD    = "forward"
+	JSON_SUFFIX      = "/json"
+)
+
+const (
+	DefaultTimeout    = 10 * time.Second
+	DefaultForwardTTL = 24 * time.Hour
+	DefaultMaxPacket  = 256 * 1024
+	maxPending        = 128
+	maxInflight       = 1024
+)
+
+var (
+	ErrGatewayClosed  = errors.New("mqtt gateway closed")
+	ErrQoS2           = errors.New("mqtt: QoS 2 is not supported")
+	ErrTooManyUnacked = errors.New("mqtt: too many unacked messages")
+)
+
+// Message is the payload of the JSON topics.
+type Message struct {
+	Id            string            `json:"id,omitempty"`
+	Sender        string            `json:"sender,omitempty"`
+	SenderService string            `json:"senderService,omitempty"`
+	Header        map[string]string `json:"header,omitempty"`
+	Body          []byte            `json:"body,omitempty"`
+}
+
+// Gateway accepts MQTT connections and relays them to the server.
+type Gateway struct {
+	// ServerAddr is the host:port of the server's TCP listener.
+	ServerAddr string
+	PublicKey  *rsa.PublicKey
+
+	// DefaultService is the service of the MQTT usernames without one.
+	DefaultService string
+
+	// Timeout bounds the MQTT CONNECT and the connection to the
+	// server. It defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// ForwardTTL is the TTL of the forwarded messages. It defaults
+	// to DefaultForwardTTL.
+	ForwardTTL time.Duration
+
+	// MaxPacket is the largest MQTT packet accepted. It defaults to
+	// DefaultMaxPacket.
+	MaxPacket int
+
+	// TLSConfig, if not nil, makes Serve accept MQTT over TLS.
+	TLSConfig *tls.Config
+
+	// ProxyProtocol sends the address of each device to the server
+	// in a PROXY protocol header, so that the tokens are bound to the
+	// network of the device rather than the one of the gateway. The
+	// listener of the server should then expect the PROXY protocol.
+	// The tokens are bound to the client id of the device anyway.
+	ProxyProtocol bool
+
+	Logger logger.Logger
+
+	lock   sync.Mutex
+	ln     net.Listener
+	closed bool
+}
+
+func (self *Gateway) timeout() time.Duration {
+	if self.Timeout > 0 {
+		return self.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (self *Gateway) logger() logger.Logger {
+	return logger.OrNop(self.Logger).With("gateway", "mqtt")
+}
+
+// Serve accepts connections on ln until Close is called. They are
+// TLS connections if TLSConfig is set.
+func (self *Gateway) Serve(ln net.Listener) error {
+	if self.TLSConfig != nil {
+		ln = tls.NewListener(ln, self.TLSConfig)
+	}
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return ErrGatewayClosed
+	}
+	self.ln = ln
+	self.lock.Unlock()
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			self.lock.Lock()
+			closed := self.closed
+			self.lock.Unlock()
+			if closed {
+				return ErrGatewayClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > time.Second {
+					backoff = time.Second
+				}
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+		go self.serve(conn)
+	}
+}
+
+// Close stops accepting connections. The sessions are left open.
+func (self *Gateway) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	if self.ln != nil {
+		return self.ln.Close()
+	}
+	return nil
+}
+
+func (self *Gateway) serve(conn net.Conn) {
+	defer conn.Close()
+	maxPacket := self.MaxPacket
+	if maxPacket <= 0 {
+		maxPacket = DefaultMaxPacket
+	}
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	conn.SetDeadline(time.Now().Add(self.timeout()))
+	p, err := readPacket(r, maxPacket)
+	if err != nil || p.Type != CONNECT {
+		return
+	}
+	l := self.logger().With("clientId", p.ClientId, "addr", conn.RemoteAddr().String())
+	s, code := self.connect(p, conn.RemoteAddr(), l)
+	writePacket(w, &packet{Type: CONNACK, ReturnCode: code})
+	if w.Flush() != nil || s == nil {
+		if s != nil {
+			s.upstream.Close()
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.conn = conn
+	s.r = r
+	s.w = w
+	s.maxPacket = maxPacket
+	s.keepAlive = time.Duration(p.KeepAlive) * time.Second
+	s.run()
+}
+
+func (self *Gateway) connect(p *packet, addr net.Addr, l logger.Logger) (s *session, code byte) {
+	if p.ProtocolName != "MQTT" || p.ProtocolLevel != 4 {
+		code = CONNACK_BAD_PROTOCOL
+		return
+	}
+	service, username := self.DefaultService, p.Username
+	if i := strings.IndexByte(p.Username, ':'); i >= 0 {
+		service, username = p.Username[:i], p.Username[i+1:]
+	}
+	if len(service) == 0 || len(username) == 0 {
+		code = CONNACK_BAD_CREDENTIALS
+		return
+	}
+	c, err := net.DialTimeout("tcp", self.ServerAddr, self.timeout())
+	if err != nil {
+		l.Warn("cannot connect to the server", "err", err)
+		code = CONNACK_UNAVAILABLE
+		return
+	}
+	if self.ProxyProtocol {
+		c.SetWriteDeadline(time.Now().Add(self.timeout()))
+		if err = listener.WriteProxyHeader(c, addr, c.RemoteAddr()); err != nil {
+			c.Close()
+			l.Warn("cannot connect to the server", "err", err)
+			code = CONNACK_UNAVAILABLE
+			return
+		}
+	}
+	opts := &client.DialOptions{Device: p.ClientId}
+	upstream, err := client.DialWithOptions(c, self.PublicKey, service, username, string(p.Password), self.timeout(), opts)
+	if upstream == nil {
+		if err == proto.ErrBadServer || err == proto.ErrUnknownServerKey {
+			l.Warn("cannot connect to the server", "err", err)
+			code = CONNACK_UNAVAILABLE
+			return
+		}
+		l.Debug("authentication failed", "service", service, "username", username, "err", err)
+		code = CONNACK_BAD_CREDENTIALS
+		return
+	}
+	ttl := self.ForwardTTL
+	if ttl <= 0 {
+		ttl = DefaultForwardTTL
+	}
+	s = &session{
+		upstream: upstream,
+		ttl:      ttl,
+		logger:   l.With("service", service, "username", username, "connId", upstream.ConnId()),
+		subs:     make(map[string]byte, 2),
+		inflight: make(map[uint16]string, 16),
+	}
+	return
+}
+
+// session relays one MQTT connection.
+type session struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	maxPacket int
+	keepAlive time.Duration
+	upstream  client.Conn
+	ttl       time.Duration
+	logger    logger.Logger
+
+	lock       sync.Mutex
+	w          *bufio.Writer
+	subs       map[string]byte
+	subscribed bool
+	pending    []*proto.MessageContainer
+	inflight   map[uint16]string
+	nextId     uint16
+}
+
+func (self *session) write(p *packet) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.writeLocked(p)
+}
+
+func (self *session) writeLocked(p *packet) error {
+	err := writePacket(self.w, p)
+	if err == nil {
+		err = self.w.Flush()
+	}
+	return err
+}
+
+func (self *session) run() {
+	digests := make(chan *client.Digest, 16)
+	self.upstream.SetDigestChannel(digests)
+	// Devices cannot retrieve messages, so they never get digests.
+	self.upstream.Config(-1, 0)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case d := <-digests:
+				self.upstream.RequestMessage(d.MsgId)
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer self.conn.Close()
+		for {
+			mc, err := self.upstream.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			if err = self.deliver(mc); err != nil {
+				return
+			}
+		}
+	}()
+	defer self.upstream.Close()
+	err := self.upstream.RequestAllCachedMessages()
+	if err == nil {
+		err = self.readLoop()
+	}
+	if err != nil {
+		self.logger.Debug("mqtt session closed", "err", err)
+	}
+}
+
+func (self *session) readLoop() error {
+	for {
+		if self.keepAlive > 0 {
+			self.conn.SetReadDeadline(time.Now().Add(self.keepAlive * 3 / 2))
+		}
+		p, err := readPacket(self.r, self.maxPacket)
+		if err != nil {
+			return err
+		}
+		switch p.Type {
+		case PUBLISH:
+			err = self.publish(p)
+		case PUBACK:
+			self.lock.Lock()
+			id, ok := self.inflight[p.PacketId]
+			delete(self.inflight, p.PacketId)
+			self.lock.Unlock()
+			if ok && len(id) > 0 {
+				err = self.upstream.Ack(id)
+			}
+		case SUBSCRIBE:
+			err = self.subscribe(p)
+		case UNSUBSCRIBE:
+			self.lock.Lock()
+			for _, t := range p.Topics {
+				delete(self.subs, t)
+			}
+			err = self.writeLocked(&packet{Type: UNSUBACK, PacketId: p.PacketId})
+			self.lock.Unlock()
+		case PINGREQ:
+			err = self.write(&packet{Type: PINGRESP})
+		case DISCONNECT:
+			return nil
+		default:
+			err = fmt.Errorf("mqtt: unexpected packet %v", p.Type)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func parseMessage(payload []byte, asJson bool) (msg *proto.Message, err error) {
+	if !asJson {
+		msg = &proto.Message{Body: payload}
+		return
+	}
+	m := new(Message)
+	err = json.Unmarshal(payload, m)
+	if err != nil {
+		return
+	}
+	msg = &proto.Message{Header: m.Header, Body: m.Body}
+	return
+}
+
+func (self *session) publish(p *packet) (err error) {
+	if p.qos() > 1 {
+		return ErrQoS2
+	}
+	topic := p.Topic
+	asJson := strings.HasSuffix(topic, JSON_SUFFIX)
+	if asJson {
+		topic = topic[:len(topic)-len(JSON_SUFFIX)]
+	}
+	msg, err := parseMessage(p.Payload, asJson)
+	if err != nil {
+		self.logger.Warn("bad message", "topic", p.Topic, "err", err)
+	} else if msg.IsEmpty() {
+		self.logger.Warn("empty message", "topic", p.Topic)
+	} else if topic == TOPIC_SERVER {
+		err = self.upstream.SendMessageToServer(msg)
+	} else if f := strings.Split(topic, "/"); len(f) == 3 && f[0] == TOPIC_FORWARD && len(f[1]) > 0 && len(f[2]) > 0 {
+		err = self.upstream.SendMessageToUser(f[1], f[2], msg, self.ttl)
+	} else {
+		self.logger.Warn("unknown topic", "topic", p.Topic)
+	}
+	if err != nil {
+		// The upstream connection is broken.
+		return err
+	}
+	if p.qos() == 1 {
+		err = self.write(&packet{Type: PUBACK, PacketId: p.PacketId})
+	}
+	return
+}
+
+func isInbox(topic string) bool {
+	return topic == TOPIC_INBOX || topic == TOPIC_INBOX_JSON
+}
+
+func (self *session) subscribe(p *packet) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	codes := make([]byte, len(p.Topics))
+	for i, t := range p.Topics {
+		qos := p.QoS[i]
+		if qos > 1 {
+			qos = 1
+		}
+		if !topicMatches(t, TOPIC_INBOX) && !topicMatches(t, TOPIC_INBOX_JSON) {
+			codes[i] = SUBACK_FAILURE
+			continue
+		}
+		self.subs[t] = qos
+		codes[i] = qos
+	}
+	err := self.writeLocked(&packet{Type: SUBACK, PacketId: p.PacketId, QoS: codes})
+	if err != nil || len(self.subs) == 0 || self.subscribed {
+		return err
+	}
+	self.subscribed = true
+	pending := self.pending
+	self.pending = nil
+	for _, mc := range pending {
+		err = self.deliverLocked(mc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *session) deliver(mc *proto.MessageContainer) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.subscribed {
+		if len(self.pending) < maxPending {
+			self.pending = append(self.pending, mc)
+		} else {
+			self.logger.Warn("message dropped before any subscription", "msgId", mc.Id)
+		}
+		return nil
+	}
+	return self.deliverLocked(mc)
+}
+
+// deliverLocked publishes the message on every inbox topic subscribed
+// to, with the highest QoS asked for it.
+func (self *session) deliverLocked(mc *proto.MessageContainer) error {
+	if mc.Message == nil {
+		return nil
+	}
+	if len(self.inflight) >= maxInflight {
+		return ErrTooManyUnacked
+	}
+	var acked bool
+	for _, topic := range []string{TOPIC_INBOX, TOPIC_INBOX_JSON} {
+		qos := -1
+		for filter, q := range self.subs {
+			if topicMatches(filter, topic) && int(q) > qos {
+				qos = int(q)
+			}
+		}
+		if qos < 0 {
+			continue
+		}
+		p := &packet{Type: PUBLISH, Topic: topic, Payload: mc.Message.Body}
+		if topic == TOPIC_INBOX_JSON {
+			m := &Message{Id: mc.Id, Header: mc.Message.Header, Body: mc.Message.Body}
+			if mc.FromUser() {
+				m.Sender = mc.Sender
+				m.SenderService = mc.SenderService
+			}
+			p.Payload, _ = json.Marshal(m)
+		}
+		if qos > 0 {
+			p.Flags = 2
+			p.PacketId = self.packetIdLocked()
+			// The message is acked to the server once, with the first PUBACK.
+			if !acked {
+				self.inflight[p.PacketId] = mc.Id
+				acked = true
+			} else {
+				self.inflight[p.PacketId] = ""
+			}
+		}
+		if err := self.writeLocked(p); err != nil {
+			return err
+		}
+	}
+	if !acked && len(mc.Id) > 0 {
+		return self.upstream.Ack(mc.Id)
+	}
+	return nil
+}
+
+func (self *session) packetIdLocked() uint16 {
+	for {
+		self.nextId++
+		if self.nextId == 0 {
+			continue
+		}
+		if _, ok := self.inflight[self.nextId]; !ok {
+			return self.nextId
+		}
+	}
+}
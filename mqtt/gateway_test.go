@@ -0,0 +1,325 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/uniqush/uniqush-conn/listener"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/testsupport"
+	"net"
+	"testing"
+	"time"
+)
+
+type singleUserAuth struct {
+	service, username, token string
+}
+
+func (self *singleUserAuth) Authenticate(srv, usr, token, addr string) (bool, error) {
+	return self.service == srv && self.username == usr && self.token == token, nil
+}
+
+type testDevice struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func dialDevice(t *testing.T, addr, username, password string) (*testDevice, byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &testDevice{conn, bufio.NewReader(conn), bufio.NewWriter(conn)}
+	d.send(t, &packet{Type: CONNECT, ProtocolName: "MQTT", ProtocolLevel: 4, ConnectFlags: 0xC2,
+		KeepAlive: 30, ClientId: "device", Username: username, Password: []byte(password)})
+	p := d.recv(t)
+	if p.Type != CONNACK {
+		t.Fatalf("got %v instead of CONNACK", p.Type)
+	}
+	return d, p.ReturnCode
+}
+
+func (self *testDevice) send(t *testing.T, p *packet) {
+	if err := writePacket(self.w, p); err != nil {
+		t.Fatal(err)
+	}
+	if err := self.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (self *testDevice) recv(t *testing.T) *packet {
+	self.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	p, err := readPacket(self.r, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func startServer(t *testing.T) (stop func(), addr string, conns chan server.Conn) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns = make(chan server.Conn, 1)
+	srv := &server.Server{
+		PrivateKey: priv,
+		Auth:       &singleUserAuth{"service", "user", "token"},
+		Handler:    server.HandlerFunc(func(conn server.Conn) { conns <- conn }),
+	}
+	go srv.Serve(ln)
+
+	gwln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := &Gateway{
+		ServerAddr:     ln.Addr().String(),
+		PublicKey:      &priv.PublicKey,
+		DefaultService: "service",
+		Timeout:        3 * time.Second,
+	}
+	go gw.Serve(gwln)
+	stop = func() {
+		srv.Close()
+		gw.Close()
+	}
+	addr = gwln.Addr().String()
+	return
+}
+
+func TestGatewayAuth(t *testing.T) {
+	stop, addr, _ := startServer(t)
+	defer stop()
+	d, code := dialDevice(t, addr, "service:user", "wrong")
+	defer d.conn.Close()
+	if code != CONNACK_BAD_CREDENTIALS {
+		t.Errorf("bad return code: %v", code)
+	}
+	d2, code := dialDevice(t, addr, "user", "token")
+	defer d2.conn.Close()
+	if code != CONNACK_ACCEPTED {
+		t.Errorf("bad return code: %v", code)
+	}
+}
+
+// deviceAuth tells where the accepted clients are from.
+type deviceAuth struct {
+	singleUserAuth
+	from chan string
+}
+
+func (self *deviceAuth) AuthenticateDevice(srv, usr, token, addr, device string) (bound string, ok bool, err error) {
+	ok, err = self.Authenticate(srv, usr, token, addr)
+	if ok {
+		self.from <- addr + " " + device
+	}
+	return
+}
+
+func TestGatewayProxyProtocol(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &deviceAuth{singleUserAuth{"service", "user", "token"}, make(chan string, 1)}
+	srv := &server.Server{
+		PrivateKey: priv,
+		Auth:       auth,
+		Handler:    server.HandlerFunc(func(conn server.Conn) {}),
+	}
+	go srv.Serve(listener.NewProxyProtocolListener(ln))
+	defer srv.Close()
+
+	gwln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := &Gateway{
+		ServerAddr:     ln.Addr().String(),
+		PublicKey:      &priv.PublicKey,
+		DefaultService: "service",
+		Timeout:        3 * time.Second,
+		ProxyProtocol:  true,
+	}
+	go gw.Serve(gwln)
+	defer gw.Close()
+
+	d, code := dialDevice(t, gwln.Addr().String(), "user", "token")
+	defer d.conn.Close()
+	if code != CONNACK_ACCEPTED {
+		t.Fatalf("bad return code: %v", code)
+	}
+	if from := <-auth.from; from != d.conn.LocalAddr().String()+" device" {
+		t.Errorf("the server does not see the device: %v", from)
+	}
+}
+
+func TestGateway(t *testing.T) {
+	stop, addr, conns := startServer(t)
+	defer stop()
+	d, code := dialDevice(t, addr, "service:user", "token")
+	defer d.conn.Close()
+	if code != CONNACK_ACCEPTED {
+		t.Fatalf("bad return code: %v", code)
+	}
+	var conn server.Conn
+	select {
+	case conn = <-conns:
+	case <-time.After(3 * time.Second):
+		t.Fatal("no connection to the server")
+	}
+	defer conn.Close()
+	fwdChan := make(chan *server.ForwardRequest, 1)
+	conn.SetForwardRequestChannel(fwdChan)
+	received := make(chan *proto.Message, 1)
+	go func() {
+		for {
+			msg, err := conn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+
+	// The message waits for the subscription.
+	msg := &proto.Message{Header: map[string]string{"title": "hi"}, Body: []byte("hello")}
+	err := conn.SendMessage(msg, "msg1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	d.send(t, &packet{Type: SUBSCRIBE, Flags: 2, PacketId: 1,
+		Topics: []string{"inbox/json", "inbox", "elsewhere"}, QoS: []byte{1, 0, 0}})
+	p := d.recv(t)
+	if p.Type != SUBACK || p.PacketId != 1 || string(p.QoS) != string([]byte{1, 0, SUBACK_FAILURE}) {
+		t.Fatalf("bad SUBACK: %+v", p)
+	}
+	var raw, js *packet
+	for i := 0; i < 2; i++ {
+		p = d.recv(t)
+		if p.Type != PUBLISH {
+			t.Fatalf("got %v instead of PUBLISH", p.Type)
+		}
+		if p.Topic == TOPIC_INBOX {
+			raw = p
+		} else {
+			js = p
+		}
+	}
+	if raw == nil || string(raw.Payload) != "hello" || raw.qos() != 0 {
+		t.Errorf("bad raw message: %+v", raw)
+	}
+	if js == nil || js.qos() != 1 {
+		t.Fatalf("bad json message: %+v", js)
+	}
+	var m Message
+	if err := json.Unmarshal(js.Payload, &m); err != nil || m.Id != "msg1" || m.Header["title"] != "hi" || string(m.Body) != "hello" {
+		t.Errorf("bad json message: %s", js.Payload)
+	}
+	d.send(t, &packet{Type: PUBACK, PacketId: js.PacketId})
+
+	d.send(t, &packet{Type: PUBLISH, Flags: 2, PacketId: 5, Topic: "server", Payload: []byte("up")})
+	if p = d.recv(t); p.Type != PUBACK || p.PacketId != 5 {
+		t.Errorf("bad PUBACK: %+v", p)
+	}
+	select {
+	case msg := <-received:
+		if string(msg.Body) != "up" {
+			t.Errorf("bad message to the server: %v", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("no message to the server")
+	}
+
+	d.send(t, &packet{Type: PUBLISH, Topic: "forward/other/user2/json", Payload: []byte(`{"header":{"a":"b"}}`)})
+	select {
+	case req := <-fwdChan:
+		if req.ReceiverService != "other" || req.Receiver != "user2" || req.MessageContainer.Message.Header["a"] != "b" {
+			t.Errorf("bad forward: %+v", req)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("no forward")
+	}
+
+	d.send(t, &packet{Type: PINGREQ})
+	if p = d.recv(t); p.Type != PINGRESP {
+		t.Errorf("got %v instead of PINGRESP", p.Type)
+	}
+
+	// Closing the upstream connection closes the MQTT one.
+	conn.Close()
+	d.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := readPacket(d.r, 0); err == nil {
+		t.Errorf("the MQTT connection should be closed")
+	}
+}
+
+func TestGatewayCachedMessages(t *testing.T) {
+	stop, addr, conns := startServer(t)
+	defer stop()
+	d, code := dialDevice(t, addr, "service:user", "token")
+	defer d.conn.Close()
+	if code != CONNACK_ACCEPTED {
+		t.Fatalf("bad return code: %v", code)
+	}
+	var conn server.Conn
+	select {
+	case conn = <-conns:
+	case <-time.After(3 * time.Second):
+		t.Fatal("no connection to the server")
+	}
+	defer conn.Close()
+	cache := testsupport.NewMockCache()
+	mc := &proto.MessageContainer{Message: &proto.Message{Body: []byte("missed")}}
+	if _, err := cache.CacheMessage("service", "user", mc, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetMessageCache(cache)
+	go func() {
+		for {
+			if _, err := conn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	d.send(t, &packet{Type: SUBSCRIBE, Flags: 2, PacketId: 1, Topics: []string{"inbox"}, QoS: []byte{0}})
+	if p := d.recv(t); p.Type != SUBACK {
+		t.Fatalf("got %v instead of SUBACK", p.Type)
+	}
+	if p := d.recv(t); p.Type != PUBLISH || string(p.Payload) != "missed" {
+		t.Errorf("the cached message should be delivered: %+v", p)
+	}
+}
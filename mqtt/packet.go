@@ -0,0 +1,346 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Control packet types of MQTT 3.1.1.
+const (
+	CONNECT     = 1
+	CONNACK     = 2
+	PUBLISH     = 3
+	PUBACK      = 4
+	PUBREC      = 5
+	PUBREL      = 6
+	PUBCOMP     = 7
+	SUBSCRIBE   = 8
+	SUBACK      = 9
+	UNSUBSCRIBE = 10
+	UNSUBACK    = 11
+	PINGREQ     = 12
+	PINGRESP    = 13
+	DISCONNECT  = 14
+)
+
+// CONNACK return codes.
+const (
+	CONNACK_ACCEPTED        = 0
+	CONNACK_BAD_PROTOCOL    = 1
+	CONNACK_BAD_CLIENT_ID   = 2
+	CONNACK_UNAVAILABLE     = 3
+	CONNACK_BAD_CREDENTIALS = 4
+	CONNACK_NOT_AUTHORIZED  = 5
+)
+
+// SUBACK_FAILURE is the return code of a rejected subscription.
+const SUBACK_FAILURE = 0x80
+
+const maxRemainingLengthDigits = 4
+
+var (
+	ErrMalformedPacket = errors.New("mqtt: malformed packet")
+	ErrPacketTooLarge  = errors.New("mqtt: packet too large")
+)
+
+// packet is a control packet. Only the fields of its type are set.
+type packet struct {
+	Type  byte
+	Flags byte
+
+	// CONNECT
+	ProtocolName  string
+	ProtocolLevel byte
+	ConnectFlags  byte
+	KeepAlive     uint16
+	ClientId      string
+	WillTopic     string
+	WillMessage   []byte
+	Username      string
+	Password      []byte
+
+	// CONNACK
+	SessionPresent bool
+	ReturnCode     byte
+
+	// PUBLISH, PUBACK, SUBSCRIBE, SUBACK, UNSUBSCRIBE, UNSUBACK
+	PacketId uint16
+	Topic    string
+	Payload  []byte
+
+	// SUBSCRIBE and UNSUBSCRIBE. QoS is only set for SUBSCRIBE, and
+	// the return codes of SUBACK are in it.
+	Topics []string
+	QoS    []byte
+}
+
+func (self *packet) qos() byte {
+	return (self.Flags >> 1) & 3
+}
+
+func readRemainingLength(r io.ByteReader) (n int, err error) {
+	mul := 1
+	for i := 0; i < maxRemainingLengthDigits; i++ {
+		var b byte
+		b, err = r.ReadByte()
+		if err != nil {
+			return
+		}
+		n += int(b&0x7F) * mul
+		if b&0x80 == 0 {
+			return
+		}
+		mul *= 128
+	}
+	err = ErrMalformedPacket
+	return
+}
+
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (self *decoder) uint16() uint16 {
+	if self.err != nil || len(self.data) < 2 {
+		self.err = ErrMalformedPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint16(self.data)
+	self.data = self.data[2:]
+	return v
+}
+
+func (self *decoder) bytes() []byte {
+	n := int(self.uint16())
+	if self.err != nil || len(self.data) < n {
+		self.err = ErrMalformedPacket
+		return nil
+	}
+	v := self.data[:n]
+	self.data = self.data[n:]
+	return v
+}
+
+func (self *decoder) string() string {
+	return string(self.bytes())
+}
+
+func (self *decoder) byte() byte {
+	if self.err != nil || len(self.data) < 1 {
+		self.err = ErrMalformedPacket
+		return 0
+	}
+	v := self.data[0]
+	self.data = self.data[1:]
+	return v
+}
+
+// readPacket reads a packet whose remaining length is at most maxLen.
+func readPacket(r *bufio.Reader, maxLen int) (p *packet, err error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	n, err := readRemainingLength(r)
+	if err != nil {
+		return
+	}
+	if maxLen > 0 && n > maxLen {
+		err = ErrPacketTooLarge
+		return
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return
+	}
+	p = &packet{Type: header >> 4, Flags: header & 0x0F}
+	d := &decoder{data: data}
+	switch p.Type {
+	case CONNECT:
+		p.ProtocolName = d.string()
+		p.ProtocolLevel = d.byte()
+		p.ConnectFlags = d.byte()
+		p.KeepAlive = d.uint16()
+		p.ClientId = d.string()
+		if p.ConnectFlags&0x04 != 0 {
+			p.WillTopic = d.string()
+			p.WillMessage = d.bytes()
+		}
+		if p.ConnectFlags&0x80 != 0 {
+			p.Username = d.string()
+		}
+		if p.ConnectFlags&0x40 != 0 {
+			p.Password = d.bytes()
+		}
+	case PUBLISH:
+		p.Topic = d.string()
+		if p.qos() > 0 {
+			p.PacketId = d.uint16()
+		}
+		if d.err == nil {
+			p.Payload = d.data
+			d.data = nil
+		}
+	case PUBACK, PUBREC, PUBREL, PUBCOMP, UNSUBACK:
+		p.PacketId = d.uint16()
+	case SUBSCRIBE, UNSUBSCRIBE:
+		p.PacketId = d.uint16()
+		for d.err == nil && len(d.data) > 0 {
+			p.Topics = append(p.Topics, d.string())
+			if p.Type == SUBSCRIBE {
+				p.QoS = append(p.QoS, d.byte())
+			}
+		}
+		if len(p.Topics) == 0 {
+			d.err = ErrMalformedPacket
+		}
+	case SUBACK:
+		p.PacketId = d.uint16()
+		p.QoS = d.data
+		d.data = nil
+	case CONNACK:
+		p.SessionPresent = d.byte()&1 != 0
+		p.ReturnCode = d.byte()
+	case PINGREQ, PINGRESP, DISCONNECT:
+	default:
+		d.err = ErrMalformedPacket
+	}
+	if d.err != nil {
+		err = d.err
+		p = nil
+	}
+	return
+}
+
+type encoder []byte
+
+func (self encoder) uint16(v uint16) encoder {
+	return append(self, byte(v>>8), byte(v))
+}
+
+func (self encoder) bytes(b []byte) encoder {
+	return append(self.uint16(uint16(len(b))), b...)
+}
+
+func (self encoder) string(s string) encoder {
+	return self.bytes([]byte(s))
+}
+
+// writePacket writes p to w. It does not flush w.
+func writePacket(w *bufio.Writer, p *packet) error {
+	var body encoder
+	flags := p.Flags
+	switch p.Type {
+	case CONNECT:
+		body = body.string(p.ProtocolName)
+		body = append(body, p.ProtocolLevel, p.ConnectFlags)
+		body = body.uint16(p.KeepAlive).string(p.ClientId)
+		if p.ConnectFlags&0x04 != 0 {
+			body = body.string(p.WillTopic).bytes(p.WillMessage)
+		}
+		if p.ConnectFlags&0x80 != 0 {
+			body = body.string(p.Username)
+		}
+		if p.ConnectFlags&0x40 != 0 {
+			body = body.bytes(p.Password)
+		}
+	case CONNACK:
+		var sp byte
+		if p.SessionPresent {
+			sp = 1
+		}
+		body = append(body, sp, p.ReturnCode)
+	case PUBLISH:
+		body = body.string(p.Topic)
+		if p.qos() > 0 {
+			body = body.uint16(p.PacketId)
+		}
+		body = append(body, p.Payload...)
+	case PUBACK, PUBREC, PUBCOMP, UNSUBACK:
+		body = body.uint16(p.PacketId)
+	case PUBREL:
+		flags = 2
+		body = body.uint16(p.PacketId)
+	case SUBSCRIBE, UNSUBSCRIBE:
+		flags = 2
+		body = body.uint16(p.PacketId)
+		for i, t := range p.Topics {
+			body = body.string(t)
+			if p.Type == SUBSCRIBE {
+				body = append(body, p.QoS[i])
+			}
+		}
+	case SUBACK:
+		body = body.uint16(p.PacketId)
+		body = append(body, p.QoS...)
+	case PINGREQ, PINGRESP, DISCONNECT:
+	default:
+		return ErrMalformedPacket
+	}
+	n := len(body)
+	if n >= 1<<(7*maxRemainingLengthDigits) {
+		return ErrPacketTooLarge
+	}
+	w.WriteByte(p.Type<<4 | flags)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		w.WriteByte(b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// topicMatches tells if the topic name matches the filter, which may
+// contain the wildcards '+' and '#'.
+func topicMatches(filter, topic string) bool {
+	for {
+		if filter == "#" {
+			return true
+		}
+		fi, ti := strings.IndexByte(filter, '/'), strings.IndexByte(topic, '/')
+		f, t := filter, topic
+		if fi >= 0 {
+			f = filter[:fi]
+		}
+		if ti >= 0 {
+			t = topic[:ti]
+		}
+		if f != "+" && f != t {
+			return false
+		}
+		if fi < 0 || ti < 0 {
+			// "a/#" matches "a" as well.
+			return fi < 0 && ti < 0 || ti < 0 && filter[fi+1:] == "#"
+		}
+		filter, topic = filter[fi+1:], topic[ti+1:]
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	packets := []*packet{
+		{Type: CONNECT, ProtocolName: "MQTT", ProtocolLevel: 4, ConnectFlags: 0xC2, KeepAlive: 60,
+			ClientId: "device", Username: "service:user", Password: []byte("token")},
+		{Type: CONNACK, ReturnCode: CONNACK_BAD_CREDENTIALS},
+		{Type: PUBLISH, Flags: 2, Topic: "inbox", PacketId: 7, Payload: bytes.Repeat([]byte("x"), 300)},
+		{Type: PUBLISH, Topic: "server", Payload: []byte{}},
+		{Type: PUBACK, PacketId: 7},
+		{Type: SUBSCRIBE, Flags: 2, PacketId: 1, Topics: []string{"inbox", "inbox/json"}, QoS: []byte{1, 0}},
+		{Type: SUBACK, PacketId: 1, QoS: []byte{1, SUBACK_FAILURE}},
+		{Type: UNSUBSCRIBE, Flags: 2, PacketId: 2, Topics: []string{"inbox"}},
+		{Type: UNSUBACK, PacketId: 2},
+		{Type: PINGREQ},
+		{Type: DISCONNECT},
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, p := range packets {
+		if err := writePacket(w, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+	r := bufio.NewReader(&buf)
+	for i, p := range packets {
+		q, err := readPacket(r, 0)
+		if err != nil {
+			t.Fatalf("packet %v: %v", i, err)
+		}
+		if !reflect.DeepEqual(p, q) {
+			t.Errorf("packet %v:\n%+v\n%+v", i, p, q)
+		}
+	}
+}
+
+func TestMalformedPacket(t *testing.T) {
+	inputs := [][]byte{
+		// Remaining length longer than four bytes.
+		{PUBLISH << 4, 0xFF, 0xFF, 0xFF, 0xFF, 0x01},
+		// Topic longer than the packet.
+		{PUBLISH << 4, 3, 0, 9, 'a'},
+		// SUBSCRIBE without topics.
+		{SUBSCRIBE<<4 | 2, 2, 0, 1},
+		// Unknown type.
+		{0, 0},
+	}
+	for i, in := range inputs {
+		_, err := readPacket(bufio.NewReader(bytes.NewReader(in)), 0)
+		if err != ErrMalformedPacket {
+			t.Errorf("input %v: %v", i, err)
+		}
+	}
+	_, err := readPacket(bufio.NewReader(bytes.NewReader([]byte{PUBLISH << 4, 100})), 10)
+	if err != ErrPacketTooLarge {
+		t.Errorf("should be too large: %v", err)
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"inbox", "inbox", true},
+		{"inbox", "inbox/json", false},
+		{"inbox/json", "inbox", false},
+		{"#", "inbox/json", true},
+		{"inbox/#", "inbox", true},
+		{"inbox/#", "inbox/json", true},
+		{"+", "inbox", true},
+		{"+", "inbox/json", false},
+		{"+/json", "inbox/json", true},
+		{"inbox/+", "inbox", false},
+		{"server", "inbox", false},
+	}
+	for _, c := range cases {
+		if topicMatches(c.filter, c.topic) != c.match {
+			t.Errorf("%v %v: should be %v", c.filter, c.topic, c.match)
+		}
+	}
+}
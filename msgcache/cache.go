@@ -18,13 +18,190 @@
 package msgcache
 
 import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/logger"
 	"github.com/uniqush/uniqush-conn/proto"
 	"time"
 )
 
 type Cache interface {
+	// CacheMessage sets the Id and the Seq of msg to the ones
+	// assigned by the cache, so that the same container can then
+	// be delivered. Don't share one container between receivers.
 	CacheMessage(service, username string, msg *proto.MessageContainer, ttl time.Duration) (id string, err error)
+
+	// CacheMessageOnce caches msg unless a message with the same
+	// OriginId is already cached for the user, e.g. by another node.
+	// In that case dup is true and the Id, Seq, CachedAt and
+	// ExpiresAt of msg are set to the ones of the cached message.
+	// It is CacheMessage if msg has no OriginId.
+	CacheMessageOnce(service, username string, msg *proto.MessageContainer, ttl time.Duration) (id string, dup bool, err error)
+
 	// XXX Is there any better way to support retrieve all feature?
 	Get(service, username, id string) (msg *proto.MessageContainer, err error)
+
+	// GetCachedMessages returns only the first, by sequence number,
+	// of the messages with the same OriginId.
 	GetCachedMessages(service, username string, excludes ...string) (msgs []*proto.MessageContainer, err error)
+
+	// Del removes the message from the cache. Its delivery
+	// state is kept.
+	Del(service, username, id string) error
+
+	// Replace sets the message of a cached container, keeping its
+	// id, sequence number and TTL. It returns false if there is no
+	// such message. msg should be in the thread of the message.
+	Replace(service, username, id string, msg *proto.Message) (ok bool, err error)
+
+	// GetMessagesBySeq returns the cached messages whose sequence
+	// numbers are in [from, to], ordered by sequence number.
+	// to == 0 means there is no upper bound.
+	GetMessagesBySeq(service, username string, from, to uint64) (msgs []*proto.MessageContainer, err error)
+
+	// GetMessagesByThread returns the cached messages of the thread,
+	// see proto.Message.ThreadId, ordered by sequence number.
+	GetMessagesByThread(service, username, threadId string) (msgs []*proto.MessageContainer, err error)
+
+	// IndexHeaders indexes the messages of the service by the values
+	// of the header fields, so that they could be queried. Only the
+	// messages cached afterwards are indexed.
+	IndexHeaders(service string, fields ...string)
+
+	// Query returns the cached messages matching the predicate,
+	// ordered by sequence number. It fails with ErrNotIndexed if a
+	// header field of the predicate is not indexed for the service.
+	// A page of the messages is selected by After and Limit.
+	Query(service, username string, p *Predicate) (msgs []*proto.MessageContainer, err error)
+
+	// UpdateDeliveryState records that the message has reached
+	// a certain state (delivered, acked or read).
+	UpdateDeliveryState(service, username, id string, state DeliveryStatus) error
+
+	// GetDeliveryState returns nil if there is no such message.
+	GetDeliveryState(service, username, id string) (state *DeliveryState, err error)
+
+	// NrUndelivered returns the number of cached messages which
+	// have never been delivered to the user.
+	NrUndelivered(service, username string) (n int, err error)
+
+	SetLogger(l logger.Logger)
+}
+
+var ErrNotIndexed = errors.New("header field is not indexed")
+
+// Predicate selects the messages whose headers have all the values
+// in Headers. A nil Predicate selects every cached message.
+type Predicate struct {
+	Headers map[string]string
+
+	// Unread leaves out the messages which have been read.
+	Unread bool
+
+	// After leaves out the messages whose sequence numbers are not
+	// greater, e.g. the ones returned by the previous page.
+	After uint64
+
+	// Limit, if positive, is the largest number of messages returned.
+	Limit int
+}
+
+// Match tells whether msg matches the predicate, regardless of the
+// indexes. read tells whether the message has been read.
+func (self *Predicate) Match(msg *proto.MessageContainer, read bool) bool {
+	if self == nil {
+		return true
+	}
+	if self.Unread && read {
+		return false
+	}
+	if self.After > 0 && msg.Seq <= self.After {
+		return false
+	}
+	for k, v := range self.Headers {
+		if msg.Message == nil || msg.Message.Header[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// DeliveryStateRetention is how long the delivery state of a message
+// is kept after the message expires. The state of a message which
+// never expires is kept forever.
+const DeliveryStateRetention = 30 * 24 * time.Hour
+
+// DeadLetterRetention is how long an expired message is kept for
+// the dead-letter handling if nobody collects it.
+const DeadLetterRetention = 24 * time.Hour
+
+// The reason of a dead letter.
+const DEADLETTER_EXPIRED = "expired"
+
+// DeadLetter is a cached message which has not been delivered.
+type DeadLetter struct {
+	Service  string                  `json:"service"`
+	Username string                  `json:"username"`
+	Message  *proto.MessageContainer `json:"msg"`
+	Reason   string                  `json:"reason"`
+}
+
+// DeadLetterCollector may be implemented by a Cache to tell the
+// messages which expired before they were delivered.
+type DeadLetterCollector interface {
+	// TrackDeadLetters keeps a copy of every message of the service
+	// cached with a TTL until the message is delivered, deleted or
+	// collected. Only the messages cached afterwards are tracked.
+	TrackDeadLetters(service string)
+
+	// CollectDeadLetters returns at most max expired messages of
+	// the service which have never been delivered. A message is
+	// returned only once, even if it is collected by several nodes.
+	CollectDeadLetters(service string, max int) (letters []*DeadLetter, err error)
+}
+
+// Pinger may be implemented by a Cache, or by any other store, kept
+// on a server which could be unreachable, e.g. redis.
+type Pinger interface {
+	Ping() error
+}
+
+type DeliveryStatus int
+
+const (
+	STATE_DELIVERED DeliveryStatus = iota
+	STATE_ACKED
+	STATE_READ
+)
+
+func (self DeliveryStatus) String() string {
+	switch self {
+	case STATE_DELIVERED:
+		return "delivered"
+	case STATE_ACKED:
+		return "acked"
+	case STATE_READ:
+		return "read"
+	}
+	return "unknown"
+}
+
+// DeliveryState tells when the message reached each state.
+// A zero time means the message has not reached the state yet.
+type DeliveryState struct {
+	Cached    time.Time `json:"cached"`
+	Delivered time.Time `json:"delivered,omitempty"`
+	Acked     time.Time `json:"acked,omitempty"`
+	Read      time.Time `json:"read,omitempty"`
+}
+
+func (self *DeliveryState) IsDelivered() bool {
+	return !self.Delivered.IsZero()
+}
+
+func (self *DeliveryState) IsAcked() bool {
+	return !self.Acked.IsZero()
+}
+
+func (self *DeliveryState) IsRead() bool {
+	return !self.Read.IsZero()
 }
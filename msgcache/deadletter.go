@@ -0,0 +1,136 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// deadlineKey is a sorted set of the tracked messages of a service,
+// whose scores are their expiration times.
+func deadlineKey(service string) string {
+	return fmt.Sprintf("mdeadline:%v", service)
+}
+
+func deadlineMember(username, id string) string {
+	return fmt.Sprintf("%v:%v", username, id)
+}
+
+// deadLetterKey keeps a copy of the message which outlives it.
+func deadLetterKey(service, username, id string) string {
+	return fmt.Sprintf("mdead:%v:%v:%v", service, username, id)
+}
+
+func (self *redisMessageCache) TrackDeadLetters(service string) {
+	self.deadLetterLock.Lock()
+	defer self.deadLetterLock.Unlock()
+	if self.deadLetterServices == nil {
+		self.deadLetterServices = make(map[string]bool, 1)
+	}
+	self.deadLetterServices[service] = true
+}
+
+func (self *redisMessageCache) tracksDeadLetters(service string) bool {
+	self.deadLetterLock.RLock()
+	defer self.deadLetterLock.RUnlock()
+	return self.deadLetterServices[service]
+}
+
+// sendTrackDeadLetter should be called in a transaction.
+func (self *redisMessageCache) sendTrackDeadLetter(conn redis.Conn, service, username, id string, data []byte, ttl time.Duration) error {
+	deadline := time.Now().Add(ttl).UnixNano()
+	err := conn.Send("ZADD", deadlineKey(service), deadline, deadlineMember(username, id))
+	if err != nil {
+		return err
+	}
+	return conn.Send("SETEX", deadLetterKey(service, username, id), int64((ttl + DeadLetterRetention).Seconds()), data)
+}
+
+// sendUntrackDeadLetter should be called in a transaction. The
+// message is no longer a dead letter once it is delivered or deleted.
+func (self *redisMessageCache) sendUntrackDeadLetter(conn redis.Conn, service, username, id string) error {
+	if !self.tracksDeadLetters(service) {
+		return nil
+	}
+	err := conn.Send("ZREM", deadlineKey(service), deadlineMember(username, id))
+	if err != nil {
+		return err
+	}
+	return conn.Send("DEL", deadLetterKey(service, username, id))
+}
+
+func (self *redisMessageCache) CollectDeadLetters(service string, max int) (letters []*DeadLetter, err error) {
+	defer func() {
+		self.logError("collect-dead-letters", service, "", err)
+	}()
+	dkey := deadlineKey(service)
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do("ZRANGEBYSCORE", dkey, "-inf", time.Now().UnixNano(), "LIMIT", 0, max)
+	members, err := redis.Strings(reply, err)
+	if err != nil {
+		return
+	}
+	for _, member := range members {
+		// Only the node removing the member gets the dead letter.
+		var n int
+		n, err = redis.Int(conn.Do("ZREM", dkey, member))
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		fields := strings.SplitN(member, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		username, id := fields[0], fields[1]
+		key := deadLetterKey(service, username, id)
+		var data []byte
+		data, err = redis.Bytes(conn.Do("GET", key))
+		if err == redis.ErrNil {
+			// Kept longer than DeadLetterRetention.
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		_, err = conn.Do("DEL", key)
+		if err != nil {
+			return
+		}
+		mc, e := msgUnmarshal(data)
+		if e != nil {
+			continue
+		}
+		letters = append(letters, &DeadLetter{
+			Service:  service,
+			Username: username,
+			Message:  mc,
+			Reason:   DEADLETTER_EXPIRED,
+		})
+	}
+	return
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCollectDeadLetters(t *testing.T) {
+	N := 4
+	msgs := multiRandomMessage(N)
+	cache := getCache()
+	defer clearDb()
+	srv := "srv"
+	usr := "usr"
+
+	collector := cache.(DeadLetterCollector)
+	collector.TrackDeadLetters(srv)
+
+	ids := make([]string, N)
+	for i, msg := range msgs {
+		id, err := cache.CacheMessage(srv, usr, msg, 1*time.Second)
+		if err != nil {
+			t.Fatalf("Set error: %v", err)
+		}
+		ids[i] = id
+	}
+	// Neither a delivered nor a deleted message is a dead letter.
+	err := cache.UpdateDeliveryState(srv, usr, ids[0], STATE_DELIVERED)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	err = cache.Del(srv, usr, ids[1])
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// A message without TTL never expires.
+	_, err = cache.CacheMessage(srv, usr, multiRandomMessage(1)[0], 0)
+	if err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+
+	letters, err := collector.CollectDeadLetters(srv, 10)
+	if err != nil || len(letters) != 0 {
+		t.Errorf("collected messages which are not expired: %v %v", letters, err)
+	}
+	time.Sleep(2 * time.Second)
+
+	letters, err = collector.CollectDeadLetters(srv, 10)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("collected %v dead letters", len(letters))
+	}
+	for i, letter := range letters {
+		if letter.Service != srv || letter.Username != usr || letter.Reason != DEADLETTER_EXPIRED {
+			t.Errorf("bad dead letter: %+v", letter)
+		}
+		if letter.Message.Id != ids[i+2] || !letter.Message.Message.Eq(msgs[i+2].Message) {
+			t.Errorf("%vth dead letter is corrupted", i)
+		}
+	}
+
+	letters, err = collector.CollectDeadLetters(srv, 10)
+	if err != nil || len(letters) != 0 {
+		t.Errorf("dead letters are collected twice: %v %v", letters, err)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+// IdGenerator assigns the ids of the cached messages. An id must be
+// unique among the messages of the user, and must not contain ':'.
+type IdGenerator interface {
+	NextId(service, username string) string
+}
+
+// IdGeneratorFunc is a function used as an IdGenerator.
+type IdGeneratorFunc func(service, username string) string
+
+func (self IdGeneratorFunc) NextId(service, username string) string {
+	return self(service, username)
+}
+
+// RandomIds returns the default IdGenerator. The ids are unique
+// but tell nothing about the order of the messages.
+func RandomIds() IdGenerator {
+	return IdGeneratorFunc(func(service, username string) string {
+		return fmt.Sprintf("%x-%x", time.Now().UnixNano(), mrand.Int63())
+	})
+}
+
+// OrderedIdGenerator is an IdGenerator whose ids sort in the order
+// they are generated, so that the cache may sort the messages by id.
+type OrderedIdGenerator interface {
+	IdGenerator
+
+	// Ordered only marks the generator.
+	Ordered()
+}
+
+// Crockford's base32, whose order is the same as the order of the
+// values it encodes.
+const sortableIdAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+type sortableIds struct {
+	lock sync.Mutex
+	last uint64
+	rand [10]byte
+}
+
+// SortableIds returns an IdGenerator of ULIDs: 48 bits of
+// milliseconds since the epoch followed by 80 random bits, in 26
+// characters. Ids generated later are greater, also within the same
+// millisecond, so sorting the ids sorts the messages by the time
+// they were cached on the node. The generator is an
+// OrderedIdGenerator.
+func SortableIds() IdGenerator {
+	return new(sortableIds)
+}
+
+func (self *sortableIds) NextId(service, username string) string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if ms > self.last {
+		self.last = ms
+		rand.Read(self.rand[:])
+	} else {
+		// The clock may not move forward. Keep the ids increasing.
+		for i := len(self.rand) - 1; i >= 0; i-- {
+			self.rand[i]++
+			if self.rand[i] != 0 {
+				break
+			}
+		}
+	}
+	return encodeSortableId(self.last, self.rand)
+}
+
+func (self *sortableIds) Ordered() {}
+
+func encodeSortableId(ms uint64, r [10]byte) string {
+	var id [26]byte
+	// 48 bits of time in 10 characters: the first one carries 3 bits.
+	for i := 9; i >= 0; i-- {
+		id[i] = sortableIdAlphabet[ms&0x1F]
+		ms >>= 5
+	}
+	// 80 random bits in 16 characters.
+	var acc uint64
+	bits := uint(0)
+	j := 10
+	for _, b := range r {
+		acc = acc<<8 | uint64(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			id[j] = sortableIdAlphabet[(acc>>bits)&0x1F]
+			j++
+		}
+	}
+	return string(id[:])
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeSortableId(t *testing.T) {
+	var r [10]byte
+	if id := encodeSortableId(0, r); id != strings.Repeat("0", 26) {
+		t.Errorf("bad id: %v", id)
+	}
+	r[9] = 0x21
+	if id := encodeSortableId(32, r); id != "0000000010"+strings.Repeat("0", 14)+"11" {
+		t.Errorf("bad id: %v", id)
+	}
+	for i := range r {
+		r[i] = 0xFF
+	}
+	if id := encodeSortableId(1<<48-1, r); id != "7"+strings.Repeat("Z", 25) {
+		t.Errorf("bad id: %v", id)
+	}
+}
+
+func TestSortableIds(t *testing.T) {
+	ids := SortableIds()
+	last := ""
+	for i := 0; i < 1000; i++ {
+		id := ids.NextId("srv", "usr")
+		if len(id) != 26 {
+			t.Fatalf("bad id: %v", id)
+		}
+		if id <= last {
+			t.Fatalf("%v is not greater than %v", id, last)
+		}
+		last = id
+	}
+}
+
+func TestCacheWithSortableIds(t *testing.T) {
+	defer clearDb()
+	getCache()
+	cache := NewRedisMessageCacheWithIds("", "", 1, SortableIds())
+	srv := "srv"
+	usr := "usr"
+	N := 10
+	msgs := multiRandomMessage(N)
+	for _, msg := range msgs {
+		_, err := cache.CacheMessage(srv, usr, msg, time.Hour)
+		if err != nil {
+			t.Fatalf("Set error: %v", err)
+		}
+	}
+	cached, err := cache.GetCachedMessages(srv, usr)
+	if err != nil || len(cached) != N {
+		t.Fatalf("got %v messages: %v", len(cached), err)
+	}
+	for i, mc := range cached {
+		if mc.Id != msgs[i].Id || (i > 0 && mc.Id <= cached[i-1].Id) {
+			t.Errorf("%vth message is out of order: %v", i, mc.Id)
+		}
+	}
+
+	// The messages are sorted by id, without a weight.
+	c, err := redis.Dial("tcp", "localhost:6379")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer c.Close()
+	c.Do("SELECT", 1)
+	if n, err := redis.Int(c.Do("EXISTS", msgWeightKey(srv, usr, msgs[0].Id))); err != nil || n != 0 {
+		t.Errorf("a weight is kept: %v %v", n, err)
+	}
+}
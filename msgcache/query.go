@@ -0,0 +1,304 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/tracing"
+)
+
+// msgHeaderKey is a sorted set of the ids of the cached messages
+// whose header field has the value, whose scores are their sequence
+// numbers. It expires with its last message.
+func msgHeaderKey(service, username, field, value string) string {
+	return fmt.Sprintf("mheader:%v:%v:%v:%v", service, username, field, value)
+}
+
+// msgQueryKey is a temporary sorted set of the ids in all the header
+// indexes queried, whose scores are their sequence numbers.
+func msgQueryKey(service, username string) string {
+	return fmt.Sprintf("mquery:%v:%v:%x-%x", service, username, time.Now().UnixNano(), rand.Int63())
+}
+
+// The number of ids read at a time by Query.
+const queryPageSize = 128
+
+// How long the intersection of the indexes is kept if the query
+// cannot delete it, in seconds.
+const queryKeyTTL = 60
+
+func (self *redisMessageCache) IndexHeaders(service string, fields ...string) {
+	self.headerLock.Lock()
+	defer self.headerLock.Unlock()
+	if self.indexedHeaders == nil {
+		self.indexedHeaders = make(map[string]map[string]bool, 1)
+	}
+	indexed := self.indexedHeaders[service]
+	if indexed == nil {
+		indexed = make(map[string]bool, len(fields))
+		self.indexedHeaders[service] = indexed
+	}
+	for _, f := range fields {
+		indexed[f] = true
+	}
+}
+
+func (self *redisMessageCache) isIndexed(service, field string) bool {
+	self.headerLock.RLock()
+	defer self.headerLock.RUnlock()
+	return self.indexedHeaders[service][field]
+}
+
+// indexKeys returns the sorted sets indexing the message, besides the
+// sequence of all the messages: the one of its thread and the ones of
+// its indexed header fields.
+func (self *redisMessageCache) indexKeys(service, username string, msg *proto.Message) (keys []string) {
+	if msg == nil {
+		return
+	}
+	if len(msg.ThreadId) > 0 {
+		keys = append(keys, msgThreadKey(service, username, msg.ThreadId))
+	}
+	for field, value := range msg.Header {
+		if self.isIndexed(service, field) {
+			keys = append(keys, msgHeaderKey(service, username, field, value))
+		}
+	}
+	return
+}
+
+// indexTTLs returns the TTLs of the keys in milliseconds, as told by
+// PTTL. It should be called before the transaction adding a message to
+// the indexes.
+func indexTTLs(conn redis.Conn, keys []string) (ttls []int64, err error) {
+	if len(keys) == 0 {
+		return
+	}
+	err = conn.Send("MULTI")
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		err = conn.Send("PTTL", key)
+		if err != nil {
+			conn.Do("DISCARD")
+			return
+		}
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return
+	}
+	ttls = make([]int64, len(keys))
+	for i := range ttls {
+		ttls[i] = -2
+		if i < len(replies) {
+			ttls[i], _ = redis.Int64(replies[i], nil)
+		}
+	}
+	return
+}
+
+// sendIndex adds the message to the indexes, which expire with their
+// last message: ttls are the TTLs of the keys, see indexTTLs, and ms
+// is the TTL of the message, or 0 if it never expires. Two messages
+// indexed at the same time may leave an index with the shorter TTL of
+// the two, in which case the other message is only lost from the
+// index. It should be called in a transaction.
+func sendIndex(conn redis.Conn, keys []string, ttls []int64, id string, seq, ms int64) error {
+	for i, key := range keys {
+		err := conn.Send("ZADD", key, seq, id)
+		if err != nil {
+			return err
+		}
+		switch {
+		case ms <= 0:
+			err = conn.Send("PERSIST", key)
+		case ttls[i] == -1 || ttls[i] >= ms:
+			// Another message of the index lives longer.
+		default:
+			err = conn.Send("PEXPIRE", key, ms)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendUnindex should be called in a transaction.
+func sendUnindex(conn redis.Conn, keys []string, id string) error {
+	for _, key := range keys {
+		err := conn.Send("ZREM", key, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *redisMessageCache) Query(service, username string, p *Predicate) (msgs []*proto.MessageContainer, err error) {
+	span := tracing.Start("cache.query", "", "service", service, "username", username)
+	defer func() {
+		self.logError("query", service, username, err)
+		tracing.End(span, err)
+	}()
+	var keys []string
+	if p != nil {
+		for field, value := range p.Headers {
+			if !self.isIndexed(service, field) {
+				err = ErrNotIndexed
+				return
+			}
+			keys = append(keys, msgHeaderKey(service, username, field, value))
+		}
+	}
+	if len(keys) == 0 {
+		keys = append(keys, msgSeqKey(service, username))
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	key := keys[0]
+	if len(keys) > 1 {
+		key, err = self.intersectIndexes(conn, service, username, keys)
+		if err != nil {
+			return
+		}
+		defer conn.Do("DEL", key)
+	}
+	limit := 0
+	min := "-inf"
+	if p != nil {
+		limit = p.Limit
+		if p.After > 0 {
+			min = "(" + strconv.FormatUint(p.After, 10)
+		}
+	}
+	for {
+		var reply []string
+		reply, err = redis.Strings(conn.Do("ZRANGEBYSCORE", key, min, "+inf", "WITHSCORES", "LIMIT", 0, queryPageSize))
+		if err != nil || len(reply) == 0 {
+			return
+		}
+		ids := make([]string, 0, len(reply)/2)
+		for i := 0; i+1 < len(reply); i += 2 {
+			ids = append(ids, reply[i])
+		}
+		min = "(" + reply[len(reply)-1]
+
+		var page []*proto.MessageContainer
+		page, err = self.queryPage(conn, keys[0], service, username, ids, p)
+		if err != nil {
+			return
+		}
+		for _, mc := range page {
+			msgs = append(msgs, mc)
+			if limit > 0 && len(msgs) >= limit {
+				return
+			}
+		}
+		if len(ids) < queryPageSize {
+			return
+		}
+	}
+}
+
+// intersectIndexes stores the ids in all the keys in a temporary key,
+// which the caller should delete.
+func (self *redisMessageCache) intersectIndexes(conn redis.Conn, service, username string, keys []string) (key string, err error) {
+	key = msgQueryKey(service, username)
+	args := make([]interface{}, 0, len(keys)+4)
+	args = append(args, key, len(keys))
+	for _, k := range keys {
+		args = append(args, k)
+	}
+	// The scores of all the indexes are the sequence numbers.
+	args = append(args, "AGGREGATE", "MIN")
+	err = conn.Send("MULTI")
+	if err != nil {
+		return
+	}
+	err = conn.Send("ZINTERSTORE", args...)
+	if err != nil {
+		conn.Do("DISCARD")
+		return
+	}
+	err = conn.Send("EXPIRE", key, queryKeyTTL)
+	if err != nil {
+		conn.Do("DISCARD")
+		return
+	}
+	_, err = conn.Do("EXEC")
+	return
+}
+
+// queryPage returns the messages whose ids are given which match the
+// predicate.
+func (self *redisMessageCache) queryPage(conn redis.Conn, indexKey, service, username string, ids []string, p *Predicate) (msgs []*proto.MessageContainer, err error) {
+	mcs, err := self.getIndexed(conn, indexKey, service, username, ids)
+	if err != nil || len(mcs) == 0 {
+		return
+	}
+	read := make([]bool, len(mcs))
+	if p != nil && p.Unread {
+		read, err = self.areRead(conn, service, username, mcs)
+		if err != nil {
+			return
+		}
+	}
+
+	// A replaced message may no longer match its indexes.
+	for i, mc := range mcs {
+		if p.Match(mc, read[i]) {
+			msgs = append(msgs, mc)
+		}
+	}
+	return
+}
+
+func (self *redisMessageCache) areRead(conn redis.Conn, service, username string, mcs []*proto.MessageContainer) (read []bool, err error) {
+	err = conn.Send("MULTI")
+	if err != nil {
+		return
+	}
+	for _, mc := range mcs {
+		err = conn.Send("HEXISTS", msgStateKey(service, username, mc.Id), STATE_READ.String())
+		if err != nil {
+			conn.Do("DISCARD")
+			return
+		}
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return
+	}
+	read = make([]bool, len(mcs))
+	for i, reply := range replies {
+		if i < len(read) {
+			read[i], _ = redis.Bool(reply, nil)
+		}
+	}
+	return
+}
@@ -21,71 +21,173 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/logger"
 	"github.com/uniqush/uniqush-conn/proto"
-	"math/rand"
+	"github.com/uniqush/uniqush-conn/redispool"
+	"github.com/uniqush/uniqush-conn/tracing"
+	"strconv"
+	"sync"
 	"time"
 )
 
 type redisMessageCache struct {
-	pool *redis.Pool
+	pool   *redis.Pool
+	logger logger.Logger
+	ids    IdGenerator
+
+	// Set if the ids are an OrderedIdGenerator: the messages are
+	// sorted by their ids rather than by their weights.
+	orderedIds bool
+
+	// The services whose dead letters are tracked.
+	deadLetterLock     sync.RWMutex
+	deadLetterServices map[string]bool
+
+	// The indexed header fields of each service.
+	headerLock     sync.RWMutex
+	indexedHeaders map[string]map[string]bool
 }
 
 func NewRedisMessageCache(addr, password string, db int) Cache {
-	if len(addr) == 0 {
-		addr = "localhost:6379"
-	}
-	if db < 0 {
-		db = 0
-	}
+	return NewRedisMessageCacheWithIds(addr, password, db, nil)
+}
 
-	dial := func() (redis.Conn, error) {
-		c, err := redis.Dial("tcp", addr)
-		if err != nil {
-			return nil, err
-		}
-		if len(password) > 0 {
-			if _, err := c.Do("AUTH", password); err != nil {
-				c.Close()
-				return nil, err
-			}
-		}
-		if _, err := c.Do("SELECT", db); err != nil {
-			c.Close()
-			return nil, err
-		}
-		return c, err
-	}
-	testOnBorrow := func(c redis.Conn, t time.Time) error {
-		_, err := c.Do("PING")
-		return err
-	}
+// NewRedisMessageCacheWithIds uses ids to assign the ids of the
+// messages. A nil ids means RandomIds(). If ids is an
+// OrderedIdGenerator, the messages are sorted by their ids, and no
+// weight is kept for each of them. The messages cached with another
+// generator are then out of order until they expire.
+func NewRedisMessageCacheWithIds(addr, password string, db int, ids IdGenerator) Cache {
+	pool := redispool.New(addr, password, db)
 
-	pool := &redis.Pool{
-		MaxIdle:      3,
-		IdleTimeout:  240 * time.Second,
-		Dial:         dial,
-		TestOnBorrow: testOnBorrow,
+	if ids == nil {
+		ids = RandomIds()
 	}
-
 	ret := new(redisMessageCache)
 	ret.pool = pool
+	ret.logger = logger.Nop()
+	ret.ids = ids
+	_, ret.orderedIds = ids.(OrderedIdGenerator)
 	return ret
 }
 
-func randomId() string {
-	return fmt.Sprintf("%x-%x", time.Now().UnixNano(), rand.Int63())
+func (self *redisMessageCache) SetLogger(l logger.Logger) {
+	self.logger = logger.OrNop(l).With("cache", "redis")
+}
+
+// Ping tells whether redis could be reached.
+func (self *redisMessageCache) Ping() error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+func (self *redisMessageCache) logError(op, service, username string, err error) {
+	if err == nil {
+		return
+	}
+	self.logger.Error("cache operation failed", "op", op, "service", service, "username", username, "err", err)
 }
 
 func (self *redisMessageCache) CacheMessage(service, username string, msg *proto.MessageContainer, ttl time.Duration) (id string, err error) {
-	id = randomId()
+	span := tracing.StartFromMessage("cache.set", msg.Message, "service", service, "username", username)
+	defer func() {
+		tracing.End(span, err)
+	}()
+	id = self.ids.NextId(service, username)
 	err = self.set(service, username, id, msg, ttl)
 	if err != nil {
+		self.logError("cache", service, username, err)
 		id = ""
 		return
 	}
+	self.logger.Debug("message cached", "service", service, "username", username, "id", id, "seq", msg.Seq)
+	return
+}
+
+// CacheMessageOnce caches the message before claiming its origin id,
+// so that the message is not lost if the node dies in between. The
+// copy is removed if another node has claimed the origin id first,
+// and GetCachedMessages leaves out the copies which are left.
+func (self *redisMessageCache) CacheMessageOnce(service, username string, msg *proto.MessageContainer, ttl time.Duration) (id string, dup bool, err error) {
+	id, err = self.CacheMessage(service, username, msg, ttl)
+	if err != nil || len(msg.OriginId) == 0 {
+		return
+	}
+	winner, err := self.claimOrigin(service, username, msg.OriginId, id, ttl)
+	if err != nil {
+		self.logError("cache-once", service, username, err)
+		// The message is cached anyway.
+		err = nil
+		return
+	}
+	if winner == id {
+		return
+	}
+	dup = true
+	self.logger.Debug("duplicate message dropped", "service", service, "username", username, "id", id, "origin", msg.OriginId, "cached", winner)
+	err = self.removeCopy(service, username, id)
+	if err != nil {
+		self.logError("cache-once", service, username, err)
+	}
+	id = winner
+	cached, err := self.Get(service, username, winner)
+	if err != nil {
+		return
+	}
+	msg.Id = winner
+	if cached != nil {
+		msg.Seq = cached.Seq
+		msg.CachedAt = cached.CachedAt
+		msg.ExpiresAt = cached.ExpiresAt
+	}
+	return
+}
+
+// claimOrigin returns the id of the message which has claimed the
+// origin id, which is id if nobody did. The claim lasts as long as the
+// message.
+func (self *redisMessageCache) claimOrigin(service, username, origin, id string, ttl time.Duration) (winner string, err error) {
+	key := msgOriginKey(service, username, origin)
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	var reply interface{}
+	if ttl.Seconds() <= 0.0 {
+		reply, err = conn.Do("SET", key, id, "NX")
+	} else {
+		ms := int64((ttl + time.Millisecond - 1) / time.Millisecond)
+		reply, err = conn.Do("SET", key, id, "PX", ms, "NX")
+	}
+	if err != nil {
+		return
+	}
+	if reply != nil {
+		winner = id
+		return
+	}
+	winner, err = redis.String(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		// The claim has just expired.
+		winner, err = id, nil
+	}
 	return
 }
 
+// removeCopy deletes a message which has never been told to anybody,
+// with its delivery state.
+func (self *redisMessageCache) removeCopy(service, username, id string) error {
+	err := self.Del(service, username, id)
+	if err != nil {
+		return err
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("DEL", msgStateKey(service, username, id))
+	return err
+}
+
 func msgKey(service, username, id string) string {
 	return fmt.Sprintf("mcache:%v:%v:%v", service, username, id)
 }
@@ -98,6 +200,19 @@ func msgQueueKey(service, username string) string {
 	return fmt.Sprintf("mqueue:%v:%v", service, username)
 }
 
+// msgSeqKey is a sorted set of the ids of the cached messages,
+// whose scores are their sequence numbers.
+func msgSeqKey(service, username string) string {
+	return fmt.Sprintf("mseq:%v:%v", service, username)
+}
+
+// msgThreadKey is a sorted set of the ids of the cached messages of
+// a thread, whose scores are their sequence numbers. It expires with
+// its last message.
+func msgThreadKey(service, username, threadId string) string {
+	return fmt.Sprintf("mthread:%v:%v:%v", service, username, threadId)
+}
+
 func msgWeightKey(service, username, id string) string {
 	return fmt.Sprintf("w_mcache:%v:%v:%v", service, username, id)
 }
@@ -106,8 +221,21 @@ func msgWeightPattern(service, username string) string {
 	return fmt.Sprintf("w_mcache:%v:%v:*", service, username)
 }
 
+func msgStateKey(service, username, id string) string {
+	return fmt.Sprintf("s_mcache:%v:%v:%v", service, username, id)
+}
+
+// msgOriginKey is the id of the message cached with the origin id.
+func msgOriginKey(service, username, origin string) string {
+	return fmt.Sprintf("morigin:%v:%v:%v", service, username, origin)
+}
+
+func undeliveredKey(service, username string) string {
+	return fmt.Sprintf("mundelivered:%v:%v", service, username)
+}
+
 func counterKey(service, username string) string {
-	return "msgCounter"
+	return fmt.Sprintf("mcounter:%v:%v", service, username)
 }
 
 func msgMarshal(msg *proto.MessageContainer) (data []byte, err error) {
@@ -125,27 +253,48 @@ func msgUnmarshal(data []byte) (msg *proto.MessageContainer, err error) {
 	return
 }
 
+// set() assigns the id and the sequence number to msg. See Cache.CacheMessage().
 func (self *redisMessageCache) set(service, username, id string, msg *proto.MessageContainer, ttl time.Duration) error {
 	msg.Id = id
 	key := msgKey(service, username, id)
 	conn := self.pool.Get()
 	defer conn.Close()
 
-	data, err := msgMarshal(msg)
+	// The counter is per-user so that it could be used as the
+	// sequence number of the message.
+	reply, err := conn.Do("INCR", counterKey(service, username))
 	if err != nil {
 		return err
 	}
 
-	reply, err := conn.Do("INCR", counterKey(service, username))
+	weight, err := redis.Int64(reply, err)
 	if err != nil {
 		return err
 	}
+	msg.Seq = uint64(weight)
+	now := time.Now().UnixNano()
+	msg.CachedAt = now
+	msg.ExpiresAt = 0
+	if ttl > 0 {
+		msg.ExpiresAt = now + int64(ttl)
+	}
 
-	weight, err := redis.Int64(reply, err)
+	data, err := msgMarshal(msg)
 	if err != nil {
 		return err
 	}
 	wkey := msgWeightKey(service, username, id)
+	// In milliseconds, rounded up: a TTL shorter than a second
+	// is still a TTL, and one second short is too early.
+	var ms int64
+	if ttl.Seconds() > 0.0 {
+		ms = int64((ttl + time.Millisecond - 1) / time.Millisecond)
+	}
+	indexes := self.indexKeys(service, username, msg.Message)
+	ttls, err := indexTTLs(conn, indexes)
+	if err != nil {
+		return err
+	}
 
 	err = conn.Send("MULTI")
 	if err != nil {
@@ -158,25 +307,69 @@ func (self *redisMessageCache) set(service, username, id string, msg *proto.Mess
 			conn.Do("DISCARD")
 			return err
 		}
-		err = conn.Send("SET", wkey, weight)
+		if !self.orderedIds {
+			err = conn.Send("SET", wkey, weight)
+		}
 	} else {
-		err = conn.Send("SETEX", key, int64(ttl.Seconds()), data)
+		err = conn.Send("SET", key, data, "PX", ms)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+		if !self.orderedIds {
+			err = conn.Send("SET", wkey, weight, "PX", ms)
+		}
+	}
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	// The delivery state outlives the message, so that it could
+	// still be told whether an expired message was delivered.
+	skey := msgStateKey(service, username, id)
+	err = conn.Send("HSET", skey, stateCachedField, now)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	if ttl.Seconds() > 0.0 {
+		err = conn.Send("EXPIRE", skey, int64((ttl + DeliveryStateRetention).Seconds()))
 		if err != nil {
 			conn.Do("DISCARD")
 			return err
 		}
-		err = conn.Send("SETEX", wkey, int64(ttl.Seconds()), weight)
 	}
+	err = conn.Send("SADD", undeliveredKey(service, username), id)
 	if err != nil {
 		conn.Do("DISCARD")
 		return err
 	}
+
+	if ttl.Seconds() > 0.0 && self.tracksDeadLetters(service) {
+		err = self.sendTrackDeadLetter(conn, service, username, id, data, ttl)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+
 	msgQK := msgQueueKey(service, username)
 	err = conn.Send("SADD", msgQK, id)
 	if err != nil {
 		conn.Do("DISCARD")
 		return err
 	}
+	err = conn.Send("ZADD", msgSeqKey(service, username), weight, id)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	err = sendIndex(conn, indexes, ttls, id, weight, ms)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
 	_, err = conn.Do("EXEC")
 	if err != nil {
 		return err
@@ -185,6 +378,11 @@ func (self *redisMessageCache) set(service, username, id string, msg *proto.Mess
 }
 
 func (self *redisMessageCache) Get(service, username, id string) (msg *proto.MessageContainer, err error) {
+	span := tracing.Start("cache.get", "", "service", service, "username", username)
+	defer func() {
+		self.logError("get", service, username, err)
+		tracing.End(span, err)
+	}()
 	key := msgKey(service, username, id)
 	conn := self.pool.Get()
 	defer conn.Close()
@@ -204,41 +402,172 @@ func (self *redisMessageCache) Get(service, username, id string) (msg *proto.Mes
 	return
 }
 
-/*
- * We may not need Delete
-func (self *redisMessageCache) Del(service, username, id string) error {
+func (self *redisMessageCache) Del(service, username, id string) (err error) {
+	defer func() {
+		self.logError("del", service, username, err)
+	}()
 	key := msgKey(service, username, id)
 	wkey := msgWeightKey(service, username, id)
 	conn := self.pool.Get()
 	defer conn.Close()
 
-	err := conn.Send("MULTI")
+	// The message tells which indexes to remove it from.
+	var indexes []string
+	data, err := redis.Bytes(conn.Do("GET", key))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if err == nil {
+		if mc, e := msgUnmarshal(data); e == nil {
+			indexes = self.indexKeys(service, username, mc.Message)
+		}
+	}
+
+	err = conn.Send("MULTI")
 	if err != nil {
 		return err
 	}
-	err = conn.Send("DEL", key)
+	err = conn.Send("DEL", key, wkey)
 	if err != nil {
 		conn.Do("DISCARD")
 		return err
 	}
-	err = conn.Send("DEL", wkey)
+	err = conn.Send("SREM", msgQueueKey(service, username), id)
 	if err != nil {
 		conn.Do("DISCARD")
 		return err
 	}
-	msgQK := msgQueueKey(service, username)
-	err = conn.Send("SREM", msgQK, id)
+	err = conn.Send("ZREM", msgSeqKey(service, username), id)
 	if err != nil {
 		conn.Do("DISCARD")
 		return err
 	}
-	_, err = conn.Do("EXEC")
+	err = conn.Send("SREM", undeliveredKey(service, username), id)
 	if err != nil {
+		conn.Do("DISCARD")
 		return err
 	}
-	return nil
+	err = self.sendUntrackDeadLetter(conn, service, username, id)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	err = sendUnindex(conn, indexes, id)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (self *redisMessageCache) Replace(service, username, id string, msg *proto.Message) (ok bool, err error) {
+	defer func() {
+		self.logError("replace", service, username, err)
+	}()
+	key := msgKey(service, username, id)
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	mc, err := msgUnmarshal(data)
+	if err != nil {
+		return
+	}
+	ttl, err := redis.Int64(conn.Do("PTTL", key))
+	if err != nil || ttl == -2 {
+		return
+	}
+	removed, added := diffKeys(self.indexKeys(service, username, mc.Message), self.indexKeys(service, username, msg))
+	ttls, err := indexTTLs(conn, added)
+	if err != nil {
+		return
+	}
+	mc.Message = msg
+	data, err = msgMarshal(mc)
+	if err != nil {
+		return
+	}
+
+	// XX leaves alone a message which has expired in the meantime.
+	args := redis.Args{key, data, "XX"}
+	if ttl > 0 {
+		args = args.Add("PX", ttl)
+	}
+	reply, err := conn.Do("SET", args...)
+	if err != nil || reply == nil {
+		return
+	}
+	ok = true
+	if ttl > 0 && self.tracksDeadLetters(service) {
+		dttl := ttl + int64(DeadLetterRetention/time.Millisecond)
+		_, err = conn.Do("SET", deadLetterKey(service, username, id), data, "XX", "PX", dttl)
+		if err != nil {
+			return
+		}
+	}
+	if len(removed) == 0 && len(added) == 0 {
+		return
+	}
+	err = self.reindex(conn, id, int64(mc.Seq), ttl, removed, added, ttls)
+	return
+}
+
+// reindex moves a replaced message from the indexes of the old message
+// to the ones of the new message. ttl is the TTL of the message in
+// milliseconds, as told by PTTL.
+func (self *redisMessageCache) reindex(conn redis.Conn, id string, seq, ttl int64, removed, added []string, ttls []int64) (err error) {
+	err = conn.Send("MULTI")
+	if err != nil {
+		return
+	}
+	err = sendUnindex(conn, removed, id)
+	if err != nil {
+		conn.Do("DISCARD")
+		return
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	err = sendIndex(conn, added, ttls, id, seq, ttl)
+	if err != nil {
+		conn.Do("DISCARD")
+		return
+	}
+	_, err = conn.Do("EXEC")
+	return
+}
+
+// diffKeys returns the keys in a but not in b, and the ones in b but
+// not in a.
+func diffKeys(a, b []string) (onlyA, onlyB []string) {
+	in := make(map[string]bool, len(a)+len(b))
+	for _, k := range b {
+		in[k] = true
+	}
+	for _, k := range a {
+		if !in[k] {
+			onlyA = append(onlyA, k)
+		}
+	}
+	in = make(map[string]bool, len(a))
+	for _, k := range a {
+		in[k] = true
+	}
+	for _, k := range b {
+		if !in[k] {
+			onlyB = append(onlyB, k)
+		}
+	}
+	return
 }
-*/
 
 /*
  * We may not need get then delete.
@@ -301,6 +630,11 @@ func (self *redisMessageCache) GetThenDel(service, username, id string) (msg *pr
 */
 
 func (self *redisMessageCache) GetCachedMessages(service, username string, excludes ...string) (msgs []*proto.MessageContainer, err error) {
+	span := tracing.Start("cache.get-all", "", "service", service, "username", username)
+	defer func() {
+		self.logError("get-all", service, username, err)
+		tracing.End(span, err)
+	}()
 	msgQK := msgQueueKey(service, username)
 	conn := self.pool.Get()
 	defer conn.Close()
@@ -309,18 +643,16 @@ func (self *redisMessageCache) GetCachedMessages(service, username string, exclu
 	if err != nil {
 		return
 	}
-	err = conn.Send("SORT", msgQK,
-		"BY",
-		msgWeightPattern(service, username),
-		"GET",
-		msgKeyPattern(service, username))
+	order := []interface{}{msgQK, "BY", msgWeightPattern(service, username)}
+	if self.orderedIds {
+		order = []interface{}{msgQK, "ALPHA"}
+	}
+	err = conn.Send("SORT", append(order, "GET", msgKeyPattern(service, username))...)
 	if err != nil {
 		conn.Do("DISCARD")
 		return
 	}
-	err = conn.Send("SORT", msgQK,
-		"BY",
-		msgWeightPattern(service, username))
+	err = conn.Send("SORT", order...)
 	if err != nil {
 		conn.Do("DISCARD")
 		return
@@ -350,6 +682,11 @@ func (self *redisMessageCache) GetCachedMessages(service, username string, exclu
 	if n == 0 {
 		return
 	}
+	excluded := make(map[string]bool, len(excludes))
+	for _, id := range excludes {
+		excluded[id] = true
+	}
+	origins := make(map[string]bool)
 	msgShadow := make([]*proto.MessageContainer, 0, n)
 	removed := make([]interface{}, 1, n+1)
 	removed[0] = msgQK
@@ -376,14 +713,18 @@ func (self *redisMessageCache) GetCachedMessages(service, username string, exclu
 			continue
 		}
 		msg, err = msgUnmarshal(data)
-		skip := false
-		for _, d := range excludes {
-			if d == msg.Id {
-				skip = true
-				break
+		if err != nil {
+			return
+		}
+		if len(msg.OriginId) > 0 {
+			if origins[msg.OriginId] {
+				// A copy cached by a node which died before
+				// claiming the origin id.
+				continue
 			}
+			origins[msg.OriginId] = true
 		}
-		if !skip {
+		if !excluded[msg.Id] {
 			msgShadow = append(msgShadow, msg)
 		}
 	}
@@ -397,3 +738,244 @@ func (self *redisMessageCache) GetCachedMessages(service, username string, exclu
 	msgs = msgShadow
 	return
 }
+
+func (self *redisMessageCache) GetMessagesBySeq(service, username string, from, to uint64) (msgs []*proto.MessageContainer, err error) {
+	span := tracing.Start("cache.get-seq", "", "service", service, "username", username)
+	defer func() {
+		self.logError("get-seq", service, username, err)
+		tracing.End(span, err)
+	}()
+	seqKey := msgSeqKey(service, username)
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	max := "+inf"
+	if to > 0 {
+		max = strconv.FormatUint(to, 10)
+	}
+	ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", seqKey, from, max))
+	if err != nil {
+		return
+	}
+	msgs, err = self.getIndexed(conn, seqKey, service, username, ids)
+	return
+}
+
+func (self *redisMessageCache) GetMessagesByThread(service, username, threadId string) (msgs []*proto.MessageContainer, err error) {
+	span := tracing.Start("cache.get-thread", "", "service", service, "username", username)
+	defer func() {
+		self.logError("get-thread", service, username, err)
+		tracing.End(span, err)
+	}()
+	threadKey := msgThreadKey(service, username, threadId)
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", threadKey, "-inf", "+inf"))
+	if err != nil {
+		return
+	}
+	msgs, err = self.getIndexed(conn, threadKey, service, username, ids)
+	return
+}
+
+// getIndexed returns the messages of the ids in the sorted set
+// indexKey, in the same order. The ids of the messages which have
+// expired or been deleted are removed from the set.
+func (self *redisMessageCache) getIndexed(conn redis.Conn, indexKey, service, username string, ids []string) (msgs []*proto.MessageContainer, err error) {
+	if len(ids) == 0 {
+		return
+	}
+	err = conn.Send("MULTI")
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		err = conn.Send("GET", msgKey(service, username, id))
+		if err != nil {
+			conn.Do("DISCARD")
+			return
+		}
+	}
+	msgObjs, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return
+	}
+
+	msgShadow := make([]*proto.MessageContainer, 0, len(msgObjs))
+	removed := make([]interface{}, 1, len(msgObjs)+1)
+	removed[0] = indexKey
+	for i, obj := range msgObjs {
+		if obj == nil {
+			// The message has expired or been deleted.
+			if i < len(ids) {
+				removed = append(removed, ids[i])
+			}
+			continue
+		}
+		var data []byte
+		data, err = redis.Bytes(obj, nil)
+		if err != nil {
+			return
+		}
+		var mc *proto.MessageContainer
+		mc, err = msgUnmarshal(data)
+		if err != nil {
+			return
+		}
+		msgShadow = append(msgShadow, mc)
+	}
+	if len(removed) > 1 {
+		_, err = conn.Do("ZREM", removed...)
+		if err != nil {
+			return
+		}
+	}
+	msgs = msgShadow
+	return
+}
+
+const stateCachedField = "cached"
+
+func (self *redisMessageCache) UpdateDeliveryState(service, username, id string, state DeliveryStatus) (err error) {
+	defer func() {
+		self.logError("update-state", service, username, err)
+	}()
+	skey := msgStateKey(service, username, id)
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	// Don't create a state for a message which does not exist.
+	reply, err := conn.Do("EXISTS", skey)
+	if err != nil {
+		return err
+	}
+	exists, err := redis.Bool(reply, err)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+	err = conn.Send("HSETNX", skey, state.String(), time.Now().UnixNano())
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	err = conn.Send("SREM", undeliveredKey(service, username), id)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	err = self.sendUntrackDeadLetter(conn, service, username, id)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (self *redisMessageCache) GetDeliveryState(service, username, id string) (state *DeliveryState, err error) {
+	skey := msgStateKey(service, username, id)
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do("HGETALL", skey)
+	if err != nil {
+		return
+	}
+	fields, err := redis.Strings(reply, err)
+	if err != nil {
+		return
+	}
+	if len(fields) == 0 {
+		return
+	}
+	state = new(DeliveryState)
+	for i := 0; i+1 < len(fields); i += 2 {
+		var ns int64
+		ns, err = strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			state = nil
+			return
+		}
+		t := time.Unix(0, ns)
+		switch fields[i] {
+		case stateCachedField:
+			state.Cached = t
+		case STATE_DELIVERED.String():
+			state.Delivered = t
+		case STATE_ACKED.String():
+			state.Acked = t
+		case STATE_READ.String():
+			state.Read = t
+		}
+	}
+	return
+}
+
+func (self *redisMessageCache) NrUndelivered(service, username string) (n int, err error) {
+	ukey := undeliveredKey(service, username)
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return
+	}
+	err = conn.Send("SORT", ukey, "BY", "nosort", "GET", msgKeyPattern(service, username))
+	if err != nil {
+		conn.Do("DISCARD")
+		return
+	}
+	err = conn.Send("SORT", ukey, "BY", "nosort")
+	if err != nil {
+		conn.Do("DISCARD")
+		return
+	}
+	reply, err := conn.Do("EXEC")
+	if err != nil {
+		return
+	}
+	bulkReply, err := redis.Values(reply, err)
+	if err != nil {
+		return
+	}
+	if len(bulkReply) != 2 {
+		return
+	}
+	msgObjs, err := redis.Values(bulkReply[0], nil)
+	if err != nil {
+		return
+	}
+	msgIds, err := redis.Values(bulkReply[1], nil)
+	if err != nil {
+		return
+	}
+
+	// Remove the ids of expired messages
+	removed := make([]interface{}, 1, len(msgObjs)+1)
+	removed[0] = ukey
+	for i, obj := range msgObjs {
+		if obj != nil {
+			n++
+			continue
+		}
+		if i < len(msgIds) {
+			id, e := redis.String(msgIds[i], nil)
+			if e == nil {
+				removed = append(removed, id)
+			}
+		}
+	}
+	if len(removed) > 1 {
+		_, err = conn.Do("SREM", removed...)
+	}
+	return
+}
@@ -92,6 +92,25 @@ func TestGetSetMessage(t *testing.T) {
 	}
 }
 
+func TestGetSetMessageWithBinaryHeader(t *testing.T) {
+	cache := getCache()
+	defer clearDb()
+	msg := &proto.MessageContainer{Message: randomMessage()}
+	msg.Message.BinaryHeader = map[string][]byte{"proto": []byte{0, 0xFF, 0, 1}}
+
+	id, err := cache.CacheMessage("srv", "usr", msg, 0*time.Second)
+	if err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	m, err := cache.Get("srv", "usr", id)
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	if m == nil || !m.Message.Eq(msg.Message) {
+		t.Errorf("binary header is not preserved: %v", m)
+	}
+}
+
 func TestGetSetMessageTTL(t *testing.T) {
 	N := 10
 	msgs := multiRandomMessage(N)
@@ -123,6 +142,58 @@ func TestGetSetMessageTTL(t *testing.T) {
 	}
 }
 
+func TestMessageExpiresAt(t *testing.T) {
+	cache := getCache()
+	defer clearDb()
+	msg := multiRandomMessage(1)[0]
+	start := time.Now()
+	// Less than a second is not forever.
+	id, err := cache.CacheMessage("srv", "usr", msg, 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	m, err := cache.Get("srv", "usr", id)
+	if err != nil || m == nil {
+		t.Fatalf("Get error: %v %v", m, err)
+	}
+	if expires := time.Unix(0, m.ExpiresAt); expires.Before(start.Add(500*time.Millisecond)) || expires.After(time.Now().Add(500*time.Millisecond)) {
+		t.Errorf("bad expiration time: %v", expires)
+	}
+	time.Sleep(time.Second)
+	if m, err = cache.Get("srv", "usr", id); err != nil || m != nil {
+		t.Errorf("the message should have expired: %v %v", m, err)
+	}
+}
+
+func TestReplaceMessage(t *testing.T) {
+	cache := getCache()
+	defer clearDb()
+	mc := &proto.MessageContainer{Message: randomMessage(), Sender: "bob"}
+	id, err := cache.CacheMessage("srv", "usr", mc, time.Second)
+	if err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	msg := randomMessage()
+	ok, err := cache.Replace("srv", "usr", id, msg)
+	if err != nil || !ok {
+		t.Fatalf("Replace error: %v %v", ok, err)
+	}
+	m, err := cache.Get("srv", "usr", id)
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	if m == nil || !m.Message.Eq(msg) || m.Seq != mc.Seq || m.Sender != "bob" {
+		t.Errorf("bad replaced message: %+v", m)
+	}
+	time.Sleep(2 * time.Second)
+	if m, _ := cache.Get("srv", "usr", id); m != nil {
+		t.Errorf("the replaced message should expire")
+	}
+	if ok, err = cache.Replace("srv", "usr", id, msg); err != nil || ok {
+		t.Errorf("an expired message is replaced: %v %v", ok, err)
+	}
+}
+
 func TestCacheThenRetrieveAll(t *testing.T) {
 	N := 10
 	msgs := multiRandomMessage(N)
@@ -155,6 +226,49 @@ func TestCacheThenRetrieveAll(t *testing.T) {
 	}
 }
 
+func TestCacheMessageOnce(t *testing.T) {
+	// Two nodes sharing the database.
+	caches := []Cache{getCache(), getCache()}
+	defer clearDb()
+	msgs := multiRandomMessage(2)
+	for _, mc := range msgs {
+		mc.OriginId = "origin"
+	}
+	id, dup, err := caches[0].CacheMessageOnce("srv", "usr", msgs[0], time.Hour)
+	if err != nil || dup {
+		t.Fatalf("Set error: %v %v", dup, err)
+	}
+	id2, dup, err := caches[1].CacheMessageOnce("srv", "usr", msgs[1], time.Hour)
+	if err != nil || !dup {
+		t.Fatalf("Set error: %v %v", dup, err)
+	}
+	if id2 != id || msgs[1].Id != id || msgs[1].Seq != msgs[0].Seq {
+		t.Errorf("the duplicate is %v/%v, not %v/%v", msgs[1].Id, msgs[1].Seq, id, msgs[0].Seq)
+	}
+	if n, err := caches[0].NrUndelivered("srv", "usr"); err != nil || n != 1 {
+		t.Errorf("%v undelivered messages: %v", n, err)
+	}
+
+	// A copy left by a node which died before claiming the origin id.
+	left := &proto.MessageContainer{Message: randomMessage(), OriginId: "origin"}
+	_, err = caches[1].CacheMessage("srv", "usr", left, time.Hour)
+	if err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	other := &proto.MessageContainer{Message: randomMessage()}
+	_, err = caches[1].CacheMessage("srv", "usr", other, time.Hour)
+	if err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	all, err := caches[0].GetCachedMessages("srv", "usr")
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	if len(all) != 2 || all[0].Id != id || all[1].Id != other.Id {
+		t.Errorf("bad cached messages: %v", all)
+	}
+}
+
 func TestGetNonExistMsg(t *testing.T) {
 	cache := getCache()
 	defer clearDb()
@@ -212,3 +326,416 @@ func TestCacheThenRetrieveAllWithTTL(t *testing.T) {
 		}
 	}
 }
+
+func TestCacheThenRetrieveBySeq(t *testing.T) {
+	N := 10
+	msgs := multiRandomMessage(N)
+	cache := getCache()
+	defer clearDb()
+	srv := "srv"
+	usr := "usr"
+
+	for i, msg := range msgs {
+		_, err := cache.CacheMessage(srv, usr, msg, 0*time.Second)
+		if err != nil {
+			t.Errorf("Set error: %v", err)
+			return
+		}
+		if msg.Seq != uint64(i+1) {
+			t.Errorf("%vth message has sequence number %v", i, msg.Seq)
+			return
+		}
+	}
+
+	// Other users should have their own sequence numbers.
+	other := multiRandomMessage(1)[0]
+	_, err := cache.CacheMessage(srv, "other", other, 0*time.Second)
+	if err != nil {
+		t.Errorf("Set error: %v", err)
+		return
+	}
+	if other.Seq != 1 {
+		t.Errorf("other user's message has sequence number %v", other.Seq)
+	}
+
+	retrievedMsgs, err := cache.GetMessagesBySeq(srv, usr, 3, 5)
+	if err != nil {
+		t.Errorf("Get error: %v", err)
+		return
+	}
+	if len(retrievedMsgs) != 3 {
+		t.Errorf("retrieved %v objects", len(retrievedMsgs))
+		return
+	}
+	for i, mc := range retrievedMsgs {
+		if !mc.Eq(msgs[i+2]) {
+			t.Errorf("%vth message does not same", i)
+		}
+	}
+
+	retrievedMsgs, err = cache.GetMessagesBySeq(srv, usr, 8, 0)
+	if err != nil {
+		t.Errorf("Get error: %v", err)
+		return
+	}
+	if len(retrievedMsgs) != 3 {
+		t.Errorf("retrieved %v objects", len(retrievedMsgs))
+	}
+}
+
+func TestCacheThenRetrieveBySeqWithTTL(t *testing.T) {
+	N := 5
+	msgs := multiRandomMessage(N)
+	cache := getCache()
+	defer clearDb()
+	srv := "srv"
+	usr := "usr"
+
+	for i, msg := range msgs {
+		ttl := 0
+		if i%2 == 1 {
+			ttl = 1
+		}
+		_, err := cache.CacheMessage(srv, usr, msg, time.Duration(ttl)*time.Second)
+		if err != nil {
+			t.Errorf("Set error: %v", err)
+			return
+		}
+	}
+	time.Sleep(2 * time.Second)
+	retrievedMsgs, err := cache.GetMessagesBySeq(srv, usr, 1, 0)
+	if err != nil {
+		t.Errorf("Get error: %v", err)
+		return
+	}
+	if len(retrievedMsgs) != 3 {
+		t.Errorf("retrieved %v objects", len(retrievedMsgs))
+		return
+	}
+	for i, mc := range retrievedMsgs {
+		if mc.Seq != uint64(2*i+1) {
+			t.Errorf("%vth message has sequence number %v", i, mc.Seq)
+		}
+	}
+}
+
+func TestCacheThenRetrieveByThread(t *testing.T) {
+	N := 6
+	msgs := multiRandomMessage(N)
+	cache := getCache()
+	defer clearDb()
+	srv := "srv"
+	usr := "usr"
+
+	for i, msg := range msgs {
+		if i%2 == 0 {
+			msg.Message.ThreadId = "thread"
+		}
+		_, err := cache.CacheMessage(srv, usr, msg, 0*time.Second)
+		if err != nil {
+			t.Errorf("Set error: %v", err)
+			return
+		}
+	}
+	cache.Del(srv, usr, msgs[2].Id)
+
+	retrievedMsgs, err := cache.GetMessagesByThread(srv, usr, "thread")
+	if err != nil {
+		t.Errorf("Get error: %v", err)
+		return
+	}
+	if len(retrievedMsgs) != 2 {
+		t.Errorf("retrieved %v objects", len(retrievedMsgs))
+		return
+	}
+	if !retrievedMsgs[0].Eq(msgs[0]) || !retrievedMsgs[1].Eq(msgs[4]) {
+		t.Errorf("wrong messages in the thread")
+	}
+
+	retrievedMsgs, err = cache.GetMessagesByThread(srv, usr, "other")
+	if err != nil {
+		t.Errorf("Get error: %v", err)
+		return
+	}
+	if len(retrievedMsgs) != 0 {
+		t.Errorf("retrieved %v objects", len(retrievedMsgs))
+	}
+}
+
+func TestDeliveryState(t *testing.T) {
+	N := 10
+	msgs := multiRandomMessage(N)
+	cache := getCache()
+	defer clearDb()
+	srv := "srv"
+	usr := "usr"
+
+	ids := make([]string, N)
+	for i, msg := range msgs {
+		id, err := cache.CacheMessage(srv, usr, msg, 0*time.Second)
+		if err != nil {
+			t.Errorf("Set error: %v", err)
+			return
+		}
+		ids[i] = id
+	}
+	n, err := cache.NrUndelivered(srv, usr)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if n != N {
+		t.Errorf("%v undelivered messages; should be %v", n, N)
+	}
+
+	nrDelivered := 3
+	for _, id := range ids[:nrDelivered] {
+		err = cache.UpdateDeliveryState(srv, usr, id, STATE_DELIVERED)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+	}
+	err = cache.UpdateDeliveryState(srv, usr, ids[0], STATE_ACKED)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	n, err = cache.NrUndelivered(srv, usr)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if n != N-nrDelivered {
+		t.Errorf("%v undelivered messages; should be %v", n, N-nrDelivered)
+	}
+
+	state, err := cache.GetDeliveryState(srv, usr, ids[0])
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if state == nil || !state.IsDelivered() || !state.IsAcked() || state.IsRead() {
+		t.Errorf("wrong state: %+v", state)
+	}
+	state, err = cache.GetDeliveryState(srv, usr, ids[N-1])
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if state == nil || state.Cached.IsZero() || state.IsDelivered() {
+		t.Errorf("wrong state: %+v", state)
+	}
+
+	state, err = cache.GetDeliveryState(srv, usr, "wont-be-a-good-message-id")
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if state != nil {
+		t.Errorf("should be nil state")
+	}
+}
+
+func TestDeliveryStateOutlivesMessage(t *testing.T) {
+	msg := multiRandomMessage(1)[0]
+	cache := getCache()
+	defer clearDb()
+	srv := "srv"
+	usr := "usr"
+
+	id, err := cache.CacheMessage(srv, usr, msg, 1*time.Second)
+	if err != nil {
+		t.Errorf("Set error: %v", err)
+		return
+	}
+	err = cache.UpdateDeliveryState(srv, usr, id, STATE_DELIVERED)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	time.Sleep(2 * time.Second)
+	state, err := cache.GetDeliveryState(srv, usr, id)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if state == nil || !state.IsDelivered() {
+		t.Errorf("the state of an expired message is lost: %+v", state)
+	}
+	n, err := cache.NrUndelivered(srv, usr)
+	if err != nil || n != 0 {
+		t.Errorf("%v undelivered messages: %v", n, err)
+	}
+}
+
+func TestDelMessage(t *testing.T) {
+	N := 3
+	msgs := multiRandomMessage(N)
+	cache := getCache()
+	defer clearDb()
+	srv := "srv"
+	usr := "usr"
+
+	ids := make([]string, N)
+	for i, msg := range msgs {
+		id, err := cache.CacheMessage(srv, usr, msg, 0*time.Second)
+		if err != nil {
+			t.Errorf("Set error: %v", err)
+			return
+		}
+		ids[i] = id
+	}
+	cache.UpdateDeliveryState(srv, usr, ids[1], STATE_DELIVERED)
+	err := cache.Del(srv, usr, ids[1])
+	if err != nil {
+		t.Errorf("Del error: %v", err)
+		return
+	}
+	if mc, _ := cache.Get(srv, usr, ids[1]); mc != nil {
+		t.Errorf("message should be deleted: %+v", mc)
+	}
+	all, _ := cache.GetCachedMessages(srv, usr)
+	bySeq, _ := cache.GetMessagesBySeq(srv, usr, 1, 0)
+	if len(all) != N-1 || len(bySeq) != N-1 {
+		t.Errorf("retrieved %v and %v objects", len(all), len(bySeq))
+	}
+	state, _ := cache.GetDeliveryState(srv, usr, ids[1])
+	if state == nil || !state.IsDelivered() {
+		t.Errorf("state should be kept: %+v", state)
+	}
+}
+
+func TestQueryByHeaders(t *testing.T) {
+	N := 6
+	msgs := multiRandomMessage(N)
+	cache := getCache()
+	defer clearDb()
+	srv := "srv"
+	usr := "usr"
+	cache.IndexHeaders(srv, "type", "room")
+
+	for i, msg := range msgs {
+		msg.Message.Header = map[string]string{"room": "lobby"}
+		if i%2 == 0 {
+			msg.Message.Header["type"] = "invite"
+		}
+		_, err := cache.CacheMessage(srv, usr, msg, 0*time.Second)
+		if err != nil {
+			t.Errorf("Set error: %v", err)
+			return
+		}
+	}
+	cache.UpdateDeliveryState(srv, usr, msgs[2].Id, STATE_READ)
+	msgs[4].Message.Header["room"] = "kitchen"
+	cache.Replace(srv, usr, msgs[4].Id, msgs[4].Message)
+
+	p := &Predicate{Headers: map[string]string{"type": "invite"}}
+	retrievedMsgs, err := cache.Query(srv, usr, p)
+	if err != nil {
+		t.Errorf("Query error: %v", err)
+		return
+	}
+	if len(retrievedMsgs) != 3 || !retrievedMsgs[1].Eq(msgs[2]) {
+		t.Errorf("retrieved %v objects", len(retrievedMsgs))
+	}
+
+	p.Unread = true
+	p.Headers["room"] = "lobby"
+	retrievedMsgs, err = cache.Query(srv, usr, p)
+	if err != nil {
+		t.Errorf("Query error: %v", err)
+		return
+	}
+	if len(retrievedMsgs) != 1 || !retrievedMsgs[0].Eq(msgs[0]) {
+		t.Errorf("retrieved %v objects", len(retrievedMsgs))
+	}
+
+	retrievedMsgs, err = cache.Query(srv, usr, nil)
+	if err != nil || len(retrievedMsgs) != N {
+		t.Errorf("retrieved %v objects: %v", len(retrievedMsgs), err)
+	}
+
+	p = &Predicate{Headers: map[string]string{"sender": "alice"}}
+	_, err = cache.Query(srv, usr, p)
+	if err != ErrNotIndexed {
+		t.Errorf("should not query a field which is not indexed: %v", err)
+	}
+
+	// The invites in the lobby, one page at a time.
+	p = &Predicate{Headers: map[string]string{"type": "invite", "room": "lobby"}, Limit: 1}
+	retrievedMsgs, err = cache.Query(srv, usr, p)
+	if err != nil || len(retrievedMsgs) != 1 || !retrievedMsgs[0].Eq(msgs[0]) {
+		t.Fatalf("bad first page: %v %v", retrievedMsgs, err)
+	}
+	p.After = retrievedMsgs[0].Seq
+	retrievedMsgs, err = cache.Query(srv, usr, p)
+	if err != nil || len(retrievedMsgs) != 1 || !retrievedMsgs[0].Eq(msgs[2]) {
+		t.Fatalf("bad second page: %v %v", retrievedMsgs, err)
+	}
+	p.After = retrievedMsgs[0].Seq
+	retrievedMsgs, err = cache.Query(srv, usr, p)
+	if err != nil || len(retrievedMsgs) != 0 {
+		t.Errorf("bad last page: %v %v", retrievedMsgs, err)
+	}
+	conn := cache.(*redisMessageCache).pool.Get()
+	defer conn.Close()
+	if keys, _ := redis.Strings(conn.Do("KEYS", "mquery:*")); len(keys) != 0 {
+		t.Errorf("the intersection is kept: %v", keys)
+	}
+}
+
+func TestIndexExpiry(t *testing.T) {
+	cache := getCache()
+	defer clearDb()
+	srv := "srv"
+	usr := "usr"
+	cache.IndexHeaders(srv, "type")
+	conn := cache.(*redisMessageCache).pool.Get()
+	defer conn.Close()
+	threadKey := msgThreadKey(srv, usr, "t")
+	headerKey := msgHeaderKey(srv, usr, "type", "invite")
+
+	mc := &proto.MessageContainer{Message: &proto.Message{ThreadId: "t", Header: map[string]string{"type": "invite"}}}
+	short, err := cache.CacheMessage(srv, usr, mc, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc = &proto.MessageContainer{Message: &proto.Message{ThreadId: "t", Header: map[string]string{"type": "invite"}}}
+	long, err := cache.CacheMessage(srv, usr, mc, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{threadKey, headerKey} {
+		ttl, _ := redis.Int64(conn.Do("PTTL", key))
+		if ttl <= int64(time.Minute/time.Millisecond) || ttl > int64(time.Hour/time.Millisecond) {
+			t.Errorf("%v should expire with the last message: %v", key, ttl)
+		}
+	}
+
+	// A replaced message is moved to its new indexes.
+	cache.Replace(srv, usr, long, &proto.Message{ThreadId: "t", Header: map[string]string{"type": "reply"}})
+	if score, _ := conn.Do("ZSCORE", headerKey, long); score != nil {
+		t.Errorf("the replaced message is still indexed by its old header")
+	}
+	if score, _ := conn.Do("ZSCORE", msgHeaderKey(srv, usr, "type", "reply"), long); score == nil {
+		t.Errorf("the replaced message is not indexed by its new header")
+	}
+
+	if err = cache.Del(srv, usr, short); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{threadKey, headerKey} {
+		if score, _ := conn.Do("ZSCORE", key, short); score != nil {
+			t.Errorf("the deleted message is still in %v", key)
+		}
+	}
+
+	mc = &proto.MessageContainer{Message: &proto.Message{ThreadId: "t"}}
+	if _, err = cache.CacheMessage(srv, usr, mc, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := redis.Int64(conn.Do("PTTL", threadKey)); ttl != -1 {
+		t.Errorf("the thread of a message which never expires should not expire: %v", ttl)
+	}
+}
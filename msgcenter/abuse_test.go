@@ -0,0 +1,178 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/audit"
+	"github.com/uniqush/uniqush-conn/evthandler"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/testsupport"
+	"testing"
+	"time"
+)
+
+// senderScorer gives the verdict of each sender after delay.
+type senderScorer struct {
+	actions map[string]string
+	delay   time.Duration
+	history chan []*audit.Record
+}
+
+func (self *senderScorer) Score(req *evthandler.AbuseRequest) (verdict *evthandler.AbuseVerdict, err error) {
+	time.Sleep(self.delay)
+	if self.history != nil {
+		self.history <- req.History
+	}
+	verdict = &evthandler.AbuseVerdict{Action: self.actions[req.Sender], Reason: "spam"}
+	return
+}
+
+func forwardAndWait(center *serviceCenter, sender string) (status, msgId string) {
+	fwdreq := forwardFrom(sender)
+	fwdreq.Reply = func(s, id string) {
+		status = s
+		msgId = id
+	}
+	center.ReceiveForward(fwdreq)
+	return
+}
+
+// waitFor polls cond for at most a second.
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func isCached(cache *testsupport.MockCache, id string) bool {
+	mc, _ := cache.Get("srv", "alice", id)
+	return mc != nil
+}
+
+func TestShadowDropForward(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		ForwardRequestHandler: allowForward{},
+		ForwardAudit:          audit.NewMemoryStore(0),
+		AbuseScorer:           &senderScorer{actions: map[string]string{"eve": evthandler.ABUSE_SHADOW_DROP}},
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+	status, dropped := forwardAndWait(center, "eve")
+	if status != proto.FWD_OK || len(dropped) == 0 {
+		t.Errorf("the sender should not tell a shadow-dropped message: %v %v", status, dropped)
+	}
+	if !waitFor(func() bool { return !isCached(cache, dropped) }) {
+		t.Errorf("a shadow-dropped message is not recalled")
+	}
+	status, id := forwardAndWait(center, "bob")
+	if status != proto.FWD_OK || !isCached(cache, id) {
+		t.Errorf("an accepted message should be delivered: %v %v", status, cache.Calls())
+	}
+	var records []*audit.Record
+	waitFor(func() bool {
+		records, _ = conf.ForwardAudit.Query(&audit.Query{Service: "srv", Username: "alice"})
+		return len(records) == 2
+	})
+	verdicts := make(map[string]string, 2)
+	for _, rec := range records {
+		verdicts[rec.Sender] = rec.Verdict
+	}
+	if len(records) != 2 || verdicts["eve"] != evthandler.ABUSE_SHADOW_DROP || verdicts["bob"] != evthandler.ABUSE_ACCEPT {
+		t.Errorf("bad audit records: %v", records)
+	}
+}
+
+func nextFlag(t *testing.T, ch <-chan *Event) *Event {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case evt := <-ch:
+			if evt.Type == EVENT_FLAG {
+				return evt
+			}
+		case <-timeout:
+			t.Fatalf("the verdict is not flagged")
+		}
+	}
+}
+
+func TestFlagForward(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	scorer := &senderScorer{
+		actions: map[string]string{"eve": evthandler.ABUSE_FLAG},
+		history: make(chan []*audit.Record, 2),
+	}
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		ForwardRequestHandler: allowForward{},
+		ForwardAudit:          audit.NewMemoryStore(0),
+		AbuseScorer:           scorer,
+	}
+	events := newEventBus()
+	ch := make(chan *Event, 10)
+	events.listen(ch)
+	center := newServiceCenter("srv", conf, nil, nil, events, nil)
+	forwardAndWait(center, "eve")
+	nextFlag(t, ch)
+	waitFor(func() bool {
+		records, _ := conf.ForwardAudit.Query(&audit.Query{Service: "srv", Username: "eve", Direction: audit.DIRECTION_SENT})
+		return len(records) == 1
+	})
+	status, id := forwardAndWait(center, "eve")
+	if status != proto.FWD_OK || !isCached(cache, id) {
+		t.Errorf("a flagged message should be delivered: %v %v", status, cache.Calls())
+	}
+	if h := <-scorer.history; len(h) != 0 {
+		t.Errorf("eve has not sent anything before: %v", h)
+	}
+	if h := <-scorer.history; len(h) != 1 || h[0].Sender != "eve" || h[0].Verdict != evthandler.ABUSE_FLAG {
+		t.Errorf("bad history of eve: %v", h)
+	}
+	if flag := nextFlag(t, ch); flag.Username != "eve" || flag.Receiver != "alice" || flag.MessageId != id || flag.Reason != "spam" {
+		t.Errorf("bad flag: %+v", flag)
+	}
+	if !isCached(cache, id) {
+		t.Errorf("a flagged message should be kept")
+	}
+}
+
+func TestScoreAfterDelivery(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		ForwardRequestHandler: allowForward{},
+		AbuseScorer:           &senderScorer{actions: map[string]string{"eve": evthandler.ABUSE_SHADOW_DROP}, delay: 200 * time.Millisecond},
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+	start := time.Now()
+	status, id := forwardAndWait(center, "eve")
+	if status != proto.FWD_OK || !isCached(cache, id) {
+		t.Errorf("a message should be delivered before it is scored: %v %v", status, cache.Calls())
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Errorf("the request waited for %v", d)
+	}
+	if !waitFor(func() bool { return !isCached(cache, id) }) {
+		t.Errorf("the late verdict does not recall the message")
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"sort"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/asset"
+	"github.com/uniqush/uniqush-conn/proto/server"
+)
+
+const defaultAssetRefresh = time.Minute
+
+// sendAssets queues the latest version of every asset for a new
+// connection. A version published meanwhile may be sent to it first:
+// the clients ignore the versions older than the ones they have.
+func (self *serviceCenter) sendAssets(conn server.Conn) {
+	if self.config.Assets == nil {
+		return
+	}
+	assets, err := self.config.Assets.Latest(self.serviceName)
+	if err != nil {
+		self.reportError(self.serviceName, conn.Username(), conn.ConnId(), "", err)
+		return
+	}
+	self.queueAssets(conn, assets...)
+}
+
+// queueAssets queues the assets to be sent to the connection, keeping
+// only the latest version of each, and starts sending them unless it
+// is being done. A slow connection thus never holds the others up.
+func (self *serviceCenter) queueAssets(conn server.Conn, assets ...*asset.Asset) {
+	if len(assets) == 0 {
+		return
+	}
+	self.assetLock.Lock()
+	pending, sending := self.assetPushes[conn]
+	if !sending {
+		pending = make(map[string]*asset.Asset, len(assets))
+		self.assetPushes[conn] = pending
+	}
+	for _, a := range assets {
+		if p, ok := pending[a.Name]; !ok || p.Version < a.Version {
+			pending[a.Name] = a
+		}
+	}
+	self.assetLock.Unlock()
+	if !sending {
+		go self.sendQueuedAssets(conn)
+	}
+}
+
+// sendQueuedAssets sends the assets queued for the connection, by
+// name, until there is none left or the connection fails.
+func (self *serviceCenter) sendQueuedAssets(conn server.Conn) {
+	for {
+		self.assetLock.Lock()
+		pending := self.assetPushes[conn]
+		if len(pending) == 0 {
+			delete(self.assetPushes, conn)
+			self.assetLock.Unlock()
+			return
+		}
+		self.assetPushes[conn] = make(map[string]*asset.Asset, 1)
+		self.assetLock.Unlock()
+
+		names := make([]string, 0, len(pending))
+		for name := range pending {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := conn.SendAsset(pending[name]); err != nil {
+				self.reportError(self.serviceName, conn.Username(), conn.ConnId(), "", err)
+				self.assetLock.Lock()
+				delete(self.assetPushes, conn)
+				self.assetLock.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// isNewAsset tells whether the version has not been pushed to the
+// connections yet, and records it.
+func (self *serviceCenter) isNewAsset(a *asset.Asset) bool {
+	self.assetLock.Lock()
+	defer self.assetLock.Unlock()
+	if self.assetVersions[a.Name] >= a.Version {
+		return false
+	}
+	self.assetVersions[a.Name] = a.Version
+	return true
+}
+
+// pushedVersion returns the latest version of the asset pushed to the
+// connections.
+func (self *serviceCenter) pushedVersion(name string) uint64 {
+	self.assetLock.Lock()
+	defer self.assetLock.Unlock()
+	return self.assetVersions[name]
+}
+
+// pushAsset queues the asset for every connection on this node, unless
+// it has already been pushed. It returns the number of connections.
+func (self *serviceCenter) pushAsset(a *asset.Asset) int {
+	if !self.isNewAsset(a) {
+		return 0
+	}
+	n := 0
+	for _, username := range self.ConnectedUsers() {
+		for _, conn := range self.Conns(username) {
+			self.queueAssets(conn, a)
+			n++
+		}
+	}
+	return n
+}
+
+// PublishAsset stores a new version of the asset and pushes it to the
+// connections on this node. The other nodes push it once they find it.
+func (self *serviceCenter) PublishAsset(name string, data []byte) (a *asset.Asset, err error) {
+	if self.config.Assets == nil {
+		err = ErrNoAssets
+		return
+	}
+	a, err = self.config.Assets.Publish(self.serviceName, name, data)
+	if err != nil {
+		return
+	}
+	self.pushAsset(a)
+	return
+}
+
+// pushNewAssets fetches and pushes the assets whose latest version in
+// the store has not been pushed yet.
+func (self *serviceCenter) pushNewAssets() {
+	versions, err := self.config.Assets.Versions(self.serviceName)
+	if err != nil {
+		self.reportError(self.serviceName, "", "", "", err)
+		return
+	}
+	for name, version := range versions {
+		if self.pushedVersion(name) >= version {
+			continue
+		}
+		a, err := self.config.Assets.Get(self.serviceName, name)
+		if err != nil {
+			self.reportError(self.serviceName, "", "", "", err)
+			continue
+		}
+		if a != nil {
+			self.pushAsset(a)
+		}
+	}
+}
+
+// watchAssets pushes the versions published by the other nodes until
+// stopWatchingAssets is called. Only the version numbers are polled.
+// The versions already in the store when it starts are only sent to
+// the new connections.
+func (self *serviceCenter) watchAssets() {
+	defer close(self.assetDone)
+	interval := self.config.AssetRefresh
+	if interval <= 0 {
+		interval = defaultAssetRefresh
+	}
+	if versions, err := self.config.Assets.Versions(self.serviceName); err == nil {
+		self.assetLock.Lock()
+		for name, version := range versions {
+			self.assetVersions[name] = version
+		}
+		self.assetLock.Unlock()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.assetStop:
+			return
+		case <-ticker.C:
+			self.pushNewAssets()
+		}
+	}
+}
+
+// stopWatchingAssets stops watchAssets, and waits for it to return.
+// It may be called more than once.
+func (self *serviceCenter) stopWatchingAssets() {
+	if self.assetStop == nil {
+		return
+	}
+	self.assetStopOnce.Do(func() {
+		close(self.assetStop)
+	})
+	<-self.assetDone
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/asset"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"github.com/uniqush/uniqush-conn/testsupport"
+)
+
+func TestPushAssets(t *testing.T) {
+	store := asset.NewMemoryStore()
+	conf := &ServiceConfig{
+		Assets:       store,
+		AssetRefresh: 50 * time.Millisecond,
+	}
+	store.Publish("srv", "flags", []byte(`{"dark":false}`))
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+
+	auth := testsupport.NewFakeAuth()
+	auth.AllowAll()
+	servConn, cliConn, err := testsupport.Pipe(auth, "srv", "alice", "token")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer cliConn.Close()
+	assetChan := make(chan *client.Asset, 10)
+	cliConn.SetAssetChannel(assetChan)
+	go func() {
+		for {
+			if _, err := cliConn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	if err = center.NewConn(servConn); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	receive := func(name string, version uint64, data string) {
+		select {
+		case a := <-assetChan:
+			if a.Name != name || a.Version != version || string(a.Data) != data {
+				t.Errorf("bad asset: %v %v %q", a.Name, a.Version, a.Data)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%v v%v is not pushed", name, version)
+		}
+	}
+
+	// The latest versions are sent on connect.
+	receive("flags", 1, `{"dark":false}`)
+	if err = cliConn.AckAsset("flags", 1); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	a, err := center.PublishAsset("flags", []byte(`{"dark":true}`))
+	if err != nil || a.Version != 2 {
+		t.Fatalf("bad asset: %+v %v", a, err)
+	}
+	receive("flags", 2, `{"dark":true}`)
+
+	// Published by another node sharing the store.
+	store.Publish("srv", "emoji", []byte("pack"))
+	receive("emoji", 1, "pack")
+
+	// Every version is pushed once.
+	select {
+	case a := <-assetChan:
+		t.Errorf("pushed again: %v %v", a.Name, a.Version)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	cliConn.AckAsset("flags", 2)
+	for i := 0; i < 100; i++ {
+		if versions, _ := store.Applied("srv", "alice"); versions[servConn.ConnId()]["flags"] == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if versions, _ := store.Applied("srv", "alice"); versions[servConn.ConnId()]["flags"] != 2 {
+		t.Errorf("bad applied versions: %v", versions)
+	}
+
+	// Nothing is polled once stopped.
+	center.stopWatchingAssets()
+	center.stopWatchingAssets()
+	store.Publish("srv", "emoji", []byte("pack2"))
+	select {
+	case a := <-assetChan:
+		t.Errorf("pushed after stop: %v %v", a.Name, a.Version)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if _, err := newServiceCenter("other", nil, nil, nil, nil, nil).PublishAsset("flags", nil); err != ErrNoAssets {
+		t.Errorf("should be rejected: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/audit"
+	"github.com/uniqush/uniqush-conn/blocklist"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/testsupport"
+	"testing"
+)
+
+func TestForwardAudit(t *testing.T) {
+	blocked := blocklist.NewMemoryStore()
+	blocked.Block("srv", "alice", "srv", "eve")
+	conf := &ServiceConfig{
+		MsgCache:              testsupport.NewMockCache(),
+		BlockList:             blocked,
+		ForwardRequestHandler: allowForward{},
+		ForwardAudit:          audit.NewMemoryStore(0),
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+	center.ReceiveForward(forwardFrom("bob"))
+	center.ReceiveForward(forwardFrom("eve"))
+
+	var records []*audit.Record
+	var err error
+	waitFor(func() bool {
+		records, err = conf.ForwardAudit.Query(&audit.Query{Service: "srv", Username: "alice"})
+		return err != nil || len(records) == 2
+	})
+	if err != nil || len(records) != 2 {
+		t.Fatalf("alice should have received 2 requests: %v %v", records, err)
+	}
+	if r := records[0]; r.Sender != "eve" || r.Status != proto.FWD_BLOCKED || len(r.MessageId) > 0 {
+		t.Errorf("bad record of the blocked request: %+v", r)
+	}
+	size := forwardFrom("bob").MessageContainer.Message.Size()
+	if r := records[1]; r.Sender != "bob" || r.Receiver != "alice" || r.Status != proto.FWD_OK || len(r.MessageId) == 0 || r.Size != size {
+		t.Errorf("bad record of the forwarded request: %+v", r)
+	}
+	records, err = conf.ForwardAudit.Query(&audit.Query{Service: "srv", Username: "bob", Direction: audit.DIRECTION_SENT})
+	if err != nil || len(records) != 1 || records[0].ReceiverService != "srv" {
+		t.Errorf("bob should have sent 1 request: %v %v", records, err)
+	}
+}
+
+func TestAuditUnknownReceiver(t *testing.T) {
+	conf := &ServiceConfig{
+		MsgCache:     testsupport.NewMockCache(),
+		ForwardAudit: audit.NewMemoryStore(0),
+	}
+	mcenter := NewMessageCenter(nil, nil, nil, 0, nil, &staticConfigReader{conf})
+	mcenter.AddService("srv")
+	fwdreq := forwardFrom("bob")
+	fwdreq.ReceiverService = "nowhere"
+	mcenter.auditForward(fwdreq, proto.FWD_UNKNOWN_RECEIVER)
+
+	var records []*audit.Record
+	var err error
+	waitFor(func() bool {
+		records, err = conf.ForwardAudit.Query(&audit.Query{Service: "srv", Username: "bob", Direction: audit.DIRECTION_SENT})
+		return err != nil || len(records) == 1
+	})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("bob should have sent 1 request: %v %v", records, err)
+	}
+	if r := records[0]; r.ReceiverService != "nowhere" || r.Status != proto.FWD_UNKNOWN_RECEIVER {
+		t.Errorf("bad record of the rejected request: %+v", r)
+	}
+}
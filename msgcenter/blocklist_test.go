@@ -0,0 +1,145 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/blocklist"
+	"github.com/uniqush/uniqush-conn/evthandler"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/subscription"
+	"github.com/uniqush/uniqush-conn/testsupport"
+	"testing"
+	"time"
+)
+
+type allowForward struct{}
+
+func (self allowForward) ShouldForward(fwd *server.ForwardRequest) bool {
+	return true
+}
+
+func (self allowForward) MaxTTL() time.Duration {
+	return time.Hour
+}
+
+func forwardFrom(sender string) *server.ForwardRequest {
+	fwdreq := new(server.ForwardRequest)
+	fwdreq.Receiver = "alice"
+	fwdreq.ReceiverService = "srv"
+	fwdreq.TTL = time.Hour
+	fwdreq.MessageContainer.Sender = sender
+	fwdreq.MessageContainer.SenderService = "srv"
+	fwdreq.MessageContainer.Message = &proto.Message{Body: []byte("hello")}
+	return fwdreq
+}
+
+func TestForwardFromBlockedSender(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	store := blocklist.NewMemoryStore()
+	store.Block("srv", "alice", "srv", "eve")
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		BlockList:             store,
+		ForwardRequestHandler: allowForward{},
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+
+	center.ReceiveForward(forwardFrom("eve"))
+	if calls := cache.Calls(); len(calls) != 0 {
+		t.Errorf("the message from a blocked sender is cached: %v", calls)
+	}
+	center.ReceiveForward(forwardFrom("bob"))
+	if calls := cache.Calls(); len(calls) != 1 || calls[0] != testsupport.OP_CACHE+" srv:alice" {
+		t.Errorf("the message from bob is not cached: %v", calls)
+	}
+}
+
+type rejectForward struct {
+	allowForward
+}
+
+func (self rejectForward) DecideForward(fwd *server.ForwardRequest) (bool, time.Duration) {
+	return false, 0
+}
+
+type shortenForward struct {
+	allowForward
+}
+
+func (self shortenForward) DecideForward(fwd *server.ForwardRequest) (bool, time.Duration) {
+	return true, time.Minute
+}
+
+func TestForwardResult(t *testing.T) {
+	store := blocklist.NewMemoryStore()
+	store.Block("srv", "alice", "srv", "eve")
+
+	cases := []struct {
+		handler evthandler.ForwardRequestHandler
+		sender  string
+		status  string
+		ttl     time.Duration
+	}{
+		{allowForward{}, "eve", proto.FWD_BLOCKED, time.Hour},
+		{allowForward{}, "bob", proto.FWD_OK, time.Hour},
+		{rejectForward{}, "bob", proto.FWD_REJECTED, time.Hour},
+		{shortenForward{}, "bob", proto.FWD_OK, time.Minute},
+	}
+	for _, c := range cases {
+		conf := &ServiceConfig{
+			MsgCache:              testsupport.NewMockCache(),
+			BlockList:             store,
+			ForwardRequestHandler: c.handler,
+		}
+		center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+		fwdreq := forwardFrom(c.sender)
+		status := ""
+		msgId := ""
+		fwdreq.Reply = func(s, id string) {
+			status = s
+			msgId = id
+		}
+		center.ReceiveForward(fwdreq)
+		if status != c.status {
+			t.Errorf("status of %T from %v is %q, not %q", c.handler, c.sender, status, c.status)
+		}
+		if status == proto.FWD_OK && len(msgId) == 0 {
+			t.Errorf("no message id in the result")
+		}
+		if fwdreq.TTL != c.ttl {
+			t.Errorf("ttl is %v, not %v", fwdreq.TTL, c.ttl)
+		}
+	}
+}
+
+func TestForwardToUnknownReceiver(t *testing.T) {
+	subs := subscription.NewMemoryStore()
+	conf := &ServiceConfig{
+		ForwardRequestHandler: allowForward{},
+		SubscriptionStore:     subs,
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+	if status, _ := center.receiveForward(forwardFrom("bob")); status != proto.FWD_UNKNOWN_RECEIVER {
+		t.Errorf("status is %q, not %q", status, proto.FWD_UNKNOWN_RECEIVER)
+	}
+	subs.Subscribe("srv", "alice", map[string]string{"pushservicetype": "gcm", "regid": "1"})
+	if status, _ := center.receiveForward(forwardFrom("bob")); status != proto.FWD_OK {
+		t.Errorf("status of a subscribed receiver is %q, not %q", status, proto.FWD_OK)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/cluster"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+)
+
+type clusterInfo struct {
+	node      string
+	locator   cluster.Locator
+	transport cluster.Transport
+}
+
+func (self *serviceCenter) registerConn(conn server.Conn) {
+	if self.cluster == nil {
+		return
+	}
+	err := self.cluster.locator.Register(self.cluster.node, conn.Service(), conn.Username(), conn.ConnId())
+	if err != nil {
+		self.reportError(conn.Service(), conn.Username(), conn.ConnId(), conn.ClientAddr().String(), err)
+	}
+}
+
+func (self *serviceCenter) unregisterConn(conn server.Conn) {
+	if self.cluster == nil {
+		return
+	}
+	err := self.cluster.locator.Unregister(self.cluster.node, conn.Service(), conn.Username(), conn.ConnId())
+	if err != nil {
+		self.reportError(conn.Service(), conn.Username(), conn.ConnId(), conn.ClientAddr().String(), err)
+	}
+}
+
+// route sends the (already cached) message to the user's
+// connections on other nodes.
+func (self *serviceCenter) route(username string, mc *proto.MessageContainer, extra map[string]string) []*Result {
+	if self.cluster == nil {
+		return nil
+	}
+	nodes, err := self.cluster.locator.Locate(self.serviceName, username)
+	if err != nil {
+		self.reportError(self.serviceName, username, "", "", err)
+		return nil
+	}
+	remote := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if node != self.cluster.node {
+			remote = append(remote, node)
+		}
+	}
+	var ret []*Result
+	add := func(node string, res []*cluster.Result, err error) {
+		if err != nil {
+			self.reportError(self.serviceName, username, "", node, err)
+			ret = append(ret, &Result{err, "", false, node})
+			return
+		}
+		for _, r := range res {
+			if r == nil {
+				continue
+			}
+			var e error
+			if len(r.Err) > 0 {
+				e = errors.New(r.Err)
+			}
+			ret = append(ret, &Result{e, r.ConnId, r.Visible, node})
+		}
+	}
+	if mcast, ok := self.cluster.transport.(cluster.Multicaster); ok && len(remote) > 1 {
+		res, errs := mcast.DeliverToNodes(remote, self.serviceName, username, mc, extra)
+		for _, node := range remote {
+			add(node, res[node], errs[node])
+		}
+		return ret
+	}
+	for _, node := range remote {
+		res, err := self.cluster.transport.Deliver(node, self.serviceName, username, mc, extra)
+		add(node, res, err)
+	}
+	return ret
+}
+
+// disconnectRemote asks the other nodes holding connections
+// of the user to close them.
+func (self *serviceCenter) disconnectRemote(username, connId string, revoke bool) int {
+	if self.cluster == nil {
+		return 0
+	}
+	nodes, err := self.cluster.locator.Locate(self.serviceName, username)
+	if err != nil {
+		self.reportError(self.serviceName, username, connId, "", err)
+		return 0
+	}
+	n := 0
+	for _, node := range nodes {
+		if node == self.cluster.node {
+			continue
+		}
+		nr, err := self.cluster.transport.Disconnect(node, self.serviceName, username, connId, revoke)
+		if err != nil {
+			self.reportError(self.serviceName, username, connId, node, err)
+			continue
+		}
+		n += nr
+	}
+	return n
+}
+
+func toClusterResults(res []*Result) []*cluster.Result {
+	ret := make([]*cluster.Result, 0, len(res))
+	for _, r := range res {
+		if r == nil {
+			continue
+		}
+		cr := &cluster.Result{ConnId: r.ConnId, Visible: r.Visible, Node: r.Node}
+		if r.Err != nil {
+			cr.Err = r.Err.Error()
+		}
+		ret = append(ret, cr)
+	}
+	return ret
+}
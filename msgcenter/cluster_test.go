@@ -0,0 +1,187 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"crypto/rsa"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/cluster"
+	"github.com/uniqush/uniqush-conn/proto"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func getLocator() cluster.Locator {
+	db := 2
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	c.Do("SELECT", db)
+	c.Do("FLUSHDB")
+	c.Close()
+	return cluster.NewRedisLocator("", "", db)
+}
+
+func joinCluster(center *MessageCenter, httpAddr string, locator cluster.Locator) error {
+	return joinClusterWith(center, httpAddr, locator, cluster.NewHttpTransport(3*time.Second))
+}
+
+func joinClusterWith(center *MessageCenter, httpAddr string, locator cluster.Locator, transport cluster.Transport) error {
+	ln, err := net.Listen("tcp", httpAddr)
+	if err != nil {
+		return err
+	}
+	err = center.SetCluster(httpAddr, locator, transport)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	handler := cluster.NewHttpHandler(center)
+	mux.Handle(cluster.DeliverPath, handler)
+	mux.Handle(cluster.DisconnectPath, handler)
+	go http.Serve(ln, mux)
+	return nil
+}
+
+func TestSendToClientOnAnotherNode(t *testing.T) {
+	addrs := []string{"127.0.0.1:8966", "127.0.0.1:8967"}
+	httpAddrs := []string{"127.0.0.1:8968", "127.0.0.1:8969"}
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	locator := getLocator()
+	centers := make([]*MessageCenter, len(addrs))
+	pubkeys := make([]*rsa.PublicKey, len(addrs))
+	for i, addr := range addrs {
+		center, pubkey, err := getMessageCenter(addr, nil, errChan)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		err = joinCluster(center, httpAddrs[i], locator)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		go center.Start()
+		centers[i] = center
+		pubkeys[i] = pubkey
+	}
+
+	// The user connects to the second node.
+	c, err := connectServer(addrs[1], "user", pubkeys[1], nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	// Wait for the connection to be registered.
+	time.Sleep(500 * time.Millisecond)
+
+	msg := randomMessage()
+	done := make(chan bool)
+	go func() {
+		testClientReceived(c, errChan, msg)
+		close(done)
+	}()
+
+	// And the message is sent through the first node.
+	res := centers[0].SendMessage("service", "user", msg, nil, 0*time.Second)
+	if len(res) != 1 {
+		t.Errorf("should have one result: %v", res)
+		return
+	}
+	if res[0].Err != nil || res[0].Node != httpAddrs[1] {
+		t.Errorf("bad result: %+v", res[0])
+	}
+	<-done
+}
+
+// fakeFeed hands the messages published by any node to the node
+// serving the feed.
+type fakeFeed struct {
+	cluster.Transport
+	sender cluster.Sender
+}
+
+func (self *fakeFeed) Publish(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) ([]*cluster.Result, error) {
+	return self.sender.SendFromFeed(service, username, mc, extra, ttl)
+}
+
+func (self *fakeFeed) ServeFeed(sender cluster.Sender) error {
+	self.sender = sender
+	return nil
+}
+
+func TestSendThroughDeliveryOnlyNode(t *testing.T) {
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+	locator := getLocator()
+	feed := &fakeFeed{Transport: cluster.NewHttpTransport(3 * time.Second)}
+
+	// The interactive node.
+	center, pubkey, err := getMessageCenter("127.0.0.1:8976", nil, errChan)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	err = joinClusterWith(center, "127.0.0.1:8977", locator, feed)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	go center.Start()
+
+	// The delivery-only node.
+	node, _, err := getMessageCenter("127.0.0.1:8978", nil, errChan)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	node.SetDeliveryOnly()
+	if err := node.SetCluster("127.0.0.1:8979", locator, cluster.NewHttpTransport(time.Second)); err != ErrNoFeed {
+		t.Errorf("a delivery-only node needs a feed: %v", err)
+	}
+	if err := node.SetCluster("127.0.0.1:8979", locator, feed); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	go node.Start()
+
+	c, err := connectServer("127.0.0.1:8976", "user", pubkey, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// Wait for the connection to be registered.
+	time.Sleep(500 * time.Millisecond)
+
+	msg := randomMessage()
+	done := make(chan bool)
+	go func() {
+		testClientReceived(c, errChan, msg)
+		close(done)
+	}()
+	res, err := center.SendToFeed("service", "user", &proto.MessageContainer{Message: msg}, nil, 0)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(res) != 1 || res[0].Err != nil || res[0].Node != "127.0.0.1:8977" {
+		t.Errorf("bad results: %+v", res)
+	}
+	<-done
+	if users := node.ConnectedUsers("service"); len(users) != 0 {
+		t.Errorf("users on the delivery-only node: %v", users)
+	}
+}
@@ -24,13 +24,14 @@ import (
 
 type minimalConn interface {
 	Username() string
-	UniqId() string
+	ConnId() string
 }
 
 type connMap interface {
 	AddConn(conn minimalConn, maxNrConnsPerUser int, maxNrUsers int) error
 	GetConn(username string) []minimalConn
 	DelConn(conn minimalConn) bool
+	AllUsers() []string
 }
 
 type connListItem struct {
@@ -90,6 +91,18 @@ func (self *treeBasedConnMap) GetConn(user string) []minimalConn {
 	return cl.list
 }
 
+func (self *treeBasedConnMap) AllUsers() []string {
+	ret := make([]string, 0, self.tree.Len())
+	min := &connListItem{name: "", list: nil}
+	self.tree.AscendGreaterOrEqual(min, func(i llrb.Item) bool {
+		if cl, ok := i.(*connListItem); ok && len(cl.list) > 0 {
+			ret = append(ret, cl.key())
+		}
+		return true
+	})
+	return ret
+}
+
 var ErrTooManyUsers = errors.New("too many users")
 var ErrTooManyConnForThisUser = errors.New("too many connections under this user")
 
@@ -109,7 +122,7 @@ func (self *treeBasedConnMap) AddConn(conn minimalConn, maxNrConnsPerUser int, m
 		return ErrTooManyConnForThisUser
 	}
 	for _, c := range cl {
-		if c.UniqId() == conn.UniqId() {
+		if c.ConnId() == conn.ConnId() {
 			return nil
 		}
 	}
@@ -128,9 +141,9 @@ func (self *treeBasedConnMap) DelConn(conn minimalConn) bool {
 		return false
 	}
 	i := -1
-	var c minimalConn
-	for i, c = range cl {
-		if c.UniqId() == conn.UniqId() {
+	for j, c := range cl {
+		if c.ConnId() == conn.ConnId() {
+			i = j
 			break
 		}
 	}
@@ -31,7 +31,7 @@ func (self *fakeConn) Username() string {
 	return self.username
 }
 
-func (self *fakeConn) UniqId() string {
+func (self *fakeConn) ConnId() string {
 	return fmt.Sprintf("%v-%v", self.username, self.n)
 }
 
@@ -183,3 +183,21 @@ func TestDeleteDupConnMap(t *testing.T) {
 		}
 	}
 }
+
+func TestDelConnTwice(t *testing.T) {
+	cmap := newTreeBasedConnMap()
+	a := &fakeConn{username: "user", n: 1}
+	b := &fakeConn{username: "user", n: 2}
+	cmap.AddConn(a, 0, 0)
+	cmap.AddConn(b, 0, 0)
+	if !cmap.DelConn(a) {
+		t.Errorf("a should be deleted")
+	}
+	if cmap.DelConn(a) {
+		t.Errorf("a is already deleted")
+	}
+	cs := cmap.GetConn("user")
+	if len(cs) != 1 || cs[0].ConnId() != b.ConnId() {
+		t.Errorf("b should be kept: %v", cs)
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/evthandler"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/testsupport"
+	"testing"
+	"time"
+)
+
+func TestDeadLetters(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	letters := make(chan *msgcache.DeadLetter, 2)
+	conf := &ServiceConfig{
+		MsgCache:           cache,
+		DeadLetterHandler:  evthandler.DeadLetterChannel(letters),
+		DeadLetterInterval: 50 * time.Millisecond,
+	}
+	newServiceCenter("srv", conf, nil, nil, nil, nil)
+
+	expired := &proto.MessageContainer{Message: &proto.Message{Body: []byte("hello")}}
+	cache.CacheMessage("srv", "alice", expired, 100*time.Millisecond)
+	delivered := &proto.MessageContainer{Message: &proto.Message{Body: []byte("delivered")}}
+	cache.CacheMessage("srv", "alice", delivered, 100*time.Millisecond)
+	cache.UpdateDeliveryState("srv", "alice", delivered.Id, msgcache.STATE_DELIVERED)
+
+	select {
+	case letter := <-letters:
+		if letter.Username != "alice" || letter.Message.Id != expired.Id || letter.Reason != msgcache.DEADLETTER_EXPIRED {
+			t.Errorf("bad dead letter: %+v", letter)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no dead letter")
+	}
+	select {
+	case letter := <-letters:
+		t.Errorf("unexpected dead letter: %+v", letter)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/dedup"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/testsupport"
+	"testing"
+)
+
+type forwardRequestResult struct {
+	req    *server.ForwardRequest
+	status string
+	msgId  string
+}
+
+func forwardWithKey(key string) (fwdreq *forwardRequestResult) {
+	fwdreq = new(forwardRequestResult)
+	fwdreq.req = forwardFrom("bob")
+	fwdreq.req.IdempotencyKey = key
+	fwdreq.req.Reply = func(status, msgId string) {
+		fwdreq.status = status
+		fwdreq.msgId = msgId
+	}
+	return
+}
+
+func TestDuplicateForward(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		Dedup:                 dedup.NewMemoryStore(),
+		ForwardRequestHandler: allowForward{},
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+
+	cases := []struct {
+		key    string
+		status string
+	}{
+		{"k1", proto.FWD_OK},
+		{"k1", proto.FWD_DUPLICATE},
+		{"k2", proto.FWD_OK},
+		// Requests without a key are never duplicates.
+		{"", proto.FWD_OK},
+		{"", proto.FWD_OK},
+	}
+	for i, c := range cases {
+		fwd := forwardWithKey(c.key)
+		center.ReceiveForward(fwd.req)
+		if fwd.status != c.status {
+			t.Errorf("%vth request with key %q: status %q, not %q", i, c.key, fwd.status, c.status)
+		}
+	}
+	if calls := cache.Calls(); len(calls) != 4 {
+		t.Errorf("%v messages are cached", len(calls))
+	}
+
+	// A failed request could be retried.
+	cache.FailNext(testsupport.OP_CACHE_ONCE, errors.New("cache failure"))
+	fwd := forwardWithKey("k3")
+	center.ReceiveForward(fwd.req)
+	if fwd.status != proto.FWD_FAILED {
+		t.Errorf("status of the failed request is %q", fwd.status)
+	}
+	fwd = forwardWithKey("k3")
+	center.ReceiveForward(fwd.req)
+	if fwd.status != proto.FWD_OK {
+		t.Errorf("status of the retry is %q", fwd.status)
+	}
+}
+
+func TestForwardCachedOnce(t *testing.T) {
+	// Two nodes sharing the cache, without any dedup store.
+	cache := testsupport.NewMockCache()
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		ForwardRequestHandler: allowForward{},
+	}
+	nodes := []*serviceCenter{
+		newServiceCenter("srv", conf, nil, nil, nil, nil),
+		newServiceCenter("srv", conf, nil, nil, nil, nil),
+	}
+
+	var ids []string
+	for _, node := range nodes {
+		fwd := forwardWithKey("k1")
+		node.ReceiveForward(fwd.req)
+		if fwd.status != proto.FWD_OK {
+			t.Fatalf("status %q", fwd.status)
+		}
+		ids = append(ids, fwd.msgId)
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("the same request has ids %v", ids)
+	}
+	for _, node := range nodes {
+		fwd := forwardWithKey("")
+		node.ReceiveForward(fwd.req)
+	}
+	msgs, err := cache.GetCachedMessages("srv", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Errorf("%v messages are cached", len(msgs))
+	}
+}
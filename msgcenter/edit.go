@@ -0,0 +1,139 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+)
+
+// supersede replaces or deletes the cached message the request
+// supersedes, so that it is never delivered again, then tells the
+// connections of the receiver. Only the sender of the message can edit
+// or recall it. The receiver is told even if the message is no longer
+// cached, e.g. once it is acked, since it may still be displayed.
+func (self *serviceCenter) supersede(fwdreq *server.ForwardRequest) (status string) {
+	if self.cache == nil {
+		return proto.FWD_FAILED
+	}
+	receiver := fwdreq.Receiver
+	id := fwdreq.Supersedes
+	mc := &fwdreq.MessageContainer
+	old, err := self.cache.Get(self.serviceName, receiver, id)
+	if err != nil {
+		self.logger.Warn("cannot get superseded message", "username", receiver, "id", id, "err", err)
+		return proto.FWD_FAILED
+	}
+	if old != nil && (old.Sender != mc.Sender || old.SenderService != mc.SenderService) {
+		self.logger.Debug("edit from another user rejected", "username", receiver, "id", id, "sender", mc.Sender, "senderService", mc.SenderService)
+		return proto.FWD_REJECTED
+	}
+	msg, ok := self.editedMessage(receiver, mc, fwdreq.Recall)
+	if !ok {
+		return proto.FWD_DROPPED
+	}
+	if old == nil {
+		self.notifyEdit(receiver, mc.Sender, mc.SenderService, id, msg)
+		return proto.FWD_NOT_FOUND
+	}
+	status = proto.FWD_OK
+	if fwdreq.Recall {
+		err = self.cache.Del(self.serviceName, receiver, id)
+		if err == nil {
+			self.uncount(receiver, id)
+		}
+	} else {
+		if old.Message != nil && msg != nil && msg.ThreadId != old.Message.ThreadId {
+			// The message stays in its thread.
+			msg.ThreadId = old.Message.ThreadId
+		}
+		var ok bool
+		ok, err = self.cache.Replace(self.serviceName, receiver, id, msg)
+		if err == nil && !ok {
+			status = proto.FWD_NOT_FOUND
+		}
+	}
+	if err != nil {
+		self.logger.Warn("cannot supersede message", "username", receiver, "id", id, "recall", fwdreq.Recall, "err", err)
+		return proto.FWD_FAILED
+	}
+	self.notifyEdit(receiver, mc.Sender, mc.SenderService, id, msg)
+	return
+}
+
+// editedMessage returns the message replacing the superseded one, or
+// nil if it is recalled. It returns false if the transformer drops the
+// new version, which then leaves the message as it is.
+func (self *serviceCenter) editedMessage(receiver string, mc *proto.MessageContainer, recall bool) (msg *proto.Message, ok bool) {
+	if recall || mc.Message == nil {
+		mc.Message = nil
+		return nil, true
+	}
+	self.stripServerHeaders(mc)
+	if !self.transform(receiver, mc) {
+		return nil, false
+	}
+	return mc.Message, true
+}
+
+// notifyEdit tells the connections of the receiver, on all the nodes
+// of the cluster, that the sender edited the message id, or recalled
+// it if msg is nil.
+func (self *serviceCenter) notifyEdit(receiver, sender, senderService, id string, msg *proto.Message) {
+	self.notifyEditLocal(receiver, sender, senderService, id, msg)
+	notice := &proto.MessageContainer{
+		Message:       msg,
+		Sender:        sender,
+		SenderService: senderService,
+		Supersedes:    id,
+	}
+	self.route(receiver, notice, nil)
+}
+
+func (self *serviceCenter) notifyEditLocal(receiver, sender, senderService, id string, msg *proto.Message) []*Result {
+	conns := self.Conns(receiver)
+	res := make([]*Result, 0, len(conns))
+	for _, conn := range conns {
+		err := conn.NotifyEdit(sender, senderService, id, msg)
+		if err != nil {
+			self.logger.Debug("cannot notify edit", "username", receiver, "connId", conn.ConnId(), "err", err)
+		}
+		res = append(res, &Result{err, conn.ConnId(), conn.Visible(), ""})
+	}
+	return res
+}
+
+// withdraw deletes a message from the cache of the receiver, and tells
+// the connections of the receiver it is recalled by its sender. It
+// returns false if the message is no longer cached.
+func (self *serviceCenter) withdraw(receiver, sender, senderService, id string) bool {
+	if self.cache == nil {
+		return false
+	}
+	old, err := self.cache.Get(self.serviceName, receiver, id)
+	if err != nil || old == nil {
+		return false
+	}
+	if err = self.cache.Del(self.serviceName, receiver, id); err != nil {
+		self.logger.Warn("cannot withdraw message", "username", receiver, "id", id, "err", err)
+		return false
+	}
+	self.uncount(receiver, id)
+	self.notifyEdit(receiver, sender, senderService, id, nil)
+	return true
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/cluster"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/testsupport"
+)
+
+func TestEditAndRecall(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		ForwardRequestHandler: allowForward{},
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+	auth := testsupport.NewFakeAuth()
+	auth.AllowAll()
+	servConn, cliConn, err := testsupport.Pipe(auth, "srv", "alice", "token")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer cliConn.Close()
+	edits := make(chan *client.Edit, 2)
+	cliConn.SetEditChannel(edits)
+	go func() {
+		for {
+			if _, err := cliConn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	if err = center.NewConn(servConn); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	send := func(fwdreq *server.ForwardRequest) (status, msgId string) {
+		fwdreq.Reply = func(s, id string) {
+			status, msgId = s, id
+		}
+		center.ReceiveForward(fwdreq)
+		return
+	}
+	status, id := send(forwardFrom("bob"))
+	if status != proto.FWD_OK || len(id) == 0 {
+		t.Fatalf("not forwarded: %v %v", status, id)
+	}
+	edit := func(sender string, body string) *server.ForwardRequest {
+		fwdreq := forwardFrom(sender)
+		fwdreq.Supersedes = id
+		if len(body) == 0 {
+			fwdreq.Recall = true
+			fwdreq.MessageContainer.Message = nil
+		} else {
+			fwdreq.MessageContainer.Message = &proto.Message{Body: []byte(body)}
+		}
+		return fwdreq
+	}
+
+	if status, _ := send(edit("eve", "forged")); status != proto.FWD_REJECTED {
+		t.Errorf("the message is edited by another user: %v", status)
+	}
+	if status, msgId := send(edit("bob", "edited")); status != proto.FWD_OK || msgId != id {
+		t.Errorf("not edited: %v %v", status, msgId)
+	}
+	if mc, _ := cache.Get("srv", "alice", id); mc == nil || string(mc.Message.Body) != "edited" {
+		t.Errorf("the cached message is not replaced: %+v", mc)
+	}
+	select {
+	case e := <-edits:
+		if e.Id != id || e.Sender != "bob" || e.Recalled() || string(e.Message.Body) != "edited" {
+			t.Errorf("bad edit: %+v", e)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the receiver is not told the edit")
+	}
+
+	if status, _ := send(edit("bob", "")); status != proto.FWD_OK {
+		t.Errorf("not recalled: %v", status)
+	}
+	if mc, _ := cache.Get("srv", "alice", id); mc != nil {
+		t.Errorf("the recalled message is still cached: %+v", mc)
+	}
+	select {
+	case e := <-edits:
+		if e.Id != id || !e.Recalled() {
+			t.Errorf("bad recall: %+v", e)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the receiver is not told the recall")
+	}
+	if status, _ := send(edit("bob", "again")); status != proto.FWD_NOT_FOUND {
+		t.Errorf("a recalled message is edited: %v", status)
+	}
+}
+
+// remoteNode is the only other node of the cluster, on which every
+// user is connected.
+type remoteNode struct {
+	lock      sync.Mutex
+	delivered []*proto.MessageContainer
+}
+
+func (self *remoteNode) Register(node, service, username, connId string) error   { return nil }
+func (self *remoteNode) Unregister(node, service, username, connId string) error { return nil }
+func (self *remoteNode) Purge(node string) error                                 { return nil }
+
+func (self *remoteNode) Locate(service, username string) ([]string, error) {
+	return []string{"remote"}, nil
+}
+
+func (self *remoteNode) Deliver(node, service, username string, mc *proto.MessageContainer, extra map[string]string) ([]*cluster.Result, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.delivered = append(self.delivered, mc)
+	return nil, nil
+}
+
+func (self *remoteNode) Disconnect(node, service, username, connId string, revoke bool) (int, error) {
+	return 0, nil
+}
+
+func (self *remoteNode) notices() []*proto.MessageContainer {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.delivered
+}
+
+func TestEditUncachedMessage(t *testing.T) {
+	conf := &ServiceConfig{
+		MsgCache:              testsupport.NewMockCache(),
+		ForwardRequestHandler: allowForward{},
+	}
+	remote := new(remoteNode)
+	center := newServiceCenter("srv", conf, nil, &clusterInfo{"local", remote, remote}, nil, nil)
+	auth := testsupport.NewFakeAuth()
+	auth.AllowAll()
+	servConn, cliConn, err := testsupport.Pipe(auth, "srv", "alice", "token")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer cliConn.Close()
+	edits := make(chan *client.Edit, 2)
+	cliConn.SetEditChannel(edits)
+	go func() {
+		for {
+			if _, err := cliConn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	if err = center.NewConn(servConn); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// The message has been acked and deleted already.
+	var status string
+	fwdreq := forwardFrom("bob")
+	fwdreq.Supersedes = "acked"
+	fwdreq.Recall = true
+	fwdreq.MessageContainer.Message = nil
+	fwdreq.Reply = func(s, id string) { status = s }
+	center.ReceiveForward(fwdreq)
+	if status != proto.FWD_NOT_FOUND {
+		t.Errorf("bad status: %v", status)
+	}
+	select {
+	case e := <-edits:
+		if e.Id != "acked" || e.Sender != "bob" || !e.Recalled() {
+			t.Errorf("bad recall: %+v", e)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the receiver is not told the recall")
+	}
+	notices := remote.notices()
+	if len(notices) != 1 || notices[0].Supersedes != "acked" || notices[0].Sender != "bob" || notices[0].Message != nil {
+		t.Errorf("the recall is not routed to the other node: %+v", notices)
+	}
+
+	// A notice from another node is only told to the connections.
+	notice := &proto.MessageContainer{Sender: "bob", SenderService: "srv", Supersedes: "other", Message: &proto.Message{Body: []byte("edited")}}
+	if res := center.deliverLocal("alice", notice, nil); len(res) != 1 || res[0].Err != nil {
+		t.Errorf("bad results: %+v", res)
+	}
+	select {
+	case e := <-edits:
+		if e.Id != "other" || e.Recalled() || string(e.Message.Body) != "edited" {
+			t.Errorf("bad edit: %+v", e)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the receiver is not told the edit")
+	}
+	if msgs, _ := conf.MsgCache.GetCachedMessages("srv", "alice"); len(msgs) != 0 {
+		t.Errorf("the notice is cached: %+v", msgs)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"sync"
+)
+
+const (
+	EVENT_MESSAGE     = "message"
+	EVENT_FORWARD     = "forward"
+	EVENT_SUBSCRIBE   = "subscribe"
+	EVENT_UNSUBSCRIBE = "unsubscribe"
+	EVENT_CONNECT     = "connect"
+	EVENT_DISCONNECT  = "disconnect"
+	EVENT_ACK         = "ack"
+
+	// A message is cached for, or delivered to, the user. It is only
+	// published if someone listens.
+	EVENT_DELIVER = "deliver"
+
+	// The abuse scorer has flagged a message forwarded by the user.
+	EVENT_FLAG = "flag"
+
+	// A connection of the user has been found too slow, or keeps up
+	// again. See ServiceConfig.SlowConsumer.
+	EVENT_SLOW_CONSUMER           = "slow-consumer"
+	EVENT_SLOW_CONSUMER_RECOVERED = "slow-consumer-recovered"
+)
+
+// Event is something a client did or asked the server to do.
+type Event struct {
+	Type     string
+	Service  string
+	Username string
+
+	// Set for EVENT_MESSAGE, EVENT_CONNECT, EVENT_DISCONNECT, EVENT_ACK
+	// and the slow consumer events.
+	ConnId string
+
+	// Only set for EVENT_CONNECT and EVENT_DISCONNECT.
+	Addr string
+
+	// Only set for EVENT_DISCONNECT and EVENT_FLAG, and for the slow
+	// consumer events, for which it is the action of the policy.
+	Reason string
+
+	// MessageId is set for EVENT_ACK and EVENT_DELIVER, and for
+	// EVENT_FLAG if the message is flagged in time. Read is only
+	// set for EVENT_ACK, and tells if the client has read the message
+	// as well.
+	MessageId string
+	Read      bool
+
+	// Set for EVENT_MESSAGE, EVENT_FORWARD, EVENT_DELIVER and
+	// EVENT_FLAG. It is a copy owned by the listeners.
+	Message *proto.Message
+
+	// Only set for EVENT_FORWARD and EVENT_FLAG.
+	Receiver        string
+	ReceiverService string
+
+	// Only set for EVENT_DELIVER, if the message is from a user.
+	Sender        string
+	SenderService string
+
+	// Only set for EVENT_SUBSCRIBE and EVENT_UNSUBSCRIBE.
+	Params map[string]string
+}
+
+func forwardEvent(fwdreq *server.ForwardRequest) *Event {
+	mc := &fwdreq.MessageContainer
+	return &Event{
+		Type:            EVENT_FORWARD,
+		Service:         mc.SenderService,
+		Username:        mc.Sender,
+		Message:         mc.Message.Copy(),
+		Receiver:        fwdreq.Receiver,
+		ReceiverService: fwdreq.ReceiverService,
+	}
+}
+
+func subscribeEvent(req *server.SubscribeRequest) *Event {
+	evt := &Event{
+		Type:     EVENT_UNSUBSCRIBE,
+		Service:  req.Service,
+		Username: req.Username,
+		Params:   req.Params,
+	}
+	if req.Subscribe {
+		evt.Type = EVENT_SUBSCRIBE
+	}
+	return evt
+}
+
+func ackEvent(ack *server.Ack) *Event {
+	return &Event{
+		Type:      EVENT_ACK,
+		Service:   ack.Service,
+		Username:  ack.Username,
+		ConnId:    ack.ConnId,
+		MessageId: ack.Id,
+		Read:      ack.Read,
+	}
+}
+
+type eventBus struct {
+	lock      sync.RWMutex
+	listeners map[chan<- *Event]bool
+}
+
+func newEventBus() *eventBus {
+	ret := new(eventBus)
+	ret.listeners = make(map[chan<- *Event]bool, 4)
+	return ret
+}
+
+// publish never blocks. A listener which is not ready
+// misses the event.
+func (self *eventBus) publish(evt *Event) {
+	if self == nil {
+		return
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for ch, _ := range self.listeners {
+		select {
+		case ch <- evt:
+		default:
+		}
+	}
+}
+
+// active tells if anyone listens, so that the events which are costly
+// to make can be skipped.
+func (self *eventBus) active() bool {
+	if self == nil {
+		return false
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return len(self.listeners) > 0
+}
+
+func (self *eventBus) listen(ch chan<- *Event) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.listeners[ch] = true
+}
+
+func (self *eventBus) unlisten(ch chan<- *Event) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.listeners, ch)
+}
+
+// EventSource is implemented by MessageCenter. The backends fed with
+// its events, like the archivers, listen to it.
+type EventSource interface {
+	Listen(ch chan<- *Event)
+	Unlisten(ch chan<- *Event)
+}
+
+// Listen sends the events of all services to ch until Unlisten
+// is called. Events are dropped if ch is not ready to receive.
+func (self *MessageCenter) Listen(ch chan<- *Event) {
+	self.events.listen(ch)
+}
+
+func (self *MessageCenter) Unlisten(ch chan<- *Event) {
+	self.events.unlisten(ch)
+}
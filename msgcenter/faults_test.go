@@ -0,0 +1,132 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/testsupport"
+	"net"
+	"testing"
+	"time"
+)
+
+func faultyPipe(t *testing.T, auth server.Authenticator, faults *proto.Faults) (servConn server.Conn, cliConn client.Conn, fc *proto.FaultyConn) {
+	sc, cc := net.Pipe()
+	fc = proto.NewFaultyConn(sc, faults)
+	done := make(chan error)
+	go func() {
+		var err error
+		servConn, err = server.AuthConn(fc, testsupport.Key(), auth, testsupport.HandshakeTimeout)
+		done <- err
+	}()
+	cliConn, err := testsupport.Dial(cc, "srv", "alice", "token")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return
+}
+
+func receiveInto(conn client.Conn, received chan<- *proto.MessageContainer) {
+	defer close(received)
+	for {
+		mc, err := conn.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		received <- mc
+	}
+}
+
+func TestReplayAfterReset(t *testing.T) {
+	auth := testsupport.NewFakeAuth()
+	auth.AllowAll()
+	conf := &ServiceConfig{MsgCache: testsupport.NewMockCache()}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+
+	// The commands reach the client slowly and in pieces.
+	servConn, cliConn, fc := faultyPipe(t, auth, &proto.Faults{Latency: time.Millisecond, MaxWriteLen: 7})
+	defer cliConn.Close()
+	if err := center.NewConn(servConn); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	received := make(chan *proto.MessageContainer, 10)
+	go receiveInto(cliConn, received)
+
+	var msgs []*proto.Message
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, &proto.Message{Body: []byte(fmt.Sprintf("message %v", i))})
+	}
+	var last uint64
+	for _, msg := range msgs[:3] {
+		center.SendMessage("alice", msg, nil, time.Hour)
+		select {
+		case mc := <-received:
+			if !mc.Message.Eq(msg) {
+				t.Errorf("bad message: %v", mc.Message)
+			}
+			last = mc.Seq
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no message")
+		}
+	}
+
+	// The connection breaks in the middle of the next message.
+	fc.SetFaults(&proto.Faults{ResetAfter: fc.NrWritten() + 10})
+	for _, msg := range msgs[3:] {
+		center.SendMessage("alice", msg, nil, time.Hour)
+	}
+	select {
+	case mc, ok := <-received:
+		if ok {
+			t.Fatalf("received a message through the broken connection: %v", mc.Message)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the client is still connected")
+	}
+
+	// The client reconnects and resumes after the last message.
+	servConn2, cliConn2, err := testsupport.Pipe(auth, "srv", "alice", "token")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer cliConn2.Close()
+	if err := center.NewConn(servConn2); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	received = make(chan *proto.MessageContainer, 10)
+	go receiveInto(cliConn2, received)
+	if err := cliConn2.ResumeCachedMessages(last); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, msg := range msgs[3:] {
+		select {
+		case mc := <-received:
+			if !mc.Message.Eq(msg) {
+				t.Errorf("bad message replayed: %v", mc.Message)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("the message is not replayed")
+		}
+	}
+}
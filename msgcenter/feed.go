@@ -0,0 +1,83 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/cluster"
+	"github.com/uniqush/uniqush-conn/proto"
+	"time"
+)
+
+// SetDeliveryOnly makes the message center a delivery-only node of a
+// cluster, e.g. to dedicate some hardware to the fan-out of large
+// campaigns. It accepts no client: Start() does not serve the
+// listener, which may be nil. It sends the messages taken from the
+// feed of the cluster transport, and those given to it through the
+// HTTP API or the scheduler. It should be called before SetCluster.
+func (self *MessageCenter) SetDeliveryOnly() {
+	self.deliveryOnly = true
+}
+
+func (self *MessageCenter) DeliveryOnly() bool {
+	return self.deliveryOnly
+}
+
+// SendFromFeed sends a message taken from the feed as if it was sent
+// to this node. It implements cluster.Sender.
+func (self *MessageCenter) SendFromFeed(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) (res []*cluster.Result, err error) {
+	var r []*Result
+	if mc.FromUser() {
+		r, err = self.DeliverForward(service, username, mc, extra, ttl)
+	} else {
+		r, err = self.DeliverMessage(service, username, mc, extra, ttl)
+	}
+	res = toClusterResults(r)
+	return
+}
+
+// SendToFeed hands the message to one of the delivery-only nodes of
+// the cluster, and returns once it is sent. It fails with ErrNoFeed if
+// the cluster transport has no feed.
+func (self *MessageCenter) SendToFeed(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) (res []*Result, err error) {
+	if self.cluster == nil {
+		err = ErrNoFeed
+		return
+	}
+	feed, ok := self.cluster.transport.(cluster.Feed)
+	if !ok {
+		err = ErrNoFeed
+		return
+	}
+	cres, err := feed.Publish(service, username, mc, extra, ttl)
+	if err != nil {
+		return
+	}
+	res = make([]*Result, 0, len(cres))
+	for _, r := range cres {
+		if r == nil {
+			continue
+		}
+		var e error
+		if len(r.Err) > 0 {
+			e = errors.New(r.Err)
+		}
+		res = append(res, &Result{e, r.ConnId, r.Visible, r.Node})
+	}
+	return
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+	"strings"
+)
+
+var ErrEmptyMessage = errors.New("empty message")
+var ErrReservedKey = errors.New("notif.uniqush.* are reserved keys")
+
+// The delivery status of a message sent through a frontend:
+// the HTTP API, the gRPC API or the admin API.
+const (
+	// At least one connection received the message.
+	STATUS_DELIVERED = "delivered"
+	// Nobody received the message. It is kept in the cache.
+	STATUS_CACHED = "cached"
+	// The message is neither delivered nor cached.
+	STATUS_DROPPED = "dropped"
+)
+
+// SplitHeader builds a message out of the header and the body posted
+// to a frontend. The "notif." fields, which are only used by the push
+// service, are moved out of the message header into extra.
+func SplitHeader(header map[string]string, body []byte) (msg *proto.Message, extra map[string]string, err error) {
+	msg = new(proto.Message)
+	msg.Header = make(map[string]string, len(header))
+	extra = make(map[string]string, len(header))
+	if len(body) > 0 {
+		msg.Body = body
+	}
+	for k, v := range header {
+		if strings.HasPrefix(k, "notif.") {
+			if strings.HasPrefix(k, "notif.uniqush.") {
+				err = ErrReservedKey
+				return
+			}
+			extra[k] = v
+		} else {
+			msg.Header[k] = v
+		}
+	}
+	if msg.IsEmpty() {
+		err = ErrEmptyMessage
+	}
+	return
+}
+
+// DeliveryStatus tells which of STATUS_* the message is in after it
+// has been delivered with the results res.
+func DeliveryStatus(mc *proto.MessageContainer, res []*Result) string {
+	for _, r := range res {
+		if r != nil && r.Err == nil {
+			return STATUS_DELIVERED
+		}
+	}
+	if mc != nil && len(mc.Id) > 0 {
+		return STATUS_CACHED
+	}
+	return STATUS_DROPPED
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"testing"
+)
+
+func TestSplitHeader(t *testing.T) {
+	msg, extra, err := SplitHeader(map[string]string{"title": "hello", "notif.msg": "hi"}, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if msg.Header["title"] != "hello" || extra["notif.msg"] != "hi" || len(msg.Header) != 1 {
+		t.Errorf("bad split: %v %v", msg.Header, extra)
+	}
+	_, _, err = SplitHeader(map[string]string{"notif.uniqush.x": "y"}, []byte("body"))
+	if err != ErrReservedKey {
+		t.Errorf("reserved keys should be rejected: %v", err)
+	}
+	_, _, err = SplitHeader(map[string]string{"notif.msg": "hi"}, nil)
+	if err != ErrEmptyMessage {
+		t.Errorf("empty messages should be rejected: %v", err)
+	}
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	mc := &proto.MessageContainer{Id: "1"}
+	if s := DeliveryStatus(mc, []*Result{&Result{ConnId: "c", Visible: true}}); s != STATUS_DELIVERED {
+		t.Errorf("bad status: %v", s)
+	}
+	if s := DeliveryStatus(mc, nil); s != STATUS_CACHED {
+		t.Errorf("bad status: %v", s)
+	}
+	if s := DeliveryStatus(&proto.MessageContainer{}, nil); s != STATUS_DROPPED {
+		t.Errorf("bad status: %v", s)
+	}
+}
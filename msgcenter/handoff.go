@@ -0,0 +1,152 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/handoff"
+	"github.com/uniqush/uniqush-conn/proto/server"
+)
+
+// The number of connections detached at a time by Handoff.
+const nrHandoffWorkers = 64
+
+func handedOff(conn server.Conn) bool {
+	d, ok := conn.(server.Detacher)
+	return ok && d.HandedOff()
+}
+
+// Handoff stops accepting connections, and sends the connections of
+// this process over sock, e.g. returned by handoff.Exec, to the process
+// on the other side, which should serve them with Adopt. Every
+// connection is paused within timeout, or closed. It returns the
+// number of connections handed off. The ones which cannot be handed
+// off, e.g. TLS ones, are left to this process; their clients will have
+// to reconnect once it exits.
+func (self *MessageCenter) Handoff(sock *net.UnixConn, timeout time.Duration) (n int, err error) {
+	self.serverLock.Lock()
+	srv := self.server
+	self.serverLock.Unlock()
+	if srv != nil {
+		// The other process has its own copy of the listening sockets.
+		srv.Close()
+	}
+
+	conns := make(chan server.Conn)
+	var nrHandedOff int64
+	var errLock sync.Mutex
+	wg := new(sync.WaitGroup)
+	wg.Add(nrHandoffWorkers)
+	for i := 0; i < nrHandoffWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for conn := range conns {
+				errLock.Lock()
+				failed := err != nil
+				errLock.Unlock()
+				if failed {
+					// Keep the rest instead of losing them.
+					continue
+				}
+				e := self.handoffConn(sock, conn, timeout, func(e error) {
+					errLock.Lock()
+					err = e
+					errLock.Unlock()
+				})
+				if e != nil {
+					self.reportError(conn.Service(), conn.Username(), conn.ConnId(), conn.ClientAddr().String(), e)
+					continue
+				}
+				atomic.AddInt64(&nrHandedOff, 1)
+			}
+		}()
+	}
+	for _, srv := range self.AllServices() {
+		center, _ := self.getServiceCenter(srv, false)
+		if center == nil {
+			continue
+		}
+		for _, usr := range center.ConnectedUsers() {
+			for _, conn := range center.Conns(usr) {
+				conns <- conn
+			}
+		}
+	}
+	close(conns)
+	wg.Wait()
+	n = int(nrHandedOff)
+	return
+}
+
+// handoffConn calls onSendError if the socket fails, in which case
+// no other connection should be sent.
+func (self *MessageCenter) handoffConn(sock *net.UnixConn, conn server.Conn, timeout time.Duration, onSendError func(err error)) error {
+	d, ok := conn.(server.Detacher)
+	if !ok {
+		return server.ErrCannotHandOff
+	}
+	state, f, err := d.Detach(timeout)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = handoff.Send(sock, state, f)
+	if err != nil {
+		onSendError(err)
+	}
+	return err
+}
+
+// Adopt serves the connections handed off over sock, e.g. returned by
+// handoff.Inherit, until the other process closes it, and returns
+// their number. The services should be added before.
+func (self *MessageCenter) Adopt(sock *net.UnixConn) (n int, err error) {
+	for {
+		state, c, e := handoff.Receive(sock)
+		if e == io.EOF {
+			return
+		}
+		if e != nil {
+			err = e
+			return
+		}
+		conn, e := server.RestoreConn(state, c, self)
+		if e == nil {
+			e = self.adoptConn(conn)
+		}
+		if e != nil {
+			self.reportError(state.Service, state.Username, state.ConnId, state.ClientAddr, e)
+			c.Close()
+			continue
+		}
+		n++
+	}
+}
+
+func (self *MessageCenter) adoptConn(conn server.Conn) error {
+	center, err := self.getServiceCenter(conn.Service(), true)
+	if err != nil {
+		return err
+	}
+	return center.adoptConn(conn)
+}
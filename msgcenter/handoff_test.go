@@ -0,0 +1,131 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+)
+
+func unixSocketPair(t *testing.T) (a, b *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "sock")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func TestHandoff(t *testing.T) {
+	addr := "127.0.0.1:8974"
+	msgChan := make(chan *proto.Message, 10)
+	errChan := make(chan error, 10)
+	old, pub, err := getMessageCenter(addr, nil, errChan)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	go old.Start()
+	// The new process listens on the same socket in production.
+	adopter, _, err := getMessageCenter("127.0.0.1:8975", msgChan, errChan)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer adopter.ln.Close()
+
+	usernames := []string{"alice", "bob"}
+	clients := make([]client.Conn, len(usernames))
+	for i, usr := range usernames {
+		clients[i], err = connectServer(addr, usr, pub, nil)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		defer clients[i].Close()
+	}
+	for len(old.ConnectedUsers("service")) < len(usernames) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	a, b := unixSocketPair(t)
+	adopted := make(chan int)
+	go func() {
+		n, err := adopter.Adopt(b)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		adopted <- n
+	}()
+	n, err := old.Handoff(a, 3*time.Second)
+	if err != nil || n != len(usernames) {
+		t.Fatalf("%v connections handed off: %v", n, err)
+	}
+	a.Close()
+	if n = <-adopted; n != len(usernames) {
+		t.Fatalf("%v connections adopted", n)
+	}
+	for len(old.ConnectedUsers("service")) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if nr := len(adopter.ConnectedUsers("service")); nr != len(usernames) {
+		t.Fatalf("%v users on the new center", nr)
+	}
+
+	for _, c := range clients {
+		msg := &proto.Message{Body: []byte("to " + c.Username())}
+		adopter.SendMessage("service", c.Username(), msg, nil, time.Hour)
+		mc, err := c.ReceiveMessage()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !mc.Message.Eq(msg) {
+			t.Errorf("wrong message after the handoff")
+		}
+
+		msg = &proto.Message{Body: []byte("from " + c.Username())}
+		if err = c.SendMessageToServer(msg); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		select {
+		case m := <-msgChan:
+			if !m.Eq(msg) {
+				t.Errorf("wrong message from the client after the handoff")
+			}
+		case <-time.After(3 * time.Second):
+			t.Errorf("no message from the client after the handoff")
+		}
+	}
+	select {
+	case err := <-errChan:
+		t.Errorf("Error: %v", err)
+	default:
+	}
+}
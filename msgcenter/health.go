@@ -0,0 +1,186 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"time"
+)
+
+// How often Drain checks whether the clients have left.
+const drainInterval = 100 * time.Millisecond
+
+// How long Health reuses the errors of the last ping of the stores.
+const pingInterval = 5 * time.Second
+
+// Health tells whether the node works and whether it could take more
+// clients, e.g. for the liveness and the readiness probes of Kubernetes.
+type Health struct {
+	// Listening tells whether the listener is being served.
+	Listening    bool `json:"listening"`
+	DeliveryOnly bool `json:"deliveryOnly,omitempty"`
+	Draining     bool `json:"draining"`
+
+	// Handshakes is nil if the node does not listen.
+	Handshakes *server.Stats `json:"handshakes,omitempty"`
+
+	// Errors maps the stores which could not be reached to the
+	// errors. A message cache is named after its service, e.g.
+	// "cache:service". The node is degraded but still ready then:
+	// the stores are shared by all the nodes, which would otherwise
+	// be taken out together.
+	Errors   map[string]string `json:"errors,omitempty"`
+	Degraded bool              `json:"degraded,omitempty"`
+}
+
+// Live tells whether the node works. It should be restarted otherwise.
+// A node stops listening when it drains, and still works. The stores
+// are not looked at.
+func (self *Health) Live() bool {
+	return self.Listening || self.DeliveryOnly || self.Draining
+}
+
+// Ready tells whether the node could take more clients: it listens,
+// it does not drain and some of its handshake workers are idle. It
+// may be degraded.
+func (self *Health) Ready() bool {
+	if self.Draining {
+		return false
+	}
+	if self.DeliveryOnly {
+		return true
+	}
+	return self.Listening && !self.Handshakes.Saturated()
+}
+
+// Health tells the errors of the last ping of the stores implementing
+// msgcache.Pinger, i.e. the message caches of the services, the
+// cluster locator and the revocation and binding stores. They are
+// pinged again in the background once the errors are older than
+// pingInterval, so that a probe never waits for a store.
+func (self *MessageCenter) Health() *Health {
+	ret := new(Health)
+	ret.DeliveryOnly = self.deliveryOnly
+	self.serverLock.Lock()
+	ret.Draining = self.draining
+	srv := self.server
+	self.serverLock.Unlock()
+	if srv != nil {
+		ret.Handshakes = srv.Stats()
+		ret.Listening = !ret.Handshakes.Closed && ret.Handshakes.NrListeners > 0
+	}
+
+	ret.Errors = self.pingErrors()
+	ret.Degraded = len(ret.Errors) > 0
+	return ret
+}
+
+// pingErrors returns the errors of the last ping, and pings the stores
+// again if they are stale. Only the first call waits for the ping.
+func (self *MessageCenter) pingErrors() map[string]string {
+	self.pingLock.Lock()
+	defer self.pingLock.Unlock()
+	if self.pingedAt.IsZero() {
+		self.pingedAt = time.Now()
+		self.pinged = self.ping()
+	} else if !self.pinging && time.Since(self.pingedAt) > pingInterval {
+		self.pinging = true
+		go func() {
+			errors := self.ping()
+			self.pingLock.Lock()
+			defer self.pingLock.Unlock()
+			self.pinged = errors
+			self.pingedAt = time.Now()
+			self.pinging = false
+		}()
+	}
+	return self.pinged
+}
+
+func (self *MessageCenter) ping() (errors map[string]string) {
+	ping := func(name string, store interface{}) {
+		p, ok := store.(msgcache.Pinger)
+		if !ok {
+			return
+		}
+		if err := p.Ping(); err != nil {
+			if errors == nil {
+				errors = make(map[string]string, 4)
+			}
+			errors[name] = err.Error()
+		}
+	}
+	for _, srv := range self.AllServices() {
+		if cache, err := self.msgCache(srv); err == nil {
+			ping("cache:"+srv, cache)
+		}
+	}
+	if self.cluster != nil {
+		ping("cluster", self.cluster.locator)
+	}
+	ping("revocation", self.revocations)
+	ping("binding", self.bindings)
+	return
+}
+
+// Draining tells whether Drain has been called.
+func (self *MessageCenter) Draining() bool {
+	self.serverLock.Lock()
+	defer self.serverLock.Unlock()
+	return self.draining
+}
+
+// Drain stops accepting connections and makes the node unready, so that
+// the clients reconnect to the other nodes. It waits up to timeout for
+// the connected clients to leave, then disconnects the others, stops
+// watching the assets and returns the number of connections.
+func (self *MessageCenter) Drain(timeout time.Duration) (n int) {
+	self.serverLock.Lock()
+	self.draining = true
+	srv := self.server
+	self.serverLock.Unlock()
+	if srv != nil {
+		srv.Close()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for self.hasConnectedUsers() && time.Now().Before(deadline) {
+		time.Sleep(drainInterval)
+	}
+	for _, srv := range self.AllServices() {
+		center, _ := self.getServiceCenter(srv, false)
+		if center == nil {
+			continue
+		}
+		for _, usr := range center.ConnectedUsers() {
+			n += center.disconnectLocal(usr, "", false)
+		}
+		center.stopWatchingAssets()
+	}
+	return
+}
+
+func (self *MessageCenter) hasConnectedUsers() bool {
+	for _, srv := range self.AllServices() {
+		if len(self.ConnectedUsers(srv)) > 0 {
+			return true
+		}
+	}
+	return false
+}
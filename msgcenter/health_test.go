@@ -0,0 +1,99 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/revocation"
+)
+
+func TestDrain(t *testing.T) {
+	addr := "127.0.0.1:8980"
+	center, pub, err := getMessageCenter(addr, nil, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	go center.Start()
+	conn, err := connectServer(addr, "alice", pub, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer conn.Close()
+	for len(center.ConnectedUsers("service")) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if health := center.Health(); !health.Ready() || len(health.Errors) != 0 {
+		t.Errorf("not ready: %+v", health)
+	}
+
+	drained := make(chan int)
+	go func() {
+		drained <- center.Drain(300 * time.Millisecond)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	health := center.Health()
+	if health.Ready() || !health.Live() || !center.Draining() {
+		t.Errorf("ready while draining: %+v", health)
+	}
+	if _, err := connectServer(addr, "bob", pub, nil); err == nil {
+		t.Errorf("a client connects while draining")
+	}
+	if n := <-drained; n != 1 {
+		t.Errorf("%v connections disconnected", n)
+	}
+	if _, err := conn.ReceiveMessage(); err == nil {
+		t.Errorf("the client is still connected")
+	}
+}
+
+type unreachableRevocations struct {
+	revocation.Store
+	nrPings int32
+}
+
+func (self *unreachableRevocations) Ping() error {
+	atomic.AddInt32(&self.nrPings, 1)
+	return errors.New("unreachable")
+}
+
+func TestDegraded(t *testing.T) {
+	addr := "127.0.0.1:8982"
+	center, _, err := getMessageCenter(addr, nil, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	store := &unreachableRevocations{Store: revocation.NewMemoryStore()}
+	center.revocations = store
+	go center.Start()
+	defer center.Drain(0)
+	for i := 0; i < 100 && !center.Health().Listening; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	health := center.Health()
+	if !health.Ready() || !health.Live() || !health.Degraded || health.Errors["revocation"] != "unreachable" {
+		t.Errorf("should be ready and degraded: %+v", health)
+	}
+	if n := atomic.LoadInt32(&store.nrPings); n != 1 {
+		t.Errorf("the stores are pinged %v times", n)
+	}
+}
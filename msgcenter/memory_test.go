@@ -0,0 +1,51 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"testing"
+)
+
+func TestOverMemoryLimit(t *testing.T) {
+	over := &Result{server.ErrMemoryLimit, "conn1", true, ""}
+	written := &Result{nil, "conn2", true, ""}
+	failed := &Result{errors.New("broken pipe"), "conn3", true, ""}
+	uncached := &proto.MessageContainer{Message: &proto.Message{Body: []byte("hello")}}
+	cached := &proto.MessageContainer{Id: "1", Message: uncached.Message}
+
+	cases := []struct {
+		mc   *proto.MessageContainer
+		res  []*Result
+		lost bool
+	}{
+		{uncached, []*Result{over}, true},
+		{uncached, []*Result{over, over}, true},
+		{uncached, []*Result{over, written}, false},
+		{uncached, []*Result{over, failed}, false},
+		{uncached, nil, false},
+		{cached, []*Result{over}, false},
+	}
+	for i, c := range cases {
+		if lost := overMemoryLimit(c.mc, c.res); lost != c.lost {
+			t.Errorf("case %v: lost should be %v", i, c.lost)
+		}
+	}
+}
@@ -18,12 +18,25 @@
 package msgcenter
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"errors"
 	"fmt"
+	"github.com/uniqush/uniqush-conn/analytics"
+	"github.com/uniqush/uniqush-conn/asset"
+	"github.com/uniqush/uniqush-conn/audit"
+	"github.com/uniqush/uniqush-conn/binding"
+	"github.com/uniqush/uniqush-conn/cluster"
 	"github.com/uniqush/uniqush-conn/evthandler"
+	"github.com/uniqush/uniqush-conn/federation"
+	"github.com/uniqush/uniqush-conn/latency"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/quota"
+	"github.com/uniqush/uniqush-conn/resource"
+	"github.com/uniqush/uniqush-conn/revocation"
+	"github.com/uniqush/uniqush-conn/sink"
 	"net"
 	"strings"
 	"sync"
@@ -31,6 +44,18 @@ import (
 )
 
 var ErrNoService = errors.New("invalid service")
+var ErrBadUsername = errors.New("bad username")
+var ErrCannotCache = errors.New("cannot cache the message")
+var ErrNoCache = errors.New("the service has no message cache")
+var ErrNoSubscriptionStore = errors.New("the service has no subscription store")
+var ErrNoPushService = errors.New("the service has no push service")
+var ErrNoQuota = errors.New("the service has no quota")
+var ErrNoAnalytics = errors.New("the service has no analytics")
+var ErrNoForwardAudit = errors.New("the service has no forward audit")
+var ErrNoFeed = errors.New("the cluster transport has no feed")
+var ErrNoBadges = errors.New("the service does not count the unread messages")
+var ErrNoAssets = errors.New("the service has no asset store")
+var ErrDropped = errors.New("the message is dropped by the transformer")
 
 type ServiceConfigReader interface {
 	ReadConfig(srv string) *ServiceConfig
@@ -42,14 +67,40 @@ type MessageCenter struct {
 
 	ln            net.Listener
 	auth          server.Authenticator
+	revoker       *server.Revoker
+	bindings      binding.Store
 	authtimeout   time.Duration
+	hslimits      server.HandshakeLimits
+	nrHsWorkers   int
 	fwdChan       chan *server.ForwardRequest
-	privkey       *rsa.PrivateKey
+	privkey       crypto.Signer
 	errHandler    evthandler.ErrorHandler
 	srvConfReader ServiceConfigReader
+	cluster       *clusterInfo
+	relay         *federation.Relay
+	logger        logger.Logger
+	events        *eventBus
+
+	forwardScheduler ForwardScheduler
+
+	// A delivery-only node has no client; see SetDeliveryOnly.
+	deliveryOnly bool
+
+	revocations revocation.Store
+
+	serverLock sync.Mutex
+	server     *server.Server
+	draining   bool
+
+	// The errors of the last ping of the stores. See Health.
+	pingLock sync.Mutex
+	pinged   map[string]string
+	pingedAt time.Time
+	pinging  bool
 }
 
 func (self *MessageCenter) reportError(service, username, connId, addr string, err error) {
+	self.logger.Error("error", "service", service, "username", username, "connId", connId, "addr", addr, "err", err)
 	if self.errHandler != nil {
 		go self.errHandler.OnError(service, username, connId, addr, err)
 	}
@@ -62,11 +113,21 @@ func (self *MessageCenter) process() {
 			if fwdreq == nil {
 				return
 			}
+			self.events.publish(forwardEvent(fwdreq))
 			srv := fwdreq.ReceiverService
-			self.srvCentersLock.Lock()
-			center, ok := self.serviceCenterMap[srv]
-			self.srvCentersLock.Unlock()
-			if !ok {
+			if self.relay != nil {
+				if self.relay.IsRemote(srv) {
+					go self.relayForward(fwdreq)
+					continue
+				}
+				srv = self.relay.LocalService(srv)
+				fwdreq.ReceiverService = srv
+			}
+			// In cluster mode, the receiver may be on another node.
+			center, err := self.getServiceCenter(srv, self.cluster != nil)
+			if err != nil || center == nil {
+				fwdreq.Done(proto.FWD_UNKNOWN_RECEIVER, "")
+				self.auditForward(fwdreq, proto.FWD_UNKNOWN_RECEIVER)
 				continue
 			}
 			center.ReceiveForward(fwdreq)
@@ -82,73 +143,704 @@ func (self *MessageCenter) AddService(srv string) *serviceCenter {
 		self.reportError(srv, "", "", "", fmt.Errorf("cannot find service's config"))
 		return nil
 	}
-	center := newServiceCenter(srv, config, self.fwdChan)
+	center := newServiceCenter(srv, config, self.fwdChan, self.cluster, self.events, self.logger)
+	center.scheduler = self.forwardScheduler
+	center.configOf = self.srvConfReader.ReadConfig
 	self.serviceCenterMap[srv] = center
 	return center
 }
 
-func (self *MessageCenter) serveConn(c net.Conn) {
-	conn, err := server.AuthConn(c, self.privkey, self.auth, self.authtimeout)
+func (self *MessageCenter) relayForward(fwdreq *server.ForwardRequest) {
+	err := self.relay.Forward(fwdreq)
 	if err != nil {
-		self.reportError("", "", "", c.RemoteAddr().String(), err)
-		c.Close()
+		fwd := &fwdreq.MessageContainer
+		self.reportError(fwd.SenderService, fwd.Sender, "", fwdreq.ReceiverService, err)
+		fwdreq.Done(proto.FWD_FAILED, "")
+		self.auditForward(fwdreq, proto.FWD_FAILED)
 		return
 	}
-	srv := conn.Service()
-	if len(srv) == 0 || strings.Contains(srv, ":") || strings.Contains(srv, "\n") {
-		self.reportError(srv, "", "", c.RemoteAddr().String(), fmt.Errorf("bad service name"))
+	fwdreq.Done(proto.FWD_OK, "")
+	self.auditForward(fwdreq, proto.FWD_OK)
+}
+
+// auditForward records a request which does not reach the service of
+// its receiver in the audit trail of the sender's service.
+func (self *MessageCenter) auditForward(fwdreq *server.ForwardRequest, status string) {
+	center, _ := self.getServiceCenter(fwdreq.MessageContainer.SenderService, false)
+	if center == nil {
 		return
 	}
+	size := 0
+	if fwdreq.MessageContainer.Message != nil {
+		size = fwdreq.MessageContainer.Message.Size()
+	}
+	center.auditForward(fwdreq, size, status, "", "")
+}
+
+// Forward accepts a forward request relayed from a peer deployment.
+// It implements federation.Receiver.
+func (self *MessageCenter) Forward(fwdreq *server.ForwardRequest) {
+	self.fwdChan <- fwdreq
+}
+
+// SetLogger should be called before adding any service or
+// starting the message center.
+func (self *MessageCenter) SetLogger(l logger.Logger) {
+	self.logger = logger.OrNop(l)
+}
+
+// SetHandshakeLimits bounds the handshakes of the connections accepted
+// afterwards. The timeout given to NewMessageCenter is used if
+// limits.Timeout is not set.
+func (self *MessageCenter) SetHandshakeLimits(limits server.HandshakeLimits) {
+	self.hslimits = limits
+}
+
+// SetHandshakeWorkers bounds the concurrent handshakes if n is
+// positive. See server.Server.NrWorkers. It should be called before
+// Start.
+func (self *MessageCenter) SetHandshakeWorkers(n int) {
+	self.nrHsWorkers = n
+}
+
+// SetFederation lets users forward messages to services of
+// other deployments through the relay.
+func (self *MessageCenter) SetFederation(relay *federation.Relay) {
+	self.relay = relay
+}
 
+func (self *MessageCenter) Federation() *federation.Relay {
+	return self.relay
+}
+
+// getServiceCenter returns nil if the service center does not
+// exist and create is false.
+func (self *MessageCenter) getServiceCenter(srv string, create bool) (center *serviceCenter, err error) {
 	self.srvCentersLock.Lock()
+	defer self.srvCentersLock.Unlock()
 	center, ok := self.serviceCenterMap[srv]
-	if !ok {
-		config := self.srvConfReader.ReadConfig(srv)
-		if config == nil {
-			self.reportError(srv, "", "", c.RemoteAddr().String(), fmt.Errorf("cannot find service's config"))
-			self.srvCentersLock.Unlock()
-			return
-		}
-		center = newServiceCenter(srv, config, self.fwdChan)
-		self.serviceCenterMap[srv] = center
+	if ok || !create {
+		return
+	}
+	config := self.srvConfReader.ReadConfig(srv)
+	if config == nil {
+		err = fmt.Errorf("cannot find service's config")
+		return
+	}
+	center = newServiceCenter(srv, config, self.fwdChan, self.cluster, self.events, self.logger)
+	center.scheduler = self.forwardScheduler
+	center.configOf = self.srvConfReader.ReadConfig
+	self.serviceCenterMap[srv] = center
+	return
+}
+
+func (self *MessageCenter) serveConn(conn server.Conn) {
+	srv := conn.Service()
+	if len(srv) == 0 || strings.Contains(srv, ":") || strings.Contains(srv, "\n") {
+		self.reportError(srv, "", "", conn.ClientAddr().String(), fmt.Errorf("bad service name"))
+		return
+	}
+
+	center, err := self.getServiceCenter(srv, true)
+	if err != nil {
+		self.reportError(srv, "", "", conn.ClientAddr().String(), err)
+		return
 	}
-	self.srvCentersLock.Unlock()
 
 	err = center.NewConn(conn)
 	if err != nil {
-		self.reportError(srv, conn.Username(), "", c.RemoteAddr().String(), err)
+		self.reportError(srv, conn.Username(), "", conn.ClientAddr().String(), err)
 	}
 }
 
+// Dictionary returns the compression dictionary of the service.
+// It implements server.DictionaryFinder.
+func (self *MessageCenter) Dictionary(service string) *proto.Dictionary {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil {
+		return nil
+	}
+	return config.CompressionDictionary
+}
+
+// AllowPlaintext tells if the public messages of the service may
+// be sent in plaintext. It implements server.PlaintextPolicy.
+func (self *MessageCenter) AllowPlaintext(service string) bool {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil {
+		return false
+	}
+	return config.PlaintextPublic
+}
+
 func (self *MessageCenter) SendMessage(service, username string, msg *proto.Message, extra map[string]string, ttl time.Duration) []*Result {
+	mc := &proto.MessageContainer{
+		Message: msg,
+	}
+	res, err := self.DeliverMessage(service, username, mc, extra, ttl)
+	if err == ErrBadUsername {
+		res = []*Result{&Result{fmt.Errorf("[Service=%v] bad username", username), "", false, ""}}
+	} else if qerr, ok := err.(*proto.QuotaError); ok {
+		res = []*Result{&Result{qerr, "", false, ""}}
+	} else if verr, ok := err.(*proto.ValidationError); ok {
+		res = []*Result{&Result{verr, "", false, ""}}
+	}
+	return res
+}
+
+// DeliverMessage caches the message and sends it to all connections
+// of the user. The id and the sequence number assigned by the cache
+// are set in mc. The error is a *proto.ValidationError if the message
+// is rejected by the validator of the service, or a *proto.QuotaError
+// if the message exceeds the quota of the user or of the service.
+func (self *MessageCenter) DeliverMessage(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) (res []*Result, err error) {
 	if len(username) == 0 || strings.Contains(username, ":") || strings.Contains(username, "\n") {
-		res := []*Result{&Result{fmt.Errorf("[Service=%v] bad username", username), "", false}}
-		return res
+		err = ErrBadUsername
+		return
+	}
+	// In cluster mode, the user may be on another node.
+	center, err := self.getServiceCenter(service, self.cluster != nil)
+	if err != nil || center == nil {
+		err = ErrNoService
+		return
 	}
+	if verr := center.validate(username, mc); verr != nil {
+		err = verr
+		return
+	}
+	if qerr := center.chargeQuota(service, username, mc.Message); qerr != nil {
+		err = qerr
+		return
+	}
+	res = center.sendMessageContainer(username, mc, extra, ttl)
+	if res == nil {
+		err = ErrCannotCache
+	}
+	return
+}
+
+// DeliverLocal delivers a message sent from another node to the local
+// connections of the user. It implements cluster.Receiver.
+func (self *MessageCenter) DeliverLocal(service, username string, mc *proto.MessageContainer, extra map[string]string) []*cluster.Result {
+	center, _ := self.getServiceCenter(service, false)
+	if center == nil {
+		return nil
+	}
+	return toClusterResults(center.deliverLocal(username, mc, extra))
+}
+
+// SetCluster makes the message center a node of a cluster. It should
+// be called before adding any service or starting the message center.
+// node is the address on which other nodes could reach this node.
+// A delivery-only node serves the feed of the transport instead, and
+// fails with ErrNoFeed if the transport has none.
+func (self *MessageCenter) SetCluster(node string, locator cluster.Locator, transport cluster.Transport) error {
+	if len(node) == 0 {
+		return cluster.ErrBadNode
+	}
+	// Connections registered by the previous run are gone.
+	err := locator.Purge(node)
+	if err != nil {
+		return err
+	}
+	if self.deliveryOnly {
+		// Nobody is connected to it: it is fed instead.
+		feed, ok := transport.(cluster.Feed)
+		if !ok {
+			return ErrNoFeed
+		}
+		err = feed.ServeFeed(self)
+		if err != nil {
+			return err
+		}
+	} else if ep, ok := transport.(cluster.Endpoint); ok {
+		err = ep.Serve(node, self)
+		if err != nil {
+			return err
+		}
+	}
+	self.cluster = &clusterInfo{
+		node:      node,
+		locator:   locator,
+		transport: transport,
+	}
+	return nil
+}
+
+// Node returns the name of this node in the cluster, or
+// an empty string if it is not in a cluster.
+func (self *MessageCenter) Node() string {
+	if self.cluster == nil {
+		return ""
+	}
+	return self.cluster.node
+}
+
+// AllServices returns the services with a running service center.
+func (self *MessageCenter) AllServices() []string {
 	self.srvCentersLock.Lock()
-	center, ok := self.serviceCenterMap[service]
-	self.srvCentersLock.Unlock()
+	defer self.srvCentersLock.Unlock()
+	ret := make([]string, 0, len(self.serviceCenterMap))
+	for srv, _ := range self.serviceCenterMap {
+		ret = append(ret, srv)
+	}
+	return ret
+}
 
-	if !ok {
+// ConnectedUsers returns the users connected to this node.
+func (self *MessageCenter) ConnectedUsers(service string) []string {
+	center, _ := self.getServiceCenter(service, false)
+	if center == nil {
 		return nil
 	}
-	return center.SendMessage(username, msg, extra, ttl)
+	return center.ConnectedUsers()
 }
 
-func (self *MessageCenter) Start() {
-	go self.process()
-	for {
-		conn, err := self.ln.Accept()
+// KnownUsers returns the users of the service this node knows of
+// besides the connected ones: the subscribers of its subscription
+// store, if any. It implements scheduler.Directory.
+func (self *MessageCenter) KnownUsers(service string) (usernames []string, err error) {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil || config.SubscriptionStore == nil {
+		return
+	}
+	return config.SubscriptionStore.Subscribers(service)
+}
+
+func (self *MessageCenter) ConnStats(service, username string) []*server.ConnStats {
+	center, _ := self.getServiceCenter(service, false)
+	if center == nil {
+		return nil
+	}
+	conns := center.Conns(username)
+	ret := make([]*server.ConnStats, 0, len(conns))
+	for _, conn := range conns {
+		ret = append(ret, conn.Stats())
+	}
+	return ret
+}
+
+// Latency returns the latency histograms of each stage of the
+// deliveries to the connections on this node.
+func (self *MessageCenter) Latency(service string) map[string]*latency.Snapshot {
+	center, _ := self.getServiceCenter(service, false)
+	if center == nil {
+		return nil
+	}
+	return center.latency.Snapshot()
+}
+
+// Resources returns what the service holds on this node, or nil if
+// none of its users has connected to this node.
+func (self *MessageCenter) Resources(service string) *resource.Usage {
+	center, _ := self.getServiceCenter(service, false)
+	if center == nil {
+		return nil
+	}
+	return center.resources.Usage()
+}
+
+// MessageSinkStats tells what the message sink of the service has
+// written or dropped on this node, or nil if the service has none.
+func (self *MessageCenter) MessageSinkStats(service string) *sink.Stats {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil || config.MessageSink == nil {
+		return nil
+	}
+	return config.MessageSink.Stats()
+}
+
+// Presence describes the connections of a user. Visibility is
+// only known for connections on this node.
+type Presence struct {
+	Online  bool
+	Visible bool
+	NrConns int
+
+	// The visibility of each connection on this node.
+	Conns map[string]bool
+
+	// Other nodes on which the user has connections.
+	Nodes []string
+}
+
+func (self *MessageCenter) Presence(service, username string) *Presence {
+	ret := new(Presence)
+	center, _ := self.getServiceCenter(service, false)
+	if center != nil {
+		v := center.Visibility(username)
+		ret.NrConns = len(v.Conns)
+		ret.Visible = v.AnyVisible()
+		ret.Conns = v.Conns
+	}
+	if self.cluster != nil {
+		nodes, err := self.cluster.locator.Locate(service, username)
+		if err != nil {
+			self.reportError(service, username, "", "", err)
+		}
+		for _, node := range nodes {
+			if node != self.cluster.node {
+				ret.Nodes = append(ret.Nodes, node)
+			}
+		}
+	}
+	ret.Online = ret.NrConns > 0 || len(ret.Nodes) > 0
+	return ret
+}
+
+// Visibility aggregates the visibility of the connections of the
+// user on this node.
+func (self *MessageCenter) Visibility(service, username string) *Visibility {
+	center, _ := self.getServiceCenter(service, false)
+	if center == nil {
+		return newVisibility(0)
+	}
+	return center.Visibility(username)
+}
+
+// Disconnect closes all connections of the user on all nodes and
+// returns the number of closed connections.
+func (self *MessageCenter) Disconnect(service, username string) int {
+	center, _ := self.getServiceCenter(service, true)
+	if center == nil {
+		return 0
+	}
+	return center.Disconnect(username, "", false)
+}
+
+// Kick revokes the connections of the user on all nodes, or only the
+// connection connId if it is not empty, and returns the number of
+// closed connections. The clients are told the connections are revoked.
+func (self *MessageCenter) Kick(service, username, connId string) int {
+	center, _ := self.getServiceCenter(service, true)
+	if center == nil {
+		return 0
+	}
+	return center.Disconnect(username, connId, true)
+}
+
+// DisconnectLocal closes the connections of the user on this node.
+// It implements cluster.Receiver.
+func (self *MessageCenter) DisconnectLocal(service, username, connId string, revoke bool) int {
+	center, _ := self.getServiceCenter(service, false)
+	if center == nil {
+		return 0
+	}
+	return center.disconnectLocal(username, connId, revoke)
+}
+
+// SetRevocationStore keeps the revocations in the store, which should
+// be shared by all nodes. It should be called before Start().
+func (self *MessageCenter) SetRevocationStore(store revocation.Store) {
+	self.revocations = store
+	self.revoker = server.NewRevoker(self.auth, store)
+}
+
+// Revoke rejects the token of the user when it reconnects. An empty
+// token rejects all tokens of the user.
+func (self *MessageCenter) Revoke(service, username, token string) error {
+	return self.revoker.Revoke(service, username, token)
+}
+
+// Unrevoke lets the user connect again.
+func (self *MessageCenter) Unrevoke(service, username string) error {
+	return self.revoker.Unrevoke(service, username)
+}
+
+// SetBindingStore keeps what the tokens are bound to in the store,
+// which should be shared by all nodes. It should be called before
+// Start().
+func (self *MessageCenter) SetBindingStore(store binding.Store) {
+	self.bindings = store
+}
+
+// Unbind lets the tokens of the user be used from another device or
+// network. They are bound again to where they are used next.
+func (self *MessageCenter) Unbind(service, username string) error {
+	return self.bindings.Unbind(service, username)
+}
+
+// BindingPolicy tells what the tokens of the service are bound to. It
+// implements server.BindingPolicyFinder.
+func (self *MessageCenter) BindingPolicy(service string) *binding.Policy {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil {
+		return nil
+	}
+	return config.TokenBinding
+}
+
+// SetDigestThreshold changes the digest threshold of all connections
+// of the user on this node and returns the number of connections.
+func (self *MessageCenter) SetDigestThreshold(service, username string, threshold int) int {
+	center, _ := self.getServiceCenter(service, false)
+	if center == nil {
+		return 0
+	}
+	conns := center.Conns(username)
+	for _, conn := range conns {
+		conn.SetDigestThreshold(threshold)
+	}
+	return len(conns)
+}
+
+func (self *MessageCenter) msgCache(service string) (cache msgcache.Cache, err error) {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil {
+		err = ErrNoService
+		return
+	}
+	if config.MsgCache == nil {
+		err = ErrNoCache
+		return
+	}
+	cache = config.MsgCache
+	return
+}
+
+// NrUndelivered returns the number of cached messages which have
+// never been delivered to the user.
+func (self *MessageCenter) NrUndelivered(service, username string) (n int, err error) {
+	cache, err := self.msgCache(service)
+	if err != nil {
+		return
+	}
+	return cache.NrUndelivered(service, username)
+}
+
+// DeliveryState returns nil if the message with the id was never cached.
+func (self *MessageCenter) DeliveryState(service, username, id string) (state *msgcache.DeliveryState, err error) {
+	cache, err := self.msgCache(service)
+	if err != nil {
+		return
+	}
+	return cache.GetDeliveryState(service, username, id)
+}
+
+// QueryCache returns the cached messages of the user matching the
+// predicate. See msgcache.Cache.Query.
+func (self *MessageCenter) QueryCache(service, username string, p *msgcache.Predicate) (msgs []*proto.MessageContainer, err error) {
+	cache, err := self.msgCache(service)
+	if err != nil {
+		return
+	}
+	return cache.Query(service, username, p)
+}
+
+// QuotaUsage is what a user, and the whole service, have sent in a day.
+type QuotaUsage struct {
+	Day     time.Time    `json:"day"`
+	User    *quota.Usage `json:"user,omitempty"`
+	Service *quota.Usage `json:"service"`
+	Limits  quota.Limits `json:"limits"`
+}
+
+// QuotaUsage returns the usage of the day. Only the usage of the
+// service is returned if username is empty.
+func (self *MessageCenter) QuotaUsage(service, username string, day time.Time) (usage *QuotaUsage, err error) {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil {
+		err = ErrNoService
+		return
+	}
+	if config.Quota == nil {
+		err = ErrNoQuota
+		return
+	}
+	ret := &QuotaUsage{Day: quota.Day(day), Limits: config.Quota.Limits()}
+	if len(username) > 0 {
+		ret.User, err = config.Quota.Usage(service, username, day)
 		if err != nil {
-			self.reportError("", "", "", self.ln.Addr().String(), err)
-			continue
+			return
 		}
-		go self.serveConn(conn)
 	}
+	ret.Service, err = config.Quota.Usage(service, "", day)
+	if err != nil {
+		return
+	}
+	usage = ret
+	return
+}
+
+// Analytics returns the counters of the service per hour or day,
+// from the period of from to the one of to.
+func (self *MessageCenter) Analytics(service string, from, to time.Time, resolution string) (points []*analytics.Point, err error) {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil {
+		err = ErrNoService
+		return
+	}
+	if config.Analytics == nil {
+		err = ErrNoAnalytics
+		return
+	}
+	return config.Analytics.Query(service, from, to, resolution)
+}
+
+// ForwardAudit returns the records of the requests forwarded to the
+// users of the service. The user queried is in the service unless
+// q.Service is set.
+func (self *MessageCenter) ForwardAudit(service string, q *audit.Query) (records []*audit.Record, err error) {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil {
+		err = ErrNoService
+		return
+	}
+	if config.ForwardAudit == nil {
+		err = ErrNoForwardAudit
+		return
+	}
+	if len(q.Service) == 0 {
+		query := *q
+		query.Service = service
+		q = &query
+	}
+	return config.ForwardAudit.Query(q)
+}
+
+// Unread returns the number of unread messages of the user. See
+// ServiceConfig.Badges.
+func (self *MessageCenter) Unread(service, username string) (n int, err error) {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil {
+		err = ErrNoService
+		return
+	}
+	if config.Badges == nil {
+		err = ErrNoBadges
+		return
+	}
+	return config.Badges.Count(service, username)
+}
+
+// PublishAsset stores a new version of the asset of the service and
+// pushes it to the connected clients. See ServiceConfig.Assets.
+func (self *MessageCenter) PublishAsset(service, name string, data []byte) (a *asset.Asset, err error) {
+	center, err := self.getServiceCenter(service, true)
+	if err != nil {
+		return
+	}
+	return center.PublishAsset(name, data)
+}
+
+// Assets returns the latest version of every asset of the service.
+func (self *MessageCenter) Assets(service string) (assets []*asset.Asset, err error) {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil {
+		err = ErrNoService
+		return
+	}
+	if config.Assets == nil {
+		err = ErrNoAssets
+		return
+	}
+	return config.Assets.Latest(service)
+}
+
+// AppliedAssets returns the latest versions of the assets applied by
+// the devices of the user, by device and then by name. The clients
+// which do not tell their device are keyed by their connection id.
+func (self *MessageCenter) AppliedAssets(service, username string) (versions map[string]map[string]uint64, err error) {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil {
+		err = ErrNoService
+		return
+	}
+	if config.Assets == nil {
+		err = ErrNoAssets
+		return
+	}
+	return config.Assets.Applied(service, username)
+}
+
+// Subscriptions returns the push notification subscriptions recorded
+// for the user.
+func (self *MessageCenter) Subscriptions(service, username string) (subs []map[string]string, err error) {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil {
+		err = ErrNoService
+		return
+	}
+	if config.SubscriptionStore == nil {
+		err = ErrNoSubscriptionStore
+		return
+	}
+	return config.SubscriptionStore.Subscriptions(service, username)
+}
+
+// SyncSubscriptions subscribes the user, or every subscriber of the
+// service if username is empty, to the push service again with the
+// recorded subscriptions. It returns the number of subscriptions sent.
+func (self *MessageCenter) SyncSubscriptions(service, username string) (n int, err error) {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil {
+		err = ErrNoService
+		return
+	}
+	if config.SubscriptionStore == nil {
+		err = ErrNoSubscriptionStore
+		return
+	}
+	if config.PushService == nil {
+		err = ErrNoPushService
+		return
+	}
+	usernames := []string{username}
+	if len(username) == 0 {
+		usernames, err = config.SubscriptionStore.Subscribers(service)
+		if err != nil {
+			return
+		}
+	}
+	for _, u := range usernames {
+		var subs []map[string]string
+		subs, err = config.SubscriptionStore.Subscriptions(service, u)
+		if err != nil {
+			return
+		}
+		for _, sub := range subs {
+			err = config.PushService.Subscribe(service, u, sub)
+			if err != nil {
+				return
+			}
+			n++
+		}
+	}
+	return
+}
+
+func (self *MessageCenter) Start() {
+	go self.process()
+	if self.deliveryOnly {
+		return
+	}
+	limits := self.hslimits
+	if limits.Timeout <= 0 {
+		limits.Timeout = self.authtimeout
+	}
+	srv := &server.Server{
+		PrivateKey:   self.privkey,
+		Auth:         server.NewBinder(self.revoker, self.bindings, self),
+		Limits:       limits,
+		Dictionaries: self,
+		Handler:      server.HandlerFunc(self.serveConn),
+		NrWorkers:    self.nrHsWorkers,
+		OnError: func(addr net.Addr, err error) {
+			self.reportError("", "", "", addr.String(), err)
+		},
+	}
+	self.serverLock.Lock()
+	if self.draining {
+		self.serverLock.Unlock()
+		return
+	}
+	self.server = srv
+	self.serverLock.Unlock()
+	srv.Serve(self.ln)
 }
 
 func NewMessageCenter(ln net.Listener,
-	privkey *rsa.PrivateKey,
+	privkey crypto.Signer,
 	errHandler evthandler.ErrorHandler,
 	authtimeout time.Duration,
 	auth server.Authenticator,
@@ -156,12 +848,16 @@ func NewMessageCenter(ln net.Listener,
 
 	self := new(MessageCenter)
 	self.ln = ln
+	self.events = newEventBus()
 	self.auth = auth
+	self.revoker = server.NewRevoker(auth, nil)
+	self.bindings = binding.NewMemoryStore()
 	self.authtimeout = authtimeout
 	self.fwdChan = make(chan *server.ForwardRequest)
 	self.privkey = privkey
 	self.errHandler = errHandler
 	self.srvConfReader = srvConfReader
 	self.serviceCenterMap = make(map[string]*serviceCenter, 128)
+	self.logger = logger.Nop()
 	return self
 }
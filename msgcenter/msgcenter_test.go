@@ -25,8 +25,10 @@ import (
 	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/client"
+	"github.com/uniqush/uniqush-conn/proto/server"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -119,13 +121,13 @@ func server2client(center *MessageCenter, clients []client.Conn, errChan chan<-
 
 func testClientReceived(client client.Conn, errChan chan<- error, msgs ...*proto.Message) {
 	for _, msg := range msgs {
-		m, err := client.ReadMessage()
+		mc, err := client.ReceiveMessage()
 		if err != nil {
 			errChan <- err
 			continue
 		}
-		if !m.EqContent(msg) {
-			errChan <- fmt.Errorf("[client=%v] %v != %v", client.Username(), m, msg)
+		if !mc.Message.Eq(msg) {
+			errChan <- fmt.Errorf("[client=%v] %v != %v", client.Username(), mc.Message, msg)
 		}
 	}
 }
@@ -187,12 +189,13 @@ func TestServerSendToClients(t *testing.T) {
 
 func receiveAndCompareMessages(msgChan <-chan *proto.Message, msgs map[string]*proto.Message, errChan chan<- error) {
 	for msg := range msgChan {
-		if m, ok := msgs[msg.Sender]; ok {
-			if !m.EqContent(msg) {
-				errChan <- fmt.Errorf("user %v should receive %v; but got %v", msg.Sender, m, msg)
+		sender := msg.Header["sender"]
+		if m, ok := msgs[sender]; ok {
+			if !m.Eq(msg) {
+				errChan <- fmt.Errorf("user %v should receive %v; but got %v", sender, m, msg)
 			}
 		} else {
-			errChan <- fmt.Errorf("Received message from unknown user: %v.", msg.Sender)
+			errChan <- fmt.Errorf("Received message from unknown user: %v.", sender)
 		}
 	}
 }
@@ -205,7 +208,8 @@ func TestClientsSendToServer(t *testing.T) {
 	defer close(errChan)
 
 	msgChan := make(chan *proto.Message)
-	center, pubkey, err := getMessageCenter(addr, msgChan, errChan)
+	reported := make(chan *proto.Message)
+	center, pubkey, err := getMessageCenter(addr, reported, errChan)
 	if err != nil {
 		t.Errorf("Error: %v", err)
 		return
@@ -223,6 +227,7 @@ func TestClientsSendToServer(t *testing.T) {
 			return
 		}
 		msg := randomMessage()
+		msg.Header["sender"] = username
 		msgs[username] = msg
 		clients[i] = client
 	}
@@ -233,14 +238,255 @@ func TestClientsSendToServer(t *testing.T) {
 	wg := new(sync.WaitGroup)
 	wg.Add(N)
 	start := make(chan bool)
-	for _, client := range clients {
-		go func() {
+	for _, c := range clients {
+		go func(c client.Conn) {
 			<-start
-			msg := msgs[client.Username()]
-			client.SendMessage(msg)
+			msg := msgs[c.Username()]
+			c.SendMessageToServer(msg)
 			wg.Done()
-		}()
+		}(c)
 	}
 	close(start)
 	wg.Wait()
+	// The messages are reported after they are sent.
+	for i := 0; i < N; i++ {
+		msgChan <- <-reported
+	}
+}
+
+func TestAdminOperations(t *testing.T) {
+	addr := "127.0.0.1:8970"
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	center, pubkey, err := getMessageCenter(addr, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	go center.Start()
+
+	c, err := connectServer(addr, "user", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	// Wait for the connection to be added.
+	time.Sleep(100 * time.Millisecond)
+
+	users := center.ConnectedUsers("service")
+	if len(users) != 1 || users[0] != "user" {
+		t.Errorf("bad users: %v", users)
+	}
+	if n := center.SetDigestThreshold("service", "user", 4096); n != 1 {
+		t.Errorf("should change one connection: %v", n)
+	}
+	stats := center.ConnStats("service", "user")
+	if len(stats) != 1 || stats[0].DigestThreshold != 4096 {
+		t.Errorf("bad stats: %v", stats)
+	}
+	if n := center.Disconnect("service", "user"); n != 1 {
+		t.Errorf("should disconnect one connection: %v", n)
+	}
+	_, err = c.ReceiveMessage()
+	if err == nil {
+		t.Errorf("connection should be closed")
+	}
+}
+
+func TestListenEvents(t *testing.T) {
+	addr := "127.0.0.1:8971"
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	center, pubkey, err := getMessageCenter(addr, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	evtChan := make(chan *Event, 10)
+	center.Listen(evtChan)
+	defer center.Unlisten(evtChan)
+	go center.Start()
+
+	c, err := connectServer(addr, "user", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer c.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	if p := center.Presence("service", "user"); !p.Online || p.NrConns != 1 || !p.Visible || len(p.Conns) != 1 {
+		t.Errorf("bad presence: %+v", p)
+	}
+	c.SetVisibility(false)
+	time.Sleep(100 * time.Millisecond)
+	if v := center.Visibility("service", "user"); !v.AllInvisible() || v.AnyVisible() {
+		t.Errorf("bad visibility: %+v", v)
+	}
+	c.SetVisibility(true)
+	time.Sleep(100 * time.Millisecond)
+	if p := center.Presence("service", "nobody"); p.Online {
+		t.Errorf("bad presence: %+v", p)
+	}
+
+	c.Subscribe(map[string]string{"pushservicetype": "gcm"})
+	c.SendMessageToServer(randomMessage())
+	c.SendMessageToUser("service", "user2", randomMessage(), time.Hour)
+
+	seen := make(map[string]*Event, 4)
+	for len(seen) < 4 {
+		select {
+		case evt := <-evtChan:
+			if evt.Type == EVENT_DELIVER {
+				continue
+			}
+			if evt.Service != "service" || evt.Username != "user" {
+				t.Errorf("bad event: %+v", evt)
+			}
+			seen[evt.Type] = evt
+		case <-time.After(3 * time.Second):
+			t.Errorf("missing events: %v", seen)
+			return
+		}
+	}
+	if evt := seen[EVENT_FORWARD]; evt == nil || evt.Receiver != "user2" {
+		t.Errorf("bad forward event: %+v", evt)
+	}
+	if evt := seen[EVENT_SUBSCRIBE]; evt == nil || evt.Params["pushservicetype"] != "gcm" {
+		t.Errorf("bad subscribe event: %+v", evt)
+	}
+	if evt := seen[EVENT_MESSAGE]; evt == nil || len(evt.ConnId) == 0 {
+		t.Errorf("bad message event: %+v", evt)
+	}
+	if evt := seen[EVENT_CONNECT]; evt == nil || len(evt.ConnId) == 0 || len(evt.Addr) == 0 {
+		t.Errorf("bad connect event: %+v", evt)
+	}
+
+	msg := randomMessage()
+	center.SendMessage("service", "user", msg, nil, time.Hour)
+	for {
+		select {
+		case evt := <-evtChan:
+			if evt.Type != EVENT_DELIVER || evt.Username != "user" {
+				continue
+			}
+			if len(evt.MessageId) == 0 || !evt.Message.Eq(msg) {
+				t.Errorf("bad deliver event: %+v", evt)
+			}
+			return
+		case <-time.After(3 * time.Second):
+			t.Errorf("missing deliver event")
+			return
+		}
+	}
+}
+
+func TestServerSendToMultipleConns(t *testing.T) {
+	addr := "127.0.0.1:8972"
+	N := 3
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	center, pubkey, err := getMessageCenter(addr, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	go center.Start()
+
+	clients := make([]client.Conn, N)
+	for i, _ := range clients {
+		clients[i], err = connectServer(addr, "user", pubkey, nil)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		defer clients[i].Close()
+	}
+	for i := 0; i < 100 && len(center.ConnStats("service", "user")) < N; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	msg := randomMessage()
+	wg := new(sync.WaitGroup)
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c client.Conn) {
+			testClientReceived(c, errChan, msg)
+			wg.Done()
+		}(c)
+	}
+	res := center.SendMessage("service", "user", msg, nil, 0*time.Second)
+	if len(res) != N {
+		t.Errorf("the message should be sent to %v connections: %v", N, res)
+	}
+	wg.Wait()
+}
+
+func TestKickAndRevoke(t *testing.T) {
+	addr := "127.0.0.1:8973"
+	errChan := make(chan error)
+	go func() {
+		for err := range errChan {
+			if err != nil && !strings.Contains(err.Error(), server.ErrAuthFail.Error()) {
+				t.Errorf("Error: %v", err)
+			}
+		}
+	}()
+	defer close(errChan)
+
+	center, pubkey, err := getMessageCenter(addr, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	go center.Start()
+
+	clients := make([]client.Conn, 2)
+	for i, _ := range clients {
+		clients[i], err = connectServer(addr, "user", pubkey, nil)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		defer clients[i].Close()
+	}
+	for i := 0; i < 100 && len(center.ConnStats("service", "user")) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := center.Kick("service", "user", clients[0].ConnId()); n != 1 {
+		t.Errorf("should kick one connection: %v", n)
+	}
+	if _, err := clients[0].ReceiveMessage(); err != client.ErrRevoked {
+		t.Errorf("the connection should be revoked: %v", err)
+	}
+	if stats := center.ConnStats("service", "user"); len(stats) != 1 || stats[0].ConnId != clients[1].ConnId() {
+		t.Errorf("the other connection should be kept: %v", stats)
+	}
+
+	center.Revoke("service", "user", "token")
+	if n := center.Kick("service", "user", ""); n != 1 {
+		t.Errorf("should kick one connection: %v", n)
+	}
+	if _, err := clients[1].ReceiveMessage(); err != client.ErrRevoked {
+		t.Errorf("the connection should be revoked: %v", err)
+	}
+	if c, err := connectServer(addr, "user", pubkey, nil); err == nil {
+		c.Close()
+		t.Errorf("a revoked token should not be accepted")
+	}
+
+	center.Unrevoke("service", "user")
+	c, err := connectServer(addr, "user", pubkey, nil)
+	if err != nil {
+		t.Errorf("the token should be accepted again: %v", err)
+		return
+	}
+	c.Close()
 }
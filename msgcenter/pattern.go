@@ -0,0 +1,40 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"path"
+	"strings"
+)
+
+// IsServicePattern returns true if the name contains any of the
+// wildcards accepted by MatchService.
+func IsServicePattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// MatchService reports whether the service matches the pattern.
+// The syntax is the one of path.Match, so "chat.*" matches
+// "chat.tenant1". A malformed pattern matches nothing.
+func MatchService(pattern, service string) bool {
+	if !IsServicePattern(pattern) {
+		return pattern == service
+	}
+	matched, err := path.Match(pattern, service)
+	return err == nil && matched
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import "testing"
+
+func TestMatchService(t *testing.T) {
+	cases := []struct {
+		pattern string
+		service string
+		match   bool
+	}{
+		{"chat", "chat", true},
+		{"chat", "chat.a", false},
+		{"chat.*", "chat.a", true},
+		{"chat.*", "chat.", true},
+		{"chat.*", "chat", false},
+		{"chat.*", "game.a", false},
+		{"*", "anything", true},
+		{"chat.[ab]", "chat.b", true},
+		{"chat.[", "chat.[", false},
+	}
+	for _, c := range cases {
+		if MatchService(c.pattern, c.service) != c.match {
+			t.Errorf("MatchService(%q, %q) should be %v", c.pattern, c.service, c.match)
+		}
+	}
+}
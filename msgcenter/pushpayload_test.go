@@ -0,0 +1,118 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/push"
+	"github.com/uniqush/uniqush-conn/testsupport"
+)
+
+// pushInfoRecorder has one delivery point for every user.
+type pushInfoRecorder struct {
+	recordingPush
+	pushed chan map[string]string
+}
+
+func (self *pushInfoRecorder) Push(service, username string, info map[string]string, msgIds []string) error {
+	self.pushed <- info
+	return nil
+}
+
+func (self *pushInfoRecorder) NrDeliveryPoints(service, username string) int {
+	return 1
+}
+
+func mustParseDigestTemplate(t *testing.T, str string) *server.DigestTemplate {
+	tmpl, err := server.ParseDigestTemplate(str)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return tmpl
+}
+
+func TestPushPayload(t *testing.T) {
+	recorder := &pushInfoRecorder{pushed: make(chan map[string]string, 10)}
+	conf := &ServiceConfig{
+		MsgCache:              testsupport.NewMockCache(),
+		ForwardRequestHandler: allowForward{},
+		PushHandler:           alwaysPush{},
+		PushService:           recorder,
+		PushPayload: &push.PayloadMapping{
+			Title:       mustParseDigestTemplate(t, "{sender}"),
+			Body:        mustParseDigestTemplate(t, "{sender}: {text}"),
+			Badge:       mustParseDigestTemplate(t, "{unread}"),
+			CollapseKey: mustParseDigestTemplate(t, "{thread}"),
+		},
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+
+	pushed := func() map[string]string {
+		select {
+		case info := <-recorder.pushed:
+			return info
+		case <-time.After(3 * time.Second):
+			t.Fatalf("the message is not pushed")
+		}
+		return nil
+	}
+
+	fwdreq := forwardFrom("bob")
+	fwdreq.MessageContainer.Message = &proto.Message{
+		Header:   map[string]string{"text": "hello", "unread": "3"},
+		ThreadId: "t1",
+	}
+	center.ReceiveForward(fwdreq)
+	info := pushed()
+	expected := map[string]string{
+		push.INFO_TITLE:             "bob",
+		push.INFO_BODY:              "bob: hello",
+		push.INFO_BADGE:             "3",
+		push.INFO_FCM_COLLAPSE_KEY:  "t1",
+		push.INFO_APNS_COLLAPSE_KEY: "t1",
+	}
+	for k, v := range expected {
+		if info[k] != v {
+			t.Errorf("%v is %q, not %q", k, info[k], v)
+		}
+	}
+
+	// Only the preview of an opaque message is looked up, and a badge
+	// which is not a number is left out.
+	fwdreq = forwardFrom("bob")
+	msg := proto.NewOpaqueMessage([]byte("secret"), "a photo")
+	msg.Header["text"] = "secret"
+	msg.Header["unread"] = "many"
+	fwdreq.MessageContainer.Message = msg
+	conf.PushPayload.Body = mustParseDigestTemplate(t, "{text}{uniqush.preview}")
+	center.ReceiveForward(fwdreq)
+	info = pushed()
+	if info[push.INFO_BODY] != "a photo" {
+		t.Errorf("bad body of an opaque message: %q", info[push.INFO_BODY])
+	}
+	if _, ok := info[push.INFO_BADGE]; ok {
+		t.Errorf("bad badge: %q", info[push.INFO_BADGE])
+	}
+	if _, ok := info[push.INFO_FCM_COLLAPSE_KEY]; ok {
+		t.Errorf("an empty collapse key is set: %q", info[push.INFO_FCM_COLLAPSE_KEY])
+	}
+}
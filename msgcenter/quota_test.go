@@ -0,0 +1,101 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/quota"
+	"github.com/uniqush/uniqush-conn/testsupport"
+	"testing"
+)
+
+func TestForwardExceedsQuota(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		ForwardRequestHandler: allowForward{},
+		Quota:                 quota.NewEnforcer(quota.NewMemoryStore(), quota.Limits{MessagesPerUser: 1}),
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+
+	var status string
+	var qerr *proto.QuotaError
+	send := func() {
+		fwdreq := forwardFrom("bob")
+		fwdreq.Reply = func(s, msgId string) {
+			status = s
+		}
+		fwdreq.OnQuotaExceeded = func(e *proto.QuotaError) {
+			qerr = e
+		}
+		center.ReceiveForward(fwdreq)
+	}
+	send()
+	if status != proto.FWD_OK || qerr != nil {
+		t.Errorf("the first message should be forwarded: %v %v", status, qerr)
+	}
+	send()
+	if status != proto.FWD_QUOTA_EXCEEDED || qerr == nil || qerr.Scope != proto.QUOTA_SCOPE_USER || qerr.Resource != proto.QUOTA_MESSAGES {
+		t.Errorf("the second message should exceed the quota: %v %v", status, qerr)
+	}
+	if calls := cache.Calls(); len(calls) != 1 {
+		t.Errorf("only one message should be cached: %v", calls)
+	}
+	// The quota is charged to the sender.
+	usage, _ := conf.Quota.Usage("srv", "bob", quota.Day(qerr.Reset).AddDate(0, 0, -1))
+	if usage.Messages != 1 {
+		t.Errorf("bad usage of bob: %+v", usage)
+	}
+}
+
+func TestCrossServiceForwardQuota(t *testing.T) {
+	conf := &ServiceConfig{
+		MsgCache:              testsupport.NewMockCache(),
+		ForwardRequestHandler: allowForward{},
+		Quota:                 quota.NewEnforcer(quota.NewMemoryStore(), quota.Limits{MessagesPerUser: 100}),
+	}
+	senderConf := &ServiceConfig{
+		Quota: quota.NewEnforcer(quota.NewMemoryStore(), quota.Limits{MessagesPerUser: 1}),
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+	center.configOf = func(service string) *ServiceConfig {
+		if service == "other" {
+			return senderConf
+		}
+		return nil
+	}
+
+	var status string
+	send := func() {
+		fwdreq := forwardFrom("bob")
+		fwdreq.MessageContainer.SenderService = "other"
+		fwdreq.Reply = func(s, msgId string) {
+			status = s
+		}
+		center.ReceiveForward(fwdreq)
+	}
+	send()
+	if status != proto.FWD_OK {
+		t.Errorf("the first message should be forwarded: %v", status)
+	}
+	// The limit is the one of the service of the sender.
+	send()
+	if status != proto.FWD_QUOTA_EXCEEDED {
+		t.Errorf("the second message should exceed the quota of the sender: %v", status)
+	}
+}
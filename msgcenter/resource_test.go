@@ -0,0 +1,74 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/resource"
+	"github.com/uniqush/uniqush-conn/testsupport"
+	"testing"
+	"time"
+)
+
+func TestMaxConnsOfService(t *testing.T) {
+	auth := testsupport.NewFakeAuth()
+	auth.AllowAll()
+	conf := &ServiceConfig{Resources: resource.Limits{MaxConns: 1}}
+	center := newServiceCenter("service", conf, nil, nil, nil, nil)
+	for i, expected := range []error{nil, ErrTooManyConns} {
+		servConn, cliConn, err := testsupport.Pipe(auth, "service", "alice", "token")
+		if err != nil {
+			t.Fatalf("cannot connect: %v", err)
+		}
+		defer cliConn.Close()
+		if err = center.NewConn(servConn); err != expected {
+			t.Errorf("conn %v: %v != %v", i, err, expected)
+		}
+		if err != nil {
+			servConn.Close()
+		}
+	}
+	if usage := center.resources.Usage(); usage.Conns != 1 || usage.RejectedConns != 1 {
+		t.Errorf("bad usage: %+v", usage)
+	}
+	center.Disconnect("alice", "", false)
+	for i := 0; i < 100 && center.resources.Usage().Conns != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if usage := center.resources.Usage(); usage.Conns != 0 {
+		t.Errorf("the conn is not released: %+v", usage)
+	}
+}
+
+func TestMaxCacheMemoryOfService(t *testing.T) {
+	msg := &proto.Message{Body: make([]byte, 100)}
+	conf := &ServiceConfig{
+		MsgCache:  testsupport.NewMockCache(),
+		Resources: resource.Limits{MaxCacheMemory: int64(msg.Size())},
+	}
+	center := newServiceCenter("service", conf, nil, nil, nil, nil)
+	if res := center.SendMessage("alice", msg.Copy(), nil, 0); res == nil {
+		t.Errorf("the first message should be cached")
+	}
+	if res := center.SendMessage("alice", msg.Copy(), nil, 0); res != nil {
+		t.Errorf("the second message should not fit in the cache: %v", res)
+	}
+	if usage := center.resources.Usage(); usage.CacheMemory != int64(msg.Size()) || usage.RejectedCacheWrites != 1 {
+		t.Errorf("bad usage: %+v", usage)
+	}
+}
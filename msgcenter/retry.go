@@ -0,0 +1,109 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+// forwardRetry is a cached message which could not be written
+// to any connection of the user.
+type forwardRetry struct {
+	mc    *proto.MessageContainer
+	extra map[string]string
+}
+
+func (self *forwardRetry) expired(now time.Time) bool {
+	return self.mc.ExpiresAt > 0 && self.mc.ExpiresAt <= now.UnixNano()
+}
+
+// The number of failed forwards kept for each user. The oldest
+// ones are dropped first.
+const maxForwardRetriesPerUser = 100
+
+// The number of users whose failed forwards are kept by a service.
+// The users whose forwards failed least recently are dropped first.
+const maxForwardRetryUsers = 10000
+
+type userRetries struct {
+	username string
+	retries  []*forwardRetry
+}
+
+// forwardRetries keeps the failed forwards of at most maxUsers users.
+// It is only used by the goroutine processing the events of the
+// service, so it is not safe for concurrent use.
+type forwardRetries struct {
+	maxUsers int
+	users    map[string]*list.Element
+
+	// Of *userRetries, the last failed first.
+	recent *list.List
+}
+
+func newForwardRetries(maxUsers int) *forwardRetries {
+	ret := new(forwardRetries)
+	ret.maxUsers = maxUsers
+	ret.users = make(map[string]*list.Element, 16)
+	ret.recent = list.New()
+	return ret
+}
+
+func (self *forwardRetries) add(username string, r *forwardRetry, now time.Time) {
+	e, ok := self.users[username]
+	if ok {
+		self.recent.MoveToFront(e)
+	} else {
+		e = self.recent.PushFront(&userRetries{username: username})
+		self.users[username] = e
+	}
+	u := e.Value.(*userRetries)
+	u.retries = append(unexpired(u.retries, now), r)
+	if len(u.retries) > maxForwardRetriesPerUser {
+		u.retries = u.retries[len(u.retries)-maxForwardRetriesPerUser:]
+	}
+	for self.recent.Len() > self.maxUsers {
+		oldest := self.recent.Back()
+		delete(self.users, oldest.Value.(*userRetries).username)
+		self.recent.Remove(oldest)
+	}
+}
+
+// take returns the unexpired forwards of the user, and forgets them.
+func (self *forwardRetries) take(username string, now time.Time) []*forwardRetry {
+	e, ok := self.users[username]
+	if !ok {
+		return nil
+	}
+	delete(self.users, username)
+	self.recent.Remove(e)
+	return unexpired(e.Value.(*userRetries).retries, now)
+}
+
+func unexpired(retries []*forwardRetry, now time.Time) []*forwardRetry {
+	ret := retries[:0]
+	for _, r := range retries {
+		if !r.expired(now) {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
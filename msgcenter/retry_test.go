@@ -0,0 +1,138 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/testsupport"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errBrokenConn = errors.New("broken connection")
+
+// brokenConn fails every write once it is broken.
+type brokenConn struct {
+	net.Conn
+	broken int32
+}
+
+func (self *brokenConn) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&self.broken) != 0 {
+		return 0, errBrokenConn
+	}
+	return self.Conn.Write(p)
+}
+
+func brokenPipe(t *testing.T, auth server.Authenticator) (servConn server.Conn, cliConn client.Conn, bc *brokenConn) {
+	sc, cc := net.Pipe()
+	bc = &brokenConn{Conn: sc}
+	done := make(chan error)
+	go func() {
+		var err error
+		servConn, err = server.AuthConn(bc, testsupport.Key(), auth, testsupport.HandshakeTimeout)
+		done <- err
+	}()
+	cliConn, err := testsupport.Dial(cc, "srv", "alice", "token")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return
+}
+
+func TestRetryForward(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	auth := testsupport.NewFakeAuth()
+	auth.AllowAll()
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		ForwardRequestHandler: allowForward{},
+		RetryForwards:         true,
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+
+	servConn, cliConn, bc := brokenPipe(t, auth)
+	defer cliConn.Close()
+	err := center.NewConn(servConn)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	atomic.StoreInt32(&bc.broken, 1)
+	fwdreq := forwardFrom("bob")
+	center.ReceiveForward(fwdreq)
+	id := fwdreq.MessageContainer.Id
+	if len(id) == 0 {
+		t.Fatalf("the message is not cached")
+	}
+
+	// The next connection is told about the message.
+	servConn2, cliConn2, err := testsupport.Pipe(auth, "srv", "alice", "token")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer cliConn2.Close()
+	digestChan := make(chan *client.Digest, 1)
+	cliConn2.SetDigestChannel(digestChan)
+	go cliConn2.ReceiveMessage()
+	err = center.NewConn(servConn2)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	select {
+	case digest := <-digestChan:
+		if digest.MsgId != id || digest.Sender != "bob" {
+			t.Errorf("bad digest: %+v", digest)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no digest")
+	}
+}
+
+func TestForwardRetriesBounded(t *testing.T) {
+	now := time.Now()
+	retry := func(id string, ttl time.Duration) *forwardRetry {
+		return &forwardRetry{mc: &proto.MessageContainer{Id: id, ExpiresAt: now.Add(ttl).UnixNano()}}
+	}
+	retries := newForwardRetries(2)
+	retries.add("alice", retry("1", time.Hour), now)
+	retries.add("alice", retry("2", time.Second), now)
+	retries.add("bob", retry("3", time.Hour), now)
+	retries.add("alice", retry("4", time.Hour), now)
+
+	// Bob's forwards are dropped first.
+	retries.add("carol", retry("5", time.Hour), now)
+	if r := retries.take("bob", now); len(r) != 0 {
+		t.Errorf("the retries of the least recent user should be dropped: %v", r)
+	}
+	// The expired forwards are dropped.
+	r := retries.take("alice", now.Add(time.Minute))
+	if len(r) != 2 || r[0].mc.Id != "1" || r[1].mc.Id != "4" {
+		t.Errorf("bad retries: %v", r)
+	}
+	if r = retries.take("alice", now); len(r) != 0 {
+		t.Errorf("the retries should be taken once: %v", r)
+	}
+}
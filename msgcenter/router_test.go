@@ -0,0 +1,150 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/testsupport"
+)
+
+// priorityRouter never caches the ephemeral messages, and always
+// pushes the ones whose priority is above 5.
+type priorityRouter struct {
+	server.DefaultRouter
+}
+
+func (self priorityRouter) Cache(info *server.RouteInfo) bool {
+	_, ok := info.Message.Message.Header["ephemeral"]
+	return !ok
+}
+
+func (self priorityRouter) Push(info *server.RouteInfo, nrVisible int) bool {
+	if p, err := strconv.Atoi(info.Message.Message.Header["priority"]); err == nil && p > 5 {
+		return true
+	}
+	return self.DefaultRouter.Push(info, nrVisible)
+}
+
+type alwaysPush struct{}
+
+func (self alwaysPush) ShouldPush(service, username string, info map[string]string) bool {
+	return true
+}
+
+// pushRecorder has one delivery point for every user.
+type pushRecorder struct {
+	recordingPush
+	pushed chan string
+}
+
+func (self *pushRecorder) Push(service, username string, info map[string]string, msgIds []string) error {
+	self.pushed <- info["notif.msg"]
+	return nil
+}
+
+func (self *pushRecorder) NrDeliveryPoints(service, username string) int {
+	return 1
+}
+
+func TestRouter(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	push := &pushRecorder{pushed: make(chan string, 10)}
+	conf := &ServiceConfig{
+		MsgCache:    cache,
+		Router:      priorityRouter{},
+		PushHandler: alwaysPush{},
+		PushService: push,
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+	auth := testsupport.NewFakeAuth()
+	auth.AllowAll()
+	servConn, cliConn, err := testsupport.Pipe(auth, "srv", "alice", "token")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer cliConn.Close()
+	go func() {
+		for {
+			if _, err := cliConn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	if err = center.NewConn(servConn); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	send := func(title string, header map[string]string) {
+		header["title"] = title
+		res := center.SendMessage("alice", &proto.Message{Header: header, Body: []byte("hi")}, nil, time.Hour)
+		if len(res) != 1 || res[0].Err != nil {
+			t.Errorf("%v is not delivered: %v", title, res)
+		}
+	}
+	send("normal", map[string]string{"priority": "1"})
+	send("ephemeral", map[string]string{"ephemeral": "1"})
+	send("urgent", map[string]string{"priority": "9"})
+
+	if n := nrCached(cache); n != 2 {
+		t.Errorf("the ephemeral message is cached: %v", cache.Calls())
+	}
+	select {
+	case title := <-push.pushed:
+		if title != "urgent" {
+			t.Errorf("%v is pushed to a visible user", title)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the urgent message is not pushed")
+	}
+	select {
+	case title := <-push.pushed:
+		t.Errorf("%v is pushed to a visible user", title)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEphemeralMessageToOfflineUser(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	push := &pushRecorder{pushed: make(chan string, 10)}
+	conf := &ServiceConfig{
+		MsgCache:    cache,
+		PushHandler: alwaysPush{},
+		PushService: push,
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+	msg := &proto.Message{Header: map[string]string{"title": "typing"}, Ephemeral: true}
+	res := center.SendMessage("alice", msg, nil, time.Hour)
+	for _, r := range res {
+		if r.Err == nil {
+			t.Errorf("the ephemeral message is delivered to an offline user: %+v", r)
+		}
+	}
+	if n := nrCached(cache); n != 0 {
+		t.Errorf("the ephemeral message is cached: %v", cache.Calls())
+	}
+	select {
+	case title := <-push.pushed:
+		t.Errorf("%v is pushed", title)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
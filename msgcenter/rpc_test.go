@@ -0,0 +1,168 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"github.com/uniqush/uniqush-conn/proto/server"
+)
+
+// rejectEve forwards the messages to anyone but eve.
+type rejectEve struct {
+	allowForward
+}
+
+func (self rejectEve) ShouldForward(fwd *server.ForwardRequest) bool {
+	return fwd.Receiver != "eve"
+}
+
+type rpcConfigReader struct {
+	msgChan chan<- *proto.Message
+}
+
+func (self rpcConfigReader) ReadConfig(service string) *ServiceConfig {
+	return &ServiceConfig{
+		MsgCache:              getCache(),
+		ForwardRequestHandler: rejectEve{},
+		MessageHandler:        &chanReporter{self.msgChan, nil},
+	}
+}
+
+// serveCalls replies the body of every call, or fails the call if it
+// has a "fail" header, or ignores it if it has an "ignore" header.
+func serveCalls(conn client.Conn) {
+	for {
+		mc, err := conn.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		if len(mc.Message.CallId()) == 0 {
+			continue
+		}
+		if _, ok := mc.Message.Header["ignore"]; ok {
+			continue
+		}
+		if reason, ok := mc.Message.Header["fail"]; ok {
+			conn.Respond(mc, nil, errors.New(reason))
+			continue
+		}
+		conn.Respond(mc, &proto.Message{Body: mc.Message.Body}, nil)
+	}
+}
+
+func TestCall(t *testing.T) {
+	addr := "127.0.0.1:8981"
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	msgChan := make(chan *proto.Message, 1)
+	center := NewMessageCenter(ln, privkey, &chanReporter{}, 3*time.Second, &alwaysAllowAuth{}, rpcConfigReader{msgChan})
+	go center.Start()
+
+	alice, err := connectServer(addr, "alice", &privkey.PublicKey, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer alice.Close()
+	bob, err := connectServer(addr, "bob", &privkey.PublicKey, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer bob.Close()
+	go serveCalls(bob)
+	received := make(chan *proto.MessageContainer, 4)
+	go func() {
+		for {
+			mc, err := alice.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			received <- mc
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	reply, err := alice.Call("service", "bob", &proto.Message{Body: []byte("ping")}, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(reply.Message.Body) != "ping" || reply.Sender != "bob" {
+		t.Errorf("bad reply: %+v", reply)
+	}
+
+	msg := &proto.Message{Header: map[string]string{"fail": "busy"}}
+	_, err = alice.Call("service", "bob", msg, 3*time.Second)
+	if cerr, ok := err.(*client.CallError); !ok || cerr.Reason != "busy" || len(cerr.Status) > 0 {
+		t.Errorf("the error is not propagated: %v", err)
+	}
+	if len(msg.Header) != 1 {
+		t.Errorf("the message of the call is changed: %v", msg.Header)
+	}
+
+	_, err = alice.Call("service", "eve", &proto.Message{Body: []byte("ping")}, 3*time.Second)
+	if cerr, ok := err.(*client.CallError); !ok || cerr.Status != proto.FWD_REJECTED {
+		t.Errorf("the rejection is not told: %v", err)
+	}
+
+	msg = &proto.Message{Header: map[string]string{"ignore": ""}}
+	if _, err = alice.Call("service", "bob", msg, 200*time.Millisecond); err != client.ErrCallTimeout {
+		t.Errorf("the call should time out: %v", err)
+	}
+
+	// The backend replies to the calls to the server. A user
+	// replying in its place does not end the call.
+	go func() {
+		call := <-msgChan
+		forged := &proto.Message{Header: map[string]string{proto.ReplyHeader: call.CallId()}, Body: []byte("forged")}
+		bob.SendMessageToUser("service", "alice", forged, time.Hour)
+		time.Sleep(100 * time.Millisecond)
+		reply := &proto.Message{Header: map[string]string{proto.ReplyHeader: call.CallId()}, Body: []byte("pong")}
+		center.SendMessage("service", "alice", reply, nil, 0)
+	}()
+	reply, err = alice.CallServer(&proto.Message{Body: []byte("ping")}, 3*time.Second)
+	if err != nil || string(reply.Message.Body) != "pong" {
+		t.Errorf("bad reply of the server: %v %v", reply, err)
+	}
+	select {
+	case mc := <-received:
+		if string(mc.Message.Body) != "forged" || mc.Sender != "bob" {
+			t.Errorf("bad message: %+v", mc)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("the forged reply is not received by the app")
+	}
+
+	select {
+	case mc := <-received:
+		t.Errorf("a reply is received by the app: %+v", mc)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+)
+
+// ForwardScheduler keeps the forward requests asking for a later
+// delivery until they are due, then delivers them with
+// MessageCenter.DeliverForward. It is implemented by
+// scheduler.Scheduler.
+type ForwardScheduler interface {
+	ScheduleForward(fwdreq *server.ForwardRequest, extra map[string]string) (id string, err error)
+}
+
+const defaultMaxForwardDelay = 7 * 24 * time.Hour
+
+// SetForwardScheduler lets the users send messages later. Without a
+// scheduler, the requests asking for a later delivery are rejected.
+// It should be called before adding any service or starting the
+// message center.
+func (self *MessageCenter) SetForwardScheduler(s ForwardScheduler) {
+	self.forwardScheduler = s
+}
+
+// DeliverForward sends a message forwarded by a user, which has been
+// accepted when it was scheduled, to all connections of the receiver.
+// The sender has been charged for it then. extra is the push info
+// taken from the message when it was scheduled.
+func (self *MessageCenter) DeliverForward(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) (res []*Result, err error) {
+	center, err := self.getServiceCenter(service, self.cluster != nil)
+	if err != nil || center == nil {
+		err = ErrNoService
+		return
+	}
+	if extra == nil {
+		extra = getPushInfo(mc, nil, true)
+	}
+	res = center.sendMessageContainer(username, mc, extra, ttl)
+	if res == nil {
+		err = ErrCannotCache
+	}
+	return
+}
+
+// isScheduled tells if the sender wants the message delivered later.
+func isScheduled(fwdreq *server.ForwardRequest) bool {
+	return !fwdreq.DeliverAt.IsZero() && fwdreq.DeliverAt.After(time.Now())
+}
+
+// scheduleForward keeps an accepted forward request until it is due.
+func (self *serviceCenter) scheduleForward(fwdreq *server.ForwardRequest, extra map[string]string) (status, id string) {
+	maxDelay := self.config.MaxForwardDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxForwardDelay
+	}
+	if self.scheduler == nil || time.Until(fwdreq.DeliverAt) > maxDelay {
+		self.forgetForward(fwdreq)
+		status = proto.FWD_REJECTED
+		return
+	}
+	id, err := self.scheduler.ScheduleForward(fwdreq, extra)
+	if err != nil {
+		self.logger.Warn("cannot schedule forward", "username", fwdreq.Receiver, "sender", fwdreq.MessageContainer.Sender, "err", err)
+		self.forgetForward(fwdreq)
+		status, id = proto.FWD_FAILED, ""
+		return
+	}
+	status = proto.FWD_SCHEDULED
+	return
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/testsupport"
+)
+
+type recordingScheduler struct {
+	scheduled []*server.ForwardRequest
+	err       error
+}
+
+func (self *recordingScheduler) ScheduleForward(fwdreq *server.ForwardRequest, extra map[string]string) (id string, err error) {
+	if self.err != nil {
+		err = self.err
+		return
+	}
+	self.scheduled = append(self.scheduled, fwdreq)
+	id = "later"
+	return
+}
+
+func nrCached(cache *testsupport.MockCache) int {
+	n := 0
+	for _, c := range cache.Calls() {
+		if strings.HasPrefix(c, "cache ") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestScheduleForward(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		ForwardRequestHandler: allowForward{},
+		MaxForwardDelay:       time.Hour,
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+	later := func(d time.Duration) (status, msgId string) {
+		fwdreq := forwardFrom("bob")
+		fwdreq.DeliverAt = time.Now().Add(d)
+		fwdreq.Reply = func(s, id string) {
+			status, msgId = s, id
+		}
+		center.ReceiveForward(fwdreq)
+		return
+	}
+
+	if status, _ := later(time.Minute); status != proto.FWD_REJECTED {
+		t.Errorf("should be rejected without a scheduler: %v", status)
+	}
+	sched := &recordingScheduler{}
+	center.scheduler = sched
+	if status, id := later(time.Minute); status != proto.FWD_SCHEDULED || id != "later" {
+		t.Errorf("should be scheduled: %v %v", status, id)
+	}
+	if status, _ := later(2 * time.Hour); status != proto.FWD_REJECTED {
+		t.Errorf("should be rejected beyond the max delay: %v", status)
+	}
+	sched.err = errors.New("store down")
+	if status, _ := later(time.Minute); status != proto.FWD_FAILED {
+		t.Errorf("should fail: %v", status)
+	}
+	sched.err = nil
+	if status, _ := later(-time.Minute); status != proto.FWD_OK {
+		t.Errorf("a past time should be delivered now: %v", status)
+	}
+	if n := nrCached(cache); n != 1 {
+		t.Errorf("%v messages cached, not only the one delivered now", n)
+	}
+	if len(sched.scheduled) != 1 || sched.scheduled[0].Receiver != "alice" {
+		t.Errorf("bad scheduled requests: %v", sched.scheduled)
+	}
+}
+
+func TestDeliverForward(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	conf := &ServiceConfig{MsgCache: cache}
+	mcenter := NewMessageCenter(nil, nil, nil, 0, nil, &staticConfigReader{conf})
+	mcenter.AddService("srv")
+	mc := &proto.MessageContainer{
+		Sender:        "bob",
+		SenderService: "srv",
+		Message:       &proto.Message{Body: []byte("later")},
+	}
+	res, err := mcenter.DeliverForward("srv", "alice", mc, nil, time.Hour)
+	if err != nil || res == nil || len(mc.Id) == 0 {
+		t.Errorf("not delivered: %v %v", res, err)
+	}
+	if n := nrCached(cache); n != 1 {
+		t.Errorf("%v messages cached", n)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"time"
+
+	"github.com/uniqush/uniqush-conn/push"
+)
+
+const defaultSilentPushCooldown = 20 * time.Minute
+
+// The key of the silent pushes in the cooldown store, scoped by the
+// receiver. The idempotency keys in the store are scoped by the sender,
+// so a user could at worst delay the silent pushes to itself.
+const silentPushKey = "\nsilent-push"
+
+// silentPush wakes the app of the user up, unless it has been done
+// within the cooldown.
+func (self *serviceCenter) silentPush(username string) {
+	if self.config.PushService == nil {
+		return
+	}
+	cooldown := self.config.SilentPushCooldown
+	if cooldown <= 0 {
+		cooldown = defaultSilentPushCooldown
+	}
+	store := self.config.Dedup
+	if store == nil {
+		store = self.cooldowns
+	}
+	service := self.serviceName
+	cooling, err := store.Seen(service, username, silentPushKey, cooldown)
+	if err != nil {
+		self.reportError(service, username, "", "", err)
+		return
+	}
+	if cooling {
+		self.logger.Debug("silent push throttled", "service", service, "username", username)
+		return
+	}
+	self.pushServiceLock.RLock()
+	defer self.pushServiceLock.RUnlock()
+	if self.nrDeliveryPoints(service, username) <= 0 {
+		return
+	}
+	info := map[string]string{push.INFO_CONTENT_AVAILABLE: "1"}
+	if err = self.config.PushService.Push(service, username, info, nil); err != nil {
+		self.reportError(service, username, "", "", err)
+	}
+}
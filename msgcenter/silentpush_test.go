@@ -0,0 +1,92 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/push"
+	"github.com/uniqush/uniqush-conn/testsupport"
+)
+
+func TestSilentPush(t *testing.T) {
+	recorder := &pushInfoRecorder{pushed: make(chan map[string]string, 10)}
+	conf := &ServiceConfig{
+		MsgCache:    testsupport.NewMockCache(),
+		PushService: recorder,
+		SilentPush:  true,
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+	auth := testsupport.NewFakeAuth()
+	auth.AllowAll()
+	servConn, cliConn, err := testsupport.Pipe(auth, "srv", "alice", "token")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer cliConn.Close()
+	go func() {
+		for {
+			if _, err := cliConn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	if err = center.NewConn(servConn); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	send := func() {
+		res := center.SendMessage("alice", &proto.Message{Body: []byte("hi")}, nil, time.Hour)
+		if len(res) != 1 || res[0].Err != nil {
+			t.Errorf("the message is not delivered: %v", res)
+		}
+	}
+	nothingPushed := func() {
+		select {
+		case info := <-recorder.pushed:
+			t.Errorf("pushed: %v", info)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// A visible user is not woken up.
+	send()
+	nothingPushed()
+
+	cliConn.SetVisibility(false)
+	for i := 0; servConn.Visible() && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	send()
+	select {
+	case info := <-recorder.pushed:
+		if len(info) != 1 || info[push.INFO_CONTENT_AVAILABLE] != "1" {
+			t.Errorf("not a silent push: %v", info)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no silent push")
+	}
+	// Only one within the cooldown.
+	send()
+	nothingPushed()
+
+	// Nor are the offline users, who are pushed the alerts instead.
+	center.SendMessage("bob", &proto.Message{Body: []byte("hi")}, nil, time.Hour)
+	nothingPushed()
+}
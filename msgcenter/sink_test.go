@@ -0,0 +1,62 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/sink"
+	"github.com/uniqush/uniqush-conn/testsupport"
+	"testing"
+	"time"
+)
+
+func TestMessageSink(t *testing.T) {
+	records := make(chan *sink.Record, 4)
+	q := sink.NewQueue(sink.SinkFunc(func(rec *sink.Record) error {
+		records <- rec
+		return nil
+	}), 0, 0)
+	defer q.Stop()
+	conf := &ServiceConfig{
+		MsgCache:              testsupport.NewMockCache(),
+		ForwardRequestHandler: allowForward{},
+		MessageSink:           q,
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+
+	fwd := forwardWithKey("")
+	center.ReceiveForward(fwd.req)
+	if fwd.status != proto.FWD_OK {
+		t.Fatalf("status %q", fwd.status)
+	}
+	center.SendMessage("alice", &proto.Message{Body: []byte("from the server")}, nil, time.Hour)
+
+	for _, kind := range []string{sink.KIND_FORWARD, sink.KIND_DELIVER} {
+		select {
+		case rec := <-records:
+			if rec.Kind != kind || rec.Service != "srv" || rec.Username != "alice" || len(rec.MessageId) == 0 || rec.Msg == nil {
+				t.Errorf("bad record: %+v", rec)
+			}
+			if kind == sink.KIND_FORWARD && (rec.Sender != "bob" || rec.SenderService != "srv" || rec.MessageId != fwd.msgId) {
+				t.Errorf("bad sender: %+v", rec)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %v record", kind)
+		}
+	}
+}
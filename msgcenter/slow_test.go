@@ -0,0 +1,44 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"testing"
+	"time"
+)
+
+func TestSlowConsumerEvents(t *testing.T) {
+	events := newEventBus()
+	ch := make(chan *Event, 2)
+	events.listen(ch)
+	center := newServiceCenter("srv", &ServiceConfig{}, nil, nil, events, nil)
+
+	center.slowChan <- &server.SlowConsumer{Service: "srv", Username: "alice", ConnId: "conn", Action: server.SLOW_CONSUMER_DIGEST}
+	center.slowChan <- &server.SlowConsumer{Service: "srv", Username: "alice", ConnId: "conn", Action: server.SLOW_CONSUMER_DIGEST, Recovered: true}
+	for _, typ := range []string{EVENT_SLOW_CONSUMER, EVENT_SLOW_CONSUMER_RECOVERED} {
+		select {
+		case evt := <-ch:
+			if evt.Type != typ || evt.Username != "alice" || evt.ConnId != "conn" || evt.Reason != server.SLOW_CONSUMER_DIGEST {
+				t.Errorf("bad event: %+v", evt)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no %v event", typ)
+		}
+	}
+}
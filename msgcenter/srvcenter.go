@@ -21,11 +21,29 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/uniqush/uniqush-conn/analytics"
+	"github.com/uniqush/uniqush-conn/asset"
+	"github.com/uniqush/uniqush-conn/audit"
+	"github.com/uniqush/uniqush-conn/badge"
+	"github.com/uniqush/uniqush-conn/binding"
+	"github.com/uniqush/uniqush-conn/blocklist"
+	"github.com/uniqush/uniqush-conn/dedup"
 	"github.com/uniqush/uniqush-conn/evthandler"
+	"github.com/uniqush/uniqush-conn/latency"
+	"github.com/uniqush/uniqush-conn/logger"
 	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/server"
 	"github.com/uniqush/uniqush-conn/push"
+	"github.com/uniqush/uniqush-conn/quota"
+	"github.com/uniqush/uniqush-conn/resource"
+	"github.com/uniqush/uniqush-conn/session"
+	"github.com/uniqush/uniqush-conn/sink"
+	"github.com/uniqush/uniqush-conn/subscription"
+	"github.com/uniqush/uniqush-conn/throttle"
+	"github.com/uniqush/uniqush-conn/tracing"
+	"github.com/uniqush/uniqush-conn/transform"
+	"github.com/uniqush/uniqush-conn/validate"
 	"strings"
 	"sync"
 	"time"
@@ -34,6 +52,10 @@ import (
 type eventConnIn struct {
 	errChan chan error
 	conn    server.Conn
+
+	// The digests of the messages which could not be forwarded to
+	// the user. Set before a nil error is sent to errChan.
+	retries []*forwardRetry
 }
 
 type eventConnLeave struct {
@@ -41,10 +63,21 @@ type eventConnLeave struct {
 	err  error
 }
 
+// An empty username means querying for the list of users.
+type eventQuery struct {
+	username string
+	connChan chan<- []server.Conn
+	userChan chan<- []string
+}
+
 type Result struct {
 	Err     error  `json:"err,omitempty"`
 	ConnId  string `json:"connId,omitempty"`
 	Visible bool   `json:"visible"`
+
+	// Node is the node holding the connection.
+	// It is empty for local connections.
+	Node string `json:"node,omitempty"`
 }
 
 func (self *Result) Error() string {
@@ -52,13 +85,160 @@ func (self *Result) Error() string {
 	return string(b)
 }
 
+type resultJson struct {
+	Err     string `json:"err,omitempty"`
+	ConnId  string `json:"connId,omitempty"`
+	Visible bool   `json:"visible"`
+	Node    string `json:"node,omitempty"`
+}
+
+// An error value cannot be marshaled by encoding/json.
+func (self *Result) MarshalJSON() ([]byte, error) {
+	r := &resultJson{ConnId: self.ConnId, Visible: self.Visible, Node: self.Node}
+	if self.Err != nil {
+		r.Err = self.Err.Error()
+	}
+	return json.Marshal(r)
+}
+
 type ServiceConfig struct {
 	MaxNrConns        int
 	MaxNrUsers        int
 	MaxNrConnsPerUser int
 
+	// MaxBandwidthPerConn limits the bytes written to each
+	// connection per second. MaxBandwidth limits the bytes written
+	// to all connections of the service on a node per second. A
+	// connection exceeding either waits before writing. Zero means
+	// no limit.
+	MaxBandwidthPerConn int
+	MaxBandwidth        int
+
+	// Resources bounds the connections of the service on a node, the
+	// goroutines calling its web hooks and push service, and the
+	// memory of the messages it caches. The cache memory is only
+	// counted if it is limited. Zero means no limit, except for
+	// MaxConns which is MaxNrConns then.
+	Resources resource.Limits
+
 	MsgCache msgcache.Cache
 
+	// IndexedHeaders are the header fields by which the cached
+	// messages could be queried. See msgcache.Cache.Query.
+	IndexedHeaders []string
+
+	// CompressionDictionary compresses the commands of the clients
+	// which have the dictionary with the same id.
+	CompressionDictionary *proto.Dictionary
+
+	// AdaptiveCompression raises the compress threshold of the
+	// connections whose messages do not compress well. See
+	// server.Conn.SetAdaptiveCompression.
+	AdaptiveCompression bool
+
+	// BodyHash adds the hash of the body to the messages sent to the
+	// users, after they are transformed, so that the clients could
+	// tell the corrupted ones. See proto.BodyHashHeader.
+	BodyHash bool
+
+	// ConnMemoryLimit, if not nil, bounds the memory buffered for
+	// each connection. See server.Conn.SetMemoryLimit.
+	ConnMemoryLimit *server.MemoryLimit
+
+	// SlowConsumer, if not nil, detects the connections which do not
+	// keep up with their messages, and what to do with them. Every
+	// change is published as an EVENT_SLOW_CONSUMER or an
+	// EVENT_SLOW_CONSUMER_RECOVERED.
+	SlowConsumer *server.SlowConsumerPolicy
+
+	// PlaintextPublic sends the public messages in plaintext to the
+	// clients accepting it. See proto.Message.Public.
+	PlaintextPublic bool
+
+	// TokenBinding, if not nil, ties the tokens of the users to the
+	// device, or the network, they are first accepted from. The
+	// sessions are also only restored from there.
+	TokenBinding *binding.Policy
+
+	// RecommendedSettings are sent to every new connection.
+	// The clients may accept or override them.
+	RecommendedSettings *proto.Settings
+
+	// LatencyHeader adds server.LatencyHeader to the cached
+	// messages sent to the clients.
+	LatencyHeader bool
+
+	// Transformer changes the messages sent to the users, including
+	// the forwarded ones, before they are cached. The forwards it drops
+	// are told proto.FWD_DROPPED.
+	Transformer transform.Transformer
+
+	// Validator rejects the invalid messages forwarded, or sent,
+	// to the users before they are handled.
+	Validator validate.Validator
+
+	// DigestTemplate renders a preview into the digests.
+	DigestTemplate *server.DigestTemplate
+
+	// DigestPolicy overrides the digest thresholds of the clients for
+	// the messages matching its rules.
+	DigestPolicy server.DigestPolicy
+
+	// Router decides whether the messages sent to the users are
+	// cached, how they are written to each connection, and whether
+	// they are pushed. It is server.DefaultRouter if it is nil.
+	Router server.Router
+
+	// BlockList stores the senders blocked by each user.
+	// Messages forwarded by them will be dropped.
+	BlockList blocklist.Store
+
+	// Dedup remembers the idempotency keys of the forward requests
+	// for DedupWindow, or five minutes if it is zero. A request with
+	// a key seen in the window is dropped.
+	Dedup       dedup.Store
+	DedupWindow time.Duration
+
+	// Quota limits the messages sent every day by each user, and
+	// in the service. Forwarded messages are charged to the sender,
+	// and messages from the server to the receiver.
+	Quota *quota.Enforcer
+
+	// AbuseScorer scores the requests forwarded to the users of the
+	// service, with the requests recently sent by the sender if there
+	// is a ForwardAudit. The requests are delivered without waiting
+	// for the verdicts: a shadow-dropped message is recalled from the
+	// receiver once it is scored, as if the sender recalled it.
+	AbuseScorer evthandler.AbuseScorer
+
+	// MaxForwardDelay limits how long a forwarded message may be
+	// kept before it is delivered at the time asked by the sender,
+	// or seven days if it is zero.
+	MaxForwardDelay time.Duration
+
+	// ForwardAudit records every request forwarded to the users of
+	// the service, whatever becomes of it, and the requests of its
+	// users which are relayed to a peer deployment or whose receivers
+	// are unknown. The records are written in the background.
+	ForwardAudit audit.Store
+
+	// Analytics counts the messages, digests and retrievals of the
+	// service, and its active users, per hour and day.
+	Analytics *analytics.Recorder
+
+	// SessionStore keeps the settings of every user between the
+	// connections. They are restored when the user connects again.
+	SessionStore session.Store
+
+	// SubscriptionStore records the push notification subscriptions,
+	// so that they can be synced to the push service again.
+	SubscriptionStore subscription.Store
+
+	// MessageSink is given a copy of every message delivered to
+	// the users of the service, e.g. to keep the chat history. It
+	// drops the copies it has no room for instead of blocking.
+	MessageSink *sink.Queue
+
 	LoginHandler          evthandler.LoginHandler
 	LogoutHandler         evthandler.LogoutHandler
 	MessageHandler        evthandler.MessageHandler
@@ -71,52 +251,479 @@ type ServiceConfig struct {
 	PushHandler        evthandler.PushHandler
 
 	PushService push.Push
+
+	// PushPayload, if not nil, renders the title, the body, the badge
+	// and the collapse key of the push notifications from the fields
+	// of the messages.
+	PushPayload *push.PayloadMapping
+
+	// SilentPush sends a silent push notification, one which only
+	// wakes the app up, to a user whose connections are all invisible
+	// when a message is cached for the user, so that the app could
+	// reconnect and drain the cache. A user is sent at most one every
+	// SilentPushCooldown, or twenty minutes if it is zero. The
+	// cooldowns are kept in Dedup, shared by the nodes, if it is set.
+	SilentPush         bool
+	SilentPushCooldown time.Duration
+
+	// Badges counts the unread messages of each user: a message is
+	// counted once cached, until it is acked, read or recalled. The
+	// count is carried by the digests, see proto.UnreadInfo, and is
+	// the badge of the push notifications.
+	Badges badge.Store
+
+	// Assets keeps the configuration assets pushed to the clients
+	// advertising proto.CAP_ASSETS, and the versions they applied. A
+	// client is sent the latest version of every asset when it
+	// connects, and every version published while it is connected.
+	// The versions published on other nodes sharing the store are
+	// found every AssetRefresh, or every minute if it is zero.
+	Assets       asset.Store
+	AssetRefresh time.Duration
+
+	// RetryForwards keeps the forwarded messages which are cached
+	// but cannot be written to any connection of the receiver. Their
+	// digests are sent to the next connection of the receiver on the
+	// same node, unless they have expired. The uncached forwards are
+	// not kept, since a digest refers to the cached message. Only the
+	// latest forwards of the users whose forwards failed last are
+	// kept, in memory.
+	RetryForwards bool
+
+	// DeadLetterHandler is told about the cached messages which
+	// expired before they were delivered. The cache should implement
+	// msgcache.DeadLetterCollector. They are collected every
+	// DeadLetterInterval, or every minute if it is zero.
+	DeadLetterHandler  evthandler.DeadLetterHandler
+	DeadLetterInterval time.Duration
 }
 
+const defaultDeadLetterInterval = time.Minute
+
+// The number of dead letters collected at a time.
+const deadLetterBatchSize = 100
+
 type writeMessageRequest struct {
 	user    string
-	msg     *proto.Message
+	mc      *proto.MessageContainer
 	ttl     time.Duration
 	extra   map[string]string
 	resChan chan<- []*Result
+
+	// local messages are sent from other nodes. They are
+	// already cached and should only be delivered.
+	local bool
+
+	// dup is set before the result is sent if the message has
+	// been cached and delivered already.
+	dup bool
 }
 
 type serviceCenter struct {
 	serviceName string
 	config      *ServiceConfig
 	fwdChan     chan<- *server.ForwardRequest
+	cluster     *clusterInfo
+	events      *eventBus
+	logger      logger.Logger
+
+	// Set by the message center once it is created.
+	scheduler ForwardScheduler
+
+	// configOf returns the config of another service, e.g. the one
+	// of the sender of a forward. Set by the message center.
+	configOf func(service string) *ServiceConfig
+
+	// Shared by all connections. Nil if there is no limit.
+	bandwidth *throttle.Bucket
+
+	resources *resource.Group
+
+	// The cache of the config, charged to the resources if their
+	// cache memory is limited.
+	cache msgcache.Cache
+
+	latency *latency.Tracker
+
+	// The cooldowns of the silent pushes if there is no Dedup.
+	cooldowns dedup.Store
+
+	// The records queued for ForwardAudit, nil if there is none.
+	audits chan *audit.Record
+
+	// The latest version of each asset pushed to the connections, and
+	// the assets waiting to be sent to each connection.
+	assetLock     sync.Mutex
+	assetVersions map[string]uint64
+	assetPushes   map[server.Conn]map[string]*asset.Asset
+	assetStop     chan bool
+	assetDone     chan bool
+	assetStopOnce sync.Once
 
 	writeReqChan chan *writeMessageRequest
 	connIn       chan *eventConnIn
 	connLeave    chan *eventConnLeave
 	subReqChan   chan *server.SubscribeRequest
+	ackChan      chan *server.Ack
+	slowChan     chan *server.SlowConsumer
+	queryChan    chan *eventQuery
 
 	pushServiceLock sync.RWMutex
 }
 
-var ErrTooManyConns = errors.New("too many connections")
+var ErrTooManyConns = resource.ErrTooManyConns
 var ErrInvalidConnType = errors.New("invalid connection type")
+var ErrDisconnected = errors.New("disconnected by the administrator")
+var ErrRevoked = errors.New("revoked by the administrator")
+
+// isBlocked() returns true if the receiver has blocked the sender.
+// The message will be delivered if the store is not available.
+func (self *serviceCenter) isBlocked(fwdreq *server.ForwardRequest) bool {
+	if self.config == nil || self.config.BlockList == nil {
+		return false
+	}
+	sender := fwdreq.MessageContainer.Sender
+	senderService := fwdreq.MessageContainer.SenderService
+	blocked, err := self.config.BlockList.IsBlocked(self.serviceName, fwdreq.Receiver, senderService, sender)
+	if err != nil {
+		self.logger.Warn("cannot read block list", "username", fwdreq.Receiver, "err", err)
+		return false
+	}
+	if blocked {
+		self.logger.Debug("forward request blocked", "username", fwdreq.Receiver, "sender", sender, "senderService", senderService)
+	}
+	return blocked
+}
+
+const defaultDedupWindow = 5 * time.Minute
+
+// isDuplicate() returns true if the sender has sent a request with
+// the same idempotency key recently. The request will be forwarded
+// if the store is not available.
+func (self *serviceCenter) isDuplicate(fwdreq *server.ForwardRequest) bool {
+	if self.config == nil || self.config.Dedup == nil || len(fwdreq.IdempotencyKey) == 0 {
+		return false
+	}
+	window := self.config.DedupWindow
+	if window <= 0 {
+		window = defaultDedupWindow
+	}
+	sender := fwdreq.MessageContainer.Sender
+	senderService := fwdreq.MessageContainer.SenderService
+	dup, err := self.config.Dedup.Seen(senderService, sender, fwdreq.IdempotencyKey, window)
+	if err != nil {
+		self.logger.Warn("cannot check idempotency key", "sender", sender, "senderService", senderService, "err", err)
+		return false
+	}
+	if dup {
+		self.logger.Debug("duplicate forward request dropped", "username", fwdreq.Receiver, "sender", sender, "senderService", senderService, "key", fwdreq.IdempotencyKey)
+	}
+	return dup
+}
+
+// forgetForward() lets the sender retry a failed request with the same key.
+func (self *serviceCenter) forgetForward(fwdreq *server.ForwardRequest) {
+	if self.config == nil || self.config.Dedup == nil || len(fwdreq.IdempotencyKey) == 0 {
+		return
+	}
+	err := self.config.Dedup.Forget(fwdreq.MessageContainer.SenderService, fwdreq.MessageContainer.Sender, fwdreq.IdempotencyKey)
+	if err != nil {
+		self.logger.Warn("cannot forget idempotency key", "sender", fwdreq.MessageContainer.Sender, "err", err)
+	}
+}
 
 func (self *serviceCenter) ReceiveForward(fwdreq *server.ForwardRequest) {
+	// The message may be transformed once forwarded.
+	size := 0
+	if fwdreq.MessageContainer.Message != nil {
+		size = fwdreq.MessageContainer.Message.Size()
+	}
+	req := self.abuseRequest(fwdreq)
+	status, msgId := self.receiveForward(fwdreq)
+	if req != nil && (status == proto.FWD_OK || status == proto.FWD_SCHEDULED) {
+		self.scoreForward(fwdreq, req, size, status, msgId)
+		return
+	}
+	self.auditForward(fwdreq, size, status, msgId, "")
+}
+
+// receiveForward returns what it tells the sender.
+func (self *serviceCenter) receiveForward(fwdreq *server.ForwardRequest) (status, msgId string) {
+	if self.isBlocked(fwdreq) {
+		status = proto.FWD_BLOCKED
+		fwdreq.Done(status, "")
+		return
+	}
+	if verr := self.validate(fwdreq.Receiver, &fwdreq.MessageContainer); verr != nil {
+		status = proto.FWD_INVALID
+		fwdreq.Invalidate(verr)
+		return
+	}
+	if len(fwdreq.Supersedes) > 0 {
+		// The message has been forwarded already.
+		status = self.supersede(fwdreq)
+		if status == proto.FWD_OK {
+			msgId = fwdreq.Supersedes
+		}
+		fwdreq.Done(status, msgId)
+		return
+	}
 	shouldFwd := false
 	if self.config != nil {
-		if self.config.ForwardRequestHandler != nil {
-			shouldFwd = self.config.ForwardRequestHandler.ShouldForward(fwdreq)
-			maxttl := self.config.ForwardRequestHandler.MaxTTL()
-			if fwdreq.TTL < 1*time.Second || fwdreq.TTL > maxttl {
+		if h := self.config.ForwardRequestHandler; h != nil {
+			var ttl time.Duration
+			if decider, ok := h.(evthandler.ForwardDecider); ok {
+				shouldFwd, ttl = decider.DecideForward(fwdreq)
+			} else {
+				shouldFwd = h.ShouldForward(fwdreq)
+			}
+			maxttl := h.MaxTTL()
+			if ttl > 0 {
+				fwdreq.TTL = ttl
+			} else if fwdreq.TTL < 1*time.Second || fwdreq.TTL > maxttl {
 				fwdreq.TTL = maxttl
 			}
 		}
 	}
 	if !shouldFwd {
+		status = proto.FWD_REJECTED
+		fwdreq.Done(status, "")
+		return
+	}
+	if self.isDuplicate(fwdreq) {
+		status = proto.FWD_DUPLICATE
+		fwdreq.Done(status, "")
 		return
 	}
 	receiver := fwdreq.Receiver
-	extra := getPushInfo(fwdreq.Message, nil, true)
-	self.SendMessage(receiver, fwdreq.Message, extra, fwdreq.TTL)
+	mc := &fwdreq.MessageContainer
+	if len(fwdreq.IdempotencyKey) > 0 {
+		// Another node may cache the same request during a failover.
+		mc.OriginId = mc.SenderService + "\n" + mc.Sender + "\n" + fwdreq.IdempotencyKey
+	}
+	if qerr := self.chargeQuota(mc.SenderService, mc.Sender, mc.Message); qerr != nil {
+		self.forgetForward(fwdreq)
+		status = proto.FWD_QUOTA_EXCEEDED
+		fwdreq.ExceedQuota(qerr)
+		return
+	}
+	extra := getPushInfo(mc, nil, true)
+	if isScheduled(fwdreq) {
+		status, msgId = self.scheduleForward(fwdreq, extra)
+		fwdreq.Done(status, msgId)
+		return
+	}
+	res := self.sendMessageContainer(receiver, mc, extra, fwdreq.TTL)
+	if dropped(res) {
+		status = proto.FWD_DROPPED
+		fwdreq.Done(status, "")
+		return
+	}
+	if res == nil {
+		self.forgetForward(fwdreq)
+		status = proto.FWD_FAILED
+		fwdreq.Done(status, "")
+		return
+	}
+	if overMemoryLimit(mc, res) {
+		self.forgetForward(fwdreq)
+		status = proto.FWD_MEMORY_LIMIT
+		fwdreq.Done(status, "")
+		return
+	}
+	if len(res) == 0 && len(mc.Id) == 0 && !self.hasSubscription(receiver) {
+		// Neither connected, nor cached, nor pushed, the message is
+		// lost: the receiver may not even exist.
+		self.forgetForward(fwdreq)
+		status = proto.FWD_UNKNOWN_RECEIVER
+		fwdreq.Done(status, "")
+		return
+	}
+	status, msgId = proto.FWD_OK, mc.Id
+	fwdreq.Done(status, msgId)
+	return
+}
+
+// The number of requests recently sent by the sender given to the
+// abuse scorer.
+const abuseHistorySize = 20
+
+// abuseRequest returns nil if the request should not be scored. The
+// message is copied before it is transformed and delivered.
+func (self *serviceCenter) abuseRequest(fwdreq *server.ForwardRequest) *evthandler.AbuseRequest {
+	mc := &fwdreq.MessageContainer
+	if self.config.AbuseScorer == nil || mc.Message == nil || len(fwdreq.Supersedes) > 0 {
+		return nil
+	}
+	return &evthandler.AbuseRequest{
+		Service:       self.serviceName,
+		Receiver:      fwdreq.Receiver,
+		Sender:        mc.Sender,
+		SenderService: mc.SenderService,
+		Message:       mc.Message.Copy(),
+	}
+}
+
+// scoreForward scores a request which has been accepted, off the
+// goroutine routing the forwards, then acts on the verdict: a
+// shadow-dropped message is recalled from the receiver, and a flagged
+// one is reported. The request is audited once it is scored.
+func (self *serviceCenter) scoreForward(fwdreq *server.ForwardRequest, req *evthandler.AbuseRequest, size int, status, msgId string) {
+	err := self.resources.Go(func() {
+		verdict := ""
+		if v := self.score(req); v != nil {
+			verdict = v.Action
+			self.actOnVerdict(req, status, msgId, v)
+		}
+		self.auditForward(fwdreq, size, status, msgId, verdict)
+	})
+	if err != nil {
+		self.logger.Warn("forward not scored", "username", req.Receiver, "sender", req.Sender, "senderService", req.SenderService, "err", err)
+		self.auditForward(fwdreq, size, status, msgId, "")
+	}
+}
+
+func (self *serviceCenter) actOnVerdict(req *evthandler.AbuseRequest, status, msgId string, v *evthandler.AbuseVerdict) {
+	switch v.Action {
+	case evthandler.ABUSE_SHADOW_DROP:
+		// A scheduled message, or one which is not cached, cannot be
+		// taken back. It is flagged instead.
+		if status == proto.FWD_OK && len(msgId) > 0 && self.withdraw(req.Receiver, req.Sender, req.SenderService, msgId) {
+			self.logger.Info("forward shadow-dropped", "username", req.Receiver, "sender", req.Sender, "senderService", req.SenderService, "id", msgId, "score", v.Score, "reason", v.Reason)
+			return
+		}
+		self.reportFlag(req, msgId, v)
+	case evthandler.ABUSE_FLAG:
+		self.reportFlag(req, msgId, v)
+	}
+}
+
+func (self *serviceCenter) score(req *evthandler.AbuseRequest) *evthandler.AbuseVerdict {
+	if store := self.config.ForwardAudit; store != nil {
+		q := &audit.Query{Service: req.SenderService, Username: req.Sender, Direction: audit.DIRECTION_SENT, Limit: abuseHistorySize}
+		history, err := store.Query(q)
+		if err != nil {
+			self.logger.Warn("cannot read sender history", "sender", req.Sender, "senderService", req.SenderService, "err", err)
+		}
+		req.History = history
+	}
+	verdict, err := self.config.AbuseScorer.Score(req)
+	if err != nil {
+		self.logger.Warn("cannot score forward", "username", req.Receiver, "sender", req.Sender, "senderService", req.SenderService, "err", err)
+		return nil
+	}
+	if verdict != nil && len(verdict.Action) == 0 {
+		verdict.Action = evthandler.ABUSE_ACCEPT
+	}
+	return verdict
 }
 
-func getPushInfo(msg *proto.Message, extra map[string]string, fwd bool) map[string]string {
+// reportFlag publishes an EVENT_FLAG. The id is empty if the message
+// is not cached.
+func (self *serviceCenter) reportFlag(req *evthandler.AbuseRequest, msgId string, verdict *evthandler.AbuseVerdict) {
+	self.logger.Info("forward flagged", "username", req.Receiver, "sender", req.Sender, "senderService", req.SenderService, "id", msgId, "action", verdict.Action, "score", verdict.Score, "reason", verdict.Reason)
+	self.events.publish(&Event{
+		Type:            EVENT_FLAG,
+		Service:         req.SenderService,
+		Username:        req.Sender,
+		MessageId:       msgId,
+		Message:         req.Message.Copy(),
+		Receiver:        req.Receiver,
+		ReceiverService: req.Service,
+		Reason:          verdict.Reason,
+	})
+}
+
+// The number of audit records queued for the writer of a service.
+// The records are dropped while the queue is full.
+const auditQueueSize = 1024
+
+// auditForward queues the request for the audit trail of the
+// service, if there is one. Its receiver may be in another service,
+// if it is recorded for its sender.
+func (self *serviceCenter) auditForward(fwdreq *server.ForwardRequest, size int, status, msgId, verdict string) {
+	if self.audits == nil {
+		return
+	}
+	mc := &fwdreq.MessageContainer
+	rec := &audit.Record{
+		Time:            time.Now(),
+		Sender:          mc.Sender,
+		SenderService:   mc.SenderService,
+		Receiver:        fwdreq.Receiver,
+		ReceiverService: fwdreq.ReceiverService,
+		Size:            size,
+		Status:          status,
+		MessageId:       msgId,
+		Verdict:         verdict,
+	}
+	if len(rec.ReceiverService) == 0 {
+		rec.ReceiverService = self.serviceName
+	}
+	select {
+	case self.audits <- rec:
+	default:
+		self.logger.Warn("audit record dropped", "username", fwdreq.Receiver, "sender", mc.Sender, "senderService", mc.SenderService, "status", status)
+	}
+}
+
+// writeAudits writes the audit records off the goroutines routing
+// the forwards.
+func (self *serviceCenter) writeAudits() {
+	for rec := range self.audits {
+		if err := self.config.ForwardAudit.Record(rec); err != nil {
+			self.logger.Warn("cannot audit forward request", "username", rec.Receiver, "sender", rec.Sender, "senderService", rec.SenderService, "err", err)
+		}
+	}
+}
+
+// validate returns nil if the message is valid, or if the service
+// has no validator.
+func (self *serviceCenter) validate(username string, mc *proto.MessageContainer) *proto.ValidationError {
+	if self.config.Validator == nil || mc.Message == nil {
+		return nil
+	}
+	verr := self.config.Validator.Validate(self.messageContext(username, mc), mc.Message)
+	if verr != nil {
+		self.logger.Debug("invalid message rejected", "username", username, "sender", mc.Sender, "senderService", mc.SenderService, "err", verr)
+	}
+	return verr
+}
+
+// quotaOf returns the quota of the users of the service.
+func (self *serviceCenter) quotaOf(service string) *quota.Enforcer {
+	if service == self.serviceName || self.configOf == nil {
+		return self.config.Quota
+	}
+	if conf := self.configOf(service); conf != nil {
+		return conf.Quota
+	}
+	return nil
+}
+
+// chargeQuota returns nil if the message does not exceed the quota of
+// the service of the user, who may be the sender of a forward from
+// another service. The message is allowed if the usage cannot be
+// counted.
+func (self *serviceCenter) chargeQuota(service, username string, msg *proto.Message) *proto.QuotaError {
+	q := self.quotaOf(service)
+	if q == nil || msg == nil {
+		return nil
+	}
+	err := q.Charge(service, username, msg.Size())
+	if err == nil {
+		return nil
+	}
+	if qerr, ok := err.(*proto.QuotaError); ok {
+		self.logger.Info("quota exceeded", "service", service, "username", username, "scope", qerr.Scope, "resource", qerr.Resource)
+		return qerr
+	}
+	self.reportError(service, username, "", "", err)
+	return nil
+}
+
+func getPushInfo(mc *proto.MessageContainer, extra map[string]string, fwd bool) map[string]string {
+	msg := mc.Message
 	if extra == nil {
 		extra = make(map[string]string, len(msg.Header)+3)
 	}
@@ -131,8 +738,8 @@ func getPushInfo(msg *proto.Message, extra map[string]string, fwd bool) map[stri
 				delete(msg.Header, k)
 			}
 		}
-		extra["uniqush.sender"] = msg.Sender
-		extra["uniqush.sender-service"] = msg.SenderService
+		extra["uniqush.sender"] = mc.Sender
+		extra["uniqush.sender-service"] = mc.SenderService
 	}
 	if msg.Header != nil {
 		if title, ok := msg.Header["title"]; ok {
@@ -145,10 +752,44 @@ func getPushInfo(msg *proto.Message, extra map[string]string, fwd bool) map[stri
 	return extra
 }
 
-func (self *serviceCenter) shouldPush(service, username string, msg *proto.Message, extra map[string]string, fwd bool) bool {
+// pushInfo is getPushInfo with the unread count as the badge, and the
+// fields of PushPayload. The fields are the ones of the digest
+// templates. Only the preview is looked up in the headers of an opaque
+// message.
+func (self *serviceCenter) pushInfo(mc *proto.MessageContainer, extra map[string]string, fwd bool) map[string]string {
+	info := getPushInfo(mc, extra, fwd)
+	if unread, ok := info[proto.UnreadInfo]; ok {
+		if _, ok = info[push.INFO_BADGE]; !ok {
+			info[push.INFO_BADGE] = unread
+		}
+	}
+	msg := mc.Message
+	self.config.PushPayload.Apply(info, func(field string) string {
+		switch field {
+		case "sender":
+			return mc.Sender
+		case "sender-service":
+			return mc.SenderService
+		case "size":
+			return fmt.Sprintf("%v", msg.Size())
+		case "thread":
+			return msg.ThreadId
+		}
+		if v, ok := info[field]; ok {
+			return v
+		}
+		if msg.Opaque && field != proto.OpaquePreviewHeader {
+			return ""
+		}
+		return msg.Header[field]
+	})
+	return info
+}
+
+func (self *serviceCenter) shouldPush(service, username string, mc *proto.MessageContainer, extra map[string]string, fwd bool) bool {
 	if self.config != nil {
 		if self.config.PushHandler != nil {
-			info := getPushInfo(msg, extra, fwd)
+			info := self.pushInfo(mc, extra, fwd)
 			return self.config.PushHandler.ShouldPush(service, username, info)
 		}
 	}
@@ -159,7 +800,19 @@ func (self *serviceCenter) subscribe(req *server.SubscribeRequest) {
 	if req == nil {
 		return
 	}
+	self.events.publish(subscribeEvent(req))
 	if self.config != nil {
+		if store := self.config.SubscriptionStore; store != nil {
+			var err error
+			if req.Subscribe {
+				err = store.Subscribe(req.Service, req.Username, req.Params)
+			} else {
+				err = store.Unsubscribe(req.Service, req.Username, req.Params)
+			}
+			if err != nil {
+				self.reportError(req.Service, req.Username, "", "", err)
+			}
+		}
 		if self.config.PushService != nil {
 			if req.Subscribe {
 				self.config.PushService.Subscribe(req.Service, req.Username, req.Params)
@@ -170,6 +823,23 @@ func (self *serviceCenter) subscribe(req *server.SubscribeRequest) {
 	}
 }
 
+// hasSubscription tells whether the user may be pushed the messages.
+// A user whose subscriptions cannot be read is assumed to have some.
+func (self *serviceCenter) hasSubscription(username string) bool {
+	if self.nrDeliveryPoints(self.serviceName, username) > 0 {
+		return true
+	}
+	if self.config == nil || self.config.SubscriptionStore == nil {
+		return false
+	}
+	subs, err := self.config.SubscriptionStore.Subscriptions(self.serviceName, username)
+	if err != nil {
+		self.reportError(self.serviceName, username, "", "", err)
+		return true
+	}
+	return len(subs) > 0
+}
+
 func (self *serviceCenter) nrDeliveryPoints(service, username string) int {
 	n := 0
 	if self.config != nil {
@@ -180,10 +850,10 @@ func (self *serviceCenter) nrDeliveryPoints(service, username string) int {
 	return n
 }
 
-func (self *serviceCenter) pushNotif(service, username string, msg *proto.Message, extra map[string]string, msgIds []string, fwd bool) {
+func (self *serviceCenter) pushNotif(service, username string, mc *proto.MessageContainer, extra map[string]string, msgIds []string, fwd bool) {
 	if self.config != nil {
 		if self.config.PushService != nil {
-			info := getPushInfo(msg, extra, fwd)
+			info := self.pushInfo(mc, extra, fwd)
 			err := self.config.PushService.Push(service, username, info, msgIds)
 			if err != nil {
 				self.reportError(service, username, "", "", err)
@@ -193,43 +863,120 @@ func (self *serviceCenter) pushNotif(service, username string, msg *proto.Messag
 }
 
 func (self *serviceCenter) reportError(service, username, connId, addr string, err error) {
+	self.logger.Error("error", "service", service, "username", username, "connId", connId, "addr", addr, "err", err)
 	if self.config != nil {
 		if self.config.ErrorHandler != nil {
-			go self.config.ErrorHandler.OnError(service, username, connId, addr, err)
+			self.spawn("error handler", func() { self.config.ErrorHandler.OnError(service, username, connId, addr, err) })
 		}
 	}
 }
 
 func (self *serviceCenter) reportLogin(service, username, connId, addr string) {
+	self.logger.Info("login", "service", service, "username", username, "connId", connId, "addr", addr)
+	self.events.publish(&Event{
+		Type:     EVENT_CONNECT,
+		Service:  service,
+		Username: username,
+		ConnId:   connId,
+		Addr:     addr,
+	})
 	if self.config != nil {
 		if self.config.LoginHandler != nil {
-			go self.config.LoginHandler.OnLogin(service, username, connId, addr)
+			self.spawn("login handler", func() { self.config.LoginHandler.OnLogin(service, username, connId, addr) })
 		}
 	}
 }
 
-func (self *serviceCenter) reportMessage(connId string, msg *proto.Message) {
+func (self *serviceCenter) reportMessage(username, connId string, msg *proto.Message) {
+	self.events.publish(&Event{
+		Type:     EVENT_MESSAGE,
+		Service:  self.serviceName,
+		Username: username,
+		ConnId:   connId,
+		Message:  msg.Copy(),
+	})
 	if self.config != nil {
 		if self.config.MessageHandler != nil {
-			go self.config.MessageHandler.OnMessage(connId, msg)
+			self.spawn("message handler", func() { self.config.MessageHandler.OnMessage(connId, msg) })
 		}
 	}
 }
 
+func (self *serviceCenter) reportDelivery(username string, mc *proto.MessageContainer) {
+	if mc.Message == nil || !self.events.active() {
+		return
+	}
+	self.events.publish(&Event{
+		Type:          EVENT_DELIVER,
+		Service:       self.serviceName,
+		Username:      username,
+		MessageId:     mc.Id,
+		Message:       mc.Message.Copy(),
+		Sender:        mc.Sender,
+		SenderService: mc.SenderService,
+	})
+}
+
+// persist hands a copy of the message to the sink of the service.
+func (self *serviceCenter) persist(username string, mc *proto.MessageContainer) {
+	if mc.Message == nil || self.config == nil || self.config.MessageSink == nil {
+		return
+	}
+	rec := &sink.Record{
+		Time:      time.Now().UnixNano(),
+		Kind:      sink.KIND_DELIVER,
+		Service:   self.serviceName,
+		Username:  username,
+		MessageId: mc.Id,
+		Msg:       mc.Message.Copy(),
+	}
+	if mc.FromUser() {
+		rec.Kind = sink.KIND_FORWARD
+		rec.Sender = mc.Sender
+		rec.SenderService = mc.SenderService
+	}
+	self.config.MessageSink.Put(rec)
+}
+
 func (self *serviceCenter) reportLogout(service, username, connId, addr string, err error) {
+	self.logger.Info("logout", "service", service, "username", username, "connId", connId, "addr", addr, "err", err)
+	evt := &Event{
+		Type:     EVENT_DISCONNECT,
+		Service:  service,
+		Username: username,
+		ConnId:   connId,
+		Addr:     addr,
+	}
+	if err != nil {
+		evt.Reason = err.Error()
+	}
+	self.events.publish(evt)
 	if self.config != nil {
 		if self.config.LogoutHandler != nil {
-			go self.config.LogoutHandler.OnLogout(service, username, connId, addr, err)
+			self.spawn("logout handler", func() { self.config.LogoutHandler.OnLogout(service, username, connId, addr, err) })
 		}
 	}
 }
 
-func (self *serviceCenter) cacheMessage(service, username string, msg *proto.Message, ttl time.Duration) (id string, err error) {
-	if self.config != nil {
-		if self.config.MsgCache != nil {
-			id, err = self.config.MsgCache.CacheMessage(service, username, msg, ttl)
-		}
+// spawn runs f in a goroutine of the service. f is queued if the
+// service runs too many, and dropped if too many are queued too. The
+// drops are counted in the usage of the resources, and reported.
+func (self *serviceCenter) spawn(what string, f func()) {
+	if err := self.resources.Go(f); err != nil {
+		self.reportError(self.serviceName, "", "", "", fmt.Errorf("%v dropped: %v", what, err))
+	}
+}
+
+// cacheMessage returns true if the message has been cached already,
+// e.g. by another node receiving the same forward request.
+func (self *serviceCenter) cacheMessage(service, username string, mc *proto.MessageContainer, ttl time.Duration) (id string, dup bool, err error) {
+	if self.cache == nil {
+		return
+	}
+	if len(mc.OriginId) > 0 {
+		return self.cache.CacheMessageOnce(service, username, mc, ttl)
 	}
+	id, err = self.cache.CacheMessage(service, username, mc, ttl)
 	return
 }
 
@@ -238,51 +985,90 @@ type connWriteErr struct {
 	err  error
 }
 
-func (self *serviceCenter) process(maxNrConns, maxNrConnsPerUser, maxNrUsers int) {
+func (self *serviceCenter) process(maxNrConnsPerUser, maxNrUsers int) {
 	connMap := newTreeBasedConnMap()
-	nrConns := 0
+	retries := newForwardRetries(maxForwardRetryUsers)
 	for {
 		select {
 		case connInEvt := <-self.connIn:
-			if maxNrConns > 0 && nrConns >= maxNrConns {
+			if err := self.resources.AcquireConn(); err != nil {
 				if connInEvt.errChan != nil {
-					connInEvt.errChan <- ErrTooManyConns
+					connInEvt.errChan <- err
 				}
 				continue
 			}
 			err := connMap.AddConn(connInEvt.conn, maxNrConnsPerUser, maxNrUsers)
 			if err != nil {
+				self.resources.ReleaseConn()
 				if connInEvt.errChan != nil {
 					connInEvt.errChan <- err
 				}
 				continue
 			}
-			nrConns++
+			connInEvt.retries = retries.take(connInEvt.conn.Username(), time.Now())
 			if connInEvt.errChan != nil {
 				connInEvt.errChan <- nil
 			}
 		case leaveEvt := <-self.connLeave:
 			deleted := connMap.DelConn(leaveEvt.conn)
-			fmt.Printf("delete a connection %v under user %v; deleted: %v\n", leaveEvt.conn.UniqId(), leaveEvt.conn.Username(), deleted)
+			self.logger.Debug("connection removed", "service", self.serviceName, "username", leaveEvt.conn.Username(), "connId", leaveEvt.conn.ConnId(), "deleted", deleted)
 			leaveEvt.conn.Close()
 			if deleted {
-				nrConns--
+				self.resources.ReleaseConn()
 				conn := leaveEvt.conn
-				self.reportLogout(conn.Service(), conn.Username(), conn.UniqId(), conn.RemoteAddr().String(), leaveEvt.err)
+				if handedOff(conn) {
+					// The user is still connected to the new process.
+					self.logger.Debug("connection handed off", "service", self.serviceName, "username", conn.Username(), "connId", conn.ConnId())
+					continue
+				}
+				// Unregister in order with the registration which
+				// happened before the connection was served.
+				self.unregisterConn(conn)
+				self.reportLogout(conn.Service(), conn.Username(), conn.ConnId(), conn.ClientAddr().String(), leaveEvt.err)
 			}
+		case query := <-self.queryChan:
+			if len(query.username) == 0 {
+				query.userChan <- connMap.AllUsers()
+				continue
+			}
+			conns := connMap.GetConn(query.username)
+			ret := make([]server.Conn, 0, len(conns))
+			for _, conn := range conns {
+				if sconn, ok := conn.(server.Conn); ok {
+					ret = append(ret, sconn)
+				}
+			}
+			query.connChan <- ret
 		case subreq := <-self.subReqChan:
 			self.pushServiceLock.Lock()
 			self.subscribe(subreq)
 			self.pushServiceLock.Unlock()
 		case wreq := <-self.writeReqChan:
-			conns := connMap.GetConn(wreq.user)
+			conns := prioritize(connsOf(connMap.GetConn(wreq.user), wreq.mc.ReceiverConn))
 			res := make([]*Result, 0, len(conns))
 			errConns := make([]*connWriteErr, 0, len(conns))
-			n := 0
-			mid, err := self.cacheMessage(self.serviceName, wreq.user, wreq.msg, wreq.ttl)
-			if err != nil {
-				self.reportError(self.serviceName, wreq.user, "", "", err)
-				continue
+			if !wreq.local && self.shouldCache(wreq) {
+				_, dup, err := self.cacheMessage(self.serviceName, wreq.user, wreq.mc, wreq.ttl)
+				if err != nil {
+					self.reportError(self.serviceName, wreq.user, "", "", err)
+					if wreq.resChan != nil {
+						wreq.resChan <- nil
+					}
+					continue
+				}
+				if dup {
+					// Delivered by whoever cached it.
+					wreq.dup = true
+					if wreq.resChan != nil {
+						wreq.resChan <- res
+					}
+					continue
+				}
+				wreq.extra = self.countUnread(wreq.user, wreq.mc, wreq.extra)
+			}
+			if len(conns) > 1 && wreq.mc.Payload == nil && wreq.mc.Message != nil {
+				// Encode the message once for all the connections.
+				wreq.mc.Payload = proto.NewPayload(wreq.mc.Message)
 			}
 			for _, conn := range conns {
 				if conn == nil {
@@ -293,46 +1079,28 @@ func (self *serviceCenter) process(maxNrConns, maxNrConnsPerUser, maxNrUsers int
 				if !ok {
 					continue
 				}
-				err = sconn.SendMessage(wreq.msg, wreq.extra, wreq.ttl, mid)
+				err = sconn.DeliverMessage(wreq.mc, wreq.extra)
+				if err == server.ErrMemoryLimit && !self.config.ConnMemoryLimit.Disconnects() {
+					// The message stays in the cache, if it is cached.
+					res = append(res, &Result{err, sconn.ConnId(), sconn.Visible(), ""})
+					self.logger.Info("message over the memory limit of the connection", "service", self.serviceName, "username", wreq.user, "connId", sconn.ConnId(), "id", wreq.mc.Id)
+					continue
+				}
 				if err != nil {
 					errConns = append(errConns, &connWriteErr{sconn, err})
-					res = append(res, &Result{err, sconn.UniqId(), sconn.Visible()})
-					self.reportError(sconn.Service(), sconn.Username(), sconn.UniqId(), sconn.RemoteAddr().String(), err)
+					res = append(res, &Result{err, sconn.ConnId(), sconn.Visible(), ""})
+					self.reportError(sconn.Service(), sconn.Username(), sconn.ConnId(), sconn.ClientAddr().String(), err)
 					continue
 				} else {
-					res = append(res, &Result{nil, sconn.UniqId(), sconn.Visible()})
-				}
-				if sconn.Visible() {
-					n++
+					res = append(res, &Result{nil, sconn.ConnId(), sconn.Visible(), ""})
 				}
 			}
 
-			if n == 0 {
-				msg := wreq.msg
-				extra := wreq.extra
-				username := wreq.user
-				service := self.serviceName
-				fwd := false
-				if len(msg.Sender) > 0 && len(msg.SenderService) > 0 {
-					if msg.Sender != username || msg.SenderService != service {
-						fwd = true
-					}
-				}
-				go func() {
-					should := self.shouldPush(service, username, msg, extra, fwd)
-					if !should {
-						return
-					}
-					self.pushServiceLock.RLock()
-					defer self.pushServiceLock.RUnlock()
-					n := self.nrDeliveryPoints(service, username)
-					if n <= 0 {
-						return
-					}
-					msgIds := []string{mid}
-					self.pushNotif(service, username, msg, extra, msgIds, fwd)
-				}()
+			if self.shouldRetryForward(wreq.mc, len(conns), len(errConns)) {
+				retries.add(wreq.user, &forwardRetry{wreq.mc, wreq.extra}, time.Now())
+				self.logger.Info("forward kept for retry", "service", self.serviceName, "username", wreq.user, "id", wreq.mc.Id)
 			}
+
 			if wreq.resChan != nil {
 				wreq.resChan <- res
 			}
@@ -340,7 +1108,7 @@ func (self *serviceCenter) process(maxNrConns, maxNrConnsPerUser, maxNrUsers int
 			// close all connections with error:
 			go func() {
 				for _, e := range errConns {
-					fmt.Printf("Need to remove connection %v\n", e.conn.UniqId())
+					self.logger.Info("closing connection after write error", "service", self.serviceName, "username", e.conn.Username(), "connId", e.conn.ConnId(), "err", e.err)
 					self.connLeave <- &eventConnLeave{conn: e.conn, err: e.err}
 				}
 			}()
@@ -348,57 +1116,398 @@ func (self *serviceCenter) process(maxNrConns, maxNrConnsPerUser, maxNrUsers int
 	}
 }
 
+// connsOf returns the connection whose id is connId, or all of the
+// conns if connId is empty.
+func connsOf(conns []minimalConn, connId string) []minimalConn {
+	if len(connId) == 0 {
+		return conns
+	}
+	for _, conn := range conns {
+		if conn.ConnId() == connId {
+			return []minimalConn{conn}
+		}
+	}
+	return nil
+}
+
+// prioritize moves the deprioritized connections, i.e. the slow
+// consumers, after the others.
+func prioritize(conns []minimalConn) []minimalConn {
+	n := 0
+	for _, conn := range conns {
+		if sconn, ok := conn.(server.Conn); ok && sconn.Deprioritized() {
+			n++
+		}
+	}
+	if n == 0 {
+		return conns
+	}
+	ret := make([]minimalConn, 0, len(conns))
+	var slow []minimalConn
+	for _, conn := range conns {
+		if sconn, ok := conn.(server.Conn); ok && sconn.Deprioritized() {
+			slow = append(slow, conn)
+			continue
+		}
+		ret = append(ret, conn)
+	}
+	return append(ret, slow...)
+}
+
+// shouldRetryForward tells if the message is a cached forward
+// which failed to be written to every connection of the receiver.
+func (self *serviceCenter) shouldRetryForward(mc *proto.MessageContainer, nrConns, nrErrs int) bool {
+	if !self.config.RetryForwards || nrErrs == 0 || nrErrs < nrConns {
+		return false
+	}
+	return mc.FromUser() && len(mc.Id) > 0 && mc.Message != nil
+}
+
 func (self *serviceCenter) SendMessage(username string, msg *proto.Message, extra map[string]string, ttl time.Duration) []*Result {
+	mc := &proto.MessageContainer{
+		Message: msg,
+	}
+	return self.sendMessageContainer(username, mc, extra, ttl)
+}
+
+func (self *serviceCenter) sendMessageContainer(username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) []*Result {
+	self.stripServerHeaders(mc)
+	if !self.transform(username, mc) {
+		return []*Result{&Result{ErrDropped, "", false, ""}}
+	}
+	self.hashBody(mc)
+	span := tracing.StartFromMessage("deliver", mc.Message, "service", self.serviceName, "username", username)
+	defer span.End()
+	// Inject before caching so that the cached message carries the context.
+	tracing.Inject(span, mc.Message)
+
 	req := new(writeMessageRequest)
 	ch := make(chan []*Result)
-	req.msg = msg
+	req.mc = mc
 	req.user = username
 	req.ttl = ttl
 	req.resChan = ch
 	req.extra = extra
 	self.writeReqChan <- req
 	res := <-ch
+	if res == nil {
+		// The message cannot be cached.
+		return nil
+	}
+	if req.dup {
+		return res
+	}
+	// It may carry the unread count now.
+	extra = req.extra
+	self.reportDelivery(username, mc)
+	self.persist(username, mc)
+	res = append(res, self.route(username, mc, extra)...)
+
+	// The user may see the message on any of the connections.
+	visibility := visibilityOf(res)
+	if !ephemeral(mc) && self.router().Push(self.routeInfo(username, mc, extra), visibility.NrVisible()) {
+		self.spawn("push", func() { self.pushOffline(username, mc, extra) })
+	}
+	if self.config.SilentPush && len(mc.Id) > 0 && visibility.AllInvisible() {
+		self.spawn("silent push", func() { self.silentPush(username) })
+	}
 	return res
 }
 
+// ephemeral messages are dropped if the user is offline.
+func ephemeral(mc *proto.MessageContainer) bool {
+	return mc.Message != nil && mc.Message.Ephemeral
+}
+
+func (self *serviceCenter) shouldCache(wreq *writeMessageRequest) bool {
+	if ephemeral(wreq.mc) {
+		return false
+	}
+	return self.router().Cache(self.routeInfo(wreq.user, wreq.mc, wreq.extra))
+}
+
+func (self *serviceCenter) router() server.Router {
+	if self.config == nil || self.config.Router == nil {
+		return server.DefaultRouter{}
+	}
+	return self.config.Router
+}
+
+func (self *serviceCenter) routeInfo(username string, mc *proto.MessageContainer, extra map[string]string) *server.RouteInfo {
+	return &server.RouteInfo{
+		Service:  self.serviceName,
+		Username: username,
+		Message:  mc,
+		Extra:    extra,
+	}
+}
+
+// messageContext is given to the transformer and to the validator of
+// the service.
+func (self *serviceCenter) messageContext(username string, mc *proto.MessageContainer) *transform.Context {
+	return &transform.Context{
+		Service:       self.serviceName,
+		Receiver:      username,
+		Sender:        mc.Sender,
+		SenderService: mc.SenderService,
+	}
+}
+
+// transform replaces the message with the one changed by the
+// transformer of the service. It returns false, leaving the message
+// as it is, if the transformer drops it.
+func (self *serviceCenter) transform(username string, mc *proto.MessageContainer) bool {
+	if self.config.Transformer == nil || mc.Message == nil {
+		return true
+	}
+	msg := self.config.Transformer.Transform(self.messageContext(username, mc), mc.Message)
+	if msg == nil {
+		return false
+	}
+	if msg != mc.Message {
+		mc.Message = msg
+		// The payload encodes the original message.
+		mc.Payload = nil
+	}
+	return true
+}
+
+// dropped tells whether the results are the ones of a message dropped
+// by the transformer.
+func dropped(res []*Result) bool {
+	return len(res) == 1 && res[0].Err == ErrDropped
+}
+
+// overMemoryLimit tells whether the message is lost because it is not
+// cached and every connection it was written to is over its memory
+// limit.
+func overMemoryLimit(mc *proto.MessageContainer, res []*Result) bool {
+	if len(mc.Id) > 0 || len(res) == 0 {
+		return false
+	}
+	for _, r := range res {
+		if r.Err != server.ErrMemoryLimit {
+			return false
+		}
+	}
+	return true
+}
+
+// serverHeaders are only set by the server. They are dropped from the
+// messages sent to the users, so that a sender could not forge them.
+var serverHeaders = []string{proto.BodyHashHeader, proto.BodySizeHeader}
+
+func (self *serviceCenter) stripServerHeaders(mc *proto.MessageContainer) {
+	if mc.Message == nil {
+		return
+	}
+	msg := mc.Message.WithoutHeaders(serverHeaders...)
+	if msg != mc.Message {
+		mc.Message = msg
+		mc.Payload = nil
+	}
+}
+
+func (self *serviceCenter) hashBody(mc *proto.MessageContainer) {
+	if !self.config.BodyHash || mc.Message == nil {
+		return
+	}
+	msg := mc.Message.WithBodyHash()
+	if msg != mc.Message {
+		mc.Message = msg
+		mc.Payload = nil
+	}
+}
+
+// deliverLocal sends a message received from another node
+// to the local connections of the user.
+func (self *serviceCenter) deliverLocal(username string, mc *proto.MessageContainer, extra map[string]string) []*Result {
+	if len(mc.Supersedes) > 0 {
+		return self.notifyEditLocal(username, mc.Sender, mc.SenderService, mc.Supersedes, mc.Message)
+	}
+	req := new(writeMessageRequest)
+	ch := make(chan []*Result)
+	req.mc = mc
+	req.user = username
+	req.resChan = ch
+	req.extra = extra
+	req.local = true
+	self.writeReqChan <- req
+	res := <-ch
+	return res
+}
+
+func (self *serviceCenter) pushOffline(username string, mc *proto.MessageContainer, extra map[string]string) {
+	service := self.serviceName
+	fwd := false
+	if len(mc.Sender) > 0 && len(mc.SenderService) > 0 {
+		if mc.Sender != username || mc.SenderService != service {
+			fwd = true
+		}
+	}
+	should := self.shouldPush(service, username, mc, extra, fwd)
+	if !should {
+		return
+	}
+	self.pushServiceLock.RLock()
+	defer self.pushServiceLock.RUnlock()
+	n := self.nrDeliveryPoints(service, username)
+	if n <= 0 {
+		return
+	}
+	msgIds := []string{mc.Id}
+	self.pushNotif(service, username, mc, extra, msgIds, fwd)
+}
+
+func (self *serviceCenter) ConnectedUsers() []string {
+	ch := make(chan []string)
+	self.queryChan <- &eventQuery{userChan: ch}
+	return <-ch
+}
+
+func (self *serviceCenter) Conns(username string) []server.Conn {
+	if len(username) == 0 {
+		return nil
+	}
+	ch := make(chan []server.Conn)
+	self.queryChan <- &eventQuery{username: username, connChan: ch}
+	return <-ch
+}
+
+// Visibility aggregates the visibility of the connections of the
+// user on this node.
+func (self *serviceCenter) Visibility(username string) *Visibility {
+	return visibilityOfConns(self.Conns(username))
+}
+
+// disconnectLocal closes the connections of the user on this node,
+// or only the one whose id is connId if it is not empty. Revoked
+// connections are told so by CMD_BYE(revoked) before being closed.
+// It returns the number of closed connections.
+func (self *serviceCenter) disconnectLocal(username, connId string, revoke bool) int {
+	n := 0
+	reason := ErrDisconnected
+	if revoke {
+		reason = ErrRevoked
+	}
+	for _, conn := range self.Conns(username) {
+		if len(connId) > 0 && conn.ConnId() != connId {
+			continue
+		}
+		if revoke {
+			if err := conn.Bye(proto.BYE_REVOKED); err != nil {
+				self.logger.Debug("cannot send bye", "username", username, "connId", conn.ConnId(), "err", err)
+			}
+		}
+		self.connLeave <- &eventConnLeave{conn: conn, err: reason}
+		n++
+	}
+	return n
+}
+
+// Disconnect closes the connections of the user on all nodes of the
+// cluster, or only the one whose id is connId if it is not empty.
+func (self *serviceCenter) Disconnect(username, connId string, revoke bool) int {
+	return self.disconnectLocal(username, connId, revoke) + self.disconnectRemote(username, connId, revoke)
+}
+
 func (self *serviceCenter) serveConn(conn server.Conn) {
 	conn.SetForwardRequestChannel(self.fwdChan)
 	conn.SetSubscribeRequestChan(self.subReqChan)
+	conn.SetAckChannel(self.ackChan)
+	conn.SetBlockList(self.config.BlockList)
+	conn.SetAssetStore(self.config.Assets)
 	var err error
 	defer func() {
 		self.connLeave <- &eventConnLeave{conn: conn, err: err}
 	}()
 	for {
 		var msg *proto.Message
-		msg, err = conn.ReadMessage()
+		msg, err = conn.ReceiveMessage()
 		if err != nil {
 			return
 		}
-		self.reportMessage(conn.UniqId(), msg)
+		self.reportMessage(conn.Username(), conn.ConnId(), msg)
 	}
 }
 
 func (self *serviceCenter) NewConn(conn server.Conn) error {
+	return self.newConn(conn, false)
+}
+
+// adoptConn serves a connection handed off by another process. The
+// client neither logs in again nor is recommended the settings again.
+func (self *serviceCenter) adoptConn(conn server.Conn) error {
+	return self.newConn(conn, true)
+}
+
+func (self *serviceCenter) newConn(conn server.Conn, adopted bool) error {
 	usr := conn.Username()
 	if len(usr) == 0 || strings.Contains(usr, ":") || strings.Contains(usr, "\n") {
-		return fmt.Errorf("[Username=%v] Invalid Username")
+		return fmt.Errorf("[Username=%v] Invalid Username", usr)
 	}
 	evt := new(eventConnIn)
 	ch := make(chan error)
 
-	conn.SetMessageCache(self.config.MsgCache)
+	conn.SetLogger(self.logger)
+	conn.SetMessageCache(self.cache)
+	conn.SetSessionStore(self.config.SessionStore)
+	if self.config.DigestTemplate != nil {
+		conn.SetDigestTemplate(self.config.DigestTemplate)
+	}
+	if len(self.config.DigestPolicy) > 0 {
+		conn.SetDigestPolicy(self.config.DigestPolicy)
+	}
+	if self.config.Router != nil {
+		conn.SetRouter(self.config.Router)
+	}
+	conn.SetLatencyRecorder(self.latency, self.config.LatencyHeader)
+	if self.config.Analytics != nil {
+		conn.SetAnalyticsRecorder(self.config.Analytics)
+	}
+	if self.config.AdaptiveCompression {
+		conn.SetAdaptiveCompression(true)
+	}
+	if self.config.ConnMemoryLimit != nil {
+		conn.SetMemoryLimit(self.config.ConnMemoryLimit)
+	}
+	if self.config.SlowConsumer != nil {
+		conn.SetSlowConsumerPolicy(self.config.SlowConsumer, self.slowChan)
+	}
+	if self.config.MaxBandwidthPerConn > 0 || self.bandwidth != nil {
+		conn.SetThrottle(throttle.NewBucket(self.config.MaxBandwidthPerConn), self.bandwidth)
+	}
 	evt.conn = conn
 	evt.errChan = ch
 	self.connIn <- evt
 	err := <-ch
 	if err == nil {
+		// The connection has to be registered before it may leave.
+		self.registerConn(conn)
+		if self.config.Analytics != nil {
+			self.config.Analytics.RecordActive(conn.Service(), usr)
+		}
+		self.sendAssets(conn)
+		for _, r := range evt.retries {
+			if e := conn.SendDigest(r.mc, r.extra); e != nil {
+				self.reportError(conn.Service(), usr, conn.ConnId(), conn.ClientAddr().String(), e)
+				break
+			}
+		}
+		if self.config.RecommendedSettings != nil && !adopted {
+			if e := conn.RecommendSettings(self.config.RecommendedSettings); e != nil {
+				self.reportError(conn.Service(), usr, conn.ConnId(), conn.ClientAddr().String(), e)
+			}
+		}
 		go self.serveConn(conn)
-		self.reportLogin(conn.Service(), usr, conn.UniqId(), conn.RemoteAddr().String())
+		if !adopted {
+			self.reportLogin(conn.Service(), usr, conn.ConnId(), conn.ClientAddr().String())
+		}
 	}
 	return err
 }
 
-func newServiceCenter(serviceName string, conf *ServiceConfig, fwdChan chan<- *server.ForwardRequest) *serviceCenter {
+func newServiceCenter(serviceName string, conf *ServiceConfig, fwdChan chan<- *server.ForwardRequest, cl *clusterInfo, events *eventBus, l logger.Logger) *serviceCenter {
 	ret := new(serviceCenter)
 	ret.config = conf
 	if ret.config == nil {
@@ -406,11 +1515,116 @@ func newServiceCenter(serviceName string, conf *ServiceConfig, fwdChan chan<- *s
 	}
 	ret.serviceName = serviceName
 	ret.fwdChan = fwdChan
+	ret.cluster = cl
+	ret.events = events
+	ret.logger = logger.OrNop(l)
+	ret.cache = ret.config.MsgCache
+	if ret.cache != nil {
+		ret.cache.SetLogger(ret.logger)
+		if len(ret.config.IndexedHeaders) > 0 {
+			ret.cache.IndexHeaders(serviceName, ret.config.IndexedHeaders...)
+		}
+	}
+	if ret.config.MessageSink != nil {
+		ret.config.MessageSink.SetLogger(ret.logger)
+	}
+	limits := ret.config.Resources
+	if limits.MaxConns <= 0 {
+		limits.MaxConns = ret.config.MaxNrConns
+	}
+	ret.resources = resource.NewGroup(limits)
+	if ret.cache != nil && ret.config.Resources.MaxCacheMemory > 0 {
+		ret.cache = resource.NewCache(ret.cache, ret.resources)
+	}
+
+	ret.bandwidth = throttle.NewBucket(ret.config.MaxBandwidth)
+	ret.latency = latency.NewTracker()
+	ret.cooldowns = dedup.NewMemoryStore()
 
 	ret.connIn = make(chan *eventConnIn)
 	ret.connLeave = make(chan *eventConnLeave)
 	ret.writeReqChan = make(chan *writeMessageRequest)
 	ret.subReqChan = make(chan *server.SubscribeRequest)
-	go ret.process(conf.MaxNrConns, conf.MaxNrConnsPerUser, conf.MaxNrUsers)
+	ret.ackChan = make(chan *server.Ack)
+	ret.slowChan = make(chan *server.SlowConsumer)
+	ret.queryChan = make(chan *eventQuery)
+	go ret.process(ret.config.MaxNrConnsPerUser, ret.config.MaxNrUsers)
+	go ret.publishAcks()
+	go ret.handleSlowConsumers()
+	if ret.config.ForwardAudit != nil {
+		ret.audits = make(chan *audit.Record, auditQueueSize)
+		go ret.writeAudits()
+	}
+	if ret.config.Assets != nil {
+		ret.assetVersions = make(map[string]uint64, 4)
+		ret.assetPushes = make(map[server.Conn]map[string]*asset.Asset, 16)
+		ret.assetStop = make(chan bool)
+		ret.assetDone = make(chan bool)
+		go ret.watchAssets()
+	}
+	if collector, ok := ret.cache.(msgcache.DeadLetterCollector); ok && ret.config.DeadLetterHandler != nil {
+		collector.TrackDeadLetters(serviceName)
+		go ret.collectDeadLetters(collector)
+	}
 	return ret
 }
+
+// publishAcks never blocks the connections for long,
+// because publishing an event never blocks.
+func (self *serviceCenter) publishAcks() {
+	for ack := range self.ackChan {
+		self.uncount(ack.Username, ack.Id)
+		self.events.publish(ackEvent(ack))
+	}
+}
+
+// handleSlowConsumers publishes the changes of the slow consumers, and
+// closes the ones which are disconnected.
+func (self *serviceCenter) handleSlowConsumers() {
+	for slow := range self.slowChan {
+		evt := &Event{
+			Type:     EVENT_SLOW_CONSUMER,
+			Service:  slow.Service,
+			Username: slow.Username,
+			ConnId:   slow.ConnId,
+			Reason:   slow.Action,
+		}
+		if slow.Recovered {
+			evt.Type = EVENT_SLOW_CONSUMER_RECOVERED
+		}
+		self.events.publish(evt)
+		if slow.Recovered || slow.Action != server.SLOW_CONSUMER_DISCONNECT {
+			continue
+		}
+		for _, conn := range self.Conns(slow.Username) {
+			if conn.ConnId() == slow.ConnId {
+				self.connLeave <- &eventConnLeave{conn: conn, err: server.ErrSlowConsumer}
+			}
+		}
+	}
+}
+
+func (self *serviceCenter) collectDeadLetters(collector msgcache.DeadLetterCollector) {
+	interval := self.config.DeadLetterInterval
+	if interval <= 0 {
+		interval = defaultDeadLetterInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for {
+			letters, err := collector.CollectDeadLetters(self.serviceName, deadLetterBatchSize)
+			if err != nil {
+				self.reportError(self.serviceName, "", "", "", err)
+				break
+			}
+			for _, letter := range letters {
+				self.logger.Debug("dead letter", "username", letter.Username, "id", letter.Message.Id, "reason", letter.Reason)
+				self.config.DeadLetterHandler.OnDeadLetter(letter)
+			}
+			if len(letters) < deadLetterBatchSize {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"github.com/uniqush/uniqush-conn/testsupport"
+)
+
+func TestReplyToOneConnection(t *testing.T) {
+	conf := &ServiceConfig{
+		MsgCache:              testsupport.NewMockCache(),
+		ForwardRequestHandler: allowForward{},
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+	auth := testsupport.NewFakeAuth()
+	auth.AllowAll()
+
+	received := make(chan string, 4)
+	var connIds []string
+	for i := 0; i < 2; i++ {
+		servConn, cliConn, err := testsupport.Pipe(auth, "srv", "alice", "token")
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		defer cliConn.Close()
+		go func(c client.Conn) {
+			for {
+				if _, err := c.ReceiveMessage(); err != nil {
+					return
+				}
+				received <- c.ConnId()
+			}
+		}(cliConn)
+		if err = center.NewConn(servConn); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		connIds = append(connIds, servConn.ConnId())
+	}
+
+	fwdreq := forwardFrom("bob")
+	fwdreq.MessageContainer.ReceiverConn = connIds[1]
+	var status string
+	fwdreq.Reply = func(s, id string) {
+		status = s
+	}
+	center.ReceiveForward(fwdreq)
+	if status != proto.FWD_OK {
+		t.Fatalf("not forwarded: %v", status)
+	}
+	select {
+	case connId := <-received:
+		if connId != connIds[1] {
+			t.Errorf("the reply is written to %v", connId)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the reply is not received")
+	}
+	select {
+	case connId := <-received:
+		t.Errorf("the reply is written to %v too", connId)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/subscription"
+	"testing"
+)
+
+type staticConfigReader struct {
+	config *ServiceConfig
+}
+
+func (self *staticConfigReader) ReadConfig(service string) *ServiceConfig {
+	return self.config
+}
+
+type recordingPush struct {
+	subscribed []string
+}
+
+func (self *recordingPush) Subscribe(service, username string, info map[string]string) error {
+	self.subscribed = append(self.subscribed, username+":"+info["regid"])
+	return nil
+}
+
+func (self *recordingPush) Unsubscribe(service, username string, info map[string]string) error {
+	return nil
+}
+
+func (self *recordingPush) Push(service, username string, info map[string]string, msgIds []string) error {
+	return nil
+}
+
+func (self *recordingPush) NrDeliveryPoints(service, username string) int {
+	return 0
+}
+
+func TestSubscriptionsAreRecordedAndSynced(t *testing.T) {
+	push := &recordingPush{}
+	conf := &ServiceConfig{
+		SubscriptionStore: subscription.NewMemoryStore(),
+		PushService:       push,
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+	for _, u := range []string{"alice", "bob"} {
+		center.subscribe(&server.SubscribeRequest{
+			Subscribe: true,
+			Service:   "srv",
+			Username:  u,
+			Params:    map[string]string{"pushservicetype": "gcm", "regid": u},
+		})
+	}
+	center.subscribe(&server.SubscribeRequest{
+		Subscribe: false,
+		Service:   "srv",
+		Username:  "bob",
+		Params:    map[string]string{"regid": "bob"},
+	})
+	push.subscribed = nil
+
+	mcenter := &MessageCenter{srvConfReader: &staticConfigReader{conf}}
+	subs, err := mcenter.Subscriptions("srv", "alice")
+	if err != nil || len(subs) != 1 || subs[0]["regid"] != "alice" {
+		t.Errorf("bad subscriptions: %v; %v", subs, err)
+	}
+	n, err := mcenter.SyncSubscriptions("srv", "")
+	if err != nil || n != 1 {
+		t.Errorf("synced %v subscriptions: %v", n, err)
+	}
+	if len(push.subscribed) != 1 || push.subscribed[0] != "alice:alice" {
+		t.Errorf("bad subscriptions sent to the push service: %v", push.subscribed)
+	}
+
+	conf.PushService = nil
+	if _, err = mcenter.SyncSubscriptions("srv", ""); err != ErrNoPushService {
+		t.Errorf("should fail without a push service: %v", err)
+	}
+}
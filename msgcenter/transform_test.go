@@ -0,0 +1,147 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/testsupport"
+	"github.com/uniqush/uniqush-conn/transform"
+	"testing"
+)
+
+func TestTransformBeforeCaching(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	truncate, err := transform.New("truncate", map[string]string{"max-size": "2"})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		ForwardRequestHandler: allowForward{},
+		Transformer: transform.Chain{
+			transform.TransformerFunc(func(ctx *transform.Context, msg *proto.Message) *proto.Message {
+				ret := msg.Copy()
+				if ret.Header == nil {
+					ret.Header = make(map[string]string, 1)
+				}
+				ret.Header["from"] = ctx.SenderService + ":" + ctx.Sender
+				return ret
+			}),
+			truncate,
+		},
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+
+	fwdreq := forwardFrom("bob")
+	original := fwdreq.MessageContainer.Message
+	center.ReceiveForward(fwdreq)
+	mcs, err := cache.GetCachedMessages("srv", "alice")
+	if err != nil || len(mcs) != 1 {
+		t.Fatalf("the message is not cached: %v", err)
+	}
+	msg := mcs[0].Message
+	if string(msg.Body) != "he" || msg.Header[transform.TruncatedHeader] != "true" || msg.Header["from"] != "srv:bob" {
+		t.Errorf("the cached message is not transformed: %+v", msg)
+	}
+	if string(original.Body) != "hello" {
+		t.Errorf("the original message is changed: %+v", original)
+	}
+}
+
+func TestBodyHashAfterTransform(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	truncate, err := transform.New("truncate", map[string]string{"max-size": "2"})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		ForwardRequestHandler: allowForward{},
+		Transformer:           truncate,
+		BodyHash:              true,
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+
+	fwdreq := forwardFrom("bob")
+	original := fwdreq.MessageContainer.Message
+	center.ReceiveForward(fwdreq)
+	mcs, err := cache.GetCachedMessages("srv", "alice")
+	if err != nil || len(mcs) != 1 {
+		t.Fatalf("the message is not cached: %v", err)
+	}
+	msg := mcs[0].Message
+	if len(msg.Header[proto.BodyHashHeader]) == 0 || msg.VerifyBodyHash() != nil {
+		t.Errorf("the hash of the transformed body is not added: %+v", msg)
+	}
+	if _, ok := original.Header[proto.BodyHashHeader]; ok {
+		t.Errorf("the original message is changed: %+v", original)
+	}
+}
+
+func TestTransformerDrops(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		ForwardRequestHandler: allowForward{},
+		Transformer: transform.TransformerFunc(func(ctx *transform.Context, msg *proto.Message) *proto.Message {
+			return nil
+		}),
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+
+	fwdreq := forwardFrom("bob")
+	if status, _ := center.receiveForward(fwdreq); status != proto.FWD_DROPPED {
+		t.Errorf("should be dropped: %v", status)
+	}
+	if fwdreq.MessageContainer.Message == nil {
+		t.Errorf("the message is lost")
+	}
+	if mcs, _ := cache.GetCachedMessages("srv", "alice"); len(mcs) != 0 {
+		t.Errorf("the dropped message is cached: %v", mcs)
+	}
+	res := center.SendMessage("alice", &proto.Message{Body: []byte("hello")}, nil, 0)
+	if !dropped(res) {
+		t.Errorf("should be dropped: %v", res)
+	}
+}
+
+func TestForgedServerHeaders(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		ForwardRequestHandler: allowForward{},
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+
+	fwdreq := forwardFrom("bob")
+	fwdreq.MessageContainer.Message.Header = map[string]string{
+		proto.BodyHashHeader: "forged",
+		proto.BodySizeHeader: "5",
+	}
+	center.ReceiveForward(fwdreq)
+	mcs, err := cache.GetCachedMessages("srv", "alice")
+	if err != nil || len(mcs) != 1 {
+		t.Fatalf("the message is not cached: %v", err)
+	}
+	if _, ok := mcs[0].Message.Header[proto.BodyHashHeader]; ok {
+		t.Errorf("the forged hash is kept: %+v", mcs[0].Message)
+	}
+	if mcs[0].Message.IsHeadersOnly() {
+		t.Errorf("the forged body size is kept: %+v", mcs[0].Message)
+	}
+}
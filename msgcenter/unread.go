@@ -0,0 +1,61 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+// countUnread counts the cached message as unread, and returns a copy
+// of extra carrying the unread count of the user. It returns extra if
+// the service does not count them, or the count is not known.
+func (self *serviceCenter) countUnread(username string, mc *proto.MessageContainer, extra map[string]string) map[string]string {
+	store := self.config.Badges
+	if store == nil || len(mc.Id) == 0 {
+		return extra
+	}
+	var expiresAt time.Time
+	if mc.ExpiresAt > 0 {
+		expiresAt = time.Unix(0, mc.ExpiresAt)
+	}
+	n, err := store.Add(self.serviceName, username, mc.Id, expiresAt)
+	if err != nil {
+		self.reportError(self.serviceName, username, "", "", err)
+		return extra
+	}
+	ret := make(map[string]string, len(extra)+1)
+	for k, v := range extra {
+		ret[k] = v
+	}
+	ret[proto.UnreadInfo] = strconv.Itoa(n)
+	return ret
+}
+
+// uncount stops counting the message as unread.
+func (self *serviceCenter) uncount(username, id string) {
+	store := self.config.Badges
+	if store == nil || len(id) == 0 {
+		return
+	}
+	if err := store.Remove(self.serviceName, username, id); err != nil {
+		self.reportError(self.serviceName, username, "", "", err)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/badge"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"github.com/uniqush/uniqush-conn/push"
+	"github.com/uniqush/uniqush-conn/testsupport"
+)
+
+func TestUnreadCount(t *testing.T) {
+	recorder := &pushInfoRecorder{pushed: make(chan map[string]string, 10)}
+	badges := badge.NewMemoryStore()
+	conf := &ServiceConfig{
+		MsgCache:    testsupport.NewMockCache(),
+		PushHandler: alwaysPush{},
+		PushService: recorder,
+		Badges:      badges,
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+	unread := func(expected int) {
+		if n, err := badges.Count("srv", "alice"); err != nil || n != expected {
+			t.Errorf("%v unread messages, not %v: %v", n, expected, err)
+		}
+	}
+	send := func() string {
+		mc := &proto.MessageContainer{Message: &proto.Message{Body: []byte("hi")}}
+		center.sendMessageContainer("alice", mc, nil, time.Hour)
+		if len(mc.Id) == 0 {
+			t.Fatalf("the message is not cached")
+		}
+		return mc.Id
+	}
+
+	// The badges of the offline user.
+	for _, badge := range []string{"1", "2"} {
+		send()
+		select {
+		case info := <-recorder.pushed:
+			if info[push.INFO_BADGE] != badge {
+				t.Errorf("the badge is %q, not %q", info[push.INFO_BADGE], badge)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("the message is not pushed")
+		}
+	}
+	unread(2)
+
+	auth := testsupport.NewFakeAuth()
+	auth.AllowAll()
+	servConn, cliConn, err := testsupport.Pipe(auth, "srv", "alice", "token")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer cliConn.Close()
+	digestChan := make(chan *client.Digest, 1)
+	cliConn.SetDigestChannel(digestChan)
+	go func() {
+		for {
+			if _, err := cliConn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	if err = center.NewConn(servConn); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	servConn.SetDigestThreshold(0)
+
+	id := send()
+	select {
+	case digest := <-digestChan:
+		if digest.MsgId != id || digest.Info[proto.UnreadInfo] != "3" {
+			t.Errorf("bad digest: %+v", digest)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no digest")
+	}
+	unread(3)
+
+	// Read receipts count down once.
+	cliConn.MarkRead(id)
+	cliConn.Ack(id)
+	for i := 0; i < 100; i++ {
+		if n, _ := badges.Count("srv", "alice"); n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	unread(2)
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/testsupport"
+	"github.com/uniqush/uniqush-conn/validate"
+	"testing"
+)
+
+func TestForwardInvalidMessage(t *testing.T) {
+	cache := testsupport.NewMockCache()
+	v, err := validate.New("required", map[string]string{"headers": "type"})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		ForwardRequestHandler: allowForward{},
+		Validator:             v,
+	}
+	center := newServiceCenter("srv", conf, nil, nil, nil, nil)
+
+	var status string
+	var verr *proto.ValidationError
+	fwdreq := forwardFrom("bob")
+	fwdreq.Reply = func(s, msgId string) {
+		status = s
+	}
+	fwdreq.OnInvalid = func(e *proto.ValidationError) {
+		verr = e
+	}
+	center.ReceiveForward(fwdreq)
+	if status != "" || verr == nil || verr.Header != "type" {
+		t.Errorf("the message should be invalid: %v %v", status, verr)
+	}
+
+	// Without OnInvalid, the sender only gets the status.
+	fwdreq = forwardFrom("bob")
+	fwdreq.Reply = func(s, msgId string) {
+		status = s
+	}
+	center.ReceiveForward(fwdreq)
+	if status != proto.FWD_INVALID {
+		t.Errorf("bad status: %v", status)
+	}
+	if calls := cache.Calls(); len(calls) != 0 {
+		t.Errorf("invalid messages should not be cached: %v", calls)
+	}
+
+	fwdreq = forwardFrom("bob")
+	fwdreq.MessageContainer.Message.Header = map[string]string{"type": "text"}
+	fwdreq.Reply = func(s, msgId string) {
+		status = s
+	}
+	center.ReceiveForward(fwdreq)
+	if status != proto.FWD_OK {
+		t.Errorf("the valid message should be forwarded: %v", status)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto/server"
+)
+
+// Visibility aggregates the visibility of the connections of a user.
+type Visibility struct {
+	// Conns maps the ids of the connections to whether they are
+	// visible.
+	Conns map[string]bool
+}
+
+func newVisibility(n int) *Visibility {
+	return &Visibility{Conns: make(map[string]bool, n)}
+}
+
+// visibilityOf the connections the results were written to. A
+// connection failed to be written is left out.
+func visibilityOf(res []*Result) *Visibility {
+	ret := newVisibility(len(res))
+	for _, r := range res {
+		if r != nil && r.Err == nil {
+			ret.Conns[r.ConnId] = ret.Conns[r.ConnId] || r.Visible
+		}
+	}
+	return ret
+}
+
+func visibilityOfConns(conns []server.Conn) *Visibility {
+	ret := newVisibility(len(conns))
+	for _, conn := range conns {
+		ret.Conns[conn.ConnId()] = conn.Visible()
+	}
+	return ret
+}
+
+// NrVisible returns the number of visible connections.
+func (self *Visibility) NrVisible() int {
+	n := 0
+	for _, v := range self.Conns {
+		if v {
+			n++
+		}
+	}
+	return n
+}
+
+// AnyVisible tells if the user is visible on any connection.
+func (self *Visibility) AnyVisible() bool {
+	return self.NrVisible() > 0
+}
+
+// AllInvisible tells if the user has connections, none of which
+// is visible.
+func (self *Visibility) AllInvisible() bool {
+	return len(self.Conns) > 0 && !self.AnyVisible()
+}
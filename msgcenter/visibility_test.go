@@ -0,0 +1,45 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVisibilityOfResults(t *testing.T) {
+	res := []*Result{
+		&Result{nil, "1", false, ""},
+		&Result{errors.New("closed"), "2", true, ""},
+		&Result{nil, "3", true, "node2"},
+	}
+	v := visibilityOf(res)
+	if len(v.Conns) != 2 || v.Conns["1"] || !v.Conns["3"] {
+		t.Errorf("bad visibility: %+v", v)
+	}
+	if v.NrVisible() != 1 || !v.AnyVisible() || v.AllInvisible() {
+		t.Errorf("bad visibility: %+v", v)
+	}
+	v = visibilityOf(res[:2])
+	if v.AnyVisible() || !v.AllInvisible() {
+		t.Errorf("bad visibility: %+v", v)
+	}
+	if v = visibilityOf(nil); v.AnyVisible() || v.AllInvisible() {
+		t.Errorf("bad visibility: %+v", v)
+	}
+}
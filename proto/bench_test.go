@@ -0,0 +1,275 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// The benchmarks of the codec run with these body sizes. The largest
+// one still fits in a command. Compare the results of
+//
+//	go test -run NONE -bench . -count 10 ./proto
+//
+// before and after a change to the codec with benchstat.
+var benchSizes = []int{64, 1024, 16 * 1024, 60 * 1024}
+
+// benchBody returns a body of n bytes. A text body compresses like
+// the usual JSON messages do; a random one does not compress at all.
+func benchBody(n int, text bool) []byte {
+	body := make([]byte, n)
+	if !text {
+		io.ReadFull(rand.Reader, body)
+		return body
+	}
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, `{"id":%d,"from":"user%d","text":"hello, world"},`, i, i%17)
+	}
+	copy(body, buf.Bytes())
+	return body
+}
+
+func benchCommand(n int, text bool) *Command {
+	cmd := &Command{Type: CMD_DATA, Params: []string{"1234567890", "service"}}
+	cmd.Message = &Message{
+		Header: map[string]string{"title": "hello", "content-type": "application/json"},
+		Body:   benchBody(n, text),
+	}
+	return cmd
+}
+
+// zeroReadWriter discards the writes. The reads return zeros, which
+// are as costly to decrypt as any ciphertext.
+type zeroReadWriter struct{}
+
+func (self zeroReadWriter) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (self zeroReadWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func benchCommandIOs(conn io.ReadWriter) (w, r *CommandIO) {
+	keys := make([]byte, 2*(authKeyLen+encrKeyLen))
+	io.ReadFull(rand.Reader, keys)
+	ks := newKeySet(keys[:encrKeyLen], keys[encrKeyLen:encrKeyLen+authKeyLen],
+		keys[encrKeyLen+authKeyLen:2*encrKeyLen+authKeyLen], keys[2*encrKeyLen+authKeyLen:])
+	w = ks.ServerCommandIO(conn)
+	r = ks.ClientCommandIO(conn)
+	return
+}
+
+func benchEachSize(b *testing.B, f func(b *testing.B, n int)) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("%vB", n), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(n))
+			f(b, n)
+		})
+	}
+}
+
+func BenchmarkEncodeCommand(b *testing.B) {
+	c, _ := benchCommandIOs(zeroReadWriter{})
+	benchEachSize(b, func(b *testing.B, n int) {
+		cmd := benchCommand(n, true)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := c.encodeCommand(cmd, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDecodeCommand(b *testing.B) {
+	c, _ := benchCommandIOs(zeroReadWriter{})
+	benchEachSize(b, func(b *testing.B, n int) {
+		data, err := c.encodeCommand(benchCommand(n, true), false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := c.decodeCommand(data, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func benchCompress(b *testing.B, text bool) {
+	c, _ := benchCommandIOs(zeroReadWriter{})
+	benchEachSize(b, func(b *testing.B, n int) {
+		cmd := benchCommand(n, text)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := c.encodeCommand(cmd, true); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkCompressText(b *testing.B) {
+	benchCompress(b, true)
+}
+
+func BenchmarkCompressRandom(b *testing.B) {
+	benchCompress(b, false)
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	c, _ := benchCommandIOs(zeroReadWriter{})
+	benchEachSize(b, func(b *testing.B, n int) {
+		data, err := c.encodeCommand(benchCommand(n, true), true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := c.decodeCommand(data, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	c, _ := benchCommandIOs(zeroReadWriter{})
+	benchEachSize(b, func(b *testing.B, n int) {
+		data := benchBody(n, false)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			mac, err := c.writeThenHmac(data)
+			if err == nil {
+				err = c.writeHmac(mac)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	_, c := benchCommandIOs(zeroReadWriter{})
+	benchEachSize(b, func(b *testing.B, n int) {
+		data := make([]byte, n)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			// Not readThenHmac(): the flag decrypted from the zeros
+			// may tell a plaintext command.
+			c.readAuth.Reset()
+			if _, err := io.ReadFull(c.cryptReader, data); err != nil {
+				b.Fatal(err)
+			}
+			c.readAuth.Sum(nil)
+		}
+	})
+}
+
+func benchExchange(b *testing.B, compress, zeroCopy bool) {
+	buf := new(bytes.Buffer)
+	w, r := benchCommandIOs(buf)
+	r.SetZeroCopy(zeroCopy)
+	benchEachSize(b, func(b *testing.B, n int) {
+		cmd := benchCommand(n, true)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := w.WriteCommand(cmd, compress); err != nil {
+				b.Fatal(err)
+			}
+			recved, err := r.ReadCommand()
+			if err != nil {
+				b.Fatal(err)
+			}
+			recved.Message.Release()
+		}
+	})
+}
+
+// The exchanges go through the whole codec: encoding, compression,
+// encryption and MAC, and back.
+func BenchmarkExchange(b *testing.B) {
+	benchExchange(b, false, false)
+}
+
+func BenchmarkExchangeCompressed(b *testing.B) {
+	benchExchange(b, true, false)
+}
+
+func BenchmarkExchangeZeroCopy(b *testing.B) {
+	benchExchange(b, true, true)
+}
+
+// BenchmarkReadCommand measures the reads alone. Without zero-copy,
+// a read allocates the message it returns, but no buffer of the size
+// of the command.
+func BenchmarkReadCommand(b *testing.B) {
+	buf := new(bytes.Buffer)
+	w, r := benchCommandIOs(buf)
+	benchEachSize(b, func(b *testing.B, n int) {
+		cmd := benchCommand(n, false)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			if err := w.WriteCommand(cmd, false); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+			if _, err := r.ReadCommand(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestBenchCommandsRoundTrip makes sure the benchmarks measure
+// commands which get through the codec.
+func TestBenchCommandsRoundTrip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, r := benchCommandIOs(buf)
+	for _, n := range benchSizes {
+		for _, text := range []bool{true, false} {
+			cmd := benchCommand(n, text)
+			if err := w.WriteCommand(cmd, true); err != nil {
+				t.Fatalf("%v bytes: %v", n, err)
+			}
+			recved, err := r.ReadCommand()
+			if err != nil {
+				t.Fatalf("%v bytes: %v", n, err)
+			}
+			if !cmd.eq(recved) {
+				t.Errorf("%v bytes: bad command", n)
+			}
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%v bytes left", buf.Len())
+	}
+}
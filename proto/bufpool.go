@@ -0,0 +1,63 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// The size of the pooled buffers. A command on the wire is never
+// larger, but a decompressed one may be.
+const pooledBufferSize = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &pooledBuffer{data: make([]byte, pooledBufferSize)}
+	},
+}
+
+// pooledBuffer holds a command read in zero-copy mode. The message
+// of the command refers to it until the message is released.
+type pooledBuffer struct {
+	data     []byte
+	released int32
+}
+
+func getBuffer() *pooledBuffer {
+	buf := bufferPool.Get().(*pooledBuffer)
+	buf.released = 0
+	return buf
+}
+
+// release() puts the buffer back to the pool. Only the first call
+// takes effect.
+func (self *pooledBuffer) release() {
+	if self == nil || !atomic.CompareAndSwapInt32(&self.released, 0, 1) {
+		return
+	}
+	bufferPool.Put(self)
+}
+
+// holds() tells if data is a slice of the buffer.
+func (self *pooledBuffer) holds(data []byte) bool {
+	if self == nil || len(data) == 0 {
+		return false
+	}
+	return &self.data[:cap(self.data)][cap(self.data)-1] == &data[:cap(data)][cap(data)-1]
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+// Asset is a version of a configuration asset pushed by the server.
+// The server sends the latest version of every asset when the client
+// connects, and every new version while it is connected, so the
+// client may receive a version it has already applied, or an older
+// one right after connecting. Such versions should be ignored.
+type Asset struct {
+	Name    string
+	Version uint64
+	Data    []byte
+}
+
+type assetProcessor struct {
+	assetChan chan<- *Asset
+}
+
+func (self *assetProcessor) ProcessCommand(cmd *proto.Command) (mc *proto.MessageContainer, err error) {
+	if cmd == nil || cmd.Type != proto.CMD_ASSET || self.assetChan == nil {
+		return
+	}
+	v, err := proto.ParseAssetVersion(cmd.Params)
+	if err != nil {
+		return
+	}
+	a := &Asset{Name: v.Name, Version: v.Version}
+	if cmd.Message != nil {
+		a.Data = cmd.Message.Body
+	}
+	self.assetChan <- a
+	return
+}
+
+func (self *clientConn) SetAssetChannel(assetChan chan<- *Asset) {
+	proc := new(assetProcessor)
+	proc.assetChan = assetChan
+	self.setCommandProcessor(proto.CMD_ASSET, proc)
+}
+
+func (self *clientConn) AckAsset(name string, version uint64) error {
+	if !self.HasCapability(proto.CAP_ASSETS) {
+		return ErrNotSupported
+	}
+	v := &proto.AssetVersion{Name: name, Version: version}
+	return self.cmdio.WriteCommand(v.Command(nil), false)
+}
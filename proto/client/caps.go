@@ -0,0 +1,105 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+var ErrNoCaps = errors.New("the server does not understand CMD_CAPS")
+var ErrNotSupported = errors.New("the server does not support the feature")
+
+// Capabilities are the features advertised to the servers
+// understanding CMD_CAPS, along with DialOptions.Capabilities.
+var Capabilities = []string{
+	proto.CAP_ACK,
+	proto.CAP_DIGEST_BATCH,
+	proto.CAP_CHECKPOINTS,
+	proto.CAP_SEQ_RANGE,
+	proto.CAP_HEADERS_ONLY,
+	proto.CAP_EDIT,
+	proto.CAP_ASSETS,
+}
+
+// readCaps reads the features of the server, which follow the
+// CMD_AUTHOK. The ones of the client were sent in the CMD_AUTH.
+func readCaps(cmdio *proto.CommandIO) (caps *proto.Caps, err error) {
+	cmd, err := cmdio.ReadCommand()
+	if err != nil {
+		return
+	}
+	if cmd.Type != proto.CMD_CAPS {
+		err = proto.ErrBadPeerImpl
+		return
+	}
+	caps, err = proto.ParseCaps(cmd.Params)
+	return
+}
+
+func (self *clientConn) setCaps(caps *proto.Caps) {
+	self.capsLock.Lock()
+	defer self.capsLock.Unlock()
+	self.caps = caps
+}
+
+func (self *clientConn) Capabilities() []string {
+	self.capsLock.Lock()
+	defer self.capsLock.Unlock()
+	if self.caps == nil {
+		return nil
+	}
+	ret := make([]string, len(self.caps.Features))
+	copy(ret, self.caps.Features)
+	return ret
+}
+
+func (self *clientConn) HasCapability(feature string) bool {
+	self.capsLock.Lock()
+	defer self.capsLock.Unlock()
+	return self.caps.Has(feature)
+}
+
+func (self *clientConn) Advertise(features ...string) error {
+	self.capsLock.Lock()
+	ok := self.caps != nil
+	self.capsLock.Unlock()
+	if !ok {
+		return ErrNoCaps
+	}
+	caps := &proto.Caps{Features: features}
+	return self.cmdio.WriteCommand(caps.Command(), false)
+}
+
+// capsProcessor replaces the features of the server when it sends
+// them again.
+type capsProcessor struct {
+	conn *clientConn
+}
+
+func (self *capsProcessor) ProcessCommand(cmd *proto.Command) (mc *proto.MessageContainer, err error) {
+	if cmd == nil || cmd.Type != proto.CMD_CAPS || self.conn == nil {
+		return
+	}
+	caps, err := proto.ParseCaps(cmd.Params)
+	if err != nil {
+		return
+	}
+	self.conn.setCaps(caps)
+	return
+}
@@ -18,32 +18,226 @@
 package client
 
 import (
+	"errors"
 	"fmt"
+	"github.com/uniqush/uniqush-conn/logger"
 	"github.com/uniqush/uniqush-conn/proto"
 	"io"
 	"math/rand"
 	"net"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// ErrRevoked is returned by ReceiveMessage() when the server revoked
+// the connection. Reconnecting with the same token will fail.
+var ErrRevoked = errors.New("connection revoked by the server")
+
+// ErrSlowConsumer is returned by ReceiveMessage() when the server
+// disconnected the client because it did not keep up. The client may
+// reconnect.
+var ErrSlowConsumer = errors.New("disconnected by the server as a slow consumer")
+
 type Conn interface {
 	Close() error
 	Service() string
 	Username() string
-	UniqId() string
+
+	// ConnId() is the id assigned by the server, or a local one if
+	// the server did not tell it.
+	ConnId() string
 
 	SendMessageToUser(service, receiver string, msg *proto.Message, ttl time.Duration) error
 	SendMessageToServer(msg *proto.Message) error
+
+	// SendOpaqueMessageToUser() forwards a payload encrypted by the app
+	// to another user. The server will not look into the payload, and the
+	// digest of the message will only contain the sender and the preview.
+	SendOpaqueMessageToUser(service, receiver string, payload []byte, preview string, ttl time.Duration) error
+
+	// SendSignal() forwards an ephemeral message, like a typing
+	// indicator, to another user. The server never caches, digests or
+	// pushes it, and drops it if the receiver is offline. It fails with
+	// ErrNotSupported if the server does not advertise proto.CAP_EPHEMERAL.
+	SendSignal(service, receiver string, msg *proto.Message) error
+
+	// ReceiveMessage() returns the message along with
+	// proto.ErrCorruptedBody if its body does not match the hash added
+	// by the server, see proto.BodyHashHeader. The connection could
+	// still be used; the message could be retrieved again with its id.
 	ReceiveMessage() (mc *proto.MessageContainer, err error)
 
+	// RequestForward() is like SendMessageToUser(), but the server tells
+	// the result of the request to the channel set by SetForwardResultChannel().
+	// The result carries the returned request id.
+	RequestForward(service, receiver string, msg *proto.Message, ttl time.Duration) (reqId string, err error)
+
+	// RequestIdempotentForward() is like RequestForward(), but the
+	// server drops a request whose key has been used recently, and
+	// tells proto.FWD_DUPLICATE instead. Retry a request with the
+	// same key if its result is unknown.
+	RequestIdempotentForward(service, receiver string, msg *proto.Message, ttl time.Duration, key string) (reqId string, err error)
+
+	// RequestMultiForward() is like RequestIdempotentForward(), but
+	// sends the message once to several receivers of the service. The
+	// result for each receiver carries its name. The servers which do
+	// not advertise proto.CAP_MULTI_FORWARD are sent one request per
+	// receiver. key may be empty.
+	RequestMultiForward(service string, receivers []string, msg *proto.Message, ttl time.Duration, key string) (reqId string, err error)
+
+	// RequestForwardAt() is like RequestForward(), but the server
+	// keeps the message until at, and tells proto.FWD_SCHEDULED. It
+	// fails with ErrNotSupported if the server does not advertise
+	// proto.CAP_SCHEDULED_FORWARD. The ttl starts at delivery.
+	RequestForwardAt(service, receiver string, msg *proto.Message, ttl time.Duration, at time.Time) (reqId string, err error)
+
+	// RequestStickyForward() is like RequestForward(), but the replies
+	// of the receiver, see Reply(), are only written to this
+	// connection rather than to all the connections of the user. It
+	// fails with ErrNotSupported if the server does not advertise
+	// proto.CAP_STICKY_REPLIES.
+	RequestStickyForward(service, receiver string, msg *proto.Message, ttl time.Duration) (reqId string, err error)
+
+	// Reply() is like RequestForward() to the sender of mc. If the
+	// sender asked for it, the reply is only written to the connection
+	// which sent mc.
+	Reply(mc *proto.MessageContainer, msg *proto.Message, ttl time.Duration) (reqId string, err error)
+
+	// EditMessage() replaces a message forwarded earlier to the
+	// receiver. id is the one told by the result of the forward
+	// request. The connected clients of the receiver are told with an
+	// Edit. The result carries the returned request id. It fails with
+	// ErrNotSupported if the server does not advertise proto.CAP_EDIT.
+	EditMessage(service, receiver, id string, msg *proto.Message) (reqId string, err error)
+
+	// RecallMessage() is like EditMessage(), but deletes the message
+	// for everyone.
+	RecallMessage(service, receiver, id string) (reqId string, err error)
+
+	// Call() sends msg to another user and waits for the reply, see
+	// Respond(), until timeout. ReceiveMessage() should be called by
+	// another goroutine meanwhile; it never returns the replies of
+	// the callee, but returns the messages which only claim to be,
+	// e.g. the ones from another user. It
+	// fails with a *CallError if the server does not forward the call
+	// or the callee replies an error, and with ErrCallTimeout if
+	// there is no reply in time. The call is ephemeral, and its reply
+	// is only written to this connection, if the server supports it.
+	Call(service, receiver string, msg *proto.Message, timeout time.Duration) (reply *proto.MessageContainer, err error)
+
+	// CallServer() is like Call(), but sends msg to the server. The
+	// backend replies with a message from the server carrying the id
+	// of the call, see proto.ReplyHeader.
+	CallServer(msg *proto.Message, timeout time.Duration) (reply *proto.MessageContainer, err error)
+
+	// Respond() replies to a call received by ReceiveMessage(), see
+	// proto.Message.CallId(). A non-nil err fails the call with its
+	// text. reply may be nil. It fails with ErrNotCall if the message
+	// is not a call.
+	Respond(call *proto.MessageContainer, reply *proto.Message, err error) error
+	SetForwardResultChannel(resChan chan<- *ForwardResult)
+
+	// SetEditChannel() sets the channel receiving the edits and the
+	// recalls of the messages forwarded to the user.
+	SetEditChannel(editChan chan<- *Edit)
+
+	// SetAssetChannel() sets the channel receiving the configuration
+	// assets pushed by the server. Once an asset is applied, the app
+	// tells the server its version with AckAsset(), which fails with
+	// ErrNotSupported if the server does not advertise proto.CAP_ASSETS.
+	SetAssetChannel(assetChan chan<- *Asset)
+	AckAsset(name string, version uint64) error
+
 	Config(digestThreshold, compressThreshold int, digestFields ...string) error
+
+	// AddDigestField() and RemoveDigestField() change the digest
+	// fields set by Config() without touching the other fields.
+	AddDigestField(fields ...string) error
+	RemoveDigestField(fields ...string) error
 	SetDigestChannel(digestChan chan<- *Digest)
-	RequestMessage(id string) error
+
+	// SetSettingsHandler() sets the function called with the settings
+	// recommended by the server. The thresholds of the returned
+	// settings are sent to the server. Returning nil ignores the
+	// recommendation. The handler is called by ReceiveMessage().
+	SetSettingsHandler(handler func(recommended *proto.Settings) *proto.Settings)
+
+	// SetQuotaHandler() sets the function called when a message
+	// cannot be forwarded because it exceeds a quota. reqId is the
+	// one returned by RequestForward(), or empty if the message was
+	// sent by SendMessageToUser(). The handler is called by
+	// ReceiveMessage().
+	SetQuotaHandler(handler func(reqId string, qerr *proto.QuotaError))
+
+	// RequestMessage() retrieves cached messages. The messages
+	// are received in the same order as the ids.
+	RequestMessage(ids ...string) error
 	SetVisibility(v bool) error
+
+	// SetHeadersOnly() asks the server to strip the bodies larger
+	// than size from the cached messages pushed to the client. Use
+	// Message.IsHeadersOnly() to tell them, and RequestMessage() to
+	// retrieve them. A negative size turns the mode off.
+	SetHeadersOnly(size int) error
 	Subscribe(params map[string]string) error
 	Unsubscribe(params map[string]string) error
 	RequestAllCachedMessages(excludes ...string) error
+
+	// SetCheckpointHandler() sets the function called with the
+	// checkpoints of the replays asked by RequestAllCachedMessages()
+	// and ResumeCachedMessages(): every cached message whose sequence
+	// number is up to seq has been received. done tells if the replay
+	// is complete. The server only sends checkpoints to the clients
+	// with a handler. The handler is called by ReceiveMessage().
+	SetCheckpointHandler(handler func(seq uint64, done bool))
+
+	// ResumeCachedMessages() is like RequestAllCachedMessages(), but
+	// only asks for the messages after the last checkpoint received.
+	// Older servers replay all the messages instead.
+	ResumeCachedMessages(after uint64, excludes ...string) error
+
+	// Block() asks the server to drop the messages forwarded
+	// by the user. An empty service means the service of the client.
+	Block(username, service string) error
+	Unblock(username, service string) error
+
+	// RequestMessagesBySeq() asks the server to re-send cached messages
+	// whose sequence numbers are in [from, to]. to == 0 means no upper bound.
+	// It is normally used to fill the gap after a reconnection.
+	RequestMessagesBySeq(from, to uint64) error
+
+	// RequestThread() asks the server to re-send the cached messages
+	// of a thread. See proto.Message.ThreadId. It fails with
+	// ErrNotSupported if the server does not advertise proto.CAP_THREADS.
+	RequestThread(threadId string) error
+
+	// Ack() tells the server that the message has been received.
+	Ack(id string) error
+
+	// MarkRead() tells the server that the message has been read by the user.
+	MarkRead(id string) error
+
+	// SetLogger() logs every command sent or received at the debug level.
+	SetLogger(l logger.Logger)
+
+	// Capabilities() are the optional features advertised by the
+	// server in CMD_CAPS. An older server advertises none.
+	Capabilities() []string
+	HasCapability(feature string) bool
+
+	// Advertise() replaces the features advertised to the server,
+	// e.g. to turn on a feature of the app. It fails with ErrNoCaps
+	// if the server is too old to understand them.
+	Advertise(features ...string) error
+
+	// SetZeroCopy() lets the bodies of the messages returned by
+	// ReceiveMessage() be slices of pooled buffers, which are not
+	// copied between decryption, decompression and decoding. Call
+	// Message.Release() once a message is used. It should be called
+	// before ReceiveMessage().
+	SetZeroCopy(on bool)
 }
 
 type CommandProcessor interface {
@@ -51,6 +245,7 @@ type CommandProcessor interface {
 }
 
 type clientConn struct {
+	nextReqId         uint64
 	cmdio             *proto.CommandIO
 	conn              net.Conn
 	compressThreshold int32
@@ -59,6 +254,17 @@ type clientConn struct {
 	username          string
 	connId            string
 	cmdProcs          []CommandProcessor
+
+	// Accessed atomically. 1 if there is a checkpoint handler.
+	checkpoints int32
+
+	// The calls waiting for their replies.
+	calls callTable
+
+	// The features of the server, nil if it does not understand
+	// CMD_CAPS.
+	capsLock sync.Mutex
+	caps     *proto.Caps
 }
 
 func (self *clientConn) Service() string {
@@ -69,10 +275,18 @@ func (self *clientConn) Username() string {
 	return self.username
 }
 
-func (self *clientConn) UniqId() string {
+func (self *clientConn) ConnId() string {
 	return self.connId
 }
 
+func (self *clientConn) SetLogger(l logger.Logger) {
+	self.cmdio.SetLogger(logger.OrNop(l).With("service", self.service, "username", self.username))
+}
+
+func (self *clientConn) SetZeroCopy(on bool) {
+	self.cmdio.SetZeroCopy(on)
+}
+
 func (self *clientConn) Close() error {
 	return self.conn.Close()
 }
@@ -85,28 +299,169 @@ func (self *clientConn) shouldCompress(size int) bool {
 	return false
 }
 
+func (self *clientConn) shouldCompressMessage(msg *proto.Message) bool {
+	if msg.Opaque {
+		return false
+	}
+	return self.shouldCompress(msg.Size())
+}
+
 func (self *clientConn) SendMessageToServer(msg *proto.Message) error {
-	compress := self.shouldCompress(msg.Size())
+	compress := self.shouldCompressMessage(msg)
 
-	cmd := new(proto.Command)
-	cmd.Message = msg
-	cmd.Type = proto.CMD_DATA
-	err := self.cmdio.WriteCommand(cmd, compress)
+	data := new(proto.Data)
+	err := self.cmdio.WriteCommand(data.Command(msg), compress)
 	return err
 }
 
+func (self *clientConn) writeForwardRequest(service, receiver string, msg *proto.Message, ttl time.Duration, reqId, key string) error {
+	req := &proto.ForwardRequest{
+		TTL:            ttl,
+		Receiver:       receiver,
+		RequestId:      reqId,
+		IdempotencyKey: key,
+	}
+	return self.writeForwardCommand(service, req, msg)
+}
+
+func (self *clientConn) writeForwardCommand(service string, req *proto.ForwardRequest, msg *proto.Message) error {
+	if service != self.Service() {
+		req.ReceiverService = service
+	}
+	compress := self.shouldCompressMessage(msg)
+	return self.cmdio.WriteCommand(req.Command(msg), compress)
+}
+
 func (self *clientConn) SendMessageToUser(service, receiver string, msg *proto.Message, ttl time.Duration) error {
-	cmd := new(proto.Command)
-	cmd.Type = proto.CMD_FWD_REQ
-	cmd.Params = make([]string, 2, 3)
-	cmd.Params[0] = fmt.Sprintf("%v", ttl)
-	cmd.Params[1] = receiver
-	if len(service) > 0 && service != self.Service() {
-		cmd.Params = append(cmd.Params, service)
+	return self.writeForwardRequest(service, receiver, msg, ttl, "", "")
+}
+
+func (self *clientConn) RequestForward(service, receiver string, msg *proto.Message, ttl time.Duration) (reqId string, err error) {
+	return self.RequestIdempotentForward(service, receiver, msg, ttl, "")
+}
+
+func (self *clientConn) RequestIdempotentForward(service, receiver string, msg *proto.Message, ttl time.Duration, key string) (reqId string, err error) {
+	reqId = self.newRequestId()
+	err = self.writeForwardRequest(service, receiver, msg, ttl, reqId, key)
+	return
+}
+
+func (self *clientConn) RequestMultiForward(service string, receivers []string, msg *proto.Message, ttl time.Duration, key string) (reqId string, err error) {
+	if len(receivers) == 0 {
+		return
+	}
+	reqId = self.newRequestId()
+	req := &proto.ForwardRequest{
+		TTL:            ttl,
+		Receiver:       receivers[0],
+		RequestId:      reqId,
+		IdempotencyKey: key,
+		MoreReceivers:  receivers[1:],
+	}
+	if self.HasCapability(proto.CAP_MULTI_FORWARD) {
+		err = self.writeForwardCommand(service, req, msg)
+		return
+	}
+	for _, r := range receivers {
+		// The result processor tells the receiver from the request id.
+		err = self.writeForwardRequest(service, r, msg, ttl, reqId+multiForwardSep+r, req.ReceiverKey(r))
+		if err != nil {
+			return
+		}
 	}
-	cmd.Message = msg
-	compress := self.shouldCompress(msg.Size())
-	return self.cmdio.WriteCommand(cmd, compress)
+	return
+}
+
+func (self *clientConn) RequestForwardAt(service, receiver string, msg *proto.Message, ttl time.Duration, at time.Time) (reqId string, err error) {
+	if !self.HasCapability(proto.CAP_SCHEDULED_FORWARD) {
+		err = ErrNotSupported
+		return
+	}
+	reqId = self.newRequestId()
+	req := &proto.ForwardRequest{
+		TTL:       ttl,
+		Receiver:  receiver,
+		RequestId: reqId,
+		DeliverAt: at,
+	}
+	err = self.writeForwardCommand(service, req, msg)
+	return
+}
+
+func (self *clientConn) RequestStickyForward(service, receiver string, msg *proto.Message, ttl time.Duration) (reqId string, err error) {
+	if !self.HasCapability(proto.CAP_STICKY_REPLIES) {
+		err = ErrNotSupported
+		return
+	}
+	reqId = self.newRequestId()
+	req := &proto.ForwardRequest{
+		TTL:           ttl,
+		Receiver:      receiver,
+		RequestId:     reqId,
+		StickyReplies: true,
+	}
+	err = self.writeForwardCommand(service, req, msg)
+	return
+}
+
+func (self *clientConn) Reply(mc *proto.MessageContainer, msg *proto.Message, ttl time.Duration) (reqId string, err error) {
+	reqId = self.newRequestId()
+	req := &proto.ForwardRequest{
+		TTL:       ttl,
+		Receiver:  mc.Sender,
+		RequestId: reqId,
+		ReplyTo:   mc.SenderConn,
+	}
+	err = self.writeForwardCommand(mc.SenderService, req, msg)
+	return
+}
+
+func (self *clientConn) EditMessage(service, receiver, id string, msg *proto.Message) (reqId string, err error) {
+	return self.writeEdit(service, receiver, id, msg)
+}
+
+func (self *clientConn) RecallMessage(service, receiver, id string) (reqId string, err error) {
+	return self.writeEdit(service, receiver, id, nil)
+}
+
+// writeEdit recalls the message if msg is nil.
+func (self *clientConn) writeEdit(service, receiver, id string, msg *proto.Message) (reqId string, err error) {
+	if !self.HasCapability(proto.CAP_EDIT) {
+		err = ErrNotSupported
+		return
+	}
+	reqId = self.newRequestId()
+	edit := &proto.Edit{Peer: receiver, Id: id, Recall: msg == nil, RequestId: reqId}
+	if service != self.Service() {
+		edit.PeerService = service
+	}
+	compress := msg != nil && self.shouldCompressMessage(msg)
+	err = self.cmdio.WriteCommand(edit.Command(msg), compress)
+	return
+}
+
+func (self *clientConn) newRequestId() string {
+	return strconv.FormatUint(atomic.AddUint64(&self.nextReqId, 1), 16)
+}
+
+func (self *clientConn) SetForwardResultChannel(resChan chan<- *ForwardResult) {
+	proc := new(forwardResultProcessor)
+	proc.resChan = resChan
+	self.setCommandProcessor(proto.CMD_FWD_RESULT, proc)
+}
+
+func (self *clientConn) SendOpaqueMessageToUser(service, receiver string, payload []byte, preview string, ttl time.Duration) error {
+	msg := proto.NewOpaqueMessage(payload, preview)
+	return self.SendMessageToUser(service, receiver, msg, ttl)
+}
+
+func (self *clientConn) SendSignal(service, receiver string, msg *proto.Message) error {
+	if !self.HasCapability(proto.CAP_EPHEMERAL) {
+		return ErrNotSupported
+	}
+	signal := *msg
+	signal.Ephemeral = true
+	return self.writeForwardRequest(service, receiver, &signal, 0, "", "")
 }
 
 func (self *clientConn) processCommand(cmd *proto.Command) (mc *proto.MessageContainer, err error) {
@@ -114,8 +469,16 @@ func (self *clientConn) processCommand(cmd *proto.Command) (mc *proto.MessageCon
 		return
 	}
 
+	if cmd.Type == proto.CMD_FWD_RESULT {
+		// The result of a call is never told to the app.
+		if res, e := proto.ParseForwardResult(cmd.Params); e == nil && self.calls.forwarded(res) {
+			return
+		}
+	}
+
+	// The commands added by newer peers are ignored.
 	t := int(cmd.Type)
-	if t > len(self.cmdProcs) {
+	if t >= len(self.cmdProcs) {
 		return
 	}
 	proc := self.cmdProcs[t]
@@ -134,31 +497,52 @@ func (self *clientConn) ReceiveMessage() (mc *proto.MessageContainer, err error)
 		}
 		switch cmd.Type {
 		case proto.CMD_DATA:
+			var data *proto.Data
+			data, err = proto.ParseData(cmd.Params)
+			if err != nil {
+				return
+			}
 			mc = new(proto.MessageContainer)
 			mc.Message = cmd.Message
-			if len(cmd.Params[0]) > 0 {
-				mc.Id = cmd.Params[0]
+			mc.Id = data.Id
+			mc.Seq = data.Seq
+			mc.SetTTL(data.TTL)
+			err = mc.Message.VerifyBodyHash()
+			if err == nil && self.calls.reply(mc) {
+				continue
 			}
 			return
 		case proto.CMD_FWD:
-			if len(cmd.Params) < 1 {
-				err = proto.ErrBadPeerImpl
+			var fwd *proto.Forward
+			fwd, err = proto.ParseForward(cmd.Params)
+			if err != nil {
 				return
 			}
 			mc = new(proto.MessageContainer)
 			mc.Message = cmd.Message
-			mc.Sender = cmd.Params[0]
-			if len(cmd.Params) > 1 {
-				mc.SenderService = cmd.Params[1]
-			} else {
+			mc.Sender = fwd.Sender
+			mc.SenderService = fwd.SenderService
+			if len(mc.SenderService) == 0 {
 				mc.SenderService = self.Service()
 			}
-			if len(cmd.Params) > 2 {
-				mc.Id = cmd.Params[2]
+			mc.Id = fwd.Id
+			mc.Seq = fwd.Seq
+			mc.SenderConn = fwd.SenderConn
+			mc.SetTTL(fwd.TTL)
+			err = mc.Message.VerifyBodyHash()
+			if err == nil && self.calls.reply(mc) {
+				continue
 			}
 			return
 		case proto.CMD_BYE:
 			err = io.EOF
+			bye, _ := proto.ParseBye(cmd.Params)
+			switch bye.Reason {
+			case proto.BYE_REVOKED:
+				err = ErrRevoked
+			case proto.BYE_SLOW_CONSUMER:
+				err = ErrSlowConsumer
+			}
 			return
 		default:
 			mc, err = self.processCommand(cmd)
@@ -185,54 +569,113 @@ func (self *clientConn) SetDigestChannel(digestChan chan<- *Digest) {
 	proc.digestChan = digestChan
 	proc.service = self.Service()
 	self.setCommandProcessor(proto.CMD_DIGEST, proc)
+	self.setCommandProcessor(proto.CMD_DIGEST_BATCH, proc)
+}
+
+func (self *clientConn) SetSettingsHandler(handler func(recommended *proto.Settings) *proto.Settings) {
+	proc := new(settingsProcessor)
+	proc.conn = self
+	proc.handler = handler
+	self.setCommandProcessor(proto.CMD_RECOMMEND_SETTING, proc)
+}
+
+func (self *clientConn) SetEditChannel(editChan chan<- *Edit) {
+	proc := new(editProcessor)
+	proc.editChan = editChan
+	proc.service = self.Service()
+	self.setCommandProcessor(proto.CMD_EDIT, proc)
+}
+
+func (self *clientConn) SetCheckpointHandler(handler func(seq uint64, done bool)) {
+	proc := new(checkpointProcessor)
+	proc.handler = handler
+	self.setCommandProcessor(proto.CMD_REPLAY_CHECKPOINT, proc)
+	var on int32
+	if handler != nil {
+		on = 1
+	}
+	atomic.StoreInt32(&self.checkpoints, on)
+}
+
+func (self *clientConn) SetQuotaHandler(handler func(reqId string, qerr *proto.QuotaError)) {
+	proc := new(quotaProcessor)
+	proc.handler = handler
+	self.setCommandProcessor(proto.CMD_QUOTA_EXCEEDED, proc)
 }
 
 func (self *clientConn) Config(digestThreshold, compressThreshold int, digestFields ...string) error {
-	self.digestThreshold = int32(digestThreshold)
-	self.compressThreshold = int32(compressThreshold)
-	cmd := new(proto.Command)
-	cmd.Type = proto.CMD_SETTING
-	cmd.Params = make([]string, 2, 2+len(digestFields))
-	cmd.Params[0] = fmt.Sprintf("%v", self.digestThreshold)
-	cmd.Params[1] = fmt.Sprintf("%v", self.compressThreshold)
-	for _, f := range digestFields {
-		cmd.Params = append(cmd.Params, f)
-	}
-	err := self.cmdio.WriteCommand(cmd, false)
+	atomic.StoreInt32(&self.digestThreshold, int32(digestThreshold))
+	atomic.StoreInt32(&self.compressThreshold, int32(compressThreshold))
+	setting := &proto.Setting{
+		DigestThreshold:   digestThreshold,
+		CompressThreshold: compressThreshold,
+		DigestFields:      digestFields,
+	}
+	err := self.cmdio.WriteCommand(setting.Command(), false)
 	return err
 }
 
-func (self *clientConn) RequestMessage(id string) error {
-	cmd := &proto.Command{
-		Type:   proto.CMD_MSG_RETRIEVE,
-		Params: []string{id},
-	}
-	return self.cmdio.WriteCommand(cmd, false)
+func (self *clientConn) AddDigestField(fields ...string) error {
+	return self.updateDigestFields(proto.DIGEST_FIELD_ADD, fields)
 }
 
-func (self *clientConn) SetVisibility(v bool) error {
-	cmd := &proto.Command{
-		Type: proto.CMD_SET_VISIBILITY,
+func (self *clientConn) RemoveDigestField(fields ...string) error {
+	return self.updateDigestFields(proto.DIGEST_FIELD_REMOVE, fields)
+}
+
+func (self *clientConn) updateDigestFields(op byte, fields []string) error {
+	// The first two parameters are the thresholds, which are left unchanged.
+	for len(fields) > 0 {
+		n := len(fields)
+		if n > proto.MaxRetrieveIds-2 {
+			n = proto.MaxRetrieveIds - 2
+		}
+		setting := &proto.Setting{
+			KeepDigestThreshold:   true,
+			KeepCompressThreshold: true,
+			DigestFields:          make([]string, 0, n),
+		}
+		for _, f := range fields[:n] {
+			setting.DigestFields = append(setting.DigestFields, string(op)+f)
+		}
+		err := self.cmdio.WriteCommand(setting.Command(), false)
+		if err != nil {
+			return err
+		}
+		fields = fields[n:]
 	}
-	if v {
-		cmd.Params = []string{"1"}
-	} else {
-		cmd.Params = []string{"0"}
+	return nil
+}
+
+func (self *clientConn) RequestMessage(ids ...string) error {
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > proto.MaxRetrieveIds {
+			n = proto.MaxRetrieveIds
+		}
+		req := &proto.Retrieve{Ids: ids[:n]}
+		err := self.cmdio.WriteCommand(req.Command(), false)
+		if err != nil {
+			return err
+		}
+		ids = ids[n:]
 	}
-	return self.cmdio.WriteCommand(cmd, false)
+	return nil
+}
+
+func (self *clientConn) SetVisibility(v bool) error {
+	vis := &proto.Visibility{Visible: v}
+	return self.cmdio.WriteCommand(vis.Command(), false)
+}
+
+func (self *clientConn) SetHeadersOnly(size int) error {
+	req := &proto.HeadersOnly{Size: size}
+	return self.cmdio.WriteCommand(req.Command(), false)
 }
 
 func (self *clientConn) subscribe(params map[string]string, sub bool) error {
-	cmd := new(proto.Command)
-	cmd.Type = proto.CMD_SUBSCRIPTION
-	if sub {
-		cmd.Params = []string{"1"}
-	} else {
-		cmd.Params = []string{"0"}
-	}
-	cmd.Message = new(proto.Message)
-	cmd.Message.Header = params
-	return self.cmdio.WriteCommand(cmd, false)
+	req := &proto.Subscription{Subscribe: sub}
+	return self.cmdio.WriteCommand(req.Command(params), false)
 }
 
 func (self *clientConn) Subscribe(params map[string]string) error {
@@ -243,23 +686,84 @@ func (self *clientConn) Unsubscribe(params map[string]string) error {
 	return self.subscribe(params, false)
 }
 
+func (self *clientConn) block(username, service string, block bool) error {
+	req := &proto.Block{Block: block, Username: username, Service: service}
+	return self.cmdio.WriteCommand(req.Command(), false)
+}
+
+func (self *clientConn) Block(username, service string) error {
+	return self.block(username, service, true)
+}
+
+func (self *clientConn) Unblock(username, service string) error {
+	return self.block(username, service, false)
+}
+
 func (self *clientConn) RequestAllCachedMessages(excludes ...string) error {
-	cmd := &proto.Command{}
-	cmd.Type = proto.CMD_REQ_ALL_CACHED
-	if len(excludes) > 0 {
-		msg := new(proto.Message)
-		data := make([]byte, 0, len(excludes)*90)
-		for _, i := range excludes {
-			data = append(data, []byte(i)...)
-			data = append(data, byte(0))
+	return self.ResumeCachedMessages(0, excludes...)
+}
+
+func (self *clientConn) ResumeCachedMessages(after uint64, excludes ...string) error {
+	// Old servers only understand the ids followed by '\0's, in one command.
+	if data, ok := proto.EncodeLegacyExcludes(excludes); ok {
+		return self.requestAllCached(data, false, false, after)
+	}
+	chunks, err := proto.EncodeExcludes(excludes)
+	if err != nil {
+		return err
+	}
+	for i, data := range chunks {
+		err = self.requestAllCached(data, true, i < len(chunks)-1, after)
+		if err != nil {
+			return err
 		}
-		msg.Body = data
-		cmd.Message = msg
 	}
-	return self.cmdio.WriteCommand(cmd, false)
+	return nil
+}
+
+func (self *clientConn) requestAllCached(excludes []byte, lengthPrefixed, more bool, after uint64) error {
+	req := &proto.AllCachedRequest{
+		// We understand CMD_DIGEST_BATCH.
+		DigestBatch:    true,
+		LengthPrefixed: lengthPrefixed,
+		More:           more,
+		Checkpoints:    atomic.LoadInt32(&self.checkpoints) > 0,
+		After:          after,
+	}
+	return self.cmdio.WriteCommand(req.Command(excludes), self.shouldCompress(len(excludes)))
+}
+
+func (self *clientConn) RequestMessagesBySeq(from, to uint64) error {
+	req := &proto.SeqRangeRequest{From: from, To: to, DigestBatch: true}
+	return self.cmdio.WriteCommand(req.Command(), false)
+}
+
+func (self *clientConn) RequestThread(threadId string) error {
+	if !self.HasCapability(proto.CAP_THREADS) {
+		return ErrNotSupported
+	}
+	req := &proto.ThreadRequest{ThreadId: threadId, DigestBatch: true}
+	return self.cmdio.WriteCommand(req.Command(), false)
+}
+
+func (self *clientConn) ack(id string, read bool) error {
+	ack := &proto.Ack{Id: id, Read: read}
+	return self.cmdio.WriteCommand(ack.Command(), false)
+}
+
+func (self *clientConn) Ack(id string) error {
+	return self.ack(id, false)
+}
+
+func (self *clientConn) MarkRead(id string) error {
+	return self.ack(id, true)
 }
 
 func NewConn(cmdio *proto.CommandIO, service, username string, conn net.Conn) Conn {
+	return newClientConn(cmdio, service, username, conn)
+}
+
+func newClientConn(cmdio *proto.CommandIO, service, username string, conn net.Conn) *clientConn {
 	ret := new(clientConn)
 	ret.conn = conn
 	ret.cmdio = cmdio
@@ -268,5 +772,6 @@ func NewConn(cmdio *proto.CommandIO, service, username string, conn net.Conn) Co
 	ret.connId = fmt.Sprintf("%x-%x", time.Now().UnixNano(), rand.Int63())
 
 	ret.cmdProcs = make([]CommandProcessor, proto.CMD_NR_CMDS)
+	ret.setCommandProcessor(proto.CMD_CAPS, &capsProcessor{conn: ret})
 	return ret
 }
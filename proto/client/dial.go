@@ -30,6 +30,43 @@ var ErrBadServiceOrUserName = errors.New("service name or user name should not c
 
 // The conn will be closed if any error occur
 func Dial(conn net.Conn, pubkey *rsa.PublicKey, service, username, token string, timeout time.Duration) (c Conn, err error) {
+	return DialWithDictionaries(conn, pubkey, service, username, token, timeout)
+}
+
+// DialWithDictionaries is like Dial, but it offers the compression
+// dictionaries to the server. The following commands are compressed
+// with the one chosen by the server, if any. A dictionary helps small
+// messages the most, so a lower compress threshold may be set with
+// Config().
+func DialWithDictionaries(conn net.Conn, pubkey *rsa.PublicKey, service, username, token string, timeout time.Duration, dicts ...*proto.Dictionary) (c Conn, err error) {
+	return DialWithOptions(conn, pubkey, service, username, token, timeout, &DialOptions{Dictionaries: dicts})
+}
+
+// DialOptions are negotiated with the server at handshake.
+type DialOptions struct {
+	// Dictionaries are offered to the server. See DialWithDictionaries.
+	Dictionaries []*proto.Dictionary
+
+	// Plaintext accepts the public messages in plaintext, and sends
+	// them so, if the server agrees. See proto.Message.Public.
+	Plaintext bool
+
+	// Capabilities are the features of the app advertised to the
+	// server, along with the ones of the client. See CMD_CAPS.
+	Capabilities []string
+
+	// Device is the id of the device. It should not change between
+	// connections: a service may reject a token from another device.
+	Device string
+}
+
+// DialWithOptions is like Dial, but it negotiates the options with
+// the server. A nil opts is the same as Dial.
+func DialWithOptions(conn net.Conn, pubkey *rsa.PublicKey, service, username, token string, timeout time.Duration, opts *DialOptions) (c Conn, err error) {
+	if opts == nil {
+		opts = new(DialOptions)
+	}
+	dicts := opts.Dictionaries
 	if strings.Contains(service, "\n") || strings.Contains(username, "\n") ||
 		strings.Contains(service, ":") || strings.Contains(username, ":") {
 		err = ErrBadServiceOrUserName
@@ -49,24 +86,62 @@ func Dial(conn net.Conn, pubkey *rsa.PublicKey, service, username, token string,
 	}
 	cmdio := ks.ClientCommandIO(conn)
 
-	cmd := new(proto.Command)
-	cmd.Type = proto.CMD_AUTH
-	cmd.Params = make([]string, 3)
-	cmd.Params[0] = service
-	cmd.Params[1] = username
-	cmd.Params[2] = token
+	auth := &proto.Auth{
+		Service:   service,
+		Username:  username,
+		Token:     token,
+		Plaintext: opts.Plaintext,
+		Caps:      append(append([]string{}, Capabilities...), opts.Capabilities...),
+		Device:    opts.Device,
+	}
+	for _, d := range dicts {
+		auth.Dictionaries = append(auth.Dictionaries, d.Id)
+	}
 
 	// don't compress, but encrypt it
-	cmdio.WriteCommand(cmd, false)
+	cmdio.WriteCommand(auth.Command(), false)
 
-	cmd, err = cmdio.ReadCommand()
+	cmd, err := cmdio.ReadCommand()
 	if err != nil {
 		return
 	}
 	if cmd.Type != proto.CMD_AUTHOK {
 		return
 	}
-	c = NewConn(cmdio, service, username, conn)
+	authok, err := proto.ParseAuthOK(cmd.Params)
+	if err != nil {
+		return
+	}
+	cc := newClientConn(cmdio, service, username, conn)
+	cc.connId = authok.ConnId
+	if len(authok.Dictionary) > 0 {
+		for _, d := range dicts {
+			if d.Id == authok.Dictionary {
+				cmdio.SetDictionary(d)
+				break
+			}
+		}
+		if cmdio.Dictionary() == nil {
+			err = proto.ErrNoDictionary
+			return
+		}
+	}
+	if authok.Plaintext {
+		if !opts.Plaintext {
+			err = proto.ErrBadPeerImpl
+			return
+		}
+		cmdio.SetPlaintext(true)
+	}
+	if authok.Caps {
+		var caps *proto.Caps
+		caps, err = readCaps(cmdio)
+		if err != nil {
+			return
+		}
+		cc.setCaps(caps)
+	}
+	c = cc
 	err = nil
 	return
 }
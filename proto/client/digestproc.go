@@ -18,49 +18,69 @@
 package client
 
 import (
-	"strconv"
-
 	"github.com/uniqush/uniqush-conn/proto"
 )
 
-type Digest struct {
-	MsgId         string
-	Sender        string
-	SenderService string
-	Size          int
-	Info          map[string]string
-}
+type Digest = proto.DigestEntry
 
 type digestProcessor struct {
 	digestChan chan<- *Digest
 	service    string
 }
 
-func (self *digestProcessor) ProcessCommand(cmd *proto.Command) (mc *proto.MessageContainer, err error) {
-	if cmd.Type != proto.CMD_DIGEST || self.digestChan == nil {
+func (self *digestProcessor) processBatch(cmd *proto.Command) (err error) {
+	if cmd.Message == nil {
+		err = proto.ErrBadPeerImpl
 		return
 	}
-	if len(cmd.Params) < 2 {
+	entries, err := proto.UnmarshalDigestBatch(cmd.Message.Body)
+	if err != nil {
 		err = proto.ErrBadPeerImpl
 		return
 	}
-	digest := new(Digest)
-	digest.Size, err = strconv.Atoi(cmd.Params[0])
+	for _, e := range entries {
+		if e == nil {
+			continue
+		}
+		digest := &Digest{
+			MsgId:    e.MsgId,
+			Sender:   e.Sender,
+			Size:     e.Size,
+			Seq:      e.Seq,
+			ThreadId: e.ThreadId,
+			Info:     e.Info,
+		}
+		if len(digest.Sender) > 0 {
+			digest.SenderService = e.SenderService
+			if len(digest.SenderService) == 0 {
+				digest.SenderService = self.service
+			}
+		}
+		self.digestChan <- digest
+	}
+	return
+}
+
+func (self *digestProcessor) ProcessCommand(cmd *proto.Command) (mc *proto.MessageContainer, err error) {
+	if self.digestChan == nil {
+		return
+	}
+	if cmd.Type == proto.CMD_DIGEST_BATCH {
+		err = self.processBatch(cmd)
+		return
+	}
+	if cmd.Type != proto.CMD_DIGEST {
+		return
+	}
+	digest, err := proto.ParseDigest(cmd.Params)
 	if err != nil {
-		err = proto.ErrBadPeerImpl
 		return
 	}
-	digest.MsgId = cmd.Params[1]
 	if cmd.Message != nil {
 		digest.Info = cmd.Message.Header
 	}
-	if len(cmd.Params) > 2 {
-		digest.Sender = cmd.Params[2]
-		if len(cmd.Params) > 3 {
-			digest.SenderService = cmd.Params[3]
-		} else {
-			digest.SenderService = self.service
-		}
+	if len(digest.Sender) > 0 && len(digest.SenderService) == 0 {
+		digest.SenderService = self.service
 	}
 	self.digestChan <- digest
 
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+// Edit tells that the sender has replaced a message forwarded to the
+// user, or recalled it.
+type Edit struct {
+	Sender        string
+	SenderService string
+
+	// Id is the id of the message in the cache of the user.
+	Id string
+
+	// Message is the new message. It is nil if the message is recalled.
+	Message *proto.Message
+}
+
+func (self *Edit) Recalled() bool {
+	return self.Message == nil
+}
+
+type editProcessor struct {
+	editChan chan<- *Edit
+	service  string
+}
+
+func (self *editProcessor) ProcessCommand(cmd *proto.Command) (mc *proto.MessageContainer, err error) {
+	if cmd == nil || cmd.Type != proto.CMD_EDIT || self.editChan == nil {
+		return
+	}
+	e, err := proto.ParseEdit(cmd.Params)
+	if err != nil {
+		return
+	}
+	edit := &Edit{
+		Sender:        e.Peer,
+		SenderService: e.PeerService,
+		Id:            e.Id,
+	}
+	if len(edit.SenderService) == 0 {
+		edit.SenderService = self.service
+	}
+	if !e.Recall {
+		if cmd.Message == nil {
+			err = proto.ErrBadPeerImpl
+			return
+		}
+		edit.Message = cmd.Message
+	}
+	self.editChan <- edit
+	return
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"strings"
+)
+
+// ForwardResult is the result of a request sent by RequestForward().
+type ForwardResult = proto.ForwardResult
+
+// multiForwardSep joins the request id of RequestMultiForward() and
+// a receiver into the id of the request sent to the receiver alone.
+const multiForwardSep = "/"
+
+// splitRequestId returns the request id returned to the app, and the
+// receiver if reqId is sent to one receiver of RequestMultiForward().
+func splitRequestId(reqId string) (id, receiver string) {
+	i := strings.Index(reqId, multiForwardSep)
+	if i < 0 {
+		return reqId, ""
+	}
+	return reqId[:i], reqId[i+len(multiForwardSep):]
+}
+
+type forwardResultProcessor struct {
+	resChan chan<- *ForwardResult
+
+	// done, if not nil, is called with every result before it is
+	// sent to resChan. See Outbox.
+	done func(res *ForwardResult)
+}
+
+func (self *forwardResultProcessor) ProcessCommand(cmd *proto.Command) (mc *proto.MessageContainer, err error) {
+	if cmd == nil || cmd.Type != proto.CMD_FWD_RESULT || (self.resChan == nil && self.done == nil) {
+		return
+	}
+	res, err := proto.ParseForwardResult(cmd.Params)
+	if err != nil {
+		return
+	}
+	if len(res.Receiver) == 0 {
+		res.RequestId, res.Receiver = splitRequestId(res.RequestId)
+	}
+	if self.done != nil {
+		self.done(res)
+	}
+	if self.resChan != nil {
+		self.resChan <- res
+	}
+	return
+}
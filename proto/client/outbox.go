@@ -0,0 +1,251 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+var ErrOutboxFull = errors.New("too many messages in the outbox")
+
+// OutgoingMessage is a message queued in an Outbox.
+type OutgoingMessage struct {
+	Service  string
+	Receiver string
+	Message  *proto.Message
+	TTL      time.Duration
+
+	// Key is the idempotency key of the forward request.
+	Key      string
+	QueuedAt time.Time
+
+	// The connection the request was last written to, and its id.
+	conn  Conn
+	reqId string
+}
+
+// Outbox keeps the messages sent to other users until the server tells
+// their results, so that the messages composed while the client is
+// disconnected are sent once it is connected again. Each message is
+// forwarded with an idempotency key: a request which may have been lost
+// with a connection is sent again with the same key, and the server
+// drops it if the first one got through, telling proto.FWD_DUPLICATE.
+// A message is sent with what is left of its TTL; the ones which
+// expire in the outbox are dropped with proto.FWD_EXPIRED instead.
+// It is goroutine-safe.
+type Outbox struct {
+	lock    sync.Mutex
+	conn    Conn
+	pending []*OutgoingMessage
+	max     int
+	resChan chan<- *ForwardResult
+	prefix  string
+	nextKey uint64
+}
+
+// NewOutbox() creates an outbox holding at most max messages, or any
+// number of them if max <= 0. The forward results of the connections
+// are sent to resChan, if not nil. The results of the messages of the
+// outbox carry their keys as the request ids.
+func NewOutbox(max int, resChan chan<- *ForwardResult) *Outbox {
+	var b [8]byte
+	rand.Read(b[:])
+	return &Outbox{
+		max:     max,
+		resChan: resChan,
+		prefix:  hex.EncodeToString(b[:]) + "-",
+	}
+}
+
+// SetConn() sends the pending messages to the connection, in the
+// order they were queued, and the later ones right away. It replaces
+// the forward result channel of the connection. A nil connection
+// queues the messages until the next one is set. The connection
+// should be set again once it is lost.
+func (self *Outbox) SetConn(conn Conn) error {
+	var cc *clientConn
+	if conn != nil {
+		var ok bool
+		if cc, ok = conn.(*clientConn); !ok {
+			return ErrNotSupported
+		}
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.conn = nil
+	if cc == nil {
+		return nil
+	}
+	proc := new(forwardResultProcessor)
+	proc.resChan = self.resChan
+	proc.done = func(res *ForwardResult) {
+		self.done(conn, res)
+	}
+	cc.setCommandProcessor(proto.CMD_FWD_RESULT, proc)
+	self.conn = conn
+	self.expire(time.Now())
+	for _, m := range self.pending {
+		if err := self.write(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore() queues the messages kept from an earlier outbox, e.g. the
+// ones returned by Pending() and persisted when the app was stopped,
+// with their keys and times, so that the server tells the duplicates
+// of those which got through. They are sent if there is a connection.
+// The limit of the outbox does not apply to them.
+func (self *Outbox) Restore(msgs []*OutgoingMessage) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, m := range msgs {
+		m := *m
+		m.conn = nil
+		m.reqId = ""
+		self.pending = append(self.pending, &m)
+	}
+	if self.conn == nil {
+		return nil
+	}
+	self.expire(time.Now())
+	for _, m := range self.pending {
+		if m.conn == self.conn {
+			continue
+		}
+		if err := self.write(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send() queues the message, and forwards it if there is a connection.
+// It returns the idempotency key of the request. The message is kept
+// if it cannot be written, until the next connection is set.
+func (self *Outbox) Send(service, receiver string, msg *proto.Message, ttl time.Duration) (key string, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.expire(time.Now())
+	if self.max > 0 && len(self.pending) >= self.max {
+		err = ErrOutboxFull
+		return
+	}
+	self.nextKey++
+	key = self.prefix + strconv.FormatUint(self.nextKey, 16)
+	m := &OutgoingMessage{
+		Service:  service,
+		Receiver: receiver,
+		Message:  msg,
+		TTL:      ttl,
+		Key:      key,
+		QueuedAt: time.Now(),
+	}
+	self.pending = append(self.pending, m)
+	if self.conn != nil {
+		self.write(m)
+	}
+	return
+}
+
+// ttlLeft returns what is left of the TTL of the message, or 0 if it
+// never expires.
+func (self *OutgoingMessage) ttlLeft(now time.Time) (ttl time.Duration, expired bool) {
+	if self.TTL <= 0 {
+		return
+	}
+	ttl = self.TTL - now.Sub(self.QueuedAt)
+	expired = ttl <= 0
+	return
+}
+
+// expire is called with the lock held. It drops the expired messages
+// and sends their results in the background, so that the caller
+// does not wait for the reader of the channel.
+func (self *Outbox) expire(now time.Time) {
+	var results []*ForwardResult
+	kept := self.pending[:0]
+	for _, m := range self.pending {
+		if _, expired := m.ttlLeft(now); expired {
+			results = append(results, &ForwardResult{RequestId: m.Key, Status: proto.FWD_EXPIRED})
+			continue
+		}
+		kept = append(kept, m)
+	}
+	for i := len(kept); i < len(self.pending); i++ {
+		self.pending[i] = nil
+	}
+	self.pending = kept
+	if len(results) == 0 || self.resChan == nil {
+		return
+	}
+	go func(resChan chan<- *ForwardResult) {
+		for _, res := range results {
+			resChan <- res
+		}
+	}(self.resChan)
+}
+
+// Pending() returns the messages whose results are unknown. They
+// may be given to Restore() later.
+func (self *Outbox) Pending() []*OutgoingMessage {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]*OutgoingMessage(nil), self.pending...)
+}
+
+// write is called with the lock held. The connection is dropped if
+// the request cannot be written.
+func (self *Outbox) write(m *OutgoingMessage) error {
+	ttl, expired := m.ttlLeft(time.Now())
+	if expired {
+		// It has just expired; it is dropped by the next expire().
+		return nil
+	}
+	reqId, err := self.conn.RequestIdempotentForward(m.Service, m.Receiver, m.Message, ttl, m.Key)
+	if err != nil {
+		self.conn = nil
+		return err
+	}
+	m.conn = self.conn
+	m.reqId = reqId
+	return nil
+}
+
+// done removes the message of the result, and sets the request id of
+// the result to the key of the message.
+func (self *Outbox) done(conn Conn, res *ForwardResult) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i, m := range self.pending {
+		if m.conn != conn || m.reqId != res.RequestId {
+			continue
+		}
+		self.pending = append(self.pending[:i], self.pending[i+1:]...)
+		res.RequestId = m.Key
+		return
+	}
+}
@@ -0,0 +1,39 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+type quotaProcessor struct {
+	handler func(reqId string, qerr *proto.QuotaError)
+}
+
+func (self *quotaProcessor) ProcessCommand(cmd *proto.Command) (mc *proto.MessageContainer, err error) {
+	if cmd == nil || cmd.Type != proto.CMD_QUOTA_EXCEEDED || self.handler == nil {
+		return
+	}
+	reqId, qerr, err := proto.ParseQuotaError(cmd.Params)
+	if err != nil {
+		return
+	}
+	reqId, _ = splitRequestId(reqId)
+	self.handler(reqId, qerr)
+	return
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+var ErrCallTimeout = errors.New("no reply to the call in time")
+var ErrNotCall = errors.New("the message is not a call")
+
+// CallError is returned by Call() if the call failed. Status is the
+// status of the forward request, see proto.FWD_*, if the server did
+// not forward the call, or empty if the callee replied an error.
+type CallError struct {
+	Status string
+	Reason string
+}
+
+func (self *CallError) Error() string {
+	if len(self.Status) > 0 {
+		return "call not forwarded: " + self.Status
+	}
+	return "call failed: " + self.Reason
+}
+
+type callResult struct {
+	mc  *proto.MessageContainer
+	err error
+}
+
+// pendingCall is a call waiting for the reply of its callee. The
+// username is empty if the callee is the server.
+type pendingCall struct {
+	ch       chan *callResult
+	service  string
+	username string
+}
+
+// repliedBy tells if the message comes from the callee.
+func (self *pendingCall) repliedBy(mc *proto.MessageContainer) bool {
+	if len(self.username) == 0 {
+		return mc.FromServer()
+	}
+	return mc.Sender == self.username && mc.SenderService == self.service
+}
+
+// callTable keeps the calls waiting for their replies, by their ids,
+// and the ids of the calls by their forward requests.
+type callTable struct {
+	lock  sync.Mutex
+	calls map[string]*pendingCall
+	reqs  map[string]string
+}
+
+// add adds the call to the user, or to the server if username is
+// empty. reqId is empty if the call is not forwarded.
+func (self *callTable) add(id, reqId, service, username string) <-chan *callResult {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.calls == nil {
+		self.calls = make(map[string]*pendingCall, 4)
+		self.reqs = make(map[string]string, 4)
+	}
+	ch := make(chan *callResult, 1)
+	self.calls[id] = &pendingCall{ch: ch, service: service, username: username}
+	if len(reqId) > 0 {
+		self.reqs[reqId] = id
+	}
+	return ch
+}
+
+func (self *callTable) remove(id, reqId string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.calls, id)
+	delete(self.reqs, reqId)
+}
+
+// done ends the call, and tells if there was such a call. If from is
+// not nil, the call only ends if it is the reply of the callee.
+func (self *callTable) done(id string, from *proto.MessageContainer, res *callResult) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	call, ok := self.calls[id]
+	if !ok || (from != nil && !call.repliedBy(from)) {
+		return false
+	}
+	delete(self.calls, id)
+	call.ch <- res
+	return true
+}
+
+// forwarded ends the call if the server did not forward it. It tells
+// if the request is the one of a call.
+func (self *callTable) forwarded(res *ForwardResult) bool {
+	self.lock.Lock()
+	id, ok := self.reqs[res.RequestId]
+	delete(self.reqs, res.RequestId)
+	self.lock.Unlock()
+	if !ok {
+		return false
+	}
+	switch res.Status {
+	case proto.FWD_OK, proto.FWD_DUPLICATE:
+	default:
+		self.done(id, nil, &callResult{err: &CallError{Status: res.Status}})
+	}
+	return true
+}
+
+// reply ends the call of the reply, and tells if it did. A reply to
+// no call, e.g. one which came after the timeout, or from another
+// user than the callee, is told to the app as any other message.
+func (self *callTable) reply(mc *proto.MessageContainer) bool {
+	if mc.Message == nil || len(mc.Message.Header) == 0 {
+		return false
+	}
+	id, ok := mc.Message.Header[proto.ReplyHeader]
+	if !ok {
+		return false
+	}
+	res := &callResult{mc: mc}
+	if reason, ok := mc.Message.Header[proto.CallErrorHeader]; ok {
+		res.err = &CallError{Reason: reason}
+	}
+	return self.done(id, mc, res)
+}
+
+func withHeader(msg *proto.Message, kv ...string) *proto.Message {
+	ret := new(proto.Message)
+	if msg != nil {
+		*ret = *msg
+	}
+	ret.Header = make(map[string]string, len(ret.Header)+len(kv)/2)
+	if msg != nil {
+		for k, v := range msg.Header {
+			ret.Header[k] = v
+		}
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		ret.Header[kv[i]] = kv[i+1]
+	}
+	return ret
+}
+
+func (self *clientConn) newCallId() string {
+	return self.ConnId() + "." + self.newRequestId()
+}
+
+// wait waits for the reply of the call until timeout.
+func (self *clientConn) wait(id, reqId string, ch <-chan *callResult, timeout time.Duration) (reply *proto.MessageContainer, err error) {
+	defer self.calls.remove(id, reqId)
+	select {
+	case res := <-ch:
+		return res.mc, res.err
+	case <-time.After(timeout):
+		err = ErrCallTimeout
+	}
+	return
+}
+
+func (self *clientConn) Call(service, receiver string, msg *proto.Message, timeout time.Duration) (reply *proto.MessageContainer, err error) {
+	id := self.newCallId()
+	call := withHeader(msg, proto.CallHeader, id)
+	// It is not worth caching.
+	call.Ephemeral = self.HasCapability(proto.CAP_EPHEMERAL)
+	reqId := self.newRequestId()
+	callee := service
+	if len(callee) == 0 {
+		callee = self.Service()
+	}
+	ch := self.calls.add(id, reqId, callee, receiver)
+	req := &proto.ForwardRequest{
+		Receiver:      receiver,
+		RequestId:     reqId,
+		StickyReplies: self.HasCapability(proto.CAP_STICKY_REPLIES),
+	}
+	err = self.writeForwardCommand(service, req, call)
+	if err != nil {
+		self.calls.remove(id, reqId)
+		return
+	}
+	return self.wait(id, reqId, ch, timeout)
+}
+
+func (self *clientConn) CallServer(msg *proto.Message, timeout time.Duration) (reply *proto.MessageContainer, err error) {
+	id := self.newCallId()
+	ch := self.calls.add(id, "", "", "")
+	err = self.SendMessageToServer(withHeader(msg, proto.CallHeader, id))
+	if err != nil {
+		self.calls.remove(id, "")
+		return
+	}
+	return self.wait(id, "", ch, timeout)
+}
+
+func (self *clientConn) Respond(call *proto.MessageContainer, reply *proto.Message, callErr error) error {
+	id := call.Message.CallId()
+	if len(id) == 0 {
+		return ErrNotCall
+	}
+	kv := []string{proto.ReplyHeader, id}
+	if callErr != nil {
+		kv = append(kv, proto.CallErrorHeader, callErr.Error())
+	}
+	msg := withHeader(reply, kv...)
+	if call.FromServer() {
+		return self.SendMessageToServer(msg)
+	}
+	msg.Ephemeral = self.HasCapability(proto.CAP_EPHEMERAL)
+	req := &proto.ForwardRequest{
+		Receiver: call.Sender,
+		ReplyTo:  call.SenderConn,
+	}
+	return self.writeForwardCommand(call.SenderService, req, msg)
+}
@@ -18,8 +18,10 @@
 package proto
 
 import (
+	"bytes"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
 	"math/big"
 	weakrand "math/rand"
@@ -28,11 +30,36 @@ import (
 const (
 	cmdflag_COMPRESS = 1 << iota
 	cmdflag_NEEDACK
+
+	// Compressed with the dictionary of the connection, instead of snappy.
+	cmdflag_DICT
+)
+
+// Everything after the flag is sent in plaintext, still authenticated
+// by the HMAC. It is the most significant bit, above the padding.
+const cmdflag_PLAINTEXT = 0x80
+
+// Flags of the message carried in the reserved bits of a command.
+const (
+	msgflag_OPAQUE = 1 << iota
+
+	// The message carries binary headers after its string headers.
+	msgflag_BINARY_HEADER
+
+	// The message is public. See Message.Public.
+	msgflag_PUBLIC
+
+	// The message is ephemeral. See Message.Ephemeral.
+	msgflag_EPHEMERAL
 )
 
 const (
 	// Params:
 	// 0. [optional] The Id of the message
+	// 1. [optional] The sequence number of the message
+	// 2. [optional] How long the message lives, in seconds from now.
+	//    It is relative so that the peers need not agree on the
+	//    time. Empty if it never expires.
 	CMD_DATA = iota
 
 	// Params:
@@ -44,9 +71,32 @@ const (
 	// Params
 	// 0. service name
 	// 1. username
+	// 2. token
+	// 3. [optional] Comma separated ids of the compression
+	//    dictionaries known by the client
+	// 4. [optional] "1" if the client accepts public messages
+	//    in plaintext. See Message.Public.
+	// 5. [optional] Comma separated features of the client, as in
+	//    CMD_CAPS. A client sending any understands CMD_CAPS.
+	// 6. [optional] The id of the device, to which a service may
+	//    bind the token.
 	CMD_AUTH
 
+	// Sent from server.
+	//
+	// Params:
+	//   0. [optional] The id of the connection
+	//   1. [optional] The id of the dictionary used by both peers
+	//      to compress the following commands. Empty if there is none.
+	//   2. [optional] "1" if both peers send public messages in plaintext
+	//   3. [optional] "1" if a CMD_CAPS with the features of the
+	//      server follows. Only sent to the clients understanding it.
 	CMD_AUTHOK
+
+	// Sent from both sides before closing the connection.
+	//
+	// Params:
+	//   0. [optional] The reason. Only sent from server, e.g. BYE_REVOKED
 	CMD_BYE
 
 	// Sent from client.
@@ -55,7 +105,9 @@ const (
 	// Params:
 	// 0. Digest threshold: -1 always send message directly; Empty: not change
 	// 1. Compression threshold: -1 always compress the data; Empty: not change
-	// >2. [optional] Digest fields
+	// >2. [optional] Digest fields. A field prefixed with '+' is added
+	//    to the current fields and one prefixed with '-' is removed
+	//    from them. Plain fields replace the current fields.
 	CMD_SETTING
 
 	// Sent from server.
@@ -67,6 +119,8 @@ const (
 	// 1. The id of the message
 	// 2. [optional] sender's username
 	// 3. [optional] sender's service
+	// 4. [optional] The sequence number of the message
+	// 5. [optional] The thread of the message. See Message.ThreadId.
 	//
 	// Message.Header:
 	// Other digest info
@@ -76,8 +130,11 @@ const (
 	// Telling the server which cached
 	// message it wants to retrieve.
 	//
+	// The messages are sent back in the same order.
+	//
 	// Params:
 	// 0. The message id
+	// >1. [optional] Ids of more messages
 	CMD_MSG_RETRIEVE
 
 	// Sent from client.
@@ -89,6 +146,35 @@ const (
 	// 1. Receiver's name
 	// 2. [optional] Receiver's service name.
 	//    If empty, then same service as the client
+	// 3. [optional] Request id chosen by the client.
+	//    If given, the server tells the result of
+	//    the request with a CMD_FWD_RESULT.
+	// 4. [optional] Idempotency key chosen by the client.
+	//    Requests with the same key from the same user
+	//    are forwarded only once within a while.
+	// 5. [optional] More receivers in the same service,
+	//    separated by "\n" which no username contains. The
+	//    server tells a CMD_FWD_RESULT for each receiver, and
+	//    the key of each receiver is the key, "\n" and its
+	//    name. Only sent to the servers advertising
+	//    CAP_MULTI_FORWARD.
+	// 6. [optional] When to deliver the message, in seconds since
+	//    the Unix epoch. The server keeps it until then, and tells
+	//    FWD_SCHEDULED. Only sent to the servers advertising
+	//    CAP_SCHEDULED_FORWARD.
+	// 7. [optional] "1" asks the replies of the receivers to be
+	//    routed to this connection only, rather than to all the
+	//    connections of the sender. The receivers are told the id
+	//    of the connection in CMD_FWD.
+	// 8. [optional] The id of the receiver's connection to which
+	//    the message is a reply. Only this connection is written
+	//    to, if it sent this connection a message with 7. Otherwise
+	//    all the connections of the receiver are. Both are only
+	//    sent to the servers advertising CAP_STICKY_REPLIES.
+	// 9. [optional] How long to wait before delivering the message,
+	//    in seconds from when the server reads the request. Sent
+	//    along with 6, which servers ignore when it is given: the
+	//    clock of the client may be wrong.
 	CMD_FWD_REQ
 
 	// Sent from server.
@@ -100,6 +186,10 @@ const (
 	// 1. [optional] Sender's service name.
 	//    If empty, then same service as the client
 	// 2. [optional] The Id of the message in the cache.
+	// 3. [optional] The sequence number of the message
+	// 4. [optional] The id of the sender's connection to which
+	//    the replies should be routed. See CMD_FWD_REQ.
+	// 5. [optional] How long the message lives, as in CMD_DATA.
 	CMD_FWD
 
 	// Sent from client.
@@ -148,24 +238,331 @@ const (
 	// all message digests are guaranteed to be received by the client. (The definition
 	// of "good connection" may be vary. Normally it means cheap and stable
 	// network, like home wifi.)
+	//
+	// Params:
+	// 0. [optional] "1" (as ASCII character) means the client
+	//    accepts CMD_DIGEST_BATCH.
+	// 1. [optional] "2" (EXCLUDES_LENGTH_PREFIXED) means the ids in
+	//    the body are each prefixed by its length, as an uvarint.
+	// 2. [optional] "1" (EXCLUDES_MORE) means more ids follow in the
+	//    next CMD_REQ_ALL_CACHED. The server sends the messages after
+	//    the last one.
+	// 3. [optional] "1" means the client accepts CMD_REPLAY_CHECKPOINT.
+	// 4. [optional] Only the messages whose sequence numbers are larger
+	//    than it are sent, to resume a replay after a checkpoint.
+	//
+	// Message.Body:
+	// [optional] Ids of the messages to exclude, each followed by a '\0',
+	// or length-prefixed.
 	CMD_REQ_ALL_CACHED
 
+	// Sent from client.
+	//
+	// Ask the server to re-send the cached messages whose
+	// sequence numbers are within a range.
+	// Like CMD_REQ_ALL_CACHED, a digest will be sent
+	// instead if the message is too large.
+	//
+	// Params:
+	// 0. The first sequence number (inclusive)
+	// 1. [optional] The last sequence number (inclusive).
+	//    If empty, then all messages after the first one.
+	// 2. [optional] "1" (as ASCII character) means the client
+	//    accepts CMD_DIGEST_BATCH.
+	CMD_REQ_SEQ_RANGE
+
+	// Sent from client.
+	//
+	// Acknowledge the receipt of a message.
+	//
+	// Params:
+	// 0. The Id of the message
+	// 1. [optional] "1" (as ASCII character) means the message
+	//    has been read by the user.
+	CMD_ACK
+
+	// Sent from server.
+	//
+	// The digests of several cached messages, sent instead of
+	// one CMD_DIGEST per message when the client asked for
+	// cached messages and accepts batches.
+	//
+	// Message.Body:
+	// A JSON array of DigestEntry
+	CMD_DIGEST_BATCH
+
+	// Sent from client.
+	//
+	// Updates the block list of the user. Forward requests
+	// from blocked senders will be dropped by the server.
+	//
+	// Params:
+	//   0. "1" means block; "0" means unblock. No change on others.
+	//   1. The username of the sender
+	//   2. The service of the sender. Empty means the user's own service.
+	CMD_BLOCK
+
+	// Sent from server.
+	// Telling the client the result of a CMD_FWD_REQ
+	// which carries a request id.
+	//
+	// Params:
+	// 0. The request id
+	// 1. The status. One of FWD_*
+	// 2. [optional] The Id of the message in the receiver's cache.
+	// 3. [optional] With FWD_INVALID, the invalid header. See ValidationError.
+	// 4. [optional] With FWD_INVALID, why the message is invalid.
+	// 5. [optional] The receiver, if the request has several.
+	CMD_FWD_RESULT
+
+	// Sent from server.
+	// Recommending the settings of the client. The client may
+	// accept them by sending a CMD_SETTING, or ignore them.
+	//
+	// Params:
+	//   0. Digest threshold
+	//   1. Compression threshold
+	//   2. [optional] Ping interval, e.g. "30s"
+	CMD_RECOMMEND_SETTING
+
+	// Sent from client.
+	// Asking the server to strip the bodies of the messages
+	// pushed to the client if they are larger than a size.
+	// The stripped messages carry their sizes in BodySizeHeader,
+	// and could be retrieved with CMD_MSG_RETRIEVE. Messages
+	// without ids are always sent with their bodies.
+	//
+	// Params:
+	//   0. The size in bytes. -1 turns the mode off.
+	CMD_SET_HEADERS_ONLY
+
+	// Sent from server.
+	// Telling the client that a message cannot be sent because
+	// it exceeds a quota. See QuotaError.
+	//
+	// Params:
+	//   0. The request id of the CMD_FWD_REQ, if there is one.
+	//   1. The scope. One of QUOTA_SCOPE_*
+	//   2. The resource. One of QUOTA_*
+	//   3. The limit
+	//   4. When the usage is reset, in seconds since the epoch
+	CMD_QUOTA_EXCEEDED
+
+	// Sent from server.
+	// Telling the client how far a replay of the cached messages
+	// asked by CMD_REQ_ALL_CACHED has gone. It is sent every few
+	// messages, and after the last one. If the connection drops, the
+	// client may resume the replay after the checkpoint.
+	//
+	// Params:
+	//   0. The sequence number up to which every cached message has
+	//      been sent, or excluded.
+	//   1. "1" if the replay is done.
+	CMD_REPLAY_CHECKPOINT
+
+	// Sent from both sides.
+	// Telling the peer about the optional features it supports. The
+	// server sends it right after CMD_AUTHOK, the client tells its
+	// features in CMD_AUTH. Both may send it again later to replace
+	// them. Older peers never send it, and it should not be sent to
+	// them: they support none.
+	//
+	// Params:
+	//   0. Comma separated features. One of CAP_*, or any other
+	//      feature the apps agree on.
+	CMD_CAPS
+
+	// Sent from both sides.
+	// Editing or recalling a message forwarded earlier. A client
+	// sends it to change a message it has forwarded, and the server
+	// sends it to the connected receivers of the message. Only sent
+	// to the peers advertising CAP_EDIT. The server sends it even if
+	// the message is no longer cached, so a client should only apply
+	// it to a message from the same sender.
+	//
+	// Params:
+	//   0. The receiver's name if sent from client, the sender's
+	//      name if sent from server
+	//   1. [optional] The service of that user. If empty, then
+	//      same service as the client
+	//   2. The Id of the message in the receiver's cache, as told
+	//      by CMD_FWD_RESULT
+	//   3. [optional] "1" if the message is recalled
+	//   4. [optional] Sent from client. Request id chosen by the
+	//      client. If given, the server tells the result of the
+	//      request with a CMD_FWD_RESULT.
+	//
+	// Message:
+	// The new message. None if the message is recalled.
+	CMD_EDIT
+
+	// Sent from client.
+	//
+	// Ask the server to re-send the cached messages of a thread, see
+	// Message.ThreadId, ordered by their sequence numbers. Like
+	// CMD_REQ_ALL_CACHED, a digest will be sent instead if the message
+	// is too large. Only sent to the servers advertising CAP_THREADS.
+	//
+	// Params:
+	// 0. The thread id
+	// 1. [optional] "1" (as ASCII character) means the client
+	//    accepts CMD_DIGEST_BATCH.
+	CMD_REQ_THREAD
+
+	// Sent from both sides.
+	// The server sends the latest version of a configuration asset,
+	// e.g. feature flags or an emoji pack, and the client tells the
+	// version it has applied. Only sent to the peers advertising
+	// CAP_ASSETS.
+	//
+	// Params:
+	//   0. The name of the asset
+	//   1. The version of the asset. Versions of the same asset only
+	//      increase.
+	//
+	// Message:
+	// Sent from server. The body is the content of the asset. The
+	// client sends no message.
+	CMD_ASSET
+
 	CMD_NR_CMDS
 )
 
+// The status of a forward request carried by CMD_FWD_RESULT.
+const (
+	FWD_OK               = "ok"
+	FWD_BLOCKED          = "blocked"
+	FWD_REJECTED         = "rejected"
+	FWD_UNKNOWN_RECEIVER = "unknown-receiver"
+	FWD_FAILED           = "failed"
+
+	// The request has the same idempotency key as an earlier one.
+	// The message has not been forwarded again.
+	FWD_DUPLICATE = "duplicate"
+
+	// The request exceeds a quota. It is followed by a
+	// CMD_QUOTA_EXCEEDED telling which one.
+	FWD_QUOTA_EXCEEDED = "quota-exceeded"
+
+	// The message is rejected by the validator of the receiver's
+	// service. The result tells which header is invalid and why.
+	FWD_INVALID = "invalid"
+
+	// The message will be delivered at the time asked for. The id is
+	// the one of the scheduled message rather than in the cache.
+	FWD_SCHEDULED = "scheduled"
+
+	// The message to edit or recall is no longer cached. The
+	// connected receivers are told anyway.
+	FWD_NOT_FOUND = "not-found"
+
+	// The message expired in the outbox of the client before it could
+	// be sent. It is never told by the server. See client.Outbox.
+	FWD_EXPIRED = "expired"
+
+	// The transformer of the receiver's service dropped the message.
+	// It is neither cached nor delivered.
+	FWD_DROPPED = "dropped"
+
+	// The message is not cached, and none of the connections of the
+	// receiver could buffer it within its memory limit. It is not
+	// delivered. See server.MemoryLimit.
+	FWD_MEMORY_LIMIT = "memory-limit"
+)
+
+// The reason of a CMD_BYE when the connection is revoked by the
+// server. The client should not reconnect with the same token.
+const BYE_REVOKED = "revoked"
+
+// The reason of a CMD_BYE when the client cannot keep up with the
+// messages written to it. The client may reconnect, and retrieve the
+// cached messages at its own pace.
+const BYE_SLOW_CONSUMER = "slow-consumer"
+
+// The optional features advertised in CMD_CAPS.
+const (
+	CAP_ACK          = "ack"
+	CAP_DIGEST_BATCH = "digest-batch"
+	CAP_CHECKPOINTS  = "checkpoints"
+	CAP_SEQ_RANGE    = "seq-range"
+	CAP_HEADERS_ONLY = "headers-only"
+
+	// The server accepts several receivers in a CMD_FWD_REQ.
+	CAP_MULTI_FORWARD = "multi-forward"
+
+	// The server delivers the forwarded messages at the time asked for.
+	CAP_SCHEDULED_FORWARD = "scheduled-forward"
+
+	// The server never caches the ephemeral messages. See
+	// Message.Ephemeral.
+	CAP_EPHEMERAL = "ephemeral"
+
+	// The peer understands CMD_EDIT.
+	CAP_EDIT = "edit"
+
+	// The server understands CMD_REQ_THREAD.
+	CAP_THREADS = "threads"
+
+	// The server routes the replies to the connection asking for
+	// them. See CMD_FWD_REQ.
+	CAP_STICKY_REPLIES = "sticky-replies"
+
+	// The peer understands CMD_ASSET.
+	CAP_ASSETS = "assets"
+
+	// Neither the server nor the client of this tree sends messages
+	// in chunks or compresses them with zstd yet. The names are
+	// reserved so that the peers which do agree on them.
+	CAP_CHUNKING = "chunking"
+	CAP_ZSTD     = "zstd"
+)
+
+// The prefixes of a digest field in CMD_SETTING which add the field
+// to, or remove it from, the current digest fields.
+const (
+	DIGEST_FIELD_ADD    = '+'
+	DIGEST_FIELD_REMOVE = '-'
+)
+
 type Command struct {
 	Type    uint8
 	Params  []string
 	Message *Message
 }
 
+var cmdNames = [CMD_NR_CMDS]string{
+	"DATA", "EMPTY", "AUTH", "AUTHOK", "BYE", "SETTING", "DIGEST",
+	"MSG_RETRIEVE", "FWD_REQ", "FWD", "SET_VISIBILITY", "SUBSCRIPTION",
+	"REQ_ALL_CACHED", "REQ_SEQ_RANGE", "ACK", "DIGEST_BATCH", "BLOCK",
+	"FWD_RESULT", "RECOMMEND_SETTING", "SET_HEADERS_ONLY", "QUOTA_EXCEEDED",
+	"REPLAY_CHECKPOINT", "CAPS", "EDIT", "REQ_THREAD", "ASSET",
+}
+
+// String() dumps the whole command. It is meant for debugging.
+func (self *Command) String() string {
+	name := fmt.Sprintf("CMD(%v)", self.Type)
+	if int(self.Type) < len(cmdNames) {
+		name = cmdNames[self.Type]
+	}
+	str := fmt.Sprintf("%v %q", name, self.Params)
+	if self.Message != nil {
+		str += fmt.Sprintf(" header=%v", self.Message.Header)
+		if len(self.Message.BinaryHeader) > 0 {
+			str += fmt.Sprintf(" binaryHeader=%q", self.Message.BinaryHeader)
+		}
+		str += fmt.Sprintf(" body=%q", self.Message.Body)
+	}
+	return str
+}
+
 const (
-	maxNrParams  = 16
+	maxNrParams  = 15
 	maxNrHeaders = 0x0000FFFF
 )
 
-var ErrTooManyParams = errors.New("Too many parameters: 16 max")
+var ErrTooManyParams = errors.New("Too many parameters: 15 max")
 var ErrTooManyHeaders = errors.New("Too many headers: 4096 max")
+var ErrBinaryHeaderTooLarge = errors.New("Binary header value too large: 4GB max")
 
 func randomBytes(N int) []byte {
 	n, err := rand.Int(rand.Reader, big.NewInt(int64(N)))
@@ -180,11 +577,9 @@ func randomBytes(N int) []byte {
 }
 
 func (self *Command) Randomize() {
-	if self.Type == CMD_AUTH || self.Type == CMD_AUTHOK ||
-		self.Type == CMD_BYE || self.Type == CMD_MSG_RETRIEVE ||
+	if self.Type == CMD_AUTH ||
 		self.Type == CMD_SET_VISIBILITY ||
-		self.Type == CMD_SUBSCRIPTION ||
-		self.Type == CMD_REQ_ALL_CACHED {
+		self.Type == CMD_SUBSCRIPTION {
 
 		// For these types, we can safely append random parameters.
 		self.appendRandomParams()
@@ -243,37 +638,86 @@ func (self *Command) appendRandomParams() {
 	return
 }
 
-// | Type | NrParams | Reserved | NrHeaders | Params | Header | Body |
+// | Type | NrParams | MsgFlags | NrHeaders | Params | Header | BinaryHeader | Body |
 //
 // Type: 8 bit
 // NrParams: 4 bit
-// Reserved: 4 bit
+// MsgFlags: 4 bit. Least significant bit: opaque message. Second bit: binary headers.
+// Third bit: public message. Fourth bit: ephemeral message.
 // NrHeaders: 16 bit Byte order: MSB | LSB. i.e. big endian
 // Params: list of strings. each string ends with \0. (ACII 0)
 // Header: list of string pairs. each string ends with \0. (ACII 0)
+// BinaryHeader: only with the binary header flag. 16 bit number of headers,
+// big endian, then each key ending with \0, the 32 bit big endian length
+// of its value and the value.
 func (self *Command) Marshal() (data []byte, err error) {
 	if self == nil {
 		return
 	}
-	nrParams := len(self.Params)
 	nrHeaders := 0
-	if nrParams > maxNrParams {
-		err = ErrTooManyParams
+	var flags byte
+	if self.Message != nil {
+		nrHeaders = nrWireHeaders(self.Message)
+		flags, err = messageFlags(self.Message)
+		if err != nil {
+			return
+		}
+	}
+	data, err = self.marshalHead(nrHeaders, flags)
+	if err != nil || self.Message == nil {
 		return
 	}
-	if self.Message != nil {
-		nrHeaders = len(self.Message.Header)
-		if nrHeaders > maxNrHeaders {
-			err = ErrTooManyHeaders
+	data = appendMessage(data, self.Message)
+	return
+}
+
+// messageFlags() returns the flags of the message put in the head
+// of the command.
+func messageFlags(msg *Message) (flags byte, err error) {
+	if msg.Opaque {
+		flags |= msgflag_OPAQUE
+	}
+	if msg.Public {
+		flags |= msgflag_PUBLIC
+	}
+	if msg.Ephemeral {
+		flags |= msgflag_EPHEMERAL
+	}
+	if len(msg.BinaryHeader) == 0 {
+		return
+	}
+	if len(msg.BinaryHeader) > maxNrHeaders {
+		err = ErrTooManyHeaders
+		return
+	}
+	for _, v := range msg.BinaryHeader {
+		if uint64(len(v)) > 0xFFFFFFFF {
+			err = ErrBinaryHeaderTooLarge
 			return
 		}
 	}
+	flags |= msgflag_BINARY_HEADER
+	return
+}
+
+// marshalHead() encodes everything before the header of the message.
+func (self *Command) marshalHead(nrHeaders int, flags byte) (data []byte, err error) {
+	nrParams := len(self.Params)
+	if nrParams > maxNrParams {
+		err = ErrTooManyParams
+		return
+	}
+	if nrHeaders > maxNrHeaders {
+		err = ErrTooManyHeaders
+		return
+	}
 
 	data = make([]byte, 4, 1024)
 	data[0] = byte(self.Type)
 
 	data[1] = byte(0x0000000F & nrParams)
 	data[1] = data[1] << 4
+	data[1] |= flags & 0x0F
 
 	data[2] = byte((0xFF00 & uint16(nrHeaders)) >> 8)
 	data[3] = byte(0x00FF & uint16(nrHeaders))
@@ -282,21 +726,56 @@ func (self *Command) Marshal() (data []byte, err error) {
 		data = append(data, []byte(param)...)
 		data = append(data, byte(0))
 	}
-	if self.Message == nil {
-		return
+	return
+}
+
+// nrWireHeaders() is the number of headers sent, including the one
+// carrying the thread.
+func nrWireHeaders(msg *Message) int {
+	n := len(msg.Header)
+	if len(msg.ThreadId) > 0 {
+		if _, ok := msg.Header[ThreadHeader]; !ok {
+			n++
+		}
 	}
+	return n
+}
 
-	for k, v := range self.Message.Header {
-		data = append(data, []byte(k)...)
-		data = append(data, byte(0))
-		data = append(data, []byte(v)...)
-		data = append(data, byte(0))
+func appendHeader(data []byte, k, v string) []byte {
+	data = append(data, []byte(k)...)
+	data = append(data, byte(0))
+	data = append(data, []byte(v)...)
+	data = append(data, byte(0))
+	return data
+}
+
+func appendMessage(data []byte, msg *Message) []byte {
+	for k, v := range msg.Header {
+		if k == ThreadHeader && len(msg.ThreadId) > 0 {
+			continue
+		}
+		data = appendHeader(data, k, v)
+	}
+	if len(msg.ThreadId) > 0 {
+		data = appendHeader(data, ThreadHeader, msg.ThreadId)
+	}
+
+	if len(msg.BinaryHeader) > 0 {
+		n := len(msg.BinaryHeader)
+		data = append(data, byte(n>>8), byte(n))
+		for k, v := range msg.BinaryHeader {
+			data = append(data, []byte(k)...)
+			data = append(data, byte(0))
+			n = len(v)
+			data = append(data, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+			data = append(data, v...)
+		}
 	}
 
-	if len(self.Message.Body) > 0 {
-		data = append(data, self.Message.Body...)
+	if len(msg.Body) > 0 {
+		data = append(data, msg.Body...)
 	}
-	return
+	return data
 }
 
 func (self *Command) eq(cmd *Command) bool {
@@ -320,14 +799,7 @@ func (self *Command) eq(cmd *Command) bool {
 var ErrMalformedCommand = errors.New("malformed command")
 
 func cutString(data []byte) (str, rest []byte, err error) {
-	var idx int
-	var d byte
-	idx = -1
-	for idx, d = range data {
-		if d == 0 {
-			break
-		}
-	}
+	idx := bytes.IndexByte(data, 0)
 	if idx < 0 {
 		err = ErrMalformedCommand
 		return
@@ -337,13 +809,59 @@ func cutString(data []byte) (str, rest []byte, err error) {
 	return
 }
 
+// sizeHint bounds the capacity allocated for n entries, each of which
+// takes at least minLen bytes of data, so that a forged count costs
+// no more memory than the data.
+func sizeHint(n int, data []byte, minLen int) int {
+	if max := len(data) / minLen; n > max {
+		return max
+	}
+	return n
+}
+
+// cutBinaryHeader() decodes the binary headers at the beginning of data.
+// The values refer to data without being copied.
+func cutBinaryHeader(data []byte) (header map[string][]byte, rest []byte, err error) {
+	if len(data) < 2 {
+		err = ErrMalformedCommand
+		return
+	}
+	nrHeaders := int((uint16(data[0]) << 8) | (uint16(data[1])))
+	data = data[2:]
+	// The key, its terminator and the length.
+	header = make(map[string][]byte, sizeHint(nrHeaders, data, 5))
+	var key []byte
+	for i := 0; i < nrHeaders; i++ {
+		key, data, err = cutString(data)
+		if err != nil {
+			return
+		}
+		if len(data) < 4 {
+			err = ErrMalformedCommand
+			return
+		}
+		n := uint64(data[0])<<24 | uint64(data[1])<<16 | uint64(data[2])<<8 | uint64(data[3])
+		data = data[4:]
+		if uint64(len(data)) < n {
+			err = ErrMalformedCommand
+			return
+		}
+		header[string(key)] = data[:n:n]
+		data = data[n:]
+	}
+	rest = data
+	return
+}
+
 func UnmarshalCommand(data []byte) (cmd *Command, err error) {
 	if len(data) < 4 {
+		err = ErrMalformedCommand
 		return
 	}
 	cmd = new(Command)
 	cmd.Type = data[0]
 	nrParams := int(data[1] >> 4)
+	msgFlags := data[1] & 0x0F
 	nrHeaders := int((uint16(data[2]) << 8) | (uint16(data[3])))
 
 	data = data[4:]
@@ -362,7 +880,8 @@ func UnmarshalCommand(data []byte) (cmd *Command, err error) {
 	msg = nil
 	if nrHeaders > 0 {
 		msg = new(Message)
-		msg.Header = make(map[string]string, nrHeaders)
+		// The key and the value, with their terminators.
+		msg.Header = make(map[string]string, sizeHint(nrHeaders, data, 2))
 		var key []byte
 		var value []byte
 		for i := 0; i < nrHeaders; i++ {
@@ -376,6 +895,19 @@ func UnmarshalCommand(data []byte) (cmd *Command, err error) {
 			}
 			msg.Header[string(key)] = string(value)
 		}
+		if thread, ok := msg.Header[ThreadHeader]; ok {
+			msg.ThreadId = thread
+			delete(msg.Header, ThreadHeader)
+		}
+	}
+	if msgFlags&msgflag_BINARY_HEADER != 0 {
+		if msg == nil {
+			msg = new(Message)
+		}
+		msg.BinaryHeader, data, err = cutBinaryHeader(data)
+		if err != nil {
+			return
+		}
 	}
 	if len(data) > 0 {
 		if msg == nil {
@@ -383,6 +915,24 @@ func UnmarshalCommand(data []byte) (cmd *Command, err error) {
 		}
 		msg.Body = data
 	}
+	if msgFlags&msgflag_OPAQUE != 0 {
+		if msg == nil {
+			msg = new(Message)
+		}
+		msg.Opaque = true
+	}
+	if msgFlags&msgflag_PUBLIC != 0 {
+		if msg == nil {
+			msg = new(Message)
+		}
+		msg.Public = true
+	}
+	if msgFlags&msgflag_EPHEMERAL != 0 {
+		if msg == nil {
+			msg = new(Message)
+		}
+		msg.Ephemeral = true
+	}
 	if msg != nil {
 		cmd.Message = msg
 	}
@@ -19,26 +19,161 @@ package proto
 
 import (
 	"code.google.com/p/snappy-go/snappy"
-	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
-	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/throttle"
 	"hash"
 	"io"
 	"sync"
+	"sync/atomic"
 )
 
+var ErrCommandTooLarge = errors.New("command too large")
+
+// The length of a command on the wire is 16-bit.
+const maxCommandLen = 0xFFFF
+
 type CommandIO struct {
+	// Accessed atomically. Keep them at the beginning
+	// to be 64-bit aligned.
+	nrCompressed    int64
+	rawBytes        int64
+	compressedBytes int64
+
 	writeAuth   hash.Hash
 	cryptWriter io.Writer
 	readAuth    hash.Hash
 	cryptReader io.Reader
 	conn        io.ReadWriter
 
+	// Kept to export the state of the connection on a handoff.
+	provider     CryptoProvider
+	keys         [4][]byte
+	writeStream  *countingStream
+	readStream   *countingStream
+	interruption *interruptibleReader
+
+	// Like cryptWriter and cryptReader, but without encryption.
+	plainWriter io.Writer
+	plainReader io.Reader
+
+	// Public messages are written, and may be read, in plaintext.
+	plaintext bool
+
 	writeLock *sync.Mutex
+	logger    logger.Logger
+
+	// Protected by writeLock.
+	throttles []*throttle.Bucket
+
+	// The dictionary negotiated at handshake. Nil if there is none.
+	dict *Dictionary
+
+	// Keep the message read in the pooled buffer.
+	zeroCopy bool
+
+	// Scratch space of the reads, so that reading a command does not
+	// allocate anything kept between two commands.
+	lenBuf [2]byte
+	macBuf []byte
+
+	// The length of the longest command read. 0 means no limit.
+	maxReadLen int
+}
+
+// SetPlaintext() writes the commands carrying public messages in
+// plaintext, and lets such commands be read. They are authenticated
+// as the others. The peers agree on it at handshake; a command in
+// plaintext read without it is treated as corrupted. It should be
+// called before any concurrent read or write.
+func (self *CommandIO) SetPlaintext(on bool) {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	self.plaintext = on
+}
+
+// SetZeroCopy() keeps the messages read afterwards in the pooled
+// buffers the commands are read into. The body and the binary headers
+// of a message read then are slices of the buffer, without being
+// copied out of it, and the message should be released by
+// Message.Release() once it is not used. Messages which are not
+// released are collected as usual, at the cost of the pool.
+// It should be called before any read.
+func (self *CommandIO) SetZeroCopy(on bool) {
+	self.zeroCopy = on
+}
+
+// SetMaxReadLength() fails the reads of the commands longer than n
+// bytes on the wire with ErrCommandTooLarge, without reading them.
+// 0 means no limit. It should be called before any read.
+func (self *CommandIO) SetMaxReadLength(n int) {
+	self.maxReadLen = n
+}
+
+// SetDictionary() compresses the commands written afterwards with
+// the dictionary, and lets the commands compressed with it be read.
+// It should be called before any concurrent read or write.
+func (self *CommandIO) SetDictionary(dict *Dictionary) {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	self.dict = dict
+}
+
+func (self *CommandIO) Dictionary() *Dictionary {
+	return self.dict
+}
+
+// CompressionStats counts the commands written compressed, and their
+// sizes before and after the compression.
+type CompressionStats struct {
+	NrCommands      int64 `json:"nrCommands"`
+	RawBytes        int64 `json:"rawBytes"`
+	CompressedBytes int64 `json:"compressedBytes"`
+}
+
+// Ratio is the size after the compression over the size before. It is
+// 0 if nothing is compressed.
+func (self *CompressionStats) Ratio() float64 {
+	if self.RawBytes <= 0 {
+		return 0
+	}
+	return float64(self.CompressedBytes) / float64(self.RawBytes)
+}
+
+// CompressionStats() returns the compression of the commands written
+// so far.
+func (self *CommandIO) CompressionStats() *CompressionStats {
+	return &CompressionStats{
+		NrCommands:      atomic.LoadInt64(&self.nrCompressed),
+		RawBytes:        atomic.LoadInt64(&self.rawBytes),
+		CompressedBytes: atomic.LoadInt64(&self.compressedBytes),
+	}
+}
+
+func (self *CommandIO) recordCompression(raw, compressed int) {
+	atomic.AddInt64(&self.nrCompressed, 1)
+	atomic.AddInt64(&self.rawBytes, int64(raw))
+	atomic.AddInt64(&self.compressedBytes, int64(compressed))
 }
 
+// SetThrottle() limits the bandwidth of the writes. Every write waits
+// for all of the buckets.
+func (self *CommandIO) SetThrottle(buckets ...*throttle.Bucket) {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	self.throttles = buckets
+}
+
+// SetLogger() should be called before any read or write.
+func (self *CommandIO) SetLogger(l logger.Logger) {
+	self.logger = logger.OrNop(l)
+}
+
+// writeThenHmac() always encrypts the flag, which is the first byte.
+// The rest is encrypted unless the flag says it is in plaintext.
 func (self *CommandIO) writeThenHmac(data []byte) (mac []byte, err error) {
 	writer := self.cryptWriter
 	self.writeAuth.Reset()
@@ -48,6 +183,14 @@ func (self *CommandIO) writeThenHmac(data []byte) (mac []byte, err error) {
 	if err != nil {
 		return
 	}
+	if len(data) > 0 && data[0]&cmdflag_PLAINTEXT != 0 {
+		err = writen(writer, data[:1])
+		if err != nil {
+			return
+		}
+		writer = self.plainWriter
+		data = data[1:]
+	}
 	err = writen(writer, data)
 	if err != nil {
 		return
@@ -66,11 +209,27 @@ func (self *CommandIO) readThenHmac(data []byte) (mac []byte, err error) {
 	if err != nil {
 		return
 	}
-	n, err := io.ReadFull(reader, data)
+	rest := data
+	if len(data) > 0 {
+		// The flag tells how the rest is sent.
+		_, err = io.ReadFull(reader, data[:1])
+		if err != nil {
+			return
+		}
+		if data[0]&cmdflag_PLAINTEXT != 0 {
+			if !self.plaintext {
+				err = ErrCorruptedData
+				return
+			}
+			reader = self.plainReader
+		}
+		rest = data[1:]
+	}
+	n, err := io.ReadFull(reader, rest)
 	if err != nil {
 		return
 	}
-	if n != len(data) {
+	if n != len(rest) {
 		err = io.EOF
 		return
 	}
@@ -89,7 +248,10 @@ func (self *CommandIO) readAndCmpHmac(mac []byte) error {
 	if len(mac) == 0 {
 		return nil
 	}
-	macRecved := make([]byte, self.readAuth.Size())
+	if len(self.macBuf) != self.readAuth.Size() {
+		self.macBuf = make([]byte, self.readAuth.Size())
+	}
+	macRecved := self.macBuf
 	n, err := io.ReadFull(self.conn, macRecved)
 	if err != nil {
 		return err
@@ -103,25 +265,82 @@ func (self *CommandIO) readAndCmpHmac(mac []byte) error {
 	return nil
 }
 
-func (self *CommandIO) decodeCommand(data []byte) (cmd *Command, err error) {
+// decodeCommand() decodes the command in data. If buf is not nil, data
+// is a slice of it, and the buffers are released unless the message
+// of the command refers to one of them.
+func (self *CommandIO) decodeCommand(data []byte, buf *pooledBuffer) (cmd *Command, err error) {
+	var held *pooledBuffer
+	defer func() {
+		if held != buf {
+			buf.release()
+		}
+	}()
 	// Flag: 8 bit
 	// Most significant 5 bits: number of bytes of padding
 	// Least significant bit: compress bit
+	// Third least significant bit: compressed with the dictionary
+	// Most significant bit: sent in plaintext
+	if len(data) == 0 {
+		err = ErrMalformedCommand
+		return
+	}
 	compress := ((data[0] & cmdflag_COMPRESS) != 0)
+	withDict := ((data[0] & cmdflag_DICT) != 0)
 	var npadding int
-	npadding = int(data[0] >> 3)
+	npadding = int((data[0] >> 3) & 0x0F)
+	if 1+npadding > len(data) {
+		err = ErrMalformedCommand
+		return
+	}
 	data = data[1 : len(data)-npadding]
 	decoded := data
-	if compress {
-		decoded, err = snappy.Decode(nil, data)
+	if compress && withDict {
+		if self.dict == nil {
+			err = ErrNoDictionary
+			return
+		}
+		runCPU(CPU_COMPRESSION, func() {
+			decoded, err = self.dict.decompress(data)
+		})
+		if err != nil {
+			return
+		}
+	} else if compress {
+		// A snappy block starts with its decoded length. Check it
+		// before the decoder allocates that much.
+		if n, l := binary.Uvarint(data); l > 0 && n > maxDecompressedLen {
+			err = ErrTooLarge
+			return
+		}
+		var dst []byte
+		var out *pooledBuffer
+		if buf != nil {
+			out = getBuffer()
+			dst = out.data
+		}
+		runCPU(CPU_COMPRESSION, func() {
+			decoded, err = snappy.Decode(dst, data)
+		})
+		if err != nil || !out.holds(decoded) {
+			out.release()
+			out = nil
+		}
 		if err != nil {
 			return
 		}
+		// The compressed data is not needed any more.
+		buf.release()
+		buf = out
 	}
 	cmd, err = UnmarshalCommand(decoded)
 	if err != nil {
 		return
 	}
+	if buf.holds(decoded) && cmd != nil && cmd.Message != nil &&
+		(len(cmd.Message.Body) > 0 || len(cmd.Message.BinaryHeader) > 0) {
+		cmd.Message.buf = buf
+		held = buf
+	}
 	return
 }
 
@@ -132,16 +351,36 @@ func (self *CommandIO) encodeCommand(cmd *Command, compress bool) (data []byte,
 	}
 
 	data = bsonEncoded
+	var flag byte
+	if compress && self.dict != nil {
+		runCPU(CPU_COMPRESSION, func() {
+			data, err = self.dict.compress(bsonEncoded)
+		})
+		flag = cmdflag_COMPRESS | cmdflag_DICT
+	} else if compress {
+		runCPU(CPU_COMPRESSION, func() {
+			data, err = snappy.Encode(nil, bsonEncoded)
+		})
+		flag = cmdflag_COMPRESS
+	}
+	if err != nil {
+		return
+	}
 	if compress {
-		data, err = snappy.Encode(nil, bsonEncoded)
-		if err != nil {
-			return
-		}
+		self.recordCompression(len(bsonEncoded), len(data))
 	}
-	var flag byte
+	data = addFlagAndPadding(data, flag)
+	return
+}
+
+func compressFlag(compress bool) byte {
 	if compress {
-		flag |= cmdflag_COMPRESS
+		return cmdflag_COMPRESS
 	}
+	return 0
+}
+
+func addFlagAndPadding(data []byte, flag byte) []byte {
 	// one byte flag
 	nrBlk := (len(data) + blkLen) / blkLen
 	npadding := (nrBlk * blkLen) - (len(data) + 1)
@@ -152,7 +391,7 @@ func (self *CommandIO) encodeCommand(cmd *Command, compress bool) (data []byte,
 	data[0] = flag
 
 	data = append(data, make([]byte, npadding)...)
-	return
+	return data
 }
 
 // WriteCommand() is goroutine-safe. i.e. Multiple goroutine could write concurrently.
@@ -161,6 +400,32 @@ func (self *CommandIO) WriteCommand(cmd *Command, compress bool) error {
 	if err != nil {
 		return err
 	}
+	return self.writeEncoded(cmd, data, compress)
+}
+
+// WriteSharedCommand() writes the command with the payload, which is
+// shared with other connections, in place of its message.
+// It is goroutine-safe.
+func (self *CommandIO) WriteSharedCommand(cmd *Command, payload *Payload, compress bool) error {
+	data, err := cmd.marshalWithPayload(payload, compress)
+	if err != nil {
+		return err
+	}
+	if compress {
+		// The block starts with the length of the data before.
+		if raw, n := binary.Uvarint(data); n > 0 {
+			self.recordCompression(int(raw), len(data))
+		}
+	}
+	return self.writeEncoded(cmd, addFlagAndPadding(data, compressFlag(compress)), compress)
+}
+
+// writeEncoded never logs the command itself: its parameters and
+// message may carry user data.
+func (self *CommandIO) writeEncoded(cmd *Command, data []byte, compress bool) error {
+	if len(data) > maxCommandLen {
+		return ErrCommandTooLarge
+	}
 	var cmdLen uint16
 	cmdLen = uint16(len(data))
 	if cmdLen == 0 {
@@ -168,7 +433,17 @@ func (self *CommandIO) WriteCommand(cmd *Command, compress bool) error {
 	}
 	self.writeLock.Lock()
 	defer self.writeLock.Unlock()
-	err = binary.Write(self.conn, binary.LittleEndian, cmdLen)
+	if self.plaintext && cmd.Message != nil && cmd.Message.Public {
+		data[0] |= cmdflag_PLAINTEXT
+	}
+	if len(self.throttles) > 0 {
+		// The length, the data and the MAC
+		n := 2 + len(data) + self.writeAuth.Size()
+		for _, b := range self.throttles {
+			b.Wait(n)
+		}
+	}
+	err := binary.Write(self.conn, binary.LittleEndian, cmdLen)
 	if err != nil {
 		return err
 	}
@@ -180,62 +455,110 @@ func (self *CommandIO) WriteCommand(cmd *Command, compress bool) error {
 	if err != nil {
 		return err
 	}
+	self.logger.Debug("command written", "cmd", cmd.Type, "nrParams", len(cmd.Params), "len", cmdLen, "compress", compress)
 	return nil
 }
 
 // ReadCommand() is not goroutine-safe.
+// It fails with ErrInterrupted once Interrupt() is called, after
+// reading the command it has started to read, if any.
 func (self *CommandIO) ReadCommand() (cmd *Command, err error) {
-	var cmdLen uint16
-	err = binary.Read(self.conn, binary.LittleEndian, &cmdLen)
+	if r := self.interruption; r != nil {
+		if r.isInterrupted() {
+			err = ErrInterrupted
+			return
+		}
+		r.started = false
+	}
+	_, err = io.ReadFull(self.conn, self.lenBuf[:])
 	if err != nil {
 		return
 	}
+	cmdLen := binary.LittleEndian.Uint16(self.lenBuf[:])
+	if self.maxReadLen > 0 && int(cmdLen) > self.maxReadLen {
+		err = ErrCommandTooLarge
+		return
+	}
 
-	data := make([]byte, int(cmdLen))
+	// The command is always read into a pooled buffer: an idle
+	// connection blocked on the next read does not pin one.
+	buf := getBuffer()
+	data := buf.data[:int(cmdLen)]
 	mac, err := self.readThenHmac(data)
+	if err == nil {
+		err = self.readAndCmpHmac(mac)
+	}
 	if err != nil {
+		buf.release()
+		if err == ErrCorruptedData {
+			self.logger.Warn("corrupted command", "len", cmdLen)
+		}
 		return
 	}
-	err = self.readAndCmpHmac(mac)
+	cmd, err = self.decodeCommand(data, buf)
 	if err != nil {
+		self.logger.Warn("cannot decode command", "len", cmdLen, "err", err)
 		return
 	}
-	cmd, err = self.decodeCommand(data)
+	if !self.zeroCopy && cmd.Message != nil {
+		cmd.Message.detach()
+	}
+	self.logger.Debug("command read", "cmd", cmd.Type, "nrParams", len(cmd.Params), "len", cmdLen)
 	return
 }
 
 func NewCommandIO(writeKey, writeAuthKey, readKey, readAuthKey []byte, conn io.ReadWriter) *CommandIO {
+	return newCommandIO(currentCryptoProvider(), writeKey, writeAuthKey, readKey, readAuthKey, conn)
+}
+
+func newCommandIO(provider CryptoProvider, writeKey, writeAuthKey, readKey, readAuthKey []byte, conn io.ReadWriter) *CommandIO {
+	return newCommandIOAt(provider, writeKey, writeAuthKey, readKey, readAuthKey, conn, 0, 0)
+}
+
+// newCommandIOAt() starts the key streams after the bytes already
+// written and read with the keys.
+func newCommandIOAt(provider CryptoProvider, writeKey, writeAuthKey, readKey, readAuthKey []byte, conn io.ReadWriter, nrWritten, nrRead uint64) *CommandIO {
 	ret := new(CommandIO)
-	ret.writeAuth = hmac.New(sha256.New, writeAuthKey)
-	ret.readAuth = hmac.New(sha256.New, readAuthKey)
+	ret.provider = provider
+	ret.keys = [4][]byte{copyBytes(writeKey), copyBytes(writeAuthKey), copyBytes(readKey), copyBytes(readAuthKey)}
+	ret.writeAuth = hmac.New(provider.NewHash, writeAuthKey)
+	ret.readAuth = hmac.New(provider.NewHash, readAuthKey)
 	ret.conn = conn
+	if dc, ok := conn.(deadlineReadWriter); ok {
+		// Let a handoff stop the reads between two commands.
+		ret.interruption = &interruptibleReader{conn: dc}
+		ret.conn = &struct {
+			io.Reader
+			io.Writer
+		}{ret.interruption, conn}
+	}
 	ret.writeLock = new(sync.Mutex)
+	ret.logger = logger.Nop()
 
-	writeBlkCipher, _ := aes.NewCipher(writeKey)
-	readBlkCipher, _ := aes.NewCipher(readKey)
+	writeBlkCipher, _ := provider.NewBlockCipher(writeKey)
+	readBlkCipher, _ := provider.NewBlockCipher(readKey)
 
 	// IV: 0 for all. Since we change keys for each connection, letting IV=0 won't hurt.
-	writeIV := make([]byte, writeBlkCipher.BlockSize())
-	readIV := make([]byte, readBlkCipher.BlockSize())
-
-	writeStream := cipher.NewCTR(writeBlkCipher, writeIV)
-	readStream := cipher.NewCTR(readBlkCipher, readIV)
+	ret.writeStream = newCountingCTR(writeBlkCipher, nrWritten)
+	ret.readStream = newCountingCTR(readBlkCipher, nrRead)
 
 	// Then for each encrypted bit,
 	// it will be written to both the connection and the hmac
 	// We use encrypt-then-hmac scheme.
-	mwriter := io.MultiWriter(conn, ret.writeAuth)
+	mwriter := io.MultiWriter(ret.conn, ret.writeAuth)
 	swriter := new(cipher.StreamWriter)
-	swriter.S = writeStream
+	swriter.S = ret.writeStream
 	swriter.W = mwriter
 	ret.cryptWriter = swriter
+	ret.plainWriter = mwriter
 
 	// Similarly, for each bit read from the connection,
 	// it will be written to the hmac as well.
-	tee := io.TeeReader(conn, ret.readAuth)
+	tee := io.TeeReader(ret.conn, ret.readAuth)
 	sreader := new(cipher.StreamReader)
-	sreader.S = readStream
+	sreader.S = ret.readStream
 	sreader.R = tee
 	ret.cryptReader = sreader
+	ret.plainReader = tee
 	return ret
 }
@@ -23,8 +23,12 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/throttle"
 	"io"
+	"strings"
 	"testing"
+	"time"
 )
 
 type opBetweenWriteAndRead interface {
@@ -244,3 +248,179 @@ func BenchmarkExchangingMultiFullCommandOverNetwork(b *testing.B) {
 	}
 	<-done
 }
+
+func TestCommandLogHidesContent(t *testing.T) {
+	io1, io2, _, _ := getBufferCommandIOs(t)
+	logbuf := new(bytes.Buffer)
+	io1.SetLogger(logger.NewWriterLogger(logbuf, logger.LEVEL_DEBUG))
+	io2.SetLogger(logger.NewWriterLogger(logbuf, logger.LEVEL_DEBUG))
+	cmd := &Command{Type: CMD_DATA, Params: []string{"secret-param"}}
+	cmd.Message = &Message{Header: map[string]string{"k": "secret-header"}, Body: []byte("secret-body")}
+	err := io1.WriteCommand(cmd, false)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	_, err = io2.ReadCommand()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	log := logbuf.String()
+	if !strings.Contains(log, "command written") || !strings.Contains(log, "command read") {
+		t.Errorf("commands are not logged: %v", log)
+	}
+	if strings.Contains(log, "secret") {
+		t.Errorf("command content is logged: %v", log)
+	}
+}
+
+func TestThrottledWrite(t *testing.T) {
+	io1, io2, _, _ := getBufferCommandIOs(t)
+	cmd := &Command{Type: CMD_DATA}
+	cmd.Message = &Message{Body: make([]byte, 1000)}
+	// The burst covers the first two commands.
+	io1.SetThrottle(throttle.NewBucket(2000), nil)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		err := io1.WriteCommand(cmd, false)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		_, err = io2.ReadCommand()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if d := time.Since(start); d < 700*time.Millisecond {
+		t.Errorf("4000 bytes at 2000B/s took %v", d)
+	}
+}
+
+func TestCompressionStats(t *testing.T) {
+	io1, io2, _, _ := getBufferCommandIOs(t)
+	cmd := &Command{Type: CMD_DATA}
+	cmd.Message = &Message{Body: make([]byte, 1000)}
+	for _, compress := range []bool{true, false, true} {
+		if err := io1.WriteCommand(cmd, compress); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if _, err := io2.ReadCommand(); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	stats := io1.CompressionStats()
+	if stats.NrCommands != 2 || stats.RawBytes <= 2000 || stats.CompressedBytes <= 0 || stats.Ratio() <= 0 {
+		t.Errorf("bad stats: %+v", stats)
+	}
+	if stats := io2.CompressionStats(); stats.NrCommands != 0 || stats.Ratio() != 0 {
+		t.Errorf("bad stats: %+v", stats)
+	}
+}
+
+func TestZeroCopyRead(t *testing.T) {
+	w, r, _, _ := getBufferCommandIOs(t)
+	r.SetZeroCopy(true)
+	for _, compress := range []bool{false, true} {
+		cmd := &Command{Type: CMD_DATA, Params: []string{"id"}}
+		cmd.Message = &Message{
+			Header:       map[string]string{"title": "hello"},
+			BinaryHeader: map[string][]byte{"proto": []byte{0, 1, 0}},
+			Body:         bytes.Repeat([]byte("zero copy "), 64),
+		}
+		empty := &Command{Type: CMD_SETTING, Params: []string{"1"}}
+		for _, c := range []*Command{cmd, empty} {
+			if err := w.WriteCommand(c, compress); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+		}
+		recved, err := r.ReadCommand()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !cmd.eq(recved) {
+			t.Errorf("%v is not %v", recved, cmd)
+		}
+		msg := recved.Message
+		cp := msg.Copy()
+		// A compressed message is held only if it is decompressed
+		// into the pooled buffer.
+		held := msg.buf != nil
+		if !held && !compress {
+			t.Errorf("the message should be in a pooled buffer")
+		}
+		if cp.buf != nil {
+			t.Errorf("the copy should not share the buffer")
+		}
+		msg.Release()
+		msg.Release()
+		if held && (msg.buf != nil || msg.Body != nil || msg.BinaryHeader != nil) {
+			t.Errorf("the message is not released: %v", msg)
+		}
+		if !cmd.Message.Eq(cp) {
+			t.Errorf("the copy is changed by the release: %v", cp)
+		}
+
+		recved, err = r.ReadCommand()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !empty.eq(recved) || recved.Message != nil {
+			t.Errorf("%v is not %v", recved, empty)
+		}
+	}
+}
+
+func TestPlaintextCommand(t *testing.T) {
+	body := []byte("public broadcast")
+	cmd := &Command{Type: CMD_DATA, Params: []string{"id"}}
+	cmd.Message = &Message{Body: body, Public: true}
+
+	w, r, buf, _ := getBufferCommandIOs(t)
+	w.SetPlaintext(true)
+	r.SetPlaintext(true)
+	if err := w.WriteCommand(cmd, false); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.Contains(buf.Bytes(), body) {
+		t.Errorf("the public message is encrypted")
+	}
+	recved, err := r.ReadCommand()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !cmd.eq(recved) || !recved.Message.Public {
+		t.Errorf("%v is not %v", recved, cmd)
+	}
+
+	// Other messages are still encrypted.
+	private := &Command{Type: CMD_DATA, Params: []string{"id"}, Message: &Message{Body: body}}
+	if err := w.WriteCommand(private, false); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if bytes.Contains(buf.Bytes(), body) {
+		t.Errorf("the private message is in plaintext")
+	}
+	if recved, err = r.ReadCommand(); err != nil || !private.eq(recved) {
+		t.Errorf("bad command: %v %v", recved, err)
+	}
+
+	// The plaintext is still authenticated.
+	if err := w.WriteCommand(cmd, false); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data := buf.Bytes()
+	idx := bytes.Index(data, body)
+	data[idx] ^= 0xFF
+	if _, err = r.ReadCommand(); err != ErrCorruptedData {
+		t.Errorf("tampered command should be rejected: %v", err)
+	}
+
+	// A peer which has not agreed rejects the plaintext.
+	w, r, _, _ = getBufferCommandIOs(t)
+	w.SetPlaintext(true)
+	if err := w.WriteCommand(cmd, false); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = r.ReadCommand(); err != ErrCorruptedData {
+		t.Errorf("plaintext should be rejected: %v", err)
+	}
+}
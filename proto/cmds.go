@@ -0,0 +1,1063 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The typed commands below build and parse the parameters of every
+// command type, so that the clients and the server agree on them. See
+// the CMD_* constants for the parameters.
+//
+// The parsers only fail with ErrBadPeerImpl, or ErrNoChange.
+
+// ErrNoChange tells that a command asks for no change, e.g. a
+// CMD_SET_VISIBILITY which is neither "0" nor "1". It should be
+// ignored, as newer peers may send values unknown to older ones.
+var ErrNoChange = errors.New("the command changes nothing")
+
+// DefaultForwardTTL is the TTL of the forward requests whose TTL
+// cannot be parsed.
+const DefaultForwardTTL = 72 * time.Hour
+
+func formatSeq(seq uint64) string {
+	if seq == 0 {
+		return ""
+	}
+	return strconv.FormatUint(seq, 10)
+}
+
+func parseSeq(str string) (seq uint64, err error) {
+	if len(str) == 0 {
+		return
+	}
+	seq, err = strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		err = ErrBadPeerImpl
+	}
+	return
+}
+
+// formatSeconds rounds d up to the second, so that a message is
+// never expired early by the peer. It is empty if d is not positive.
+func formatSeconds(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+func parseSeconds(str string) (d time.Duration, err error) {
+	if len(str) == 0 {
+		return
+	}
+	sec, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || sec < 0 {
+		err = ErrBadPeerImpl
+		return
+	}
+	d = time.Duration(sec) * time.Second
+	return
+}
+
+func formatFlag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// parseFlag parses "1" or "0". Anything else is ErrNoChange.
+func parseFlag(str string) (b bool, err error) {
+	switch str {
+	case "1":
+		b = true
+	case "0":
+	default:
+		err = ErrNoChange
+	}
+	return
+}
+
+// param returns the ith parameter, or an empty string.
+func param(params []string, i int) string {
+	if i < len(params) {
+		return params[i]
+	}
+	return ""
+}
+
+// trimParams drops the trailing empty parameters, but the first n.
+func trimParams(params []string, n int) []string {
+	for len(params) > n && len(params[len(params)-1]) == 0 {
+		params = params[:len(params)-1]
+	}
+	return params
+}
+
+// Data carries a message to or from the server. See CMD_DATA.
+type Data struct {
+	Id  string
+	Seq uint64
+
+	// TTL is how long the message lives from now. Zero if it never
+	// expires.
+	TTL time.Duration
+}
+
+// Command returns a CMD_DATA carrying msg.
+func (self *Data) Command(msg *Message) *Command {
+	return &Command{
+		Type:    CMD_DATA,
+		Params:  trimParams([]string{self.Id, formatSeq(self.Seq), formatSeconds(self.TTL)}, 0),
+		Message: msg,
+	}
+}
+
+// ParseData parses the parameters of a CMD_DATA.
+func ParseData(params []string) (d *Data, err error) {
+	seq, err := parseSeq(param(params, 1))
+	if err != nil {
+		return
+	}
+	ttl, err := parseSeconds(param(params, 2))
+	if err != nil {
+		return
+	}
+	d = &Data{Id: param(params, 0), Seq: seq, TTL: ttl}
+	return
+}
+
+// Empty tells that a message is empty. See CMD_EMPTY.
+type Empty struct {
+	Id string
+}
+
+// Command returns a CMD_EMPTY.
+func (self *Empty) Command() *Command {
+	return &Command{
+		Type:   CMD_EMPTY,
+		Params: trimParams([]string{self.Id}, 0),
+	}
+}
+
+// ParseEmpty parses the parameters of a CMD_EMPTY.
+func ParseEmpty(params []string) (e *Empty, err error) {
+	e = &Empty{Id: param(params, 0)}
+	return
+}
+
+// Auth logs a client in. See CMD_AUTH.
+type Auth struct {
+	Service  string
+	Username string
+	Token    string
+
+	// Dictionaries are the ids of the compression dictionaries known
+	// by the client.
+	Dictionaries []string
+
+	// Plaintext tells if the client accepts public messages in
+	// plaintext.
+	Plaintext bool
+
+	// Caps are the features of the client. A client sending any
+	// understands CMD_CAPS.
+	Caps []string
+
+	// Device is the id of the device of the client. A service may
+	// bind the token to it.
+	Device string
+}
+
+// Command returns a CMD_AUTH.
+func (self *Auth) Command() *Command {
+	params := []string{self.Service, self.Username, self.Token, strings.Join(self.Dictionaries, ","), "", "", self.Device}
+	if self.Plaintext {
+		params[4] = "1"
+	}
+	params[5] = strings.Join(self.Caps, ",")
+	return &Command{Type: CMD_AUTH, Params: trimParams(params, 3)}
+}
+
+// HasDictionary tells if the client knows the dictionary.
+func (self *Auth) HasDictionary(id string) bool {
+	for _, d := range self.Dictionaries {
+		if d == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAuth parses the parameters of a CMD_AUTH.
+func ParseAuth(params []string) (a *Auth, err error) {
+	if len(params) < 3 {
+		err = ErrBadPeerImpl
+		return
+	}
+	a = &Auth{
+		Service:   params[0],
+		Username:  params[1],
+		Token:     params[2],
+		Plaintext: param(params, 4) == "1",
+		Device:    param(params, 6),
+	}
+	if ids := param(params, 3); len(ids) > 0 {
+		a.Dictionaries = strings.Split(ids, ",")
+	}
+	for _, f := range strings.Split(param(params, 5), ",") {
+		if len(f) > 0 {
+			a.Caps = append(a.Caps, f)
+		}
+	}
+	return
+}
+
+// AuthOK accepts a client. See CMD_AUTHOK.
+type AuthOK struct {
+	ConnId string
+
+	// Dictionary is the id of the dictionary used by both peers, if
+	// there is one.
+	Dictionary string
+
+	// Plaintext tells if both peers send public messages in plaintext.
+	Plaintext bool
+
+	// Caps tells if a CMD_CAPS follows.
+	Caps bool
+}
+
+// Command returns a CMD_AUTHOK.
+func (self *AuthOK) Command() *Command {
+	params := []string{self.ConnId, self.Dictionary, "", ""}
+	if self.Plaintext {
+		params[2] = "1"
+	}
+	if self.Caps {
+		params[3] = "1"
+	}
+	return &Command{Type: CMD_AUTHOK, Params: trimParams(params, 1)}
+}
+
+// ParseAuthOK parses the parameters of a CMD_AUTHOK.
+func ParseAuthOK(params []string) (a *AuthOK, err error) {
+	a = &AuthOK{
+		ConnId:     param(params, 0),
+		Dictionary: param(params, 1),
+		Plaintext:  param(params, 2) == "1",
+		Caps:       param(params, 3) == "1",
+	}
+	return
+}
+
+// Bye closes a connection. See CMD_BYE.
+type Bye struct {
+	// Reason is only sent from the server, e.g. BYE_REVOKED.
+	Reason string
+}
+
+// Command returns a CMD_BYE.
+func (self *Bye) Command() *Command {
+	return &Command{
+		Type:   CMD_BYE,
+		Params: trimParams([]string{self.Reason}, 0),
+	}
+}
+
+// ParseBye parses the parameters of a CMD_BYE.
+func ParseBye(params []string) (b *Bye, err error) {
+	b = &Bye{Reason: param(params, 0)}
+	return
+}
+
+// Setting tells the server about the preference of a client. See
+// CMD_SETTING.
+type Setting struct {
+	DigestThreshold   int
+	CompressThreshold int
+
+	// The thresholds are left unchanged if Keep* is true.
+	KeepDigestThreshold   bool
+	KeepCompressThreshold bool
+
+	// DigestFields are the fields, each maybe prefixed with
+	// DIGEST_FIELD_ADD or DIGEST_FIELD_REMOVE.
+	DigestFields []string
+}
+
+// Command returns a CMD_SETTING.
+func (self *Setting) Command() *Command {
+	params := make([]string, 2, 2+len(self.DigestFields))
+	if !self.KeepDigestThreshold {
+		params[0] = strconv.Itoa(self.DigestThreshold)
+	}
+	if !self.KeepCompressThreshold {
+		params[1] = strconv.Itoa(self.CompressThreshold)
+	}
+	params = append(params, self.DigestFields...)
+	return &Command{Type: CMD_SETTING, Params: params}
+}
+
+// ParseSetting parses the parameters of a CMD_SETTING.
+func ParseSetting(params []string) (s *Setting, err error) {
+	if len(params) < 2 {
+		err = ErrBadPeerImpl
+		return
+	}
+	ret := new(Setting)
+	if len(params[0]) > 0 {
+		ret.DigestThreshold, err = strconv.Atoi(params[0])
+		if err != nil {
+			err = ErrBadPeerImpl
+			return
+		}
+	} else {
+		ret.KeepDigestThreshold = true
+	}
+	if len(params[1]) > 0 {
+		ret.CompressThreshold, err = strconv.Atoi(params[1])
+		if err != nil {
+			err = ErrBadPeerImpl
+			return
+		}
+	} else {
+		ret.KeepCompressThreshold = true
+	}
+	if len(params) > 2 {
+		ret.DigestFields = params[2:]
+	}
+	s = ret
+	return
+}
+
+// Command returns a CMD_DIGEST carrying the entry.
+func (self *DigestEntry) Command() *Command {
+	params := []string{strconv.Itoa(self.Size), self.MsgId, "", "", formatSeq(self.Seq), self.ThreadId}
+	n := 2
+	if len(self.Sender) > 0 {
+		params[2] = self.Sender
+		params[3] = self.SenderService
+		n = 4
+	}
+	cmd := &Command{
+		Type:   CMD_DIGEST,
+		Params: trimParams(params, n),
+	}
+	if self.Info != nil {
+		cmd.Message = &Message{Header: self.Info}
+	}
+	return cmd
+}
+
+// ParseDigest parses the parameters of a CMD_DIGEST. The Info of the
+// entry is the header of its message, which is set by the caller.
+func ParseDigest(params []string) (e *DigestEntry, err error) {
+	if len(params) < 2 {
+		err = ErrBadPeerImpl
+		return
+	}
+	ret := &DigestEntry{MsgId: params[1]}
+	ret.Size, err = strconv.Atoi(params[0])
+	if err != nil {
+		err = ErrBadPeerImpl
+		return
+	}
+	ret.Sender = param(params, 2)
+	if len(ret.Sender) > 0 {
+		ret.SenderService = param(params, 3)
+	}
+	ret.Seq, err = parseSeq(param(params, 4))
+	if err != nil {
+		return
+	}
+	ret.ThreadId = param(params, 5)
+	e = ret
+	return
+}
+
+// MaxRetrieveIds is the number of message ids a CMD_MSG_RETRIEVE may
+// carry.
+const MaxRetrieveIds = maxNrParams
+
+// Retrieve asks for cached messages. See CMD_MSG_RETRIEVE.
+type Retrieve struct {
+	// Ids should not be more than MaxRetrieveIds.
+	Ids []string
+}
+
+// Command returns a CMD_MSG_RETRIEVE.
+func (self *Retrieve) Command() *Command {
+	return &Command{Type: CMD_MSG_RETRIEVE, Params: self.Ids}
+}
+
+// ParseRetrieve parses the parameters of a CMD_MSG_RETRIEVE. The
+// empty ids are dropped.
+func ParseRetrieve(params []string) (r *Retrieve, err error) {
+	if len(params) < 1 {
+		err = ErrBadPeerImpl
+		return
+	}
+	ids := make([]string, 0, len(params))
+	for _, id := range params {
+		if len(id) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	r = &Retrieve{Ids: ids}
+	return
+}
+
+// ForwardRequest asks the server to forward a message to another
+// user. See CMD_FWD_REQ.
+type ForwardRequest struct {
+	TTL      time.Duration
+	Receiver string
+
+	// ReceiverService is empty if it is the service of the sender.
+	ReceiverService string
+
+	// RequestId, if not empty, asks for a CMD_FWD_RESULT.
+	RequestId      string
+	IdempotencyKey string
+
+	// MoreReceivers are in the service of Receiver too.
+	MoreReceivers []string
+
+	// DeliverAt, if not zero, is when to deliver the message.
+	DeliverAt time.Time
+
+	// StickyReplies asks the replies to be routed to the sending
+	// connection only.
+	StickyReplies bool
+
+	// ReplyTo, if not empty, is the only connection of the receiver
+	// the message is written to. It is ignored unless the connection
+	// sent a message with StickyReplies to the sender.
+	ReplyTo string
+}
+
+// Receivers returns Receiver, then MoreReceivers.
+func (self *ForwardRequest) Receivers() []string {
+	return append([]string{self.Receiver}, self.MoreReceivers...)
+}
+
+// ReceiverKey returns the idempotency key of the request to one of its
+// receivers.
+func (self *ForwardRequest) ReceiverKey(receiver string) string {
+	if len(self.MoreReceivers) == 0 || len(self.IdempotencyKey) == 0 {
+		return self.IdempotencyKey
+	}
+	return self.IdempotencyKey + "\n" + receiver
+}
+
+// Command returns a CMD_FWD_REQ carrying msg.
+func (self *ForwardRequest) Command(msg *Message) *Command {
+	params := []string{self.TTL.String(), self.Receiver, self.ReceiverService, self.RequestId, self.IdempotencyKey, strings.Join(self.MoreReceivers, "\n"), "", "", self.ReplyTo, ""}
+	if !self.DeliverAt.IsZero() {
+		params[6] = strconv.FormatInt(self.DeliverAt.Unix(), 10)
+		params[9] = formatSeconds(time.Until(self.DeliverAt))
+	}
+	if self.StickyReplies {
+		params[7] = "1"
+	}
+	return &Command{
+		Type:    CMD_FWD_REQ,
+		Params:  trimParams(params, 2),
+		Message: msg,
+	}
+}
+
+// ParseForwardRequest parses the parameters of a CMD_FWD_REQ. A TTL
+// which cannot be parsed is DefaultForwardTTL.
+func ParseForwardRequest(params []string) (f *ForwardRequest, err error) {
+	if len(params) < 2 {
+		err = ErrBadPeerImpl
+		return
+	}
+	ttl, e := time.ParseDuration(params[0])
+	if e != nil {
+		ttl = DefaultForwardTTL
+	}
+	f = &ForwardRequest{
+		TTL:             ttl,
+		Receiver:        params[1],
+		ReceiverService: param(params, 2),
+		RequestId:       param(params, 3),
+		IdempotencyKey:  param(params, 4),
+	}
+	for _, r := range strings.Split(param(params, 5), "\n") {
+		if len(r) > 0 {
+			f.MoreReceivers = append(f.MoreReceivers, r)
+		}
+	}
+	if at := param(params, 6); len(at) > 0 {
+		sec, e := strconv.ParseInt(at, 10, 64)
+		if e != nil {
+			f, err = nil, ErrBadPeerImpl
+			return
+		}
+		f.DeliverAt = time.Unix(sec, 0)
+	}
+	if delay := param(params, 9); len(delay) > 0 {
+		var d time.Duration
+		d, err = parseSeconds(delay)
+		if err != nil {
+			f = nil
+			return
+		}
+		f.DeliverAt = time.Now().Add(d)
+	}
+	f.StickyReplies = param(params, 7) == "1"
+	f.ReplyTo = param(params, 8)
+	return
+}
+
+// Forward carries a message from another user. See CMD_FWD.
+type Forward struct {
+	Sender string
+
+	// SenderService is empty if it is the service of the receiver.
+	SenderService string
+	Id            string
+	Seq           uint64
+
+	// SenderConn, if not empty, is the connection of the sender to
+	// which the replies should be routed.
+	SenderConn string
+
+	// TTL is how long the message lives from now. Zero if it never
+	// expires.
+	TTL time.Duration
+}
+
+// Command returns a CMD_FWD carrying msg.
+func (self *Forward) Command(msg *Message) *Command {
+	params := []string{self.Sender, self.SenderService, self.Id, formatSeq(self.Seq), self.SenderConn, formatSeconds(self.TTL)}
+	return &Command{
+		Type:    CMD_FWD,
+		Params:  trimParams(params, 3),
+		Message: msg,
+	}
+}
+
+// ParseForward parses the parameters of a CMD_FWD.
+func ParseForward(params []string) (f *Forward, err error) {
+	if len(params) < 1 {
+		err = ErrBadPeerImpl
+		return
+	}
+	seq, err := parseSeq(param(params, 3))
+	if err != nil {
+		return
+	}
+	ttl, err := parseSeconds(param(params, 5))
+	if err != nil {
+		return
+	}
+	f = &Forward{
+		Sender:        params[0],
+		SenderService: param(params, 1),
+		Id:            param(params, 2),
+		Seq:           seq,
+		SenderConn:    param(params, 4),
+		TTL:           ttl,
+	}
+	return
+}
+
+// Visibility makes a client visible or invisible to the server. See
+// CMD_SET_VISIBILITY.
+type Visibility struct {
+	Visible bool
+}
+
+// Command returns a CMD_SET_VISIBILITY.
+func (self *Visibility) Command() *Command {
+	return &Command{
+		Type:   CMD_SET_VISIBILITY,
+		Params: []string{formatFlag(self.Visible)},
+	}
+}
+
+// ParseVisibility parses the parameters of a CMD_SET_VISIBILITY.
+func ParseVisibility(params []string) (v *Visibility, err error) {
+	if len(params) < 1 {
+		err = ErrBadPeerImpl
+		return
+	}
+	visible, err := parseFlag(params[0])
+	if err != nil {
+		return
+	}
+	v = &Visibility{Visible: visible}
+	return
+}
+
+// Subscription subscribes a user to, or unsubscribes it from, a push
+// service. The parameters of the subscription are the header of the
+// message of the command. See CMD_SUBSCRIPTION.
+type Subscription struct {
+	Subscribe bool
+}
+
+// Command returns a CMD_SUBSCRIPTION with the parameters of the
+// subscription.
+func (self *Subscription) Command(params map[string]string) *Command {
+	return &Command{
+		Type:    CMD_SUBSCRIPTION,
+		Params:  []string{formatFlag(self.Subscribe)},
+		Message: &Message{Header: params},
+	}
+}
+
+// ParseSubscription parses the parameters of a CMD_SUBSCRIPTION.
+func ParseSubscription(params []string) (s *Subscription, err error) {
+	if len(params) < 1 {
+		err = ErrBadPeerImpl
+		return
+	}
+	sub, err := parseFlag(params[0])
+	if err != nil {
+		return
+	}
+	s = &Subscription{Subscribe: sub}
+	return
+}
+
+// AllCachedRequest asks for all cached messages. The ids to exclude
+// are the body of the message of the command. See CMD_REQ_ALL_CACHED.
+type AllCachedRequest struct {
+	DigestBatch bool
+
+	// LengthPrefixed tells if the ids are encoded by EncodeExcludes,
+	// instead of EncodeLegacyExcludes.
+	LengthPrefixed bool
+
+	// More tells if more ids follow in the next command.
+	More bool
+
+	Checkpoints bool
+
+	// After is the sequence number after which the messages are sent.
+	After uint64
+}
+
+// Command returns a CMD_REQ_ALL_CACHED excluding the ids.
+func (self *AllCachedRequest) Command(excludes []byte) *Command {
+	params := make([]string, 5)
+	if self.DigestBatch {
+		params[0] = "1"
+	}
+	if self.LengthPrefixed {
+		params[1] = EXCLUDES_LENGTH_PREFIXED
+	}
+	if self.More {
+		params[2] = EXCLUDES_MORE
+	}
+	if self.Checkpoints {
+		params[3] = "1"
+	}
+	params[4] = formatSeq(self.After)
+	cmd := &Command{
+		Type:   CMD_REQ_ALL_CACHED,
+		Params: trimParams(params, 1),
+	}
+	if len(excludes) > 0 {
+		cmd.Message = &Message{Body: excludes}
+	}
+	return cmd
+}
+
+// ParseAllCachedRequest parses the parameters of a CMD_REQ_ALL_CACHED.
+func ParseAllCachedRequest(params []string) (r *AllCachedRequest, err error) {
+	after, err := parseSeq(param(params, 4))
+	if err != nil {
+		return
+	}
+	r = &AllCachedRequest{
+		DigestBatch:    param(params, 0) == "1",
+		LengthPrefixed: param(params, 1) == EXCLUDES_LENGTH_PREFIXED,
+		More:           param(params, 2) == EXCLUDES_MORE,
+		Checkpoints:    param(params, 3) == "1",
+		After:          after,
+	}
+	return
+}
+
+// SeqRangeRequest asks for the cached messages whose sequence numbers
+// are within [From, To]. To is 0 if there is no upper bound. See
+// CMD_REQ_SEQ_RANGE.
+type SeqRangeRequest struct {
+	From        uint64
+	To          uint64
+	DigestBatch bool
+}
+
+// Command returns a CMD_REQ_SEQ_RANGE.
+func (self *SeqRangeRequest) Command() *Command {
+	params := []string{strconv.FormatUint(self.From, 10), formatSeq(self.To), ""}
+	if self.DigestBatch {
+		params[2] = "1"
+	}
+	return &Command{
+		Type:   CMD_REQ_SEQ_RANGE,
+		Params: trimParams(params, 1),
+	}
+}
+
+// ParseSeqRangeRequest parses the parameters of a CMD_REQ_SEQ_RANGE.
+func ParseSeqRangeRequest(params []string) (r *SeqRangeRequest, err error) {
+	if len(params) < 1 {
+		err = ErrBadPeerImpl
+		return
+	}
+	from, err := strconv.ParseUint(params[0], 10, 64)
+	if err != nil {
+		err = ErrBadPeerImpl
+		return
+	}
+	to, err := parseSeq(param(params, 1))
+	if err != nil {
+		return
+	}
+	r = &SeqRangeRequest{From: from, To: to, DigestBatch: param(params, 2) == "1"}
+	return
+}
+
+// ThreadRequest asks for the cached messages of a thread. See
+// CMD_REQ_THREAD.
+type ThreadRequest struct {
+	ThreadId    string
+	DigestBatch bool
+}
+
+// Command returns a CMD_REQ_THREAD.
+func (self *ThreadRequest) Command() *Command {
+	params := []string{self.ThreadId, ""}
+	if self.DigestBatch {
+		params[1] = "1"
+	}
+	return &Command{
+		Type:   CMD_REQ_THREAD,
+		Params: trimParams(params, 1),
+	}
+}
+
+// ParseThreadRequest parses the parameters of a CMD_REQ_THREAD.
+func ParseThreadRequest(params []string) (r *ThreadRequest, err error) {
+	if len(params) < 1 || len(params[0]) == 0 {
+		err = ErrBadPeerImpl
+		return
+	}
+	r = &ThreadRequest{ThreadId: params[0], DigestBatch: param(params, 1) == "1"}
+	return
+}
+
+// Ack acknowledges the receipt of a message. See CMD_ACK.
+type Ack struct {
+	Id   string
+	Read bool
+}
+
+// Command returns a CMD_ACK.
+func (self *Ack) Command() *Command {
+	return &Command{
+		Type:   CMD_ACK,
+		Params: []string{self.Id, formatFlag(self.Read)},
+	}
+}
+
+// ParseAck parses the parameters of a CMD_ACK.
+func ParseAck(params []string) (a *Ack, err error) {
+	if len(params) < 1 {
+		err = ErrBadPeerImpl
+		return
+	}
+	a = &Ack{Id: params[0], Read: param(params, 1) == "1"}
+	return
+}
+
+// Block blocks, or unblocks, a sender. See CMD_BLOCK.
+type Block struct {
+	Block    bool
+	Username string
+
+	// Service is empty if it is the service of the user.
+	Service string
+}
+
+// Command returns a CMD_BLOCK.
+func (self *Block) Command() *Command {
+	return &Command{
+		Type:   CMD_BLOCK,
+		Params: []string{formatFlag(self.Block), self.Username, self.Service},
+	}
+}
+
+// ParseBlock parses the parameters of a CMD_BLOCK.
+func ParseBlock(params []string) (b *Block, err error) {
+	if len(params) < 2 || len(params[1]) == 0 {
+		err = ErrBadPeerImpl
+		return
+	}
+	block, err := parseFlag(params[0])
+	if err != nil {
+		return
+	}
+	b = &Block{Block: block, Username: params[1], Service: param(params, 2)}
+	return
+}
+
+// ForwardResult is the result of a forward request which carries a
+// request id. See CMD_FWD_RESULT.
+type ForwardResult struct {
+	RequestId string
+
+	// Status is one of FWD_*
+	Status string
+
+	// MsgId is the id of the message in the receiver's cache.
+	// It may be empty even if the message is forwarded.
+	MsgId string
+
+	// Invalid tells why the message is invalid if Status is
+	// FWD_INVALID. It may be nil.
+	Invalid *ValidationError
+
+	// Receiver is set if the request has several receivers.
+	Receiver string
+}
+
+// Command returns a CMD_FWD_RESULT.
+func (self *ForwardResult) Command() *Command {
+	params := []string{self.RequestId, self.Status, self.MsgId, "", "", self.Receiver}
+	if self.Invalid != nil {
+		params[3] = self.Invalid.Header
+		params[4] = self.Invalid.Reason
+	}
+	return &Command{Type: CMD_FWD_RESULT, Params: trimParams(params, 2)}
+}
+
+// ParseForwardResult parses the parameters of a CMD_FWD_RESULT.
+func ParseForwardResult(params []string) (r *ForwardResult, err error) {
+	if len(params) < 2 {
+		err = ErrBadPeerImpl
+		return
+	}
+	r = &ForwardResult{
+		RequestId: params[0],
+		Status:    params[1],
+		MsgId:     param(params, 2),
+	}
+	if r.Status == FWD_INVALID && len(params) > 3 {
+		r.Invalid = &ValidationError{
+			Header: params[3],
+			Reason: param(params, 4),
+		}
+	}
+	r.Receiver = param(params, 5)
+	return
+}
+
+// HeadersOnly asks the server to strip the bodies of the messages
+// larger than Size. A negative Size turns the mode off. See
+// CMD_SET_HEADERS_ONLY.
+type HeadersOnly struct {
+	Size int
+}
+
+// Command returns a CMD_SET_HEADERS_ONLY.
+func (self *HeadersOnly) Command() *Command {
+	size := self.Size
+	if size < 0 {
+		size = -1
+	}
+	return &Command{
+		Type:   CMD_SET_HEADERS_ONLY,
+		Params: []string{strconv.Itoa(size)},
+	}
+}
+
+// ParseHeadersOnly parses the parameters of a CMD_SET_HEADERS_ONLY.
+func ParseHeadersOnly(params []string) (h *HeadersOnly, err error) {
+	if len(params) < 1 {
+		err = ErrBadPeerImpl
+		return
+	}
+	size, err := strconv.Atoi(params[0])
+	if err != nil {
+		err = ErrBadPeerImpl
+		return
+	}
+	h = &HeadersOnly{Size: size}
+	return
+}
+
+// ReplayCheckpoint tells how far a replay of the cached messages has
+// gone. See CMD_REPLAY_CHECKPOINT.
+type ReplayCheckpoint struct {
+	Seq  uint64
+	Done bool
+}
+
+// Command returns a CMD_REPLAY_CHECKPOINT.
+func (self *ReplayCheckpoint) Command() *Command {
+	params := []string{formatSeq(self.Seq), ""}
+	if self.Done {
+		params[1] = "1"
+	}
+	return &Command{Type: CMD_REPLAY_CHECKPOINT, Params: params}
+}
+
+// ParseReplayCheckpoint parses the parameters of a
+// CMD_REPLAY_CHECKPOINT.
+func ParseReplayCheckpoint(params []string) (c *ReplayCheckpoint, err error) {
+	if len(params) < 1 {
+		err = ErrBadPeerImpl
+		return
+	}
+	seq, err := parseSeq(params[0])
+	if err != nil {
+		return
+	}
+	c = &ReplayCheckpoint{Seq: seq, Done: param(params, 1) == "1"}
+	return
+}
+
+// Caps are the optional features supported by a peer. See CMD_CAPS.
+type Caps struct {
+	Features []string
+}
+
+// Has tells if the feature is supported.
+func (self *Caps) Has(feature string) bool {
+	if self == nil {
+		return false
+	}
+	for _, f := range self.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Command returns a CMD_CAPS.
+func (self *Caps) Command() *Command {
+	return &Command{
+		Type:   CMD_CAPS,
+		Params: []string{strings.Join(self.Features, ",")},
+	}
+}
+
+// ParseCaps parses the parameters of a CMD_CAPS. The empty features
+// are dropped.
+func ParseCaps(params []string) (c *Caps, err error) {
+	ret := new(Caps)
+	for _, f := range strings.Split(param(params, 0), ",") {
+		if len(f) > 0 {
+			ret.Features = append(ret.Features, f)
+		}
+	}
+	c = ret
+	return
+}
+
+// Edit changes, or recalls, a message forwarded earlier. See CMD_EDIT.
+type Edit struct {
+	// Peer is the receiver if sent from client, and the sender if
+	// sent from server.
+	Peer string
+
+	// PeerService is empty if it is the service of the client.
+	PeerService string
+
+	// Id is the id of the message in the receiver's cache.
+	Id     string
+	Recall bool
+
+	// RequestId is only sent from client.
+	RequestId string
+}
+
+// Command returns a CMD_EDIT carrying msg. A recall carries no message.
+func (self *Edit) Command(msg *Message) *Command {
+	params := []string{self.Peer, self.PeerService, self.Id, "", self.RequestId}
+	if self.Recall {
+		params[3] = "1"
+		msg = nil
+	}
+	return &Command{
+		Type:    CMD_EDIT,
+		Params:  trimParams(params, 3),
+		Message: msg,
+	}
+}
+
+// ParseEdit parses the parameters of a CMD_EDIT.
+func ParseEdit(params []string) (e *Edit, err error) {
+	if len(params) < 3 || len(params[0]) == 0 || len(params[2]) == 0 {
+		err = ErrBadPeerImpl
+		return
+	}
+	e = &Edit{
+		Peer:        params[0],
+		PeerService: params[1],
+		Id:          params[2],
+		Recall:      param(params, 3) == "1",
+		RequestId:   param(params, 4),
+	}
+	return
+}
+
+// AssetVersion names a version of a configuration asset. See CMD_ASSET.
+type AssetVersion struct {
+	Name    string
+	Version uint64
+}
+
+// Command returns a CMD_ASSET. The server sends the content of the
+// asset as the body of msg, the client sends a nil msg.
+func (self *AssetVersion) Command(msg *Message) *Command {
+	return &Command{
+		Type:    CMD_ASSET,
+		Params:  []string{self.Name, strconv.FormatUint(self.Version, 10)},
+		Message: msg,
+	}
+}
+
+// ParseAssetVersion parses the parameters of a CMD_ASSET.
+func ParseAssetVersion(params []string) (a *AssetVersion, err error) {
+	if len(params) < 2 || len(params[0]) == 0 {
+		err = ErrBadPeerImpl
+		return
+	}
+	v, e := strconv.ParseUint(params[1], 10, 64)
+	if e != nil {
+		err = ErrBadPeerImpl
+		return
+	}
+	a = &AssetVersion{Name: params[0], Version: v}
+	return
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// roundTrip marshals and unmarshals the command, as a peer would read it.
+func roundTrip(t *testing.T, cmd *Command, typ uint8) []string {
+	if cmd.Type != typ {
+		t.Fatalf("bad command type: %v", cmd)
+	}
+	data, err := cmd.Marshal()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	read, err := UnmarshalCommand(data)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return read.Params
+}
+
+func TestTypedCommands(t *testing.T) {
+	auth := &Auth{Service: "srv", Username: "alice", Token: "tok", Dictionaries: []string{"a", "b"}, Plaintext: true, Caps: []string{CAP_ACK, "app.x"}, Device: "phone"}
+	if parsed, err := ParseAuth(roundTrip(t, auth.Command(), CMD_AUTH)); err != nil || !reflect.DeepEqual(parsed, auth) {
+		t.Errorf("bad auth: %+v %v", parsed, err)
+	}
+	authok := &AuthOK{ConnId: "c", Plaintext: true, Caps: true}
+	if parsed, err := ParseAuthOK(roundTrip(t, authok.Command(), CMD_AUTHOK)); err != nil || *parsed != *authok {
+		t.Errorf("bad authok: %+v %v", parsed, err)
+	}
+	caps := &Caps{Features: []string{CAP_ACK, CAP_SEQ_RANGE}}
+	if parsed, err := ParseCaps(roundTrip(t, caps.Command(), CMD_CAPS)); err != nil || !reflect.DeepEqual(parsed, caps) || !parsed.Has(CAP_SEQ_RANGE) {
+		t.Errorf("bad caps: %+v %v", parsed, err)
+	}
+	data := &Data{Seq: 3, TTL: 90 * time.Second}
+	if parsed, err := ParseData(roundTrip(t, data.Command(nil), CMD_DATA)); err != nil || *parsed != *data {
+		t.Errorf("bad data: %+v %v", parsed, err)
+	}
+	setting := &Setting{CompressThreshold: -1, KeepDigestThreshold: true, DigestFields: []string{"+title"}}
+	if parsed, err := ParseSetting(roundTrip(t, setting.Command(), CMD_SETTING)); err != nil || !reflect.DeepEqual(parsed, setting) {
+		t.Errorf("bad setting: %+v %v", parsed, err)
+	}
+	digest := &DigestEntry{MsgId: "m", Size: 512, Sender: "bob", Seq: 9, ThreadId: "t"}
+	if parsed, err := ParseDigest(roundTrip(t, digest.Command(), CMD_DIGEST)); err != nil || !reflect.DeepEqual(parsed, digest) {
+		t.Errorf("bad digest: %+v %v", parsed, err)
+	}
+	fwdreq := &ForwardRequest{TTL: time.Hour, Receiver: "bob", RequestId: "1", IdempotencyKey: "k", MoreReceivers: []string{"carol", "dave"}, DeliverAt: time.Unix(1700000000, 0), StickyReplies: true, ReplyTo: "conn1"}
+	if parsed, err := ParseForwardRequest(roundTrip(t, fwdreq.Command(nil), CMD_FWD_REQ)); err != nil || !reflect.DeepEqual(parsed, fwdreq) {
+		t.Errorf("bad forward request: %+v %v", parsed, err)
+	}
+	if k := fwdreq.ReceiverKey("carol"); k != "k\ncarol" || (&ForwardRequest{IdempotencyKey: "k"}).ReceiverKey("bob") != "k" {
+		t.Errorf("bad key: %q", k)
+	}
+	fwd := &Forward{Sender: "bob", SenderService: "other", Seq: 2, SenderConn: "conn2", TTL: time.Hour}
+	if parsed, err := ParseForward(roundTrip(t, fwd.Command(nil), CMD_FWD)); err != nil || *parsed != *fwd {
+		t.Errorf("bad forward: %+v %v", parsed, err)
+	}
+	all := &AllCachedRequest{DigestBatch: true, LengthPrefixed: true, Checkpoints: true, After: 42}
+	if parsed, err := ParseAllCachedRequest(roundTrip(t, all.Command(nil), CMD_REQ_ALL_CACHED)); err != nil || *parsed != *all {
+		t.Errorf("bad request of all cached: %+v %v", parsed, err)
+	}
+	rng := &SeqRangeRequest{From: 1, DigestBatch: true}
+	if parsed, err := ParseSeqRangeRequest(roundTrip(t, rng.Command(), CMD_REQ_SEQ_RANGE)); err != nil || *parsed != *rng {
+		t.Errorf("bad seq range: %+v %v", parsed, err)
+	}
+	thread := &ThreadRequest{ThreadId: "t", DigestBatch: true}
+	if parsed, err := ParseThreadRequest(roundTrip(t, thread.Command(), CMD_REQ_THREAD)); err != nil || *parsed != *thread {
+		t.Errorf("bad thread request: %+v %v", parsed, err)
+	}
+	block := &Block{Block: true, Username: "eve"}
+	if parsed, err := ParseBlock(roundTrip(t, block.Command(), CMD_BLOCK)); err != nil || *parsed != *block {
+		t.Errorf("bad block: %+v %v", parsed, err)
+	}
+	res := &ForwardResult{RequestId: "1", Status: FWD_INVALID, Invalid: &ValidationError{Header: "h", Reason: "r"}, Receiver: "carol"}
+	if parsed, err := ParseForwardResult(roundTrip(t, res.Command(), CMD_FWD_RESULT)); err != nil || !reflect.DeepEqual(parsed, res) {
+		t.Errorf("bad forward result: %+v %v", parsed, err)
+	}
+	edit := &Edit{Peer: "bob", Id: "m", Recall: true, RequestId: "2"}
+	if parsed, err := ParseEdit(roundTrip(t, edit.Command(nil), CMD_EDIT)); err != nil || *parsed != *edit {
+		t.Errorf("bad edit: %+v %v", parsed, err)
+	}
+	asset := &AssetVersion{Name: "flags", Version: 12}
+	if parsed, err := ParseAssetVersion(roundTrip(t, asset.Command(nil), CMD_ASSET)); err != nil || *parsed != *asset {
+		t.Errorf("bad asset: %+v %v", parsed, err)
+	}
+	cp := &ReplayCheckpoint{Seq: 7, Done: true}
+	if parsed, err := ParseReplayCheckpoint(roundTrip(t, cp.Command(), CMD_REPLAY_CHECKPOINT)); err != nil || *parsed != *cp {
+		t.Errorf("bad checkpoint: %+v %v", parsed, err)
+	}
+}
+
+// The times on the wire do not depend on the clocks of the peers.
+func TestRelativeTimes(t *testing.T) {
+	data := &Data{Id: "m", TTL: 1500 * time.Millisecond}
+	if parsed, err := ParseData(roundTrip(t, data.Command(nil), CMD_DATA)); err != nil || parsed.TTL != 2*time.Second {
+		t.Errorf("the TTL should be rounded up: %+v %v", parsed, err)
+	}
+	if parsed, err := ParseData(roundTrip(t, (&Data{Id: "m"}).Command(nil), CMD_DATA)); err != nil || parsed.TTL != 0 {
+		t.Errorf("the message should never expire: %+v %v", parsed, err)
+	}
+
+	fwdreq := &ForwardRequest{TTL: time.Hour, Receiver: "bob", DeliverAt: time.Now().Add(time.Hour)}
+	params := roundTrip(t, fwdreq.Command(nil), CMD_FWD_REQ)
+	// The clock of the client is a day late.
+	params[6] = strconv.FormatInt(time.Now().Add(-23*time.Hour).Unix(), 10)
+	parsed, err := ParseForwardRequest(params)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if d := time.Until(parsed.DeliverAt); d < 59*time.Minute || d > time.Hour+time.Second {
+		t.Errorf("should be delivered in an hour, not %v", d)
+	}
+
+	mc := new(MessageContainer)
+	if mc.TTL() != 0 {
+		t.Errorf("the message should never expire")
+	}
+	mc.SetTTL(time.Minute)
+	if ttl := mc.TTL(); ttl <= 59*time.Second || ttl > time.Minute {
+		t.Errorf("bad TTL: %v", ttl)
+	}
+	mc.ExpiresAt = time.Now().Add(-time.Second).UnixNano()
+	if mc.TTL() <= 0 {
+		t.Errorf("an expired message still being delivered should have a TTL")
+	}
+}
+
+// The parameters sent by the peers which predate the typed commands.
+func TestLegacyParams(t *testing.T) {
+	if d, err := ParseData([]string{""}); err != nil || d.Id != "" || d.Seq != 0 {
+		t.Errorf("bad data: %+v %v", d, err)
+	}
+	if d, err := ParseData(nil); err != nil || d.Id != "" {
+		t.Errorf("bad data without params: %+v %v", d, err)
+	}
+	if f, err := ParseForwardRequest([]string{"forever", "bob"}); err != nil || f.TTL != DefaultForwardTTL {
+		t.Errorf("bad forward request: %+v %v", f, err)
+	}
+	if s, err := ParseSetting([]string{"", ""}); err != nil || !s.KeepDigestThreshold || !s.KeepCompressThreshold {
+		t.Errorf("bad setting: %+v %v", s, err)
+	}
+	if r, err := ParseRetrieve([]string{"a", "", "b"}); err != nil || !reflect.DeepEqual(r.Ids, []string{"a", "b"}) {
+		t.Errorf("bad retrieve: %+v %v", r, err)
+	}
+	if _, err := ParseVisibility([]string{"2"}); err != ErrNoChange {
+		t.Errorf("should change nothing: %v", err)
+	}
+}
+
+func TestMalformedParams(t *testing.T) {
+	bad := []struct {
+		name  string
+		parse func() error
+	}{
+		{"auth", func() error { _, err := ParseAuth([]string{"srv", "alice"}); return err }},
+		{"data", func() error { _, err := ParseData([]string{"id", "x"}); return err }},
+		{"digest", func() error { _, err := ParseDigest([]string{"big", "id"}); return err }},
+		{"forward", func() error { _, err := ParseForward(nil); return err }},
+		{"forward request", func() error { _, err := ParseForwardRequest([]string{"1h"}); return err }},
+		{"forward time", func() error { _, err := ParseForwardRequest([]string{"1h", "bob", "", "", "", "", "soon"}); return err }},
+		{"setting", func() error { _, err := ParseSetting([]string{"1"}); return err }},
+		{"seq range", func() error { _, err := ParseSeqRangeRequest([]string{"-1"}); return err }},
+		{"block", func() error { _, err := ParseBlock([]string{"1", ""}); return err }},
+		{"ack", func() error { _, err := ParseAck(nil); return err }},
+		{"headers only", func() error { _, err := ParseHeadersOnly([]string{"x"}); return err }},
+		{"checkpoint", func() error { _, err := ParseReplayCheckpoint(nil); return err }},
+		{"forward result", func() error { _, err := ParseForwardResult([]string{"1"}); return err }},
+		{"thread", func() error { _, err := ParseThreadRequest([]string{""}); return err }},
+		{"edit", func() error { _, err := ParseEdit([]string{"bob", "", ""}); return err }},
+		{"asset", func() error { _, err := ParseAssetVersion([]string{"flags", "new"}); return err }},
+	}
+	for _, b := range bad {
+		if err := b.parse(); err != ErrBadPeerImpl {
+			t.Errorf("%v: should be rejected: %v", b.name, err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The kinds of the jobs run by a CPUPool.
+const (
+	// The compression and decompression of the commands. They delay
+	// the delivery, so they go before the handshakes.
+	CPU_COMPRESSION = iota
+
+	// The signatures and DH keys of the key exchanges.
+	CPU_HANDSHAKE
+
+	nrCPUJobKinds
+)
+
+// CPUPool runs the CPU-bound work of the connections on a bounded
+// number of goroutines, so that a burst of handshakes cannot take all
+// the CPUs from the connections delivering messages. The workers take
+// the compression jobs before the handshake ones.
+type CPUPool struct {
+	// Accessed atomically. Keep them at the beginning to be 64-bit aligned.
+	nrQueued [nrCPUJobKinds]int64
+	nrDone   [nrCPUJobKinds]int64
+	waited   [nrCPUJobKinds]int64
+
+	nrWorkers int
+	queues    [nrCPUJobKinds]chan *cpuJob
+	done      chan bool
+	workers   sync.WaitGroup
+
+	// Held to queue a job, so that none is queued once closed.
+	lock   sync.RWMutex
+	closed bool
+}
+
+type cpuJob struct {
+	f        func()
+	queuedAt time.Time
+	finished chan bool
+}
+
+// CPUJobStats tells how the jobs of a kind waited for the workers.
+type CPUJobStats struct {
+	// NrQueued is the number of jobs waiting for a worker now.
+	NrQueued int64         `json:"nrQueued"`
+	NrDone   int64         `json:"nrDone"`
+	MeanWait time.Duration `json:"meanWait"`
+}
+
+type CPUPoolStats struct {
+	NrWorkers   int          `json:"nrWorkers"`
+	Compression *CPUJobStats `json:"compression"`
+	Handshake   *CPUJobStats `json:"handshake"`
+}
+
+// NewCPUPool starts nrWorkers goroutines. At most queueLen jobs of
+// each kind wait for them; Run blocks once the queue is full.
+func NewCPUPool(nrWorkers, queueLen int) *CPUPool {
+	if nrWorkers <= 0 {
+		nrWorkers = 1
+	}
+	if queueLen < 0 {
+		queueLen = 0
+	}
+	ret := new(CPUPool)
+	ret.nrWorkers = nrWorkers
+	for i := range ret.queues {
+		ret.queues[i] = make(chan *cpuJob, queueLen)
+	}
+	ret.done = make(chan bool)
+	ret.workers.Add(nrWorkers)
+	for i := 0; i < nrWorkers; i++ {
+		go ret.work()
+	}
+	return ret
+}
+
+func (self *CPUPool) work() {
+	defer self.workers.Done()
+	urgent := self.queues[CPU_COMPRESSION]
+	for {
+		select {
+		case job := <-urgent:
+			self.runJob(CPU_COMPRESSION, job)
+			continue
+		default:
+		}
+		select {
+		case job := <-urgent:
+			self.runJob(CPU_COMPRESSION, job)
+		case job := <-self.queues[CPU_HANDSHAKE]:
+			self.runJob(CPU_HANDSHAKE, job)
+		case <-self.done:
+			self.drain()
+			return
+		}
+	}
+}
+
+// drain() runs the jobs queued before the pool was closed.
+func (self *CPUPool) drain() {
+	for kind, q := range self.queues {
+		for {
+			select {
+			case job := <-q:
+				self.runJob(kind, job)
+				continue
+			default:
+			}
+			break
+		}
+	}
+}
+
+func (self *CPUPool) runJob(kind int, job *cpuJob) {
+	atomic.AddInt64(&self.nrQueued[kind], -1)
+	atomic.AddInt64(&self.waited[kind], int64(time.Since(job.queuedAt)))
+	atomic.AddInt64(&self.nrDone[kind], 1)
+	job.f()
+	close(job.finished)
+}
+
+// Run calls f on a worker and returns once it has returned. f is
+// called by the caller if the pool is nil or closed.
+func (self *CPUPool) Run(kind int, f func()) {
+	if self == nil || kind < 0 || kind >= nrCPUJobKinds {
+		f()
+		return
+	}
+	job := &cpuJob{f: f, queuedAt: time.Now(), finished: make(chan bool)}
+	self.lock.RLock()
+	if self.closed {
+		self.lock.RUnlock()
+		f()
+		return
+	}
+	atomic.AddInt64(&self.nrQueued[kind], 1)
+	self.queues[kind] <- job
+	self.lock.RUnlock()
+	<-job.finished
+}
+
+func (self *CPUPool) jobStats(kind int) *CPUJobStats {
+	ret := new(CPUJobStats)
+	ret.NrQueued = atomic.LoadInt64(&self.nrQueued[kind])
+	ret.NrDone = atomic.LoadInt64(&self.nrDone[kind])
+	if ret.NrDone > 0 {
+		ret.MeanWait = time.Duration(atomic.LoadInt64(&self.waited[kind]) / ret.NrDone)
+	}
+	return ret
+}
+
+// Stats returns nil if the pool is nil.
+func (self *CPUPool) Stats() *CPUPoolStats {
+	if self == nil {
+		return nil
+	}
+	ret := new(CPUPoolStats)
+	ret.NrWorkers = self.nrWorkers
+	ret.Compression = self.jobStats(CPU_COMPRESSION)
+	ret.Handshake = self.jobStats(CPU_HANDSHAKE)
+	return ret
+}
+
+// Close stops the workers. The jobs run afterwards are run by their
+// callers.
+func (self *CPUPool) Close() {
+	self.lock.Lock()
+	if !self.closed {
+		self.closed = true
+		close(self.done)
+	}
+	self.lock.Unlock()
+	self.workers.Wait()
+}
+
+var cpuPoolLock sync.RWMutex
+var cpuPool *CPUPool
+
+// SetCPUPool makes the connections run their compression and
+// handshakes on p. A nil p runs them on the connections' goroutines,
+// which is the default.
+func SetCPUPool(p *CPUPool) {
+	cpuPoolLock.Lock()
+	defer cpuPoolLock.Unlock()
+	cpuPool = p
+}
+
+// CurrentCPUPool returns the pool given to SetCPUPool.
+func CurrentCPUPool() *CPUPool {
+	cpuPoolLock.RLock()
+	defer cpuPoolLock.RUnlock()
+	return cpuPool
+}
+
+func runCPU(kind int, f func()) {
+	CurrentCPUPool().Run(kind, f)
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCPUPoolRunsCompressionFirst(t *testing.T) {
+	pool := NewCPUPool(1, 8)
+	defer pool.Close()
+
+	// Hold the only worker until the jobs are queued.
+	hold := make(chan bool)
+	started := make(chan bool)
+	go pool.Run(CPU_HANDSHAKE, func() {
+		started <- true
+		<-hold
+	})
+	<-started
+
+	var lock sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	run := func(kind int) {
+		defer wg.Done()
+		pool.Run(kind, func() {
+			lock.Lock()
+			order = append(order, kind)
+			lock.Unlock()
+		})
+	}
+	wg.Add(2)
+	go run(CPU_HANDSHAKE)
+	go run(CPU_COMPRESSION)
+	for {
+		stats := pool.Stats()
+		if stats.Handshake.NrQueued == 1 && stats.Compression.NrQueued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(hold)
+	wg.Wait()
+	if len(order) != 2 || order[0] != CPU_COMPRESSION {
+		t.Errorf("bad order: %v", order)
+	}
+	stats := pool.Stats()
+	if stats.NrWorkers != 1 || stats.Handshake.NrDone != 2 || stats.Compression.NrDone != 1 || stats.Handshake.NrQueued != 0 {
+		t.Errorf("bad stats: %+v %+v", stats.Handshake, stats.Compression)
+	}
+	if stats.Handshake.MeanWait <= 0 {
+		t.Errorf("bad wait: %v", stats.Handshake.MeanWait)
+	}
+}
+
+func TestCPUPoolClosed(t *testing.T) {
+	pool := NewCPUPool(2, 0)
+	pool.Close()
+	ran := false
+	pool.Run(CPU_COMPRESSION, func() { ran = true })
+	if !ran {
+		t.Errorf("not run after close")
+	}
+	var nilPool *CPUPool
+	ran = false
+	nilPool.Run(CPU_COMPRESSION, func() { ran = true })
+	if !ran || nilPool.Stats() != nil {
+		t.Errorf("bad nil pool")
+	}
+}
+
+func TestExchangingCommandsOnCPUPool(t *testing.T) {
+	pool := NewCPUPool(2, 4)
+	defer pool.Close()
+	SetCPUPool(pool)
+	defer SetCPUPool(nil)
+
+	io1, io2 := getNetworkCommandIOs(t)
+	if io1 == nil || io2 == nil {
+		return
+	}
+	testSendingCommands(t, nil, true, true, io1, io2, randomCommand(), randomCommand())
+	stats := pool.Stats()
+	if stats.Handshake.NrDone != 3 || stats.Compression.NrDone < 4 {
+		t.Errorf("bad stats: %+v %+v", stats.Handshake, stats.Compression)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	pss "github.com/monnand/rsa"
+	"hash"
+	"io"
+	"sync"
+)
+
+var ErrUnsupportedSigner = errors.New("the signer does not hold an RSA key")
+
+// CryptoProvider supplies the primitives used by the key exchange
+// and by the command streams. Deployments which have to use validated
+// modules (e.g. a BoringCrypto build, or an HSM) can plug their own in
+// with SetCryptoProvider.
+type CryptoProvider interface {
+	// Random returns the source of the nonces, salts and DH keys.
+	Random() io.Reader
+
+	// NewHash returns a SHA-256 hash. It is also used for the HMACs
+	// and the key derivation.
+	NewHash() hash.Hash
+
+	// NewBlockCipher returns an AES block cipher with the key.
+	NewBlockCipher(key []byte) (cipher.Block, error)
+
+	// VerifyPSS verifies the RSASSA-PSS signature of the SHA-256
+	// digest hashed with a salt of saltLen bytes.
+	VerifyPSS(pub *rsa.PublicKey, hashed, sig []byte, saltLen int) error
+}
+
+type defaultCryptoProvider struct{}
+
+func (self defaultCryptoProvider) Random() io.Reader {
+	return rand.Reader
+}
+
+func (self defaultCryptoProvider) NewHash() hash.Hash {
+	return sha256.New()
+}
+
+func (self defaultCryptoProvider) NewBlockCipher(key []byte) (cipher.Block, error) {
+	return aes.NewCipher(key)
+}
+
+func (self defaultCryptoProvider) VerifyPSS(pub *rsa.PublicKey, hashed, sig []byte, saltLen int) error {
+	return pss.VerifyPSS(pub, crypto.SHA256, hashed, sig, saltLen)
+}
+
+// DefaultCryptoProvider uses the standard library.
+var DefaultCryptoProvider CryptoProvider = defaultCryptoProvider{}
+
+var cryptoProviderLock sync.RWMutex
+var cryptoProvider CryptoProvider = DefaultCryptoProvider
+
+// SetCryptoProvider replaces the crypto primitives used by the
+// connections established afterwards. A nil p restores the default one.
+func SetCryptoProvider(p CryptoProvider) {
+	if p == nil {
+		p = DefaultCryptoProvider
+	}
+	cryptoProviderLock.Lock()
+	defer cryptoProviderLock.Unlock()
+	cryptoProvider = p
+}
+
+func currentCryptoProvider() CryptoProvider {
+	cryptoProviderLock.RLock()
+	defer cryptoProviderLock.RUnlock()
+	return cryptoProvider
+}
+
+// pssSigner signs with an RSA private key held in memory.
+type pssSigner struct {
+	key *rsa.PrivateKey
+}
+
+func (self *pssSigner) Public() crypto.PublicKey {
+	return &self.key.PublicKey
+}
+
+func (self *pssSigner) Sign(r io.Reader, digest []byte, opts crypto.SignerOpts) (sig []byte, err error) {
+	saltLen := pssSaltLen
+	if o, ok := opts.(*rsa.PSSOptions); ok {
+		saltLen = o.SaltLength
+	}
+	salt := make([]byte, saltLen)
+	n, err := io.ReadFull(r, salt)
+	if err != nil || n != len(salt) {
+		err = ErrZeroEntropy
+		return
+	}
+	return pss.SignPSS(r, self.key, opts.HashFunc(), digest, salt)
+}
+
+// signerOf returns the signer used by the handshake for the key. An
+// in-memory RSA key keeps being signed with the same code as before.
+func signerOf(key crypto.Signer) crypto.Signer {
+	if priv, ok := key.(*rsa.PrivateKey); ok {
+		return &pssSigner{priv}
+	}
+	return key
+}
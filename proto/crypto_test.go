@@ -0,0 +1,121 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"hash"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// opaqueSigner hides the private key like an HSM would.
+type opaqueSigner struct {
+	key *rsa.PrivateKey
+}
+
+func (self *opaqueSigner) Public() crypto.PublicKey {
+	return &self.key.PublicKey
+}
+
+func (self *opaqueSigner) Sign(r io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return self.key.Sign(r, digest, opts)
+}
+
+type countingProvider struct {
+	defaultCryptoProvider
+	nrHashes  int32
+	nrCiphers int32
+}
+
+func (self *countingProvider) NewHash() hash.Hash {
+	atomic.AddInt32(&self.nrHashes, 1)
+	return self.defaultCryptoProvider.NewHash()
+}
+
+func (self *countingProvider) NewBlockCipher(key []byte) (cipher.Block, error) {
+	atomic.AddInt32(&self.nrCiphers, 1)
+	return self.defaultCryptoProvider.NewBlockCipher(key)
+}
+
+func TestKeyExchangeWithSignerAndProvider(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := new(countingProvider)
+	SetCryptoProvider(provider)
+	defer SetCryptoProvider(nil)
+
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+	var serverKeySet *keySet
+	var es error
+	done := make(chan bool)
+	go func() {
+		serverKeySet, es = ServerKeyExchangeWithSigner(&opaqueSigner{priv}, s)
+		done <- true
+	}()
+	clientKeySet, err := ClientKeyExchange(&priv.PublicKey, c)
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	<-done
+	if es != nil {
+		t.Fatalf("server: %v", es)
+	}
+	if !serverKeySet.eq(clientKeySet) {
+		t.Fatalf("key sets not equal")
+	}
+	if atomic.LoadInt32(&provider.nrHashes) == 0 {
+		t.Errorf("the provider's hash was not used")
+	}
+
+	serverKeySet.ServerCommandIO(s)
+	if n := atomic.LoadInt32(&provider.nrCiphers); n != 2 {
+		t.Errorf("%v ciphers created by the provider; should be 2", n)
+	}
+}
+
+type ecSigner struct {
+	opaqueSigner
+}
+
+func (self *ecSigner) Public() crypto.PublicKey {
+	return "not an RSA key"
+}
+
+func TestKeyExchangeWithNonRSASigner(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+	_, err = ServerKeyExchangeWithSigner(&ecSigner{opaqueSigner{priv}}, s)
+	if err != ErrUnsupportedSigner {
+		t.Errorf("should be ErrUnsupportedSigner: %v", err)
+	}
+}
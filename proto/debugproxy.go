@@ -0,0 +1,271 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// What a DebugProxy does with a frame, i.e. a command on the wire.
+type FrameAction int
+
+const (
+	FRAME_PASS FrameAction = iota
+	FRAME_DROP
+	FRAME_DUPLICATE
+
+	// Flips a bit of the encrypted command, so that its MAC fails.
+	FRAME_CORRUPT
+
+	// Waits for the delay of the proxy before sending the frame. The
+	// frames after it wait too.
+	FRAME_DELAY
+
+	// Sends the frame after the next one which is sent. A frame held
+	// while another one is held is sent before it.
+	FRAME_REORDER
+)
+
+// FrameFilter tells what to do with the nth frame, counted from 0,
+// sent by the server if fromServer, or by the client. The frame
+// starts with its length and ends with its MAC.
+type FrameFilter func(fromServer bool, n int, frame []byte) FrameAction
+
+// DebugProxy relays a connection between a client and a server, and
+// tampers with the commands on demand, so that tests can see how the
+// peers cope with adverse networks. The key exchange is relayed as is.
+type DebugProxy struct {
+	client net.Conn
+	server net.Conn
+	sigLen int
+	macLen int
+
+	lock    sync.Mutex
+	filter  FrameFilter
+	delay   time.Duration
+	actions [2][]FrameAction
+	nrSeen  [2]int
+
+	// Tells the relay from the server if the client has asked for
+	// another key exchange packet.
+	retries   chan bool
+	closeOnce sync.Once
+	done      sync.WaitGroup
+}
+
+// NewDebugProxy relays between the connection to the client and the
+// one to the server, whose RSA key has sigLen bytes.
+func NewDebugProxy(client, server net.Conn, sigLen int) *DebugProxy {
+	ret := new(DebugProxy)
+	ret.client = client
+	ret.server = server
+	ret.sigLen = sigLen
+	ret.macLen = currentCryptoProvider().NewHash().Size()
+	ret.retries = make(chan bool, 2)
+	ret.done.Add(2)
+	go ret.relay(false, client, server)
+	go ret.relay(true, server, client)
+	return ret
+}
+
+// NewDebugPipe returns the ends of an in-memory connection relayed by
+// a DebugProxy, like net.Pipe.
+func NewDebugPipe(sigLen int) (client, server net.Conn, proxy *DebugProxy) {
+	client, pc := net.Pipe()
+	ps, server := net.Pipe()
+	proxy = NewDebugProxy(pc, ps, sigLen)
+	return
+}
+
+func direction(fromServer bool) int {
+	if fromServer {
+		return 1
+	}
+	return 0
+}
+
+// Tamper makes the proxy do the actions to the next frames from one
+// side, one frame each. The filter, if any, decides for the frames
+// after them.
+func (self *DebugProxy) Tamper(fromServer bool, actions ...FrameAction) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	d := direction(fromServer)
+	self.actions[d] = append(self.actions[d], actions...)
+}
+
+// SetFilter decides for the frames no action is given to by Tamper.
+// A nil f passes them.
+func (self *DebugProxy) SetFilter(f FrameFilter) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.filter = f
+}
+
+// SetDelay sets how long FRAME_DELAY waits.
+func (self *DebugProxy) SetDelay(d time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.delay = d
+}
+
+// NrFrames returns the number of frames sent by a side so far.
+func (self *DebugProxy) NrFrames(fromServer bool) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.nrSeen[direction(fromServer)]
+}
+
+func (self *DebugProxy) action(fromServer bool, frame []byte) (action FrameAction, delay time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	d := direction(fromServer)
+	n := self.nrSeen[d]
+	self.nrSeen[d]++
+	delay = self.delay
+	if len(self.actions[d]) > 0 {
+		action = self.actions[d][0]
+		self.actions[d] = self.actions[d][1:]
+	} else if self.filter != nil {
+		action = self.filter(fromServer, n, frame)
+	}
+	return
+}
+
+// Close closes both connections and waits for the relays.
+func (self *DebugProxy) Close() error {
+	self.closeOnce.Do(func() {
+		self.client.Close()
+		self.server.Close()
+	})
+	self.done.Wait()
+	return nil
+}
+
+func (self *DebugProxy) relay(fromServer bool, src, dst net.Conn) {
+	defer self.done.Done()
+	// Either side closing closes the other one.
+	defer func() {
+		src.Close()
+		dst.Close()
+	}()
+	var err error
+	if fromServer {
+		err = self.relayServerKeyExchange(src, dst)
+	} else {
+		err = self.relayClientKeyExchange(src, dst)
+	}
+	if err != nil {
+		return
+	}
+	self.relayFrames(fromServer, src, dst)
+}
+
+func (self *DebugProxy) relayClientKeyExchange(src, dst net.Conn) error {
+	defer close(self.retries)
+	pkt := make([]byte, 1+dhPubkeyLen+authKeyLen)
+	for {
+		if _, err := io.ReadFull(src, pkt); err != nil {
+			return err
+		}
+		if err := writen(dst, pkt); err != nil {
+			return err
+		}
+		retry := pkt[0] == keyRetryMarker
+		self.retries <- retry
+		if !retry {
+			return nil
+		}
+	}
+}
+
+func (self *DebugProxy) relayServerKeyExchange(src, dst net.Conn) error {
+	pkt := make([]byte, serverKeyExchangeLen(self.sigLen))
+	for {
+		if _, err := io.ReadFull(src, pkt[:1]); err != nil {
+			return err
+		}
+		if pkt[0] == keyRetryMarker {
+			// The server has no key the client asked for.
+			writen(dst, pkt[:1])
+			return io.EOF
+		}
+		if _, err := io.ReadFull(src, pkt[1:]); err != nil {
+			return err
+		}
+		if err := writen(dst, pkt); err != nil {
+			return err
+		}
+		retry, ok := <-self.retries
+		if !ok {
+			return io.EOF
+		}
+		if !retry {
+			return nil
+		}
+	}
+}
+
+func (self *DebugProxy) relayFrames(fromServer bool, src, dst net.Conn) {
+	var held []byte
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(src, hdr[:]); err != nil {
+			return
+		}
+		frame := make([]byte, 2+int(binary.LittleEndian.Uint16(hdr[:]))+self.macLen)
+		copy(frame, hdr[:])
+		if _, err := io.ReadFull(src, frame[2:]); err != nil {
+			return
+		}
+		action, delay := self.action(fromServer, frame)
+		var out [][]byte
+		switch action {
+		case FRAME_DROP:
+		case FRAME_DUPLICATE:
+			out = append(out, frame, frame)
+		case FRAME_CORRUPT:
+			frame[2+(len(frame)-2-self.macLen)/2] ^= 0x01
+			out = append(out, frame)
+		case FRAME_DELAY:
+			time.Sleep(delay)
+			out = append(out, frame)
+		case FRAME_REORDER:
+			if held == nil {
+				held = frame
+				continue
+			}
+			out = append(out, frame)
+		default:
+			out = append(out, frame)
+		}
+		if held != nil && len(out) > 0 {
+			out = append(out, held)
+			held = nil
+		}
+		for _, f := range out {
+			if err := writen(dst, f); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const testSigLen = 128
+
+// fakeKeyExchange writes the key exchange packets of both sides
+// through the proxy.
+func fakeKeyExchange(t *testing.T, client, server net.Conn) {
+	spkt := make([]byte, serverKeyExchangeLen(testSigLen))
+	spkt[0] = currentProtocolVersion
+	cpkt := make([]byte, 1+dhPubkeyLen+authKeyLen)
+	cpkt[0] = currentProtocolVersion
+	go writen(server, spkt)
+	if _, err := io.ReadFull(client, spkt); err != nil {
+		t.Fatal(err)
+	}
+	go writen(client, cpkt)
+	if _, err := io.ReadFull(server, cpkt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testFrame returns a frame whose bytes are all b.
+func testFrame(b byte) []byte {
+	frame := bytes.Repeat([]byte{b}, 2+16+32)
+	binary.LittleEndian.PutUint16(frame, 16)
+	return frame
+}
+
+func readFrames(t *testing.T, c net.Conn, n int) (frames [][]byte) {
+	for i := 0; i < n; i++ {
+		frame := make([]byte, len(testFrame(0)))
+		if _, err := io.ReadFull(c, frame); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	return
+}
+
+func TestDebugProxyActions(t *testing.T) {
+	client, server, proxy := NewDebugPipe(testSigLen)
+	defer proxy.Close()
+	fakeKeyExchange(t, client, server)
+
+	proxy.Tamper(true, FRAME_DROP, FRAME_DUPLICATE, FRAME_REORDER, FRAME_PASS, FRAME_CORRUPT)
+	go func() {
+		for b := byte(1); b <= 6; b++ {
+			writen(server, testFrame(b))
+		}
+	}()
+	frames := readFrames(t, client, 6)
+	for i, b := range []byte{2, 2, 4, 3, 0, 6} {
+		if b == 0 {
+			if bytes.Equal(frames[i], testFrame(5)) || len(frames[i]) != len(testFrame(5)) {
+				t.Errorf("frame %v should be corrupted", i)
+			}
+			continue
+		}
+		if !bytes.Equal(frames[i], testFrame(b)) {
+			t.Errorf("frame %v should be %v: %v", i, b, frames[i])
+		}
+	}
+	if n := proxy.NrFrames(true); n != 6 {
+		t.Errorf("bad number of frames: %v", n)
+	}
+
+	proxy.SetDelay(50 * time.Millisecond)
+	proxy.SetFilter(func(fromServer bool, n int, frame []byte) FrameAction {
+		if fromServer || n != 1 {
+			return FRAME_PASS
+		}
+		return FRAME_DELAY
+	})
+	go func() {
+		writen(client, testFrame(1))
+		writen(client, testFrame(2))
+	}()
+	start := time.Now()
+	frames = readFrames(t, server, 1)
+	if d := time.Since(start); d >= 50*time.Millisecond || !bytes.Equal(frames[0], testFrame(1)) {
+		t.Errorf("the first frame should not be delayed: %v", d)
+	}
+	frames = readFrames(t, server, 1)
+	if d := time.Since(start); d < 50*time.Millisecond || !bytes.Equal(frames[0], testFrame(2)) {
+		t.Errorf("the second frame should be delayed: %v", d)
+	}
+}
+
+func TestDebugProxyCommands(t *testing.T) {
+	priv := generateTestKeys(t, 1)[0]
+	c, s, proxy := NewDebugPipe(testSigLen)
+	defer proxy.Close()
+	var sks *keySet
+	var serr error
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		sks, serr = ServerKeyExchange(priv, s)
+	}()
+	cks, err := ClientKeyExchange(&priv.PublicKey, c)
+	<-done
+	if err != nil || serr != nil {
+		t.Fatalf("Error: %v %v", err, serr)
+	}
+	sio := sks.ServerCommandIO(s)
+	cio := cks.ClientCommandIO(c)
+
+	cmd := randomCommand()
+	go cio.WriteCommand(cmd, true)
+	if recved, err := sio.ReadCommand(); err != nil || !cmd.eq(recved) {
+		t.Errorf("bad command: %v %v", recved, err)
+	}
+
+	proxy.Tamper(false, FRAME_CORRUPT)
+	go cio.WriteCommand(cmd, true)
+	if _, err := sio.ReadCommand(); err != ErrCorruptedData {
+		t.Errorf("should be corrupted: %v", err)
+	}
+
+	// A replayed command is decrypted with the wrong key stream.
+	proxy.Tamper(true, FRAME_DUPLICATE)
+	go sio.WriteCommand(cmd, false)
+	if recved, err := cio.ReadCommand(); err != nil || !cmd.eq(recved) {
+		t.Errorf("bad command: %v %v", recved, err)
+	}
+	if recved, err := cio.ReadCommand(); err == nil && cmd.eq(recved) {
+		t.Errorf("the replayed command should not be read")
+	}
+}
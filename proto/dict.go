@@ -0,0 +1,99 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+var ErrNoDictionary = errors.New("command compressed with an unknown dictionary")
+var ErrTooLarge = errors.New("decompressed command too large")
+
+// The largest command decompressed with a dictionary.
+const maxDecompressedLen = 16 * 1024 * 1024
+
+// Dictionary is a preset dictionary for compressing the commands of
+// a service, e.g. the common header keys and JSON scaffolding of its
+// messages. Both peers must have the same data for the same id.
+// It is goroutine-safe.
+type Dictionary struct {
+	Id   string
+	Data []byte
+
+	writers sync.Pool
+	readers sync.Pool
+}
+
+// NewDictionary returns a dictionary. The id should not contain ','.
+func NewDictionary(id string, data []byte) *Dictionary {
+	ret := new(Dictionary)
+	ret.Id = id
+	ret.Data = data
+	return ret
+}
+
+func (self *Dictionary) compress(data []byte) (out []byte, err error) {
+	buf := new(bytes.Buffer)
+	w, ok := self.writers.Get().(*flate.Writer)
+	if ok {
+		// Reset() keeps the dictionary.
+		w.Reset(buf)
+	} else {
+		w, err = flate.NewWriterDict(buf, flate.BestCompression, self.Data)
+		if err != nil {
+			return
+		}
+	}
+	defer self.writers.Put(w)
+	if _, err = w.Write(data); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	out = buf.Bytes()
+	return
+}
+
+func (self *Dictionary) decompress(data []byte) (out []byte, err error) {
+	src := bytes.NewReader(data)
+	r, ok := self.readers.Get().(io.ReadCloser)
+	if ok {
+		err = r.(flate.Resetter).Reset(src, self.Data)
+		if err != nil {
+			return
+		}
+	} else {
+		r = flate.NewReaderDict(src, self.Data)
+	}
+	defer self.readers.Put(r)
+	out, err = ioutil.ReadAll(io.LimitReader(r, maxDecompressedLen+1))
+	if err != nil {
+		return
+	}
+	if len(out) > maxDecompressedLen {
+		out = nil
+		err = ErrTooLarge
+	}
+	return
+}
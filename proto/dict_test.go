@@ -0,0 +1,79 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDictionaryCompression(t *testing.T) {
+	dict := NewDictionary("chat-v1", []byte(`{"type":"chat","text":"","sender":""}`))
+	io1, io2, buffer, _ := getBufferCommandIOs(t)
+	io1.SetDictionary(dict)
+	io2.SetDictionary(dict)
+
+	cmd := &Command{Type: CMD_DATA, Params: []string{"id"}}
+	cmd.Message = &Message{Body: []byte(`{"type":"chat","text":"hi","sender":"alice"}`)}
+	plain, err := io1.encodeCommand(cmd, false)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	compressed, err := io1.encodeCommand(cmd, true)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if compressed[0]&cmdflag_DICT == 0 || len(compressed) >= len(plain) {
+		t.Errorf("not compressed with the dictionary: %v bytes vs %v bytes", len(compressed), len(plain))
+	}
+
+	for i := 0; i < 3; i++ {
+		err = io1.WriteCommand(cmd, true)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		recved, err := io2.ReadCommand()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !recved.eq(cmd) {
+			t.Errorf("corrupted command: %v", recved)
+		}
+	}
+
+	// A peer without the dictionary cannot read the command.
+	io2.SetDictionary(nil)
+	io1.WriteCommand(cmd, true)
+	if _, err = io2.ReadCommand(); err != ErrNoDictionary {
+		t.Errorf("read a command without the dictionary: %v", err)
+	}
+	if buffer.Len() != 0 {
+		t.Errorf("%v bytes left", buffer.Len())
+	}
+}
+
+func TestDictionaryRejectsLargeOutput(t *testing.T) {
+	dict := NewDictionary("d", nil)
+	data, err := dict.compress(bytes.Repeat([]byte{0}, maxDecompressedLen+1))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = dict.decompress(data); err != ErrTooLarge {
+		t.Errorf("decompressed too much: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"encoding/json"
+)
+
+// The digest info field carrying the number of unread messages of the
+// user, including the message of the digest, if the server counts them.
+const UnreadInfo = "uniqush.unread"
+
+// DigestEntry is the digest of one message in a CMD_DIGEST_BATCH.
+type DigestEntry struct {
+	MsgId         string            `json:"id"`
+	Size          int               `json:"size"`
+	Sender        string            `json:"sender,omitempty"`
+	SenderService string            `json:"service,omitempty"`
+	Seq           uint64            `json:"seq,omitempty"`
+	ThreadId      string            `json:"thread,omitempty"`
+	Info          map[string]string `json:"info,omitempty"`
+}
+
+// UnmarshalDigestBatch decodes the body of a CMD_DIGEST_BATCH.
+func UnmarshalDigestBatch(data []byte) (entries []*DigestEntry, err error) {
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		entries = nil
+		err = ErrMalformedCommand
+	}
+	return
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var ErrNoSessionKeys = errors.New("no session keys for the key exchange")
+
+// The lengths of the signatures looked for in a captured key
+// exchange, i.e. those of the 2048, 1024, 3072 and 4096-bit RSA keys.
+var sigLens = []int{256, 128, 384, 512}
+
+// serverKeyExchangeLen returns the length of the key exchange packet
+// of a server signing with an RSA key of sigLen bytes.
+func serverKeyExchangeLen(sigLen int) int {
+	return 1 + dhPubkeyLen + sigLen + nonceLen
+}
+
+// peekSessionKeys looks for the keys of the key exchange packet after
+// the first skip bytes of r. It returns the length of the packet.
+func peekSessionKeys(r *bufio.Reader, skip int, keys map[string]*SessionKeys) (sk *SessionKeys, n int) {
+	for _, l := range sigLens {
+		n = serverKeyExchangeLen(l)
+		pkt, err := r.Peek(skip + n)
+		if err != nil || pkt[skip] != currentProtocolVersion {
+			continue
+		}
+		if sk = keys[hex.EncodeToString(pkt[len(pkt)-nonceLen:])]; sk != nil {
+			return
+		}
+	}
+	return nil, 0
+}
+
+// readClientKeyExchange reads a key exchange packet of the client.
+// If retry, the client has asked the server to sign with another key.
+func readClientKeyExchange(r io.Reader) (retry bool, err error) {
+	pkt := make([]byte, 1+dhPubkeyLen+authKeyLen)
+	if _, err = io.ReadFull(r, pkt); err != nil {
+		return
+	}
+	retry = pkt[0] == keyRetryMarker
+	if !retry && pkt[0] > currentProtocolVersion {
+		err = ErrImcompatibleProtocol
+	}
+	return
+}
+
+// SkipKeyExchange reads the key exchange captured from both sides of
+// a connection, and returns the keys it has derived among keys. The
+// commands follow in both readers.
+func SkipKeyExchange(fromServer *bufio.Reader, fromClient io.Reader, keys map[string]*SessionKeys) (sk *SessionKeys, err error) {
+	retry, err := readClientKeyExchange(fromClient)
+	if err != nil {
+		return
+	}
+	var n int
+	if !retry {
+		sk, n = peekSessionKeys(fromServer, 0, keys)
+	} else {
+		// The first packet was signed by a key the client does not
+		// have, so its keys were not logged.
+		for _, l := range sigLens {
+			skip := serverKeyExchangeLen(l)
+			if sk, n = peekSessionKeys(fromServer, skip, keys); sk != nil {
+				n += skip
+				break
+			}
+		}
+		if sk != nil {
+			retry, err = readClientKeyExchange(fromClient)
+			if err == nil && retry {
+				err = ErrBadKeyExchangePacket
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	if sk == nil {
+		err = ErrNoSessionKeys
+		return
+	}
+	_, err = fromServer.Discard(n)
+	return
+}
+
+// CommandReader returns a CommandIO reading the commands written by
+// the server, if fromServer, or by the client from r. What is written
+// to it is discarded.
+func (self *SessionKeys) CommandReader(r io.Reader, fromServer bool) *CommandIO {
+	ks := newKeySet(self.ServerEncrKey, self.ServerAuthKey, self.ClientEncrKey, self.ClientAuthKey)
+	conn := &struct {
+		io.Reader
+		io.Writer
+	}{r, ioutil.Discard}
+	var ret *CommandIO
+	if fromServer {
+		ret = ks.ClientCommandIO(conn)
+	} else {
+		ret = ks.ServerCommandIO(conn)
+	}
+	// Either side may have sent the public messages in plaintext.
+	ret.SetPlaintext(true)
+	return ret
+}
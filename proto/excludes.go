@@ -0,0 +1,104 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// Values of the parameters of CMD_REQ_ALL_CACHED.
+const (
+	// The excludes are length-prefixed.
+	EXCLUDES_LENGTH_PREFIXED = "2"
+
+	// More excludes follow in the next CMD_REQ_ALL_CACHED.
+	EXCLUDES_MORE = "1"
+)
+
+// The largest body of excludes in a command, which leaves room for
+// the rest of the command in maxCommandLen.
+const MaxExcludesChunk = 32 * 1024
+
+// EncodeExcludes encodes the ids each prefixed by its length as an
+// uvarint, in chunks no longer than MaxExcludesChunk. An id which
+// does not fit in a chunk is an ErrCommandTooLarge.
+func EncodeExcludes(ids []string) (chunks [][]byte, err error) {
+	var chunk []byte
+	var buf [binary.MaxVarintLen64]byte
+	for _, id := range ids {
+		n := binary.PutUvarint(buf[:], uint64(len(id)))
+		if n+len(id) > MaxExcludesChunk {
+			err = ErrCommandTooLarge
+			chunks = nil
+			return
+		}
+		if len(chunk)+n+len(id) > MaxExcludesChunk {
+			chunks = append(chunks, chunk)
+			chunk = nil
+		}
+		if chunk == nil {
+			chunk = make([]byte, 0, MaxExcludesChunk)
+		}
+		chunk = append(chunk, buf[:n]...)
+		chunk = append(chunk, id...)
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return
+}
+
+// DecodeExcludes decodes a chunk made by EncodeExcludes.
+func DecodeExcludes(data []byte) (ids []string, err error) {
+	for len(data) > 0 {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || l > uint64(len(data)-n) {
+			ids = nil
+			err = ErrMalformedCommand
+			return
+		}
+		data = data[n:]
+		ids = append(ids, string(data[:l]))
+		data = data[l:]
+	}
+	return
+}
+
+// EncodeLegacyExcludes encodes the ids each followed by a '\0', as
+// understood by every server. ok is false if an id has a '\0', or if
+// they do not fit in one chunk.
+func EncodeLegacyExcludes(ids []string) (data []byte, ok bool) {
+	n := 0
+	for _, id := range ids {
+		if strings.IndexByte(id, 0) >= 0 {
+			return
+		}
+		n += len(id) + 1
+	}
+	if n > MaxExcludesChunk {
+		return
+	}
+	data = make([]byte, 0, n)
+	for _, id := range ids {
+		data = append(data, id...)
+		data = append(data, 0)
+	}
+	ok = true
+	return
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestExcludes(t *testing.T) {
+	ids := []string{"a", "with\x00zero", "", fmt.Sprintf("%0100d", 1)}
+	for i := 0; i < 2000; i++ {
+		ids = append(ids, fmt.Sprintf("message-id-%032d", i))
+	}
+	chunks, err := EncodeExcludes(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) < 2 {
+		t.Errorf("%v chunks", len(chunks))
+	}
+	var decoded []string
+	for _, chunk := range chunks {
+		if len(chunk) > MaxExcludesChunk {
+			t.Errorf("chunk of %v bytes", len(chunk))
+		}
+		d, err := DecodeExcludes(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, d...)
+	}
+	if len(decoded) != len(ids) {
+		t.Fatalf("%v ids decoded", len(decoded))
+	}
+	for i, id := range ids {
+		if decoded[i] != id {
+			t.Errorf("id %v: %q instead of %q", i, decoded[i], id)
+		}
+	}
+	if _, err = EncodeExcludes([]string{string(make([]byte, MaxExcludesChunk))}); err != ErrCommandTooLarge {
+		t.Errorf("should reject a long id: %v", err)
+	}
+	if _, err = DecodeExcludes([]byte{5, 'a', 'b'}); err != ErrMalformedCommand {
+		t.Errorf("should reject a truncated id: %v", err)
+	}
+	if _, ok := EncodeLegacyExcludes(ids[:2]); ok {
+		t.Errorf("an id with a zero byte cannot be encoded")
+	}
+	if _, ok := EncodeLegacyExcludes(ids); ok {
+		t.Errorf("the ids do not fit in a chunk")
+	}
+	if data, ok := EncodeLegacyExcludes([]string{"a", "b"}); !ok || string(data) != "a\x00b\x00" {
+		t.Errorf("bad legacy excludes: %q", data)
+	}
+}
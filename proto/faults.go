@@ -0,0 +1,168 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Faults are the network failures a FaultyConn injects. The zero
+// value injects none.
+type Faults struct {
+	// Latency delays every write.
+	Latency time.Duration
+
+	// MaxWriteLen, if positive, splits the writes into chunks of at
+	// most that many bytes, so that the peer reads the commands in
+	// pieces.
+	MaxWriteLen int
+
+	// MaxReadLen, if positive, bounds the bytes returned by a read.
+	MaxReadLen int
+
+	// ResetAfter, if positive, resets the connection once that many
+	// bytes have been written in total, which is usually in the
+	// middle of a command.
+	ResetAfter int64
+}
+
+type injectedReset struct{}
+
+func (self injectedReset) Error() string   { return "connection reset by the injected faults" }
+func (self injectedReset) Timeout() bool   { return false }
+func (self injectedReset) Temporary() bool { return false }
+
+// ErrInjectedReset is returned by a FaultyConn which has been reset.
+var ErrInjectedReset net.Error = injectedReset{}
+
+// FaultyConn injects faults to the connection it wraps. It is meant
+// for the tests of the reconnection and the replay of the cached
+// messages; wrap the connection before giving it to AuthConn or Dial.
+type FaultyConn struct {
+	net.Conn
+
+	lock      sync.Mutex
+	faults    Faults
+	nrWritten int64
+	reset     bool
+	writeLock sync.Mutex
+}
+
+func NewFaultyConn(conn net.Conn, faults *Faults) *FaultyConn {
+	ret := &FaultyConn{Conn: conn}
+	ret.SetFaults(faults)
+	return ret
+}
+
+// SetFaults changes the faults injected afterwards. A nil faults
+// injects none.
+func (self *FaultyConn) SetFaults(faults *Faults) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.faults = Faults{}
+	if faults != nil {
+		self.faults = *faults
+	}
+}
+
+// NrWritten returns the bytes written so far.
+func (self *FaultyConn) NrWritten() int64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.nrWritten
+}
+
+// Reset closes the connection as if the peer had reset it.
+func (self *FaultyConn) Reset() {
+	self.lock.Lock()
+	self.reset = true
+	self.lock.Unlock()
+	self.Conn.Close()
+}
+
+func (self *FaultyConn) isReset() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.reset
+}
+
+// nextChunk() returns how many bytes of p to write next, and if the
+// connection should be reset after them.
+func (self *FaultyConn) nextChunk(p []byte) (n int, latency time.Duration, reset bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	n = len(p)
+	if f := self.faults.MaxWriteLen; f > 0 && n > f {
+		n = f
+	}
+	if f := self.faults.ResetAfter; f > 0 && self.nrWritten+int64(n) >= f {
+		n = int(f - self.nrWritten)
+		if n < 0 {
+			n = 0
+		}
+		reset = true
+	}
+	self.nrWritten += int64(n)
+	latency = self.faults.Latency
+	return
+}
+
+func (self *FaultyConn) Write(p []byte) (n int, err error) {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	for n < len(p) {
+		if self.isReset() {
+			err = ErrInjectedReset
+			return
+		}
+		l, latency, reset := self.nextChunk(p[n:])
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+		if l > 0 {
+			l, err = self.Conn.Write(p[n : n+l])
+			n += l
+			if err != nil {
+				return
+			}
+		}
+		if reset {
+			self.Reset()
+		}
+	}
+	return
+}
+
+func (self *FaultyConn) Read(p []byte) (n int, err error) {
+	if self.isReset() {
+		err = ErrInjectedReset
+		return
+	}
+	self.lock.Lock()
+	if f := self.faults.MaxReadLen; f > 0 && len(p) > f {
+		p = p[:f]
+	}
+	self.lock.Unlock()
+	n, err = self.Conn.Read(p)
+	if err != nil && self.isReset() {
+		err = ErrInjectedReset
+	}
+	return
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFaultyConnPartialWrites(t *testing.T) {
+	s, c := net.Pipe()
+	defer c.Close()
+	fc := NewFaultyConn(s, &Faults{MaxWriteLen: 3, Latency: time.Millisecond})
+	defer fc.Close()
+	data := []byte("0123456789")
+	start := time.Now()
+	go fc.Write(data)
+	var got []byte
+	for len(got) < len(data) {
+		buf := make([]byte, 16)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 3 {
+			t.Errorf("read %v bytes at once", n)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("bad data: %q", got)
+	}
+	if d := time.Since(start); d < 4*time.Millisecond {
+		t.Errorf("the chunks are not delayed: %v", d)
+	}
+}
+
+func TestFaultyConnReset(t *testing.T) {
+	s, c := net.Pipe()
+	defer c.Close()
+	fc := NewFaultyConn(s, nil)
+	done := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(c)
+		done <- data
+	}()
+	fc.Write([]byte("012"))
+	fc.SetFaults(&Faults{ResetAfter: fc.NrWritten() + 4})
+	n, err := fc.Write([]byte("3456789"))
+	if n != 4 || err != ErrInjectedReset {
+		t.Errorf("wrote %v bytes: %v", n, err)
+	}
+	if data := <-done; string(data) != "0123456" {
+		t.Errorf("bad data: %q", data)
+	}
+	if _, err := fc.Write([]byte("a")); err != ErrInjectedReset {
+		t.Errorf("should be reset: %v", err)
+	}
+	if _, err := fc.Read(make([]byte, 1)); err != ErrInjectedReset {
+		t.Errorf("should be reset: %v", err)
+	}
+}
+
+func TestCommandsOverFaultyConn(t *testing.T) {
+	_, _, _, ks := getBufferCommandIOs(t)
+	s, c := net.Pipe()
+	faults := &Faults{MaxWriteLen: 3, MaxReadLen: 5}
+	w := ks.ServerCommandIO(NewFaultyConn(s, faults))
+	r := ks.ClientCommandIO(NewFaultyConn(c, faults))
+	cmds := []*Command{randomCommand(), randomCommand()}
+	go func() {
+		for _, cmd := range cmds {
+			w.WriteCommand(cmd, true)
+		}
+	}()
+	for i, cmd := range cmds {
+		recved, err := r.ReadCommand()
+		if err != nil || !cmd.eq(recved) {
+			t.Errorf("command %v: %v %v", i, recved, err)
+		}
+	}
+
+	// Reset in the middle of a command.
+	s, c = net.Pipe()
+	w = ks.ServerCommandIO(NewFaultyConn(s, &Faults{ResetAfter: 10}))
+	r = ks.ClientCommandIO(c)
+	go w.WriteCommand(cmds[0], false)
+	if _, err := r.ReadCommand(); err != io.ErrUnexpectedEOF && err != io.EOF {
+		t.Errorf("should fail: %v", err)
+	}
+}
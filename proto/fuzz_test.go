@@ -0,0 +1,216 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+)
+
+// Run the targets with e.g. go test -fuzz FuzzUnmarshalCommand ./proto
+
+func seedCommands() [][]byte {
+	cmds := []*Command{
+		&Command{Type: CMD_AUTH, Params: []string{"service", "user", "token"}},
+		&Command{Type: CMD_DATA, Params: []string{"id"}, Message: &Message{
+			Header: map[string]string{"title": "hello"},
+			Body:   []byte("world"),
+		}},
+		&Command{Type: CMD_FWD, Message: &Message{
+			BinaryHeader: map[string][]byte{"sig": []byte{0, 1, 2}},
+			Opaque:       true,
+		}},
+	}
+	ret := make([][]byte, 0, len(cmds))
+	for _, cmd := range cmds {
+		data, err := cmd.Marshal()
+		if err != nil {
+			panic(err)
+		}
+		ret = append(ret, data)
+	}
+	return ret
+}
+
+func FuzzUnmarshalCommand(f *testing.F) {
+	for _, data := range seedCommands() {
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cmd, err := UnmarshalCommand(data)
+		if err != nil {
+			return
+		}
+		encoded, err := cmd.Marshal()
+		if err != nil {
+			return
+		}
+		again, err := UnmarshalCommand(encoded)
+		if err != nil {
+			t.Fatalf("cannot decode the re-encoded command: %v", err)
+		}
+		if !again.eq(cmd) {
+			t.Fatalf("re-encoded command differs: %v; %v", cmd, again)
+		}
+	})
+}
+
+func FuzzDecodeCommand(f *testing.F) {
+	for _, data := range seedCommands() {
+		f.Add(addFlagAndPadding(data, 0))
+		f.Add(addFlagAndPadding(data, cmdflag_COMPRESS))
+	}
+	cmdio := new(CommandIO)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cmd, err := cmdio.decodeCommand(data, nil)
+		if err == nil && cmd.Message != nil {
+			cmd.Message.Release()
+		}
+
+		buf := getBuffer()
+		if len(data) > len(buf.data) {
+			buf.release()
+			return
+		}
+		n := copy(buf.data, data)
+		cmd, err = cmdio.decodeCommand(buf.data[:n], buf)
+		if err == nil && cmd.Message != nil {
+			cmd.Message.Release()
+		}
+	})
+}
+
+// fuzzConn reads the data given by the fuzzer and drops the writes.
+type fuzzConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (self *fuzzConn) Read(p []byte) (int, error) {
+	return self.r.Read(p)
+}
+
+func (self *fuzzConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+var fuzzKeyOnce sync.Once
+var fuzzKey *rsa.PrivateKey
+
+func getFuzzKey() *rsa.PrivateKey {
+	fuzzKeyOnce.Do(func() {
+		var err error
+		fuzzKey, err = rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			panic(err)
+		}
+	})
+	return fuzzKey
+}
+
+// The server parses the packet of the client.
+func FuzzServerKeyExchange(f *testing.F) {
+	pkt := make([]byte, 1+dhPubkeyLen+authKeyLen)
+	pkt[0] = currentProtocolVersion
+	pkt[dhPubkeyLen] = 2
+	f.Add(pkt)
+	retry := make([]byte, len(pkt))
+	retry[0] = keyRetryMarker
+	f.Add(retry)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ServerKeyExchange(getFuzzKey(), &fuzzConn{r: bytes.NewReader(data)})
+	})
+}
+
+// The client parses the packet of the server.
+func FuzzClientKeyExchange(f *testing.F) {
+	key := getFuzzKey()
+	siglen := (key.N.BitLen() + 7) / 8
+	pkt := make([]byte, 1+dhPubkeyLen+siglen+nonceLen)
+	pkt[0] = currentProtocolVersion
+	f.Add(pkt)
+	f.Add([]byte{keyRetryMarker})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ClientKeyExchange(&key.PublicKey, &fuzzConn{r: bytes.NewReader(data)})
+	})
+}
+
+func TestDecodeMalformedCommand(t *testing.T) {
+	cmdio := new(CommandIO)
+	bomb := make([]byte, binary.MaxVarintLen64)
+	bomb = bomb[:binary.PutUvarint(bomb, 1<<32)]
+	cases := []struct {
+		data []byte
+		err  error
+	}{
+		{nil, ErrMalformedCommand},
+		// 15 bytes of padding in a 2-byte command
+		{[]byte{0x0F << 3, 0}, ErrMalformedCommand},
+		{addFlagAndPadding([]byte{CMD_DATA, 0}, 0), ErrMalformedCommand},
+		{addFlagAndPadding(bomb, cmdflag_COMPRESS), ErrTooLarge},
+	}
+	for i, c := range cases {
+		_, err := cmdio.decodeCommand(c.data, nil)
+		if err != c.err {
+			t.Errorf("case %v: error %v, not %v", i, err, c.err)
+		}
+	}
+}
+
+func TestUnterminatedString(t *testing.T) {
+	// One parameter without its terminator.
+	data := []byte{CMD_AUTH, 1 << 4, 0, 0, 'a', 'b'}
+	if _, err := UnmarshalCommand(data); err != ErrMalformedCommand {
+		t.Errorf("should be ErrMalformedCommand: %v", err)
+	}
+}
+
+func TestHeaderBomb(t *testing.T) {
+	// 65535 headers are announced, but there is only one.
+	data := []byte{CMD_DATA, 0, 0xFF, 0xFF, 'k', 0, 'v', 0}
+	if _, err := UnmarshalCommand(data); err != ErrMalformedCommand {
+		t.Errorf("should be ErrMalformedCommand: %v", err)
+	}
+	if n := sizeHint(0xFFFF, data[4:], 2); n != 2 {
+		t.Errorf("bad size hint: %v", n)
+	}
+}
+
+func TestBadDHPublicKey(t *testing.T) {
+	for _, y := range [][]byte{{0}, {1}, dhPrimeMinusOne.Bytes(), dhPrime.Bytes()} {
+		if _, err := parseDHPublicKey(leftPaddingZero(y, dhPubkeyLen)); err != ErrBadKeyExchangePacket {
+			t.Errorf("%x should be rejected: %v", y, err)
+		}
+	}
+	if _, err := parseDHPublicKey([]byte{2}); err != nil {
+		t.Errorf("error: %v", err)
+	}
+}
+
+func TestWriteTooLargeCommand(t *testing.T) {
+	cmdio := new(CommandIO)
+	err := cmdio.writeEncoded(&Command{}, make([]byte, maxCommandLen+1), false)
+	if err != ErrCommandTooLarge {
+		t.Errorf("should be ErrCommandTooLarge: %v", err)
+	}
+}
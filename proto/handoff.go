@@ -0,0 +1,179 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var ErrInterrupted = errors.New("reads interrupted")
+var ErrNotInterruptible = errors.New("the connection has no read deadline")
+
+// CommandIOState is what another process needs to go on with the
+// command streams of a connection: the session keys, and the number of
+// bytes encrypted and decrypted with them. It holds the keys of the
+// connection, and should only be passed to a trusted process.
+type CommandIOState struct {
+	WriteKey     []byte `json:"writeKey"`
+	WriteAuthKey []byte `json:"writeAuthKey"`
+	ReadKey      []byte `json:"readKey"`
+	ReadAuthKey  []byte `json:"readAuthKey"`
+	NrWritten    uint64 `json:"nrWritten"`
+	NrRead       uint64 `json:"nrRead"`
+	Plaintext    bool   `json:"plaintext,omitempty"`
+
+	// DictionaryId is the id of the dictionary negotiated at handshake.
+	DictionaryId string `json:"dictionaryId,omitempty"`
+}
+
+// State() returns the state of the command streams. It should only
+// be called when no command is being read or written, e.g. once the
+// reads are interrupted and the writes are done, and no command should
+// be read or written afterwards.
+func (self *CommandIO) State() *CommandIOState {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	ret := &CommandIOState{
+		WriteKey:     copyBytes(self.keys[0]),
+		WriteAuthKey: copyBytes(self.keys[1]),
+		ReadKey:      copyBytes(self.keys[2]),
+		ReadAuthKey:  copyBytes(self.keys[3]),
+		NrWritten:    self.writeStream.n,
+		NrRead:       self.readStream.n,
+		Plaintext:    self.plaintext,
+	}
+	if self.dict != nil {
+		ret.DictionaryId = self.dict.Id
+	}
+	return ret
+}
+
+// RestoreCommandIO goes on with the command streams of the state on
+// conn, which is the same connection, e.g. handed off by another
+// process. dict should be the dictionary of state.DictionaryId, if
+// there is one.
+func RestoreCommandIO(state *CommandIOState, conn io.ReadWriter, dict *Dictionary) (cmdio *CommandIO, err error) {
+	if len(state.DictionaryId) > 0 && (dict == nil || dict.Id != state.DictionaryId) {
+		err = ErrNoDictionary
+		return
+	}
+	cmdio = newCommandIOAt(currentCryptoProvider(), state.WriteKey, state.WriteAuthKey,
+		state.ReadKey, state.ReadAuthKey, conn, state.NrWritten, state.NrRead)
+	cmdio.plaintext = state.Plaintext
+	if len(state.DictionaryId) > 0 {
+		cmdio.dict = dict
+	}
+	return
+}
+
+// Interrupt() makes ReadCommand() fail with ErrInterrupted between two
+// commands, so that the state of the streams can be taken. It only
+// works if the connection has a read deadline, e.g. if it is a
+// net.Conn, and it cannot be undone.
+func (self *CommandIO) Interrupt() error {
+	r := self.interruption
+	if r == nil {
+		return ErrNotInterruptible
+	}
+	atomic.StoreInt32(&r.interrupted, 1)
+	return r.conn.SetReadDeadline(time.Now())
+}
+
+type deadlineReadWriter interface {
+	io.ReadWriter
+	SetReadDeadline(t time.Time) error
+}
+
+// interruptibleReader stops the reads with the read deadline once it
+// is interrupted. The command being read is read to its end first.
+type interruptibleReader struct {
+	conn        deadlineReadWriter
+	interrupted int32
+
+	// started is set once the command being read is started. It is
+	// only used by the reading goroutine.
+	started bool
+}
+
+func (self *interruptibleReader) isInterrupted() bool {
+	return atomic.LoadInt32(&self.interrupted) != 0
+}
+
+func (self *interruptibleReader) Read(p []byte) (n int, err error) {
+	for {
+		n, err = self.conn.Read(p)
+		if n > 0 {
+			self.started = true
+		}
+		if err == nil || !self.isInterrupted() {
+			return
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return
+		}
+		if !self.started {
+			return 0, ErrInterrupted
+		}
+		// Read the rest of the command.
+		self.conn.SetReadDeadline(time.Time{})
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// countingStream counts the bytes of the key stream used so far.
+type countingStream struct {
+	cipher.Stream
+	n uint64
+}
+
+func (self *countingStream) XORKeyStream(dst, src []byte) {
+	self.Stream.XORKeyStream(dst, src)
+	self.n += uint64(len(src))
+}
+
+// newCountingCTR returns the CTR stream of the block, with an IV of
+// 0, after its first offset bytes.
+func newCountingCTR(block cipher.Block, offset uint64) *countingStream {
+	bs := uint64(block.BlockSize())
+	iv := make([]byte, bs)
+	// The counter is the IV as a big-endian number.
+	binary.BigEndian.PutUint64(iv[len(iv)-8:], offset/bs)
+	s := cipher.NewCTR(block, iv)
+	if r := offset % bs; r > 0 {
+		skip := make([]byte, r)
+		s.XORKeyStream(skip, skip)
+	}
+	return &countingStream{s, offset}
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	ret := make([]byte, len(b))
+	copy(ret, b)
+	return ret
+}
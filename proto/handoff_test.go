@@ -0,0 +1,119 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRestoreCommandIO(t *testing.T) {
+	sks, cks, s2c, c2s := exchangeKeysOrReport(t, true)
+	if sks == nil || cks == nil || s2c == nil || c2s == nil {
+		return
+	}
+	defer s2c.Close()
+	defer c2s.Close()
+	scmdio := sks.ServerCommandIO(s2c)
+	ccmdio := cks.ClientCommandIO(c2s)
+	testSendingCommands(t, nil, true, true, scmdio, ccmdio, randomCommand(), randomCommand())
+	testSendingCommands(t, nil, false, true, ccmdio, scmdio, randomCommand())
+
+	restored, err := RestoreCommandIO(scmdio.State(), s2c, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	testSendingCommands(t, nil, false, true, restored, ccmdio, randomCommand(), randomCommand())
+	testSendingCommands(t, nil, true, true, ccmdio, restored, randomCommand(), randomCommand())
+}
+
+func TestInterruptBetweenCommands(t *testing.T) {
+	sks, cks, s2c, c2s := exchangeKeysOrReport(t, true)
+	if sks == nil || cks == nil || s2c == nil || c2s == nil {
+		return
+	}
+	defer s2c.Close()
+	defer c2s.Close()
+	scmdio := sks.ServerCommandIO(s2c)
+
+	// Send a command in two parts, with the interruption in between.
+	buf := new(bytes.Buffer)
+	bufio := cks.ClientCommandIO(buf)
+	cmd := randomCommand()
+	if err := bufio.WriteCommand(cmd, false); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data := buf.Bytes()
+	c2s.Write(data[:5])
+
+	type readResult struct {
+		cmd *Command
+		err error
+	}
+	results := make(chan *readResult)
+	go func() {
+		for {
+			cmd, err := scmdio.ReadCommand()
+			results <- &readResult{cmd, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := scmdio.Interrupt(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	c2s.Write(data[5:])
+
+	res := <-results
+	if res.err != nil || !cmd.eq(res.cmd) {
+		t.Fatalf("the command being read is lost: %v", res.err)
+	}
+	res = <-results
+	if res.err != ErrInterrupted {
+		t.Fatalf("not interrupted: %v", res.err)
+	}
+
+	// Both sides go on.
+	restored, err := RestoreCommandIO(scmdio.State(), s2c, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ccmdio, err := RestoreCommandIO(bufio.State(), c2s, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	testSendingCommands(t, nil, true, true, ccmdio, restored, randomCommand(), randomCommand())
+	testSendingCommands(t, nil, false, true, restored, ccmdio, randomCommand())
+}
+
+func TestRestoreCommandIOWithoutDictionary(t *testing.T) {
+	state := &CommandIOState{
+		WriteKey:     make([]byte, encrKeyLen),
+		WriteAuthKey: make([]byte, authKeyLen),
+		ReadKey:      make([]byte, encrKeyLen),
+		ReadAuthKey:  make([]byte, authKeyLen),
+		DictionaryId: "dict",
+	}
+	if _, err := RestoreCommandIO(state, new(bytes.Buffer), nil); err != ErrNoDictionary {
+		t.Errorf("restored without the dictionary: %v", err)
+	}
+}
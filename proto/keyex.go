@@ -19,17 +19,43 @@ package proto
 
 import (
 	"crypto"
-	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
+	"errors"
 	"github.com/monnand/dhkx"
-	pss "github.com/monnand/rsa"
 	"io"
+	"math/big"
 	"net"
 )
 
 const currentProtocolVersion byte = 1
 
+// A client which cannot verify the server's signature sends this
+// instead of its version, followed by the fingerprint of the key it
+// pinned. The server then retries once with that key, if it has it.
+const keyRetryMarker byte = 0xFF
+
+var errKeyRetry = errors.New("key retry")
+
+// The prime of the DH group of the key exchange.
+var dhPrime = func() *big.Int {
+	group, _ := dhkx.GetGroup(dhGroupID)
+	return group.P()
+}()
+
+var dhPrimeMinusOne = new(big.Int).Sub(dhPrime, big.NewInt(1))
+
+// parseDHPublicKey rejects the public keys out of (1, p-1), with which
+// the shared key could be guessed.
+func parseDHPublicKey(data []byte) (pub *dhkx.DHKey, err error) {
+	y := new(big.Int).SetBytes(data)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(dhPrimeMinusOne) >= 0 {
+		err = ErrBadKeyExchangePacket
+		return
+	}
+	pub = dhkx.NewPublicKey(data)
+	return
+}
+
 // The authentication here is quite similar with, if not same as, tarsnap's auth algorithm.
 //
 // First, server generate a Diffie-Hellman public key, dhpub1, sign it with
@@ -46,37 +72,85 @@ const currentProtocolVersion byte = 1
 // Now, we can use K to derive any key we need on server and client side.
 // master key, mkey = MGF1(nonce || K, 48)
 func ServerKeyExchange(privKey *rsa.PrivateKey, conn net.Conn) (ks *keySet, err error) {
-	group, _ := dhkx.GetGroup(dhGroupID)
-	priv, _ := group.GeneratePrivateKey(nil)
+	return ServerKeyExchangeWithSigner(privKey, conn)
+}
 
-	mypub := priv.Bytes()
-	mypub = leftPaddingZero(mypub, dhPubkeyLen)
+// ServerKeyExchangeWithSigner is like ServerKeyExchange, but the DH
+// public key is signed by signer, which may keep the RSA private key
+// out of the process (e.g. in an HSM). It must sign with RSASSA-PSS
+// when given a *rsa.PSSOptions.
+//
+// If signer is a *KeyRing, a client pinning one of its previous keys
+// gets a signature by that key.
+func ServerKeyExchangeWithSigner(signer crypto.Signer, conn net.Conn) (ks *keySet, err error) {
+	provider := currentCryptoProvider()
+	ring, _ := signer.(*KeyRing)
+	var fingerprint []byte
+	for retried := false; ; retried = true {
+		ks, fingerprint, err = serverKeyExchange(provider, signer, conn)
+		if err != errKeyRetry {
+			return
+		}
+		if ring != nil && !retried {
+			signer = ring.find(provider, fingerprint)
+		} else {
+			signer = nil
+		}
+		if signer == nil {
+			// Tell the client we have no such key.
+			writen(conn, []byte{keyRetryMarker})
+			err = ErrUnknownServerKey
+			return
+		}
+	}
+}
 
-	salt := make([]byte, pssSaltLen)
-	n, err := io.ReadFull(rand.Reader, salt)
-	if err != nil || n != len(salt) {
+func serverKeyExchange(provider CryptoProvider, signer crypto.Signer, conn net.Conn) (ks *keySet, fingerprint []byte, err error) {
+	pubKey, ok := signer.Public().(*rsa.PublicKey)
+	if !ok {
+		err = ErrUnsupportedSigner
+		return
+	}
+	signer = signerOf(signer)
+	group, _ := dhkx.GetGroup(dhGroupID)
+	// The DH keys and the signature are computed by the CPU pool.
+	var priv *dhkx.DHKey
+	runCPU(CPU_HANDSHAKE, func() {
+		priv, err = group.GeneratePrivateKey(provider.Random())
+	})
+	if err != nil {
 		err = ErrZeroEntropy
 		return
 	}
 
-	sha := sha256.New()
+	mypub := priv.Bytes()
+	mypub = leftPaddingZero(mypub, dhPubkeyLen)
+
+	sha := provider.NewHash()
 	hashed := make([]byte, sha.Size())
 	sha.Write([]byte{currentProtocolVersion})
 	sha.Write(mypub)
 	hashed = sha.Sum(hashed[:0])
 
-	sig, err := pss.SignPSS(rand.Reader, privKey, crypto.SHA256, hashed, salt)
+	var sig []byte
+	runCPU(CPU_HANDSHAKE, func() {
+		sig, err = signer.Sign(provider.Random(), hashed, &rsa.PSSOptions{SaltLength: pssSaltLen, Hash: crypto.SHA256})
+	})
 	if err != nil {
 		return
 	}
 
-	siglen := (privKey.N.BitLen() + 7) / 8
+	siglen := (pubKey.N.BitLen() + 7) / 8
+	if len(sig) > siglen {
+		err = ErrUnsupportedSigner
+		return
+	}
 	keyExPkt := make([]byte, dhPubkeyLen+siglen+nonceLen+1)
 	keyExPkt[0] = currentProtocolVersion
 	copy(keyExPkt[1:], mypub)
-	copy(keyExPkt[dhPubkeyLen+1:], sig)
+	copy(keyExPkt[dhPubkeyLen+1:], leftPaddingZero(sig, siglen))
 	nonce := keyExPkt[dhPubkeyLen+siglen+1:]
-	n, err = io.ReadFull(rand.Reader, nonce)
+	n, err := io.ReadFull(provider.Random(), nonce)
 	if err != nil || n != len(nonce) {
 		err = ErrZeroEntropy
 		return
@@ -109,21 +183,33 @@ func ServerKeyExchange(privKey *rsa.PrivateKey, conn net.Conn) (ks *keySet, err
 	}
 
 	version := keyExPkt[0]
+	if version == keyRetryMarker {
+		fingerprint = make([]byte, sha.Size())
+		copy(fingerprint, keyExPkt[1:])
+		err = errKeyRetry
+		return
+	}
 	if version > currentProtocolVersion {
 		err = ErrImcompatibleProtocol
 		return
 	}
 	// First, recover client's DH public key
-	clientpub := dhkx.NewPublicKey(keyExPkt[1 : dhPubkeyLen+1])
+	clientpub, err := parseDHPublicKey(keyExPkt[1 : dhPubkeyLen+1])
+	if err != nil {
+		return
+	}
 
 	// Compute a shared key K.
-	K, err := group.ComputeKey(clientpub, priv)
+	var K *dhkx.DHKey
+	runCPU(CPU_HANDSHAKE, func() {
+		K, err = group.ComputeKey(clientpub, priv)
+	})
 	if err != nil {
 		return
 	}
 
 	// Generate keys from the shared key
-	ks, err = generateKeys(K.Bytes(), nonce)
+	ks, err = generateKeys(provider, K.Bytes(), nonce)
 	if err != nil {
 		return
 	}
@@ -133,10 +219,37 @@ func ServerKeyExchange(privKey *rsa.PrivateKey, conn net.Conn) (ks *keySet, err
 	if err != nil {
 		return
 	}
+	logSessionKeys(nonce, ks)
 	return
 }
 
+// ClientKeyExchange verifies the server's signature with pubKey. If it
+// fails, the client asks the server once to sign with pubKey, in case
+// the server has rotated its key.
 func ClientKeyExchange(pubKey *rsa.PublicKey, conn net.Conn) (ks *keySet, err error) {
+	provider := currentCryptoProvider()
+	ks, err = clientKeyExchange(provider, pubKey, conn)
+	if err != errKeyRetry {
+		return
+	}
+	// The signature was wrong.
+	pkt := make([]byte, 1+dhPubkeyLen+authKeyLen)
+	pkt[0] = keyRetryMarker
+	copy(pkt[1:], keyFingerprint(provider, pubKey))
+	err = writen(conn, pkt)
+	if err != nil {
+		err = ErrBadServer
+		return
+	}
+	ks, err = clientKeyExchange(provider, pubKey, conn)
+	if err == errKeyRetry || err == io.EOF {
+		// Older servers close the connection.
+		err = ErrBadServer
+	}
+	return
+}
+
+func clientKeyExchange(provider CryptoProvider, pubKey *rsa.PublicKey, conn net.Conn) (ks *keySet, err error) {
 	// Receive the data from server, which contains:
 	// - version
 	// - Server's DH public key: g ^ x
@@ -144,16 +257,26 @@ func ClientKeyExchange(pubKey *rsa.PublicKey, conn net.Conn) (ks *keySet, err er
 	// - nonce
 	siglen := (pubKey.N.BitLen() + 7) / 8
 	keyExPkt := make([]byte, dhPubkeyLen+siglen+nonceLen+1)
-	n, err := io.ReadFull(conn, keyExPkt)
+	// The server sends only the marker if it does not have the key
+	// we asked for.
+	_, err = io.ReadFull(conn, keyExPkt[:1])
 	if err != nil {
 		return
 	}
-	if n != len(keyExPkt) {
+	version := keyExPkt[0]
+	if version == keyRetryMarker {
+		err = ErrUnknownServerKey
+		return
+	}
+	n, err := io.ReadFull(conn, keyExPkt[1:])
+	if err != nil {
+		return
+	}
+	if n != len(keyExPkt)-1 {
 		err = ErrBadKeyExchangePacket
 		return
 	}
 
-	version := keyExPkt[0]
 	if version != currentProtocolVersion {
 		err = ErrImcompatibleProtocol
 		return
@@ -163,34 +286,43 @@ func ClientKeyExchange(pubKey *rsa.PublicKey, conn net.Conn) (ks *keySet, err er
 	signature := keyExPkt[dhPubkeyLen+1 : dhPubkeyLen+siglen+1]
 	nonce := keyExPkt[dhPubkeyLen+siglen+1:]
 
-	sha := sha256.New()
+	sha := provider.NewHash()
 	hashed := make([]byte, sha.Size())
 	sha.Write(keyExPkt[:dhPubkeyLen+1])
 	hashed = sha.Sum(hashed[:0])
 
 	// Verify the signature
-	err = pss.VerifyPSS(pubKey, crypto.SHA256, hashed, signature, pssSaltLen)
+	err = provider.VerifyPSS(pubKey, hashed, signature, pssSaltLen)
 
 	if err != nil {
+		err = errKeyRetry
 		return
 	}
 
 	// Generate a DH key
 	group, _ := dhkx.GetGroup(dhGroupID)
-	priv, _ := group.GeneratePrivateKey(nil)
+	priv, err := group.GeneratePrivateKey(provider.Random())
+	if err != nil {
+		err = ErrZeroEntropy
+		return
+	}
 	mypub := leftPaddingZero(priv.Bytes(), dhPubkeyLen)
 
 	// Generate the shared key from server's DH public key and client DH private key
-	serverpub := dhkx.NewPublicKey(serverPubData)
+	serverpub, err := parseDHPublicKey(serverPubData)
+	if err != nil {
+		return
+	}
 	K, err := group.ComputeKey(serverpub, priv)
 	if err != nil {
 		return
 	}
 
-	ks, err = generateKeys(K.Bytes(), nonce)
+	ks, err = generateKeys(provider, K.Bytes(), nonce)
 	if err != nil {
 		return
 	}
+	logSessionKeys(nonce, ks)
 
 	keyExPkt = keyExPkt[:1+dhPubkeyLen+authKeyLen]
 	keyExPkt[0] = currentProtocolVersion
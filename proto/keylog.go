@@ -0,0 +1,127 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+var ErrBadKeyLog = errors.New("malformed key log")
+
+// The lines of a key log start with it.
+const keyLogLabel = "UNIQUSH"
+
+// SessionKeys are the keys derived by a key exchange, with which the
+// commands of the connection can be decoded. They are identified by
+// the nonce which the server sends in plaintext.
+type SessionKeys struct {
+	Nonce         []byte
+	ServerEncrKey []byte
+	ServerAuthKey []byte
+	ClientEncrKey []byte
+	ClientAuthKey []byte
+}
+
+// String() returns the line of the keys in a key log, without the
+// newline: the label, then the nonce and the keys in hex.
+func (self *SessionKeys) String() string {
+	return fmt.Sprintf("%v %x %x %x %x %x", keyLogLabel, self.Nonce,
+		self.ServerEncrKey, self.ServerAuthKey, self.ClientEncrKey, self.ClientAuthKey)
+}
+
+func ParseSessionKeys(line string) (keys *SessionKeys, err error) {
+	fields := strings.Fields(line)
+	if len(fields) != 6 || fields[0] != keyLogLabel {
+		err = ErrBadKeyLog
+		return
+	}
+	var values [5][]byte
+	for i := range values {
+		values[i], err = hex.DecodeString(fields[i+1])
+		if err != nil {
+			err = ErrBadKeyLog
+			return
+		}
+	}
+	if len(values[0]) != nonceLen || len(values[1]) != encrKeyLen || len(values[2]) != authKeyLen ||
+		len(values[3]) != encrKeyLen || len(values[4]) != authKeyLen {
+		err = ErrBadKeyLog
+		return
+	}
+	keys = &SessionKeys{values[0], values[1], values[2], values[3], values[4]}
+	return
+}
+
+// ReadKeyLog reads the keys written to a key log, by their nonces in
+// hex. Empty lines and the lines starting with '#' are skipped.
+func ReadKeyLog(r io.Reader) (keys map[string]*SessionKeys, err error) {
+	keys = make(map[string]*SessionKeys, 16)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		k, e := ParseSessionKeys(line)
+		if e != nil {
+			err = fmt.Errorf("line %v: %v", n, e)
+			return
+		}
+		keys[hex.EncodeToString(k.Nonce)] = k
+	}
+	err = scanner.Err()
+	return
+}
+
+func (self *keySet) sessionKeys(nonce []byte) *SessionKeys {
+	return &SessionKeys{
+		Nonce:         copyBytes(nonce),
+		ServerEncrKey: copyBytes(self.serverEncrKey),
+		ServerAuthKey: copyBytes(self.serverAuthKey),
+		ClientEncrKey: copyBytes(self.clientEncrKey),
+		ClientAuthKey: copyBytes(self.clientAuthKey),
+	}
+}
+
+var keyLogLock sync.Mutex
+var keyLog io.Writer
+
+// SetKeyLog makes the key exchanges afterwards write their session
+// keys to w, one line each, so that their traffic can be decoded by
+// uniqush-conn-dump. Whoever reads w can decrypt the connections: it
+// is only meant for debugging. A nil w stops the logging.
+func SetKeyLog(w io.Writer) {
+	keyLogLock.Lock()
+	defer keyLogLock.Unlock()
+	keyLog = w
+}
+
+func logSessionKeys(nonce []byte, ks *keySet) {
+	keyLogLock.Lock()
+	defer keyLogLock.Unlock()
+	if keyLog == nil {
+		return
+	}
+	fmt.Fprintln(keyLog, ks.sessionKeys(nonce))
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"net"
+	"sync"
+	"testing"
+)
+
+// tappedConn keeps what is written to the connection.
+type tappedConn struct {
+	net.Conn
+	lock    sync.Mutex
+	written bytes.Buffer
+}
+
+func (self *tappedConn) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	self.written.Write(p)
+	self.lock.Unlock()
+	return self.Conn.Write(p)
+}
+
+func tapKeyExchange(t *testing.T, signer crypto.Signer, pub *rsa.PublicKey) (server, client *tappedConn, sks, cks *keySet) {
+	s, c := net.Pipe()
+	server = &tappedConn{Conn: s}
+	client = &tappedConn{Conn: c}
+	var serr error
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		sks, serr = ServerKeyExchangeWithSigner(signer, server)
+	}()
+	cks, err := ClientKeyExchange(pub, client)
+	<-done
+	if err != nil || serr != nil {
+		t.Fatalf("Error: %v %v", err, serr)
+	}
+	return
+}
+
+func TestDecodeWithKeyLog(t *testing.T) {
+	keys := generateTestKeys(t, 2)
+	ring, err := NewKeyRing(keys[0], keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With the previous key, the client asks the server to retry.
+	for _, k := range keys {
+		testDecodeWithKeyLog(t, ring, &k.PublicKey)
+	}
+}
+
+func testDecodeWithKeyLog(t *testing.T, signer crypto.Signer, pub *rsa.PublicKey) {
+	log := new(bytes.Buffer)
+	SetKeyLog(log)
+	defer SetKeyLog(nil)
+	server, client, sks, cks := tapKeyExchange(t, signer, pub)
+
+	toServer := randomCommand()
+	toClient := randomCommand()
+	go func() {
+		cks.ClientCommandIO(client).WriteCommand(toServer, true)
+	}()
+	sio := sks.ServerCommandIO(server)
+	if _, err := sio.ReadCommand(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	go func() {
+		sio.WriteCommand(toClient, false)
+	}()
+	if _, err := cks.ClientCommandIO(client).ReadCommand(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	keys, err := ReadKeyLog(bytes.NewReader(log.Bytes()))
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("bad key log: %v %q", err, log.String())
+	}
+
+	fromServer := bufio.NewReader(bytes.NewReader(server.written.Bytes()))
+	fromClient := bytes.NewReader(client.written.Bytes())
+	sk, err := SkipKeyExchange(fromServer, fromClient, keys)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	cmd, err := sk.CommandReader(fromClient, false).ReadCommand()
+	if err != nil || !cmd.eq(toServer) {
+		t.Errorf("bad command from the client: %v %v", cmd, err)
+	}
+	cmd, err = sk.CommandReader(fromServer, true).ReadCommand()
+	if err != nil || !cmd.eq(toClient) {
+		t.Errorf("bad command from the server: %v %v", cmd, err)
+	}
+
+	for k := range keys {
+		delete(keys, k)
+	}
+	fromServer = bufio.NewReader(bytes.NewReader(server.written.Bytes()))
+	fromClient = bytes.NewReader(client.written.Bytes())
+	if _, err := SkipKeyExchange(fromServer, fromClient, keys); err != ErrNoSessionKeys {
+		t.Errorf("should not find the keys: %v", err)
+	}
+}
+
+func TestParseSessionKeys(t *testing.T) {
+	ks := &SessionKeys{
+		Nonce:         bytes.Repeat([]byte{1}, nonceLen),
+		ServerEncrKey: bytes.Repeat([]byte{2}, encrKeyLen),
+		ServerAuthKey: bytes.Repeat([]byte{3}, authKeyLen),
+		ClientEncrKey: bytes.Repeat([]byte{4}, encrKeyLen),
+		ClientAuthKey: bytes.Repeat([]byte{5}, authKeyLen),
+	}
+	parsed, err := ParseSessionKeys(ks.String())
+	if err != nil || parsed.String() != ks.String() {
+		t.Errorf("bad keys: %v %v", parsed, err)
+	}
+	for _, line := range []string{"", "UNIQUSH 01 02", "TLS " + ks.String()[len(keyLogLabel)+1:], ks.String() + "00"} {
+		if _, err := ParseSessionKeys(line); err != ErrBadKeyLog {
+			t.Errorf("%q should be rejected: %v", line, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"io"
+	"sync"
+)
+
+var ErrKeySizeMismatch = errors.New("the keys of a key ring should be of the same size")
+var ErrUnknownServerKey = errors.New("the server does not hold the key pinned by the client")
+
+// KeyRing holds the current private key of the server and the
+// previous ones, so that the key can be rotated without breaking the
+// clients which still pin an old public key.
+//
+// A KeyRing is a crypto.Signer signing with the current key. Given to
+// ServerKeyExchangeWithSigner, it lets a client which cannot verify
+// the current key ask for a signature by the key it pinned.
+//
+// All the keys should be RSA keys of the same size.
+type KeyRing struct {
+	lock sync.RWMutex
+	// keys[0] is the current key
+	keys []crypto.Signer
+}
+
+func NewKeyRing(current crypto.Signer, previous ...crypto.Signer) (ring *KeyRing, err error) {
+	ring = new(KeyRing)
+	err = ring.SetKeys(current, previous...)
+	if err != nil {
+		ring = nil
+	}
+	return
+}
+
+func checkKeys(keys []crypto.Signer) error {
+	siglen := -1
+	for _, k := range keys {
+		pub, ok := k.Public().(*rsa.PublicKey)
+		if !ok {
+			return ErrUnsupportedSigner
+		}
+		l := (pub.N.BitLen() + 7) / 8
+		if siglen >= 0 && l != siglen {
+			return ErrKeySizeMismatch
+		}
+		siglen = l
+	}
+	return nil
+}
+
+// SetKeys replaces all the keys of the ring.
+func (self *KeyRing) SetKeys(current crypto.Signer, previous ...crypto.Signer) error {
+	keys := make([]crypto.Signer, 0, len(previous)+1)
+	keys = append(keys, current)
+	keys = append(keys, previous...)
+	err := checkKeys(keys)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.keys = keys
+	return nil
+}
+
+// Rotate makes key the current key. The current key becomes the only
+// previous one.
+func (self *KeyRing) Rotate(key crypto.Signer) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	keys := []crypto.Signer{key}
+	if len(self.keys) > 0 {
+		keys = append(keys, self.keys[0])
+	}
+	err := checkKeys(keys)
+	if err != nil {
+		return err
+	}
+	self.keys = keys
+	return nil
+}
+
+func (self *KeyRing) current() crypto.Signer {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.keys[0]
+}
+
+func (self *KeyRing) Public() crypto.PublicKey {
+	return self.current().Public()
+}
+
+func (self *KeyRing) Sign(r io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return signerOf(self.current()).Sign(r, digest, opts)
+}
+
+// find returns the key whose public key has the fingerprint, or nil.
+func (self *KeyRing) find(provider CryptoProvider, fingerprint []byte) crypto.Signer {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for _, k := range self.keys {
+		pub := k.Public().(*rsa.PublicKey)
+		if bytes.Equal(keyFingerprint(provider, pub), fingerprint) {
+			return k
+		}
+	}
+	return nil
+}
+
+// keyFingerprint is the hash of the PKCS#1 encoding of the key.
+func keyFingerprint(provider CryptoProvider, pub *rsa.PublicKey) []byte {
+	h := provider.NewHash()
+	h.Write(x509.MarshalPKCS1PublicKey(pub))
+	return h.Sum(nil)
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+)
+
+func exchangeKeysWithRing(t *testing.T, ring *KeyRing, pub *rsa.PublicKey) (ss, cs *keySet, es, ec error) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+	done := make(chan bool)
+	go func() {
+		ss, es = ServerKeyExchangeWithSigner(ring, s)
+		if es != nil {
+			s.Close()
+		}
+		done <- true
+	}()
+	cs, ec = ClientKeyExchange(pub, c)
+	if ec != nil {
+		c.Close()
+	}
+	<-done
+	return
+}
+
+func generateTestKeys(t *testing.T, n int) []*rsa.PrivateKey {
+	ret := make([]*rsa.PrivateKey, n)
+	for i := range ret {
+		k, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret[i] = k
+	}
+	return ret
+}
+
+func TestKeyRingPreviousKey(t *testing.T) {
+	keys := generateTestKeys(t, 3)
+	ring, err := NewKeyRing(keys[0], keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range keys[:2] {
+		ss, cs, es, ec := exchangeKeysWithRing(t, ring, &k.PublicKey)
+		if es != nil || ec != nil {
+			t.Fatalf("key %v: server: %v; client: %v", i, es, ec)
+		}
+		if !ss.eq(cs) {
+			t.Errorf("key %v: key sets not equal", i)
+		}
+	}
+
+	_, _, es, ec := exchangeKeysWithRing(t, ring, &keys[2].PublicKey)
+	if es != ErrUnknownServerKey {
+		t.Errorf("server should fail with ErrUnknownServerKey: %v", es)
+	}
+	if ec == nil {
+		t.Errorf("client should fail")
+	}
+}
+
+func TestKeyRingRotate(t *testing.T) {
+	keys := generateTestKeys(t, 3)
+	ring, err := NewKeyRing(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring.Rotate(keys[1])
+	ring.Rotate(keys[2])
+	_, _, es, ec := exchangeKeysWithRing(t, ring, &keys[1].PublicKey)
+	if es != nil || ec != nil {
+		t.Errorf("server: %v; client: %v", es, ec)
+	}
+	_, _, es, _ = exchangeKeysWithRing(t, ring, &keys[0].PublicKey)
+	if es != ErrUnknownServerKey {
+		t.Errorf("the oldest key should be dropped: %v", es)
+	}
+}
+
+func TestKeyRingSizeMismatch(t *testing.T) {
+	small := generateTestKeys(t, 1)[0]
+	large, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewKeyRing(large, small)
+	if err != ErrKeySizeMismatch {
+		t.Errorf("should be ErrKeySizeMismatch: %v", err)
+	}
+	ring, _ := NewKeyRing(small)
+	err = ring.Rotate(large)
+	if err != ErrKeySizeMismatch {
+		t.Errorf("should be ErrKeySizeMismatch: %v", err)
+	}
+}
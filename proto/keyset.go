@@ -20,7 +20,6 @@ package proto
 import (
 	"bytes"
 	"crypto/hmac"
-	"crypto/sha256"
 	"fmt"
 	"io"
 )
@@ -30,6 +29,7 @@ type keySet struct {
 	serverAuthKey []byte
 	clientEncrKey []byte
 	clientAuthKey []byte
+	provider      CryptoProvider
 }
 
 func (self *keySet) String() string {
@@ -59,12 +59,13 @@ func newKeySet(serverEncrKey, serverAuthKey, clientEncrKey, clientAuthKey []byte
 	result.serverAuthKey = serverAuthKey
 	result.clientEncrKey = clientEncrKey
 	result.clientAuthKey = clientAuthKey
+	result.provider = currentCryptoProvider()
 
 	return result
 }
 
 func (self *keySet) serverHMAC(data, mac []byte) error {
-	hash := hmac.New(sha256.New, self.serverAuthKey)
+	hash := hmac.New(self.provider.NewHash, self.serverAuthKey)
 	err := writen(hash, data)
 	if err != nil {
 		return err
@@ -89,17 +90,17 @@ func (self *keySet) checkServerHMAC(data, mac []byte) error {
 }
 
 func (self *keySet) ClientCommandIO(conn io.ReadWriter) *CommandIO {
-	ret := NewCommandIO(self.clientEncrKey, self.clientAuthKey, self.serverEncrKey, self.serverAuthKey, conn)
+	ret := newCommandIO(self.provider, self.clientEncrKey, self.clientAuthKey, self.serverEncrKey, self.serverAuthKey, conn)
 	return ret
 }
 
 func (self *keySet) ServerCommandIO(conn io.ReadWriter) *CommandIO {
-	ret := NewCommandIO(self.serverEncrKey, self.serverAuthKey, self.clientEncrKey, self.clientAuthKey, conn)
+	ret := newCommandIO(self.provider, self.serverEncrKey, self.serverAuthKey, self.clientEncrKey, self.clientAuthKey, conn)
 	return ret
 }
 
 func (self *keySet) clientHMAC(data, mac []byte) error {
-	hash := hmac.New(sha256.New, self.clientAuthKey)
+	hash := hmac.New(self.provider.NewHash, self.clientAuthKey)
 	err := writen(hash, data)
 	if err != nil {
 		return err
@@ -123,11 +124,11 @@ func (self *keySet) checkClientHMAC(data, mac []byte) error {
 	return nil
 }
 
-func generateKeys(k, nonce []byte) (ks *keySet, err error) {
+func generateKeys(provider CryptoProvider, k, nonce []byte) (ks *keySet, err error) {
 	mkey := make([]byte, 48)
-	mgf1XOR(mkey, sha256.New(), append(k, nonce...))
+	mgf1XOR(mkey, provider.NewHash(), append(k, nonce...))
 
-	h := hmac.New(sha256.New, mkey)
+	h := hmac.New(provider.NewHash, mkey)
 
 	serverEncrKey := make([]byte, encrKeyLen)
 	h.Write([]byte("ServerEncr"))
@@ -150,5 +151,6 @@ func generateKeys(k, nonce []byte) (ks *keySet, err error) {
 	h.Reset()
 
 	ks = newKeySet(serverEncrKey, serverAuthKey, clientEncrKey, clientAuthKey)
+	ks.provider = provider
 	return
 }
@@ -17,6 +17,14 @@
 
 package proto
 
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"time"
+)
+
 // MessageContainer is used to represent a message inside
 // the program. It has meta-data about a message like:
 // the message id, the sender and the service of the sender.
@@ -25,6 +33,70 @@ type MessageContainer struct {
 	Id            string   `json:"id,omitempty"`
 	Sender        string   `json:"sender,omitempty"`
 	SenderService string   `json:"service,omitempty"`
+
+	// Seq is a per-(service,user) monotonically increasing
+	// sequence number assigned by the cache. 0 means the
+	// message has never been cached.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// CachedAt is when the message was cached, in nanoseconds
+	// since the epoch. 0 means the message has never been cached.
+	CachedAt int64 `json:"cachedAt,omitempty"`
+
+	// ExpiresAt is when the message expires, in nanoseconds since the
+	// epoch by the clock of this process. The cache sets it on the
+	// server, and the client from the TTL sent by the server. 0 means
+	// the message never expires.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+
+	// OriginId, if not empty, identifies where the message comes
+	// from, e.g. a forward request and its idempotency key. The
+	// copies with the same origin id cached for a user are the
+	// same message. See msgcache.Cache.CacheMessageOnce.
+	OriginId string `json:"originId,omitempty"`
+
+	// SenderConn, if not empty, is the connection of the sender to
+	// which the replies should be routed. See CMD_FWD_REQ.
+	SenderConn string `json:"senderConn,omitempty"`
+
+	// ReceiverConn, if not empty, is the only connection of the
+	// receiver the message is written to. It is a reply to the
+	// message the connection sent with SenderConn.
+	ReceiverConn string `json:"receiverConn,omitempty"`
+
+	// Supersedes, if not empty, makes the container a notice that the
+	// message whose id it is has been edited by its sender: Message
+	// replaces it, or recalls it if nil. Notices are routed to the
+	// other nodes like messages, but they are never cached.
+	Supersedes string `json:"supersedes,omitempty"`
+
+	// Payload, if not nil, is the encoded Message shared by all
+	// the connections receiving it. Senders delivering one message
+	// to many users may put the same payload in every container.
+	// It is never stored.
+	Payload *Payload `json:"-"`
+}
+
+// TTL returns how long the message lives from now, or 0 if it never
+// expires. A message which has just expired still has a nanosecond.
+func (self *MessageContainer) TTL() time.Duration {
+	if self.ExpiresAt <= 0 {
+		return 0
+	}
+	d := time.Duration(self.ExpiresAt - time.Now().UnixNano())
+	if d <= 0 {
+		d = time.Nanosecond
+	}
+	return d
+}
+
+// SetTTL sets ExpiresAt to ttl from now, by the local clock.
+func (self *MessageContainer) SetTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		self.ExpiresAt = 0
+		return
+	}
+	self.ExpiresAt = time.Now().Add(ttl).UnixNano()
 }
 
 func (self *MessageContainer) FromServer() bool {
@@ -45,6 +117,9 @@ func (a *MessageContainer) Eq(b *MessageContainer) bool {
 	if a.SenderService != b.SenderService {
 		return false
 	}
+	if a.Seq != b.Seq {
+		return false
+	}
 	return a.Message.Eq(b.Message)
 }
 
@@ -56,13 +131,261 @@ type Message struct {
 	*/
 	Header map[string]string `json:"header,omitempty"`
 	Body   []byte            `json:"body,omitempty"`
+
+	// BinaryHeader carries header values which are not text, e.g.
+	// serialized protobufs. The values are sent as they are, without
+	// being escaped, and may contain any byte including \0. The keys
+	// should not collide with the ones in Header.
+	BinaryHeader map[string][]byte `json:"binaryHeader,omitempty"`
+
+	// If a message is opaque, its body is encrypted by the client,
+	// i.e. end-to-end encrypted. The server will never compress the
+	// body or extract digest fields from the message. A digest of an
+	// opaque message only carries the sender and the preview header.
+	Opaque bool `json:"opaque,omitempty"`
+
+	// If a message is public, e.g. a broadcast, its confidentiality
+	// is not needed. It is sent in plaintext, but still authenticated,
+	// to the peers which agreed at handshake, saving the encryption on
+	// both ends. The parameters of the command carrying it, such as the
+	// id and the sender, are in plaintext as well.
+	Public bool `json:"public,omitempty"`
+
+	// If a message is ephemeral, e.g. a typing indicator or a live
+	// location, it is only worth delivering right away. The server
+	// never caches it nor sends its digest, and drops it if the
+	// receiver is offline.
+	Ephemeral bool `json:"ephemeral,omitempty"`
+
+	// ThreadId, if not empty, is the conversation the message belongs
+	// to. The cache indexes the messages by thread, and the digests
+	// carry it. It is sent in ThreadHeader.
+	ThreadId string `json:"threadId,omitempty"`
+
+	// The buffer holding the body and the binary headers if the
+	// message is read in zero-copy mode.
+	buf *pooledBuffer
+}
+
+// Release() gives back the buffer holding the body and the binary
+// headers of a message read in zero-copy mode, see
+// CommandIO.SetZeroCopy(). Neither the body nor the binary headers
+// could be used afterwards; Copy() the message to keep it. It does
+// nothing for other messages.
+func (self *Message) Release() {
+	if self == nil || self.buf == nil {
+		return
+	}
+	buf := self.buf
+	self.buf = nil
+	self.Body = nil
+	self.BinaryHeader = nil
+	buf.release()
+}
+
+// detach() copies the body and the binary headers out of the pooled
+// buffer holding them, if any, and gives the buffer back.
+func (self *Message) detach() {
+	if self == nil || self.buf == nil {
+		return
+	}
+	buf := self.buf
+	self.buf = nil
+	self.Body = copyBytes(self.Body)
+	for k, v := range self.BinaryHeader {
+		self.BinaryHeader[k] = copyBytes(v)
+	}
+	buf.release()
+}
+
+// The header of an opaque message which will be carried in its digest.
+// It is provided by the app and should not contain any sensitive data.
+const OpaquePreviewHeader = "uniqush.preview"
+
+// The header carrying the trace context of a message, in the format
+// of a W3C traceparent. It is kept when the message is forwarded so
+// that the message could be followed across the system.
+const TraceHeader = "uniqush.traceparent"
+
+// The header of a message whose body has been stripped by the server
+// because the client asked for headers only. It carries the size of
+// the body. The whole message could be retrieved with its id. The
+// server drops the one set by the sender.
+const BodySizeHeader = "uniqush.body-size"
+
+// The header carrying Message.ThreadId in a command. The peers which
+// predate the field see it as a plain header. Apps should not set it.
+const ThreadHeader = "uniqush.thread"
+
+// The headers of the calls made with client.Conn.Call() and of their
+// replies. A call carries its id in CallHeader, and the reply carries
+// it in ReplyHeader, along with the error of the callee, if any, in
+// CallErrorHeader.
+const (
+	CallHeader      = "uniqush.call"
+	ReplyHeader     = "uniqush.reply-to"
+	CallErrorHeader = "uniqush.call-error"
+)
+
+// CallId() returns the id of the call carried by the message, or an
+// empty string if the message is not a call.
+func (self *Message) CallId() string {
+	if self == nil || len(self.Header) == 0 {
+		return ""
+	}
+	return self.Header[CallHeader]
+}
+
+// The header carrying the SHA-256 of the body, in base64, added by the
+// server when the message is sent. The receiver checks it once the body
+// is decompressed and decrypted, see VerifyBodyHash(). The server drops
+// the one set by the sender.
+const BodyHashHeader = "uniqush.body-sha256"
+
+var ErrCorruptedBody = errors.New("the body does not match its hash")
+
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// WithBodyHash() returns a copy of the message carrying the hash of
+// its body in BodyHashHeader. The body is shared with the original.
+// It returns the message itself if it already carries the right hash.
+func (self *Message) WithBodyHash() *Message {
+	h := bodyHash(self.Body)
+	if self.Header[BodyHashHeader] == h {
+		return self
+	}
+	ret := new(Message)
+	*ret = *self
+	ret.buf = nil
+	ret.Header = make(map[string]string, len(self.Header)+1)
+	for k, v := range self.Header {
+		ret.Header[k] = v
+	}
+	ret.Header[BodyHashHeader] = h
+	return ret
+}
+
+// WithoutHeaders() returns a copy of the message without the headers.
+// The body is shared with the original. It returns the message itself
+// if it has none of them.
+func (self *Message) WithoutHeaders(names ...string) *Message {
+	n := 0
+	for _, name := range names {
+		if _, ok := self.Header[name]; ok {
+			n++
+		}
+	}
+	if n == 0 {
+		return self
+	}
+	ret := new(Message)
+	*ret = *self
+	ret.buf = nil
+	ret.Header = make(map[string]string, len(self.Header)-n)
+	for k, v := range self.Header {
+		ret.Header[k] = v
+	}
+	for _, name := range names {
+		delete(ret.Header, name)
+	}
+	return ret
+}
+
+// VerifyBodyHash() returns ErrCorruptedBody if the body does not match
+// BodyHashHeader. A message without the header, or whose body has been
+// stripped, is not checked.
+func (self *Message) VerifyBodyHash() error {
+	if self == nil || len(self.Header) == 0 || self.IsHeadersOnly() {
+		return nil
+	}
+	h, ok := self.Header[BodyHashHeader]
+	if !ok {
+		return nil
+	}
+	if h != bodyHash(self.Body) {
+		return ErrCorruptedBody
+	}
+	return nil
+}
+
+// HeadersOnly() returns a copy of the message without its body. The
+// size of the body is carried in BodySizeHeader.
+func (self *Message) HeadersOnly() *Message {
+	ret := new(Message)
+	*ret = *self
+	ret.Body = nil
+	ret.Header = make(map[string]string, len(self.Header)+1)
+	for k, v := range self.Header {
+		ret.Header[k] = v
+	}
+	ret.Header[BodySizeHeader] = strconv.Itoa(len(self.Body))
+	return ret
+}
+
+// IsHeadersOnly() tells if the body of the message has been stripped.
+func (self *Message) IsHeadersOnly() bool {
+	if self == nil || len(self.Header) == 0 {
+		return false
+	}
+	_, ok := self.Header[BodySizeHeader]
+	return ok
+}
+
+// NewOpaqueMessage() creates a message whose body is encrypted by the client.
+func NewOpaqueMessage(body []byte, preview string) *Message {
+	msg := new(Message)
+	msg.Body = body
+	msg.Opaque = true
+	if len(preview) > 0 {
+		msg.Header = map[string]string{OpaquePreviewHeader: preview}
+	}
+	return msg
+}
+
+// Preview() returns the app-provided preview of an opaque message.
+func (self *Message) Preview() string {
+	if self == nil || len(self.Header) == 0 {
+		return ""
+	}
+	return self.Header[OpaquePreviewHeader]
+}
+
+// Copy() returns a deep copy of the message, so that the copy can be
+// read while the original is being modified, or after it is released.
+func (self *Message) Copy() *Message {
+	if self == nil {
+		return nil
+	}
+	ret := new(Message)
+	*ret = *self
+	ret.buf = nil
+	if self.Header != nil {
+		ret.Header = make(map[string]string, len(self.Header))
+		for k, v := range self.Header {
+			ret.Header[k] = v
+		}
+	}
+	if self.BinaryHeader != nil {
+		ret.BinaryHeader = make(map[string][]byte, len(self.BinaryHeader))
+		for k, v := range self.BinaryHeader {
+			ret.BinaryHeader[k] = append([]byte(nil), v...)
+		}
+	}
+	if self.Body != nil {
+		ret.Body = make([]byte, len(self.Body))
+		copy(ret.Body, self.Body)
+	}
+	return ret
 }
 
 func (self *Message) IsEmpty() bool {
 	if self == nil {
 		return true
 	}
-	return len(self.Header) == 0 && len(self.Body) == 0
+	return len(self.Header) == 0 && len(self.BinaryHeader) == 0 && len(self.Body) == 0 && len(self.ThreadId) == 0
 }
 
 func (self *Message) Size() int {
@@ -74,6 +397,13 @@ func (self *Message) Size() int {
 		ret += len(k) + 1
 		ret += len(v) + 1
 	}
+	for k, v := range self.BinaryHeader {
+		ret += len(k) + 1
+		ret += len(v) + 4
+	}
+	if len(self.ThreadId) > 0 {
+		ret += len(ThreadHeader) + len(self.ThreadId) + 2
+	}
 	ret += 8
 	return ret
 }
@@ -86,6 +416,12 @@ func (a *Message) Eq(b *Message) bool {
 			return false
 		}
 	}
+	if b == nil {
+		return false
+	}
+	if a.Opaque != b.Opaque || a.Public != b.Public || a.Ephemeral != b.Ephemeral || a.ThreadId != b.ThreadId {
+		return false
+	}
 	if len(a.Header) != len(b.Header) {
 		return false
 	}
@@ -98,6 +434,18 @@ func (a *Message) Eq(b *Message) bool {
 			return false
 		}
 	}
+	if len(a.BinaryHeader) != len(b.BinaryHeader) {
+		return false
+	}
+	for k, v := range a.BinaryHeader {
+		if bv, ok := b.BinaryHeader[k]; ok {
+			if !xorBytesEq(bv, v) {
+				return false
+			}
+		} else {
+			return false
+		}
+	}
 	return xorBytesEq(a.Body, b.Body)
 }
 
@@ -124,3 +124,197 @@ func BenchmarkCommandMarshalUnmarshalBson(b *testing.B) {
 		bson.Unmarshal(data, c)
 	}
 }
+
+func TestCommandMarshalOpaqueMessage(t *testing.T) {
+	cmd := new(Command)
+	cmd.Type = 1
+	cmd.Params = make([]string, 1)
+	cmd.Params[0] = "hello"
+	cmd.Message = NewOpaqueMessage([]byte{1, 2, 3, 3}, "new message")
+	err := marshalUnmarshal(cmd)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	// An opaque message without header and body
+	cmd.Message = NewOpaqueMessage(nil, "")
+	err = marshalUnmarshal(cmd)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+}
+
+func TestCommandMarshalEphemeralMessage(t *testing.T) {
+	cmd := &Command{Type: CMD_FWD_REQ, Params: []string{"0s", "bob"}}
+	cmd.Message = &Message{Header: map[string]string{"typing": "1"}, Ephemeral: true}
+	err := marshalUnmarshal(cmd)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	// An ephemeral message without header and body
+	cmd.Message = &Message{Ephemeral: true}
+	err = marshalUnmarshal(cmd)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	cmd.Message = &Message{Header: map[string]string{"typing": "1"}}
+	data, _ := cmd.Marshal()
+	if c, _ := UnmarshalCommand(data); c == nil || c.Message.Ephemeral {
+		t.Errorf("the message should not be ephemeral: %v", c)
+	}
+}
+
+func TestCommandMarshalThreadId(t *testing.T) {
+	cmd := &Command{Type: CMD_FWD_REQ, Params: []string{"0s", "bob"}}
+	cmd.Message = &Message{Header: map[string]string{"title": "hi"}, Body: []byte("hello"), ThreadId: "t1"}
+	err := marshalUnmarshal(cmd)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	// A message with nothing but the thread
+	cmd.Message = &Message{ThreadId: "t1"}
+	err = marshalUnmarshal(cmd)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if p := NewPayload(cmd.Message); p.nrHeaders != 1 {
+		t.Errorf("bad payload: %+v", p)
+	}
+
+	// The field wins over the header set by the app.
+	cmd.Message = &Message{Header: map[string]string{ThreadHeader: "t0", "title": "hi"}, ThreadId: "t1"}
+	data, _ := cmd.Marshal()
+	c, err := UnmarshalCommand(data)
+	if err != nil || c.Message.ThreadId != "t1" || len(c.Message.Header) != 1 {
+		t.Errorf("bad message: %+v %v", c, err)
+	}
+}
+
+func TestCommandMarshalBinaryHeader(t *testing.T) {
+	cmd := new(Command)
+	cmd.Type = 1
+	cmd.Params = []string{"hello"}
+	cmd.Message = new(Message)
+	cmd.Message.Header = map[string]string{"a": "h"}
+	cmd.Message.BinaryHeader = map[string][]byte{
+		"proto": []byte{0, 1, 2, 0, 0xFF},
+		"empty": []byte{},
+	}
+	cmd.Message.Body = []byte{1, 2, 3, 3}
+	err := marshalUnmarshal(cmd)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	// Binary headers only
+	cmd.Message = &Message{BinaryHeader: map[string][]byte{"proto": []byte{0}}}
+	err = marshalUnmarshal(cmd)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	data, err := cmd.Marshal()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// Cut the value of the binary header
+	if _, err = UnmarshalCommand(data[:len(data)-1]); err != ErrMalformedCommand {
+		t.Errorf("truncated binary header should be rejected: %v", err)
+	}
+}
+
+func TestCommandString(t *testing.T) {
+	for i, name := range cmdNames {
+		if len(name) == 0 {
+			t.Errorf("command %v has no name", i)
+		}
+	}
+	cmd := &Command{Type: CMD_FWD_REQ, Params: []string{"alice", "service"}}
+	cmd.Message = &Message{Body: []byte("hello")}
+	str := cmd.String()
+	if str != `FWD_REQ ["alice" "service"] header=map[] body="hello"` {
+		t.Errorf("bad dump: %v", str)
+	}
+}
+
+func TestCommandMarshalTooManyParams(t *testing.T) {
+	cmd := &Command{Type: CMD_MSG_RETRIEVE, Params: make([]string, 15)}
+	err := marshalUnmarshal(cmd)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	// NrParams only has 4 bits.
+	cmd.Params = make([]string, 16)
+	if _, err = cmd.Marshal(); err != ErrTooManyParams {
+		t.Errorf("16 parameters should be rejected: %v", err)
+	}
+}
+
+func TestMessageCopy(t *testing.T) {
+	msg := &Message{
+		Header:       map[string]string{"a": "b"},
+		BinaryHeader: map[string][]byte{"c": []byte{0, 1}},
+		Body:         []byte("hello"),
+	}
+	cp := msg.Copy()
+	if !cp.Eq(msg) {
+		t.Errorf("copy differs: %v", cp)
+	}
+	delete(msg.Header, "a")
+	msg.Body[0] = 'j'
+	msg.BinaryHeader["c"][0] = 2
+	if cp.Header["a"] != "b" || string(cp.Body) != "hello" || cp.BinaryHeader["c"][0] != 0 {
+		t.Errorf("copy shares data with the original: %v", cp)
+	}
+	var nilmsg *Message
+	if nilmsg.Copy() != nil {
+		t.Errorf("copy of nil should be nil")
+	}
+}
+
+func TestBodyHash(t *testing.T) {
+	msg := &Message{
+		Header: map[string]string{"a": "b"},
+		Body:   []byte("hello"),
+	}
+	hashed := msg.WithBodyHash()
+	if _, ok := msg.Header[BodyHashHeader]; ok {
+		t.Errorf("the original message is changed: %v", msg)
+	}
+	if hashed.WithBodyHash() != hashed {
+		t.Errorf("the hash is computed twice")
+	}
+	if err := hashed.VerifyBodyHash(); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if err := hashed.HeadersOnly().VerifyBodyHash(); err != nil {
+		t.Errorf("a stripped body should not be checked: %v", err)
+	}
+	if err := msg.VerifyBodyHash(); err != nil {
+		t.Errorf("a message without hash should not be checked: %v", err)
+	}
+	corrupted := hashed.Copy()
+	corrupted.Body[0] = 'j'
+	if err := corrupted.VerifyBodyHash(); err != ErrCorruptedBody {
+		t.Errorf("the corruption is not detected: %v", err)
+	}
+}
+
+func TestWithoutHeaders(t *testing.T) {
+	msg := &Message{
+		Header: map[string]string{"a": "b", BodyHashHeader: "forged"},
+		Body:   []byte("hello"),
+	}
+	if msg.WithoutHeaders("c") != msg {
+		t.Errorf("copied without a reason")
+	}
+	stripped := msg.WithoutHeaders(BodyHashHeader, "c")
+	if _, ok := stripped.Header[BodyHashHeader]; ok || stripped.Header["a"] != "b" || string(stripped.Body) != "hello" {
+		t.Errorf("bad message: %v", stripped)
+	}
+	if _, ok := msg.Header[BodyHashHeader]; !ok {
+		t.Errorf("the original message is changed: %v", msg)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"bytes"
+	"code.google.com/p/snappy-go/snappy"
+	"encoding/binary"
+	"sync"
+)
+
+// Payload is the encoded header and body of a message. When a message
+// is sent to many connections, the connections share one Payload so
+// that the message is serialized, and compressed, only once; only the
+// parameters of the command and the encryption differ between them.
+//
+// The message should not be changed after the payload is created.
+// Otherwise, the changes will not be sent.
+type Payload struct {
+	nrHeaders int
+	flags     byte
+	size      int
+	data      []byte
+	err       error
+
+	compressOnce sync.Once
+	compressed   []byte
+	compressErr  error
+}
+
+func NewPayload(msg *Message) *Payload {
+	ret := new(Payload)
+	if msg == nil {
+		return ret
+	}
+	ret.nrHeaders = nrWireHeaders(msg)
+	ret.flags, ret.err = messageFlags(msg)
+	ret.size = msg.Size()
+	ret.data = appendMessage(make([]byte, 0, ret.size), msg)
+	return ret
+}
+
+// Size() is the size of the message when the payload was created.
+func (self *Payload) Size() int {
+	if self == nil {
+		return 0
+	}
+	return self.size
+}
+
+// A snappy block is the length of the uncompressed data followed
+// by literals and copies. Copies refer to the data already decoded by
+// its offset from the current position. Hence the payload, once
+// compressed, could be put after a literal carrying the head of the
+// command without being compressed again.
+var snappyComposable = func() bool {
+	head := []byte("head")
+	data := bytes.Repeat([]byte("payload"), 16)
+	p := &Payload{data: data}
+	composed, err := p.compressAfter(head)
+	if err != nil {
+		return false
+	}
+	decoded, err := snappy.Decode(nil, composed)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(decoded, append(head, data...))
+}()
+
+func appendSnappyLiteral(dst, lit []byte) []byte {
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n<<2))
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// compressAfter() returns the snappy encoded head followed by the
+// payload, compressing the payload only the first time.
+func (self *Payload) compressAfter(head []byte) (data []byte, err error) {
+	self.compressOnce.Do(func() {
+		if len(self.data) == 0 {
+			return
+		}
+		var enc []byte
+		runCPU(CPU_COMPRESSION, func() {
+			enc, self.compressErr = snappy.Encode(nil, self.data)
+		})
+		if self.compressErr != nil {
+			return
+		}
+		_, n := binary.Uvarint(enc)
+		if n <= 0 {
+			self.compressErr = ErrCorruptedData
+			return
+		}
+		self.compressed = enc[n:]
+	})
+	if self.compressErr != nil {
+		err = self.compressErr
+		return
+	}
+	data = make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(head)+5+len(self.compressed))
+	n := binary.PutUvarint(data, uint64(len(head)+len(self.data)))
+	data = data[:n]
+	if len(head) > 0 {
+		data = appendSnappyLiteral(data, head)
+	}
+	data = append(data, self.compressed...)
+	return
+}
+
+// marshalWithPayload() encodes the command and the payload which
+// replaces the message of the command.
+func (self *Command) marshalWithPayload(payload *Payload, compress bool) (data []byte, err error) {
+	if payload.err != nil {
+		err = payload.err
+		return
+	}
+	data, err = self.marshalHead(payload.nrHeaders, payload.flags)
+	if err != nil {
+		return
+	}
+	if !compress {
+		data = append(data, payload.data...)
+		return
+	}
+	if snappyComposable {
+		return payload.compressAfter(data)
+	}
+	runCPU(CPU_COMPRESSION, func() {
+		data, err = snappy.Encode(nil, append(data, payload.data...))
+	})
+	return
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func testSharedCommands(t *testing.T, compress bool) {
+	msg := &Message{
+		Header:       map[string]string{"title": "hello"},
+		BinaryHeader: map[string][]byte{"thumbnail": []byte{0x89, 0, 'P', 'N', 'G'}},
+		Body:         bytes.Repeat([]byte("group broadcast "), 64),
+	}
+	payload := NewPayload(msg)
+	for i := 0; i < 3; i++ {
+		w, r, _, _ := getBufferCommandIOs(t)
+		cmd := &Command{
+			Type:    CMD_DATA,
+			Params:  []string{fmt.Sprintf("id-%v", i), fmt.Sprintf("%v", i+1)},
+			Message: msg,
+		}
+		err := w.WriteSharedCommand(cmd, payload, compress)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		recved, err := r.ReadCommand()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !cmd.eq(recved) {
+			t.Errorf("%v is not %v", recved, cmd)
+		}
+	}
+}
+
+func TestSharedCommandNoCompress(t *testing.T) {
+	testSharedCommands(t, false)
+}
+
+func TestSharedCommand(t *testing.T) {
+	testSharedCommands(t, true)
+}
+
+func TestSharedCommandOpaqueNoMessage(t *testing.T) {
+	w, r, _, _ := getBufferCommandIOs(t)
+	msg := &Message{Body: []byte("encrypted"), Opaque: true}
+	cmd := &Command{Type: CMD_FWD, Params: []string{"alice", "srv", "id"}, Message: msg}
+	if err := w.WriteSharedCommand(cmd, NewPayload(msg), false); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	empty := &Command{Type: CMD_SETTING, Params: []string{"1"}}
+	if err := w.WriteSharedCommand(empty, NewPayload(nil), true); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, expected := range []*Command{cmd, empty} {
+		recved, err := r.ReadCommand()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !expected.eq(recved) {
+			t.Errorf("%v is not %v", recved, expected)
+		}
+	}
+}
+
+func TestSnappyLiteral(t *testing.T) {
+	for _, n := range []int{1, 60, 61, 256, 257, 70000} {
+		lit := appendSnappyLiteral(nil, make([]byte, n))
+		hdr := len(lit) - n
+		expected := 1
+		switch {
+		case n > 1<<16:
+			expected = 4
+		case n > 256:
+			expected = 3
+		case n > 60:
+			expected = 2
+		}
+		if hdr != expected || lit[0]&0x3 != 0 {
+			t.Errorf("bad literal of %v bytes: tag=%x header=%v", n, lit[0], hdr)
+		}
+	}
+}
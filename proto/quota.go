@@ -0,0 +1,89 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The scopes of a quota.
+const (
+	QUOTA_SCOPE_USER    = "user"
+	QUOTA_SCOPE_SERVICE = "service"
+)
+
+// The resources limited by a quota.
+const (
+	QUOTA_MESSAGES = "messages"
+	QUOTA_BYTES    = "bytes"
+)
+
+// QuotaError tells that the messages or the bytes sent by a user,
+// or in a service, have reached their limit until Reset.
+type QuotaError struct {
+	Scope    string    `json:"scope"`
+	Resource string    `json:"resource"`
+	Limit    int64     `json:"limit"`
+	Reset    time.Time `json:"reset"`
+}
+
+func (self *QuotaError) Error() string {
+	return fmt.Sprintf("%v quota of %v exceeded: limit %v until %v", self.Scope, self.Resource, self.Limit, self.Reset.UTC().Format(time.RFC3339))
+}
+
+// Command returns a CMD_QUOTA_EXCEEDED carrying the error.
+func (self *QuotaError) Command(reqId string) *Command {
+	return &Command{
+		Type: CMD_QUOTA_EXCEEDED,
+		Params: []string{
+			reqId,
+			self.Scope,
+			self.Resource,
+			strconv.FormatInt(self.Limit, 10),
+			strconv.FormatInt(self.Reset.Unix(), 10),
+		},
+	}
+}
+
+// ParseQuotaError parses the parameters of a CMD_QUOTA_EXCEEDED.
+func ParseQuotaError(params []string) (reqId string, qerr *QuotaError, err error) {
+	if len(params) < 5 {
+		err = ErrBadPeerImpl
+		return
+	}
+	limit, err := strconv.ParseInt(params[3], 10, 64)
+	if err != nil {
+		err = ErrBadPeerImpl
+		return
+	}
+	reset, err := strconv.ParseInt(params[4], 10, 64)
+	if err != nil {
+		err = ErrBadPeerImpl
+		return
+	}
+	reqId = params[0]
+	qerr = &QuotaError{
+		Scope:    params[1],
+		Resource: params[2],
+		Limit:    limit,
+		Reset:    time.Unix(reset, 0),
+	}
+	return
+}
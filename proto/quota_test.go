@@ -0,0 +1,46 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaErrorCommand(t *testing.T) {
+	qerr := &QuotaError{
+		Scope:    QUOTA_SCOPE_USER,
+		Resource: QUOTA_BYTES,
+		Limit:    1024,
+		Reset:    time.Unix(1700000000, 0),
+	}
+	cmd := qerr.Command("7")
+	if cmd.Type != CMD_QUOTA_EXCEEDED {
+		t.Errorf("bad command: %v", cmd)
+	}
+	reqId, parsed, err := ParseQuotaError(cmd.Params)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if reqId != "7" || *parsed != *qerr {
+		t.Errorf("bad quota error: %v %+v", reqId, parsed)
+	}
+	if _, _, err := ParseQuotaError(cmd.Params[:4]); err == nil {
+		t.Errorf("should reject a short command")
+	}
+}
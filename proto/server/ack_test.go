@@ -0,0 +1,87 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/uniqush/uniqush-conn/proto"
+
+	"testing"
+	"time"
+)
+
+func TestAckMessages(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	defer clearCache()
+	servConn.SetMessageCache(cache)
+
+	N := 10
+	mcs := make([]*proto.MessageContainer, N)
+
+	for i := 0; i < N; i++ {
+		mcs[i] = &proto.MessageContainer{
+			Message: randomMessage(),
+			Id:      fmt.Sprintf("%v", i),
+		}
+		_, err := cache.CacheMessage(servConn.Service(), servConn.Username(), mcs[i], 1*time.Hour)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+	}
+
+	go func() {
+		for _, mc := range mcs {
+			cliConn.MarkRead(mc.Id)
+		}
+		// So that the server will return from ReceiveMessage()
+		cliConn.SendMessageToServer(randomMessage())
+	}()
+
+	_, err = servConn.ReceiveMessage()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	for _, mc := range mcs {
+		state, err := cache.GetDeliveryState(servConn.Service(), servConn.Username(), mc.Id)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			continue
+		}
+		if state == nil || !state.IsDelivered() || !state.IsAcked() || !state.IsRead() {
+			t.Errorf("wrong state: %+v", state)
+		}
+	}
+	n, err := cache.NrUndelivered(servConn.Service(), servConn.Username())
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("%v messages are not delivered", n)
+	}
+}
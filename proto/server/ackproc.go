@@ -0,0 +1,92 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+type ackProcessor struct {
+	conn  *serverConn
+	cache msgcache.Cache
+}
+
+// Ack tells that the client acked a cached message.
+type Ack struct {
+	Service  string
+	Username string
+	ConnId   string
+	Id       string
+	Read     bool
+}
+
+func (self *ackProcessor) ProcessCommand(cmd *proto.Command) (msg *proto.Message, err error) {
+	if cmd == nil || cmd.Type != proto.CMD_ACK || self.conn == nil || self.cache == nil {
+		return
+	}
+	ack, err := proto.ParseAck(cmd.Params)
+	if err != nil {
+		return
+	}
+	id := ack.Id
+	if len(id) == 0 {
+		return
+	}
+	srv := self.conn.Service()
+	usr := self.conn.Username()
+
+	var state *msgcache.DeliveryState
+	if self.conn.latency != nil {
+		// The state before the ack. An error only loses the latency.
+		state, _ = self.cache.GetDeliveryState(srv, usr, id)
+	}
+
+	// An acked message must have been delivered.
+	err = self.cache.UpdateDeliveryState(srv, usr, id, msgcache.STATE_DELIVERED)
+	if err != nil {
+		return
+	}
+	err = self.cache.UpdateDeliveryState(srv, usr, id, msgcache.STATE_ACKED)
+	if err != nil {
+		return
+	}
+	self.conn.ackLatency(state)
+	if ack.Read {
+		err = self.cache.UpdateDeliveryState(srv, usr, id, msgcache.STATE_READ)
+		if err != nil {
+			return
+		}
+	}
+	if self.conn.autoCached() {
+		err = self.cache.Del(srv, usr, id)
+		if err != nil {
+			return
+		}
+	}
+	if self.conn.ackChan != nil {
+		self.conn.ackChan <- &Ack{
+			Service:  srv,
+			Username: usr,
+			ConnId:   self.conn.ConnId(),
+			Id:       id,
+			Read:     ack.Read,
+		}
+	}
+	return
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+type proxiedConn struct {
+	net.Conn
+}
+
+func (self *proxiedConn) Transport() string {
+	return "websocket"
+}
+
+func (self *proxiedConn) ClientAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+}
+
+func TestClientAddr(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	conn := NewConn(nil, "service", "user", c1)
+	if conn.Transport() != "tcp" || conn.ClientAddr() != c1.RemoteAddr() {
+		t.Errorf("bad address of a plain connection: %v %v", conn.Transport(), conn.ClientAddr())
+	}
+	conn = NewConn(nil, "service", "user", &proxiedConn{c1})
+	stats := conn.Stats()
+	if stats.Transport != "websocket" || stats.ClientAddr != "[2001:db8::1]:443" || stats.RemoteAddr != c1.RemoteAddr().String() {
+		t.Errorf("bad stats: %+v", stats)
+	}
+}
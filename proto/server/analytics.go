@@ -0,0 +1,47 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+// AnalyticsRecorder is implemented by analytics.Recorder.
+type AnalyticsRecorder interface {
+	RecordMessage(service, username string, size int)
+	RecordDigests(service, username string, n int)
+	RecordRetrieval(service, username string)
+}
+
+func (self *serverConn) SetAnalyticsRecorder(r AnalyticsRecorder) {
+	self.analytics = r
+}
+
+func (self *serverConn) recordMessage(size int) {
+	if self.analytics != nil {
+		self.analytics.RecordMessage(self.service, self.username, size)
+	}
+}
+
+func (self *serverConn) recordDigests(n int) {
+	if self.analytics != nil {
+		self.analytics.RecordDigests(self.service, self.username, n)
+	}
+}
+
+func (self *serverConn) recordRetrieval() {
+	if self.analytics != nil {
+		self.analytics.RecordRetrieval(self.service, self.username)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+)
+
+type countingRecorder struct {
+	lock                        sync.Mutex
+	msgs, bytes, digests, retrs int
+}
+
+func (self *countingRecorder) RecordMessage(service, username string, size int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.msgs++
+	self.bytes += size
+}
+
+func (self *countingRecorder) RecordDigests(service, username string, n int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.digests += n
+}
+
+func (self *countingRecorder) RecordRetrieval(service, username string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.retrs++
+}
+
+func TestAnalyticsRecorder(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	defer clearCache()
+	servConn.SetMessageCache(cache)
+	rec := new(countingRecorder)
+	servConn.SetAnalyticsRecorder(rec)
+	servConn.SetDigestThreshold(0)
+	digestChan := make(chan *client.Digest, 1)
+	cliConn.SetDigestChannel(digestChan)
+	go servConn.ReceiveMessage()
+
+	mc := &proto.MessageContainer{
+		Message: randomMessage(),
+	}
+	_, err = cache.CacheMessage(servConn.Service(), servConn.Username(), mc, 1*time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	received := make(chan *proto.MessageContainer, 1)
+	go func() {
+		for {
+			mc, err := cliConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			received <- mc
+		}
+	}()
+	if err = servConn.DeliverMessage(mc, nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	select {
+	case d := <-digestChan:
+		cliConn.RequestMessage(d.MsgId)
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no digest")
+	}
+	select {
+	case <-received:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the message is not retrieved")
+	}
+
+	// The message is recorded once it is written.
+	for i := 0; i < 100; i++ {
+		rec.lock.Lock()
+		done := rec.retrs > 0
+		rec.lock.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.digests != 1 || rec.msgs != 1 || rec.bytes != mc.Message.Size() || rec.retrs != 1 {
+		t.Errorf("bad counters: %v messages, %v bytes, %v digests, %v retrievals", rec.msgs, rec.bytes, rec.digests, rec.retrs)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/asset"
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+// assetProcessor records the versions of the assets applied by the
+// device of the client, or by the connection if the client did not
+// tell its device.
+type assetProcessor struct {
+	conn  *serverConn
+	store asset.Store
+}
+
+func (self *assetProcessor) ProcessCommand(cmd *proto.Command) (msg *proto.Message, err error) {
+	if cmd == nil || cmd.Type != proto.CMD_ASSET || self.conn == nil || self.store == nil {
+		return
+	}
+	applied, err := proto.ParseAssetVersion(cmd.Params)
+	if err != nil {
+		return
+	}
+	device := self.conn.device
+	if device == "" {
+		device = self.conn.ConnId()
+	}
+	err = self.store.SetApplied(self.conn.Service(), self.conn.Username(), device, applied.Name, applied.Version)
+	return
+}
+
+func (self *serverConn) SetAssetStore(store asset.Store) {
+	if store == nil {
+		return
+	}
+	proc := new(assetProcessor)
+	proc.conn = self
+	proc.store = store
+	self.setCommandProcessor(proto.CMD_ASSET, proc)
+}
+
+func (self *serverConn) SendAsset(a *asset.Asset) error {
+	if a == nil || !self.HasCapability(proto.CAP_ASSETS) {
+		return nil
+	}
+	v := &proto.AssetVersion{Name: a.Name, Version: a.Version}
+	msg := &proto.Message{Body: a.Data}
+	return self.writeMessageCommand(v.Command(msg), nil, self.shouldCompress(len(a.Data)))
+}
@@ -18,9 +18,10 @@
 package server
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"errors"
 	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/tracing"
 	"net"
 	"strings"
 	"time"
@@ -30,11 +31,81 @@ type Authenticator interface {
 	Authenticate(srv, usr, token, addr string) (bool, error)
 }
 
+// DictionaryFinder returns the compression dictionary of a service,
+// or nil if it has none.
+type DictionaryFinder interface {
+	Dictionary(service string) *proto.Dictionary
+}
+
+// PlaintextPolicy tells if the public messages of a service may be
+// sent in plaintext. A DictionaryFinder given to
+// AuthConnWithDictionaries may implement it.
+type PlaintextPolicy interface {
+	AllowPlaintext(service string) bool
+}
+
 var ErrAuthFail = errors.New("authentication failed")
+var ErrTooManyHandshakes = errors.New("too many handshakes from the address")
+
+// DefaultHandshakeTimeout is used if HandshakeLimits.Timeout is not set.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// HandshakeLimits bounds what a connection may hold before it is
+// authenticated. A zero field means no limit, except Timeout.
+type HandshakeLimits struct {
+	// Timeout bounds the whole handshake.
+	Timeout time.Duration
+
+	// KeyExchangeTimeout bounds the key exchange, including the
+	// PROXY protocol header.
+	KeyExchangeTimeout time.Duration
+
+	// MaxAuthBytes bounds the length of the auth command.
+	MaxAuthBytes int
+
+	// Guard bounds the concurrent handshakes per address.
+	Guard *HandshakeGuard
+}
 
-// The conn will be closed if any error occur
-func AuthConn(conn net.Conn, privkey *rsa.PrivateKey, auth Authenticator, timeout time.Duration) (c Conn, err error) {
-	conn.SetDeadline(time.Now().Add(timeout))
+// The conn will be closed if any error occur.
+// The privkey is usually a *rsa.PrivateKey, but any crypto.Signer
+// holding an RSA key (e.g. a PKCS#11 one) can sign the handshake. A
+// *proto.KeyRing also accepts the clients pinning a previous key.
+func AuthConn(conn net.Conn, privkey crypto.Signer, auth Authenticator, timeout time.Duration) (c Conn, err error) {
+	return AuthConnWithDictionaries(conn, privkey, auth, timeout, nil)
+}
+
+// AuthConnWithDictionaries is like AuthConn, but it compresses the
+// commands with the dictionary of the service if the client has it.
+// If dicts is a PlaintextPolicy allowing it, the public messages are
+// sent in plaintext to the clients accepting it.
+func AuthConnWithDictionaries(conn net.Conn, privkey crypto.Signer, auth Authenticator, timeout time.Duration, dicts DictionaryFinder) (c Conn, err error) {
+	return AuthConnWithLimits(conn, privkey, auth, HandshakeLimits{Timeout: timeout}, dicts)
+}
+
+// headerReader is implemented by the connections starting with a
+// header, e.g. the PROXY protocol one, which tells the client address.
+type headerReader interface {
+	ReadHeader() error
+}
+
+// AuthConnWithLimits is like AuthConnWithDictionaries, but the
+// handshake is bounded by limits.
+func AuthConnWithLimits(conn net.Conn, privkey crypto.Signer, auth Authenticator, limits HandshakeLimits, dicts DictionaryFinder) (c Conn, err error) {
+	span := tracing.Start("handshake", "", "addr", conn.RemoteAddr().String())
+	defer func() {
+		tracing.End(span, err)
+	}()
+	timeout := limits.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	kxDeadline := deadline
+	if limits.KeyExchangeTimeout > 0 && limits.KeyExchangeTimeout < timeout {
+		kxDeadline = time.Now().Add(limits.KeyExchangeTimeout)
+	}
+	conn.SetDeadline(kxDeadline)
 	defer func() {
 		if err == nil {
 			err = conn.SetDeadline(time.Time{})
@@ -44,27 +115,49 @@ func AuthConn(conn net.Conn, privkey *rsa.PrivateKey, auth Authenticator, timeou
 		}
 	}()
 
-	ks, err := proto.ServerKeyExchange(privkey, conn)
+	// Read the header first, so that the address is the client's.
+	if h, ok := conn.(headerReader); ok {
+		err = h.ReadHeader()
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+	if limits.Guard != nil {
+		addr := ClientAddr(conn)
+		if !limits.Guard.acquire(addr) {
+			err = ErrTooManyHandshakes
+			conn.Close()
+			return
+		}
+		defer limits.Guard.release(addr)
+	}
+
+	ks, err := proto.ServerKeyExchangeWithSigner(privkey, conn)
 	if err != nil {
 		conn.Close()
 		return
 	}
+	conn.SetDeadline(deadline)
 	cmdio := ks.ServerCommandIO(conn)
+	cmdio.SetMaxReadLength(limits.MaxAuthBytes)
 	cmd, err := cmdio.ReadCommand()
 	if err != nil {
 		return
 	}
+	cmdio.SetMaxReadLength(0)
 	if cmd.Type != proto.CMD_AUTH {
 		err = ErrAuthFail
 		return
 	}
-	if len(cmd.Params) != 3 {
+	req, err := proto.ParseAuth(cmd.Params)
+	if err != nil {
 		err = ErrAuthFail
 		return
 	}
-	service := cmd.Params[0]
-	username := cmd.Params[1]
-	token := cmd.Params[2]
+	service := req.Service
+	username := req.Username
+	token := req.Token
 
 	// Username and service should not contain "\n"
 	if strings.Contains(service, "\n") || strings.Contains(username, "\n") ||
@@ -73,7 +166,16 @@ func AuthConn(conn net.Conn, privkey *rsa.PrivateKey, auth Authenticator, timeou
 		return
 	}
 
-	ok, err := auth.Authenticate(service, username, token, conn.RemoteAddr().String())
+	// The client's address is only known after the first read
+	// if the connection is behind a proxy.
+	addr := ClientAddr(conn).String()
+	var ok bool
+	var bound string
+	if da, isDA := auth.(DeviceAuthenticator); isDA {
+		bound, ok, err = da.AuthenticateDevice(service, username, token, addr, req.Device)
+	} else {
+		ok, err = auth.Authenticate(service, username, token, addr)
+	}
 	if err != nil {
 		return
 	}
@@ -82,14 +184,44 @@ func AuthConn(conn net.Conn, privkey *rsa.PrivateKey, auth Authenticator, timeou
 		return
 	}
 
-	cmd.Type = proto.CMD_AUTHOK
-	cmd.Params = nil
-	cmd.Message = nil
-	err = cmdio.WriteCommand(cmd, false)
+	var dict *proto.Dictionary
+	if dicts != nil && len(req.Dictionaries) > 0 {
+		dict = dicts.Dictionary(service)
+		if dict != nil && !req.HasDictionary(dict.Id) {
+			dict = nil
+		}
+	}
+
+	plaintext := false
+	if policy, ok := dicts.(PlaintextPolicy); ok && req.Plaintext {
+		plaintext = policy.AllowPlaintext(service)
+	}
+
+	sc := newServerConn(cmdio, service, username, conn)
+	sc.binding = bound
+	sc.device = req.Device
+	authok := &proto.AuthOK{ConnId: sc.ConnId(), Plaintext: plaintext, Caps: len(req.Caps) > 0}
+	if dict != nil {
+		authok.Dictionary = dict.Id
+	}
+	err = cmdio.WriteCommand(authok.Command(), false)
 	if err != nil {
 		return
 	}
-	c = NewConn(cmdio, service, username, conn)
+	if dict != nil {
+		cmdio.SetDictionary(dict)
+	}
+	if plaintext {
+		cmdio.SetPlaintext(true)
+	}
+	if len(req.Caps) > 0 {
+		err = writeCaps(cmdio)
+		if err != nil {
+			return
+		}
+		sc.setCaps(&proto.Caps{Features: req.Caps})
+	}
+	c = sc
 	err = nil
 	return
 }
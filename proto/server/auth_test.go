@@ -20,8 +20,12 @@ package server
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/client"
+	"io"
+	"io/ioutil"
 	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -116,6 +120,27 @@ func TestAuthOK(t *testing.T) {
 	}
 }
 
+func TestConnIdSentToClient(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	ids := make(map[string]bool, 2)
+	for i := 0; i < 2; i++ {
+		servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if len(servConn.ConnId()) == 0 || servConn.ConnId() != cliConn.ConnId() {
+			t.Errorf("server's id %q is not client's %q", servConn.ConnId(), cliConn.ConnId())
+		}
+		ids[servConn.ConnId()] = true
+		servConn.Close()
+		cliConn.Close()
+	}
+	if len(ids) != 2 {
+		t.Errorf("connection ids are not unique: %v", ids)
+	}
+}
+
 func TestAuthFail(t *testing.T) {
 	addr := "127.0.0.1:8088"
 	token := "wrong token"
@@ -130,3 +155,94 @@ func TestAuthFail(t *testing.T) {
 		cliConn.Close()
 	}
 }
+
+// silentClient reads what the server sends, but sends nothing.
+func silentClient(c net.Conn) {
+	io.Copy(ioutil.Discard, c)
+}
+
+func TestKeyExchangeTimeout(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, c := net.Pipe()
+	defer c.Close()
+	go silentClient(c)
+	limits := HandshakeLimits{Timeout: 10 * time.Second, KeyExchangeTimeout: 200 * time.Millisecond}
+	start := time.Now()
+	_, err = AuthConnWithLimits(s, priv, new(singleUserAuth), limits, nil)
+	if err == nil {
+		t.Fatal("should time out")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("the key exchange took %v", d)
+	}
+}
+
+func TestTooManyHandshakes(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := HandshakeLimits{
+		Timeout: 500 * time.Millisecond,
+		Guard:   NewHandshakeGuard(1),
+	}
+	s1, c1 := net.Pipe()
+	defer c1.Close()
+	go silentClient(c1)
+	done := make(chan error)
+	go func() {
+		_, err := AuthConnWithLimits(s1, priv, new(singleUserAuth), limits, nil)
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Both pipes have the same address.
+	s2, c2 := net.Pipe()
+	defer c2.Close()
+	_, err = AuthConnWithLimits(s2, priv, new(singleUserAuth), limits, nil)
+	if err != ErrTooManyHandshakes {
+		t.Errorf("should be ErrTooManyHandshakes: %v", err)
+	}
+	if err = <-done; err == nil {
+		t.Errorf("the silent client should time out")
+	}
+
+	// The slot is released once the first handshake is over.
+	s3, c3 := net.Pipe()
+	defer c3.Close()
+	go silentClient(c3)
+	_, err = AuthConnWithLimits(s3, priv, new(singleUserAuth), limits, nil)
+	if err == ErrTooManyHandshakes {
+		t.Errorf("the guard is not released")
+	}
+}
+
+func TestMaxAuthBytes(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &singleUserAuth{"service", "username", strings.Repeat("t", 1024)}
+	limits := HandshakeLimits{Timeout: 3 * time.Second, MaxAuthBytes: 512}
+	for _, token := range []string{"token", auth.token} {
+		auth.token = token
+		s, c := net.Pipe()
+		go client.Dial(c, &priv.PublicKey, auth.service, auth.username, token, 3*time.Second)
+		conn, err := AuthConnWithLimits(s, priv, auth, limits, nil)
+		if len(token) > limits.MaxAuthBytes {
+			if err != proto.ErrCommandTooLarge {
+				t.Errorf("should be ErrCommandTooLarge: %v", err)
+			}
+		} else if err != nil {
+			t.Errorf("error: %v", err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		s.Close()
+		c.Close()
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoCache(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	defer clearCache()
+	servConn.SetMessageCache(cache)
+	servConn.SetAutoCache(true, time.Hour)
+
+	msg := randomMessage()
+	err = servConn.SendMessage(msg, "", nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	mc, err := cliConn.ReceiveMessage()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if len(mc.Id) == 0 || mc.Seq != 1 {
+		t.Errorf("the message is not cached: %+v", mc)
+		return
+	}
+
+	go func() {
+		cliConn.Ack(mc.Id)
+		// So that the server will return from ReceiveMessage()
+		cliConn.SendMessageToServer(randomMessage())
+	}()
+	_, err = servConn.ReceiveMessage()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if cached, _ := cache.Get(servConn.Service(), servConn.Username(), mc.Id); cached != nil {
+		t.Errorf("acked message should be deleted")
+	}
+	state, _ := cache.GetDeliveryState(servConn.Service(), servConn.Username(), mc.Id)
+	if state == nil || !state.IsAcked() {
+		t.Errorf("bad state: %+v", state)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/binding"
+)
+
+// BindingPolicyFinder returns the binding policy of a service, or nil
+// if its tokens are bound to nothing.
+type BindingPolicyFinder interface {
+	BindingPolicy(service string) *binding.Policy
+}
+
+// DeviceAuthenticator is an Authenticator which is also told the id
+// of the device sent by the client, if any. It returns what the
+// connection is bound to, if anything: the session saved by a
+// connection is only restored for connections bound to the same.
+type DeviceAuthenticator interface {
+	AuthenticateDevice(srv, usr, token, addr, device string) (bound string, ok bool, err error)
+}
+
+// Binder is an Authenticator which ties the tokens to the device, or
+// the network, they are first accepted from. A token used elsewhere
+// is rejected even if the underlying Authenticator accepts it.
+type Binder struct {
+	auth     Authenticator
+	store    binding.Store
+	policies BindingPolicyFinder
+}
+
+// NewBinder keeps the bindings in the store. A store shared by all
+// nodes makes a token bound on one node rejected elsewhere by every
+// node.
+func NewBinder(auth Authenticator, store binding.Store, policies BindingPolicyFinder) *Binder {
+	ret := new(Binder)
+	ret.auth = auth
+	ret.store = store
+	ret.policies = policies
+	if ret.store == nil {
+		ret.store = binding.NewMemoryStore()
+	}
+	return ret
+}
+
+// Unbind() frees all tokens of the user. They are tied again to
+// where they are accepted next.
+func (self *Binder) Unbind(srv, usr string) error {
+	return self.store.Unbind(srv, usr)
+}
+
+func (self *Binder) Authenticate(srv, usr, token, addr string) (bool, error) {
+	_, ok, err := self.AuthenticateDevice(srv, usr, token, addr, "")
+	return ok, err
+}
+
+func (self *Binder) AuthenticateDevice(srv, usr, token, addr, device string) (bound string, ok bool, err error) {
+	var policy *binding.Policy
+	if self.policies != nil {
+		policy = self.policies.BindingPolicy(srv)
+	}
+	key, err := policy.Key(addr, device)
+	if err != nil {
+		// The client cannot be told where it is from.
+		err = nil
+		return
+	}
+	if self.auth == nil {
+		return
+	}
+	// Only the accepted tokens are bound: a bad token sent first
+	// from elsewhere must not lock the user out.
+	ok, err = self.auth.Authenticate(srv, usr, token, addr)
+	if err != nil || !ok || len(key) == 0 {
+		return
+	}
+	ok, err = self.store.Bind(srv, usr, token, key)
+	if err != nil || !ok {
+		ok = false
+		return
+	}
+	bound = key
+	return
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/binding"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"github.com/uniqush/uniqush-conn/session"
+)
+
+type singlePolicy struct {
+	policy *binding.Policy
+}
+
+func (self *singlePolicy) BindingPolicy(service string) *binding.Policy {
+	return self.policy
+}
+
+func TestBinder(t *testing.T) {
+	auth := &singleUserAuth{"service", "username", "token"}
+	policies := &singlePolicy{&binding.Policy{Device: true, IPv4Prefix: 24}}
+	binder := NewBinder(auth, binding.NewMemoryStore(), policies)
+	check := func(token, addr, device string, expected bool) {
+		bound, ok, err := binder.AuthenticateDevice("service", "username", token, addr, device)
+		if err != nil || ok != expected || (ok && len(bound) == 0) {
+			t.Errorf("token %q from %v/%q: expected %v; got %v %q (%v)", token, addr, device, expected, ok, bound, err)
+		}
+	}
+	// A bad token does not bind.
+	check("wrong", "10.0.0.1:1000", "evil", false)
+	check("token", "10.0.0.1:1000", "", false)
+	check("token", "10.0.0.1:1000", "phone", true)
+	check("token", "10.0.0.7:2000", "phone", true)
+	check("token", "10.0.1.1:1000", "phone", false)
+	check("token", "10.0.0.1:1000", "tablet", false)
+	if ok, _ := binder.Authenticate("service", "username", "token", "10.0.0.1:1000"); ok {
+		t.Errorf("a client without device id should be rejected")
+	}
+
+	binder.Unbind("service", "username")
+	check("token", "10.0.1.1:1000", "tablet", true)
+	check("token", "10.0.0.1:1000", "phone", false)
+
+	// Nothing is bound without a policy.
+	policies.policy = nil
+	if bound, ok, err := binder.AuthenticateDevice("service", "username", "token", "10.0.0.1:1000", "phone"); !ok || len(bound) > 0 || err != nil {
+		t.Errorf("without a policy: got %v %q (%v)", ok, bound, err)
+	}
+}
+
+func dialWithDevice(priv *rsa.PrivateKey, auth Authenticator, device string) (servConn Conn, cliConn client.Conn, err error) {
+	c1, c2 := net.Pipe()
+	done := make(chan error)
+	go func() {
+		var e error
+		servConn, e = AuthConn(c1, priv, auth, 3*time.Second)
+		if e != nil {
+			c1.Close()
+		}
+		done <- e
+	}()
+	cliConn, err = client.DialWithOptions(c2, &priv.PublicKey, "service", "username", "token", 3*time.Second, &client.DialOptions{Device: device})
+	if e := <-done; err == nil {
+		err = e
+	}
+	return
+}
+
+func TestSessionBoundToDevice(t *testing.T) {
+	priv, e := rsa.GenerateKey(rand.Reader, 2048)
+	if e != nil {
+		t.Fatalf("Error: %v", e)
+	}
+	auth := &singleUserAuth{"service", "username", "token"}
+	binder := NewBinder(auth, nil, &singlePolicy{&binding.Policy{Device: true}})
+	store := session.NewMemoryStore()
+
+	servConn, cliConn, err := dialWithDevice(priv, binder, "phone")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	servConn.SetSessionStore(store)
+	// The pipe does not buffer the commands.
+	go func() {
+		cliConn.SetVisibility(false)
+		cliConn.SendMessageToServer(randomMessage())
+	}()
+	_, err = servConn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	servConn.Close()
+	cliConn.Close()
+
+	_, _, err = dialWithDevice(priv, binder, "tablet")
+	if err == nil {
+		t.Fatalf("the token should be rejected from another device")
+	}
+
+	// The token is free again, but not the session.
+	binder.Unbind("service", "username")
+	servConn, cliConn, err = dialWithDevice(priv, binder, "tablet")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	servConn.SetSessionStore(store)
+	if !servConn.Visible() {
+		t.Errorf("the session of another device should not be restored")
+	}
+	servConn.Close()
+	cliConn.Close()
+
+	state, err := store.Load("service", "username")
+	if err != nil || state == nil || state.Binding != "device=tablet" {
+		t.Errorf("the tablet should have saved its session: %+v (%v)", state, err)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/blocklist"
+	"github.com/uniqush/uniqush-conn/proto"
+	"testing"
+	"time"
+)
+
+func TestBlockList(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+	store := blocklist.NewMemoryStore()
+	servConn.SetBlockList(store)
+
+	go func() {
+		if err := cliConn.Block("bob", ""); err != nil {
+			t.Errorf("block error: %v", err)
+		}
+		if err := cliConn.Block("eve", "other"); err != nil {
+			t.Errorf("block error: %v", err)
+		}
+		if err := cliConn.Unblock("eve", "other"); err != nil {
+			t.Errorf("unblock error: %v", err)
+		}
+		// The server will have processed the commands above
+		// once it receives this message.
+		cliConn.SendMessageToServer(&proto.Message{Body: []byte("sync")})
+	}()
+
+	if _, err := servConn.ReceiveMessage(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	srv := servConn.Service()
+	usr := servConn.Username()
+	if blocked, _ := store.IsBlocked(srv, usr, srv, "bob"); !blocked {
+		t.Errorf("bob should be blocked")
+	}
+	if blocked, _ := store.IsBlocked(srv, usr, "other", "eve"); blocked {
+		t.Errorf("eve should be unblocked")
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/blocklist"
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+type blockProcessor struct {
+	conn  *serverConn
+	store blocklist.Store
+}
+
+func (self *blockProcessor) ProcessCommand(cmd *proto.Command) (msg *proto.Message, err error) {
+	if cmd == nil || cmd.Type != proto.CMD_BLOCK || self.conn == nil || self.store == nil {
+		return
+	}
+	req, err := proto.ParseBlock(cmd.Params)
+	if err == proto.ErrNoChange {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	senderService := self.conn.Service()
+	if len(req.Service) > 0 {
+		senderService = req.Service
+	}
+	if req.Block {
+		err = self.store.Block(self.conn.Service(), self.conn.Username(), senderService, req.Username)
+	} else {
+		err = self.store.Unblock(self.conn.Service(), self.conn.Username(), senderService, req.Username)
+	}
+	return
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+func TestBodyHash(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+	servConn.SetDigestThreshold(-1)
+
+	// Large enough to be compressed.
+	good := &proto.Message{Body: bytes.Repeat([]byte("hello"), 1024)}
+	good = good.WithBodyHash()
+	corrupted := &proto.Message{
+		Header: map[string]string{proto.BodyHashHeader: good.Header[proto.BodyHashHeader]},
+		Body:   []byte("hellp"),
+	}
+	go func() {
+		servConn.SendMessage(good, "", nil)
+		servConn.SendMessage(corrupted, "", nil)
+		servConn.ForwardMessage("bob", servConn.Service(), corrupted, "")
+		servConn.SendMessage(good, "", nil)
+	}()
+	mc, err := cliConn.ReceiveMessage()
+	if err != nil || !mc.Message.Eq(good) {
+		t.Fatalf("bad message: %v %v", mc, err)
+	}
+	for i := 0; i < 2; i++ {
+		mc, err = cliConn.ReceiveMessage()
+		if err != proto.ErrCorruptedBody || mc == nil || string(mc.Message.Body) != "hellp" {
+			t.Errorf("the corruption is not detected: %v %v", mc, err)
+		}
+	}
+	// The connection is still usable.
+	mc, err = cliConn.ReceiveMessage()
+	if err != nil || !mc.Message.Eq(good) {
+		t.Errorf("bad message: %v %v", mc, err)
+	}
+}
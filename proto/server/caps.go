@@ -0,0 +1,88 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+// Capabilities are the features advertised to the clients
+// understanding CMD_CAPS.
+var Capabilities = []string{
+	proto.CAP_ACK,
+	proto.CAP_DIGEST_BATCH,
+	proto.CAP_CHECKPOINTS,
+	proto.CAP_SEQ_RANGE,
+	proto.CAP_HEADERS_ONLY,
+	proto.CAP_MULTI_FORWARD,
+	proto.CAP_SCHEDULED_FORWARD,
+	proto.CAP_EPHEMERAL,
+	proto.CAP_EDIT,
+	proto.CAP_THREADS,
+	proto.CAP_STICKY_REPLIES,
+	proto.CAP_ASSETS,
+}
+
+// writeCaps sends the features of the server right after the
+// CMD_AUTHOK. The client already told its own in the CMD_AUTH, so
+// the handshake does not wait for another round trip.
+func writeCaps(cmdio *proto.CommandIO) error {
+	caps := &proto.Caps{Features: Capabilities}
+	return cmdio.WriteCommand(caps.Command(), false)
+}
+
+func (self *serverConn) setCaps(caps *proto.Caps) {
+	self.capsLock.Lock()
+	defer self.capsLock.Unlock()
+	self.caps = caps
+}
+
+func (self *serverConn) Capabilities() []string {
+	self.capsLock.Lock()
+	defer self.capsLock.Unlock()
+	if self.caps == nil {
+		return nil
+	}
+	ret := make([]string, len(self.caps.Features))
+	copy(ret, self.caps.Features)
+	return ret
+}
+
+func (self *serverConn) HasCapability(feature string) bool {
+	self.capsLock.Lock()
+	defer self.capsLock.Unlock()
+	return self.caps.Has(feature)
+}
+
+// capsProcessor replaces the features of the client when it sends
+// them again.
+type capsProcessor struct {
+	conn *serverConn
+}
+
+func (self *capsProcessor) ProcessCommand(cmd *proto.Command) (msg *proto.Message, err error) {
+	if cmd == nil || cmd.Type != proto.CMD_CAPS || self.conn == nil {
+		return
+	}
+	caps, err := proto.ParseCaps(cmd.Params)
+	if err != nil {
+		return
+	}
+	self.conn.setCaps(caps)
+	return
+}
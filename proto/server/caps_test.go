@@ -0,0 +1,114 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+)
+
+func TestCapsExchanged(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	for _, f := range Capabilities {
+		if !cliConn.HasCapability(f) {
+			t.Errorf("client does not see %v of the server: %v", f, cliConn.Capabilities())
+		}
+	}
+	for _, f := range client.Capabilities {
+		if !servConn.HasCapability(f) {
+			t.Errorf("server does not see %v of the client: %v", f, servConn.Capabilities())
+		}
+	}
+	if servConn.HasCapability("app.feature") {
+		t.Errorf("unknown feature advertised")
+	}
+
+	err = cliConn.Advertise("app.feature")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	go func() {
+		// Let the server receive the features.
+		cliConn.SendMessageToServer(randomMessage())
+	}()
+	_, err = servConn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !servConn.HasCapability("app.feature") || servConn.HasCapability(proto.CAP_ACK) {
+		t.Errorf("features not replaced: %v", servConn.Capabilities())
+	}
+}
+
+func TestNoCapsForOldClients(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &singleUserAuth{"service", "username", "token"}
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	authok := make(chan *proto.AuthOK, 1)
+	go func() {
+		defer close(authok)
+		ks, err := proto.ClientKeyExchange(&priv.PublicKey, c)
+		if err != nil {
+			return
+		}
+		cmdio := ks.ClientCommandIO(c)
+		req := &proto.Auth{Service: auth.service, Username: auth.username, Token: auth.token}
+		cmdio.WriteCommand(req.Command(), false)
+		cmd, err := cmdio.ReadCommand()
+		if err != nil || cmd.Type != proto.CMD_AUTHOK {
+			return
+		}
+		ok, err := proto.ParseAuthOK(cmd.Params)
+		if err == nil {
+			authok <- ok
+		}
+	}()
+	// Over a pipe a CMD_CAPS nobody reads would time the handshake out.
+	conn, err := AuthConn(s, priv, auth, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer conn.Close()
+	ok := <-authok
+	if ok == nil || ok.Caps {
+		t.Errorf("bad CMD_AUTHOK: %+v", ok)
+	}
+	if caps := conn.Capabilities(); len(caps) != 0 {
+		t.Errorf("old client advertised %v", caps)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+// The number of cached messages replayed between two checkpoints.
+const checkpointInterval = 100
+
+// replayCheckpoints tells, at every position of a replay, the largest
+// sequence number such that every message up to it has been sent.
+// The messages are normally in the order of their sequence numbers,
+// but a message cached concurrently may be out of order.
+type replayCheckpoints struct {
+	// after is the sequence number the replay resumes after.
+	after uint64
+
+	// suffixMin[i] is the smallest sequence number from i on, and
+	// max the largest one.
+	suffixMin []uint64
+	max       uint64
+}
+
+func newReplayCheckpoints(mcs []*proto.MessageContainer, after uint64) *replayCheckpoints {
+	ret := &replayCheckpoints{after: after, suffixMin: make([]uint64, len(mcs)+1)}
+	var min uint64
+	for i := len(mcs) - 1; i >= 0; i-- {
+		mc := mcs[i]
+		if mc == nil || mc.Seq == 0 {
+			ret.suffixMin[i] = min
+			continue
+		}
+		if min == 0 || mc.Seq < min {
+			min = mc.Seq
+		}
+		if mc.Seq > ret.max {
+			ret.max = mc.Seq
+		}
+		ret.suffixMin[i] = min
+	}
+	return ret
+}
+
+// due tells if a checkpoint should follow the message at i. The last
+// one is followed by the final checkpoint instead.
+func (self *replayCheckpoints) due(i int) bool {
+	return self != nil && (i+1)%checkpointInterval == 0 && i+1 < len(self.suffixMin)-1
+}
+
+// seq returns the checkpoint after the message at i.
+func (self *replayCheckpoints) seq(i int) (cp uint64) {
+	cp = self.after
+	next := self.suffixMin[i+1]
+	if next == 0 {
+		// Everything has been sent.
+		next = self.max + 1
+	}
+	if next-1 > cp {
+		cp = next - 1
+	}
+	return
+}
+
+func (self *serverConn) writeCheckpoint(seq uint64, done bool) error {
+	cp := &proto.ReplayCheckpoint{Seq: seq, Done: done}
+	return self.writer.write(cp.Command(), nil, false)
+}
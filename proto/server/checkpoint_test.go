@@ -0,0 +1,136 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+func TestReplayCheckpointsOutOfOrder(t *testing.T) {
+	mcs := []*proto.MessageContainer{{Seq: 3}, {Seq: 5}, {Seq: 4}, {}, {Seq: 6}}
+	cps := newReplayCheckpoints(mcs, 2)
+	for i, expected := range []uint64{3, 3, 5, 5, 6} {
+		if seq := cps.seq(i); seq != expected {
+			t.Errorf("checkpoint after %v: %v instead of %v", i, seq, expected)
+		}
+	}
+	if seq := newReplayCheckpoints(nil, 7).seq(-1); seq != 7 {
+		t.Errorf("checkpoint of an empty replay: %v", seq)
+	}
+}
+
+type checkpoint struct {
+	seq  uint64
+	done bool
+}
+
+func TestReplayCheckpoints(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	defer clearCache()
+	servConn.SetMessageCache(cache)
+	N := 250
+	for i := 0; i < N; i++ {
+		mc := &proto.MessageContainer{Message: randomMessage()}
+		if _, err = cache.CacheMessage(servConn.Service(), servConn.Username(), mc, time.Hour); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	checkpoints := make(chan checkpoint, 10)
+	cliConn.SetCheckpointHandler(func(seq uint64, done bool) {
+		checkpoints <- checkpoint{seq, done}
+	})
+	received := make(chan *proto.MessageContainer, N)
+	go func() {
+		for {
+			mc, err := cliConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			received <- mc
+		}
+	}()
+	go func() {
+		for {
+			if _, err := servConn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err = cliConn.RequestAllCachedMessages(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var cps []checkpoint
+	for len(cps) == 0 || !cps[len(cps)-1].done {
+		select {
+		case cp := <-checkpoints:
+			cps = append(cps, cp)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("checkpoints: %+v", cps)
+		}
+	}
+	if len(cps) != 3 || cps[0].seq != 100 || cps[1].seq != 200 || cps[2].seq != uint64(N) {
+		t.Errorf("bad checkpoints: %+v", cps)
+	}
+	if len(received) != N {
+		t.Errorf("%v messages before the last checkpoint", len(received))
+	}
+	for len(received) > 0 {
+		<-received
+	}
+
+	// Resume after the first checkpoint.
+	if err = cliConn.ResumeCachedMessages(cps[0].seq); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	select {
+	case cp := <-checkpoints:
+		if cp.seq != 200 || cp.done {
+			t.Errorf("bad checkpoint: %+v", cp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no checkpoint")
+	}
+	select {
+	case cp := <-checkpoints:
+		if cp.seq != uint64(N) || !cp.done {
+			t.Errorf("bad checkpoint: %+v", cp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no checkpoint")
+	}
+	if len(received) != N-100 {
+		t.Errorf("%v messages resumed", len(received))
+	}
+	mc := <-received
+	if mc.Seq != 101 {
+		t.Errorf("resumed at %v", mc.Seq)
+	}
+}
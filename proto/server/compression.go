@@ -0,0 +1,120 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+// The adaptive compression looks at the ratio of every window of
+// adaptiveCompressionWindow bytes compressed. A window compressed to
+// more than poorCompressionRatio of its size doubles the threshold,
+// and one compressed to less than goodCompressionRatio halves it,
+// never below the threshold of the client.
+const (
+	adaptiveCompressionWindow    = 16 * 1024
+	poorCompressionRatio         = 0.9
+	goodCompressionRatio         = 0.7
+	maxAdaptiveCompressThreshold = 64 * 1024
+)
+
+type adaptiveCompression struct {
+	// Accessed atomically.
+	enabled int32
+
+	lock sync.Mutex
+
+	// threshold is 0 unless it is raised above the one of the client.
+	threshold int
+
+	// The compression when the current window started.
+	window proto.CompressionStats
+}
+
+func (self *adaptiveCompression) raisedThreshold() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.threshold
+}
+
+func (self *adaptiveCompression) reset() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.threshold = 0
+}
+
+// adapt returns the threshold to use instead of t, given the
+// compression so far.
+func (self *adaptiveCompression) adapt(t int, stats *proto.CompressionStats) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if t <= 0 {
+		return t
+	}
+	raw := stats.RawBytes - self.window.RawBytes
+	if raw >= adaptiveCompressionWindow {
+		ratio := float64(stats.CompressedBytes-self.window.CompressedBytes) / float64(raw)
+		self.window = *stats
+		threshold := self.threshold
+		if threshold < t {
+			threshold = t
+		}
+		switch {
+		case ratio > poorCompressionRatio:
+			threshold *= 2
+			if threshold > maxAdaptiveCompressThreshold {
+				threshold = maxAdaptiveCompressThreshold
+			}
+		case ratio < goodCompressionRatio:
+			threshold /= 2
+		}
+		if threshold <= t {
+			threshold = 0
+		}
+		self.threshold = threshold
+	}
+	if self.threshold > t {
+		return self.threshold
+	}
+	return t
+}
+
+func (self *serverConn) SetAdaptiveCompression(on bool) {
+	self.compression.lock.Lock()
+	defer self.compression.lock.Unlock()
+	self.compression.threshold = 0
+	self.compression.window = *self.cmdio.CompressionStats()
+	var enabled int32
+	if on {
+		enabled = 1
+	}
+	atomic.StoreInt32(&self.compression.enabled, enabled)
+}
+
+// effectiveCompressThreshold is the compress threshold of the client,
+// unless the adaptive compression raises it.
+func (self *serverConn) effectiveCompressThreshold() int {
+	t := int(atomic.LoadInt32(&self.compressThreshold))
+	if atomic.LoadInt32(&self.compression.enabled) == 0 {
+		return t
+	}
+	return self.compression.adapt(t, self.cmdio.CompressionStats())
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+func TestAdaptiveCompression(t *testing.T) {
+	c := new(adaptiveCompression)
+	stats := new(proto.CompressionStats)
+	compress := func(raw, compressed int64) int {
+		stats.RawBytes += raw
+		stats.CompressedBytes += compressed
+		return c.adapt(1024, stats)
+	}
+	if th := compress(1000, 990); th != 1024 {
+		t.Errorf("adapted before a whole window: %v", th)
+	}
+	if th := compress(adaptiveCompressionWindow, adaptiveCompressionWindow); th != 2048 {
+		t.Errorf("threshold not raised: %v", th)
+	}
+	if th := compress(adaptiveCompressionWindow, adaptiveCompressionWindow); th != 4096 {
+		t.Errorf("threshold not raised: %v", th)
+	}
+	if th := compress(adaptiveCompressionWindow, adaptiveCompressionWindow/5*4); th != 4096 {
+		t.Errorf("threshold changed: %v", th)
+	}
+	if th := compress(adaptiveCompressionWindow, adaptiveCompressionWindow/10); th != 2048 {
+		t.Errorf("threshold not lowered: %v", th)
+	}
+	if th := compress(adaptiveCompressionWindow, adaptiveCompressionWindow/10); th != 1024 || c.raisedThreshold() != 0 {
+		t.Errorf("threshold not lowered: %v %v", th, c.raisedThreshold())
+	}
+	for i := 0; i < 10; i++ {
+		compress(adaptiveCompressionWindow, adaptiveCompressionWindow)
+	}
+	if th := c.raisedThreshold(); th != maxAdaptiveCompressThreshold {
+		t.Errorf("threshold not capped: %v", th)
+	}
+	c.reset()
+	if th := c.adapt(0, stats); th != 0 {
+		t.Errorf("compression turned on: %v", th)
+	}
+}
+
+func TestAdaptiveCompressionOfConn(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+	servConn.SetAdaptiveCompression(true)
+	servConn.SetDigestThreshold(-1)
+
+	// Random bodies do not compress.
+	go func() {
+		for i := 0; i < 20; i++ {
+			msg := &proto.Message{Body: make([]byte, 2048)}
+			rand.Read(msg.Body)
+			if err := servConn.SendMessage(msg, "", nil); err != nil {
+				t.Errorf("Error: %v", err)
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, err := cliConn.ReceiveMessage(); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	stats := servConn.Stats()
+	if stats.Compression == nil || stats.Compression.NrCommands == 0 || stats.Compression.NrCommands >= 20 {
+		t.Errorf("bad compression: %+v", stats.Compression)
+	}
+	if stats.AdaptiveCompressThreshold <= stats.CompressThreshold {
+		t.Errorf("threshold not raised: %+v", stats)
+	}
+}
@@ -19,8 +19,14 @@ package server
 
 import (
 	"fmt"
+	"github.com/uniqush/uniqush-conn/asset"
+	"github.com/uniqush/uniqush-conn/blocklist"
+	"github.com/uniqush/uniqush-conn/logger"
 	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/session"
+	"github.com/uniqush/uniqush-conn/throttle"
+	"github.com/uniqush/uniqush-conn/tracing"
 	"io"
 	"math/rand"
 	"net"
@@ -33,11 +39,32 @@ import (
 // SendMessage() and ForwardMessage() will send a message ditest,
 // instead of the message itself, if the message is too large.
 // ReceiveMessage() should nevery be called concurrently.
+//
+// The commands are written one at a time, in the order the writes are
+// called, so that concurrent writes, e.g. of the messages and the
+// digests, never interleave on the wire. The goroutine writing them
+// only runs while there are commands to write.
+// A write waits until its command is written, and fails with
+// ErrConnClosed once the connection is closed.
 type Conn interface {
 	Close() error
 	Service() string
 	Username() string
-	UniqId() string
+
+	// ConnId() is unique for every connection accepted by the server.
+	// It is told to the client in CMD_AUTHOK, and is carried by the
+	// events, the logs and the admin API to tell the connections of
+	// the same user apart.
+	ConnId() string
+	RemoteAddr() net.Addr
+
+	// ClientAddr() is the address of the client. It differs from
+	// RemoteAddr() if the client connects through a proxy which
+	// tells the client's address with the PROXY protocol.
+	ClientAddr() net.Addr
+
+	// Transport() is how the client connects: "tcp", "tls" or "websocket".
+	Transport() string
 
 	// If the message is generated from the server, then use SendMessage()
 	// to send it to the client.
@@ -47,6 +74,30 @@ type Conn interface {
 	// use ForwardMessage() to send it to the client.
 	ForwardMessage(sender, senderService string, msg *proto.Message, id string) error
 
+	// DeliverMessage() sends a message container, which is normally
+	// retrieved from the cache, to the client. The id and the sequence
+	// number of the message will be sent along with the message.
+	DeliverMessage(mc *proto.MessageContainer, extra map[string]string) error
+
+	// SendDigest() tells the client about a cached message with a
+	// digest, whatever the digest threshold is. The client may then
+	// retrieve the message with its id.
+	SendDigest(mc *proto.MessageContainer, extra map[string]string) error
+
+	// NotifyEdit() tells the client that the sender has replaced the
+	// message whose id is id with msg, or recalled it if msg is nil.
+	// It does nothing if the client does not advertise proto.CAP_EDIT.
+	NotifyEdit(sender, senderService, id string, msg *proto.Message) error
+
+	// SendAsset() sends the version of a configuration asset to the
+	// client. It does nothing if the client does not advertise
+	// proto.CAP_ASSETS.
+	SendAsset(a *asset.Asset) error
+
+	// Bye() tells the client why the connection is about to be closed.
+	// It does not close the connection.
+	Bye(reason string) error
+
 	// ReceiveMessage() will keep receiving Commands from the client
 	// until it receives a Command with type CMD_DATA.
 	ReceiveMessage() (msg *proto.Message, err error)
@@ -54,21 +105,207 @@ type Conn interface {
 	SetMessageCache(cache msgcache.Cache)
 	SetForwardRequestChannel(fwdChan chan<- *ForwardRequest)
 	SetSubscribeRequestChan(subChan chan<- *SubscribeRequest)
+
+	// SetAckChannel() sends the acks of the cached messages to ackChan.
+	// It only works with a message cache.
+	SetAckChannel(ackChan chan<- *Ack)
+
+	// SetBlockList() lets the client update its block list
+	// stored in the store.
+	SetBlockList(store blocklist.Store)
+
+	// SetAssetStore() records in the store the versions of the
+	// assets applied by the client.
+	SetAssetStore(store asset.Store)
+
+	// SetSessionStore() restores the settings saved for the user,
+	// if there are any, and saves them whenever the client changes
+	// them or the connection is closed. It should be called before
+	// ReceiveMessage(). A connection restored by RestoreConn() keeps
+	// the settings it is handed off with.
+	SetSessionStore(store session.Store)
+
+	// SetWriteAheadLog() makes SendMessage(), ForwardMessage() and
+	// DeliverMessage() persist a message without an id before writing
+	// it, and discard it once it is written. They only fail if the
+	// message is neither written nor persisted.
+	SetWriteAheadLog(wal WriteAheadLog)
+
+	// SetAutoCache() lets the connection own the cache given by
+	// SetMessageCache(): every message without an id is cached for
+	// ttl before it is sent, and deleted once the client acks it.
+	// It replaces the write-ahead log.
+	SetAutoCache(enabled bool, ttl time.Duration)
+
+	// SetThrottle() limits the bandwidth used to write to the client.
+	// Every write waits for all of the buckets.
+	SetThrottle(buckets ...*throttle.Bucket)
 	Visible() bool
+
+	// LastSeq() is the sequence number of the last cached message
+	// delivered to the user, possibly on a previous connection if
+	// the session is restored.
+	LastSeq() uint64
+
+	// Capabilities() are the optional features advertised by the
+	// client in CMD_AUTH, or later in CMD_CAPS. An older client
+	// advertises none.
+	Capabilities() []string
+	HasCapability(feature string) bool
+
+	// SetDigestThreshold() overrides the digest threshold set by the client.
+	SetDigestThreshold(threshold int)
+
+	// RecommendSettings() sends the settings to the client, which
+	// may accept or override them. The settings of the connection
+	// change only if the client accepts them.
+	RecommendSettings(settings *proto.Settings) error
+
+	// SetLatencyRecorder() records the latencies of the cached
+	// messages sent to and acked by the client. If header is true,
+	// the messages carry LatencyHeader.
+	SetLatencyRecorder(r LatencyRecorder, header bool)
+
+	// SetAnalyticsRecorder() counts the messages and digests sent to
+	// the client, and the messages it retrieves.
+	SetAnalyticsRecorder(r AnalyticsRecorder)
+
+	// SetDigestTemplate() adds a preview rendered by the
+	// template into every digest. Opaque messages keep their own previews.
+	SetDigestTemplate(tmpl *DigestTemplate)
+
+	// SetDigestPolicy() sets the digest thresholds of the messages
+	// matching its rules.
+	SetDigestPolicy(policy DigestPolicy)
+
+	// SetRouter() replaces the DefaultRouter deciding whether a
+	// message is sent whole, as a digest or headers only.
+	SetRouter(router Router)
+
+	// SetAdaptiveCompression() raises the compress threshold of the
+	// client while the messages written to it do not compress well,
+	// like the media which are already compressed, and lowers it back
+	// once they do. A new threshold set by the client starts over.
+	SetAdaptiveCompression(on bool)
+
+	// SetMemoryLimit() bounds the memory buffered for the client, so
+	// that a stalled client cannot hold much of the server's memory.
+	// A write over the limit fails with ErrMemoryLimit, unless the
+	// policy of the limit sends the message as a digest instead.
+	SetMemoryLimit(limit *MemoryLimit)
+
+	// SetSlowConsumerPolicy() detects whether the client keeps up with
+	// the messages written to it, and downgrades it to digests, lowers
+	// its priority or disconnects it while it does not. The changes
+	// are reported to reports. See SlowConsumerPolicy.
+	SetSlowConsumerPolicy(policy *SlowConsumerPolicy, reports chan<- *SlowConsumer)
+
+	// Deprioritized() tells whether the messages of the user should be
+	// written to the other connections first.
+	Deprioritized() bool
+	Stats() *ConnStats
+
+	// SetLogger() should be called before ReceiveMessage(). Every
+	// record will carry the service, the username and the connection id.
+	SetLogger(l logger.Logger)
+}
+
+type ConnStats struct {
+	ConnId            string    `json:"connId"`
+	Service           string    `json:"service"`
+	Username          string    `json:"username"`
+	RemoteAddr        string    `json:"addr"`
+	ClientAddr        string    `json:"clientAddr"`
+	Transport         string    `json:"transport"`
+	ConnectedAt       time.Time `json:"connectedAt"`
+	Visible           bool      `json:"visible"`
+	DigestThreshold   int       `json:"digestThreshold"`
+	CompressThreshold int       `json:"compressThreshold"`
+	NrMsgsSent        int64     `json:"nrMsgsSent"`
+	NrDigestsSent     int64     `json:"nrDigestsSent"`
+	NrMsgsReceived    int64     `json:"nrMsgsReceived"`
+	LastSeq           uint64    `json:"lastSeq,omitempty"`
+	Capabilities      []string  `json:"capabilities,omitempty"`
+
+	// Compression tells how well the commands written to the client
+	// compress. AdaptiveCompressThreshold, if not zero, is the compress
+	// threshold raised because they do not compress well.
+	Compression               *proto.CompressionStats `json:"compression,omitempty"`
+	AdaptiveCompressThreshold int                     `json:"adaptiveCompressThreshold,omitempty"`
+
+	// BufferedBytes is the memory buffered for the client. See
+	// SetMemoryLimit(). NrOverMemoryLimit is the number of writes
+	// which did not fit in the limit.
+	BufferedBytes     int64 `json:"bufferedBytes"`
+	NrOverMemoryLimit int64 `json:"nrOverMemoryLimit,omitempty"`
+
+	// SlowConsumer is set while the client is a slow consumer.
+	// See SetSlowConsumerPolicy().
+	SlowConsumer bool `json:"slowConsumer,omitempty"`
 }
 
 type serverConn struct {
+	// Accessed atomically. Keep them at the beginning
+	// to be 64-bit aligned.
+	nrMsgsSent     int64
+	nrDigestsSent  int64
+	nrMsgsReceived int64
+	lastSeq        uint64
+
 	cmdio             *proto.CommandIO
+	writer            *commandWriter
 	conn              net.Conn
 	compressThreshold int32
+	compression       adaptiveCompression
 	digestThreshold   int32
+	headersOnly       int32
 	service           string
 	username          string
 	connId            string
 	digestFielsLock   sync.Mutex
 	digestFields      []string
+	digestTemplate    *DigestTemplate
+	digestPolicy      DigestPolicy
+	router            Router
 	cmdProcs          []CommandProcessor
 	visible           int32
+	autoCache         int32
+	cache             msgcache.Cache
+	walLock           sync.Mutex
+	wal               WriteAheadLog
+	ackChan           chan<- *Ack
+	sessions          session.Store
+	binding           string
+	device            string
+	latency           LatencyRecorder
+	latencyHeader     bool
+	analytics         AnalyticsRecorder
+	connectedAt       time.Time
+	logger            logger.Logger
+
+	memoryLimitLock sync.Mutex
+	memoryLimit     *MemoryLimit
+
+	// Set while the client is a slow consumer. Accessed atomically.
+	slowConsumer  int32
+	digestOnly    int32
+	deprioritized int32
+
+	// The features of the client. See CMD_CAPS.
+	capsLock sync.Mutex
+	caps     *proto.Caps
+
+	// Set while the connection is handed off. handedOff is accessed
+	// atomically.
+	detachLock sync.Mutex
+	detaching  *detachment
+	handedOff  int32
+
+	// restored is set if the connection is handed off by another process.
+	restored bool
+
+	// The connections the client may reply to.
+	replyTargets replyTargets
 }
 
 type CommandProcessor interface {
@@ -80,10 +317,120 @@ func (self *serverConn) Visible() bool {
 	return v > 0
 }
 
+func (self *serverConn) LastSeq() uint64 {
+	return atomic.LoadUint64(&self.lastSeq)
+}
+
+func (self *serverConn) SetLogger(l logger.Logger) {
+	self.logger = logger.OrNop(l).With("service", self.service, "username", self.username, "connId", self.connId)
+	self.cmdio.SetLogger(self.logger)
+}
+
+func (self *serverConn) SetDigestThreshold(threshold int) {
+	atomic.StoreInt32(&self.digestThreshold, int32(threshold))
+}
+
+func (self *serverConn) RecommendSettings(settings *proto.Settings) error {
+	if settings == nil {
+		return nil
+	}
+	return self.writer.write(settings.Command(), nil, false)
+}
+
+func (self *serverConn) SetDigestTemplate(tmpl *DigestTemplate) {
+	self.digestFielsLock.Lock()
+	defer self.digestFielsLock.Unlock()
+	self.digestTemplate = tmpl
+}
+
+func (self *serverConn) Stats() *ConnStats {
+	ret := new(ConnStats)
+	ret.ConnId = self.connId
+	ret.Service = self.service
+	ret.Username = self.username
+	ret.RemoteAddr = self.conn.RemoteAddr().String()
+	ret.ClientAddr = self.ClientAddr().String()
+	ret.Transport = self.Transport()
+	ret.ConnectedAt = self.connectedAt
+	ret.Visible = self.Visible()
+	ret.DigestThreshold = int(atomic.LoadInt32(&self.digestThreshold))
+	ret.CompressThreshold = int(atomic.LoadInt32(&self.compressThreshold))
+	ret.AdaptiveCompressThreshold = self.compression.raisedThreshold()
+	if self.cmdio != nil {
+		ret.Compression = self.cmdio.CompressionStats()
+	}
+	ret.NrMsgsSent = atomic.LoadInt64(&self.nrMsgsSent)
+	ret.NrDigestsSent = atomic.LoadInt64(&self.nrDigestsSent)
+	ret.NrMsgsReceived = atomic.LoadInt64(&self.nrMsgsReceived)
+	ret.LastSeq = self.LastSeq()
+	ret.Capabilities = self.Capabilities()
+	ret.BufferedBytes, ret.NrOverMemoryLimit = self.writer.memoryStats()
+	ret.SlowConsumer = atomic.LoadInt32(&self.slowConsumer) > 0
+	return ret
+}
+
+func (self *serverConn) Bye(reason string) error {
+	bye := &proto.Bye{Reason: reason}
+	return self.writer.write(bye.Command(), nil, false)
+}
+
+// writeForwardResult() writes a CMD_FWD_RESULT.
+func (self *serverConn) writeForwardResult(res *proto.ForwardResult) {
+	err := self.writer.write(res.Command(), nil, false)
+	if err != nil {
+		self.logger.Warn("cannot send forward result", "reqId", res.RequestId, "err", err)
+	}
+}
+
+func (self *serverConn) writeQuotaError(reqId string, qerr *proto.QuotaError) {
+	err := self.writer.write(qerr.Command(reqId), nil, false)
+	if err != nil {
+		self.logger.Warn("cannot send quota error", "reqId", reqId, "err", err)
+	}
+}
+
 func (self *serverConn) Close() error {
+	// The process the connection is handed off to saves it instead.
+	if !self.HandedOff() {
+		self.saveSession()
+	}
+	self.writer.stop()
 	return self.conn.Close()
 }
 
+func (self *serverConn) RemoteAddr() net.Addr {
+	return self.conn.RemoteAddr()
+}
+
+func (self *serverConn) SetThrottle(buckets ...*throttle.Bucket) {
+	self.cmdio.SetThrottle(buckets...)
+}
+
+func (self *serverConn) ClientAddr() net.Addr {
+	return ClientAddr(self.conn)
+}
+
+func (self *serverConn) Transport() string {
+	if c, ok := self.conn.(interface {
+		Transport() string
+	}); ok {
+		return c.Transport()
+	}
+	return "tcp"
+}
+
+// ClientAddr returns the address of the client if the connection,
+// e.g. one accepted by the listener package, knows it. Otherwise,
+// it is the remote address of the connection.
+func ClientAddr(conn net.Conn) net.Addr {
+	if c, ok := conn.(interface {
+		ClientAddr() net.Addr
+	}); ok {
+		return c.ClientAddr()
+	}
+	return conn.RemoteAddr()
+}
+
 func (self *serverConn) Service() string {
 	return self.service
 }
@@ -92,42 +439,58 @@ func (self *serverConn) Username() string {
 	return self.username
 }
 
-func (self *serverConn) UniqId() string {
+func (self *serverConn) ConnId() string {
 	return self.connId
 }
 
 func (self *serverConn) shouldCompress(size int) bool {
-	t := int(atomic.LoadInt32(&self.compressThreshold))
+	t := self.effectiveCompressThreshold()
 	if t > 0 && t < size {
 		return true
 	}
 	return false
 }
 
-func (self *serverConn) shouldDigest(sz int) bool {
-	d := atomic.LoadInt32(&self.digestThreshold)
-	if d >= 0 && d < int32(sz) {
-		return true
+func (self *serverConn) shouldCompressMessage(msg *proto.Message, size int) bool {
+	if msg.Opaque {
+		// Encrypted data cannot be compressed anyway.
+		return false
 	}
-	return false
+	return self.shouldCompress(size)
 }
 
-func (self *serverConn) writeDigest(mc *proto.MessageContainer, extra map[string]string, sz int) error {
-	digest := &proto.Command{
-		Type: proto.CMD_DIGEST,
+// digestEntry should only be called if mc.Message is not nil.
+func (self *serverConn) digestEntry(mc *proto.MessageContainer, extra map[string]string, sz int) *proto.DigestEntry {
+	entry := &proto.DigestEntry{
+		MsgId:    mc.Id,
+		Size:     sz,
+		Seq:      mc.Seq,
+		ThreadId: mc.Message.ThreadId,
 	}
-	params := [4]string{fmt.Sprintf("%v", sz), mc.Id}
-
 	if mc.FromUser() {
-		params[2] = mc.Sender
-		params[3] = mc.SenderService
-		digest.Params = params[:4]
-	} else {
-		digest.Params = params[:2]
+		entry.Sender = mc.Sender
+		entry.SenderService = mc.SenderService
 	}
 
 	msg := mc.Message
+	unread, counted := extra[proto.UnreadInfo]
+	if msg.Opaque {
+		// Never look into an opaque message.
+		if preview := msg.Preview(); len(preview) > 0 {
+			entry.Info = map[string]string{proto.OpaquePreviewHeader: preview}
+		}
+		if counted {
+			if entry.Info == nil {
+				entry.Info = make(map[string]string, 1)
+			}
+			entry.Info[proto.UnreadInfo] = unread
+		}
+		return entry
+	}
 	header := make(map[string]string, len(extra)+len(msg.Header))
+	if counted {
+		header[proto.UnreadInfo] = unread
+	}
 	self.digestFielsLock.Lock()
 	defer self.digestFielsLock.Unlock()
 
@@ -143,70 +506,182 @@ func (self *serverConn) writeDigest(mc *proto.MessageContainer, extra map[string
 			}
 		}
 	}
-	if len(header) > 0 {
-		digest.Message = &proto.Message{
-			Header: header,
+	if self.digestTemplate != nil {
+		preview := self.digestTemplate.Execute(func(field string) string {
+			switch field {
+			case "sender":
+				return mc.Sender
+			case "sender-service":
+				return mc.SenderService
+			case "size":
+				return fmt.Sprintf("%v", sz)
+			case "thread":
+				return msg.ThreadId
+			}
+			if v, ok := extra[field]; ok {
+				return v
+			}
+			return msg.Header[field]
+		})
+		if len(preview) > 0 {
+			header[proto.OpaquePreviewHeader] = preview
 		}
 	}
+	if len(header) > 0 {
+		entry.Info = header
+	}
+	return entry
+}
+
+func (self *serverConn) writeDigest(mc *proto.MessageContainer, extra map[string]string, sz int) (err error) {
+	defer func() {
+		if err == nil {
+			atomic.AddInt64(&self.nrDigestsSent, 1)
+			self.recordDigests(1)
+			self.logger.Debug("digest sent", "id", mc.Id, "size", sz)
+		}
+	}()
+	digest := self.digestEntry(mc, extra, sz).Command()
 
-	compress := self.shouldCompress(digest.Message.Size())
-	return self.cmdio.WriteCommand(digest, compress)
+	compress := false
+	if !mc.Message.Opaque {
+		compress = self.shouldCompress(digest.Message.Size())
+	}
+	return self.writer.writeBounded(digest, nil, compress)
 }
 
 func (self *serverConn) SendMessage(msg *proto.Message, id string, extra map[string]string) error {
-	return self.send(msg, id, extra, true)
+	mc := &proto.MessageContainer{
+		Id:      id,
+		Message: msg,
+	}
+	persisted := self.writeAhead(mc)
+	return self.afterWriteAhead(mc, persisted, self.send(mc, extra, true))
+}
+
+func (self *serverConn) DeliverMessage(mc *proto.MessageContainer, extra map[string]string) error {
+	if mc == nil {
+		return nil
+	}
+	persisted := self.writeAhead(mc)
+	if mc.FromUser() {
+		return self.afterWriteAhead(mc, persisted, self.forward(mc, true))
+	}
+	return self.afterWriteAhead(mc, persisted, self.send(mc, extra, true))
+}
+
+func (self *serverConn) SendDigest(mc *proto.MessageContainer, extra map[string]string) error {
+	if mc == nil || mc.Message == nil {
+		return nil
+	}
+	return self.writeDigest(mc, extra, mc.Message.Size())
+}
+
+func (self *serverConn) NotifyEdit(sender, senderService, id string, msg *proto.Message) error {
+	if !self.HasCapability(proto.CAP_EDIT) {
+		return nil
+	}
+	edit := &proto.Edit{Peer: sender, PeerService: senderService, Id: id, Recall: msg == nil}
+	compress := false
+	if msg != nil {
+		compress = self.shouldCompressMessage(msg, msg.Size())
+	}
+	return self.writeMessageCommand(edit.Command(msg), nil, compress)
 }
 
-func (self *serverConn) send(msg *proto.Message, id string, extra map[string]string, tryDigest bool) error {
+func (self *serverConn) send(mc *proto.MessageContainer, extra map[string]string, tryDigest bool) error {
+	msg := mc.Message
 	if msg == nil {
-		cmd := &proto.Command{
-			Type: proto.CMD_EMPTY,
-		}
-		if len(id) > 0 {
-			cmd.Params = []string{id}
-		}
-		return self.cmdio.WriteCommand(cmd, false)
+		empty := &proto.Empty{Id: mc.Id}
+		return self.writer.writeBounded(empty.Command(), nil, false)
 	}
 	sz := msg.Size()
-	if tryDigest && self.shouldDigest(sz) {
-		container := &proto.MessageContainer{
-			Id:      id,
-			Message: msg,
-		}
-		return self.writeDigest(container, extra, sz)
+	route := ROUTE_LIVE
+	if tryDigest {
+		route = self.route(mc, extra)
 	}
-	cmd := &proto.Command{
-		Type:    proto.CMD_DATA,
-		Message: msg,
+	if route == ROUTE_DIGEST {
+		return self.writeDigest(mc, extra, sz)
+	}
+	msg, payload := self.queueLatency(mc)
+	if route == ROUTE_HEADERS_ONLY && len(mc.Id) > 0 {
+		msg, payload = msg.HeadersOnly(), nil
+	}
+	data := &proto.Data{Id: mc.Id, Seq: mc.Seq, TTL: mc.TTL()}
+	err := self.writeMessageCommand(data.Command(msg), payload, self.shouldCompressMessage(msg, sz))
+	if self.fallBackToDigest(mc, err) {
+		return self.writeDigest(mc, extra, sz)
+	}
+	if err != nil {
+		return err
 	}
-	cmd.Params = []string{id}
-	return self.cmdio.WriteCommand(cmd, self.shouldCompress(sz))
+	atomic.AddInt64(&self.nrMsgsSent, 1)
+	self.recordMessage(sz)
+	self.markDelivered(mc)
+	return nil
+}
+
+// markDelivered records the delivery of a cached message.
+// A failure here should not be treated as a failure of delivery,
+// so the error is ignored.
+func (self *serverConn) markDelivered(mc *proto.MessageContainer) {
+	self.advanceSeq(mc.Seq)
+	if self.cache == nil || len(mc.Id) == 0 {
+		return
+	}
+	self.logger.Debug("message delivered", "id", mc.Id)
+	self.cache.UpdateDeliveryState(self.Service(), self.Username(), mc.Id, msgcache.STATE_DELIVERED)
+}
+
+// writeMessageCommand() reuses the payload shared with other
+// connections, if there is one, instead of encoding the message again.
+func (self *serverConn) writeMessageCommand(cmd *proto.Command, payload *proto.Payload, compress bool) error {
+	return self.writer.writeBounded(cmd, payload, compress)
 }
 
 func (self *serverConn) ForwardMessage(sender, senderService string, msg *proto.Message, id string) error {
-	return self.forward(sender, senderService, msg, id, true)
+	mc := &proto.MessageContainer{
+		Id:            id,
+		Sender:        sender,
+		SenderService: senderService,
+		Message:       msg,
+	}
+	persisted := self.writeAhead(mc)
+	return self.afterWriteAhead(mc, persisted, self.forward(mc, true))
 }
 
-func (self *serverConn) forward(sender, senderService string, msg *proto.Message, id string, tryDigest bool) error {
+func (self *serverConn) forward(mc *proto.MessageContainer, tryDigest bool) error {
+	msg := mc.Message
 	sz := msg.Size()
 	if sz == 0 {
 		return nil
 	}
-	if tryDigest && self.shouldDigest(sz) {
-		container := &proto.MessageContainer{
-			Id:            id,
-			Sender:        sender,
-			SenderService: senderService,
-			Message:       msg,
-		}
-		return self.writeDigest(container, nil, sz)
+	route := ROUTE_LIVE
+	if tryDigest {
+		route = self.route(mc, nil)
 	}
-	cmd := &proto.Command{
-		Type:    proto.CMD_FWD,
-		Message: msg,
+	if route == ROUTE_DIGEST {
+		return self.writeDigest(mc, nil, sz)
+	}
+	msg, payload := self.queueLatency(mc)
+	if route == ROUTE_HEADERS_ONLY && len(mc.Id) > 0 {
+		msg, payload = msg.HeadersOnly(), nil
+	}
+	fwd := &proto.Forward{Sender: mc.Sender, SenderService: mc.SenderService, Id: mc.Id, Seq: mc.Seq, SenderConn: mc.SenderConn, TTL: mc.TTL()}
+	err := self.writeMessageCommand(fwd.Command(msg), payload, self.shouldCompressMessage(msg, sz))
+	if self.fallBackToDigest(mc, err) {
+		return self.writeDigest(mc, nil, sz)
+	}
+	if err != nil {
+		return err
 	}
-	cmd.Params = []string{sender, senderService, id}
-	return self.cmdio.WriteCommand(cmd, self.shouldCompress(sz))
+	if len(mc.SenderConn) > 0 {
+		self.replyTargets.add(mc.SenderService, mc.Sender, mc.SenderConn)
+	}
+	atomic.AddInt64(&self.nrMsgsSent, 1)
+	self.recordMessage(sz)
+	self.markDelivered(mc)
+	return nil
 }
 
 func (self *serverConn) processCommand(cmd *proto.Command) (msg *proto.Message, err error) {
@@ -214,13 +689,17 @@ func (self *serverConn) processCommand(cmd *proto.Command) (msg *proto.Message,
 		return
 	}
 
+	// The commands added by newer peers are ignored.
 	t := int(cmd.Type)
-	if t > len(self.cmdProcs) {
+	if t >= len(self.cmdProcs) {
 		return
 	}
 	proc := self.cmdProcs[t]
 	if proc != nil {
+		span := tracing.StartFromMessage("command", cmd.Message, "cmd", cmd.Type, "connId", self.connId)
+		tracing.Inject(span, cmd.Message)
 		msg, err = proc.ProcessCommand(cmd)
+		tracing.End(span, err)
 	}
 	return
 }
@@ -229,22 +708,36 @@ func (self *serverConn) ReceiveMessage() (msg *proto.Message, err error) {
 	var cmd *proto.Command
 	for {
 		cmd, err = self.cmdio.ReadCommand()
+		if err == proto.ErrInterrupted {
+			err = self.waitDetach()
+			return
+		}
 		if err != nil {
 			if err == io.ErrUnexpectedEOF || err == io.EOF {
 				err = io.EOF
+			} else {
+				self.logger.Warn("cannot read command", "err", err)
 			}
 			return
 		}
 		switch cmd.Type {
 		case proto.CMD_DATA:
 			msg = cmd.Message
+			atomic.AddInt64(&self.nrMsgsReceived, 1)
+			span := tracing.StartFromMessage("receive", msg, "connId", self.connId)
+			tracing.Inject(span, msg)
+			span.End()
 			return
 		case proto.CMD_BYE:
 			err = io.EOF
 			return
 		default:
 			msg, err = self.processCommand(cmd)
-			if err != nil || msg != nil {
+			if err != nil {
+				self.logger.Warn("cannot process command", "cmd", cmd.Type, "err", err)
+				return
+			}
+			if msg != nil {
 				return
 			}
 		}
@@ -255,6 +748,7 @@ func (self *serverConn) SetMessageCache(cache msgcache.Cache) {
 	if cache == nil {
 		return
 	}
+	self.cache = cache
 	proc := new(messageRetriever)
 	proc.cache = cache
 	proc.conn = self
@@ -264,6 +758,17 @@ func (self *serverConn) SetMessageCache(cache msgcache.Cache) {
 	p2.cache = cache
 	p2.conn = self
 	self.setCommandProcessor(proto.CMD_REQ_ALL_CACHED, p2)
+
+	p3 := new(seqRangeRetriever)
+	p3.cache = cache
+	p3.conn = self
+	self.setCommandProcessor(proto.CMD_REQ_SEQ_RANGE, p3)
+	self.setCommandProcessor(proto.CMD_REQ_THREAD, &threadRetriever{p3})
+
+	p4 := new(ackProcessor)
+	p4.cache = cache
+	p4.conn = self
+	self.setCommandProcessor(proto.CMD_ACK, p4)
 }
 
 func (self *serverConn) SetForwardRequestChannel(fwdChan chan<- *ForwardRequest) {
@@ -274,6 +779,7 @@ func (self *serverConn) SetForwardRequestChannel(fwdChan chan<- *ForwardRequest)
 	proc.conn = self
 	proc.fwdChan = fwdChan
 	self.setCommandProcessor(proto.CMD_FWD_REQ, proc)
+	self.setCommandProcessor(proto.CMD_EDIT, &editProcessor{proc})
 }
 
 func (self *serverConn) SetSubscribeRequestChan(subChan chan<- *SubscribeRequest) {
@@ -286,6 +792,42 @@ func (self *serverConn) SetSubscribeRequestChan(subChan chan<- *SubscribeRequest
 	self.setCommandProcessor(proto.CMD_SUBSCRIPTION, proc)
 }
 
+func (self *serverConn) SetAckChannel(ackChan chan<- *Ack) {
+	self.ackChan = ackChan
+}
+
+func (self *serverConn) SetBlockList(store blocklist.Store) {
+	if store == nil {
+		return
+	}
+	proc := new(blockProcessor)
+	proc.conn = self
+	proc.store = store
+	self.setCommandProcessor(proto.CMD_BLOCK, proc)
+}
+
+func (self *serverConn) SetWriteAheadLog(wal WriteAheadLog) {
+	self.walLock.Lock()
+	defer self.walLock.Unlock()
+	self.wal = wal
+}
+
+func (self *serverConn) SetAutoCache(enabled bool, ttl time.Duration) {
+	self.walLock.Lock()
+	defer self.walLock.Unlock()
+	if !enabled || self.cache == nil {
+		atomic.StoreInt32(&self.autoCache, 0)
+		self.wal = nil
+		return
+	}
+	self.wal = NewCacheWriteAheadLog(self.cache, ttl)
+	atomic.StoreInt32(&self.autoCache, 1)
+}
+
+func (self *serverConn) autoCached() bool {
+	return atomic.LoadInt32(&self.autoCache) > 0
+}
+
 func (self *serverConn) setCommandProcessor(cmdType uint8, proc CommandProcessor) {
 	if cmdType >= proto.CMD_NR_CMDS {
 		return
@@ -296,15 +838,27 @@ func (self *serverConn) setCommandProcessor(cmdType uint8, proc CommandProcessor
 	self.cmdProcs[cmdType] = proc
 }
 
+func newConnId() string {
+	return fmt.Sprintf("%x-%x", time.Now().UnixNano(), rand.Int63())
+}
+
 func NewConn(cmdio *proto.CommandIO, service, username string, conn net.Conn) Conn {
+	return newServerConn(cmdio, service, username, conn)
+}
+
+func newServerConn(cmdio *proto.CommandIO, service, username string, conn net.Conn) *serverConn {
 	ret := new(serverConn)
 	ret.conn = conn
 	ret.cmdio = cmdio
+	ret.writer = newCommandWriter(cmdio)
 	ret.service = service
 	ret.username = username
-	ret.connId = fmt.Sprintf("%x-%x", time.Now().UnixNano(), rand.Int63())
+	ret.connId = newConnId()
 	ret.digestThreshold = 1024
 	ret.compressThreshold = 1024
+	ret.headersOnly = -1
+	ret.connectedAt = time.Now()
+	ret.logger = logger.Nop()
 
 	settingproc := new(settingProcessor)
 	settingproc.conn = ret
@@ -314,6 +868,14 @@ func NewConn(cmdio *proto.CommandIO, service, username string, conn net.Conn) Co
 	visproc.conn = ret
 	ret.setCommandProcessor(proto.CMD_SET_VISIBILITY, visproc)
 
+	hoproc := new(headersOnlyProcessor)
+	hoproc.conn = ret
+	ret.setCommandProcessor(proto.CMD_SET_HEADERS_ONLY, hoproc)
+
+	capsproc := new(capsProcessor)
+	capsproc.conn = ret
+	ret.setCommandProcessor(proto.CMD_CAPS, capsproc)
+
 	ret.visible = 1
 	return ret
 }
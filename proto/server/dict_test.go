@@ -0,0 +1,90 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"net"
+	"testing"
+	"time"
+)
+
+type singleDictionary struct {
+	dict *proto.Dictionary
+}
+
+func (self *singleDictionary) Dictionary(service string) *proto.Dictionary {
+	return self.dict
+}
+
+func dialWithDictionaries(t *testing.T, server *proto.Dictionary, offered ...*proto.Dictionary) (servConn Conn, cliConn client.Conn) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	auth := &singleUserAuth{"service", "username", "token"}
+	c1, c2 := net.Pipe()
+	done := make(chan error)
+	go func() {
+		var err error
+		servConn, err = AuthConnWithDictionaries(c1, priv, auth, 3*time.Second, &singleDictionary{server})
+		done <- err
+	}()
+	cliConn, err = client.DialWithDictionaries(c2, &priv.PublicKey, "service", "username", "token", 3*time.Second, offered...)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return
+}
+
+func TestNegotiateDictionary(t *testing.T) {
+	dict := proto.NewDictionary("chat-v1", []byte(`{"text":""}`))
+	other := proto.NewDictionary("other", []byte(`xyz`))
+
+	servConn, cliConn := dialWithDictionaries(t, dict, other, dict)
+	defer servConn.Close()
+	defer cliConn.Close()
+	if servConn.(*serverConn).cmdio.Dictionary() != dict {
+		t.Errorf("dictionary not negotiated")
+	}
+	servConn.SetDigestThreshold(-1)
+	msg := &proto.Message{Body: bytes.Repeat([]byte(`{"text":"hello"}`), 100)}
+	go servConn.SendMessage(msg, "id", nil)
+	mc, err := cliConn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !mc.Message.Eq(msg) {
+		t.Errorf("corrupted message")
+	}
+
+	// The client does not have the dictionary of the service.
+	servConn2, cliConn2 := dialWithDictionaries(t, dict, other)
+	defer servConn2.Close()
+	defer cliConn2.Close()
+	if servConn2.(*serverConn).cmdio.Dictionary() != nil {
+		t.Errorf("unknown dictionary used")
+	}
+}
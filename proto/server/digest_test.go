@@ -115,3 +115,62 @@ func TestSendMessageDigestFromServerToClient(t *testing.T) {
 	close(digestChan)
 	cliConn.Close()
 }
+
+func TestSendOpaqueMessageDigestFromServerToClient(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	preview := "new message"
+	msg := proto.NewOpaqueMessage([]byte("encrypted"), preview)
+	msg.Header["df1"] = "df1value"
+
+	err = cliConn.Config(0, 2048, "df1")
+	if err != nil {
+		t.Errorf("Error: %v\n", err)
+	}
+	digestChan := make(chan *client.Digest)
+	cliConn.SetDigestChannel(digestChan)
+
+	go func() {
+		// Let the server receive the settings.
+		cliConn.SendMessageToServer(randomMessage())
+		cliConn.ReceiveMessage()
+	}()
+	_, err = servConn.ReceiveMessage()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	err = servConn.ForwardMessage("sender", "someservice", msg, "1")
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	digest := <-digestChan
+	if len(digest.Info) != 1 || digest.Info[proto.OpaquePreviewHeader] != preview {
+		t.Errorf("Error: wrong digest: %v", digest.Info)
+	}
+	if digest.Sender != "sender" || digest.SenderService != "someservice" {
+		t.Errorf("Error: wrong sender: %v:%v", digest.SenderService, digest.Sender)
+	}
+}
+
+func TestMergeDigestFields(t *testing.T) {
+	fields := mergeDigestFields(nil, []string{"df1", "df2"})
+	fields = mergeDigestFields(fields, []string{"+location", "+df1"})
+	if fmt.Sprint(fields) != "[df2 location df1]" {
+		t.Errorf("wrong fields after adding: %v", fields)
+	}
+	fields = mergeDigestFields(fields, []string{"-location", "-unknown"})
+	if fmt.Sprint(fields) != "[df2 df1]" {
+		t.Errorf("wrong fields after removing: %v", fields)
+	}
+	fields = mergeDigestFields(fields, []string{"df3", "+df4"})
+	if fmt.Sprint(fields) != "[df3 df4]" {
+		t.Errorf("wrong fields after replacing: %v", fields)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/uniqush/uniqush-conn/proto"
+	"sync/atomic"
+)
+
+// A command could not be longer than 64K.
+const maxDigestBatchSize = 32 * 1024
+
+// deliverCachedMessages sends the cached messages to the client. If batch
+// is true, the digests of the large messages are sent in CMD_DIGEST_BATCH
+// instead of one CMD_DIGEST for each message. If checkpoints is not nil,
+// they are sent every checkpointInterval messages, and at the end.
+// The pending digests are charged to the memory of the connection.
+func (self *serverConn) deliverCachedMessages(mcs []*proto.MessageContainer, batch bool, checkpoints *replayCheckpoints) error {
+	var buf []byte
+	n := 0
+	flush := func() error {
+		self.writer.discharge(int64(len(buf)))
+		nr := n
+		n = 0
+		return self.writeDigestBatch(buf, nr)
+	}
+	defer func() {
+		if n > 0 {
+			self.writer.discharge(int64(len(buf)))
+		}
+	}()
+	for i, mc := range mcs {
+		if mc == nil {
+			continue
+		}
+		if !batch || mc.Message == nil || self.route(mc, nil) != ROUTE_DIGEST {
+			err := self.DeliverMessage(mc, nil)
+			if err != nil {
+				return err
+			}
+		} else {
+			data, err := json.Marshal(self.digestEntry(mc, nil, mc.Message.Size()))
+			if err != nil {
+				return err
+			}
+			if n > 0 && len(buf)+len(data)+2 > maxDigestBatchSize {
+				err = flush()
+				if err != nil {
+					return err
+				}
+			}
+			err = self.writer.charge(int64(len(data) + 1))
+			if err == ErrMemoryLimit && n > 0 {
+				// Make room by writing the pending digests.
+				if err = flush(); err == nil {
+					err = self.writer.charge(int64(len(data) + 1))
+				}
+			}
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				buf = append(buf[:0], '[')
+			} else {
+				buf = append(buf, ',')
+			}
+			buf = append(buf, data...)
+			n++
+		}
+		if !checkpoints.due(i) {
+			continue
+		}
+		// A checkpoint covers the digests before it.
+		if n > 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if err := self.writeCheckpoint(checkpoints.seq(i), false); err != nil {
+			return err
+		}
+	}
+	if n > 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	if checkpoints != nil {
+		return self.writeCheckpoint(checkpoints.seq(len(mcs)-1), true)
+	}
+	return nil
+}
+
+func (self *serverConn) writeDigestBatch(data []byte, n int) error {
+	data = append(data, ']')
+	cmd := &proto.Command{
+		Type:    proto.CMD_DIGEST_BATCH,
+		Message: &proto.Message{Body: data},
+	}
+	err := self.writer.writeBounded(cmd, nil, self.shouldCompress(len(data)))
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&self.nrDigestsSent, int64(n))
+	self.recordDigests(n)
+	self.logger.Debug("digest batch sent", "nr", n, "size", len(data))
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer may be read while the connection logs.
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (self *lockedBuffer) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.buf.Write(p)
+}
+
+func (self *lockedBuffer) String() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.buf.String()
+}
+
+func TestRequestAllCachedDigestsInBatches(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	defer clearCache()
+	// Enough digests for more than one batch.
+	N := 1000
+	ids := make([]string, N)
+	for i := 0; i < N; i++ {
+		mc := &proto.MessageContainer{
+			Message: &proto.Message{
+				Header: map[string]string{"df1": fmt.Sprintf("value%v", i)},
+				Body:   []byte("some body longer than the digest threshold"),
+			},
+		}
+		ids[i], err = cache.CacheMessage(servConn.Service(), servConn.Username(), mc, time.Hour)
+		if err != nil {
+			t.Fatalf("dberror: %v", err)
+		}
+	}
+	servConn.SetMessageCache(cache)
+	buf := new(lockedBuffer)
+	servConn.SetLogger(logger.NewWriterLogger(buf, logger.LEVEL_DEBUG))
+
+	digestChan := make(chan *client.Digest)
+	cliConn.SetDigestChannel(digestChan)
+	err = cliConn.Config(0, 2048, "df1")
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	go servConn.ReceiveMessage()
+	go cliConn.ReceiveMessage()
+
+	cliConn.RequestAllCachedMessages()
+	for i := 0; i < N; i++ {
+		select {
+		case digest := <-digestChan:
+			if digest.MsgId != ids[i] || digest.Seq != uint64(i+1) {
+				t.Fatalf("bad digest %v: %+v", i, digest)
+			}
+			if digest.Info["df1"] != fmt.Sprintf("value%v", i) {
+				t.Errorf("bad digest info: %v", digest.Info)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v digests", i)
+		}
+	}
+
+	log := buf.String()
+	nrBatches := strings.Count(log, "digest batch sent")
+	if nrBatches < 2 || strings.Contains(log, "msg=\"digest sent\"") {
+		t.Errorf("digests should be sent in batches: %v batches", nrBatches)
+	}
+	// The counter is updated after the last batch is written.
+	deadline := time.Now().Add(time.Second)
+	for servConn.Stats().NrDigestsSent != int64(N) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := servConn.Stats().NrDigestsSent; n != int64(N) {
+		t.Errorf("bad number of digests: %v", n)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+// Thresholds of the digest rules.
+const (
+	DIGEST_ALWAYS = 0
+	DIGEST_NEVER  = -1
+)
+
+// DigestRule sets the digest threshold of the messages whose header
+// Header is Value, or is set to anything if Value is empty, e.g. a
+// priority class or a tag. The threshold is like the one of the
+// client: a message larger than it is sent as a digest, and a
+// negative one means never.
+type DigestRule struct {
+	Header    string
+	Value     string
+	Threshold int
+}
+
+func (self *DigestRule) matches(msg *proto.Message) bool {
+	v, ok := msg.Header[self.Header]
+	return ok && (len(self.Value) == 0 || v == self.Value)
+}
+
+// DigestPolicy is a list of rules, the first matching one of which
+// overrides the digest threshold of the connection, whether set by the
+// client or by SetDigestThreshold().
+type DigestPolicy []*DigestRule
+
+// Threshold returns the threshold of the first rule matching the
+// message. ok is false if there is none.
+func (self DigestPolicy) Threshold(msg *proto.Message) (threshold int, ok bool) {
+	if msg == nil {
+		return
+	}
+	for _, r := range self {
+		if r.matches(msg) {
+			threshold = r.Threshold
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+func (self *serverConn) SetDigestPolicy(policy DigestPolicy) {
+	self.digestFielsLock.Lock()
+	defer self.digestFielsLock.Unlock()
+	self.digestPolicy = policy
+}
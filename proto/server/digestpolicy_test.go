@@ -0,0 +1,112 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+)
+
+func TestDigestPolicyThreshold(t *testing.T) {
+	policy := DigestPolicy{
+		&DigestRule{Header: "tag", Value: "media", Threshold: DIGEST_ALWAYS},
+		&DigestRule{Header: "tag", Value: "control", Threshold: DIGEST_NEVER},
+		&DigestRule{Header: "priority", Threshold: 100},
+	}
+	for _, c := range []struct {
+		header    map[string]string
+		threshold int
+		ok        bool
+	}{
+		{map[string]string{"tag": "media", "priority": "low"}, DIGEST_ALWAYS, true},
+		{map[string]string{"tag": "control"}, DIGEST_NEVER, true},
+		{map[string]string{"tag": "other", "priority": "high"}, 100, true},
+		{map[string]string{"tag": "other"}, 0, false},
+	} {
+		threshold, ok := policy.Threshold(&proto.Message{Header: c.header})
+		if threshold != c.threshold || ok != c.ok {
+			t.Errorf("%v: got %v %v", c.header, threshold, ok)
+		}
+	}
+	if _, ok := policy.Threshold(nil); ok {
+		t.Errorf("a nil message matches")
+	}
+}
+
+func TestDigestPolicy(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	// The client never wants digests, but the media always are.
+	servConn.SetDigestThreshold(-1)
+	servConn.SetDigestPolicy(DigestPolicy{
+		&DigestRule{Header: "tag", Value: "media", Threshold: DIGEST_ALWAYS},
+	})
+	digestChan := make(chan *client.Digest, 1)
+	cliConn.SetDigestChannel(digestChan)
+	received := make(chan *proto.MessageContainer, 2)
+	go func() {
+		for {
+			mc, err := cliConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			received <- mc
+		}
+	}()
+
+	media := &proto.MessageContainer{
+		Id:      "media",
+		Message: &proto.Message{Header: map[string]string{"tag": "media"}, Body: []byte("picture")},
+	}
+	if err = servConn.DeliverMessage(media, nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	select {
+	case d := <-digestChan:
+		if d.MsgId != "media" {
+			t.Errorf("bad digest: %+v", d)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no digest")
+	}
+
+	text := &proto.MessageContainer{
+		Message: &proto.Message{Header: map[string]string{"tag": "text"}, Body: []byte("hello")},
+	}
+	if err = servConn.DeliverMessage(text, nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	select {
+	case mc := <-received:
+		if string(mc.Message.Body) != "hello" {
+			t.Errorf("bad message: %+v", mc.Message)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no message")
+	}
+}
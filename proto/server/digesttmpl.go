@@ -0,0 +1,93 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrBadDigestTemplate = errors.New("bad digest template")
+
+// DigestTemplate renders a preview of a message into its digest,
+// e.g. "New message from {sender}: {title}".
+//
+// A field is replaced by one of:
+//   - sender: the sender's username
+//   - sender-service: the sender's service
+//   - size: the size of the message
+//   - thread: the thread of the message
+//   - the value of the message header or the push info with
+//     the same name
+//
+// Unknown fields are replaced by empty strings. Use "{{" and "}}"
+// for literal braces.
+type DigestTemplate struct {
+	// Odd elements are field names.
+	parts []string
+}
+
+func ParseDigestTemplate(str string) (tmpl *DigestTemplate, err error) {
+	tmpl = new(DigestTemplate)
+	var buf []byte
+	inField := false
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		switch {
+		case !inField && c == '{' && i+1 < len(str) && str[i+1] == '{':
+			buf = append(buf, c)
+			i++
+		case !inField && c == '}' && i+1 < len(str) && str[i+1] == '}':
+			buf = append(buf, c)
+			i++
+		case !inField && c == '{':
+			tmpl.parts = append(tmpl.parts, string(buf))
+			buf = buf[:0]
+			inField = true
+		case inField && c == '}':
+			name := strings.TrimSpace(string(buf))
+			if len(name) == 0 {
+				return nil, ErrBadDigestTemplate
+			}
+			tmpl.parts = append(tmpl.parts, name)
+			buf = buf[:0]
+			inField = false
+		case c == '{' || c == '}':
+			return nil, ErrBadDigestTemplate
+		default:
+			buf = append(buf, c)
+		}
+	}
+	if inField {
+		return nil, ErrBadDigestTemplate
+	}
+	tmpl.parts = append(tmpl.parts, string(buf))
+	return
+}
+
+// Execute replaces each field by the value returned by lookup.
+func (self *DigestTemplate) Execute(lookup func(field string) string) string {
+	var buf []byte
+	for i, p := range self.parts {
+		if i%2 == 1 {
+			p = lookup(p)
+		}
+		buf = append(buf, p...)
+	}
+	return string(buf)
+}
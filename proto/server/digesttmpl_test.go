@@ -0,0 +1,95 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"testing"
+	"time"
+)
+
+func TestDigestTemplate(t *testing.T) {
+	fields := map[string]string{"sender": "alice", "title": "hi"}
+	lookup := func(f string) string {
+		return fields[f]
+	}
+	tmpls := map[string]string{
+		"New message from {sender}: {title}": "New message from alice: hi",
+		"{ sender }{unknown}":                "alice",
+		"{{literal}} {title}":                "{literal} hi",
+		"no field":                           "no field",
+	}
+	for str, expected := range tmpls {
+		tmpl, err := ParseDigestTemplate(str)
+		if err != nil {
+			t.Errorf("%v: %v", str, err)
+			continue
+		}
+		if out := tmpl.Execute(lookup); out != expected {
+			t.Errorf("%v: expected %q; got %q", str, expected, out)
+		}
+	}
+	for _, str := range []string{"{sender", "sender}", "{}", "{a{b}}"} {
+		if _, err := ParseDigestTemplate(str); err == nil {
+			t.Errorf("%v should be rejected", str)
+		}
+	}
+}
+
+func TestDigestWithTemplate(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	tmpl, _ := ParseDigestTemplate("New message from {sender}: {title}")
+	servConn.SetDigestTemplate(tmpl)
+	err = cliConn.Config(0, 2048)
+	if err != nil {
+		t.Errorf("Error: %v\n", err)
+	}
+	digestChan := make(chan *client.Digest)
+	cliConn.SetDigestChannel(digestChan)
+
+	go func() {
+		// Let the server receive the settings.
+		cliConn.SendMessageToServer(randomMessage())
+		cliConn.ReceiveMessage()
+	}()
+	_, err = servConn.ReceiveMessage()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	msg := &proto.Message{
+		Header: map[string]string{"title": "hello"},
+		Body:   []byte("body"),
+	}
+	err = servConn.ForwardMessage("alice", "service", msg, "1")
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	digest := <-digestChan
+	if p := digest.Info[proto.OpaquePreviewHeader]; p != "New message from alice: hello" {
+		t.Errorf("Error: wrong preview: %q", p)
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+// editProcessor sends the edits and the recalls of the client as
+// forward requests which supersede a message.
+type editProcessor struct {
+	*forwardProcessor
+}
+
+func (self *editProcessor) ProcessCommand(cmd *proto.Command) (msg *proto.Message, err error) {
+	if cmd == nil || cmd.Type != proto.CMD_EDIT || self.conn == nil || self.fwdChan == nil {
+		return
+	}
+	edit, err := proto.ParseEdit(cmd.Params)
+	if err != nil {
+		return
+	}
+	content := cmd.Message
+	if edit.Recall {
+		content = nil
+	} else if content == nil {
+		err = proto.ErrBadPeerImpl
+		return
+	}
+	req := &proto.ForwardRequest{
+		Receiver:        edit.Peer,
+		ReceiverService: edit.PeerService,
+		RequestId:       edit.RequestId,
+	}
+	fwdreq := self.forwardRequest(req, edit.Peer, content)
+	fwdreq.Supersedes = edit.Id
+	fwdreq.Recall = edit.Recall
+	self.fwdChan <- fwdreq
+	return
+}
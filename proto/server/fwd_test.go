@@ -135,3 +135,467 @@ func TestForwardRequestFromClientToServer(t *testing.T) {
 	close(fwdChan)
 	cliConn.Close()
 }
+
+func TestForwardResultFromServerToClient(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	fwdChan := make(chan *ForwardRequest, 2)
+	servConn.SetForwardRequestChannel(fwdChan)
+	resChan := make(chan *client.ForwardResult, 1)
+	cliConn.SetForwardResultChannel(resChan)
+
+	go func() {
+		for {
+			_, err := servConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			_, err := cliConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Without a request id, the server does not reply.
+	err = cliConn.SendMessageToUser("", "receiver", randomMessage(), time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fwdreq := <-fwdChan
+	if fwdreq.Reply != nil {
+		t.Errorf("reply set without a request id")
+	}
+
+	reqId, err := cliConn.RequestForward("", "receiver", randomMessage(), time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fwdreq = <-fwdChan
+	if fwdreq.ReceiverService != servConn.Service() {
+		t.Errorf("receiver's service is %v, not %v", fwdreq.ReceiverService, servConn.Service())
+	}
+	fwdreq.Done(proto.FWD_OK, "msgid")
+	fwdreq.Done(proto.FWD_FAILED, "")
+
+	select {
+	case res := <-resChan:
+		if res.RequestId != reqId || res.Status != proto.FWD_OK || res.MsgId != "msgid" {
+			t.Errorf("bad result: %+v", res)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no result received")
+	}
+	select {
+	case res := <-resChan:
+		t.Errorf("result sent twice: %+v", res)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestQuotaExceededFromServerToClient(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	fwdChan := make(chan *ForwardRequest, 1)
+	servConn.SetForwardRequestChannel(fwdChan)
+	resChan := make(chan *client.ForwardResult, 1)
+	cliConn.SetForwardResultChannel(resChan)
+	type quotaNotice struct {
+		reqId string
+		qerr  *proto.QuotaError
+	}
+	quotaChan := make(chan *quotaNotice, 1)
+	cliConn.SetQuotaHandler(func(reqId string, qerr *proto.QuotaError) {
+		quotaChan <- &quotaNotice{reqId, qerr}
+	})
+
+	go func() {
+		for {
+			_, err := servConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			_, err := cliConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	reqId, err := cliConn.RequestForward("", "receiver", randomMessage(), time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fwdreq := <-fwdChan
+	fwdreq.ExceedQuota(&proto.QuotaError{
+		Scope:    proto.QUOTA_SCOPE_USER,
+		Resource: proto.QUOTA_MESSAGES,
+		Limit:    10,
+		Reset:    time.Now().Add(time.Hour),
+	})
+
+	select {
+	case res := <-resChan:
+		if res.RequestId != reqId || res.Status != proto.FWD_QUOTA_EXCEEDED {
+			t.Errorf("bad result: %+v", res)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no result received")
+	}
+	select {
+	case n := <-quotaChan:
+		if n.reqId != reqId || n.qerr.Scope != proto.QUOTA_SCOPE_USER || n.qerr.Limit != 10 {
+			t.Errorf("bad quota error: %v %+v", n.reqId, n.qerr)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no quota error received")
+	}
+}
+
+func TestInvalidForwardFromServerToClient(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	fwdChan := make(chan *ForwardRequest, 1)
+	servConn.SetForwardRequestChannel(fwdChan)
+	resChan := make(chan *client.ForwardResult, 1)
+	cliConn.SetForwardResultChannel(resChan)
+
+	go func() {
+		for {
+			_, err := servConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			_, err := cliConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	reqId, err := cliConn.RequestForward("", "receiver", randomMessage(), time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fwdreq := <-fwdChan
+	fwdreq.Invalidate(&proto.ValidationError{Header: "type", Reason: "missing"})
+	// Done after Invalidate should not send another result.
+	fwdreq.Done(proto.FWD_OK, "")
+
+	select {
+	case res := <-resChan:
+		if res.RequestId != reqId || res.Status != proto.FWD_INVALID ||
+			res.Invalid == nil || res.Invalid.Header != "type" || res.Invalid.Reason != "missing" {
+			t.Errorf("bad result: %+v", res)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no result received")
+	}
+	select {
+	case res := <-resChan:
+		t.Errorf("result sent twice: %+v", res)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func testMultiForward(t *testing.T, multi bool) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+	if cliConn.HasCapability(proto.CAP_MULTI_FORWARD) != multi {
+		t.Fatalf("bad capabilities: %v", cliConn.Capabilities())
+	}
+
+	fwdChan := make(chan *ForwardRequest, 3)
+	servConn.SetForwardRequestChannel(fwdChan)
+	resChan := make(chan *client.ForwardResult, 3)
+	cliConn.SetForwardResultChannel(resChan)
+	go func() {
+		for {
+			_, err := servConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			_, err := cliConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	receivers := []string{"bob", "carol", "dave"}
+	reqId, err := cliConn.RequestMultiForward("", receivers, randomMessage(), time.Hour, "key")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var msg *proto.Message
+	for _, r := range receivers {
+		fwdreq := <-fwdChan
+		if fwdreq.Receiver != r || fwdreq.IdempotencyKey != "key\n"+r {
+			t.Errorf("bad request: %+v", fwdreq)
+		}
+		if fwdreq.MessageContainer.Message == msg {
+			t.Errorf("receivers share the message")
+		}
+		msg = fwdreq.MessageContainer.Message
+		fwdreq.Done(proto.FWD_OK, "id-"+r)
+	}
+	for _, r := range receivers {
+		select {
+		case res := <-resChan:
+			if res.RequestId != reqId || res.Receiver != r || res.MsgId != "id-"+r {
+				t.Errorf("bad result: %+v", res)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no result received")
+		}
+	}
+}
+
+func TestMultiForward(t *testing.T) {
+	testMultiForward(t, true)
+}
+
+func TestMultiForwardToOldServer(t *testing.T) {
+	caps := Capabilities
+	defer func() {
+		Capabilities = caps
+	}()
+	Capabilities = []string{proto.CAP_ACK}
+	testMultiForward(t, false)
+}
+
+func TestForwardAt(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	fwdChan := make(chan *ForwardRequest, 1)
+	servConn.SetForwardRequestChannel(fwdChan)
+	go func() {
+		for {
+			_, err := servConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	_, err = cliConn.RequestForwardAt("", "receiver", randomMessage(), time.Hour, at)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	select {
+	case fwdreq := <-fwdChan:
+		// The delay is sent in seconds, rounded up, and counted
+		// from when the server reads it.
+		if d := fwdreq.DeliverAt.Sub(at); d < 0 || d > 2*time.Second {
+			t.Errorf("delivered at %v, not %v", fwdreq.DeliverAt, at)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no request received")
+	}
+}
+
+func TestEditFromClientToServer(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	fwdChan := make(chan *ForwardRequest, 2)
+	servConn.SetForwardRequestChannel(fwdChan)
+	resChan := make(chan *client.ForwardResult, 1)
+	cliConn.SetForwardResultChannel(resChan)
+	edits := make(chan *client.Edit, 1)
+	cliConn.SetEditChannel(edits)
+	go func() {
+		for {
+			if _, err := servConn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := cliConn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	msg := randomMessage()
+	reqId, err := cliConn.EditMessage("", "receiver", "m1", msg)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	select {
+	case fwdreq := <-fwdChan:
+		if fwdreq.Supersedes != "m1" || fwdreq.Recall || fwdreq.Receiver != "receiver" || !fwdreq.MessageContainer.Message.Eq(msg) {
+			t.Errorf("bad edit: %+v", fwdreq)
+		}
+		fwdreq.Done(proto.FWD_OK, "m1")
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no request received")
+	}
+	select {
+	case res := <-resChan:
+		if res.RequestId != reqId || res.Status != proto.FWD_OK || res.MsgId != "m1" {
+			t.Errorf("bad result: %+v", res)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no result received")
+	}
+
+	if _, err = cliConn.RecallMessage("", "receiver", "m1"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	select {
+	case fwdreq := <-fwdChan:
+		if fwdreq.Supersedes != "m1" || !fwdreq.Recall || fwdreq.MessageContainer.Message != nil {
+			t.Errorf("bad recall: %+v", fwdreq)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no request received")
+	}
+
+	if err = servConn.NotifyEdit("sender", "", "m2", nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	select {
+	case e := <-edits:
+		if e.Id != "m2" || e.Sender != "sender" || e.SenderService != cliConn.Service() || !e.Recalled() {
+			t.Errorf("bad edit: %+v", e)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no edit received")
+	}
+}
+
+func TestStickyReplies(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	fwdChan := make(chan *ForwardRequest, 2)
+	servConn.SetForwardRequestChannel(fwdChan)
+	go func() {
+		for {
+			_, err := servConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	_, err = cliConn.RequestStickyForward("", "receiver", randomMessage(), time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	select {
+	case fwdreq := <-fwdChan:
+		if fwdreq.MessageContainer.SenderConn != servConn.ConnId() || len(fwdreq.MessageContainer.ReceiverConn) > 0 {
+			t.Errorf("bad request: %+v", fwdreq.MessageContainer)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no request received")
+	}
+
+	// The client replies to a sticky message.
+	mc := &proto.MessageContainer{Message: randomMessage(), Sender: "sender", SenderService: servConn.Service(), Id: "1", SenderConn: "conn1"}
+	go servConn.DeliverMessage(mc, nil)
+	rmc, err := cliConn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if rmc.SenderConn != "conn1" {
+		t.Errorf("bad sender connection: %+v", rmc)
+	}
+	_, err = cliConn.Reply(rmc, randomMessage(), time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	select {
+	case fwdreq := <-fwdChan:
+		if fwdreq.Receiver != "sender" || fwdreq.MessageContainer.ReceiverConn != "conn1" || len(fwdreq.MessageContainer.SenderConn) > 0 {
+			t.Errorf("bad reply: %+v", fwdreq)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no reply received")
+	}
+
+	// No message came from the other connections of the sender, nor
+	// from the ones of other users.
+	for _, forged := range []*proto.MessageContainer{
+		{Sender: "sender", SenderService: servConn.Service(), SenderConn: "conn2"},
+		{Sender: "other", SenderService: servConn.Service(), SenderConn: "conn1"},
+	} {
+		_, err = cliConn.Reply(forged, randomMessage(), time.Hour)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		select {
+		case fwdreq := <-fwdChan:
+			if fwdreq.Receiver != forged.Sender || len(fwdreq.MessageContainer.ReceiverConn) > 0 {
+				t.Errorf("a reply to %v is written to %v only", forged.Sender, fwdreq.MessageContainer.ReceiverConn)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no reply received")
+		}
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/tracing"
 )
 
 type forwardProcessor struct {
@@ -33,6 +34,70 @@ type ForwardRequest struct {
 	ReceiverService  string                 `json:"service"`
 	TTL              time.Duration          `json:"ttl"`
 	MessageContainer proto.MessageContainer `json:"msg"`
+
+	// IdempotencyKey, if not empty, is chosen by the sender to
+	// tell the retries of the same request apart from other requests.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// DeliverAt, if not zero, is when the sender wants the message
+	// delivered.
+	DeliverAt time.Time `json:"deliverAt,omitempty"`
+
+	// Supersedes, if not empty, is the id of a message the sender
+	// has forwarded to the receiver. The request replaces it with
+	// the message, or deletes it if Recall. See proto.CMD_EDIT.
+	Supersedes string `json:"supersedes,omitempty"`
+	Recall     bool   `json:"recall,omitempty"`
+
+	// Reply, if not nil, tells the sender the result of the request.
+	// It is not relayed to other deployments.
+	Reply func(status, msgId string) `json:"-"`
+
+	// OnQuotaExceeded, if not nil, tells the sender which quota the
+	// request exceeds. It is not relayed to other deployments.
+	OnQuotaExceeded func(qerr *proto.QuotaError) `json:"-"`
+
+	// OnInvalid, if not nil, replaces Reply to tell the sender why
+	// the message is invalid. It is not relayed to other deployments.
+	OnInvalid func(verr *proto.ValidationError) `json:"-"`
+}
+
+// Done tells the sender the result of the request. Status is one of
+// proto.FWD_*. Only the first call takes effect.
+func (self *ForwardRequest) Done(status, msgId string) {
+	if self == nil || self.Reply == nil {
+		return
+	}
+	reply := self.Reply
+	self.Reply = nil
+	reply(status, msgId)
+}
+
+// ExceedQuota tells the sender that the request is dropped because
+// it exceeds a quota.
+func (self *ForwardRequest) ExceedQuota(qerr *proto.QuotaError) {
+	if self == nil {
+		return
+	}
+	self.Done(proto.FWD_QUOTA_EXCEEDED, "")
+	if self.OnQuotaExceeded != nil {
+		self.OnQuotaExceeded(qerr)
+	}
+}
+
+// Invalidate tells the sender that the request is dropped because
+// the message is invalid. It takes effect only if Done has not been
+// called.
+func (self *ForwardRequest) Invalidate(verr *proto.ValidationError) {
+	if self == nil || self.Reply == nil {
+		return
+	}
+	if self.OnInvalid == nil {
+		self.Done(proto.FWD_INVALID, "")
+		return
+	}
+	self.Reply = nil
+	self.OnInvalid(verr)
 }
 
 func (self *forwardProcessor) ProcessCommand(cmd *proto.Command) (msg *proto.Message, err error) {
@@ -40,29 +105,72 @@ func (self *forwardProcessor) ProcessCommand(cmd *proto.Command) (msg *proto.Mes
 		return
 	}
 
-	if len(cmd.Params) < 2 {
-		err = proto.ErrBadPeerImpl
+	req, err := proto.ParseForwardRequest(cmd.Params)
+	if err != nil {
 		return
 	}
-	if self.fwdChan == nil {
-		return
+	receivers := req.Receivers()
+	span := tracing.StartFromMessage("forward", cmd.Message, "receiver", req.Receiver, "service", req.ReceiverService, "nrReceivers", len(receivers))
+	tracing.Inject(span, cmd.Message)
+	defer span.End()
+	for i, receiver := range receivers {
+		msg := cmd.Message
+		if i > 0 {
+			// The message may be transformed for each receiver.
+			msg = msg.Copy()
+		}
+		self.fwdChan <- self.forwardRequest(req, receiver, msg)
 	}
+	return
+}
+
+// forwardRequest is the request to one of the receivers of req.
+func (self *forwardProcessor) forwardRequest(req *proto.ForwardRequest, receiver string, msg *proto.Message) *ForwardRequest {
 	fwdreq := new(ForwardRequest)
 	fwdreq.MessageContainer.Sender = self.conn.Username()
 	fwdreq.MessageContainer.SenderService = self.conn.Service()
-	fwdreq.MessageContainer.Message = cmd.Message
-	fwdreq.TTL, err = time.ParseDuration(cmd.Params[0])
-
-	if err != nil {
-		err = nil
-		fwdreq.TTL = 72 * time.Hour
+	fwdreq.MessageContainer.Message = msg
+	if req.StickyReplies {
+		fwdreq.MessageContainer.SenderConn = self.conn.ConnId()
 	}
-	fwdreq.Receiver = cmd.Params[1]
-	if len(cmd.Params) > 2 {
-		fwdreq.ReceiverService = cmd.Params[2]
-	} else {
+	fwdreq.TTL = req.TTL
+	fwdreq.Receiver = receiver
+	fwdreq.ReceiverService = req.ReceiverService
+	if len(fwdreq.ReceiverService) == 0 {
 		fwdreq.ReceiverService = self.conn.Service()
 	}
-	self.fwdChan <- fwdreq
-	return
+	if len(req.ReplyTo) > 0 {
+		// Only the connection a sticky message came from may be
+		// replied to. The other replies go to every connection.
+		if self.conn.replyTargets.has(fwdreq.ReceiverService, receiver, req.ReplyTo) {
+			fwdreq.MessageContainer.ReceiverConn = req.ReplyTo
+		} else {
+			self.conn.logger.Debug("reply to an unknown connection", "receiver", receiver, "service", fwdreq.ReceiverService, "replyTo", req.ReplyTo)
+		}
+	}
+	reqId := req.RequestId
+	conn := self.conn
+	if len(reqId) > 0 {
+		// Older clients only send one receiver.
+		res := &proto.ForwardResult{RequestId: reqId}
+		if len(req.MoreReceivers) > 0 {
+			res.Receiver = receiver
+		}
+		fwdreq.Reply = func(status, msgId string) {
+			r := *res
+			r.Status, r.MsgId = status, msgId
+			conn.writeForwardResult(&r)
+		}
+		fwdreq.OnInvalid = func(verr *proto.ValidationError) {
+			r := *res
+			r.Status, r.Invalid = proto.FWD_INVALID, verr
+			conn.writeForwardResult(&r)
+		}
+	}
+	fwdreq.OnQuotaExceeded = func(qerr *proto.QuotaError) {
+		conn.writeQuotaError(reqId, qerr)
+	}
+	fwdreq.IdempotencyKey = req.ReceiverKey(receiver)
+	fwdreq.DeliverAt = req.DeliverAt
+	return fwdreq
 }
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// HandshakeGuard bounds the number of concurrent handshakes from the
+// same IP address, so that a client cannot hold the server with
+// connections which never authenticate.
+type HandshakeGuard struct {
+	lock       sync.Mutex
+	maxPerAddr int
+	nrConns    map[string]int
+}
+
+func NewHandshakeGuard(maxPerAddr int) *HandshakeGuard {
+	ret := new(HandshakeGuard)
+	ret.maxPerAddr = maxPerAddr
+	ret.nrConns = make(map[string]int, 128)
+	return ret
+}
+
+func addrHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// acquire returns false if there are too many handshakes from the
+// address. Otherwise, release should be called once the handshake is done.
+func (self *HandshakeGuard) acquire(addr net.Addr) bool {
+	host := addrHost(addr)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.nrConns[host] >= self.maxPerAddr {
+		return false
+	}
+	self.nrConns[host]++
+	return true
+}
+
+func (self *HandshakeGuard) release(addr net.Addr) {
+	host := addrHost(addr)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if n := self.nrConns[host]; n > 1 {
+		self.nrConns[host] = n - 1
+	} else {
+		delete(self.nrConns, host)
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/session"
+)
+
+var ErrHandedOff = errors.New("connection handed off")
+var ErrCannotHandOff = errors.New("the connection cannot be handed off")
+var ErrHandoffTimeout = errors.New("the connection was not paused in time")
+var ErrBadConnState = errors.New("bad connection state")
+
+// ConnState is what another process needs to serve a connection handed
+// off to it, along with the file descriptor of the connection. It
+// holds the session keys, and should only be passed to a trusted
+// process, e.g. over a Unix socket.
+type ConnState struct {
+	ConnId         string                `json:"connId"`
+	Service        string                `json:"service"`
+	Username       string                `json:"username"`
+	ClientAddr     string                `json:"clientAddr,omitempty"`
+	Transport      string                `json:"transport,omitempty"`
+	ConnectedAt    time.Time             `json:"connectedAt"`
+	NrMsgsSent     int64                 `json:"nrMsgsSent"`
+	NrDigestsSent  int64                 `json:"nrDigestsSent"`
+	NrMsgsReceived int64                 `json:"nrMsgsReceived"`
+	Session        *session.State        `json:"session"`
+	Capabilities   []string              `json:"capabilities,omitempty"`
+	IO             *proto.CommandIOState `json:"io"`
+}
+
+// Detacher is implemented by the connections which can be handed off
+// to another process. Only the plain TCP connections can: the state of
+// TLS and WebSocket ones cannot be taken.
+type Detacher interface {
+	// Detach() pauses the connection between two commands, and returns
+	// its state and a duplicate of its file descriptor. It should be
+	// called while ReceiveMessage() is called, which then fails with
+	// ErrHandedOff. The connection should then be closed without
+	// telling the client. If the connection cannot be paused within
+	// timeout, both fail, and the client has to reconnect.
+	Detach(timeout time.Duration) (state *ConnState, f *os.File, err error)
+
+	// HandedOff() tells if Detach() succeeded.
+	HandedOff() bool
+}
+
+type fileConn interface {
+	File() (f *os.File, err error)
+}
+
+// detachment lets Detach() wait for the reader to pause, and the
+// reader wait for the result.
+type detachment struct {
+	paused    chan bool
+	pauseOnce sync.Once
+	done      chan bool
+	err       error
+}
+
+func (self *serverConn) HandedOff() bool {
+	return atomic.LoadInt32(&self.handedOff) != 0
+}
+
+func (self *serverConn) Detach(timeout time.Duration) (state *ConnState, f *os.File, err error) {
+	fc, ok := self.conn.(fileConn)
+	if !ok {
+		err = ErrCannotHandOff
+		return
+	}
+	d := &detachment{paused: make(chan bool), done: make(chan bool)}
+	self.detachLock.Lock()
+	if self.detaching != nil {
+		self.detachLock.Unlock()
+		err = ErrCannotHandOff
+		return
+	}
+	self.detaching = d
+	self.detachLock.Unlock()
+	defer func() {
+		d.err = err
+		if err == nil {
+			atomic.StoreInt32(&self.handedOff, 1)
+			d.err = ErrHandedOff
+		}
+		close(d.done)
+	}()
+
+	deadline := time.Now().Add(timeout)
+	err = self.cmdio.Interrupt()
+	if err != nil {
+		return
+	}
+	select {
+	case <-d.paused:
+	case <-time.After(timeout):
+		err = ErrHandoffTimeout
+		return
+	}
+	// Let the commands being written go, unless the client is too slow.
+	self.conn.SetWriteDeadline(deadline)
+	err = self.writer.drain()
+	if err != nil {
+		return
+	}
+	f, err = fc.File()
+	if err != nil {
+		return
+	}
+	state = &ConnState{
+		ConnId:         self.connId,
+		Service:        self.service,
+		Username:       self.username,
+		ClientAddr:     self.ClientAddr().String(),
+		Transport:      self.Transport(),
+		ConnectedAt:    self.connectedAt,
+		NrMsgsSent:     atomic.LoadInt64(&self.nrMsgsSent),
+		NrDigestsSent:  atomic.LoadInt64(&self.nrDigestsSent),
+		NrMsgsReceived: atomic.LoadInt64(&self.nrMsgsReceived),
+		Session:        self.sessionState(),
+		Capabilities:   self.Capabilities(),
+		IO:             self.cmdio.State(),
+	}
+	self.logger.Info("connection detached")
+	return
+}
+
+// waitDetach is called by the reader once its reads are interrupted.
+func (self *serverConn) waitDetach() error {
+	self.detachLock.Lock()
+	d := self.detaching
+	self.detachLock.Unlock()
+	if d == nil {
+		return proto.ErrInterrupted
+	}
+	d.pauseOnce.Do(func() {
+		close(d.paused)
+	})
+	<-d.done
+	return d.err
+}
+
+// handedOffConn keeps the transport and the client address of a
+// connection handed off by another process.
+type handedOffConn struct {
+	net.Conn
+	transport  string
+	clientAddr net.Addr
+}
+
+func (self *handedOffConn) Transport() string {
+	return self.transport
+}
+
+func (self *handedOffConn) ClientAddr() net.Addr {
+	return self.clientAddr
+}
+
+// File lets the connection be handed off again.
+func (self *handedOffConn) File() (f *os.File, err error) {
+	fc, ok := self.Conn.(fileConn)
+	if !ok {
+		err = ErrCannotHandOff
+		return
+	}
+	return fc.File()
+}
+
+// RestoreConn serves a connection handed off by another process with
+// its state. conn is usually made from the file descriptor with
+// net.FileConn(). The dictionary of the connection, if any, is the
+// one of the service found by dicts.
+func RestoreConn(state *ConnState, conn net.Conn, dicts DictionaryFinder) (c Conn, err error) {
+	if state == nil || state.IO == nil || len(state.Service) == 0 || len(state.Username) == 0 {
+		err = ErrBadConnState
+		return
+	}
+	var dict *proto.Dictionary
+	if len(state.IO.DictionaryId) > 0 && dicts != nil {
+		dict = dicts.Dictionary(state.Service)
+	}
+	hc := &handedOffConn{Conn: conn, transport: state.Transport, clientAddr: conn.RemoteAddr()}
+	if addr, e := net.ResolveTCPAddr("tcp", state.ClientAddr); len(state.ClientAddr) > 0 && e == nil {
+		hc.clientAddr = addr
+	}
+	if len(hc.transport) == 0 {
+		hc.transport = "tcp"
+	}
+	cmdio, err := proto.RestoreCommandIO(state.IO, hc, dict)
+	if err != nil {
+		return
+	}
+	sc := newServerConn(cmdio, state.Service, state.Username, hc)
+	sc.connId = state.ConnId
+	if !state.ConnectedAt.IsZero() {
+		sc.connectedAt = state.ConnectedAt
+	}
+	sc.nrMsgsSent = state.NrMsgsSent
+	sc.nrDigestsSent = state.NrDigestsSent
+	sc.nrMsgsReceived = state.NrMsgsReceived
+	if state.Session != nil {
+		sc.restoreSession(state.Session)
+	}
+	if len(state.Capabilities) > 0 {
+		sc.setCaps(&proto.Caps{Features: state.Capabilities})
+	}
+	sc.restored = true
+	c = sc
+	return
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+func TestHandoff(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer cliConn.Close()
+	servConn.SetDigestThreshold(4096)
+
+	received := make(chan *proto.Message, 1)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := servConn.ReceiveMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			received <- msg
+		}
+	}()
+	msg := randomMessage()
+	if err = cliConn.SendMessageToServer(msg); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if m := <-received; !m.Eq(msg) {
+		t.Errorf("wrong message")
+	}
+	if err = servConn.SendMessage(randomMessage(), "", nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = cliConn.ReceiveMessage(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	state, f, err := servConn.(Detacher).Detach(3 * time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = <-readErr; err != ErrHandedOff {
+		t.Errorf("the reader got %v", err)
+	}
+	if err = servConn.SendMessage(randomMessage(), "", nil); err != ErrConnClosed {
+		t.Errorf("sent after the handoff: %v", err)
+	}
+	servConn.Close()
+	if state.ConnId != servConn.ConnId() || state.Session.DigestThreshold != 4096 || state.NrMsgsSent != 1 {
+		t.Errorf("bad state: %+v", state)
+	}
+
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	restored, err := RestoreConn(state, c, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer restored.Close()
+	if restored.ConnId() != state.ConnId || restored.Stats().DigestThreshold != 4096 || restored.Stats().NrMsgsReceived != 1 {
+		t.Errorf("bad restored connection: %+v", restored.Stats())
+	}
+
+	msg = randomMessage()
+	if err = restored.SendMessage(msg, "id", nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	mc, err := cliConn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if mc.Id != "id" || !mc.Message.Eq(msg) {
+		t.Errorf("wrong message after the handoff")
+	}
+	msg = randomMessage()
+	if err = cliConn.SendMessageToServer(msg); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	m, err := restored.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !m.Eq(msg) {
+		t.Errorf("wrong message from the client after the handoff")
+	}
+}
+
+func TestDetachTimeout(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	// Nothing reads the connection.
+	_, _, err = servConn.(Detacher).Detach(100 * time.Millisecond)
+	if err != ErrHandoffTimeout {
+		t.Errorf("detached: %v", err)
+	}
+	if servConn.(Detacher).HandedOff() {
+		t.Errorf("handed off")
+	}
+	if _, err = servConn.ReceiveMessage(); err != ErrHandoffTimeout {
+		t.Errorf("the reader got %v", err)
+	}
+}
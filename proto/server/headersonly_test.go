@@ -0,0 +1,117 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+func TestHeadersOnly(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	defer clearCache()
+	servConn.SetMessageCache(cache)
+	servConn.SetDigestThreshold(-1)
+
+	err = cliConn.SetHeadersOnly(16)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	go func() {
+		// Let the server receive the setting.
+		cliConn.SendMessageToServer(randomMessage())
+	}()
+	_, err = servConn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	large := &proto.MessageContainer{
+		Message: &proto.Message{
+			Header: map[string]string{"title": "photo"},
+			Body:   bytes.Repeat([]byte("x"), 100),
+		},
+	}
+	_, err = cache.CacheMessage(servConn.Service(), servConn.Username(), large, time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	small := &proto.MessageContainer{
+		Message: &proto.Message{Body: []byte("hi")},
+	}
+	_, err = cache.CacheMessage(servConn.Service(), servConn.Username(), small, time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// A message without an id could not be retrieved later.
+	uncached := &proto.MessageContainer{Message: large.Message}
+
+	go func() {
+		servConn.DeliverMessage(large, nil)
+		servConn.DeliverMessage(small, nil)
+		servConn.DeliverMessage(uncached, nil)
+	}()
+	mc, err := cliConn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if mc.Id != large.Id || !mc.Message.IsHeadersOnly() || len(mc.Message.Body) != 0 {
+		t.Errorf("the body is not stripped: %+v", mc.Message)
+	}
+	if mc.Message.Header["title"] != "photo" || mc.Message.Header[proto.BodySizeHeader] != strconv.Itoa(100) {
+		t.Errorf("bad headers: %v", mc.Message.Header)
+	}
+	if large.Message.IsHeadersOnly() {
+		t.Errorf("the cached message is changed")
+	}
+	for _, expected := range []*proto.MessageContainer{small, uncached} {
+		mc, err = cliConn.ReceiveMessage()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if mc.Message.IsHeadersOnly() || !mc.Message.Eq(expected.Message) {
+			t.Errorf("the body is stripped: %+v", mc.Message)
+		}
+	}
+
+	// The whole message is retrieved on demand.
+	go func() {
+		cliConn.RequestMessage(large.Id)
+		servConn.ReceiveMessage()
+	}()
+	mc, err = cliConn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if mc.Id != large.Id || !mc.Message.Eq(large.Message) {
+		t.Errorf("bad retrieved message: %+v", mc.Message)
+	}
+}
@@ -0,0 +1,41 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+type headersOnlyProcessor struct {
+	conn *serverConn
+}
+
+func (self *headersOnlyProcessor) ProcessCommand(cmd *proto.Command) (msg *proto.Message, err error) {
+	if cmd == nil || cmd.Type != proto.CMD_SET_HEADERS_ONLY || self.conn == nil {
+		return
+	}
+	req, err := proto.ParseHeadersOnly(cmd.Params)
+	if err != nil {
+		return
+	}
+	atomic.StoreInt32(&self.conn.headersOnly, int32(req.Size))
+	self.conn.saveSession()
+	return
+}
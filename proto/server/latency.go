@@ -0,0 +1,85 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/latency"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+// LatencyHeader carries how long the message waited in the server,
+// in milliseconds, if the connection is told to add it.
+const LatencyHeader = "server-latency"
+
+// LatencyRecorder is implemented by latency.Tracker.
+type LatencyRecorder interface {
+	RecordLatency(stage string, d time.Duration)
+}
+
+func (self *serverConn) SetLatencyRecorder(r LatencyRecorder, header bool) {
+	self.latency = r
+	self.latencyHeader = header
+}
+
+// queueLatency records how long a cached message waited before it
+// is sent. The returned message, with the latency header added if
+// required, should be sent instead. The payload is nil if the
+// message has been changed.
+func (self *serverConn) queueLatency(mc *proto.MessageContainer) (msg *proto.Message, payload *proto.Payload) {
+	msg = mc.Message
+	payload = mc.Payload
+	if mc.CachedAt <= 0 {
+		return
+	}
+	d := time.Since(time.Unix(0, mc.CachedAt))
+	if self.latency != nil {
+		self.latency.RecordLatency(latency.STAGE_QUEUE, d)
+	}
+	if !self.latencyHeader {
+		return
+	}
+	// The message may be shared with other connections.
+	msg = new(proto.Message)
+	*msg = *mc.Message
+	msg.Header = make(map[string]string, len(mc.Message.Header)+1)
+	for k, v := range mc.Message.Header {
+		msg.Header[k] = v
+	}
+	msg.Header[LatencyHeader] = strconv.FormatInt(int64(d/time.Millisecond), 10)
+	payload = nil
+	return
+}
+
+// ackLatency records how long the message took to be acked.
+// state is the delivery state before the ack.
+func (self *serverConn) ackLatency(state *msgcache.DeliveryState) {
+	if self.latency == nil || state == nil || state.IsAcked() {
+		return
+	}
+	now := time.Now()
+	if state.IsDelivered() {
+		self.latency.RecordLatency(latency.STAGE_ACK, now.Sub(state.Delivered))
+	}
+	if !state.Cached.IsZero() {
+		self.latency.RecordLatency(latency.STAGE_TOTAL, now.Sub(state.Cached))
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/latency"
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+func TestDeliveryLatency(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	defer clearCache()
+	servConn.SetMessageCache(cache)
+	tracker := latency.NewTracker()
+	servConn.SetLatencyRecorder(tracker, true)
+
+	mc := &proto.MessageContainer{
+		Message: randomMessage(),
+	}
+	_, err = cache.CacheMessage(servConn.Service(), servConn.Username(), mc, 1*time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if mc.CachedAt <= 0 {
+		t.Fatalf("the cache time is not set")
+	}
+	cached, err := cache.Get(servConn.Service(), servConn.Username(), mc.Id)
+	if err != nil || cached == nil || cached.CachedAt != mc.CachedAt {
+		t.Fatalf("the cache time is not kept: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	go servConn.DeliverMessage(cached, nil)
+	received, err := cliConn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ms, err := strconv.Atoi(received.Message.Header[LatencyHeader])
+	if err != nil || ms < 10 {
+		t.Errorf("bad latency header: %v", received.Message.Header)
+	}
+	if _, ok := cached.Message.Header[LatencyHeader]; ok {
+		t.Errorf("the latency header is added to the cached message")
+	}
+
+	go func() {
+		cliConn.Ack(received.Id)
+		// So that the server will return from ReceiveMessage()
+		cliConn.SendMessageToServer(randomMessage())
+	}()
+	_, err = servConn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	stages := tracker.Snapshot()
+	for _, stage := range []string{latency.STAGE_QUEUE, latency.STAGE_ACK, latency.STAGE_TOTAL} {
+		if s, ok := stages[stage]; !ok || s.Count != 1 {
+			t.Errorf("stage %v is not recorded: %+v", stage, s)
+		}
+	}
+}
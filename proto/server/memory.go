@@ -0,0 +1,92 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+var ErrMemoryLimit = errors.New("connection memory limit exceeded")
+
+// The policies of a MemoryLimit.
+const (
+	// A cached message which does not fit is sent as a digest, and
+	// kept in the cache until the client retrieves it.
+	MEMORY_POLICY_CACHE = "cache"
+
+	// A message which does not fit fails the write, after which the
+	// connection is closed by its owner.
+	MEMORY_POLICY_DISCONNECT = "disconnect"
+)
+
+// MemoryLimit bounds the memory buffered for a connection: the commands
+// queued to be written, the one being written and the digests pending
+// in a batch. A stalled client then holds at most Bytes, beyond which
+// the messages are handled according to Policy. A message is always
+// written if nothing else is buffered. The default policy is
+// MEMORY_POLICY_CACHE.
+type MemoryLimit struct {
+	Bytes  int64
+	Policy string
+}
+
+// Disconnects tells whether the connections going over the limit
+// should be closed.
+func (self *MemoryLimit) Disconnects() bool {
+	return self != nil && self.Policy == MEMORY_POLICY_DISCONNECT
+}
+
+// commandSize is about the memory held by a command until it is
+// written: its parameters, its message and the encoded frame.
+func commandSize(cmd *proto.Command) int64 {
+	n := 2 * cmd.Message.Size()
+	for _, p := range cmd.Params {
+		n += len(p) + 1
+	}
+	return int64(n)
+}
+
+// SetMemoryLimit() bounds the memory buffered for the connection. A nil
+// limit removes the bound, while the memory is still counted.
+func (self *serverConn) SetMemoryLimit(limit *MemoryLimit) {
+	self.memoryLimitLock.Lock()
+	self.memoryLimit = limit
+	self.memoryLimitLock.Unlock()
+	var n int64
+	if limit != nil {
+		n = limit.Bytes
+	}
+	self.writer.setLimit(n)
+}
+
+// fallBackToDigest tells whether a message exceeding the memory limit
+// should be sent as a digest instead. Only a cached message, which the
+// client could retrieve, is.
+func (self *serverConn) fallBackToDigest(mc *proto.MessageContainer, err error) bool {
+	if err != ErrMemoryLimit || len(mc.Id) == 0 {
+		return false
+	}
+	self.memoryLimitLock.Lock()
+	defer self.memoryLimitLock.Unlock()
+	if self.memoryLimit.Disconnects() {
+		return false
+	}
+	self.logger.Debug("message over the memory limit sent as a digest", "id", mc.Id)
+	return true
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"github.com/uniqush/uniqush-conn/throttle"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimit(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	servConn, cliConn, err := buildServerClientConns(addr, "token", 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+	digestChan := make(chan *client.Digest, 1)
+	cliConn.SetDigestChannel(digestChan)
+	go func() {
+		for {
+			if _, err := cliConn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// The client is stalled by the throttle while the first message
+	// is written.
+	servConn.SetThrottle(throttle.NewBucket(1000))
+	servConn.SetDigestThreshold(-1)
+	servConn.SetMemoryLimit(&MemoryLimit{Bytes: 5000, Policy: MEMORY_POLICY_DISCONNECT})
+	body := bytes.Repeat([]byte("a"), 2000)
+	written := make(chan error, 1)
+	go func() {
+		written <- servConn.SendMessage(&proto.Message{Body: body}, "", nil)
+	}()
+	for servConn.Stats().BufferedBytes == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = servConn.SendMessage(&proto.Message{Body: body}, "", nil)
+	if err != ErrMemoryLimit {
+		t.Errorf("a message over the limit is queued: %v", err)
+	}
+	mc := &proto.MessageContainer{Id: "cached", Message: &proto.Message{Body: body}}
+	if err = servConn.DeliverMessage(mc, nil); err != ErrMemoryLimit {
+		t.Errorf("a cached message over the limit is queued: %v", err)
+	}
+
+	servConn.SetMemoryLimit(&MemoryLimit{Bytes: 5000, Policy: MEMORY_POLICY_CACHE})
+	if err = servConn.DeliverMessage(mc, nil); err != nil {
+		t.Errorf("a cached message over the limit is not sent as a digest: %v", err)
+	}
+	if err = <-written; err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	select {
+	case digest := <-digestChan:
+		if digest.MsgId != mc.Id {
+			t.Errorf("wrong digest: %+v", digest)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("no digest")
+	}
+	stats := servConn.Stats()
+	if stats.BufferedBytes != 0 || stats.NrOverMemoryLimit != 3 || stats.NrDigestsSent != 1 {
+		t.Errorf("bad stats: %+v", stats)
+	}
+}
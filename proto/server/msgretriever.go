@@ -31,23 +31,36 @@ func (self *messageRetriever) ProcessCommand(cmd *proto.Command) (msg *proto.Mes
 	if cmd == nil || cmd.Type != proto.CMD_MSG_RETRIEVE || self.conn == nil || self.cache == nil {
 		return
 	}
-	if len(cmd.Params) < 1 {
-		err = proto.ErrBadPeerImpl
+	req, err := proto.ParseRetrieve(cmd.Params)
+	if err != nil {
 		return
 	}
-	id := cmd.Params[0]
+	for _, id := range req.Ids {
+		err = self.retrieve(id)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (self *messageRetriever) retrieve(id string) (err error) {
 	mc, err := self.cache.Get(self.conn.Service(), self.conn.Username(), id)
 	if err != nil {
 		return
 	}
 	if mc == nil || mc.Message == nil {
-		err = self.conn.send(nil, id, nil, false)
+		err = self.conn.send(&proto.MessageContainer{Id: id}, nil, false)
 		return
 	}
+	mc.Id = id
 	if mc.FromServer() {
-		err = self.conn.send(mc.Message, id, nil, false)
+		err = self.conn.send(mc, nil, false)
 	} else {
-		err = self.conn.forward(mc.Sender, mc.SenderService, mc.Message, id, false)
+		err = self.conn.forward(mc, false)
+	}
+	if err == nil {
+		self.conn.recordRetrieval()
 	}
 	return
 }
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"testing"
+	"time"
+)
+
+func TestRetrieveMultipleMessages(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	defer clearCache()
+	servConn.SetMessageCache(cache)
+
+	// More than one command could carry.
+	N := 20
+	mcs := make([]*proto.MessageContainer, N)
+	ids := make([]string, N)
+	for i := 0; i < N; i++ {
+		mcs[i] = &proto.MessageContainer{
+			Message: randomMessage(),
+		}
+		ids[i], err = cache.CacheMessage(servConn.Service(), servConn.Username(), mcs[i], time.Hour)
+		if err != nil {
+			t.Fatalf("dberror: %v", err)
+		}
+	}
+	go servConn.ReceiveMessage()
+
+	err = cliConn.RequestMessage(ids...)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i, mc := range mcs {
+		rmc, err := cliConn.ReceiveMessage()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if rmc.Id != ids[i] || !rmc.Message.Eq(mc.Message) {
+			t.Errorf("message %v is corrupted", i)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+)
+
+func connectOutbox(t *testing.T, outbox *client.Outbox) (servConn Conn, cliConn client.Conn, fwdChan chan *ForwardRequest) {
+	servConn, cliConn, err := buildServerClientConns("127.0.0.1:8088", "token", 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fwdChan = make(chan *ForwardRequest, 2)
+	servConn.SetForwardRequestChannel(fwdChan)
+	go func() {
+		for {
+			if _, err := servConn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := cliConn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	if err = outbox.SetConn(cliConn); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return
+}
+
+func receiveForward(t *testing.T, fwdChan <-chan *ForwardRequest, key string) *ForwardRequest {
+	select {
+	case fwdreq := <-fwdChan:
+		if fwdreq.IdempotencyKey != key {
+			t.Errorf("the key is %q, not %q", fwdreq.IdempotencyKey, key)
+		}
+		return fwdreq
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the message with key %q is not sent", key)
+	}
+	return nil
+}
+
+func receiveResult(t *testing.T, resChan <-chan *client.ForwardResult, key, status string) {
+	select {
+	case res := <-resChan:
+		if res.RequestId != key || res.Status != status {
+			t.Errorf("bad result: %+v", res)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no result received")
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	resChan := make(chan *client.ForwardResult, 2)
+	outbox := client.NewOutbox(2, resChan)
+
+	// Composed while disconnected.
+	k1, err := outbox.Send("", "receiver", randomMessage(), time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	k2, err := outbox.Send("", "receiver", randomMessage(), time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if k1 == k2 {
+		t.Errorf("the same key %q for two messages", k1)
+	}
+	if _, err = outbox.Send("", "receiver", randomMessage(), time.Hour); err != client.ErrOutboxFull {
+		t.Errorf("the outbox should be full: %v", err)
+	}
+
+	servConn, cliConn, fwdChan := connectOutbox(t, outbox)
+	receiveForward(t, fwdChan, k1).Done(proto.FWD_OK, "msgid")
+	receiveResult(t, resChan, k1, proto.FWD_OK)
+	// The connection is lost before the result of the second message.
+	receiveForward(t, fwdChan, k2)
+	servConn.Close()
+	cliConn.Close()
+	outbox.SetConn(nil)
+	if pending := outbox.Pending(); len(pending) != 1 || pending[0].Key != k2 {
+		t.Fatalf("bad pending messages: %v", pending)
+	}
+
+	// It is sent again with the same key once reconnected.
+	servConn, cliConn, fwdChan = connectOutbox(t, outbox)
+	defer servConn.Close()
+	defer cliConn.Close()
+	receiveForward(t, fwdChan, k2).Done(proto.FWD_DUPLICATE, "")
+	receiveResult(t, resChan, k2, proto.FWD_DUPLICATE)
+
+	// The later messages are sent right away.
+	k3, err := outbox.Send("", "receiver", randomMessage(), time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	receiveForward(t, fwdChan, k3).Done(proto.FWD_OK, "msgid")
+	receiveResult(t, resChan, k3, proto.FWD_OK)
+	if pending := outbox.Pending(); len(pending) != 0 {
+		t.Errorf("bad pending messages: %v", pending)
+	}
+}
+
+func TestOutboxExpiryAndRestore(t *testing.T) {
+	resChan := make(chan *client.ForwardResult, 2)
+	outbox := client.NewOutbox(0, resChan)
+	expired, err := outbox.Send("", "receiver", randomMessage(), 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	live, err := outbox.Send("", "receiver", randomMessage(), time.Hour)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The app is stopped, and the pending messages are restored
+	// into another outbox.
+	restored := client.NewOutbox(0, resChan)
+	queuedAt := time.Now().Add(-30 * time.Minute)
+	pending := outbox.Pending()
+	for _, m := range pending {
+		m.QueuedAt = queuedAt
+	}
+	if err := restored.Restore(pending); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	servConn, cliConn, fwdChan := connectOutbox(t, restored)
+	defer servConn.Close()
+	defer cliConn.Close()
+	receiveResult(t, resChan, expired, proto.FWD_EXPIRED)
+	fwdreq := receiveForward(t, fwdChan, live)
+	if fwdreq.TTL <= 0 || fwdreq.TTL > 30*time.Minute {
+		t.Errorf("the TTL is %v", fwdreq.TTL)
+	}
+	fwdreq.Done(proto.FWD_DUPLICATE, "")
+	receiveResult(t, resChan, live, proto.FWD_DUPLICATE)
+	if pending := restored.Pending(); len(pending) != 0 {
+		t.Errorf("bad pending messages: %v", pending)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type plaintextPolicy struct {
+	singleDictionary
+	allow bool
+}
+
+func (self *plaintextPolicy) AllowPlaintext(service string) bool {
+	return self.allow
+}
+
+// tapConn records what is written to the connection.
+type tapConn struct {
+	net.Conn
+	lock    sync.Mutex
+	written bytes.Buffer
+}
+
+func (self *tapConn) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	self.written.Write(p)
+	self.lock.Unlock()
+	return self.Conn.Write(p)
+}
+
+func (self *tapConn) contains(p []byte) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return bytes.Contains(self.written.Bytes(), p)
+}
+
+func dialWithPlaintext(t *testing.T, allow, accept bool) (servConn Conn, cliConn client.Conn, tap *tapConn) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	auth := &singleUserAuth{"service", "username", "token"}
+	c1, c2 := net.Pipe()
+	tap = &tapConn{Conn: c1}
+	done := make(chan error)
+	go func() {
+		var err error
+		servConn, err = AuthConnWithDictionaries(tap, priv, auth, 3*time.Second, &plaintextPolicy{allow: allow})
+		done <- err
+	}()
+	cliConn, err = client.DialWithOptions(c2, &priv.PublicKey, "service", "username", "token", 3*time.Second, &client.DialOptions{Plaintext: accept})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return
+}
+
+func TestPublicMessageInPlaintext(t *testing.T) {
+	cases := []struct {
+		allow, accept, plaintext bool
+	}{
+		{true, true, true},
+		{true, false, false},
+		{false, true, false},
+	}
+	for _, c := range cases {
+		servConn, cliConn, tap := dialWithPlaintext(t, c.allow, c.accept)
+		body := []byte("public broadcast")
+		msg := &proto.Message{Body: body, Public: true}
+		go servConn.SendMessage(msg, "id", nil)
+		mc, err := cliConn.ReceiveMessage()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !mc.Message.Eq(msg) {
+			t.Errorf("corrupted message: %v", mc.Message)
+		}
+		if tap.contains(body) != c.plaintext {
+			t.Errorf("%+v: plaintext on the wire: %v", c, tap.contains(body))
+		}
+
+		// From the client to the server.
+		go cliConn.SendMessageToServer(msg)
+		recved, err := servConn.ReceiveMessage()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !recved.Eq(msg) {
+			t.Errorf("corrupted message: %v", recved)
+		}
+		servConn.Close()
+		cliConn.Close()
+	}
+}
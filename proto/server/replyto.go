@@ -0,0 +1,71 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"container/list"
+	"sync"
+)
+
+// The number of connections of other users a connection may reply to.
+// The ones it received a message from least recently are forgotten
+// first.
+const maxReplyTargets = 256
+
+// replyTargets are the connections which sent the messages, or the
+// calls, asking for sticky replies written to a connection. Only those
+// may be replied to, so that a client cannot pick which connection of
+// another user gets its messages. See proto.ForwardRequest.ReplyTo.
+type replyTargets struct {
+	lock    sync.Mutex
+	targets map[string]*list.Element
+
+	// Of the keys of targets, the last received from first.
+	recent *list.List
+}
+
+func replyTargetKey(service, username, connId string) string {
+	return service + "\n" + username + "\n" + connId
+}
+
+func (self *replyTargets) add(service, username, connId string) {
+	key := replyTargetKey(service, username, connId)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.targets == nil {
+		self.targets = make(map[string]*list.Element, 4)
+		self.recent = list.New()
+	}
+	if e, ok := self.targets[key]; ok {
+		self.recent.MoveToFront(e)
+		return
+	}
+	self.targets[key] = self.recent.PushFront(key)
+	if self.recent.Len() > maxReplyTargets {
+		e := self.recent.Back()
+		self.recent.Remove(e)
+		delete(self.targets, e.Value.(string))
+	}
+}
+
+func (self *replyTargets) has(service, username, connId string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, ok := self.targets[replyTargetKey(service, username, connId)]
+	return ok
+}
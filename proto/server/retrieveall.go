@@ -18,13 +18,23 @@
 package server
 
 import (
+	"errors"
 	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/proto"
 )
 
+// The most message ids a client may exclude at once.
+const maxExcludes = 1 << 17
+
+var ErrTooManyExcludes = errors.New("too many excluded messages")
+
 type retriaveAllMessages struct {
 	conn  *serverConn
 	cache msgcache.Cache
+
+	// The excludes of the previous commands, if they told that more
+	// would follow. Only used by ProcessCommand.
+	pending []string
 }
 
 func cutString(data []byte) (str, rest []byte, err error) {
@@ -45,47 +55,70 @@ func cutString(data []byte) (str, rest []byte, err error) {
 	return
 }
 
-func (self *retriaveAllMessages) sendAllCachedMessage(excludes ...string) error {
+// sendAllCachedMessage sends the messages after the sequence number
+// after, or all of them if it is 0.
+func (self *retriaveAllMessages) sendAllCachedMessage(batch, checkpoints bool, after uint64, excludes ...string) error {
 	mcs, err := self.cache.GetCachedMessages(self.conn.Service(), self.conn.Username(), excludes...)
 	if err != nil {
 		return err
 	}
-	if len(mcs) == 0 {
-		return nil
-	}
-	for _, mc := range mcs {
-		if mc == nil {
-			continue
-		}
-		if mc.FromServer() {
-			err = self.conn.SendMessage(mc.Message, mc.Id, nil)
-		} else {
-			err = self.conn.ForwardMessage(mc.Sender, mc.SenderService, mc.Message, mc.Id)
+	if after > 0 {
+		rest := mcs[:0]
+		for _, mc := range mcs {
+			if mc != nil && mc.Seq > after {
+				rest = append(rest, mc)
+			}
 		}
+		mcs = rest
 	}
-	return nil
+	var cps *replayCheckpoints
+	if checkpoints {
+		cps = newReplayCheckpoints(mcs, after)
+	}
+	return self.conn.deliverCachedMessages(mcs, batch, cps)
 }
 
 func (self *retriaveAllMessages) ProcessCommand(cmd *proto.Command) (msg *proto.Message, err error) {
 	if cmd == nil || cmd.Type != proto.CMD_REQ_ALL_CACHED || self.conn == nil || self.cache == nil {
 		return
 	}
-	excludes := make([]string, 0, 10)
+	req, err := proto.ParseAllCachedRequest(cmd.Params)
+	if err != nil {
+		return
+	}
+	var body []byte
 	if cmd.Message != nil {
-		msg := cmd.Message
-		if len(msg.Body) > 0 {
-			data := msg.Body
-			for len(data) > 0 {
-				var id []byte
-				var err error
-				id, data, err = cutString(data)
-				if err != nil {
-					break
-				}
-				excludes = append(excludes, string(id))
+		body = cmd.Message.Body
+	}
+	excludes := self.pending
+	self.pending = nil
+	if req.LengthPrefixed {
+		var ids []string
+		ids, err = proto.DecodeExcludes(body)
+		if err != nil {
+			return
+		}
+		excludes = append(excludes, ids...)
+	} else {
+		data := body
+		for len(data) > 0 {
+			var id []byte
+			var err error
+			id, data, err = cutString(data)
+			if err != nil {
+				break
 			}
+			excludes = append(excludes, string(id))
 		}
 	}
-	err = self.sendAllCachedMessage(excludes...)
+	if len(excludes) > maxExcludes {
+		err = ErrTooManyExcludes
+		return
+	}
+	if req.More {
+		self.pending = excludes
+		return
+	}
+	err = self.sendAllCachedMessage(req.DigestBatch, req.Checkpoints, req.After, excludes...)
 	return
 }
@@ -87,3 +87,51 @@ func TestRequestAllCachedMessages(t *testing.T) {
 	}()
 	wg.Wait()
 }
+
+func TestRequestAllCachedMessagesWithManyExcludes(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	defer clearCache()
+	servConn.SetMessageCache(cache)
+
+	N := 10
+	ids := make([]string, N)
+	for i := 0; i < N; i++ {
+		mc := &proto.MessageContainer{Message: randomMessage()}
+		ids[i], err = cache.CacheMessage(servConn.Service(), servConn.Username(), mc, 1*time.Hour)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	// More excludes than fit in a command.
+	excludes := make([]string, 0, 4000)
+	for i := 0; i < 4000; i++ {
+		excludes = append(excludes, fmt.Sprintf("no-such-message-%032d", i))
+	}
+	for i := 0; i < N; i += 2 {
+		excludes = append(excludes, ids[i])
+	}
+
+	go servConn.ReceiveMessage()
+	err = cliConn.RequestAllCachedMessages(excludes...)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i := 1; i < N; i += 2 {
+		mc, err := cliConn.ReceiveMessage()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if mc.Id != ids[i] {
+			t.Errorf("received %v instead of %v", mc.Id, ids[i])
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/revocation"
+)
+
+// Revoker is an Authenticator which rejects the revoked tokens, and
+// the tokens of the revoked users, before asking the underlying
+// Authenticator.
+type Revoker struct {
+	auth  Authenticator
+	store revocation.Store
+}
+
+// NewRevoker keeps the revocations in the store. A store shared by
+// all nodes makes the revocations take effect on the whole cluster
+// and survive restarts.
+func NewRevoker(auth Authenticator, store revocation.Store) *Revoker {
+	ret := new(Revoker)
+	ret.auth = auth
+	ret.store = store
+	if ret.store == nil {
+		ret.store = revocation.NewMemoryStore()
+	}
+	return ret
+}
+
+// Revoke() rejects the token of the user from now on. An empty token
+// revokes all tokens of the user.
+func (self *Revoker) Revoke(srv, usr, token string) error {
+	return self.store.Revoke(srv, usr, token)
+}
+
+// Unrevoke() accepts the user and all of its tokens again.
+func (self *Revoker) Unrevoke(srv, usr string) error {
+	return self.store.Unrevoke(srv, usr)
+}
+
+func (self *Revoker) Authenticate(srv, usr, token, addr string) (bool, error) {
+	revoked, err := self.store.IsRevoked(srv, usr, token)
+	if err != nil || revoked {
+		return false, err
+	}
+	if self.auth == nil {
+		return false, nil
+	}
+	return self.auth.Authenticate(srv, usr, token, addr)
+}
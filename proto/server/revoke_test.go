@@ -0,0 +1,46 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/revocation"
+	"testing"
+)
+
+func TestRevoker(t *testing.T) {
+	auth := &singleUserAuth{"service", "username", "token"}
+	revoker := NewRevoker(auth, revocation.NewMemoryStore())
+	check := func(token string, expected bool) {
+		ok, err := revoker.Authenticate("service", "username", token, "addr")
+		if err != nil || ok != expected {
+			t.Errorf("token %q: expected %v; got %v (%v)", token, expected, ok, err)
+		}
+	}
+	check("token", true)
+	check("wrong", false)
+
+	revoker.Revoke("service", "username", "token")
+	check("token", false)
+	revoker.Unrevoke("service", "username")
+	check("token", true)
+
+	revoker.Revoke("service", "username", "")
+	check("token", false)
+	revoker.Unrevoke("service", "username")
+	check("token", true)
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+// Route is how a message is written to a connection.
+type Route int
+
+const (
+	// The whole message.
+	ROUTE_LIVE Route = iota
+	// A digest, so that the client retrieves it later.
+	ROUTE_DIGEST
+	// Only the headers, so that the client retrieves the body later.
+	// The messages without an id are sent whole, since they could
+	// not be retrieved.
+	ROUTE_HEADERS_ONLY
+)
+
+// RouteInfo describes a message sent to a user.
+type RouteInfo struct {
+	Service  string
+	Username string
+	Message  *proto.MessageContainer
+	Extra    map[string]string
+}
+
+// RouteConn describes a connection of the user the message is sent to.
+type RouteConn struct {
+	ConnId  string
+	Visible bool
+
+	// DigestThreshold is the one set by the client or by
+	// SetDigestThreshold(), or the one of the matching rule of the
+	// DigestPolicy. A negative one means never.
+	DigestThreshold int
+
+	// HeadersOnly is the body size set by the client above which only
+	// the headers are sent. A negative one means never.
+	HeadersOnly int
+
+	// Capabilities are the features of the client. See CMD_CAPS.
+	Capabilities []string
+}
+
+// Router decides how the messages sent to the users are delivered.
+// It should be safe to call from many goroutines.
+type Router interface {
+	// Cache tells if the message is cached before it is delivered.
+	// A message which is not cached cannot be retrieved later. It is
+	// not asked about the ephemeral messages, which are never cached.
+	Cache(info *RouteInfo) bool
+
+	// Route tells how the message is written to a connection. It is
+	// not asked about the messages retrieved by the client.
+	Route(info *RouteInfo, conn *RouteConn) Route
+
+	// Push tells if a push notification should be sent, once the
+	// message is written to nrVisible visible connections of the user.
+	// The PushHandler of the service still has the last word. It is
+	// not asked about the ephemeral messages, which are never pushed.
+	Push(info *RouteInfo, nrVisible int) bool
+}
+
+// DefaultRouter caches every message, digests the ones larger than
+// the digest threshold, strips the bodies larger than the headers-only
+// threshold, and pushes the messages which no visible connection
+// received.
+type DefaultRouter struct{}
+
+func (self DefaultRouter) Cache(info *RouteInfo) bool {
+	return true
+}
+
+func (self DefaultRouter) Route(info *RouteInfo, conn *RouteConn) Route {
+	msg := info.Message.Message
+	if msg == nil {
+		return ROUTE_LIVE
+	}
+	if conn.DigestThreshold >= 0 && conn.DigestThreshold < msg.Size() {
+		return ROUTE_DIGEST
+	}
+	if conn.HeadersOnly >= 0 && len(msg.Body) > conn.HeadersOnly {
+		return ROUTE_HEADERS_ONLY
+	}
+	return ROUTE_LIVE
+}
+
+func (self DefaultRouter) Push(info *RouteInfo, nrVisible int) bool {
+	return nrVisible == 0
+}
+
+// route asks the router of the connection how to write the message.
+// The ephemeral messages are always sent whole, and the cached ones as
+// digests to a slow consumer downgraded to digests.
+func (self *serverConn) route(mc *proto.MessageContainer, extra map[string]string) Route {
+	if mc.Message == nil || mc.Message.Ephemeral {
+		return ROUTE_LIVE
+	}
+	if len(mc.Id) > 0 && atomic.LoadInt32(&self.digestOnly) > 0 {
+		return ROUTE_DIGEST
+	}
+	conn := &RouteConn{
+		ConnId:          self.connId,
+		Visible:         self.Visible(),
+		DigestThreshold: int(atomic.LoadInt32(&self.digestThreshold)),
+		HeadersOnly:     int(atomic.LoadInt32(&self.headersOnly)),
+		Capabilities:    self.Capabilities(),
+	}
+	self.digestFielsLock.Lock()
+	policy := self.digestPolicy
+	router := self.router
+	self.digestFielsLock.Unlock()
+	if t, ok := policy.Threshold(mc.Message); ok {
+		conn.DigestThreshold = t
+	}
+	if router == nil {
+		router = DefaultRouter{}
+	}
+	info := &RouteInfo{
+		Service:  self.service,
+		Username: self.username,
+		Message:  mc,
+		Extra:    extra,
+	}
+	return router.Route(info, conn)
+}
+
+func (self *serverConn) SetRouter(router Router) {
+	self.digestFielsLock.Lock()
+	defer self.digestFielsLock.Unlock()
+	self.router = router
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+)
+
+func TestDefaultRouter(t *testing.T) {
+	msg := &proto.Message{Header: map[string]string{"title": "hi"}, Body: []byte("hello")}
+	info := &RouteInfo{Message: &proto.MessageContainer{Id: "1", Message: msg}}
+	for _, c := range []struct {
+		digest, headersOnly int
+		route               Route
+	}{
+		{-1, -1, ROUTE_LIVE},
+		{1024, -1, ROUTE_LIVE},
+		{0, -1, ROUTE_DIGEST},
+		{0, 0, ROUTE_DIGEST},
+		{-1, 2, ROUTE_HEADERS_ONLY},
+		{-1, 5, ROUTE_LIVE},
+	} {
+		r := DefaultRouter{}.Route(info, &RouteConn{DigestThreshold: c.digest, HeadersOnly: c.headersOnly})
+		if r != c.route {
+			t.Errorf("%+v: got %v", c, r)
+		}
+	}
+	if !(DefaultRouter{}).Push(info, 0) || (DefaultRouter{}).Push(info, 1) {
+		t.Errorf("only the messages no visible connection received should be pushed")
+	}
+}
+
+// tagRouter digests the messages with a tag.
+type tagRouter struct {
+	DefaultRouter
+}
+
+func (self tagRouter) Route(info *RouteInfo, conn *RouteConn) Route {
+	if _, ok := info.Message.Message.Header["tag"]; ok {
+		return ROUTE_DIGEST
+	}
+	return self.DefaultRouter.Route(info, conn)
+}
+
+func TestSetRouter(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	servConn.SetDigestThreshold(-1)
+	servConn.SetRouter(tagRouter{})
+	digestChan := make(chan *client.Digest, 1)
+	cliConn.SetDigestChannel(digestChan)
+	received := make(chan *proto.MessageContainer, 2)
+	go func() {
+		for {
+			mc, err := cliConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			received <- mc
+		}
+	}()
+
+	tagged := &proto.MessageContainer{
+		Id:      "tagged",
+		Message: &proto.Message{Header: map[string]string{"tag": "x"}, Body: []byte("hi")},
+	}
+	if err = servConn.DeliverMessage(tagged, nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	select {
+	case d := <-digestChan:
+		if d.MsgId != "tagged" {
+			t.Errorf("bad digest: %+v", d)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no digest")
+	}
+
+	plain := &proto.MessageContainer{Message: &proto.Message{Body: []byte("hello")}}
+	if err = servConn.DeliverMessage(plain, nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	select {
+	case mc := <-received:
+		if string(mc.Message.Body) != "hello" {
+			t.Errorf("bad message: %+v", mc.Message)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no message")
+	}
+}
+
+func TestSignalIsNeverDigested(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	fwdChan := make(chan *ForwardRequest, 1)
+	servConn.SetForwardRequestChannel(fwdChan)
+	go func() {
+		for {
+			if _, err := servConn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	msg := &proto.Message{Header: map[string]string{"typing": "1"}, Body: []byte("...")}
+	if err = cliConn.SendSignal("", "receiver", msg); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if msg.Ephemeral {
+		t.Errorf("the message of the caller is modified")
+	}
+	var fwdreq *ForwardRequest
+	select {
+	case fwdreq = <-fwdChan:
+		if !fwdreq.MessageContainer.Message.Ephemeral {
+			t.Fatalf("the signal is not ephemeral")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no request received")
+	}
+
+	servConn.SetDigestThreshold(0)
+	digestChan := make(chan *client.Digest, 1)
+	cliConn.SetDigestChannel(digestChan)
+	received := make(chan *proto.MessageContainer, 1)
+	go func() {
+		for {
+			mc, err := cliConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			received <- mc
+		}
+	}()
+	mc := &proto.MessageContainer{Id: "signal", Message: fwdreq.MessageContainer.Message}
+	if err = servConn.DeliverMessage(mc, nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	select {
+	case mc := <-received:
+		if !mc.Message.Eq(fwdreq.MessageContainer.Message) {
+			t.Errorf("bad message: %+v", mc.Message)
+		}
+	case d := <-digestChan:
+		t.Errorf("the signal is digested: %+v", d)
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no message")
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+type seqRangeRetriever struct {
+	conn  *serverConn
+	cache msgcache.Cache
+}
+
+func (self *seqRangeRetriever) ProcessCommand(cmd *proto.Command) (msg *proto.Message, err error) {
+	if cmd == nil || cmd.Type != proto.CMD_REQ_SEQ_RANGE || self.conn == nil || self.cache == nil {
+		return
+	}
+	req, err := proto.ParseSeqRangeRequest(cmd.Params)
+	if err != nil {
+		return
+	}
+	mcs, err := self.cache.GetMessagesBySeq(self.conn.Service(), self.conn.Username(), req.From, req.To)
+	if err != nil {
+		return
+	}
+	err = self.conn.deliverCachedMessages(mcs, req.DigestBatch, nil)
+	return
+}
+
+// threadRetriever re-sends the cached messages of a thread.
+type threadRetriever struct {
+	*seqRangeRetriever
+}
+
+func (self *threadRetriever) ProcessCommand(cmd *proto.Command) (msg *proto.Message, err error) {
+	if cmd == nil || cmd.Type != proto.CMD_REQ_THREAD || self.conn == nil || self.cache == nil {
+		return
+	}
+	req, err := proto.ParseThreadRequest(cmd.Params)
+	if err != nil {
+		return
+	}
+	mcs, err := self.cache.GetMessagesByThread(self.conn.Service(), self.conn.Username(), req.ThreadId)
+	if err != nil {
+		return
+	}
+	err = self.conn.deliverCachedMessages(mcs, req.DigestBatch, nil)
+	return
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/uniqush/uniqush-conn/proto"
+
+	"testing"
+	"time"
+)
+
+func TestRequestMessagesBySeq(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	defer clearCache()
+	servConn.SetMessageCache(cache)
+
+	N := 10
+	mcs := make([]*proto.MessageContainer, N)
+
+	for i := 0; i < N; i++ {
+		mcs[i] = &proto.MessageContainer{
+			Message: randomMessage(),
+			Id:      fmt.Sprintf("%v", i),
+		}
+		_, err := cache.CacheMessage(servConn.Service(), servConn.Username(), mcs[i], 1*time.Hour)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	// The client missed messages from 5 to 7
+	from := 5
+	to := 7
+	go func() {
+		cliConn.RequestMessagesBySeq(uint64(from), uint64(to))
+		for _, mc := range mcs[from-1 : to] {
+			rmc, err := cliConn.ReceiveMessage()
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			if !rmc.Eq(mc) {
+				t.Errorf("corrupted data")
+			}
+		}
+		wg.Done()
+	}()
+
+	go func() {
+		servConn.ReceiveMessage()
+	}()
+	wg.Wait()
+}
+
+func TestRequestThread(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	defer clearCache()
+	servConn.SetMessageCache(cache)
+
+	N := 6
+	var thread []*proto.MessageContainer
+
+	for i := 0; i < N; i++ {
+		mc := &proto.MessageContainer{
+			Message: randomMessage(),
+			Id:      fmt.Sprintf("%v", i),
+		}
+		if i%3 == 0 {
+			mc.Message.ThreadId = "thread"
+			thread = append(thread, mc)
+		}
+		_, err := cache.CacheMessage(servConn.Service(), servConn.Username(), mc, 1*time.Hour)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	go func() {
+		err := cliConn.RequestThread("thread")
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		for _, mc := range thread {
+			rmc, err := cliConn.ReceiveMessage()
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			if !rmc.Eq(mc) || rmc.Message.ThreadId != "thread" {
+				t.Errorf("corrupted data")
+			}
+		}
+		wg.Done()
+	}()
+
+	go func() {
+		servConn.ReceiveMessage()
+	}()
+	wg.Wait()
+}
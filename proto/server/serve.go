@@ -0,0 +1,259 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrServerClosed = errors.New("server closed")
+
+// Handler serves the authenticated connections.
+type Handler interface {
+	ServeConn(conn Conn)
+}
+
+type HandlerFunc func(conn Conn)
+
+func (self HandlerFunc) ServeConn(conn Conn) {
+	self(conn)
+}
+
+// Server accepts the connections of its listeners, authenticates them
+// and gives each of them to the Handler in its own goroutine. The
+// fields should be set before the first call to Serve.
+type Server struct {
+	PrivateKey   crypto.Signer
+	Auth         Authenticator
+	Limits       HandshakeLimits
+	Dictionaries DictionaryFinder
+	Handler      Handler
+
+	// NrWorkers, if positive, bounds the concurrent handshakes. The
+	// connections then wait in the listeners' backlog when all workers
+	// are busy, so a few idle sockets can hold up the others until
+	// they time out. By default, each connection is authenticated in
+	// its own goroutine within Limits.Timeout.
+	NrWorkers int
+
+	// OnError, if not nil, is called with the errors of the listeners
+	// and of the handshakes, along with the address of the listener
+	// or of the client.
+	OnError func(addr net.Addr, err error)
+
+	startOnce sync.Once
+	conns     chan net.Conn
+	lock      sync.Mutex
+	lns       map[net.Listener]bool
+	closed    bool
+	done      chan bool
+	workers   sync.WaitGroup
+	nrBusy    int32
+}
+
+// Stats tells what a server is doing.
+type Stats struct {
+	// NrListeners is the number of listeners being served.
+	NrListeners int `json:"nrListeners"`
+
+	// NrWorkers is 0 if the handshakes are not bounded.
+	NrWorkers int `json:"nrWorkers"`
+
+	// NrBusyWorkers is the number of handshakes in progress. The
+	// new connections wait once it reaches a positive NrWorkers.
+	NrBusyWorkers int  `json:"nrBusyWorkers"`
+	Closed        bool `json:"closed"`
+}
+
+// Saturated tells whether all the handshake workers are busy.
+// A server without a worker pool is never saturated.
+func (self *Stats) Saturated() bool {
+	return self.NrWorkers > 0 && self.NrBusyWorkers >= self.NrWorkers
+}
+
+func (self *Server) nrWorkers() int {
+	if self.NrWorkers <= 0 {
+		return 0
+	}
+	return self.NrWorkers
+}
+
+// Stats returns the state of the listeners and of the workers.
+func (self *Server) Stats() *Stats {
+	ret := new(Stats)
+	ret.NrWorkers = self.nrWorkers()
+	ret.NrBusyWorkers = int(atomic.LoadInt32(&self.nrBusy))
+	self.lock.Lock()
+	ret.NrListeners = len(self.lns)
+	ret.Closed = self.closed
+	self.lock.Unlock()
+	return ret
+}
+
+func (self *Server) start() {
+	self.startOnce.Do(func() {
+		n := self.nrWorkers()
+		self.done = make(chan bool)
+		if n == 0 {
+			return
+		}
+		self.conns = make(chan net.Conn)
+		self.workers.Add(n)
+		for i := 0; i < n; i++ {
+			go self.work()
+		}
+	})
+}
+
+func (self *Server) reportError(addr net.Addr, err error) {
+	if self.OnError != nil {
+		self.OnError(addr, err)
+	}
+}
+
+func (self *Server) work() {
+	defer self.workers.Done()
+	for {
+		select {
+		case c := <-self.conns:
+			self.handshake(c)
+		case <-self.done:
+			return
+		}
+	}
+}
+
+func (self *Server) handshake(c net.Conn) {
+	atomic.AddInt32(&self.nrBusy, 1)
+	defer atomic.AddInt32(&self.nrBusy, -1)
+	conn, err := AuthConnWithLimits(c, self.PrivateKey, self.Auth, self.Limits, self.Dictionaries)
+	if err != nil {
+		self.reportError(ClientAddr(c), err)
+		c.Close()
+		return
+	}
+	go self.Handler.ServeConn(conn)
+}
+
+// Serve accepts the connections of ln until it fails or the server is
+// closed, in which case it returns ErrServerClosed. It may be called
+// with several listeners at the same time, which share the workers.
+func (self *Server) Serve(ln net.Listener) error {
+	self.start()
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	if self.lns == nil {
+		self.lns = make(map[net.Listener]bool, 4)
+	}
+	self.lns[ln] = true
+	self.lock.Unlock()
+	defer func() {
+		self.lock.Lock()
+		delete(self.lns, ln)
+		self.lock.Unlock()
+	}()
+
+	var delay time.Duration
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if self.isClosed() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			self.reportError(ln.Addr(), err)
+			// Back off, e.g. when the process runs out of file descriptors.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay < time.Second {
+				delay *= 2
+			}
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if self.conns == nil {
+			if !self.goHandshake(c) {
+				return ErrServerClosed
+			}
+			continue
+		}
+		select {
+		case self.conns <- c:
+		case <-self.done:
+			c.Close()
+			return ErrServerClosed
+		}
+	}
+}
+
+// goHandshake authenticates c in its own goroutine, which Close
+// waits for. It returns false if the server is closed.
+func (self *Server) goHandshake(c net.Conn) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		c.Close()
+		return false
+	}
+	self.workers.Add(1)
+	go func() {
+		defer self.workers.Done()
+		self.handshake(c)
+	}()
+	return true
+}
+
+func (self *Server) isClosed() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.closed
+}
+
+// Close closes the listeners and waits for the handshakes in progress.
+// The authenticated connections are left to the Handler.
+func (self *Server) Close() error {
+	self.start()
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return nil
+	}
+	self.closed = true
+	var err error
+	for ln := range self.lns {
+		if e := ln.Close(); e != nil {
+			err = e
+		}
+	}
+	self.lock.Unlock()
+	close(self.done)
+	self.workers.Wait()
+	return err
+}
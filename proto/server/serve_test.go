@@ -0,0 +1,155 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan Conn, 2)
+	errs := make(chan error, 4)
+	srv := &Server{
+		PrivateKey: priv,
+		Auth:       &singleUserAuth{"service", "username", "token"},
+		Limits:     HandshakeLimits{Timeout: 500 * time.Millisecond},
+		Handler:    HandlerFunc(func(conn Conn) { conns <- conn }),
+		NrWorkers:  1,
+		OnError:    func(addr net.Addr, err error) { errs <- err },
+	}
+	served := make(chan error)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	// A silent client holds the only worker until it times out.
+	silent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go silentClient(silent)
+	time.Sleep(100 * time.Millisecond)
+	if stats := srv.Stats(); stats.NrListeners != 1 || stats.NrBusyWorkers != 1 || !stats.Saturated() {
+		t.Errorf("bad stats with a silent client: %+v", stats)
+	}
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli, err := client.Dial(c, &priv.PublicKey, "service", "username", "token", 3*time.Second)
+		if err != nil {
+			t.Fatalf("client %v: %v", i, err)
+		}
+		defer cli.Close()
+		select {
+		case conn := <-conns:
+			if conn.ConnId() != cli.ConnId() {
+				t.Errorf("client %v: handler got %v, not %v", i, conn.ConnId(), cli.ConnId())
+			}
+			conn.Close()
+		case <-time.After(3 * time.Second):
+			t.Fatalf("client %v: handler not called", i)
+		}
+	}
+	select {
+	case <-errs:
+	default:
+		t.Errorf("the handshake of the silent client should fail")
+	}
+
+	srv.Close()
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Errorf("Serve should return ErrServerClosed: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("Serve does not return after Close")
+	}
+	if stats := srv.Stats(); stats.NrListeners != 0 || stats.NrBusyWorkers != 0 || !stats.Closed {
+		t.Errorf("bad stats after Close: %+v", stats)
+	}
+	if err := srv.Serve(ln); err != ErrServerClosed {
+		t.Errorf("Serve after Close should return ErrServerClosed: %v", err)
+	}
+}
+
+func TestServerWithoutWorkers(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan Conn, 1)
+	srv := &Server{
+		PrivateKey: priv,
+		Auth:       &singleUserAuth{"service", "username", "token"},
+		Limits:     HandshakeLimits{Timeout: 10 * time.Second},
+		Handler:    HandlerFunc(func(conn Conn) { conns <- conn }),
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// A silent client does not hold up the others.
+	silent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go silentClient(silent)
+	time.Sleep(100 * time.Millisecond)
+	if stats := srv.Stats(); stats.NrWorkers != 0 || stats.NrBusyWorkers != 1 || stats.Saturated() {
+		t.Errorf("bad stats with a silent client: %+v", stats)
+	}
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := client.Dial(c, &priv.PublicKey, "service", "username", "token", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	select {
+	case conn := <-conns:
+		conn.Close()
+	case <-time.After(3 * time.Second):
+		t.Fatalf("handler not called")
+	}
+	silent.Close()
+}
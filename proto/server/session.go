@@ -0,0 +1,110 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/uniqush/uniqush-conn/session"
+)
+
+func (self *serverConn) SetSessionStore(store session.Store) {
+	self.sessions = store
+	// A restored connection keeps the settings it was handed off with.
+	if store == nil || self.restored {
+		return
+	}
+	state, err := store.Load(self.service, self.username)
+	if err != nil {
+		self.logger.Warn("cannot load session", "err", err)
+		return
+	}
+	if state == nil {
+		return
+	}
+	if state.Binding != self.binding {
+		// Saved from another device or network.
+		self.logger.Info("session bound elsewhere; not restored")
+		return
+	}
+	self.restoreSession(state)
+}
+
+func (self *serverConn) restoreSession(state *session.State) {
+	atomic.StoreInt32(&self.digestThreshold, int32(state.DigestThreshold))
+	atomic.StoreInt32(&self.compressThreshold, int32(state.CompressThreshold))
+	atomic.StoreInt32(&self.headersOnly, int32(state.HeadersOnly))
+	if state.Visible {
+		atomic.StoreInt32(&self.visible, 1)
+	} else {
+		atomic.StoreInt32(&self.visible, 0)
+	}
+	self.advanceSeq(state.LastSeq)
+	self.binding = state.Binding
+
+	self.digestFielsLock.Lock()
+	defer self.digestFielsLock.Unlock()
+	self.digestFields = make([]string, len(state.DigestFields))
+	copy(self.digestFields, state.DigestFields)
+}
+
+func (self *serverConn) sessionState() *session.State {
+	state := new(session.State)
+	state.DigestThreshold = int(atomic.LoadInt32(&self.digestThreshold))
+	state.CompressThreshold = int(atomic.LoadInt32(&self.compressThreshold))
+	state.HeadersOnly = int(atomic.LoadInt32(&self.headersOnly))
+	state.Visible = self.Visible()
+	state.LastSeq = atomic.LoadUint64(&self.lastSeq)
+	state.Binding = self.binding
+
+	self.digestFielsLock.Lock()
+	defer self.digestFielsLock.Unlock()
+	if len(self.digestFields) > 0 {
+		state.DigestFields = make([]string, len(self.digestFields))
+		copy(state.DigestFields, self.digestFields)
+	}
+	return state
+}
+
+// saveSession is called whenever the client changes the settings
+// of the connection, and when the connection is closed. A failure
+// only costs the client a reconnection with the default settings,
+// so it is logged instead of returned.
+func (self *serverConn) saveSession() {
+	if self.sessions == nil {
+		return
+	}
+	err := self.sessions.Save(self.service, self.username, self.sessionState())
+	if err != nil {
+		self.logger.Warn("cannot save session", "err", err)
+	}
+}
+
+// advanceSeq remembers seq if it is the largest sequence number
+// delivered so far. The messages may be delivered out of order.
+func (self *serverConn) advanceSeq(seq uint64) {
+	for {
+		last := atomic.LoadUint64(&self.lastSeq)
+		if seq <= last {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&self.lastSeq, last, seq) {
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/session"
+)
+
+func TestRestoreSession(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	store := session.NewMemoryStore()
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	servConn.SetSessionStore(store)
+
+	cliConn.Config(512, 2048, "title")
+	cliConn.SetVisibility(false)
+	// The message lets the server read the settings first.
+	err = cliConn.SendMessageToServer(randomMessage())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	_, err = servConn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	mc := &proto.MessageContainer{
+		Id:      "1",
+		Seq:     7,
+		Message: &proto.Message{Body: []byte("hello")},
+	}
+	err = servConn.DeliverMessage(mc, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	servConn.Close()
+	cliConn.Close()
+
+	servConn, cliConn, err = buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+	if !servConn.Visible() {
+		t.Errorf("a new connection should be visible without the session")
+	}
+	servConn.SetSessionStore(store)
+	stats := servConn.Stats()
+	if stats.Visible || stats.DigestThreshold != 512 || stats.CompressThreshold != 2048 {
+		t.Errorf("settings are not restored: %+v", stats)
+	}
+	if servConn.LastSeq() != 7 {
+		t.Errorf("last seq is %v", servConn.LastSeq())
+	}
+	c := servConn.(*serverConn)
+	if !reflect.DeepEqual(c.digestFields, []string{"title"}) {
+		t.Errorf("digest fields are %v", c.digestFields)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+func TestRecommendSettings(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	recommended := &proto.Settings{
+		DigestThreshold:   512,
+		CompressThreshold: 256,
+		PingInterval:      30 * time.Second,
+	}
+	received := make(chan *proto.Settings, 1)
+	cliConn.SetSettingsHandler(func(s *proto.Settings) *proto.Settings {
+		received <- s
+		// Accept the digest threshold but keep our own compression threshold.
+		return &proto.Settings{DigestThreshold: s.DigestThreshold, CompressThreshold: 2048}
+	})
+	go func() {
+		cliConn.ReceiveMessage()
+	}()
+	err = servConn.RecommendSettings(recommended)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if s := <-received; *s != *recommended {
+		t.Errorf("wrong settings: %+v", s)
+	}
+
+	// The message lets the server read the setting first.
+	err = cliConn.SendMessageToServer(randomMessage())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	_, err = servConn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	c := servConn.(*serverConn)
+	if d := atomic.LoadInt32(&c.digestThreshold); d != 512 {
+		t.Errorf("digest threshold is %v", d)
+	}
+	if d := atomic.LoadInt32(&c.compressThreshold); d != 2048 {
+		t.Errorf("compress threshold is %v", d)
+	}
+}
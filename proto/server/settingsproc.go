@@ -18,7 +18,6 @@
 package server
 
 import (
-	"strconv"
 	"sync/atomic"
 
 	"github.com/uniqush/uniqush-conn/proto"
@@ -32,37 +31,60 @@ func (self *settingProcessor) ProcessCommand(cmd *proto.Command) (msg *proto.Mes
 	if cmd.Type != proto.CMD_SETTING || self.conn == nil {
 		return
 	}
-	if len(cmd.Params) < 2 {
-		err = proto.ErrBadPeerImpl
+	setting, err := proto.ParseSetting(cmd.Params)
+	if err != nil {
 		return
 	}
-	if len(cmd.Params[0]) > 0 {
-		var d int
-		d, err = strconv.Atoi(cmd.Params[0])
-		if err != nil {
-			err = proto.ErrBadPeerImpl
-			return
-		}
-		atomic.StoreInt32(&self.conn.digestThreshold, int32(d))
-
+	if !setting.KeepDigestThreshold {
+		atomic.StoreInt32(&self.conn.digestThreshold, int32(setting.DigestThreshold))
 	}
-	if len(cmd.Params[1]) > 0 {
-		var c int
-		c, err = strconv.Atoi(cmd.Params[1])
-		if err != nil {
-			err = proto.ErrBadPeerImpl
-			return
-		}
-		atomic.StoreInt32(&self.conn.compressThreshold, int32(c))
+	if !setting.KeepCompressThreshold {
+		atomic.StoreInt32(&self.conn.compressThreshold, int32(setting.CompressThreshold))
+		self.conn.compression.reset()
 	}
-	nrPreDigestFields := 2
-	if len(cmd.Params) > nrPreDigestFields {
+	if len(setting.DigestFields) > 0 {
 		self.conn.digestFielsLock.Lock()
-		defer self.conn.digestFielsLock.Unlock()
-		self.conn.digestFields = make([]string, len(cmd.Params)-nrPreDigestFields)
-		for i, f := range cmd.Params[nrPreDigestFields:] {
-			self.conn.digestFields[i] = f
-		}
+		self.conn.digestFields = mergeDigestFields(self.conn.digestFields, setting.DigestFields)
+		self.conn.digestFielsLock.Unlock()
 	}
+	self.conn.saveSession()
 	return
 }
+
+// mergeDigestFields applies the digest fields of a CMD_SETTING
+// command to the current ones. "+field" adds a field and "-field"
+// removes it. Plain fields replace the whole list, as they always did.
+func mergeDigestFields(current, params []string) []string {
+	ret := make([]string, 0, len(current)+len(params))
+	ret = append(ret, current...)
+	replaced := false
+	for _, p := range params {
+		if len(p) == 0 {
+			continue
+		}
+		switch p[0] {
+		case proto.DIGEST_FIELD_ADD:
+			ret = removeDigestField(ret, p[1:])
+			ret = append(ret, p[1:])
+		case proto.DIGEST_FIELD_REMOVE:
+			ret = removeDigestField(ret, p[1:])
+		default:
+			if !replaced {
+				ret = ret[:0]
+				replaced = true
+			}
+			ret = removeDigestField(ret, p)
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+func removeDigestField(fields []string, f string) []string {
+	for i, field := range fields {
+		if field == f {
+			return append(fields[:i], fields[i+1:]...)
+		}
+	}
+	return fields
+}
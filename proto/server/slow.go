@@ -0,0 +1,207 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrSlowConsumer = errors.New("slow consumer")
+
+// The actions taken on a slow consumer.
+const (
+	// The cached messages are only sent as digests, which the client
+	// retrieves at its own pace.
+	SLOW_CONSUMER_DIGEST = "digest"
+
+	// The connection is written after the other connections of the
+	// user. See Conn.Deprioritized().
+	SLOW_CONSUMER_DEPRIORITIZE = "deprioritize"
+
+	// The commands not written yet are dropped, and the client is told
+	// CMD_BYE(BYE_SLOW_CONSUMER) before the connection is closed. A
+	// disconnected client does not recover.
+	SLOW_CONSUMER_DISCONNECT = "disconnect"
+)
+
+// How long the CMD_BYE of a slow consumer may take to be written.
+const slowConsumerByeTimeout = 5 * time.Second
+
+// SlowConsumerPolicy tells when a client is too slow, and what to
+// do about it. A write is late if the command is written more than
+// Latency after it is queued, or if more than QueueDepth commands are
+// queued behind it. Zero disables either. A client is slow once its
+// writes have been late for Window, and recovers once they have been
+// on time for Window.
+type SlowConsumerPolicy struct {
+	Latency    time.Duration
+	QueueDepth int
+	Window     time.Duration
+	Action     string
+}
+
+func (self *SlowConsumerPolicy) late(latency time.Duration, depth int) bool {
+	if self.Latency > 0 && latency > self.Latency {
+		return true
+	}
+	return self.QueueDepth > 0 && depth > self.QueueDepth
+}
+
+// SlowConsumer reports that a connection has been found slow, or that
+// it has recovered.
+type SlowConsumer struct {
+	Service   string
+	Username  string
+	ConnId    string
+	Action    string
+	Recovered bool
+}
+
+// slowDetector follows the writes of a connection.
+type slowDetector struct {
+	lock      sync.Mutex
+	policy    *SlowConsumerPolicy
+	reports   chan<- *SlowConsumer
+	slow      bool
+	evicted   bool
+	lateSince time.Time
+	fastSince time.Time
+}
+
+// sample returns the new state of the connection if it changes.
+func (self *slowDetector) sample(latency time.Duration, depth int) (changed, slow bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.evicted {
+		return
+	}
+	now := time.Now()
+	if self.policy.late(latency, depth) {
+		self.fastSince = time.Time{}
+		if self.lateSince.IsZero() {
+			self.lateSince = now
+		}
+		if !self.slow && now.Sub(self.lateSince) >= self.policy.Window {
+			self.slow = true
+			changed = true
+		}
+	} else {
+		self.lateSince = time.Time{}
+		if self.fastSince.IsZero() {
+			self.fastSince = now
+		}
+		if self.slow && now.Sub(self.fastSince) >= self.policy.Window {
+			self.slow = false
+			changed = true
+		}
+	}
+	if changed && self.slow && self.policy.Action == SLOW_CONSUMER_DISCONNECT {
+		self.evicted = true
+	}
+	slow = self.slow
+	return
+}
+
+// SetSlowConsumerPolicy() follows the writes to the client, and takes
+// the action of the policy while the client is slow. The changes are
+// reported to reports, if it is not nil, in which case the owner of a
+// disconnected slow consumer should close it. A nil policy stops
+// following the writes.
+func (self *serverConn) SetSlowConsumerPolicy(policy *SlowConsumerPolicy, reports chan<- *SlowConsumer) {
+	if policy == nil {
+		self.writer.setMonitor(nil)
+		self.setSlow(nil, false)
+		return
+	}
+	d := &slowDetector{policy: policy, reports: reports}
+	self.writer.setMonitor(func(latency time.Duration, depth int) {
+		if changed, slow := d.sample(latency, depth); changed {
+			self.onSlowConsumer(d, slow)
+		}
+	})
+}
+
+func (self *serverConn) setSlow(policy *SlowConsumerPolicy, slow bool) {
+	var digestOnly, deprioritized int32
+	if slow {
+		switch policy.Action {
+		case SLOW_CONSUMER_DIGEST:
+			digestOnly = 1
+		case SLOW_CONSUMER_DEPRIORITIZE:
+			deprioritized = 1
+		}
+	}
+	atomic.StoreInt32(&self.digestOnly, digestOnly)
+	atomic.StoreInt32(&self.deprioritized, deprioritized)
+	var s int32
+	if slow {
+		s = 1
+	}
+	atomic.StoreInt32(&self.slowConsumer, s)
+}
+
+// onSlowConsumer may be called by the writer goroutine, so it never
+// waits for a write.
+func (self *serverConn) onSlowConsumer(d *slowDetector, slow bool) {
+	self.setSlow(d.policy, slow)
+	report := &SlowConsumer{
+		Service:   self.service,
+		Username:  self.username,
+		ConnId:    self.connId,
+		Action:    d.policy.Action,
+		Recovered: !slow,
+	}
+	if slow {
+		self.logger.Warn("slow consumer", "action", d.policy.Action)
+	} else {
+		self.logger.Info("slow consumer recovered", "action", d.policy.Action)
+	}
+	var written <-chan error
+	if slow && d.policy.Action == SLOW_CONSUMER_DISCONNECT {
+		self.writer.dropQueued(ErrSlowConsumer)
+		self.conn.SetWriteDeadline(time.Now().Add(slowConsumerByeTimeout))
+		bye := &proto.Bye{Reason: proto.BYE_SLOW_CONSUMER}
+		written = self.writer.post(bye.Command())
+	}
+	if d.reports == nil && written == nil {
+		return
+	}
+	go func() {
+		if written != nil {
+			<-written
+			if d.reports == nil {
+				// Nobody else would close it.
+				self.Close()
+				return
+			}
+		}
+		if d.reports != nil {
+			d.reports <- report
+		}
+	}()
+}
+
+// Deprioritized() tells whether the client is slow, and its
+// messages should be written after the others.
+func (self *serverConn) Deprioritized() bool {
+	return atomic.LoadInt32(&self.deprioritized) > 0
+}
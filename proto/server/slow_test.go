@@ -0,0 +1,144 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"github.com/uniqush/uniqush-conn/throttle"
+	"testing"
+	"time"
+)
+
+// stallConn writes a large message, which takes about a second to be
+// written through the throttle, and lets it stall.
+func stallConn(t *testing.T, servConn Conn, policy *SlowConsumerPolicy) (reports chan *SlowConsumer, written chan error) {
+	reports = make(chan *SlowConsumer, 4)
+	written = make(chan error, 1)
+	servConn.SetThrottle(throttle.NewBucket(1000))
+	servConn.SetDigestThreshold(-1)
+	servConn.SetSlowConsumerPolicy(policy, reports)
+	go func() {
+		written <- servConn.SendMessage(&proto.Message{Body: bytes.Repeat([]byte("a"), 2000)}, "", nil)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	return
+}
+
+func receiveReport(t *testing.T, reports chan *SlowConsumer) *SlowConsumer {
+	select {
+	case r := <-reports:
+		return r
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no report")
+	}
+	return nil
+}
+
+func TestSlowConsumerDigest(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	servConn, cliConn, err := buildServerClientConns(addr, "token", 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+	digestChan := make(chan *client.Digest, 1)
+	cliConn.SetDigestChannel(digestChan)
+	go func() {
+		for {
+			if _, err := cliConn.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	policy := &SlowConsumerPolicy{Latency: 50 * time.Millisecond, Action: SLOW_CONSUMER_DIGEST}
+	reports, written := stallConn(t, servConn, policy)
+	// Queued behind the stalled one, it tells that the client is slow.
+	first := &proto.MessageContainer{Id: "first", Message: &proto.Message{Body: []byte("hello")}}
+	go servConn.DeliverMessage(first, nil)
+	r := receiveReport(t, reports)
+	if r.Recovered || r.Action != SLOW_CONSUMER_DIGEST || r.ConnId != servConn.ConnId() || !servConn.Stats().SlowConsumer {
+		t.Errorf("bad report: %+v", r)
+	}
+
+	second := &proto.MessageContainer{Id: "second", Message: &proto.Message{Body: []byte("hello")}}
+	if err := servConn.DeliverMessage(second, nil); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if err := <-written; err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	select {
+	case digest := <-digestChan:
+		if digest.MsgId != second.Id {
+			t.Errorf("wrong digest: %+v", digest)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("a slow consumer is not sent digests")
+	}
+	// The client keeps up once the throttle is lifted.
+	servConn.SetThrottle()
+	if err := servConn.SendMessage(&proto.Message{Body: []byte("hello")}, "", nil); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if r = receiveReport(t, reports); !r.Recovered || servConn.Stats().SlowConsumer {
+		t.Errorf("bad report: %+v", r)
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	servConn, cliConn, err := buildServerClientConns(addr, "token", 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+	received := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := cliConn.ReceiveMessage(); err != nil {
+				received <- err
+				return
+			}
+		}
+	}()
+
+	policy := &SlowConsumerPolicy{QueueDepth: 0, Latency: 50 * time.Millisecond, Action: SLOW_CONSUMER_DISCONNECT}
+	reports, written := stallConn(t, servConn, policy)
+	if err := servConn.SendMessage(&proto.Message{Body: []byte("hello")}, "", nil); err != ErrSlowConsumer {
+		t.Errorf("the message to a slow consumer is not dropped: %v", err)
+	}
+	if err := <-written; err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if r := receiveReport(t, reports); r.Recovered || r.Action != SLOW_CONSUMER_DISCONNECT {
+		t.Errorf("bad report: %+v", r)
+	}
+	select {
+	case err := <-received:
+		if err != client.ErrSlowConsumer {
+			t.Errorf("the client is not told it is slow: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("the client is not told it is slow")
+	}
+}
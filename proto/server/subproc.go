@@ -35,8 +35,8 @@ func (self *subscribeProcessor) ProcessCommand(cmd *proto.Command) (msg *proto.M
 	if cmd == nil || cmd.Type != proto.CMD_SUBSCRIPTION || self.conn == nil || self.subChan == nil {
 		return
 	}
-	if len(cmd.Params) < 1 {
-		err = proto.ErrBadPeerImpl
+	s, err := proto.ParseSubscription(cmd.Params)
+	if err != nil && err != proto.ErrNoChange {
 		return
 	}
 	if cmd.Message == nil {
@@ -47,19 +47,15 @@ func (self *subscribeProcessor) ProcessCommand(cmd *proto.Command) (msg *proto.M
 		err = proto.ErrBadPeerImpl
 		return
 	}
-	sub := true
-	if cmd.Params[0] == "0" {
-		sub = false
-	} else if cmd.Params[0] == "1" {
-		sub = true
-	} else {
+	if err == proto.ErrNoChange {
+		err = nil
 		return
 	}
 	req := new(SubscribeRequest)
 	req.Params = cmd.Message.Header
 	req.Service = self.conn.Service()
 	req.Username = self.conn.Username()
-	req.Subscribe = sub
+	req.Subscribe = s.Subscribe
 	self.subChan <- req
 	return
 }
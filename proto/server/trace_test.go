@@ -0,0 +1,79 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/tracing"
+	"sync"
+	"testing"
+	"time"
+)
+
+type ctxSpan struct {
+	ctx string
+}
+
+func (self *ctxSpan) Context() string    { return self.ctx }
+func (self *ctxSpan) SetError(err error) {}
+func (self *ctxSpan) End()               {}
+
+type chainTracer struct {
+	lock  sync.Mutex
+	names []string
+}
+
+func (self *chainTracer) StartSpan(name, parent string, kv ...interface{}) tracing.Span {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.names = append(self.names, name)
+	return &ctxSpan{name + "<" + parent}
+}
+
+func TestForwardRequestCarriesTraceContext(t *testing.T) {
+	tracer := new(chainTracer)
+	tracing.SetTracer(tracer)
+	defer tracing.SetTracer(nil)
+
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	fwdChan := make(chan *ForwardRequest)
+	servConn.SetForwardRequestChannel(fwdChan)
+	go servConn.ReceiveMessage()
+
+	msg := randomMessage()
+	msg.Header[proto.TraceHeader] = "client"
+	err = cliConn.SendMessageToUser("service", "receiver", msg, 1*time.Hour)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	fwdreq := <-fwdChan
+	ctx := tracing.Context(fwdreq.MessageContainer.Message)
+	if ctx != "forward<command<client" {
+		t.Errorf("bad trace context: %v", ctx)
+	}
+}
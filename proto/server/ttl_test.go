@@ -0,0 +1,67 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+func TestTTLSentToClient(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	servConn, cliConn, err := buildServerClientConns(addr, "token", 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	// By the clock of the server.
+	expires := time.Now().Add(time.Hour).UnixNano()
+	mcs := []*proto.MessageContainer{
+		&proto.MessageContainer{Id: "1", Message: randomMessage(), ExpiresAt: expires},
+		&proto.MessageContainer{Id: "2", Message: randomMessage(), ExpiresAt: expires, Sender: "bob", SenderService: "service"},
+		&proto.MessageContainer{Id: "3", Message: randomMessage()},
+	}
+	for _, mc := range mcs {
+		err = servConn.DeliverMessage(mc, nil)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	for _, mc := range mcs {
+		rmc, err := cliConn.ReceiveMessage()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if rmc.Id != mc.Id {
+			t.Fatalf("bad message: %+v", rmc)
+		}
+		if mc.ExpiresAt == 0 {
+			if rmc.ExpiresAt != 0 {
+				t.Errorf("message %v should never expire", rmc.Id)
+			}
+			continue
+		}
+		if d := time.Until(time.Unix(0, rmc.ExpiresAt)); d < 59*time.Minute || d > time.Hour+time.Second {
+			t.Errorf("message %v should expire in an hour, not %v", rmc.Id, d)
+		}
+	}
+}
@@ -31,14 +31,20 @@ func (self *visibilityProcessor) ProcessCommand(cmd *proto.Command) (msg *proto.
 	if cmd == nil || cmd.Type != proto.CMD_SET_VISIBILITY {
 		return
 	}
-	if len(cmd.Params) < 1 {
-		err = proto.ErrBadPeerImpl
+	v, err := proto.ParseVisibility(cmd.Params)
+	if err == proto.ErrNoChange {
+		err = nil
+	}
+	if err != nil {
 		return
 	}
-	if cmd.Params[0] == "0" {
-		atomic.StoreInt32(&self.conn.visible, 0)
-	} else if cmd.Params[0] == "1" {
-		atomic.StoreInt32(&self.conn.visible, 1)
+	if v != nil {
+		visible := int32(0)
+		if v.Visible {
+			visible = 1
+		}
+		atomic.StoreInt32(&self.conn.visible, visible)
 	}
+	self.conn.saveSession()
 	return
 }
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto"
+	"time"
+)
+
+// WriteAheadLog keeps a message which is not cached yet before it
+// is written to the client. A message which cannot be written, or
+// which is lost in the buffers when the server crashes, can then
+// still be retrieved by the client.
+type WriteAheadLog interface {
+	// Persist should assign mc.Id, so that the client could
+	// retrieve the message with it.
+	Persist(service, username string, mc *proto.MessageContainer) error
+
+	// Discard deletes a persisted message once it is written.
+	Discard(service, username, id string) error
+}
+
+type cacheWriteAheadLog struct {
+	cache msgcache.Cache
+	ttl   time.Duration
+}
+
+// NewCacheWriteAheadLog returns a WriteAheadLog which keeps the
+// messages in the cache for ttl.
+func NewCacheWriteAheadLog(cache msgcache.Cache, ttl time.Duration) WriteAheadLog {
+	ret := new(cacheWriteAheadLog)
+	ret.cache = cache
+	ret.ttl = ttl
+	return ret
+}
+
+func (self *cacheWriteAheadLog) Persist(service, username string, mc *proto.MessageContainer) error {
+	_, err := self.cache.CacheMessage(service, username, mc, self.ttl)
+	return err
+}
+
+func (self *cacheWriteAheadLog) Discard(service, username, id string) error {
+	return self.cache.Del(service, username, id)
+}
+
+// writeAhead tells if the message has been persisted.
+// Messages which are already cached, and the ephemeral ones, are not
+// persisted.
+func (self *serverConn) writeAhead(mc *proto.MessageContainer) bool {
+	wal := self.writeAheadLog()
+	if wal == nil || len(mc.Id) > 0 || mc.Message.IsEmpty() || mc.Message.Ephemeral {
+		return false
+	}
+	err := wal.Persist(self.Service(), self.Username(), mc)
+	if err != nil {
+		self.logger.Warn("cannot write the message ahead", "err", err)
+		return false
+	}
+	return true
+}
+
+// afterWriteAhead treats a persisted message as delivered even
+// if it cannot be written. A message which is written is discarded
+// from the log, unless the log is the auto cache, which keeps the
+// message until the client acks it.
+func (self *serverConn) afterWriteAhead(mc *proto.MessageContainer, persisted bool, err error) error {
+	if !persisted {
+		return err
+	}
+	if err != nil {
+		self.logger.Warn("message kept by the write-ahead log", "id", mc.Id, "err", err)
+		return nil
+	}
+	if wal := self.writeAheadLog(); wal != nil && !self.autoCached() {
+		if derr := wal.Discard(self.Service(), self.Username(), mc.Id); derr != nil {
+			self.logger.Warn("cannot discard the written message", "id", mc.Id, "err", derr)
+		}
+	}
+	return nil
+}
+
+func (self *serverConn) writeAheadLog() WriteAheadLog {
+	self.walLock.Lock()
+	defer self.walLock.Unlock()
+	return self.wal
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWriteAheadLog(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	defer clearCache()
+	servConn.SetWriteAheadLog(NewCacheWriteAheadLog(cache, time.Hour))
+
+	msg := randomMessage()
+	err = servConn.SendMessage(msg, "", nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	mc, err := cliConn.ReceiveMessage()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if len(mc.Id) == 0 || !mc.Message.Eq(msg) {
+		t.Errorf("bad message: %+v", mc)
+	}
+	// A written message is discarded from the log.
+	cached, err := cache.Get(servConn.Service(), servConn.Username(), mc.Id)
+	if err != nil || cached != nil {
+		t.Errorf("written message not discarded: %v %v", cached, err)
+	}
+
+	// A persisted message counts as delivered even if the
+	// connection is broken.
+	servConn.Close()
+	err = servConn.SendMessage(randomMessage(), "", nil)
+	if err != nil {
+		t.Errorf("persisted message should not fail: %v", err)
+	}
+	msgs, err := cache.GetCachedMessages(servConn.Service(), servConn.Username())
+	if err != nil || len(msgs) != 1 {
+		t.Errorf("%v messages persisted: %v", len(msgs), err)
+	}
+
+	servConn.SetWriteAheadLog(nil)
+	err = servConn.SendMessage(randomMessage(), "", nil)
+	if err == nil {
+		t.Errorf("should fail without the write-ahead log")
+	}
+}
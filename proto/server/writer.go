@@ -0,0 +1,288 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+	"sync"
+	"time"
+)
+
+var ErrConnClosed = errors.New("connection closed")
+
+type writeRequest struct {
+	cmd      *proto.Command
+	payload  *proto.Payload
+	compress bool
+	size     int64
+	queuedAt time.Time
+	errChan  chan error
+}
+
+// commandWriter is the only one writing to a connection. The commands
+// are queued by any goroutine and written one after another in the
+// order they are queued, so that the frames are never interleaved.
+//
+// The writer goroutine only runs while there are commands to write,
+// so that an idle connection does not pin one.
+type commandWriter struct {
+	cmdio   *proto.CommandIO
+	lock    sync.Mutex
+	queue   []*writeRequest
+	running bool
+	closed  bool
+
+	// Set by drain(). idle, if not nil, is closed once the writer
+	// goroutine stops.
+	draining bool
+	idle     chan bool
+	failed   error
+
+	// buffered is the memory held by the commands queued or being
+	// written, and by the digests charged to the writer. The bounded
+	// writes fail with ErrMemoryLimit once it would exceed limit.
+	buffered    int64
+	limit       int64
+	nrOverLimit int64
+
+	// writing is the command being written. monitor, if not nil, is
+	// told how late the commands are written, and how many are queued
+	// behind, whenever one is queued or written.
+	writing *writeRequest
+	monitor func(latency time.Duration, depth int)
+}
+
+func newCommandWriter(cmdio *proto.CommandIO) *commandWriter {
+	ret := new(commandWriter)
+	ret.cmdio = cmdio
+	return ret
+}
+
+func (self *commandWriter) run() {
+	for {
+		self.lock.Lock()
+		if len(self.queue) == 0 || self.closed {
+			self.running = false
+			if self.idle != nil {
+				close(self.idle)
+				self.idle = nil
+			}
+			self.lock.Unlock()
+			return
+		}
+		req := self.queue[0]
+		self.queue[0] = nil
+		self.queue = self.queue[1:]
+		if len(self.queue) == 0 {
+			// Let the backing array go.
+			self.queue = nil
+		}
+		self.writing = req
+		self.lock.Unlock()
+
+		var err error
+		if req.payload == nil {
+			err = self.cmdio.WriteCommand(req.cmd, req.compress)
+		} else {
+			err = self.cmdio.WriteSharedCommand(req.cmd, req.payload, req.compress)
+		}
+		self.lock.Lock()
+		if err != nil {
+			self.failed = err
+		}
+		self.writing = nil
+		depth := len(self.queue)
+		monitor := self.monitor
+		self.lock.Unlock()
+		self.discharge(req.size)
+		req.errChan <- err
+		if monitor != nil {
+			monitor(time.Since(req.queuedAt), depth)
+		}
+	}
+}
+
+// write() queues the command and waits until it is written. The
+// payload, if not nil, replaces the message of the command.
+func (self *commandWriter) write(cmd *proto.Command, payload *proto.Payload, compress bool) error {
+	return self.queueAndWait(cmd, payload, compress, false)
+}
+
+// writeBounded() is write() failing with ErrMemoryLimit if the command
+// does not fit in the memory limit. It is used for the messages and
+// their digests, while the other commands are only counted.
+func (self *commandWriter) writeBounded(cmd *proto.Command, payload *proto.Payload, compress bool) error {
+	return self.queueAndWait(cmd, payload, compress, true)
+}
+
+func (self *commandWriter) queueAndWait(cmd *proto.Command, payload *proto.Payload, compress, bounded bool) error {
+	errChan, err := self.queueCommand(cmd, payload, compress, bounded)
+	if err != nil {
+		return err
+	}
+	return <-errChan
+}
+
+// post() queues the command without waiting until it is written. The
+// channel receives the error of the write.
+func (self *commandWriter) post(cmd *proto.Command) <-chan error {
+	errChan, err := self.queueCommand(cmd, nil, false, false)
+	if err != nil {
+		errChan = make(chan error, 1)
+		errChan <- err
+	}
+	return errChan
+}
+
+func (self *commandWriter) queueCommand(cmd *proto.Command, payload *proto.Payload, compress, bounded bool) (errChan chan error, err error) {
+	req := &writeRequest{
+		cmd:      cmd,
+		payload:  payload,
+		compress: compress,
+		size:     commandSize(cmd),
+		queuedAt: time.Now(),
+		errChan:  make(chan error, 1),
+	}
+	self.lock.Lock()
+	if self.closed || self.draining {
+		self.lock.Unlock()
+		err = ErrConnClosed
+		return
+	}
+	if bounded && self.overLimit(req.size) {
+		self.lock.Unlock()
+		err = ErrMemoryLimit
+		return
+	}
+	self.buffered += req.size
+	self.queue = append(self.queue, req)
+	if !self.running {
+		self.running = true
+		go self.run()
+	}
+	// A stalled write is noticed without waiting for it to end.
+	var latency time.Duration
+	if self.writing != nil {
+		latency = req.queuedAt.Sub(self.writing.queuedAt)
+	}
+	depth := len(self.queue) - 1
+	monitor := self.monitor
+	self.lock.Unlock()
+	if monitor != nil {
+		monitor(latency, depth)
+	}
+	errChan = req.errChan
+	return
+}
+
+// dropQueued() fails the commands not written yet with err. The
+// command being written, if any, is not interrupted.
+func (self *commandWriter) dropQueued(err error) {
+	self.lock.Lock()
+	dropped := self.queue
+	self.queue = nil
+	self.lock.Unlock()
+	for _, req := range dropped {
+		self.discharge(req.size)
+		req.errChan <- err
+	}
+}
+
+func (self *commandWriter) setMonitor(monitor func(latency time.Duration, depth int)) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.monitor = monitor
+}
+
+// stop() drops the commands not written yet. The command being
+// written, if any, is not interrupted.
+func (self *commandWriter) stop() {
+	self.lock.Lock()
+	dropped := self.queue
+	self.queue = nil
+	self.closed = true
+	self.lock.Unlock()
+	for _, req := range dropped {
+		self.discharge(req.size)
+		req.errChan <- ErrConnClosed
+	}
+}
+
+// drain() fails the commands queued afterwards with ErrConnClosed, and
+// waits until the ones queued before are written. It returns the error
+// of the last failed write, after which the stream cannot be trusted.
+func (self *commandWriter) drain() error {
+	self.lock.Lock()
+	self.draining = true
+	var idle chan bool
+	if self.running {
+		idle = make(chan bool)
+		self.idle = idle
+	}
+	self.lock.Unlock()
+	if idle != nil {
+		<-idle
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.failed
+}
+
+// overLimit should be called with the lock held. A command is always
+// accepted if nothing else is buffered, so that a message larger than
+// the limit is not refused forever.
+func (self *commandWriter) overLimit(size int64) bool {
+	if self.limit <= 0 || self.buffered == 0 || self.buffered+size <= self.limit {
+		return false
+	}
+	self.nrOverLimit++
+	return true
+}
+
+func (self *commandWriter) setLimit(limit int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.limit = limit
+}
+
+// charge() counts the memory held for the connection out of the
+// queue, e.g. by a batch of digests, as long as it fits in the limit.
+func (self *commandWriter) charge(size int64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.overLimit(size) {
+		return ErrMemoryLimit
+	}
+	self.buffered += size
+	return nil
+}
+
+func (self *commandWriter) discharge(size int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.buffered -= size
+}
+
+// memoryStats() returns the memory buffered and the number of bounded
+// writes and charges which did not fit in the limit.
+func (self *commandWriter) memoryStats() (buffered, nrOverLimit int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.buffered, self.nrOverLimit
+}
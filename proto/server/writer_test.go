@@ -0,0 +1,137 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentWrites(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	N := 8
+	M := 16
+	// The digests are not returned by ReceiveMessage().
+	digestChan := make(chan *client.Digest, N*M)
+	cliConn.SetDigestChannel(digestChan)
+	var wg sync.WaitGroup
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < M; j++ {
+				msg := &proto.Message{Body: []byte(fmt.Sprintf("%v-%v", i, j))}
+				mc := &proto.MessageContainer{Id: fmt.Sprintf("id-%v-%v", i, j), Message: msg}
+				var err error
+				if j%2 == 0 {
+					err = servConn.SendMessage(msg, "", nil)
+				} else {
+					err = servConn.SendDigest(mc, nil)
+				}
+				if err != nil {
+					t.Errorf("Error: %v", err)
+				}
+			}
+		}(i)
+	}
+	msgChan := make(chan *proto.MessageContainer, N*M)
+	go func() {
+		for {
+			mc, err := cliConn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			msgChan <- mc
+		}
+	}()
+	received := make(map[string]bool, N*M/2)
+	nrDigests := 0
+	for len(received) < N*M/2 || nrDigests < N*M/2 {
+		select {
+		case mc := <-msgChan:
+			received[string(mc.Message.Body)] = true
+		case <-digestChan:
+			nrDigests++
+		case <-time.After(3 * time.Second):
+			t.Fatalf("received %v messages and %v digests", len(received), nrDigests)
+		}
+	}
+	wg.Wait()
+	for i := 0; i < N; i++ {
+		for j := 0; j < M; j += 2 {
+			if !received[fmt.Sprintf("%v-%v", i, j)] {
+				t.Errorf("message %v-%v is not received", i, j)
+			}
+		}
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer cliConn.Close()
+	servConn.Close()
+	err = servConn.SendMessage(&proto.Message{Body: []byte("hello")}, "", nil)
+	if err != ErrConnClosed {
+		t.Errorf("should not write after close: %v", err)
+	}
+}
+
+func TestNoWriterWhenIdle(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+	go cliConn.ReceiveMessage()
+
+	err = servConn.SendMessage(&proto.Message{Body: []byte("hello")}, "", nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	writer := servConn.(*serverConn).writer
+	for i := 0; i < 100; i++ {
+		writer.lock.Lock()
+		running := writer.running
+		writer.lock.Unlock()
+		if !running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("the writer goroutine keeps running on an idle connection")
+}
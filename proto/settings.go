@@ -0,0 +1,74 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import (
+	"strconv"
+	"time"
+)
+
+// Settings are the settings recommended by the server to its clients.
+type Settings struct {
+	DigestThreshold   int           `json:"digestThreshold"`
+	CompressThreshold int           `json:"compressThreshold"`
+	PingInterval      time.Duration `json:"pingInterval"`
+}
+
+// Command returns a CMD_RECOMMEND_SETTING carrying the settings.
+func (self *Settings) Command() *Command {
+	cmd := &Command{
+		Type:   CMD_RECOMMEND_SETTING,
+		Params: make([]string, 2, 3),
+	}
+	cmd.Params[0] = strconv.Itoa(self.DigestThreshold)
+	cmd.Params[1] = strconv.Itoa(self.CompressThreshold)
+	if self.PingInterval > 0 {
+		cmd.Params = append(cmd.Params, self.PingInterval.String())
+	}
+	return cmd
+}
+
+// ParseSettings parses the parameters of a CMD_RECOMMEND_SETTING.
+func ParseSettings(params []string) (s *Settings, err error) {
+	if len(params) < 2 {
+		err = ErrBadPeerImpl
+		return
+	}
+	s = new(Settings)
+	s.DigestThreshold, err = strconv.Atoi(params[0])
+	if err != nil {
+		s = nil
+		err = ErrBadPeerImpl
+		return
+	}
+	s.CompressThreshold, err = strconv.Atoi(params[1])
+	if err != nil {
+		s = nil
+		err = ErrBadPeerImpl
+		return
+	}
+	if len(params) > 2 && len(params[2]) > 0 {
+		s.PingInterval, err = time.ParseDuration(params[2])
+		if err != nil {
+			s = nil
+			err = ErrBadPeerImpl
+			return
+		}
+	}
+	return
+}
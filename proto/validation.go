@@ -0,0 +1,34 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package proto
+
+import "fmt"
+
+// ValidationError tells why a message is rejected by the validator
+// of a service. Header is empty if the error is not about a header.
+type ValidationError struct {
+	Header string `json:"header,omitempty"`
+	Reason string `json:"reason"`
+}
+
+func (self *ValidationError) Error() string {
+	if len(self.Header) == 0 {
+		return fmt.Sprintf("invalid message: %v", self.Reason)
+	}
+	return fmt.Sprintf("invalid header %v: %v", self.Header, self.Reason)
+}
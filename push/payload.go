@@ -0,0 +1,80 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package push
+
+import (
+	"strconv"
+
+	"github.com/uniqush/uniqush-conn/proto/server"
+)
+
+// The push info fields, i.e. the parameters of uniqush-push, set by
+// a PayloadMapping. uniqush-push sends the ones which make sense for
+// the delivery point, APNS or FCM.
+const (
+	INFO_TITLE             = "notif.title"
+	INFO_BODY              = "notif.msg"
+	INFO_BADGE             = "notif.badge"
+	INFO_FCM_COLLAPSE_KEY  = "notif.collapse_key"
+	INFO_APNS_COLLAPSE_KEY = "notif.apns-collapse-id"
+
+	// A push info with only this field is a silent push, which wakes
+	// the app up without alerting the user: content-available for
+	// APNS, and a data message for FCM.
+	INFO_CONTENT_AVAILABLE = "notif.content-available"
+)
+
+// PayloadMapping renders the payload fields of the push notifications
+// of a service from the fields of the messages, the way the previews
+// of the digests are, see server.DigestTemplate. A nil template leaves
+// the field alone. A badge which is not a number is left out.
+type PayloadMapping struct {
+	Title       *server.DigestTemplate
+	Body        *server.DigestTemplate
+	Badge       *server.DigestTemplate
+	CollapseKey *server.DigestTemplate
+}
+
+// Apply() renders the fields with lookup, and sets them in the push
+// info passed to Push.Push(). The non-empty ones replace the fields
+// already in info.
+func (self *PayloadMapping) Apply(info map[string]string, lookup func(field string) string) {
+	if self == nil {
+		return
+	}
+	set := func(tmpl *server.DigestTemplate, keys ...string) {
+		if tmpl == nil {
+			return
+		}
+		v := tmpl.Execute(lookup)
+		if len(v) == 0 {
+			return
+		}
+		for _, k := range keys {
+			info[k] = v
+		}
+	}
+	set(self.Title, INFO_TITLE)
+	set(self.Body, INFO_BODY)
+	if self.Badge != nil {
+		if n, err := strconv.Atoi(self.Badge.Execute(lookup)); err == nil && n >= 0 {
+			info[INFO_BADGE] = strconv.Itoa(n)
+		}
+	}
+	set(self.CollapseKey, INFO_FCM_COLLAPSE_KEY, INFO_APNS_COLLAPSE_KEY)
+}
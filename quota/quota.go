@@ -0,0 +1,163 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package quota counts the messages and the bytes sent by every
+// user, and in every service, per day, and enforces limits on them.
+// Days are in UTC.
+package quota
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"sync"
+	"time"
+)
+
+type Usage struct {
+	Messages int64 `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// Store keeps the usage of every day. The usage of a whole service
+// is kept with an empty username.
+type Store interface {
+	// Add adds to the usage of the day, possibly negative numbers,
+	// and returns the usage after the addition.
+	Add(service, username string, day time.Time, nrMsgs, nrBytes int64) (usage *Usage, err error)
+	Usage(service, username string, day time.Time) (usage *Usage, err error)
+}
+
+// Limits are per day. Zero means no limit.
+type Limits struct {
+	MessagesPerUser    int64 `json:"messagesPerUser,omitempty"`
+	BytesPerUser       int64 `json:"bytesPerUser,omitempty"`
+	MessagesPerService int64 `json:"messagesPerService,omitempty"`
+	BytesPerService    int64 `json:"bytesPerService,omitempty"`
+}
+
+// Day returns the beginning of the day of t.
+func Day(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func dayKey(day time.Time) string {
+	return Day(day).Format("20060102")
+}
+
+// Enforcer charges the messages to the store, unless they exceed
+// the limits.
+type Enforcer struct {
+	store  Store
+	limits Limits
+}
+
+func NewEnforcer(store Store, limits Limits) *Enforcer {
+	ret := new(Enforcer)
+	ret.store = store
+	ret.limits = limits
+	return ret
+}
+
+func (self *Enforcer) Limits() Limits {
+	return self.limits
+}
+
+func (self *Enforcer) Usage(service, username string, day time.Time) (usage *Usage, err error) {
+	return self.store.Usage(service, username, day)
+}
+
+func exceeded(usage *Usage, maxMsgs, maxBytes int64, scope string, reset time.Time) *proto.QuotaError {
+	if maxMsgs > 0 && usage.Messages > maxMsgs {
+		return &proto.QuotaError{Scope: scope, Resource: proto.QUOTA_MESSAGES, Limit: maxMsgs, Reset: reset}
+	}
+	if maxBytes > 0 && usage.Bytes > maxBytes {
+		return &proto.QuotaError{Scope: scope, Resource: proto.QUOTA_BYTES, Limit: maxBytes, Reset: reset}
+	}
+	return nil
+}
+
+// Charge counts a message of size bytes sent by, or to, the user.
+// If it exceeds a limit, nothing is counted and the error is a
+// *proto.QuotaError.
+func (self *Enforcer) Charge(service, username string, size int) error {
+	now := time.Now()
+	reset := Day(now).AddDate(0, 0, 1)
+	n := int64(size)
+	usage, err := self.store.Add(service, username, now, 1, n)
+	if err != nil {
+		return err
+	}
+	if qerr := exceeded(usage, self.limits.MessagesPerUser, self.limits.BytesPerUser, proto.QUOTA_SCOPE_USER, reset); qerr != nil {
+		self.store.Add(service, username, now, -1, -n)
+		return qerr
+	}
+	usage, err = self.store.Add(service, "", now, 1, n)
+	if err != nil {
+		self.store.Add(service, username, now, -1, -n)
+		return err
+	}
+	if qerr := exceeded(usage, self.limits.MessagesPerService, self.limits.BytesPerService, proto.QUOTA_SCOPE_SERVICE, reset); qerr != nil {
+		self.store.Add(service, "", now, -1, -n)
+		self.store.Add(service, username, now, -1, -n)
+		return qerr
+	}
+	return nil
+}
+
+type memStore struct {
+	lock  sync.Mutex
+	usage map[string]*Usage
+}
+
+// NewMemoryStore returns a Store which counts the usage on this node
+// only, so that each node of a cluster enforces the whole quota. The
+// usage of the past days is never dropped.
+func NewMemoryStore() Store {
+	ret := new(memStore)
+	ret.usage = make(map[string]*Usage, 100)
+	return ret
+}
+
+func usageKey(service, username string, day time.Time) string {
+	return service + "\n" + username + "\n" + dayKey(day)
+}
+
+func (self *memStore) Add(service, username string, day time.Time, nrMsgs, nrBytes int64) (usage *Usage, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := usageKey(service, username, day)
+	u, ok := self.usage[key]
+	if !ok {
+		u = new(Usage)
+		self.usage[key] = u
+	}
+	u.Messages += nrMsgs
+	u.Bytes += nrBytes
+	usage = new(Usage)
+	*usage = *u
+	return
+}
+
+func (self *memStore) Usage(service, username string, day time.Time) (usage *Usage, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	usage = new(Usage)
+	if u, ok := self.usage[usageKey(service, username, day)]; ok {
+		*usage = *u
+	}
+	return
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package quota
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/proto"
+	"testing"
+	"time"
+)
+
+func getRedisStore() Store {
+	db := 9
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	c.Do("SELECT", db)
+	c.Do("FLUSHDB")
+	c.Close()
+	return NewRedisStore("", "", db)
+}
+
+func testStore(store Store, t *testing.T) {
+	today := time.Now()
+	usage, err := store.Usage("srv", "alice", today)
+	if err != nil || usage.Messages != 0 || usage.Bytes != 0 {
+		t.Errorf("bad usage: %+v %v", usage, err)
+	}
+	store.Add("srv", "alice", today, 1, 100)
+	usage, err = store.Add("srv", "alice", today, 2, 50)
+	if err != nil || usage.Messages != 3 || usage.Bytes != 150 {
+		t.Errorf("bad usage: %+v %v", usage, err)
+	}
+	usage, err = store.Add("srv", "alice", today, -1, -50)
+	if err != nil || usage.Messages != 2 || usage.Bytes != 100 {
+		t.Errorf("bad usage: %+v %v", usage, err)
+	}
+	usage, err = store.Usage("srv", "alice", today)
+	if err != nil || usage.Messages != 2 || usage.Bytes != 100 {
+		t.Errorf("bad usage: %+v %v", usage, err)
+	}
+	usage, err = store.Usage("srv", "alice", today.AddDate(0, 0, -1))
+	if err != nil || usage.Messages != 0 {
+		t.Errorf("yesterday should have no usage: %+v %v", usage, err)
+	}
+	usage, err = store.Usage("srv", "bob", today)
+	if err != nil || usage.Messages != 0 {
+		t.Errorf("bob should have no usage: %+v %v", usage, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(NewMemoryStore(), t)
+}
+
+func TestRedisStore(t *testing.T) {
+	testStore(getRedisStore(), t)
+}
+
+func TestEnforcer(t *testing.T) {
+	store := NewMemoryStore()
+	e := NewEnforcer(store, Limits{MessagesPerUser: 2, BytesPerUser: 100, MessagesPerService: 3})
+	if err := e.Charge("srv", "alice", 10); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	err := e.Charge("srv", "alice", 200)
+	if qerr, ok := err.(*proto.QuotaError); !ok || qerr.Scope != proto.QUOTA_SCOPE_USER || qerr.Resource != proto.QUOTA_BYTES || qerr.Limit != 100 {
+		t.Errorf("should exceed the byte quota: %v", err)
+	}
+	if err := e.Charge("srv", "alice", 10); err != nil {
+		t.Errorf("a rejected message should not be counted: %v", err)
+	}
+	err = e.Charge("srv", "alice", 10)
+	if qerr, ok := err.(*proto.QuotaError); !ok || qerr.Resource != proto.QUOTA_MESSAGES || !qerr.Reset.After(time.Now()) {
+		t.Errorf("should exceed the message quota: %v", err)
+	}
+	if err := e.Charge("srv", "bob", 10); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	err = e.Charge("srv", "carol", 10)
+	if qerr, ok := err.(*proto.QuotaError); !ok || qerr.Scope != proto.QUOTA_SCOPE_SERVICE {
+		t.Errorf("should exceed the service quota: %v", err)
+	}
+	usage, _ := e.Usage("srv", "carol", time.Now())
+	if usage.Messages != 0 {
+		t.Errorf("carol should have no usage: %+v", usage)
+	}
+	usage, _ = e.Usage("srv", "", time.Now())
+	if usage.Messages != 3 || usage.Bytes != 30 {
+		t.Errorf("bad service usage: %+v", usage)
+	}
+}
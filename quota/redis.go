@@ -0,0 +1,98 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package quota
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/redispool"
+	"time"
+)
+
+// The usage of a day is kept for two days, so that it could still
+// be read on the next day.
+const usageRetention = 2 * 24 * time.Hour
+
+type redisStore struct {
+	pool *redis.Pool
+}
+
+// NewRedisStore keeps the usage of each day in a redis hash.
+func NewRedisStore(addr, password string, db int) Store {
+	pool := redispool.New(addr, password, db)
+
+	ret := new(redisStore)
+	ret.pool = pool
+	return ret
+}
+
+func redisUsageKey(service, username string, day time.Time) string {
+	return fmt.Sprintf("quota:%v:%v:%v", service, username, dayKey(day))
+}
+
+func (self *redisStore) Add(service, username string, day time.Time, nrMsgs, nrBytes int64) (usage *Usage, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	key := redisUsageKey(service, username, day)
+	conn.Send("MULTI")
+	conn.Send("HINCRBY", key, "messages", nrMsgs)
+	conn.Send("HINCRBY", key, "bytes", nrBytes)
+	conn.Send("EXPIRE", key, int64(usageRetention/time.Second))
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return
+	}
+	if len(reply) < 2 {
+		err = fmt.Errorf("bad reply from redis")
+		return
+	}
+	usage = new(Usage)
+	usage.Messages, err = redis.Int64(reply[0], nil)
+	if err != nil {
+		usage = nil
+		return
+	}
+	usage.Bytes, err = redis.Int64(reply[1], nil)
+	if err != nil {
+		usage = nil
+	}
+	return
+}
+
+func (self *redisStore) Usage(service, username string, day time.Time) (usage *Usage, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	reply, err := redis.Values(conn.Do("HMGET", redisUsageKey(service, username, day), "messages", "bytes"))
+	if err != nil {
+		return
+	}
+	usage = new(Usage)
+	if len(reply) < 2 {
+		return
+	}
+	if reply[0] != nil {
+		usage.Messages, err = redis.Int64(reply[0], nil)
+	}
+	if err == nil && reply[1] != nil {
+		usage.Bytes, err = redis.Int64(reply[1], nil)
+	}
+	if err != nil {
+		usage = nil
+	}
+	return
+}
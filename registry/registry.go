@@ -0,0 +1,64 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package registry keeps the factories of the plugins created by name
+// out of the configuration, like the transformers and the validators.
+package registry
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Factory creates a plugin out of its parameters.
+type Factory func(params map[string]string) (interface{}, error)
+
+// Registry is safe to use from several goroutines.
+type Registry struct {
+	kind      string
+	lock      sync.RWMutex
+	factories map[string]Factory
+}
+
+// New returns an empty registry of the plugins of a kind, e.g.
+// "transformer", which is named by the errors.
+func New(kind string) *Registry {
+	ret := new(Registry)
+	ret.kind = kind
+	ret.factories = make(map[string]Factory, 8)
+	return ret
+}
+
+// Register makes a plugin available by name. Registering a name again
+// replaces its factory.
+func (self *Registry) Register(name string, f Factory) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.factories[name] = f
+}
+
+// New creates the plugin registered with name.
+func (self *Registry) New(name string, params map[string]string) (p interface{}, err error) {
+	self.lock.RLock()
+	f, ok := self.factories[name]
+	self.lock.RUnlock()
+	if !ok {
+		err = fmt.Errorf("unknown %v: %v", self.kind, name)
+		return
+	}
+	return f(params)
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package registry
+
+import (
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := New("plugin")
+	if _, err := r.New("echo", nil); err == nil || err.Error() != "unknown plugin: echo" {
+		t.Errorf("should be unknown: %v", err)
+	}
+	r.Register("echo", func(params map[string]string) (interface{}, error) {
+		return params["value"], nil
+	})
+	p, err := r.New("echo", map[string]string{"value": "hello"})
+	if err != nil || p != "hello" {
+		t.Errorf("bad plugin: %v %v", p, err)
+	}
+	// Registering again replaces the factory.
+	r.Register("echo", func(params map[string]string) (interface{}, error) {
+		return "again", nil
+	})
+	if p, _ := r.New("echo", nil); p != "again" {
+		t.Errorf("the factory is not replaced: %v", p)
+	}
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package resource
+
+import (
+	"container/heap"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto"
+	"sync"
+	"time"
+)
+
+// cachedEntry is a message charged to the group.
+type cachedEntry struct {
+	key    string
+	size   int64
+	expiry time.Time
+
+	// The index in the heap, or -1 if the message never expires.
+	index int
+}
+
+type expiryHeap []*cachedEntry
+
+func (self expiryHeap) Len() int {
+	return len(self)
+}
+
+func (self expiryHeap) Less(i, j int) bool {
+	return self[i].expiry.Before(self[j].expiry)
+}
+
+func (self expiryHeap) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+	self[i].index = i
+	self[j].index = j
+}
+
+func (self *expiryHeap) Push(x interface{}) {
+	e := x.(*cachedEntry)
+	e.index = len(*self)
+	*self = append(*self, e)
+}
+
+func (self *expiryHeap) Pop() interface{} {
+	old := *self
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*self = old[:len(old)-1]
+	e.index = -1
+	return e
+}
+
+type limitedCache struct {
+	msgcache.Cache
+	group    *Group
+	lock     sync.Mutex
+	entries  map[string]*cachedEntry
+	expiries expiryHeap
+}
+
+type limitedCollectorCache struct {
+	*limitedCache
+	msgcache.DeadLetterCollector
+}
+
+// NewCache charges the size of every message cached through it to the
+// cache memory of the group, until the message expires or is deleted
+// through it. A message exceeding the limit is not cached, and the
+// error is ErrCacheFull. Only the messages cached by this node since
+// it started are counted, and the expired ones are released on the
+// next write.
+func NewCache(cache msgcache.Cache, group *Group) msgcache.Cache {
+	ret := &limitedCache{
+		Cache:   cache,
+		group:   group,
+		entries: make(map[string]*cachedEntry, 1024),
+	}
+	if collector, ok := cache.(msgcache.DeadLetterCollector); ok {
+		return &limitedCollectorCache{ret, collector}
+	}
+	return ret
+}
+
+// Ping pings the cache if it is a msgcache.Pinger.
+func (self *limitedCache) Ping() error {
+	if p, ok := self.Cache.(msgcache.Pinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+func entryKey(service, username, id string) string {
+	return service + "\n" + username + "\n" + id
+}
+
+func (self *limitedCache) CacheMessage(service, username string, mc *proto.MessageContainer, ttl time.Duration) (id string, err error) {
+	now := time.Now()
+	self.expire(now)
+	var size int64
+	if mc.Message != nil {
+		size = int64(mc.Message.Size())
+	}
+	err = self.group.AcquireCacheMemory(size)
+	if err != nil {
+		return
+	}
+	id, err = self.Cache.CacheMessage(service, username, mc, ttl)
+	if err != nil {
+		self.group.ReleaseCacheMemory(size)
+		return
+	}
+	self.charge(entryKey(service, username, id), size, now, ttl)
+	return
+}
+
+// CacheMessageOnce charges only the message which is cached, not the
+// duplicates.
+func (self *limitedCache) CacheMessageOnce(service, username string, mc *proto.MessageContainer, ttl time.Duration) (id string, dup bool, err error) {
+	now := time.Now()
+	self.expire(now)
+	var size int64
+	if mc.Message != nil {
+		size = int64(mc.Message.Size())
+	}
+	err = self.group.AcquireCacheMemory(size)
+	if err != nil {
+		return
+	}
+	id, dup, err = self.Cache.CacheMessageOnce(service, username, mc, ttl)
+	if err != nil || dup {
+		self.group.ReleaseCacheMemory(size)
+		return
+	}
+	self.charge(entryKey(service, username, id), size, now, ttl)
+	return
+}
+
+// charge records the memory acquired for a cached message.
+func (self *limitedCache) charge(key string, size int64, now time.Time, ttl time.Duration) {
+	entry := &cachedEntry{key: key, size: size, index: -1}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if old, ok := self.entries[entry.key]; ok {
+		// Cached again with the same id.
+		self.remove(old)
+	}
+	self.entries[entry.key] = entry
+	if ttl.Seconds() > 0.0 {
+		entry.expiry = now.Add(ttl)
+		heap.Push(&self.expiries, entry)
+	}
+}
+
+func (self *limitedCache) Del(service, username, id string) error {
+	err := self.Cache.Del(service, username, id)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if entry, ok := self.entries[entryKey(service, username, id)]; ok {
+		self.remove(entry)
+	}
+	return nil
+}
+
+// Replace charges the difference between the sizes of the messages.
+func (self *limitedCache) Replace(service, username, id string, msg *proto.Message) (ok bool, err error) {
+	var size int64
+	if msg != nil {
+		size = int64(msg.Size())
+	}
+	key := entryKey(service, username, id)
+	self.lock.Lock()
+	entry, charged := self.entries[key]
+	var old int64
+	if charged {
+		old = entry.size
+	}
+	self.lock.Unlock()
+	if !charged {
+		return self.Cache.Replace(service, username, id, msg)
+	}
+	if size > old {
+		err = self.group.AcquireCacheMemory(size - old)
+		if err != nil {
+			return
+		}
+	}
+	ok, err = self.Cache.Replace(service, username, id, msg)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err == nil && ok && self.entries[key] == entry {
+		entry.size = size
+		if size < old {
+			self.group.ReleaseCacheMemory(old - size)
+		}
+		return
+	}
+	// Not replaced, or released in the meantime.
+	if size > old {
+		self.group.ReleaseCacheMemory(size - old)
+	}
+	return
+}
+
+// remove should be called with the lock held.
+func (self *limitedCache) remove(entry *cachedEntry) {
+	delete(self.entries, entry.key)
+	if entry.index >= 0 {
+		heap.Remove(&self.expiries, entry.index)
+	}
+	self.group.ReleaseCacheMemory(entry.size)
+}
+
+func (self *limitedCache) expire(now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for len(self.expiries) > 0 && !self.expiries[0].expiry.After(now) {
+		self.remove(self.expiries[0])
+	}
+}
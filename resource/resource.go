@@ -0,0 +1,195 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package resource bounds what every service may hold on a node: its
+// connections, the goroutines spawned on its behalf, e.g. to call its
+// web hooks, and the memory of the messages it caches, so that a
+// misbehaving service cannot exhaust a node shared with others.
+package resource
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var ErrTooManyConns = errors.New("too many connections in the service")
+var ErrTooManyGoroutines = errors.New("too many goroutines in the service")
+var ErrCacheFull = errors.New("the service has cached too many bytes")
+
+// Limits of a group. Zero means no limit.
+type Limits struct {
+	MaxConns      int `json:"maxConns,omitempty"`
+	MaxGoroutines int `json:"maxGoroutines,omitempty"`
+
+	// MaxQueuedGoroutines is the number of functions which may wait
+	// for one of the MaxGoroutines to return. Zero means none waits.
+	MaxQueuedGoroutines int `json:"maxQueuedGoroutines,omitempty"`
+
+	// MaxCacheMemory is in bytes of cached messages.
+	MaxCacheMemory int64 `json:"maxCacheMemory,omitempty"`
+}
+
+// Usage tells what a group holds, and how many times each limit has
+// been hit.
+type Usage struct {
+	Conns       int64  `json:"conns"`
+	Goroutines  int64  `json:"goroutines"`
+	Queued      int    `json:"queued"`
+	CacheMemory int64  `json:"cacheMemory"`
+	Limits      Limits `json:"limits"`
+
+	RejectedConns       int64 `json:"rejectedConns"`
+	RejectedGoroutines  int64 `json:"rejectedGoroutines"`
+	RejectedCacheWrites int64 `json:"rejectedCacheWrites"`
+}
+
+// Group accounts the resources of a service on this node. It is
+// goroutine-safe.
+type Group struct {
+	// Accessed atomically. Keep them at the beginning
+	// to be 64-bit aligned.
+	conns               int64
+	goroutines          int64
+	cacheMemory         int64
+	rejectedConns       int64
+	rejectedGoroutines  int64
+	rejectedCacheWrites int64
+
+	limits Limits
+	queue  chan func()
+}
+
+func NewGroup(limits Limits) *Group {
+	ret := new(Group)
+	ret.limits = limits
+	if limits.MaxGoroutines > 0 && limits.MaxQueuedGoroutines > 0 {
+		ret.queue = make(chan func(), limits.MaxQueuedGoroutines)
+	}
+	return ret
+}
+
+func (self *Group) Limits() Limits {
+	return self.limits
+}
+
+// acquire adds n to the counter unless it exceeds max.
+func acquire(counter *int64, n, max int64) bool {
+	if max <= 0 {
+		atomic.AddInt64(counter, n)
+		return true
+	}
+	for {
+		cur := atomic.LoadInt64(counter)
+		if cur+n > max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(counter, cur, cur+n) {
+			return true
+		}
+	}
+}
+
+// AcquireConn fails with ErrTooManyConns if the group has too many
+// connections. Otherwise, the connection should be released once it
+// is closed.
+func (self *Group) AcquireConn() error {
+	if !acquire(&self.conns, 1, int64(self.limits.MaxConns)) {
+		atomic.AddInt64(&self.rejectedConns, 1)
+		return ErrTooManyConns
+	}
+	return nil
+}
+
+func (self *Group) ReleaseConn() {
+	atomic.AddInt64(&self.conns, -1)
+}
+
+// Go runs f in a goroutine. If the group already runs too many, f is
+// queued until one of them returns, or dropped with the error
+// ErrTooManyGoroutines if the queue is full.
+func (self *Group) Go(f func()) error {
+	max := int64(self.limits.MaxGoroutines)
+	if acquire(&self.goroutines, 1, max) {
+		go self.run(f)
+		return nil
+	}
+	select {
+	case self.queue <- f:
+	default:
+		atomic.AddInt64(&self.rejectedGoroutines, 1)
+		return ErrTooManyGoroutines
+	}
+	// The goroutines may have returned before f is queued.
+	self.runQueued()
+	return nil
+}
+
+// run runs f, then the queued functions, in the goroutine.
+func (self *Group) run(f func()) {
+	for f != nil {
+		f()
+		select {
+		case f = <-self.queue:
+		default:
+			f = nil
+		}
+	}
+	atomic.AddInt64(&self.goroutines, -1)
+	// A function may be queued before the counter is decreased.
+	self.runQueued()
+}
+
+// runQueued starts a goroutine running the queued functions, if there
+// are some and the group could run one more.
+func (self *Group) runQueued() {
+	if len(self.queue) == 0 || !acquire(&self.goroutines, 1, int64(self.limits.MaxGoroutines)) {
+		return
+	}
+	select {
+	case f := <-self.queue:
+		go self.run(f)
+	default:
+		atomic.AddInt64(&self.goroutines, -1)
+	}
+}
+
+// AcquireCacheMemory fails with ErrCacheFull if n more bytes would
+// exceed the limit.
+func (self *Group) AcquireCacheMemory(n int64) error {
+	if !acquire(&self.cacheMemory, n, self.limits.MaxCacheMemory) {
+		atomic.AddInt64(&self.rejectedCacheWrites, 1)
+		return ErrCacheFull
+	}
+	return nil
+}
+
+func (self *Group) ReleaseCacheMemory(n int64) {
+	atomic.AddInt64(&self.cacheMemory, -n)
+}
+
+func (self *Group) Usage() *Usage {
+	return &Usage{
+		Conns:               atomic.LoadInt64(&self.conns),
+		Goroutines:          atomic.LoadInt64(&self.goroutines),
+		Queued:              len(self.queue),
+		CacheMemory:         atomic.LoadInt64(&self.cacheMemory),
+		Limits:              self.limits,
+		RejectedConns:       atomic.LoadInt64(&self.rejectedConns),
+		RejectedGoroutines:  atomic.LoadInt64(&self.rejectedGoroutines),
+		RejectedCacheWrites: atomic.LoadInt64(&self.rejectedCacheWrites),
+	}
+}
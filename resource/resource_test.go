@@ -0,0 +1,234 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package resource
+
+import (
+	"fmt"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto"
+	"testing"
+	"time"
+)
+
+func TestConns(t *testing.T) {
+	g := NewGroup(Limits{MaxConns: 2})
+	for i := 0; i < 2; i++ {
+		if err := g.AcquireConn(); err != nil {
+			t.Fatalf("cannot acquire conn %v: %v", i, err)
+		}
+	}
+	if err := g.AcquireConn(); err != ErrTooManyConns {
+		t.Errorf("should reject the third conn: %v", err)
+	}
+	g.ReleaseConn()
+	if err := g.AcquireConn(); err != nil {
+		t.Errorf("cannot acquire a released conn: %v", err)
+	}
+	if u := g.Usage(); u.Conns != 2 || u.RejectedConns != 1 {
+		t.Errorf("bad usage: %+v", u)
+	}
+}
+
+func TestGo(t *testing.T) {
+	g := NewGroup(Limits{MaxGoroutines: 2})
+	block := make(chan bool)
+	done := make(chan bool)
+	for i := 0; i < 2; i++ {
+		err := g.Go(func() {
+			<-block
+			done <- true
+		})
+		if err != nil {
+			t.Fatalf("cannot run goroutine %v: %v", i, err)
+		}
+	}
+	if err := g.Go(func() {}); err != ErrTooManyGoroutines {
+		t.Errorf("should drop the third goroutine: %v", err)
+	}
+	if u := g.Usage(); u.Goroutines != 2 || u.RejectedGoroutines != 1 {
+		t.Errorf("bad usage: %+v", u)
+	}
+	close(block)
+	<-done
+	<-done
+	// The counter is decreased after f returns.
+	for i := 0; i < 100 && g.Usage().Goroutines != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if err := g.Go(func() {}); err != nil {
+		t.Errorf("cannot run a goroutine after the others returned: %v", err)
+	}
+}
+
+func TestGoQueued(t *testing.T) {
+	g := NewGroup(Limits{MaxGoroutines: 1, MaxQueuedGoroutines: 2})
+	block := make(chan bool)
+	done := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		i := i
+		err := g.Go(func() {
+			<-block
+			done <- i
+		})
+		if err != nil {
+			t.Fatalf("cannot run goroutine %v: %v", i, err)
+		}
+	}
+	if err := g.Go(func() {}); err != ErrTooManyGoroutines {
+		t.Errorf("should drop the fourth goroutine: %v", err)
+	}
+	if u := g.Usage(); u.Goroutines != 1 || u.Queued != 2 || u.RejectedGoroutines != 1 {
+		t.Errorf("bad usage: %+v", u)
+	}
+	close(block)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("the queued goroutines are not run")
+		}
+	}
+	for i := 0; i < 100 && g.Usage().Goroutines != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if u := g.Usage(); u.Goroutines != 0 || u.Queued != 0 {
+		t.Errorf("bad usage: %+v", u)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	g := NewGroup(Limits{})
+	for i := 0; i < 1000; i++ {
+		if err := g.AcquireConn(); err != nil {
+			t.Fatalf("unlimited group rejects a conn: %v", err)
+		}
+		if err := g.AcquireCacheMemory(1 << 20); err != nil {
+			t.Fatalf("unlimited group rejects cache memory: %v", err)
+		}
+	}
+	if u := g.Usage(); u.Conns != 1000 || u.CacheMemory != 1000<<20 {
+		t.Errorf("bad usage: %+v", u)
+	}
+}
+
+type fakeCache struct {
+	msgcache.Cache
+	n    int
+	msgs map[string]*proto.MessageContainer
+}
+
+func (self *fakeCache) CacheMessage(service, username string, mc *proto.MessageContainer, ttl time.Duration) (id string, err error) {
+	self.n++
+	id = fmt.Sprintf("%v", self.n)
+	mc.Id = id
+	self.msgs[id] = mc
+	return
+}
+
+func (self *fakeCache) Del(service, username, id string) error {
+	delete(self.msgs, id)
+	return nil
+}
+
+func (self *fakeCache) Replace(service, username, id string, msg *proto.Message) (ok bool, err error) {
+	if mc, found := self.msgs[id]; found {
+		mc.Message = msg
+		ok = true
+	}
+	return
+}
+
+func message(size int) *proto.MessageContainer {
+	return &proto.MessageContainer{Message: &proto.Message{Body: make([]byte, size)}}
+}
+
+func TestCache(t *testing.T) {
+	size := int64(message(100).Message.Size())
+	g := NewGroup(Limits{MaxCacheMemory: 3 * size})
+	cache := NewCache(&fakeCache{msgs: make(map[string]*proto.MessageContainer)}, g)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := cache.CacheMessage("service", "alice", message(100), 0)
+		if err != nil {
+			t.Fatalf("cannot cache message %v: %v", i, err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := cache.CacheMessage("service", "alice", message(100), 0); err != ErrCacheFull {
+		t.Errorf("should reject the fourth message: %v", err)
+	}
+	if u := g.Usage(); u.CacheMemory != 3*size || u.RejectedCacheWrites != 1 {
+		t.Errorf("bad usage: %+v", u)
+	}
+	cache.Del("service", "alice", ids[0])
+	if u := g.Usage(); u.CacheMemory != 2*size {
+		t.Errorf("deleted message is still charged: %+v", u)
+	}
+	if _, err := cache.CacheMessage("service", "alice", message(100), 0); err != nil {
+		t.Errorf("cannot cache after a deletion: %v", err)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	size := int64(message(100).Message.Size())
+	g := NewGroup(Limits{MaxCacheMemory: 2 * size})
+	cache := NewCache(&fakeCache{msgs: make(map[string]*proto.MessageContainer)}, g)
+	if _, err := cache.CacheMessage("service", "alice", message(100), 100*time.Millisecond); err != nil {
+		t.Fatalf("cannot cache: %v", err)
+	}
+	if _, err := cache.CacheMessage("service", "alice", message(100), 0); err != nil {
+		t.Fatalf("cannot cache: %v", err)
+	}
+	if _, err := cache.CacheMessage("service", "alice", message(100), 0); err != ErrCacheFull {
+		t.Errorf("should reject the third message: %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	// The expired message is released by the next write.
+	if _, err := cache.CacheMessage("service", "alice", message(100), 0); err != nil {
+		t.Errorf("cannot cache after an expiry: %v", err)
+	}
+	if u := g.Usage(); u.CacheMemory != 2*size {
+		t.Errorf("bad usage: %+v", u)
+	}
+}
+
+func TestCacheReplace(t *testing.T) {
+	size := int64(message(100).Message.Size())
+	g := NewGroup(Limits{MaxCacheMemory: 3 * size})
+	cache := NewCache(&fakeCache{msgs: make(map[string]*proto.MessageContainer)}, g)
+	id, err := cache.CacheMessage("service", "alice", message(100), 0)
+	if err != nil {
+		t.Fatalf("cannot cache: %v", err)
+	}
+	if _, err := cache.Replace("service", "alice", id, message(1000).Message); err != ErrCacheFull {
+		t.Errorf("should reject the larger message: %v", err)
+	}
+	bigger := message(100 + int(size))
+	if ok, err := cache.Replace("service", "alice", id, bigger.Message); err != nil || !ok {
+		t.Fatalf("cannot replace: %v %v", ok, err)
+	}
+	if u := g.Usage(); u.CacheMemory != int64(bigger.Message.Size()) {
+		t.Errorf("bad usage: %+v", u)
+	}
+	if ok, err := cache.Replace("service", "alice", id, nil); err != nil || !ok {
+		t.Fatalf("cannot replace: %v %v", ok, err)
+	}
+	if u := g.Usage(); u.CacheMemory != 0 {
+		t.Errorf("bad usage: %+v", u)
+	}
+}
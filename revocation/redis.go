@@ -0,0 +1,83 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package revocation
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/redispool"
+)
+
+type redisStore struct {
+	pool *redis.Pool
+}
+
+// NewRedisStore keeps the revocations in redis. The hashes of the
+// revoked tokens of a user are kept in a set.
+func NewRedisStore(addr, password string, db int) Store {
+	pool := redispool.New(addr, password, db)
+
+	ret := new(redisStore)
+	ret.pool = pool
+	return ret
+}
+
+func revokedUserKey(service, username string) string {
+	return fmt.Sprintf("revocation:user:%v:%v", service, username)
+}
+
+func revokedTokensKey(service, username string) string {
+	return fmt.Sprintf("revocation:tokens:%v:%v", service, username)
+}
+
+func (self *redisStore) Revoke(service, username, token string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	var err error
+	if len(token) == 0 {
+		_, err = conn.Do("SET", revokedUserKey(service, username), "1")
+	} else {
+		_, err = conn.Do("SADD", revokedTokensKey(service, username), tokenHash(token))
+	}
+	return err
+}
+
+func (self *redisStore) Unrevoke(service, username string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", revokedUserKey(service, username), revokedTokensKey(service, username))
+	return err
+}
+
+func (self *redisStore) IsRevoked(service, username, token string) (bool, error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	revoked, err := redis.Bool(conn.Do("EXISTS", revokedUserKey(service, username)))
+	if err != nil || revoked {
+		return revoked, err
+	}
+	return redis.Bool(conn.Do("SISMEMBER", revokedTokensKey(service, username), tokenHash(token)))
+}
+
+// Ping tells whether redis could be reached.
+func (self *redisStore) Ping() error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
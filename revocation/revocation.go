@@ -0,0 +1,100 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package revocation keeps the tokens, and the users, which should no
+// longer be accepted by the server. All nodes of a cluster should share
+// the same store so that a revoked token is rejected by every node.
+package revocation
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+)
+
+type Store interface {
+	// Revoke() rejects the token of the user from now on. An empty
+	// token rejects all tokens of the user.
+	Revoke(service, username, token string) error
+
+	// Unrevoke() accepts the user and all of its tokens again.
+	Unrevoke(service, username string) error
+
+	IsRevoked(service, username, token string) (bool, error)
+}
+
+// Tokens are never stored as they are.
+func tokenHash(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+type memStore struct {
+	lock  sync.RWMutex
+	users map[string]bool
+	// (service, username) -> set of token hashes
+	tokens map[string]map[string]bool
+}
+
+// NewMemoryStore returns a Store which keeps the revoked users and
+// tokens in memory. The revocations are lost when the process exits,
+// and are not seen by the other nodes.
+func NewMemoryStore() Store {
+	ret := new(memStore)
+	ret.users = make(map[string]bool, 16)
+	ret.tokens = make(map[string]map[string]bool, 16)
+	return ret
+}
+
+func userKey(service, username string) string {
+	return service + "\n" + username
+}
+
+func (self *memStore) Revoke(service, username, token string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := userKey(service, username)
+	if len(token) == 0 {
+		self.users[key] = true
+		return nil
+	}
+	tokens, ok := self.tokens[key]
+	if !ok {
+		tokens = make(map[string]bool, 2)
+		self.tokens[key] = tokens
+	}
+	tokens[tokenHash(token)] = true
+	return nil
+}
+
+func (self *memStore) Unrevoke(service, username string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := userKey(service, username)
+	delete(self.users, key)
+	delete(self.tokens, key)
+	return nil
+}
+
+func (self *memStore) IsRevoked(service, username, token string) (bool, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	key := userKey(service, username)
+	if self.users[key] {
+		return true, nil
+	}
+	return self.tokens[key][tokenHash(token)], nil
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package revocation
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+func getRedisStore() Store {
+	db := 4
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	c.Do("SELECT", db)
+	c.Do("FLUSHDB")
+	c.Close()
+	return NewRedisStore("", "", db)
+}
+
+func testStore(store Store, t *testing.T) {
+	check := func(username, token string, expected bool) {
+		revoked, err := store.IsRevoked("srv", username, token)
+		if err != nil || revoked != expected {
+			t.Errorf("%v/%v: expected %v; got %v (%v)", username, token, expected, revoked, err)
+		}
+	}
+	check("alice", "token", false)
+	if err := store.Revoke("srv", "alice", "token"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	check("alice", "token", true)
+	check("alice", "other", false)
+	check("bob", "token", false)
+
+	if err := store.Revoke("srv", "bob", ""); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	check("bob", "any", true)
+
+	for _, usr := range []string{"alice", "bob"} {
+		if err := store.Unrevoke("srv", usr); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		check(usr, "token", false)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(NewMemoryStore(), t)
+}
+
+func TestRedisStore(t *testing.T) {
+	testStore(getRedisStore(), t)
+}
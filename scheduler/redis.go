@@ -0,0 +1,145 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/redispool"
+	"time"
+)
+
+// The ids of the campaigns are kept in a sorted set, scored by their
+// send time in milliseconds. Each campaign is kept as a JSON string.
+const campaignSetKey = "campaigns"
+
+type redisStore struct {
+	pool *redis.Pool
+}
+
+// NewRedisStore keeps the campaigns in redis, so that they survive
+// a restart and can be shared by the nodes of a cluster.
+func NewRedisStore(addr, password string, db int) Store {
+	pool := redispool.New(addr, password, db)
+
+	ret := new(redisStore)
+	ret.pool = pool
+	return ret
+}
+
+func campaignKey(id string) string {
+	return fmt.Sprintf("campaign:%v", id)
+}
+
+func sendAtScore(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (self *redisStore) Add(c *Campaign) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("SET", campaignKey(c.Id), data)
+	conn.Send("ZADD", campaignSetKey, sendAtScore(c.SendAt), c.Id)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (self *redisStore) get(conn redis.Conn, id string) (c *Campaign, err error) {
+	data, err := redis.Bytes(conn.Do("GET", campaignKey(id)))
+	if err != nil {
+		if err == redis.ErrNil {
+			err = nil
+		}
+		return
+	}
+	c = new(Campaign)
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		c = nil
+	}
+	return
+}
+
+func (self *redisStore) Due(now time.Time, max int) (campaigns []*Campaign, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", campaignSetKey, "-inf", sendAtScore(now), "LIMIT", 0, max))
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		// Only the one who removes the id sends the campaign.
+		var n int
+		n, err = redis.Int(conn.Do("ZREM", campaignSetKey, id))
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		var c *Campaign
+		c, err = self.get(conn, id)
+		if err != nil {
+			return
+		}
+		conn.Do("DEL", campaignKey(id))
+		if c != nil {
+			campaigns = append(campaigns, c)
+		}
+	}
+	return
+}
+
+func (self *redisStore) Cancel(id string) (found bool, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	n, err := redis.Int(conn.Do("ZREM", campaignSetKey, id))
+	if err != nil {
+		return
+	}
+	found = n > 0
+	_, err = conn.Do("DEL", campaignKey(id))
+	return
+}
+
+func (self *redisStore) Pending() (campaigns []*Campaign, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", campaignSetKey, "-inf", "+inf"))
+	if err != nil {
+		return
+	}
+	campaigns = make([]*Campaign, 0, len(ids))
+	for _, id := range ids {
+		var c *Campaign
+		c, err = self.get(conn, id)
+		if err != nil {
+			return
+		}
+		if c != nil {
+			campaigns = append(campaigns, c)
+		}
+	}
+	return
+}
@@ -0,0 +1,330 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package scheduler sends messages, e.g. announcements, to a set of
+// users at a given time.
+//
+// A campaign is sent to the listed users of a service, or of several
+// services if the service is a pattern accepted by
+// msgcenter.MatchService. A campaign without users is sent to every
+// known user of the services when it is due: the users connected to
+// the node and, if the center is a Directory, the users it knows of,
+// e.g. the subscribers of the services. A query narrows them down to
+// the usernames matching a pattern. In a cluster, the nodes may share
+// the store; a campaign is then sent once by one of them, and a
+// campaign without users only reaches the connected users of that
+// node, besides the ones of the directory. With SetFeed, the node hands the campaigns
+// over to the delivery-only nodes of the cluster, so that their fan-out
+// does not slow the interactive nodes down.
+//
+// Campaigns are cached with their TTL like any other message, so
+// that offline users receive them when they connect.
+//
+// The scheduler also keeps the messages forwarded by the users who ask
+// for a later delivery, as campaigns to the receiver from the sender.
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"math/rand"
+	"path"
+	"sync"
+	"time"
+)
+
+var ErrNoService = errors.New("no service")
+var ErrEmptyMessage = errors.New("empty message")
+var ErrBadQuery = errors.New("bad query")
+
+// BATCH_SIZE is the maximum number of due campaigns taken from the
+// store at a time.
+const BATCH_SIZE = 16
+
+type Campaign struct {
+	Id      string `json:"id"`
+	Service string `json:"service"`
+
+	// Usernames are the receivers. If it is empty, the campaign is
+	// sent to every known user of the services.
+	Usernames []string `json:"usernames,omitempty"`
+
+	// Query, if not empty, only keeps the receivers whose username
+	// matches it. The syntax is the one of path.Match, so "vip-*"
+	// matches "vip-alice".
+	Query string `json:"query,omitempty"`
+
+	Message *proto.Message    `json:"message"`
+	Extra   map[string]string `json:"extra,omitempty"`
+	TTL     time.Duration     `json:"ttl"`
+	SendAt  time.Time         `json:"sendAt"`
+
+	// Sender and SenderService are set if the message is forwarded
+	// by a user.
+	Sender        string `json:"sender,omitempty"`
+	SenderService string `json:"senderService,omitempty"`
+}
+
+// Report tells how a campaign was sent. A receiver is counted as
+// delivered if any of its connections received the message, and as
+// cached if it was offline and the message is cached for it.
+type Report struct {
+	Campaign    *Campaign `json:"campaign"`
+	NrDelivered int       `json:"nrDelivered"`
+	NrCached    int       `json:"nrCached"`
+	NrDropped   int       `json:"nrDropped"`
+}
+
+// Center is implemented by msgcenter.MessageCenter.
+type Center interface {
+	AllServices() []string
+	ConnectedUsers(service string) []string
+	DeliverMessage(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) (res []*msgcenter.Result, err error)
+	DeliverForward(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) (res []*msgcenter.Result, err error)
+}
+
+// Directory is implemented by msgcenter.MessageCenter. If the
+// center is a Directory, a campaign without users is sent to the
+// users it knows of as well as to the connected ones, so that the
+// offline ones get it from the cache.
+type Directory interface {
+	KnownUsers(service string) (usernames []string, err error)
+}
+
+// Feed is implemented by msgcenter.MessageCenter.
+type Feed interface {
+	SendToFeed(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) (res []*msgcenter.Result, err error)
+}
+
+type Scheduler struct {
+	center   Center
+	feed     Feed
+	store    Store
+	logger   logger.Logger
+	reportFn func(r *Report)
+	stop     chan bool
+	stopOnce sync.Once
+}
+
+func NewScheduler(center Center, store Store) *Scheduler {
+	ret := new(Scheduler)
+	ret.center = center
+	ret.store = store
+	ret.logger = logger.Nop()
+	ret.stop = make(chan bool)
+	return ret
+}
+
+func (self *Scheduler) SetLogger(l logger.Logger) {
+	self.logger = logger.OrNop(l)
+}
+
+// SetReportHandler lets fn know about every campaign sent. It
+// should be called before Run().
+func (self *Scheduler) SetReportHandler(fn func(r *Report)) {
+	self.reportFn = fn
+}
+
+// SetFeed hands the campaigns to the delivery-only nodes of the
+// cluster instead of sending them from this node. It should be
+// called before Run().
+func (self *Scheduler) SetFeed(feed Feed) {
+	self.feed = feed
+}
+
+func newCampaignId() string {
+	return fmt.Sprintf("%x-%x", time.Now().UnixNano(), rand.Int63())
+}
+
+// Schedule stores the campaign and returns its id. A campaign whose
+// send time has passed is sent as soon as possible.
+func (self *Scheduler) Schedule(c *Campaign) (id string, err error) {
+	if len(c.Service) == 0 {
+		err = ErrNoService
+		return
+	}
+	if c.Message == nil || c.Message.IsEmpty() {
+		err = ErrEmptyMessage
+		return
+	}
+	if _, e := path.Match(c.Query, ""); e != nil {
+		err = ErrBadQuery
+		return
+	}
+	if len(c.Id) == 0 {
+		c.Id = newCampaignId()
+	}
+	err = self.store.Add(c)
+	if err != nil {
+		return
+	}
+	id = c.Id
+	return
+}
+
+// ScheduleForward keeps the forwarded message until fwdreq.DeliverAt.
+// It implements msgcenter.ForwardScheduler.
+func (self *Scheduler) ScheduleForward(fwdreq *server.ForwardRequest, extra map[string]string) (id string, err error) {
+	mc := &fwdreq.MessageContainer
+	c := &Campaign{
+		Service:       fwdreq.ReceiverService,
+		Usernames:     []string{fwdreq.Receiver},
+		Message:       mc.Message,
+		Extra:         extra,
+		TTL:           fwdreq.TTL,
+		SendAt:        fwdreq.DeliverAt,
+		Sender:        mc.Sender,
+		SenderService: mc.SenderService,
+	}
+	return self.Schedule(c)
+}
+
+// Cancel removes a campaign which has not been sent.
+func (self *Scheduler) Cancel(id string) (found bool, err error) {
+	return self.store.Cancel(id)
+}
+
+func (self *Scheduler) Pending() (campaigns []*Campaign, err error) {
+	return self.store.Pending()
+}
+
+// Run sends the due campaigns every interval until Stop() is called.
+func (self *Scheduler) Run(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case now := <-ticker.C:
+			self.sendDue(now)
+		}
+	}
+}
+
+func (self *Scheduler) Stop() {
+	self.stopOnce.Do(func() {
+		close(self.stop)
+	})
+}
+
+func (self *Scheduler) sendDue(now time.Time) {
+	for {
+		campaigns, err := self.store.Due(now, BATCH_SIZE)
+		if err != nil {
+			self.logger.Error("cannot read due campaigns", "err", err)
+			return
+		}
+		for _, c := range campaigns {
+			r := self.send(c)
+			self.logger.Info("campaign sent", "id", c.Id, "service", c.Service,
+				"delivered", r.NrDelivered, "cached", r.NrCached, "dropped", r.NrDropped)
+			if self.reportFn != nil {
+				self.reportFn(r)
+			}
+		}
+		if len(campaigns) < BATCH_SIZE {
+			return
+		}
+	}
+}
+
+func (self *Scheduler) services(c *Campaign) []string {
+	if !msgcenter.IsServicePattern(c.Service) {
+		return []string{c.Service}
+	}
+	all := self.center.AllServices()
+	ret := make([]string, 0, len(all))
+	for _, srv := range all {
+		if msgcenter.MatchService(c.Service, srv) {
+			ret = append(ret, srv)
+		}
+	}
+	return ret
+}
+
+// receivers returns the users of the service the campaign is sent
+// to, each once.
+func (self *Scheduler) receivers(c *Campaign, srv string) []string {
+	usernames := c.Usernames
+	if len(usernames) == 0 {
+		usernames = self.center.ConnectedUsers(srv)
+		if dir, ok := self.center.(Directory); ok {
+			known, err := dir.KnownUsers(srv)
+			if err != nil {
+				self.logger.Error("cannot read the known users", "id", c.Id, "service", srv, "err", err)
+			}
+			usernames = append(usernames, known...)
+		}
+	}
+	seen := make(map[string]bool, len(usernames))
+	ret := make([]string, 0, len(usernames))
+	for _, usr := range usernames {
+		if seen[usr] {
+			continue
+		}
+		seen[usr] = true
+		if len(c.Query) > 0 {
+			if matched, _ := path.Match(c.Query, usr); !matched {
+				continue
+			}
+		}
+		ret = append(ret, usr)
+	}
+	return ret
+}
+
+func (self *Scheduler) send(c *Campaign) *Report {
+	r := &Report{Campaign: c}
+	for _, srv := range self.services(c) {
+		for _, usr := range self.receivers(c, srv) {
+			mc := &proto.MessageContainer{
+				Message:       c.Message,
+				Sender:        c.Sender,
+				SenderService: c.SenderService,
+			}
+			var res []*msgcenter.Result
+			var err error
+			if self.feed != nil {
+				res, err = self.feed.SendToFeed(srv, usr, mc, c.Extra, c.TTL)
+			} else if mc.FromUser() {
+				res, err = self.center.DeliverForward(srv, usr, mc, c.Extra, c.TTL)
+			} else {
+				res, err = self.center.DeliverMessage(srv, usr, mc, c.Extra, c.TTL)
+			}
+			if err != nil {
+				self.logger.Debug("cannot send campaign", "id", c.Id, "service", srv, "username", usr, "err", err)
+			}
+			switch msgcenter.DeliveryStatus(mc, res) {
+			case msgcenter.STATUS_DELIVERED:
+				r.NrDelivered++
+			case msgcenter.STATUS_CACHED:
+				r.NrCached++
+			default:
+				r.NrDropped++
+			}
+		}
+	}
+	return r
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package scheduler
+
+import (
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCenter delivers to the connected users and caches for the
+// others of "srv.cached".
+type fakeCenter struct {
+	lock      sync.Mutex
+	connected map[string][]string
+	received  map[string]int
+	forwarded []*proto.MessageContainer
+}
+
+func newFakeCenter() *fakeCenter {
+	ret := new(fakeCenter)
+	ret.connected = map[string][]string{
+		"srv.a":      []string{"alice", "bob"},
+		"srv.cached": []string{"carol"},
+		"other":      []string{"eve"},
+	}
+	ret.received = make(map[string]int)
+	return ret
+}
+
+func (self *fakeCenter) AllServices() []string {
+	return []string{"srv.a", "srv.cached", "other"}
+}
+
+func (self *fakeCenter) ConnectedUsers(service string) []string {
+	return self.connected[service]
+}
+
+func (self *fakeCenter) DeliverMessage(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) (res []*msgcenter.Result, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.received[service+":"+username]++
+	for _, usr := range self.connected[service] {
+		if usr == username {
+			res = []*msgcenter.Result{&msgcenter.Result{ConnId: "1", Visible: true}}
+			return
+		}
+	}
+	if service == "srv.cached" {
+		mc.Id = "cached"
+	}
+	return
+}
+
+func (self *fakeCenter) DeliverForward(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) (res []*msgcenter.Result, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.forwarded = append(self.forwarded, mc)
+	res = []*msgcenter.Result{&msgcenter.Result{ConnId: "1", Visible: true}}
+	return
+}
+
+func TestScheduleCampaigns(t *testing.T) {
+	center := newFakeCenter()
+	sched := NewScheduler(center, NewMemoryStore())
+	reports := make(chan *Report, 10)
+	sched.SetReportHandler(func(r *Report) {
+		reports <- r
+	})
+	msg := &proto.Message{Header: map[string]string{"title": "hello"}}
+	_, err := sched.Schedule(&Campaign{Service: "srv.*", Message: msg, SendAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	_, err = sched.Schedule(&Campaign{Service: "srv.cached", Usernames: []string{"carol", "dave"}, Message: msg, SendAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	later, err := sched.Schedule(&Campaign{Service: "other", Message: msg, SendAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := sched.Schedule(&Campaign{Service: "other", SendAt: time.Now()}); err != ErrEmptyMessage {
+		t.Errorf("should reject an empty message: %v", err)
+	}
+
+	go sched.Run(10 * time.Millisecond)
+	defer sched.Stop()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-reports:
+			switch r.Campaign.Service {
+			case "srv.*":
+				if r.NrDelivered != 3 || r.NrCached != 0 || r.NrDropped != 0 {
+					t.Errorf("bad report: %+v", r)
+				}
+			case "srv.cached":
+				if r.NrDelivered != 1 || r.NrCached != 1 || r.NrDropped != 0 {
+					t.Errorf("bad report: %+v", r)
+				}
+			default:
+				t.Errorf("should not be sent: %+v", r.Campaign)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("campaigns are not sent")
+		}
+	}
+	center.lock.Lock()
+	if center.received["other:eve"] != 0 || center.received["srv.cached:carol"] != 2 {
+		t.Errorf("bad receivers: %v", center.received)
+	}
+	center.lock.Unlock()
+
+	pending, err := sched.Pending()
+	if err != nil || len(pending) != 1 || pending[0].Id != later {
+		t.Errorf("bad pending campaigns: %v", err)
+	}
+	found, err := sched.Cancel(later)
+	if err != nil || !found {
+		t.Errorf("cannot cancel: %v", err)
+	}
+}
+
+func TestScheduleForward(t *testing.T) {
+	center := newFakeCenter()
+	sched := NewScheduler(center, NewMemoryStore())
+	reports := make(chan *Report, 10)
+	sched.SetReportHandler(func(r *Report) {
+		reports <- r
+	})
+	fwdreq := &server.ForwardRequest{
+		Receiver:        "dave",
+		ReceiverService: "srv.a",
+		TTL:             time.Hour,
+		DeliverAt:       time.Now().Add(50 * time.Millisecond),
+	}
+	fwdreq.MessageContainer.Sender = "bob"
+	fwdreq.MessageContainer.SenderService = "other"
+	fwdreq.MessageContainer.Message = &proto.Message{Body: []byte("later")}
+	id, err := sched.ScheduleForward(fwdreq, nil)
+	if err != nil || len(id) == 0 {
+		t.Fatalf("Error: %v", err)
+	}
+
+	go sched.Run(10 * time.Millisecond)
+	defer sched.Stop()
+	select {
+	case r := <-reports:
+		if r.Campaign.Id != id || r.NrDelivered != 1 {
+			t.Errorf("bad report: %+v", r)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the forward is not sent")
+	}
+	center.lock.Lock()
+	defer center.lock.Unlock()
+	if len(center.forwarded) != 1 || center.forwarded[0].Sender != "bob" || center.forwarded[0].SenderService != "other" {
+		t.Errorf("bad forwards: %v", center.forwarded)
+	}
+	if len(center.received) != 0 {
+		t.Errorf("the forward is sent from the server: %v", center.received)
+	}
+}
+
+// directoryCenter knows of offline users of "srv.cached" as well.
+type directoryCenter struct {
+	*fakeCenter
+}
+
+func (self directoryCenter) KnownUsers(service string) ([]string, error) {
+	if service == "srv.cached" {
+		return []string{"carol", "vip-dave", "frank"}, nil
+	}
+	return nil, nil
+}
+
+func TestScheduleToKnownUsers(t *testing.T) {
+	center := directoryCenter{newFakeCenter()}
+	sched := NewScheduler(center, NewMemoryStore())
+	reports := make(chan *Report, 10)
+	sched.SetReportHandler(func(r *Report) {
+		reports <- r
+	})
+	msg := &proto.Message{Header: map[string]string{"title": "hello"}}
+	if _, err := sched.Schedule(&Campaign{Service: "srv.cached", Query: "[", Message: msg}); err != ErrBadQuery {
+		t.Errorf("should reject a bad query: %v", err)
+	}
+	_, err := sched.Schedule(&Campaign{Service: "srv.cached", Message: msg, SendAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	_, err = sched.Schedule(&Campaign{Service: "srv.*", Query: "vip-*", Message: msg, SendAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	go sched.Run(10 * time.Millisecond)
+	defer sched.Stop()
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-reports:
+			if len(r.Campaign.Query) == 0 {
+				// carol is connected and known; vip-dave and frank are cached.
+				if r.NrDelivered != 1 || r.NrCached != 2 || r.NrDropped != 0 {
+					t.Errorf("bad report: %+v", r)
+				}
+			} else if r.NrDelivered != 0 || r.NrCached != 1 || r.NrDropped != 0 {
+				t.Errorf("bad report of the query: %+v", r)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("campaigns are not sent")
+		}
+	}
+	center.lock.Lock()
+	defer center.lock.Unlock()
+	if center.received["srv.cached:carol"] != 1 || center.received["srv.cached:vip-dave"] != 2 ||
+		center.received["srv.a:alice"] != 0 {
+		t.Errorf("bad receivers: %v", center.received)
+	}
+}
+
+// fakeFeed hands the messages to another center, as a delivery-only
+// node would.
+type fakeFeed struct {
+	node *fakeCenter
+}
+
+func (self *fakeFeed) SendToFeed(service, username string, mc *proto.MessageContainer, extra map[string]string, ttl time.Duration) (res []*msgcenter.Result, err error) {
+	if mc.FromUser() {
+		return self.node.DeliverForward(service, username, mc, extra, ttl)
+	}
+	return self.node.DeliverMessage(service, username, mc, extra, ttl)
+}
+
+func TestScheduleToFeed(t *testing.T) {
+	center := newFakeCenter()
+	node := newFakeCenter()
+	sched := NewScheduler(center, NewMemoryStore())
+	sched.SetFeed(&fakeFeed{node})
+	reports := make(chan *Report, 10)
+	sched.SetReportHandler(func(r *Report) {
+		reports <- r
+	})
+	msg := &proto.Message{Header: map[string]string{"title": "hello"}}
+	_, err := sched.Schedule(&Campaign{Service: "srv.cached", Usernames: []string{"carol", "dave"}, Message: msg, SendAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	go sched.Run(10 * time.Millisecond)
+	defer sched.Stop()
+	select {
+	case r := <-reports:
+		if r.NrDelivered != 1 || r.NrCached != 1 || r.NrDropped != 0 {
+			t.Errorf("bad report: %+v", r)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the campaign is not sent")
+	}
+	center.lock.Lock()
+	defer center.lock.Unlock()
+	if len(center.received) != 0 {
+		t.Errorf("the campaign is sent from this node: %v", center.received)
+	}
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if node.received["srv.cached:carol"] != 1 || node.received["srv.cached:dave"] != 1 {
+		t.Errorf("bad receivers: %v", node.received)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package scheduler
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store keeps the campaigns until they are due.
+type Store interface {
+	Add(c *Campaign) error
+
+	// Due removes and returns at most max campaigns whose send time
+	// is not after now, the earliest first. A campaign is returned
+	// by only one of the concurrent calls.
+	Due(now time.Time, max int) (campaigns []*Campaign, err error)
+
+	// Cancel removes the campaign. found is false if it has been
+	// sent or has never been added.
+	Cancel(id string) (found bool, err error)
+
+	// Pending returns the campaigns not sent yet, the earliest first.
+	Pending() (campaigns []*Campaign, err error)
+}
+
+type bySendAt []*Campaign
+
+func (self bySendAt) Len() int           { return len(self) }
+func (self bySendAt) Less(i, j int) bool { return self[i].SendAt.Before(self[j].SendAt) }
+func (self bySendAt) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+type memStore struct {
+	lock      sync.Mutex
+	campaigns map[string]*Campaign
+}
+
+// NewMemoryStore returns a Store which keeps the campaigns in memory.
+// The campaigns not sent yet are lost when the process exits.
+func NewMemoryStore() Store {
+	ret := new(memStore)
+	ret.campaigns = make(map[string]*Campaign, 16)
+	return ret
+}
+
+func (self *memStore) Add(c *Campaign) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.campaigns[c.Id] = c
+	return nil
+}
+
+func (self *memStore) sorted() []*Campaign {
+	ret := make([]*Campaign, 0, len(self.campaigns))
+	for _, c := range self.campaigns {
+		ret = append(ret, c)
+	}
+	sort.Sort(bySendAt(ret))
+	return ret
+}
+
+func (self *memStore) Due(now time.Time, max int) (campaigns []*Campaign, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, c := range self.sorted() {
+		if len(campaigns) >= max || c.SendAt.After(now) {
+			break
+		}
+		delete(self.campaigns, c.Id)
+		campaigns = append(campaigns, c)
+	}
+	return
+}
+
+func (self *memStore) Cancel(id string) (found bool, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, found = self.campaigns[id]
+	delete(self.campaigns, id)
+	return
+}
+
+func (self *memStore) Pending() (campaigns []*Campaign, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	campaigns = self.sorted()
+	return
+}
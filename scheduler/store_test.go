@@ -0,0 +1,109 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package scheduler
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/proto"
+	"testing"
+	"time"
+)
+
+func getRedisStore() Store {
+	db := 8
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	c.Do("SELECT", db)
+	c.Do("FLUSHDB")
+	c.Close()
+	return NewRedisStore("", "", db)
+}
+
+func campaignAt(id string, t time.Time) *Campaign {
+	return &Campaign{
+		Id:      id,
+		Service: "srv",
+		Message: &proto.Message{Body: []byte(id)},
+		TTL:     time.Hour,
+		SendAt:  t,
+	}
+}
+
+func campaignIds(campaigns []*Campaign) []string {
+	ret := make([]string, len(campaigns))
+	for i, c := range campaigns {
+		ret[i] = c.Id
+	}
+	return ret
+}
+
+func testStore(store Store, t *testing.T) {
+	now := time.Now()
+	for _, c := range []*Campaign{
+		campaignAt("later", now.Add(time.Hour)),
+		campaignAt("second", now.Add(-time.Minute)),
+		campaignAt("first", now.Add(-time.Hour)),
+		campaignAt("third", now.Add(-time.Second)),
+	} {
+		if err := store.Add(c); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	pending, err := store.Pending()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if ids := campaignIds(pending); len(ids) != 4 || ids[0] != "first" || ids[3] != "later" {
+		t.Errorf("bad pending campaigns: %v", ids)
+	}
+
+	due, err := store.Due(now, 2)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if ids := campaignIds(due); len(ids) != 2 || ids[0] != "first" || ids[1] != "second" {
+		t.Errorf("bad due campaigns: %v", ids)
+	}
+	if string(due[0].Message.Body) != "first" || due[0].TTL != time.Hour || !due[0].SendAt.Equal(now.Add(-time.Hour)) {
+		t.Errorf("bad campaign: %+v", due[0])
+	}
+
+	found, err := store.Cancel("third")
+	if err != nil || !found {
+		t.Errorf("cannot cancel: %v", err)
+	}
+	found, err = store.Cancel("first")
+	if err != nil || found {
+		t.Errorf("a sent campaign is cancelled: %v", err)
+	}
+	due, err = store.Due(now, 2)
+	if err != nil || len(due) != 0 {
+		t.Errorf("nothing should be due: %v %v", campaignIds(due), err)
+	}
+	due, err = store.Due(now.Add(2*time.Hour), 2)
+	if ids := campaignIds(due); err != nil || len(ids) != 1 || ids[0] != "later" {
+		t.Errorf("bad due campaigns: %v %v", ids, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(NewMemoryStore(), t)
+}
+
+func TestRedisStore(t *testing.T) {
+	testStore(getRedisStore(), t)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/redispool"
+)
+
+type redisStore struct {
+	pool *redis.Pool
+}
+
+// NewRedisStore keeps the state of each user as a JSON string.
+func NewRedisStore(addr, password string, db int) Store {
+	pool := redispool.New(addr, password, db)
+
+	ret := new(redisStore)
+	ret.pool = pool
+	return ret
+}
+
+func sessionKey(service, username string) string {
+	return fmt.Sprintf("session:%v:%v", service, username)
+}
+
+func (self *redisStore) Load(service, username string) (state *State, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("GET", sessionKey(service, username)))
+	if err != nil {
+		if err == redis.ErrNil {
+			err = nil
+		}
+		return
+	}
+	state = new(State)
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		state = nil
+	}
+	return
+}
+
+func (self *redisStore) Save(service, username string, state *State) error {
+	if state == nil {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("SET", sessionKey(service, username), data)
+	return err
+}
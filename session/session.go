@@ -0,0 +1,95 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package session keeps the settings of every user between
+// connections, so that a client does not have to configure the
+// connection again every time it reconnects.
+package session
+
+import "sync"
+
+// State is what the server remembers about the connection of a user.
+type State struct {
+	DigestThreshold   int      `json:"digestThreshold"`
+	CompressThreshold int      `json:"compressThreshold"`
+	HeadersOnly       int      `json:"headersOnly"`
+	DigestFields      []string `json:"digestFields,omitempty"`
+	Visible           bool     `json:"visible"`
+
+	// LastSeq is the sequence number of the last cached message
+	// delivered to the user.
+	LastSeq uint64 `json:"lastSeq,omitempty"`
+
+	// Binding is what the token of the connection was bound to. The
+	// state is only restored for a connection bound to the same.
+	Binding string `json:"binding,omitempty"`
+}
+
+// Store is keyed by (service, username).
+type Store interface {
+	// Load returns nil if nothing is stored for the user.
+	Load(service, username string) (state *State, err error)
+	Save(service, username string, state *State) error
+}
+
+type memStore struct {
+	lock   sync.RWMutex
+	states map[string]*State
+}
+
+// NewMemoryStore returns a Store which keeps the states saved on this
+// node. A client resuming its session on another node starts over.
+func NewMemoryStore() Store {
+	ret := new(memStore)
+	ret.states = make(map[string]*State, 100)
+	return ret
+}
+
+func userKey(service, username string) string {
+	return service + "\n" + username
+}
+
+func copyState(state *State) *State {
+	ret := new(State)
+	*ret = *state
+	if state.DigestFields != nil {
+		ret.DigestFields = make([]string, len(state.DigestFields))
+		copy(ret.DigestFields, state.DigestFields)
+	}
+	return ret
+}
+
+func (self *memStore) Load(service, username string) (state *State, err error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	s, ok := self.states[userKey(service, username)]
+	if !ok {
+		return
+	}
+	state = copyState(s)
+	return
+}
+
+func (self *memStore) Save(service, username string, state *State) error {
+	if state == nil {
+		return nil
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.states[userKey(service, username)] = copyState(state)
+	return nil
+}
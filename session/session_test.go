@@ -0,0 +1,90 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package session
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"reflect"
+	"testing"
+)
+
+func getRedisStore() Store {
+	db := 7
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	c.Do("SELECT", db)
+	c.Do("FLUSHDB")
+	c.Close()
+	return NewRedisStore("", "", db)
+}
+
+func testStore(store Store, t *testing.T) {
+	state, err := store.Load("srv", "alice")
+	if err != nil || state != nil {
+		t.Errorf("nothing should be stored: %v %v", state, err)
+	}
+	saved := &State{
+		DigestThreshold:   512,
+		CompressThreshold: 2048,
+		HeadersOnly:       -1,
+		DigestFields:      []string{"title", "from"},
+		Visible:           true,
+		LastSeq:           42,
+	}
+	if err := store.Save("srv", "alice", saved); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// Changes made after Save() should not be seen.
+	saved.DigestFields[0] = "changed"
+	state, err = store.Load("srv", "alice")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	saved.DigestFields[0] = "title"
+	if !reflect.DeepEqual(state, saved) {
+		t.Errorf("loaded %+v; saved %+v", state, saved)
+	}
+	state, err = store.Load("srv", "bob")
+	if err != nil || state != nil {
+		t.Errorf("bob should have nothing stored: %v %v", state, err)
+	}
+	state, err = store.Load("other", "alice")
+	if err != nil || state != nil {
+		t.Errorf("alice in another service should have nothing stored: %v %v", state, err)
+	}
+
+	saved.Visible = false
+	saved.DigestFields = nil
+	if err := store.Save("srv", "alice", saved); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	state, err = store.Load("srv", "alice")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if state.Visible || len(state.DigestFields) != 0 {
+		t.Errorf("the state is not overwritten: %+v", state)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(NewMemoryStore(), t)
+}
+
+func TestRedisStore(t *testing.T) {
+	testStore(getRedisStore(), t)
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package sink hands a copy of every message delivered or forwarded
+// by a service to a hook, e.g. to persist the chat history in the
+// database of the deployment. The hook is called out of band: the
+// records are queued, and dropped once the queue is full, so that a
+// slow or broken database never blocks the delivery.
+package sink
+
+import (
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/proto"
+	"sync"
+	"sync/atomic"
+)
+
+// The kinds of a Record.
+const (
+	// The message is sent by the server, e.g. through the HTTP API.
+	KIND_DELIVER = "deliver"
+
+	// The message is forwarded from a user.
+	KIND_FORWARD = "forward"
+)
+
+// Record is a message delivered to a user.
+type Record struct {
+	// Time is when the message was delivered, in nanoseconds since the epoch.
+	Time      int64  `json:"time"`
+	Kind      string `json:"kind"`
+	Service   string `json:"service"`
+	Username  string `json:"username"`
+	MessageId string `json:"msgId,omitempty"`
+
+	// Only set if the message is from a user.
+	Sender        string `json:"sender,omitempty"`
+	SenderService string `json:"senderService,omitempty"`
+
+	Msg *proto.Message `json:"msg"`
+}
+
+// Sink persists the records. It is called by the workers of a Queue,
+// so it may block, and it is not retried if it fails.
+type Sink interface {
+	Persist(rec *Record) error
+}
+
+// SinkFunc is a function used as a Sink.
+type SinkFunc func(rec *Record) error
+
+func (self SinkFunc) Persist(rec *Record) error {
+	return self(rec)
+}
+
+// Stats tells what happened to the records put in a queue.
+type Stats struct {
+	Queued  uint64 `json:"queued"`
+	Written uint64 `json:"written"`
+	Failed  uint64 `json:"failed"`
+	Dropped uint64 `json:"dropped"`
+
+	// Pending is the number of records waiting in the queue.
+	Pending int `json:"pending"`
+}
+
+const (
+	DefaultQueueSize = 4096
+	DefaultWorkers   = 1
+
+	// One in dropLogInterval dropped records is logged.
+	dropLogInterval = 1000
+)
+
+// Queue feeds a sink with a few workers.
+type Queue struct {
+	sink  Sink
+	queue chan *Record
+	wg    sync.WaitGroup
+
+	// lock guards the logger, and the queue from being closed
+	// while a record is put.
+	lock   sync.RWMutex
+	logger logger.Logger
+	closed bool
+
+	queued  uint64
+	written uint64
+	failed  uint64
+	dropped uint64
+}
+
+// NewQueue starts the workers writing to the sink. A size or a
+// number of workers which is not positive means the default one.
+func NewQueue(sink Sink, size, workers int) *Queue {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	ret := new(Queue)
+	ret.sink = sink
+	ret.logger = logger.Nop()
+	ret.queue = make(chan *Record, size)
+	ret.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go ret.run()
+	}
+	return ret
+}
+
+func (self *Queue) SetLogger(l logger.Logger) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.logger = logger.OrNop(l).With("sink", "")
+}
+
+func (self *Queue) getLogger() logger.Logger {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.logger
+}
+
+func (self *Queue) Sink() Sink {
+	return self.sink
+}
+
+// Put queues the record. It never blocks, and returns false if the
+// record is dropped because the queue is full or stopped.
+func (self *Queue) Put(rec *Record) bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if !self.closed {
+		select {
+		case self.queue <- rec:
+			atomic.AddUint64(&self.queued, 1)
+			return true
+		default:
+		}
+	}
+	if n := atomic.AddUint64(&self.dropped, 1); n%dropLogInterval == 1 {
+		// Not every drop, so that a full queue does not flood the log.
+		self.logger.Warn("message sink records dropped", "dropped", n, "service", rec.Service, "username", rec.Username)
+	}
+	return false
+}
+
+func (self *Queue) Stats() *Stats {
+	return &Stats{
+		Queued:  atomic.LoadUint64(&self.queued),
+		Written: atomic.LoadUint64(&self.written),
+		Failed:  atomic.LoadUint64(&self.failed),
+		Dropped: atomic.LoadUint64(&self.dropped),
+		Pending: len(self.queue),
+	}
+}
+
+// Stop returns once the queued records are written. The records put
+// afterwards are dropped.
+func (self *Queue) Stop() {
+	self.lock.Lock()
+	if !self.closed {
+		self.closed = true
+		close(self.queue)
+	}
+	self.lock.Unlock()
+	self.wg.Wait()
+}
+
+func (self *Queue) run() {
+	defer self.wg.Done()
+	for rec := range self.queue {
+		err := self.sink.Persist(rec)
+		if err != nil {
+			atomic.AddUint64(&self.failed, 1)
+			self.getLogger().Warn("message sink failed", "service", rec.Service, "username", rec.Username, "id", rec.MessageId, "err", err)
+			continue
+		}
+		atomic.AddUint64(&self.written, 1)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package sink
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestQueueDropsWhenFull(t *testing.T) {
+	taken := make(chan bool, 1)
+	block := make(chan bool)
+	var lock sync.Mutex
+	var persisted []string
+	q := NewQueue(SinkFunc(func(rec *Record) error {
+		select {
+		case taken <- true:
+		default:
+		}
+		<-block
+		lock.Lock()
+		defer lock.Unlock()
+		persisted = append(persisted, rec.MessageId)
+		return nil
+	}), 2, 1)
+
+	// The worker holds the first record, the queue the next two.
+	if !q.Put(&Record{MessageId: "1"}) {
+		t.Fatalf("the first record is dropped")
+	}
+	<-taken
+	for _, id := range []string{"2", "3", "4", "5"} {
+		q.Put(&Record{MessageId: id})
+	}
+	stats := q.Stats()
+	if stats.Queued != 3 || stats.Dropped != 2 || stats.Pending != 2 {
+		t.Errorf("bad stats: %+v", stats)
+	}
+	close(block)
+	q.Stop()
+	if len(persisted) != 3 {
+		t.Errorf("persisted: %v", persisted)
+	}
+	if q.Put(&Record{MessageId: "6"}) {
+		t.Errorf("a stopped queue takes a record")
+	}
+	stats = q.Stats()
+	if stats.Written != 3 || stats.Dropped != 3 || stats.Pending != 0 {
+		t.Errorf("bad stats: %+v", stats)
+	}
+}
+
+func TestQueueCountsFailures(t *testing.T) {
+	q := NewQueue(SinkFunc(func(rec *Record) error {
+		if rec.Username == "bob" {
+			return errors.New("database down")
+		}
+		return nil
+	}), 0, 2)
+	for _, u := range []string{"alice", "bob", "alice"} {
+		q.Put(&Record{Username: u})
+	}
+	q.Stop()
+	if stats := q.Stats(); stats.Written != 2 || stats.Failed != 1 || stats.Dropped != 0 {
+		t.Errorf("bad stats: %+v", stats)
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package sse
+
+import (
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// session queues the events of one connection to the server until
+// the client takes them.
+type session struct {
+	upstream client.Conn
+	logger   logger.Logger
+	notify   chan bool
+
+	lock     sync.Mutex
+	queue    []*Event
+	closed   bool
+	lastSeen time.Time
+	waiters  int
+}
+
+func newSession(upstream client.Conn, l logger.Logger) *session {
+	return &session{
+		upstream: upstream,
+		logger:   l,
+		notify:   make(chan bool, 1),
+		lastSeen: time.Now(),
+	}
+}
+
+// run pushes the messages and digests until the connection to the
+// server is closed.
+func (self *session) run() {
+	digests := make(chan *client.Digest, 16)
+	self.upstream.SetDigestChannel(digests)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case d := <-digests:
+				self.push(&Event{
+					Type:          EVENT_DIGEST,
+					Id:            d.MsgId,
+					Sender:        d.Sender,
+					SenderService: d.SenderService,
+					Size:          d.Size,
+					Info:          d.Info,
+				})
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		mc, err := self.upstream.ReceiveMessage()
+		if err != nil {
+			self.close(err)
+			return
+		}
+		if mc.Message == nil {
+			continue
+		}
+		evt := &Event{Type: EVENT_MESSAGE, Id: mc.Id, Header: mc.Message.Header, Body: mc.Message.Body}
+		if mc.FromUser() {
+			evt.Sender = mc.Sender
+			evt.SenderService = mc.SenderService
+		}
+		self.push(evt)
+	}
+}
+
+func (self *session) signal() {
+	select {
+	case self.notify <- true:
+	default:
+	}
+}
+
+func (self *session) push(evt *Event) {
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return
+	}
+	if len(self.queue) >= maxQueued {
+		self.lock.Unlock()
+		self.close(ErrTooSlow)
+		return
+	}
+	self.queue = append(self.queue, evt)
+	self.lock.Unlock()
+	self.signal()
+}
+
+// requeue puts back the events which could not be written.
+func (self *session) requeue(evts []*Event) {
+	self.lock.Lock()
+	self.queue = append(evts, self.queue...)
+	self.lock.Unlock()
+	self.signal()
+}
+
+// close queues a closed event, which is the last one, and closes the
+// connection to the server.
+func (self *session) close(err error) {
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return
+	}
+	self.closed = true
+	self.queue = append(self.queue, &Event{Type: EVENT_CLOSED})
+	self.lock.Unlock()
+	self.signal()
+	if err != nil {
+		self.logger.Debug("sse session closed", "err", err)
+	}
+	self.upstream.Close()
+}
+
+func (self *session) touch() {
+	self.lock.Lock()
+	self.lastSeen = time.Now()
+	self.lock.Unlock()
+}
+
+// idleSince tells if nobody is waiting for the events and there has
+// been no request since the deadline.
+func (self *session) idleSince(deadline time.Time) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.waiters == 0 && self.lastSeen.Before(deadline)
+}
+
+// wait takes the queued events, waiting for some up to the timeout
+// or until the request is gone. closed tells if the closed event has
+// been taken, now or before.
+func (self *session) wait(r *http.Request, timeout time.Duration) (evts []*Event, closed bool) {
+	self.lock.Lock()
+	self.waiters++
+	self.lock.Unlock()
+	defer func() {
+		self.lock.Lock()
+		self.waiters--
+		self.lastSeen = time.Now()
+		self.lock.Unlock()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		self.lock.Lock()
+		evts = self.queue
+		self.queue = nil
+		closed = self.closed
+		self.lock.Unlock()
+		if len(evts) > 0 || closed {
+			return
+		}
+		select {
+		case <-self.notify:
+		case <-timer.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
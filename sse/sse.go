@@ -0,0 +1,567 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package sse is an HTTP front-end to a uniqush-conn server, for the
+// clients on networks where only HTTP(S) gets through. The messages
+// and digests are pushed as Server-Sent Events, or returned by long
+// polls.
+//
+// Every session is a connection of the endpoint to the server, on
+// behalf of the client, so the server handles it like any other
+// connection. The endpoints, under the prefix, are:
+//
+//	POST connect.json   service, username, token, device   opens a session
+//	GET  events         session                            the event stream
+//	GET  poll.json      session, timeout                   the pending events
+//	POST ack.json       session, id                        acks a message
+//	POST retrieve.json  session, id...                     retrieves cached messages
+//	POST send.json      a JSON SendRequest                 sends a message
+//	POST close.json     session                            closes the session
+//
+// The device is optional, unless the service binds the tokens to the
+// devices. See client.DialOptions.
+//
+// An event is delivered once, to the stream or poll that takes it. A
+// cached message which is not acked stays in the cache and is sent
+// again on the next session. A session is closed once it has not been
+// used for the idle timeout, or when its client cannot keep up.
+package sse
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/listener"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_MESSAGE = "message"
+	EVENT_DIGEST  = "digest"
+	EVENT_CLOSED  = "closed"
+)
+
+const (
+	DefaultPrefix      = "/sse/"
+	DefaultTimeout     = 10 * time.Second
+	DefaultIdleTimeout = 2 * time.Minute
+	DefaultForwardTTL  = 24 * time.Hour
+	DefaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 2 * time.Minute
+	keepAliveInterval  = 15 * time.Second
+	maxQueued          = 256
+)
+
+var (
+	ErrNoSession     = errors.New("no such session")
+	ErrSessionClosed = errors.New("session closed")
+	ErrTooSlow       = errors.New("sse: too many undelivered events")
+)
+
+// Event is pushed to the client. The digests have a size and info but
+// no header and body.
+type Event struct {
+	Type          string            `json:"type"`
+	Id            string            `json:"id,omitempty"`
+	Sender        string            `json:"sender,omitempty"`
+	SenderService string            `json:"senderService,omitempty"`
+	Header        map[string]string `json:"header,omitempty"`
+	Body          []byte            `json:"body,omitempty"`
+	Size          int               `json:"size,omitempty"`
+	Info          map[string]string `json:"info,omitempty"`
+}
+
+// SendRequest is the body of send.json. The message goes to the
+// server if there is no receiver. The service defaults to the one of
+// the session.
+type SendRequest struct {
+	Session  string            `json:"session"`
+	Service  string            `json:"service,omitempty"`
+	Receiver string            `json:"receiver,omitempty"`
+	Header   map[string]string `json:"header,omitempty"`
+	Body     []byte            `json:"body,omitempty"`
+	TTL      string            `json:"ttl,omitempty"`
+}
+
+type connectResponse struct {
+	Session string `json:"session"`
+	ConnId  string `json:"connId"`
+}
+
+// Endpoint is an http.Handler relaying the sessions to the server.
+type Endpoint struct {
+	// ServerAddr is the host:port of the server's TCP listener.
+	ServerAddr string
+	PublicKey  *rsa.PublicKey
+
+	// Prefix is the path of the endpoints. It defaults to DefaultPrefix.
+	Prefix string
+
+	// Timeout bounds the connection to the server. It defaults to
+	// DefaultTimeout.
+	Timeout time.Duration
+
+	// IdleTimeout is how long a session lives without any request.
+	// It defaults to DefaultIdleTimeout.
+	IdleTimeout time.Duration
+
+	// ForwardTTL is the TTL of the forwarded messages without one.
+	// It defaults to DefaultForwardTTL.
+	ForwardTTL time.Duration
+
+	// AllowOrigin, if not empty, is sent as
+	// Access-Control-Allow-Origin so that browsers may use the
+	// endpoint from other origins.
+	AllowOrigin string
+
+	// ProxyProtocol sends the address of each client to the server in
+	// a PROXY protocol header, so that the tokens are bound to the
+	// network of the client rather than the one of the endpoint. The
+	// listener of the server should then expect the PROXY protocol.
+	// The address is the one of the HTTP request.
+	ProxyProtocol bool
+
+	Logger logger.Logger
+
+	lock     sync.Mutex
+	sessions map[string]*session
+	closed   bool
+	done     chan bool
+}
+
+func (self *Endpoint) timeout() time.Duration {
+	if self.Timeout > 0 {
+		return self.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (self *Endpoint) idleTimeout() time.Duration {
+	if self.IdleTimeout > 0 {
+		return self.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+func (self *Endpoint) prefix() string {
+	if len(self.Prefix) == 0 {
+		return DefaultPrefix
+	}
+	if !strings.HasSuffix(self.Prefix, "/") {
+		return self.Prefix + "/"
+	}
+	return self.Prefix
+}
+
+func (self *Endpoint) logger() logger.Logger {
+	return logger.OrNop(self.Logger).With("gateway", "sse")
+}
+
+// NrSessions returns the number of open sessions.
+func (self *Endpoint) NrSessions() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.sessions)
+}
+
+// Close closes every session. Later connect requests are rejected.
+func (self *Endpoint) Close() error {
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return nil
+	}
+	self.closed = true
+	if self.done != nil {
+		close(self.done)
+	}
+	sessions := self.sessions
+	self.sessions = nil
+	self.lock.Unlock()
+	for _, s := range sessions {
+		s.close(nil)
+	}
+	return nil
+}
+
+func (self *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(self.AllowOrigin) > 0 {
+		w.Header().Set("Access-Control-Allow-Origin", self.AllowOrigin)
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Last-Event-ID")
+			return
+		}
+	}
+	prefix := self.prefix()
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.URL.Path[len(prefix):] {
+	case "connect.json":
+		self.connect(w, r)
+	case "events":
+		self.events(w, r)
+	case "poll.json":
+		self.poll(w, r)
+	case "ack.json":
+		self.ack(w, r)
+	case "retrieve.json":
+		self.retrieve(w, r)
+	case "send.json":
+		self.send(w, r)
+	case "close.json":
+		self.closeSession(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func badSession(w http.ResponseWriter, err error) {
+	if err == ErrNoSession {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusGone)
+}
+
+func newSessionId() (id string, err error) {
+	var b [16]byte
+	_, err = rand.Read(b[:])
+	if err != nil {
+		return
+	}
+	id = hex.EncodeToString(b[:])
+	return
+}
+
+// reap closes the idle sessions until the endpoint is closed.
+func (self *Endpoint) reap(done chan bool) {
+	ticker := time.NewTicker(self.idleTimeout() / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		var idle []*session
+		deadline := time.Now().Add(-self.idleTimeout())
+		self.lock.Lock()
+		for id, s := range self.sessions {
+			if s.idleSince(deadline) {
+				delete(self.sessions, id)
+				idle = append(idle, s)
+			}
+		}
+		self.lock.Unlock()
+		for _, s := range idle {
+			s.logger.Debug("idle session closed")
+			s.close(nil)
+		}
+	}
+}
+
+func (self *Endpoint) add(s *session) (id string, err error) {
+	id, err = newSessionId()
+	if err != nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		err = ErrSessionClosed
+		return
+	}
+	if self.sessions == nil {
+		self.sessions = make(map[string]*session, 16)
+		self.done = make(chan bool)
+		go self.reap(self.done)
+	}
+	self.sessions[id] = s
+	return
+}
+
+func (self *Endpoint) remove(id string, s *session) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.sessions[id] == s {
+		delete(self.sessions, id)
+	}
+}
+
+func (self *Endpoint) get(r *http.Request) (s *session, err error) {
+	id := r.FormValue("session")
+	self.lock.Lock()
+	s = self.sessions[id]
+	self.lock.Unlock()
+	if s == nil {
+		err = ErrNoSession
+		return
+	}
+	s.touch()
+	return
+}
+
+func (self *Endpoint) connect(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	service := r.FormValue("service")
+	username := r.FormValue("username")
+	token := r.FormValue("token")
+	if len(service) == 0 || len(username) == 0 {
+		http.Error(w, "no service or username", http.StatusBadRequest)
+		return
+	}
+	l := self.logger().With("addr", r.RemoteAddr)
+	c, err := net.DialTimeout("tcp", self.ServerAddr, self.timeout())
+	if err != nil {
+		l.Warn("cannot connect to the server", "err", err)
+		http.Error(w, "server unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if self.ProxyProtocol {
+		// The address is not resolved: it is the one of the request.
+		addr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		c.SetWriteDeadline(time.Now().Add(self.timeout()))
+		if err = listener.WriteProxyHeader(c, addr, c.RemoteAddr()); err != nil {
+			c.Close()
+			l.Warn("cannot connect to the server", "err", err)
+			http.Error(w, "server unavailable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	opts := &client.DialOptions{Device: r.FormValue("device")}
+	upstream, err := client.DialWithOptions(c, self.PublicKey, service, username, token, self.timeout(), opts)
+	if upstream == nil {
+		if err == proto.ErrBadServer || err == proto.ErrUnknownServerKey {
+			l.Warn("cannot connect to the server", "err", err)
+			http.Error(w, "server unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		l.Debug("authentication failed", "service", service, "username", username, "err", err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	s := newSession(upstream, l.With("service", service, "username", username, "connId", upstream.ConnId()))
+	id, err := self.add(s)
+	if err != nil {
+		upstream.Close()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	go func() {
+		s.run()
+		self.remove(id, s)
+	}()
+	writeJson(w, &connectResponse{Session: id, ConnId: upstream.ConnId()})
+}
+
+func (self *Endpoint) events(w http.ResponseWriter, r *http.Request) {
+	s, err := self.get(r)
+	if err != nil {
+		badSession(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		evts, closed := s.wait(r, keepAliveInterval)
+		for _, evt := range evts {
+			data, _ := json.Marshal(evt)
+			_, err = fmt.Fprintf(w, "event: %v\ndata: %s\n\n", evt.Type, data)
+			if err != nil {
+				s.requeue(evts)
+				return
+			}
+		}
+		if len(evts) == 0 && !closed {
+			if _, err = fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		if closed || r.Context().Err() != nil {
+			return
+		}
+	}
+}
+
+func (self *Endpoint) poll(w http.ResponseWriter, r *http.Request) {
+	s, err := self.get(r)
+	if err != nil {
+		badSession(w, err)
+		return
+	}
+	timeout := DefaultPollTimeout
+	if t := r.FormValue("timeout"); len(t) > 0 {
+		secs, err := strconv.Atoi(t)
+		if err != nil || secs < 0 {
+			http.Error(w, "bad timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(secs) * time.Second
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+	}
+	evts, _ := s.wait(r, timeout)
+	if evts == nil {
+		evts = []*Event{}
+	}
+	writeJson(w, evts)
+}
+
+func (self *Endpoint) ack(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	s, err := self.get(r)
+	if err != nil {
+		badSession(w, err)
+		return
+	}
+	id := r.FormValue("id")
+	if len(id) == 0 {
+		http.Error(w, "no id", http.StatusBadRequest)
+		return
+	}
+	if err = s.upstream.Ack(id); err != nil {
+		badSession(w, ErrSessionClosed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (self *Endpoint) retrieve(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	s, err := self.get(r)
+	if err != nil {
+		badSession(w, err)
+		return
+	}
+	ids := r.Form["id"]
+	if len(ids) == 0 {
+		http.Error(w, "no id", http.StatusBadRequest)
+		return
+	}
+	if err = s.upstream.RequestMessage(ids...); err != nil {
+		badSession(w, ErrSessionClosed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (self *Endpoint) send(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	defer r.Body.Close()
+	req := new(SendRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	self.lock.Lock()
+	s := self.sessions[req.Session]
+	self.lock.Unlock()
+	if s == nil {
+		badSession(w, ErrNoSession)
+		return
+	}
+	s.touch()
+	msg := &proto.Message{Header: req.Header, Body: req.Body}
+	if msg.IsEmpty() {
+		http.Error(w, "empty message", http.StatusBadRequest)
+		return
+	}
+	if len(req.Receiver) == 0 {
+		err = s.upstream.SendMessageToServer(msg)
+	} else {
+		ttl := self.ForwardTTL
+		if ttl <= 0 {
+			ttl = DefaultForwardTTL
+		}
+		if len(req.TTL) > 0 {
+			ttl, err = time.ParseDuration(req.TTL)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		service := req.Service
+		if len(service) == 0 {
+			service = s.upstream.Service()
+		}
+		err = s.upstream.SendMessageToUser(service, req.Receiver, msg, ttl)
+	}
+	if err != nil {
+		badSession(w, ErrSessionClosed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (self *Endpoint) closeSession(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	s, err := self.get(r)
+	if err != nil {
+		badSession(w, err)
+		return
+	}
+	self.remove(r.FormValue("session"), s)
+	s.close(nil)
+	w.WriteHeader(http.StatusNoContent)
+}
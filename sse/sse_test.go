@@ -0,0 +1,370 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/uniqush/uniqush-conn/listener"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type singleUserAuth struct {
+	service, username, token string
+}
+
+func (self *singleUserAuth) Authenticate(srv, usr, token, addr string) (bool, error) {
+	return self.service == srv && self.username == usr && self.token == token, nil
+}
+
+func startServer(t *testing.T) (stop func(), ep *Endpoint, base string, conns chan server.Conn) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns = make(chan server.Conn, 1)
+	srv := &server.Server{
+		PrivateKey: priv,
+		Auth:       &singleUserAuth{"service", "user", "token"},
+		Handler:    server.HandlerFunc(func(conn server.Conn) { conns <- conn }),
+	}
+	go srv.Serve(ln)
+	ep = &Endpoint{
+		ServerAddr: ln.Addr().String(),
+		PublicKey:  &priv.PublicKey,
+		Timeout:    3 * time.Second,
+	}
+	hs := httptest.NewServer(ep)
+	stop = func() {
+		ep.Close()
+		hs.Close()
+		srv.Close()
+	}
+	base = hs.URL + DefaultPrefix
+	return
+}
+
+func connect(t *testing.T, base, token string) (session string, status int) {
+	resp, err := http.PostForm(base+"connect.json", url.Values{"service": {"service"}, "username": {"user"}, "token": {token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	status = resp.StatusCode
+	if status != http.StatusOK {
+		return
+	}
+	var cr connectResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cr); err != nil || len(cr.Session) == 0 || len(cr.ConnId) == 0 {
+		t.Fatalf("bad connect response: %+v %v", cr, err)
+	}
+	session = cr.Session
+	return
+}
+
+func acceptConn(t *testing.T, conns chan server.Conn) server.Conn {
+	select {
+	case conn := <-conns:
+		return conn
+	case <-time.After(3 * time.Second):
+		t.Fatal("no connection to the server")
+	}
+	return nil
+}
+
+func poll(t *testing.T, base, session string) []*Event {
+	resp, err := http.Get(base + "poll.json?timeout=3&session=" + session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad status: %v", resp.StatusCode)
+	}
+	var evts []*Event
+	if err := json.NewDecoder(resp.Body).Decode(&evts); err != nil {
+		t.Fatal(err)
+	}
+	return evts
+}
+
+func post(t *testing.T, base, path string, v url.Values) int {
+	resp, err := http.PostForm(base+path, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestConnectAuth(t *testing.T) {
+	stop, ep, base, _ := startServer(t)
+	defer stop()
+	if _, status := connect(t, base, "wrong"); status != http.StatusForbidden {
+		t.Errorf("bad status: %v", status)
+	}
+	if _, status := connect(t, base, "token"); status != http.StatusOK {
+		t.Errorf("bad status: %v", status)
+	}
+	if n := ep.NrSessions(); n != 1 {
+		t.Errorf("%v sessions", n)
+	}
+	if status := post(t, base, "ack.json", url.Values{"session": {"nosuch"}, "id": {"1"}}); status != http.StatusNotFound {
+		t.Errorf("bad status: %v", status)
+	}
+}
+
+// deviceAuth tells where the accepted clients are from.
+type deviceAuth struct {
+	singleUserAuth
+	from chan string
+}
+
+func (self *deviceAuth) AuthenticateDevice(srv, usr, token, addr, device string) (bound string, ok bool, err error) {
+	ok, err = self.Authenticate(srv, usr, token, addr)
+	if ok {
+		self.from <- addr + " " + device
+	}
+	return
+}
+
+func TestProxyProtocol(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &deviceAuth{singleUserAuth{"service", "user", "token"}, make(chan string, 1)}
+	srv := &server.Server{
+		PrivateKey: priv,
+		Auth:       auth,
+		Handler:    server.HandlerFunc(func(conn server.Conn) {}),
+	}
+	go srv.Serve(listener.NewProxyProtocolListener(ln))
+	defer srv.Close()
+	ep := &Endpoint{
+		ServerAddr:    ln.Addr().String(),
+		PublicKey:     &priv.PublicKey,
+		Timeout:       3 * time.Second,
+		ProxyProtocol: true,
+	}
+	defer ep.Close()
+	clients := make(chan string, 1)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients <- r.RemoteAddr
+		ep.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+
+	v := url.Values{"service": {"service"}, "username": {"user"}, "token": {"token"}, "device": {"phone"}}
+	resp, err := http.PostForm(hs.URL+DefaultPrefix+"connect.json", v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad status: %v", resp.StatusCode)
+	}
+	if from := <-auth.from; from != <-clients+" phone" {
+		t.Errorf("the server does not see the client: %v", from)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	stop, ep, base, conns := startServer(t)
+	defer stop()
+	session, _ := connect(t, base, "token")
+	conn := acceptConn(t, conns)
+	defer conn.Close()
+	fwdChan := make(chan *server.ForwardRequest, 1)
+	conn.SetForwardRequestChannel(fwdChan)
+	received := make(chan *proto.Message, 1)
+	go func() {
+		for {
+			msg, err := conn.ReceiveMessage()
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- msg
+		}
+	}()
+
+	msg := &proto.Message{Header: map[string]string{"title": "hi"}, Body: []byte("hello")}
+	if err := conn.SendMessage(msg, "msg1", nil); err != nil {
+		t.Fatal(err)
+	}
+	evts := poll(t, base, session)
+	if len(evts) != 1 || evts[0].Type != EVENT_MESSAGE || evts[0].Id != "msg1" ||
+		evts[0].Header["title"] != "hi" || string(evts[0].Body) != "hello" {
+		t.Fatalf("bad events: %+v", evts)
+	}
+	if status := post(t, base, "ack.json", url.Values{"session": {session}, "id": {"msg1"}}); status != http.StatusNoContent {
+		t.Errorf("bad status: %v", status)
+	}
+
+	mc := &proto.MessageContainer{Id: "msg2", Message: &proto.Message{Body: []byte("cached")}}
+	if err := conn.SendDigest(mc, map[string]string{"title": "digest"}); err != nil {
+		t.Fatal(err)
+	}
+	evts = poll(t, base, session)
+	if len(evts) != 1 || evts[0].Type != EVENT_DIGEST || evts[0].Id != "msg2" || evts[0].Size <= 0 {
+		t.Fatalf("bad events: %+v", evts[0])
+	}
+
+	body, _ := json.Marshal(&SendRequest{Session: session, Body: []byte("up")})
+	resp, err := http.Post(base+"send.json", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("bad status: %v", resp.StatusCode)
+	}
+	select {
+	case msg := <-received:
+		if msg == nil || string(msg.Body) != "up" {
+			t.Errorf("bad message to the server: %v", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("no message to the server")
+	}
+
+	body, _ = json.Marshal(&SendRequest{Session: session, Service: "other", Receiver: "user2", Header: map[string]string{"a": "b"}})
+	resp, err = http.Post(base+"send.json", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	select {
+	case req := <-fwdChan:
+		if req.ReceiverService != "other" || req.Receiver != "user2" || req.MessageContainer.Message.Header["a"] != "b" {
+			t.Errorf("bad forward: %+v", req)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("no forward")
+	}
+
+	if status := post(t, base, "close.json", url.Values{"session": {session}}); status != http.StatusNoContent {
+		t.Errorf("bad status: %v", status)
+	}
+	select {
+	case <-received:
+	case <-time.After(3 * time.Second):
+		t.Errorf("the connection to the server should be closed")
+	}
+	if n := ep.NrSessions(); n != 0 {
+		t.Errorf("%v sessions", n)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	stop, _, base, conns := startServer(t)
+	defer stop()
+	session, _ := connect(t, base, "token")
+	conn := acceptConn(t, conns)
+	defer conn.Close()
+
+	resp, err := http.Get(base + "events?session=" + session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("bad content type: %v", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+	next := func() (typ string, evt *Event) {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimRight(line, "\n")
+			if strings.HasPrefix(line, "event: ") {
+				typ = line[len("event: "):]
+			} else if strings.HasPrefix(line, "data: ") {
+				evt = new(Event)
+				if err := json.Unmarshal([]byte(line[len("data: "):]), evt); err != nil {
+					t.Fatal(err)
+				}
+			} else if len(line) == 0 && evt != nil {
+				return
+			}
+		}
+	}
+
+	if err := conn.SendMessage(&proto.Message{Body: []byte("hello")}, "msg1", nil); err != nil {
+		t.Fatal(err)
+	}
+	typ, evt := next()
+	if typ != EVENT_MESSAGE || evt.Id != "msg1" || string(evt.Body) != "hello" {
+		t.Errorf("bad event %v: %+v", typ, evt)
+	}
+
+	// Closing the upstream connection ends the stream.
+	conn.Close()
+	typ, evt = next()
+	if typ != EVENT_CLOSED || evt.Type != EVENT_CLOSED {
+		t.Errorf("bad event %v: %+v", typ, evt)
+	}
+}
+
+func TestIdleSession(t *testing.T) {
+	stop, ep, base, conns := startServer(t)
+	defer stop()
+	ep.IdleTimeout = 100 * time.Millisecond
+	connect(t, base, "token")
+	conn := acceptConn(t, conns)
+	defer conn.Close()
+	done := make(chan bool)
+	go func() {
+		for {
+			if _, err := conn.ReceiveMessage(); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Errorf("the idle session should be closed")
+	}
+	if n := ep.NrSessions(); n != 0 {
+		t.Errorf("%v sessions", n)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package subscription
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/redispool"
+)
+
+type redisStore struct {
+	pool *redis.Pool
+}
+
+// NewRedisStore keeps the subscriptions of each user in a redis set.
+// Every member is a subscription encoded in JSON.
+func NewRedisStore(addr, password string, db int) Store {
+	pool := redispool.New(addr, password, db)
+
+	ret := new(redisStore)
+	ret.pool = pool
+	return ret
+}
+
+func subscriptionKey(service, username string) string {
+	return fmt.Sprintf("sub:%v:%v", service, username)
+}
+
+func subscribersKey(service string) string {
+	return fmt.Sprintf("subscribers:%v", service)
+}
+
+// removeMatches removes the subscriptions containing all of params.
+// It returns the number of subscriptions left.
+func (self *redisStore) removeMatches(conn redis.Conn, service, username string, params map[string]string) (n int, err error) {
+	key := subscriptionKey(service, username)
+	members, err := redis.Strings(conn.Do("SMEMBERS", key))
+	if err != nil {
+		return
+	}
+	n = len(members)
+	for _, m := range members {
+		var sub map[string]string
+		if json.Unmarshal([]byte(m), &sub) == nil && !matches(sub, params) {
+			continue
+		}
+		_, err = conn.Do("SREM", key, m)
+		if err != nil {
+			return
+		}
+		n--
+	}
+	return
+}
+
+func (self *redisStore) Subscribe(service, username string, params map[string]string) error {
+	// Keys of a map are sorted by encoding/json, so the same parameters
+	// are always encoded into the same member.
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err = self.removeMatches(conn, service, username, params)
+	if err != nil {
+		return err
+	}
+	conn.Send("MULTI")
+	conn.Send("SADD", subscriptionKey(service, username), data)
+	conn.Send("SADD", subscribersKey(service), username)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (self *redisStore) Unsubscribe(service, username string, params map[string]string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	n, err := self.removeMatches(conn, service, username, params)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		_, err = conn.Do("SREM", subscribersKey(service), username)
+	}
+	return err
+}
+
+func (self *redisStore) Subscriptions(service, username string) (subs []map[string]string, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	members, err := redis.Strings(conn.Do("SMEMBERS", subscriptionKey(service, username)))
+	if err != nil {
+		return
+	}
+	subs = make([]map[string]string, 0, len(members))
+	for _, m := range members {
+		var sub map[string]string
+		if json.Unmarshal([]byte(m), &sub) != nil {
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	return
+}
+
+func (self *redisStore) Subscribers(service string) (usernames []string, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("SMEMBERS", subscribersKey(service)))
+}
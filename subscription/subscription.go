@@ -0,0 +1,130 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package subscription records the push notification subscriptions
+// of every user, so that they can be synced to uniqush-push again
+// after a restart.
+package subscription
+
+import "sync"
+
+// Store keeps the parameters of each subscription of a user.
+// Parameters are the ones sent by CMD_SUBSCRIPTION, e.g.
+// pushservicetype and regid.
+type Store interface {
+	// Subscribe replaces the subscriptions matching params.
+	Subscribe(service, username string, params map[string]string) error
+
+	// Unsubscribe removes every subscription which contains all of params.
+	Unsubscribe(service, username string, params map[string]string) error
+	Subscriptions(service, username string) (subs []map[string]string, err error)
+
+	// Subscribers returns the users which have at least one subscription.
+	Subscribers(service string) (usernames []string, err error)
+}
+
+// matches returns true if sub contains all of params.
+func matches(sub, params map[string]string) bool {
+	for k, v := range params {
+		if sv, ok := sub[k]; !ok || sv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func copyParams(params map[string]string) map[string]string {
+	ret := make(map[string]string, len(params))
+	for k, v := range params {
+		ret[k] = v
+	}
+	return ret
+}
+
+type memStore struct {
+	lock  sync.RWMutex
+	users map[string]map[string][]map[string]string
+}
+
+// NewMemoryStore returns a Store which keeps the subscriptions in
+// memory. The users have to subscribe again once the process exits.
+func NewMemoryStore() Store {
+	ret := new(memStore)
+	ret.users = make(map[string]map[string][]map[string]string, 10)
+	return ret
+}
+
+func removeMatches(subs []map[string]string, params map[string]string) []map[string]string {
+	ret := subs[:0]
+	for _, sub := range subs {
+		if !matches(sub, params) {
+			ret = append(ret, sub)
+		}
+	}
+	return ret
+}
+
+func (self *memStore) Subscribe(service, username string, params map[string]string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	users, ok := self.users[service]
+	if !ok {
+		users = make(map[string][]map[string]string, 100)
+		self.users[service] = users
+	}
+	subs := removeMatches(users[username], params)
+	users[username] = append(subs, copyParams(params))
+	return nil
+}
+
+func (self *memStore) Unsubscribe(service, username string, params map[string]string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	users, ok := self.users[service]
+	if !ok {
+		return nil
+	}
+	subs := removeMatches(users[username], params)
+	if len(subs) == 0 {
+		delete(users, username)
+	} else {
+		users[username] = subs
+	}
+	return nil
+}
+
+func (self *memStore) Subscriptions(service, username string) (subs []map[string]string, err error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	list := self.users[service][username]
+	subs = make([]map[string]string, 0, len(list))
+	for _, sub := range list {
+		subs = append(subs, copyParams(sub))
+	}
+	return
+}
+
+func (self *memStore) Subscribers(service string) (usernames []string, err error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	users := self.users[service]
+	usernames = make([]string, 0, len(users))
+	for username := range users {
+		usernames = append(usernames, username)
+	}
+	return
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package subscription
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+func getRedisStore() Store {
+	db := 5
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	c.Do("SELECT", db)
+	c.Do("FLUSHDB")
+	c.Close()
+	return NewRedisStore("", "", db)
+}
+
+func gcm(regid string) map[string]string {
+	return map[string]string{"pushservicetype": "gcm", "regid": regid}
+}
+
+func testStore(store Store, t *testing.T) {
+	if err := store.Subscribe("srv", "alice", gcm("1")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := store.Subscribe("srv", "alice", gcm("2")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// Subscribing twice should not duplicate the subscription.
+	if err := store.Subscribe("srv", "alice", gcm("2")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := store.Subscribe("other", "bob", gcm("3")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	subs, err := store.Subscriptions("srv", "alice")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(subs) != 2 {
+		t.Errorf("Wrong number of subscriptions: %v", subs)
+	}
+	for _, sub := range subs {
+		if sub["pushservicetype"] != "gcm" || (sub["regid"] != "1" && sub["regid"] != "2") {
+			t.Errorf("Unknown subscription: %v", sub)
+		}
+	}
+	users, err := store.Subscribers("srv")
+	if err != nil || len(users) != 1 || users[0] != "alice" {
+		t.Errorf("Wrong subscribers: %v; %v", users, err)
+	}
+
+	if err := store.Unsubscribe("srv", "alice", map[string]string{"regid": "1"}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	subs, err = store.Subscriptions("srv", "alice")
+	if err != nil || len(subs) != 1 || subs[0]["regid"] != "2" {
+		t.Errorf("Wrong subscriptions after unsubscribing: %v; %v", subs, err)
+	}
+	if err := store.Unsubscribe("srv", "alice", gcm("2")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	users, err = store.Subscribers("srv")
+	if err != nil || len(users) != 0 {
+		t.Errorf("alice should have no subscription: %v; %v", users, err)
+	}
+	if err := store.Unsubscribe("srv", "nobody", gcm("2")); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	subs, err = store.Subscriptions("other", "bob")
+	if err != nil || len(subs) != 1 {
+		t.Errorf("Subscriptions are per service: %v; %v", subs, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(NewMemoryStore(), t)
+}
+
+func TestRedisStore(t *testing.T) {
+	testStore(getRedisStore(), t)
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package testsupport
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FakeAuth is a server.Authenticator which only accepts
+// the tokens added by Allow(), unless AllowAll() is called.
+type FakeAuth struct {
+	lock     sync.Mutex
+	tokens   map[string]string
+	allowAll bool
+	err      error
+}
+
+func NewFakeAuth() *FakeAuth {
+	ret := new(FakeAuth)
+	ret.tokens = make(map[string]string, 4)
+	return ret
+}
+
+func authKey(service, username string) string {
+	return fmt.Sprintf("%v:%v", service, username)
+}
+
+func (self *FakeAuth) Allow(service, username, token string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.tokens[authKey(service, username)] = token
+}
+
+func (self *FakeAuth) AllowAll() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.allowAll = true
+}
+
+// Fail makes Authenticate() return err. Passing nil
+// restores the normal behavior.
+func (self *FakeAuth) Fail(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.err = err
+}
+
+func (self *FakeAuth) Authenticate(srv, usr, token, addr string) (bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.err != nil {
+		return false, self.err
+	}
+	if self.allowAll {
+		return true, nil
+	}
+	t, ok := self.tokens[authKey(srv, usr)]
+	return ok && t == token, nil
+}
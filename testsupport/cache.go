@@ -0,0 +1,465 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package testsupport
+
+import (
+	"fmt"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations of msgcache.Cache, used to script MockCache.
+const (
+	OP_CACHE          = "cache"
+	OP_CACHE_ONCE     = "cache-once"
+	OP_GET            = "get"
+	OP_GET_ALL        = "get-all"
+	OP_DEL            = "del"
+	OP_REPLACE        = "replace"
+	OP_GET_SEQ        = "get-seq"
+	OP_GET_THREAD     = "get-thread"
+	OP_QUERY          = "query"
+	OP_UPDATE_STATE   = "update-state"
+	OP_GET_STATE      = "get-state"
+	OP_NR_UNDELIVERED = "nr-undelivered"
+	OP_DEAD_LETTERS   = "dead-letters"
+)
+
+type cachedMessage struct {
+	mc      *proto.MessageContainer
+	expire  time.Time
+	state   msgcache.DeliveryState
+	pending bool
+
+	// A deleted message only keeps its delivery state.
+	deleted bool
+}
+
+// MockCache is an in-memory msgcache.Cache. Errors could be
+// injected into any operation with FailNext(), and every call
+// is recorded in Calls().
+type MockCache struct {
+	lock     sync.Mutex
+	msgs     map[string][]*cachedMessage
+	seqs     map[string]uint64
+	nextId   uint64
+	failures map[string][]error
+	calls    []string
+
+	// Dead letters of the tracked services, waiting to be collected.
+	tracked     map[string]bool
+	deadLetters []*msgcache.DeadLetter
+
+	// The indexed header fields of each service.
+	indexed map[string]map[string]bool
+}
+
+func NewMockCache() *MockCache {
+	ret := new(MockCache)
+	ret.msgs = make(map[string][]*cachedMessage, 16)
+	ret.seqs = make(map[string]uint64, 16)
+	ret.failures = make(map[string][]error, 4)
+	ret.tracked = make(map[string]bool, 1)
+	ret.indexed = make(map[string]map[string]bool, 1)
+	return ret
+}
+
+// FailNext makes the next call of op return err. Queued
+// errors are returned in order.
+func (self *MockCache) FailNext(op string, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.failures[op] = append(self.failures[op], err)
+}
+
+// Calls returns the operations called so far, like
+// "cache service:username".
+func (self *MockCache) Calls() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ret := make([]string, len(self.calls))
+	copy(ret, self.calls)
+	return ret
+}
+
+func (self *MockCache) SetLogger(l logger.Logger) {
+}
+
+// begin should be called with the lock held.
+func (self *MockCache) begin(op, service, username string) error {
+	self.calls = append(self.calls, fmt.Sprintf("%v %v:%v", op, service, username))
+	errs := self.failures[op]
+	if len(errs) == 0 {
+		return nil
+	}
+	self.failures[op] = errs[1:]
+	return errs[0]
+}
+
+func copyContainer(mc *proto.MessageContainer) *proto.MessageContainer {
+	ret := new(proto.MessageContainer)
+	*ret = *mc
+	if mc.Message != nil {
+		msg := new(proto.Message)
+		*msg = *mc.Message
+		if mc.Message.Header != nil {
+			msg.Header = make(map[string]string, len(mc.Message.Header))
+			for k, v := range mc.Message.Header {
+				msg.Header[k] = v
+			}
+		}
+		ret.Message = msg
+	}
+	return ret
+}
+
+// live returns the messages which have not expired, ordered
+// by their sequence numbers. It should be called with the lock held.
+func (self *MockCache) live(key string) []*cachedMessage {
+	now := time.Now()
+	msgs := self.msgs[key]
+	ret := msgs[:0]
+	for _, m := range msgs {
+		if m.expire.IsZero() || m.expire.After(now) {
+			ret = append(ret, m)
+		} else if m.pending && !m.deleted {
+			self.expired(key, m)
+		}
+	}
+	self.msgs[key] = ret
+	return ret
+}
+
+// expired keeps the dead letter if the service is tracked. It
+// should be called with the lock held.
+func (self *MockCache) expired(key string, m *cachedMessage) {
+	fields := strings.SplitN(key, ":", 2)
+	if len(fields) != 2 || !self.tracked[fields[0]] {
+		return
+	}
+	self.deadLetters = append(self.deadLetters, &msgcache.DeadLetter{
+		Service:  fields[0],
+		Username: fields[1],
+		Message:  copyContainer(m.mc),
+		Reason:   msgcache.DEADLETTER_EXPIRED,
+	})
+}
+
+func (self *MockCache) TrackDeadLetters(service string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.tracked[service] = true
+}
+
+func (self *MockCache) CollectDeadLetters(service string, max int) (letters []*msgcache.DeadLetter, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err = self.begin(OP_DEAD_LETTERS, service, "")
+	if err != nil {
+		return
+	}
+	for key := range self.msgs {
+		if strings.HasPrefix(key, service+":") {
+			self.live(key)
+		}
+	}
+	rest := self.deadLetters[:0]
+	for _, letter := range self.deadLetters {
+		if letter.Service == service && len(letters) < max {
+			letters = append(letters, letter)
+		} else {
+			rest = append(rest, letter)
+		}
+	}
+	self.deadLetters = rest
+	return
+}
+
+func (self *MockCache) find(key, id string) *cachedMessage {
+	for _, m := range self.live(key) {
+		if m.mc.Id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+func (self *MockCache) CacheMessage(service, username string, mc *proto.MessageContainer, ttl time.Duration) (id string, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err = self.begin(OP_CACHE, service, username)
+	if err != nil {
+		return
+	}
+	id = self.cache(service, username, mc, ttl)
+	return
+}
+
+func (self *MockCache) CacheMessageOnce(service, username string, mc *proto.MessageContainer, ttl time.Duration) (id string, dup bool, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err = self.begin(OP_CACHE_ONCE, service, username)
+	if err != nil {
+		return
+	}
+	if len(mc.OriginId) > 0 {
+		for _, m := range self.live(authKey(service, username)) {
+			if m.mc.OriginId == mc.OriginId && !m.deleted {
+				mc.Id = m.mc.Id
+				mc.Seq = m.mc.Seq
+				mc.CachedAt = m.mc.CachedAt
+				mc.ExpiresAt = m.mc.ExpiresAt
+				id, dup = mc.Id, true
+				return
+			}
+		}
+	}
+	id = self.cache(service, username, mc, ttl)
+	return
+}
+
+// cache should be called with the lock held.
+func (self *MockCache) cache(service, username string, mc *proto.MessageContainer, ttl time.Duration) (id string) {
+	key := authKey(service, username)
+	self.nextId++
+	self.seqs[key]++
+	id = fmt.Sprintf("%x", self.nextId)
+	mc.Id = id
+	mc.Seq = self.seqs[key]
+	now := time.Now()
+	mc.CachedAt = now.UnixNano()
+	mc.ExpiresAt = 0
+	if ttl > 0 {
+		mc.ExpiresAt = now.Add(ttl).UnixNano()
+	}
+
+	m := &cachedMessage{mc: copyContainer(mc), pending: true}
+	m.state.Cached = now
+	if ttl > 0 {
+		m.expire = m.state.Cached.Add(ttl)
+	}
+	self.msgs[key] = append(self.msgs[key], m)
+	return
+}
+
+func (self *MockCache) Get(service, username, id string) (mc *proto.MessageContainer, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err = self.begin(OP_GET, service, username)
+	if err != nil {
+		return
+	}
+	if m := self.find(authKey(service, username), id); m != nil && !m.deleted {
+		mc = copyContainer(m.mc)
+	}
+	return
+}
+
+func (self *MockCache) GetCachedMessages(service, username string, excludes ...string) (msgs []*proto.MessageContainer, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err = self.begin(OP_GET_ALL, service, username)
+	if err != nil {
+		return
+	}
+	ex := make(map[string]bool, len(excludes))
+	for _, id := range excludes {
+		ex[id] = true
+	}
+	origins := make(map[string]bool)
+	for _, m := range self.live(authKey(service, username)) {
+		if m.deleted {
+			continue
+		}
+		if len(m.mc.OriginId) > 0 {
+			if origins[m.mc.OriginId] {
+				continue
+			}
+			origins[m.mc.OriginId] = true
+		}
+		if !ex[m.mc.Id] {
+			msgs = append(msgs, copyContainer(m.mc))
+		}
+	}
+	return
+}
+
+func (self *MockCache) Del(service, username, id string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err := self.begin(OP_DEL, service, username)
+	if err != nil {
+		return err
+	}
+	if m := self.find(authKey(service, username), id); m != nil {
+		m.deleted = true
+	}
+	return nil
+}
+
+func (self *MockCache) GetMessagesByThread(service, username, threadId string) (msgs []*proto.MessageContainer, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err = self.begin(OP_GET_THREAD, service, username)
+	if err != nil {
+		return
+	}
+	for _, m := range self.live(authKey(service, username)) {
+		if m.deleted || m.mc.Message == nil || m.mc.Message.ThreadId != threadId {
+			continue
+		}
+		msgs = append(msgs, copyContainer(m.mc))
+	}
+	return
+}
+
+func (self *MockCache) IndexHeaders(service string, fields ...string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.indexed[service] == nil {
+		self.indexed[service] = make(map[string]bool, len(fields))
+	}
+	for _, f := range fields {
+		self.indexed[service][f] = true
+	}
+}
+
+func (self *MockCache) Query(service, username string, p *msgcache.Predicate) (msgs []*proto.MessageContainer, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err = self.begin(OP_QUERY, service, username)
+	if err != nil {
+		return
+	}
+	if p != nil {
+		for field := range p.Headers {
+			if !self.indexed[service][field] {
+				err = msgcache.ErrNotIndexed
+				return
+			}
+		}
+	}
+	for _, m := range self.live(authKey(service, username)) {
+		if m.deleted || !p.Match(m.mc, m.state.IsRead()) {
+			continue
+		}
+		msgs = append(msgs, copyContainer(m.mc))
+		if p != nil && p.Limit > 0 && len(msgs) >= p.Limit {
+			break
+		}
+	}
+	return
+}
+
+func (self *MockCache) Replace(service, username, id string, msg *proto.Message) (ok bool, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err = self.begin(OP_REPLACE, service, username)
+	if err != nil {
+		return
+	}
+	m := self.find(authKey(service, username), id)
+	if m == nil || m.deleted {
+		return
+	}
+	mc := copyContainer(m.mc)
+	mc.Message = msg
+	mc.Payload = nil
+	m.mc = copyContainer(mc)
+	ok = true
+	return
+}
+
+func (self *MockCache) GetMessagesBySeq(service, username string, from, to uint64) (msgs []*proto.MessageContainer, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err = self.begin(OP_GET_SEQ, service, username)
+	if err != nil {
+		return
+	}
+	for _, m := range self.live(authKey(service, username)) {
+		if m.deleted || m.mc.Seq < from || (to > 0 && m.mc.Seq > to) {
+			continue
+		}
+		msgs = append(msgs, copyContainer(m.mc))
+	}
+	return
+}
+
+func (self *MockCache) UpdateDeliveryState(service, username, id string, state msgcache.DeliveryStatus) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err := self.begin(OP_UPDATE_STATE, service, username)
+	if err != nil {
+		return err
+	}
+	m := self.find(authKey(service, username), id)
+	if m == nil {
+		return nil
+	}
+	m.pending = false
+	now := time.Now()
+	var t *time.Time
+	switch state {
+	case msgcache.STATE_DELIVERED:
+		t = &m.state.Delivered
+	case msgcache.STATE_ACKED:
+		t = &m.state.Acked
+	case msgcache.STATE_READ:
+		t = &m.state.Read
+	default:
+		return nil
+	}
+	if t.IsZero() {
+		*t = now
+	}
+	return nil
+}
+
+func (self *MockCache) GetDeliveryState(service, username, id string) (state *msgcache.DeliveryState, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err = self.begin(OP_GET_STATE, service, username)
+	if err != nil {
+		return
+	}
+	if m := self.find(authKey(service, username), id); m != nil {
+		state = new(msgcache.DeliveryState)
+		*state = m.state
+	}
+	return
+}
+
+func (self *MockCache) NrUndelivered(service, username string) (n int, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err = self.begin(OP_NR_UNDELIVERED, service, username)
+	if err != nil {
+		return
+	}
+	for _, m := range self.live(authKey(service, username)) {
+		if m.pending && !m.deleted {
+			n++
+		}
+	}
+	return
+}
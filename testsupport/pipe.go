@@ -0,0 +1,159 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package testsupport helps applications test their integration
+// with uniqush-conn without binding TCP ports or running redis.
+package testsupport
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrListenerClosed = errors.New("listener closed")
+
+// Generating a key is slow, so all tests share one.
+var keyOnce sync.Once
+var privKey *rsa.PrivateKey
+
+// Key returns the private key used by Pipe() and Listener.
+func Key() *rsa.PrivateKey {
+	keyOnce.Do(func() {
+		var err error
+		privKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+	})
+	return privKey
+}
+
+const HandshakeTimeout = 3 * time.Second
+
+// Dial authenticates a client over c.
+func Dial(c net.Conn, service, username, token string) (conn client.Conn, err error) {
+	conn, err = client.Dial(c, &Key().PublicKey, service, username, token, HandshakeTimeout)
+	if err == nil && conn == nil {
+		// the server did not reply CMD_AUTHOK.
+		err = server.ErrAuthFail
+	}
+	return
+}
+
+// Pipe returns a pair of authenticated connections linked
+// by an in-memory net.Pipe.
+func Pipe(auth server.Authenticator, service, username, token string) (servConn server.Conn, cliConn client.Conn, err error) {
+	sc, cc := net.Pipe()
+	var es error
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		servConn, es = server.AuthConn(sc, Key(), auth, HandshakeTimeout)
+		if es != nil {
+			// like msgcenter, close it so that the client won't wait.
+			sc.Close()
+		}
+	}()
+	cliConn, err = Dial(cc, service, username, token)
+	<-done
+	if err == nil {
+		err = es
+	}
+	if err != nil {
+		if servConn != nil {
+			servConn.Close()
+			servConn = nil
+		}
+		if cliConn != nil {
+			cliConn.Close()
+			cliConn = nil
+		}
+	}
+	return
+}
+
+type pipeAddr struct{}
+
+func (self pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (self pipeAddr) String() string {
+	return "pipe"
+}
+
+// Listener is a net.Listener whose connections are
+// in-memory pipes created by Dial(). It could be given
+// to msgcenter.NewMessageCenter() with Key().
+type Listener struct {
+	conns     chan net.Conn
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+func NewListener() *Listener {
+	ret := new(Listener)
+	ret.conns = make(chan net.Conn)
+	ret.closed = make(chan bool)
+	return ret
+}
+
+func (self *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-self.conns:
+		return c, nil
+	case <-self.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (self *Listener) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+	})
+	return nil
+}
+
+func (self *Listener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial returns the client side of a new connection.
+func (self *Listener) Dial() (net.Conn, error) {
+	sc, cc := net.Pipe()
+	select {
+	case self.conns <- sc:
+		return cc, nil
+	case <-self.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Connect dials the listener and authenticates the client.
+func (self *Listener) Connect(service, username, token string) (conn client.Conn, err error) {
+	c, err := self.Dial()
+	if err != nil {
+		return
+	}
+	return Dial(c, service, username, token)
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package testsupport
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/proto"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	auth := NewFakeAuth()
+	auth.Allow("service", "user", "token")
+	servConn, cliConn, err := Pipe(auth, "service", "user", "token")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	msg := &proto.Message{Body: []byte("hello")}
+	go servConn.SendMessage(msg, "1", nil)
+	mc, err := cliConn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !mc.Message.Eq(msg) || mc.Id != "1" {
+		t.Errorf("bad message: %+v", mc)
+	}
+
+	_, _, err = Pipe(auth, "service", "user", "wrong token")
+	if err == nil {
+		t.Errorf("should fail with a wrong token")
+	}
+	auth.Fail(errors.New("auth server is down"))
+	_, _, err = Pipe(auth, "service", "user", "token")
+	if err == nil {
+		t.Errorf("should fail if the authenticator fails")
+	}
+}
+
+func TestMockCache(t *testing.T) {
+	cache := NewMockCache()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		mc := &proto.MessageContainer{Message: &proto.Message{Body: []byte{byte(i)}}}
+		id, err := cache.CacheMessage("service", "user", mc, 0)
+		if err != nil || mc.Id != id || mc.Seq != uint64(i+1) {
+			t.Fatalf("bad cache: %v %v %+v", id, err, mc)
+		}
+		ids = append(ids, id)
+	}
+	cache.CacheMessage("service", "user", &proto.MessageContainer{Message: &proto.Message{}}, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	msgs, _ := cache.GetCachedMessages("service", "user", ids[0])
+	if len(msgs) != 2 || msgs[0].Id != ids[1] {
+		t.Errorf("bad messages: %v", msgs)
+	}
+	msgs, _ = cache.GetMessagesBySeq("service", "user", 2, 2)
+	if len(msgs) != 1 || msgs[0].Seq != 2 {
+		t.Errorf("bad messages: %v", msgs)
+	}
+
+	cache.UpdateDeliveryState("service", "user", ids[0], 0)
+	if n, _ := cache.NrUndelivered("service", "user"); n != 2 {
+		t.Errorf("bad number of undelivered messages: %v", n)
+	}
+	state, _ := cache.GetDeliveryState("service", "user", ids[0])
+	if state == nil || !state.IsDelivered() {
+		t.Errorf("bad state: %+v", state)
+	}
+
+	e := errors.New("down")
+	cache.FailNext(OP_GET, e)
+	if _, err := cache.Get("service", "user", ids[0]); err != e {
+		t.Errorf("should fail: %v", err)
+	}
+	if mc, err := cache.Get("service", "user", ids[0]); err != nil || mc == nil {
+		t.Errorf("should only fail once: %v", err)
+	}
+	if calls := cache.Calls(); len(calls) != 11 || calls[0] != "cache service:user" {
+		t.Errorf("bad calls: %v", calls)
+	}
+
+	cache.Del("service", "user", ids[0])
+	if mc, _ := cache.Get("service", "user", ids[0]); mc != nil {
+		t.Errorf("message should be deleted: %+v", mc)
+	}
+	if state, _ := cache.GetDeliveryState("service", "user", ids[0]); state == nil || !state.IsDelivered() {
+		t.Errorf("state should be kept: %+v", state)
+	}
+	if ok, _ := cache.Replace("service", "user", ids[0], &proto.Message{}); ok {
+		t.Errorf("a deleted message is replaced")
+	}
+	msg := &proto.Message{Body: []byte("new")}
+	if ok, _ := cache.Replace("service", "user", ids[1], msg); !ok {
+		t.Errorf("cannot replace")
+	}
+	if mc, _ := cache.Get("service", "user", ids[1]); mc == nil || !mc.Message.Eq(msg) || mc.Seq != 2 {
+		t.Errorf("bad replaced message: %+v", mc)
+	}
+
+	cache.IndexHeaders("service", "type")
+	msg.Header = map[string]string{"type": "invite"}
+	cache.Replace("service", "user", ids[2], msg)
+	msgs, _ = cache.Query("service", "user", &msgcache.Predicate{Headers: map[string]string{"type": "invite"}})
+	if len(msgs) != 1 || msgs[0].Id != ids[2] {
+		t.Errorf("bad messages: %v", msgs)
+	}
+	if _, err := cache.Query("service", "user", &msgcache.Predicate{Headers: map[string]string{"room": "1"}}); err != msgcache.ErrNotIndexed {
+		t.Errorf("should not query a field which is not indexed: %v", err)
+	}
+}
+
+type mockConfigReader struct {
+	cache *MockCache
+}
+
+func (self *mockConfigReader) ReadConfig(service string) *msgcenter.ServiceConfig {
+	return &msgcenter.ServiceConfig{MsgCache: self.cache}
+}
+
+func TestMessageCenterOverListener(t *testing.T) {
+	ln := NewListener()
+	auth := NewFakeAuth()
+	auth.AllowAll()
+	cache := NewMockCache()
+	center := msgcenter.NewMessageCenter(ln, Key(), nil, HandshakeTimeout, auth, &mockConfigReader{cache})
+	go center.Start()
+
+	conn, err := ln.Connect("service", "user", "token")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer conn.Close()
+	// Wait for the connection to be added.
+	time.Sleep(100 * time.Millisecond)
+
+	msg := &proto.Message{Body: []byte("hello")}
+	go center.SendMessage("service", "user", msg, nil, time.Hour)
+	mc, err := conn.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !mc.Message.Eq(msg) || len(mc.Id) == 0 {
+		t.Errorf("bad message: %+v", mc)
+	}
+	if cached, _ := cache.Get("service", "user", mc.Id); cached == nil {
+		t.Errorf("the message should be cached")
+	}
+}
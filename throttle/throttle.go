@@ -0,0 +1,79 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package throttle limits the bandwidth of connections with token
+// buckets counting bytes.
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket. It is goroutine-safe, so a bucket may be
+// shared by all connections of a service.
+type Bucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket allows bytesPerSec bytes per second, and bursts of up to
+// one second of traffic. It returns nil, which never throttles, if
+// bytesPerSec is not positive.
+func NewBucket(bytesPerSec int) *Bucket {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	ret := new(Bucket)
+	ret.rate = float64(bytesPerSec)
+	ret.burst = ret.rate
+	ret.tokens = ret.burst
+	ret.last = time.Now()
+	return ret
+}
+
+// reserve takes n tokens, going into debt if there are not enough,
+// and returns how long the caller should wait for the debt to be paid.
+func (self *Bucket) reserve(n int) time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	self.tokens += now.Sub(self.last).Seconds() * self.rate
+	if self.tokens > self.burst {
+		self.tokens = self.burst
+	}
+	self.last = now
+	self.tokens -= float64(n)
+	if self.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-self.tokens / self.rate * float64(time.Second))
+}
+
+// Wait blocks until n bytes may be sent. A write larger than the burst
+// is not split: it is sent at once, and the following ones wait longer.
+func (self *Bucket) Wait(n int) {
+	if self == nil || n <= 0 {
+		return
+	}
+	if d := self.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNilBucket(t *testing.T) {
+	b := NewBucket(0)
+	if b != nil {
+		t.Errorf("a bucket without limit should be nil")
+	}
+	start := time.Now()
+	b.Wait(1 << 30)
+	if time.Since(start) > 10*time.Millisecond {
+		t.Errorf("nil bucket throttles")
+	}
+}
+
+func TestBucket(t *testing.T) {
+	b := NewBucket(10000)
+	start := time.Now()
+	// The burst is sent immediately.
+	b.Wait(10000)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("burst is throttled: %v", d)
+	}
+	b.Wait(2000)
+	b.Wait(2000)
+	if d := time.Since(start); d < 350*time.Millisecond || d > time.Second {
+		t.Errorf("4000 more bytes at 10000B/s took %v", d)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package tracing provides optional hooks to trace the handshake,
+// command processing, cache operations and forwards. It does not
+// depend on any tracing system. To send spans to a tracing system,
+// e.g. OpenTelemetry, implement Tracer and call SetTracer() at start.
+//
+// The trace context is propagated in the proto.TraceHeader of a
+// message, so a message could be followed from the sender, through
+// the server and the backend, to the receiver.
+package tracing
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"sync"
+)
+
+type Tracer interface {
+	// StartSpan() starts a span as a child of parent, which is a
+	// propagated trace context, or a new trace if parent is empty.
+	// kv are attributes of the span in key-value pairs.
+	StartSpan(name, parent string, kv ...interface{}) Span
+}
+
+type Span interface {
+	// Context() returns the trace context to be propagated
+	// to the children of the span.
+	Context() string
+	SetError(err error)
+	End()
+}
+
+type nopSpan string
+
+func (self nopSpan) Context() string    { return string(self) }
+func (self nopSpan) SetError(err error) {}
+func (self nopSpan) End()               {}
+
+type nopTracer struct{}
+
+func (self nopTracer) StartSpan(name, parent string, kv ...interface{}) Span {
+	// Keep the context so that it would be propagated anyway.
+	return nopSpan(parent)
+}
+
+var tracerLock sync.RWMutex
+var tracer Tracer = nopTracer{}
+
+// SetTracer() sets the tracer used by all packages. A nil tracer
+// turns tracing off.
+func SetTracer(t Tracer) {
+	tracerLock.Lock()
+	defer tracerLock.Unlock()
+	if t == nil {
+		t = nopTracer{}
+	}
+	tracer = t
+}
+
+func Start(name, parent string, kv ...interface{}) Span {
+	tracerLock.RLock()
+	t := tracer
+	tracerLock.RUnlock()
+	return t.StartSpan(name, parent, kv...)
+}
+
+// Context() returns the trace context carried by the message.
+func Context(msg *proto.Message) string {
+	if msg == nil || len(msg.Header) == 0 {
+		return ""
+	}
+	return msg.Header[proto.TraceHeader]
+}
+
+// StartFromMessage() starts a span as a child of the trace
+// context carried by the message.
+func StartFromMessage(name string, msg *proto.Message, kv ...interface{}) Span {
+	return Start(name, Context(msg), kv...)
+}
+
+// Inject() puts the trace context of the span into the message,
+// so that the span would be the parent of the following spans.
+func Inject(span Span, msg *proto.Message) {
+	if msg == nil {
+		return
+	}
+	ctx := span.Context()
+	if len(ctx) == 0 {
+		return
+	}
+	if msg.Header == nil {
+		msg.Header = make(map[string]string, 1)
+	}
+	msg.Header[proto.TraceHeader] = ctx
+}
+
+// End() records err, if any, and ends the span.
+func End(span Span, err error) {
+	if err != nil {
+		span.SetError(err)
+	}
+	span.End()
+}
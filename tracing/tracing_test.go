@@ -0,0 +1,83 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package tracing
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+	"testing"
+)
+
+type recordedSpan struct {
+	name   string
+	parent string
+	err    error
+	ended  bool
+}
+
+func (self *recordedSpan) Context() string    { return self.name + "<" + self.parent }
+func (self *recordedSpan) SetError(err error) { self.err = err }
+func (self *recordedSpan) End()               { self.ended = true }
+
+type recorder struct {
+	spans []*recordedSpan
+}
+
+func (self *recorder) StartSpan(name, parent string, kv ...interface{}) Span {
+	span := &recordedSpan{name: name, parent: parent}
+	self.spans = append(self.spans, span)
+	return span
+}
+
+func TestNopTracerKeepsContext(t *testing.T) {
+	msg := &proto.Message{Header: map[string]string{proto.TraceHeader: "ctx"}}
+	span := StartFromMessage("op", msg)
+	Inject(span, msg)
+	End(span, nil)
+	if Context(msg) != "ctx" {
+		t.Errorf("context should be kept: %v", Context(msg))
+	}
+
+	msg = &proto.Message{Body: []byte("hello")}
+	Inject(StartFromMessage("op", msg), msg)
+	if msg.Header != nil {
+		t.Errorf("should not add an empty context")
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	rec := new(recorder)
+	SetTracer(rec)
+	defer SetTracer(nil)
+
+	msg := &proto.Message{Header: map[string]string{proto.TraceHeader: "root"}}
+	span := StartFromMessage("first", msg)
+	Inject(span, msg)
+	End(span, errors.New("failed"))
+
+	span = StartFromMessage("second", msg)
+	Inject(span, msg)
+	End(span, nil)
+
+	if Context(msg) != "second<first<root" {
+		t.Errorf("bad context: %v", Context(msg))
+	}
+	if len(rec.spans) != 2 || !rec.spans[0].ended || rec.spans[0].err == nil || rec.spans[1].err != nil {
+		t.Errorf("bad spans: %+v", rec.spans)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package transform
+
+import (
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"regexp"
+	"strconv"
+)
+
+// TruncatedHeader is set to "true" in a message whose body has been
+// truncated. OriginalSizeHeader carries the size before truncation.
+const (
+	TruncatedHeader    = "truncated"
+	OriginalSizeHeader = "original-size"
+)
+
+// The patterns which could be given by name to "redact".
+var redactPatterns = map[string]string{
+	"email": `[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`,
+	"phone": `\+?[0-9][0-9 \-]{7,}[0-9]`,
+}
+
+const defaultRedaction = "[redacted]"
+
+func init() {
+	Register("header", newHeaderInjector)
+	Register("truncate", newTruncator)
+	Register("redact", newRedactor)
+}
+
+type headerInjector struct {
+	header map[string]string
+}
+
+// newHeaderInjector sets the headers given as parameters,
+// overwriting the ones of the message.
+func newHeaderInjector(params map[string]string) (Transformer, error) {
+	if len(params) == 0 {
+		return nil, fmt.Errorf("header: no header")
+	}
+	ret := new(headerInjector)
+	ret.header = make(map[string]string, len(params))
+	for k, v := range params {
+		ret.header[k] = v
+	}
+	return ret, nil
+}
+
+func (self *headerInjector) Transform(ctx *Context, msg *proto.Message) *proto.Message {
+	ret := copyHeader(msg, len(self.header))
+	for k, v := range self.header {
+		ret.Header[k] = v
+	}
+	return ret
+}
+
+type truncator struct {
+	maxSize int
+}
+
+// newTruncator truncates the bodies larger than "max-size" bytes.
+// Opaque bodies are never truncated.
+func newTruncator(params map[string]string) (Transformer, error) {
+	n, err := strconv.Atoi(params["max-size"])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("truncate: bad max-size: %v", params["max-size"])
+	}
+	return &truncator{n}, nil
+}
+
+func (self *truncator) Transform(ctx *Context, msg *proto.Message) *proto.Message {
+	if msg.Opaque || len(msg.Body) <= self.maxSize {
+		return msg
+	}
+	ret := copyHeader(msg, 2)
+	ret.Body = msg.Body[:self.maxSize]
+	ret.Header[TruncatedHeader] = "true"
+	ret.Header[OriginalSizeHeader] = strconv.Itoa(len(msg.Body))
+	return ret
+}
+
+type redactor struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// newRedactor replaces what matches "pattern", a regular expression
+// or one of "email" and "phone", in the header values and the body
+// with "replacement". Opaque bodies are never redacted.
+func newRedactor(params map[string]string) (Transformer, error) {
+	p := params["pattern"]
+	if named, ok := redactPatterns[p]; ok {
+		p = named
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("redact: no pattern")
+	}
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return nil, fmt.Errorf("redact: %v", err)
+	}
+	ret := &redactor{re, defaultRedaction}
+	if r, ok := params["replacement"]; ok {
+		ret.replacement = r
+	}
+	return ret, nil
+}
+
+func (self *redactor) Transform(ctx *Context, msg *proto.Message) *proto.Message {
+	var ret *proto.Message
+	for k, v := range msg.Header {
+		if !self.pattern.MatchString(v) {
+			continue
+		}
+		if ret == nil {
+			ret = copyHeader(msg, 0)
+		}
+		ret.Header[k] = self.pattern.ReplaceAllString(v, self.replacement)
+	}
+	if !msg.Opaque && self.pattern.Match(msg.Body) {
+		if ret == nil {
+			ret = copyHeader(msg, 0)
+		}
+		ret.Body = self.pattern.ReplaceAll(msg.Body, []byte(self.replacement))
+	}
+	if ret == nil {
+		return msg
+	}
+	return ret
+}
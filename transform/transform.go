@@ -0,0 +1,103 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package transform changes the messages sent to the users of a
+// service, e.g. to add headers, to truncate large bodies or to
+// redact personal data. The transformers are applied before the
+// messages are cached, so the cached messages are what the users
+// see.
+//
+// Transformers are created by name, with the factories registered
+// by Register(). The built-in ones are "header", "truncate" and
+// "redact".
+package transform
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/registry"
+)
+
+// Context tells to whom, and from whom, the message is sent.
+// Sender and SenderService are empty unless the message is forwarded.
+// The validators are given the same one.
+type Context struct {
+	Service       string
+	Receiver      string
+	Sender        string
+	SenderService string
+}
+
+// Transformer should not modify msg, which may be shared with other
+// receivers. It returns the message to send instead, which is msg
+// itself if nothing is changed, or nil to drop the message.
+type Transformer interface {
+	Transform(ctx *Context, msg *proto.Message) *proto.Message
+}
+
+type TransformerFunc func(ctx *Context, msg *proto.Message) *proto.Message
+
+func (self TransformerFunc) Transform(ctx *Context, msg *proto.Message) *proto.Message {
+	return self(ctx, msg)
+}
+
+// Chain applies the transformers in order.
+type Chain []Transformer
+
+func (self Chain) Transform(ctx *Context, msg *proto.Message) *proto.Message {
+	for _, t := range self {
+		if msg == nil {
+			return nil
+		}
+		msg = t.Transform(ctx, msg)
+	}
+	return msg
+}
+
+// Factory creates a transformer out of its parameters.
+type Factory func(params map[string]string) (Transformer, error)
+
+var factories = registry.New("transformer")
+
+// Register makes a transformer available by name. Registering a
+// name again replaces its factory.
+func Register(name string, f Factory) {
+	factories.Register(name, func(params map[string]string) (interface{}, error) {
+		return f(params)
+	})
+}
+
+// New creates the transformer registered with name.
+func New(name string, params map[string]string) (t Transformer, err error) {
+	p, err := factories.New(name, params)
+	if err != nil {
+		return
+	}
+	t, _ = p.(Transformer)
+	return
+}
+
+// copyHeader returns a copy of the message whose header could be
+// changed. The body is still shared.
+func copyHeader(msg *proto.Message, extra int) *proto.Message {
+	ret := new(proto.Message)
+	*ret = *msg
+	ret.Header = make(map[string]string, len(msg.Header)+extra)
+	for k, v := range msg.Header {
+		ret.Header[k] = v
+	}
+	return ret
+}
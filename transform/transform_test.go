@@ -0,0 +1,114 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package transform
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"testing"
+)
+
+func mustNew(name string, params map[string]string, t *testing.T) Transformer {
+	tr, err := New(name, params)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return tr
+}
+
+func TestChain(t *testing.T) {
+	chain := Chain{
+		mustNew("header", map[string]string{"origin": "server"}, t),
+		mustNew("redact", map[string]string{"pattern": "email"}, t),
+		mustNew("truncate", map[string]string{"max-size": "16"}, t),
+	}
+	msg := &proto.Message{
+		Header: map[string]string{"title": "from alice@example.com"},
+		Body:   []byte("write to bob@example.com for details"),
+	}
+	ctx := &Context{Service: "srv", Receiver: "carol"}
+	out := chain.Transform(ctx, msg)
+	if out.Header["origin"] != "server" {
+		t.Errorf("no header injected: %v", out.Header)
+	}
+	if out.Header["title"] != "from [redacted]" {
+		t.Errorf("header not redacted: %v", out.Header["title"])
+	}
+	if string(out.Body) != "write to [redact" || out.Header[TruncatedHeader] != "true" || out.Header[OriginalSizeHeader] != "31" {
+		t.Errorf("bad body: %q %v", out.Body, out.Header)
+	}
+
+	// The original message is shared and should not be changed.
+	if len(msg.Header) != 1 || msg.Header["title"] != "from alice@example.com" || string(msg.Body) != "write to bob@example.com for details" {
+		t.Errorf("the original message is changed: %+v", msg)
+	}
+}
+
+func TestTransformersKeepOpaqueBodies(t *testing.T) {
+	msg := proto.NewOpaqueMessage([]byte("secret alice@example.com secret"), "hi")
+	ctx := &Context{Service: "srv", Receiver: "carol"}
+	for _, tr := range []Transformer{
+		mustNew("redact", map[string]string{"pattern": "email"}, t),
+		mustNew("truncate", map[string]string{"max-size": "4"}, t),
+	} {
+		if out := tr.Transform(ctx, msg); out != msg {
+			t.Errorf("an opaque message is changed: %+v", out)
+		}
+	}
+}
+
+func TestUnchangedMessage(t *testing.T) {
+	msg := &proto.Message{Body: []byte("short")}
+	ctx := &Context{Service: "srv", Receiver: "carol"}
+	for _, tr := range []Transformer{
+		mustNew("redact", map[string]string{"pattern": "email"}, t),
+		mustNew("truncate", map[string]string{"max-size": "16"}, t),
+	} {
+		if out := tr.Transform(ctx, msg); out != msg {
+			t.Errorf("the message should not be copied: %+v", out)
+		}
+	}
+}
+
+func TestBadTransformers(t *testing.T) {
+	if _, err := New("nosuch", nil); err == nil {
+		t.Errorf("should reject an unknown transformer")
+	}
+	if _, err := New("truncate", map[string]string{"max-size": "-1"}); err == nil {
+		t.Errorf("should reject a negative size")
+	}
+	if _, err := New("redact", map[string]string{"pattern": "("}); err == nil {
+		t.Errorf("should reject a bad pattern")
+	}
+	if _, err := New("header", nil); err == nil {
+		t.Errorf("should reject an empty header")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register("receiver", func(params map[string]string) (Transformer, error) {
+		return TransformerFunc(func(ctx *Context, msg *proto.Message) *proto.Message {
+			ret := copyHeader(msg, 1)
+			ret.Header["to"] = ctx.Receiver
+			return ret
+		}), nil
+	})
+	out := mustNew("receiver", nil, t).Transform(&Context{Service: "srv", Receiver: "carol"}, &proto.Message{Body: []byte("hi")})
+	if out.Header["to"] != "carol" {
+		t.Errorf("bad header: %v", out.Header)
+	}
+}
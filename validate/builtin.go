@@ -0,0 +1,134 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package validate
+
+import (
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The formats which could be given by name to "format".
+var formats = map[string]string{
+	"int":   `-?[0-9]+`,
+	"bool":  `true|false`,
+	"email": `[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`,
+	"uuid":  `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+}
+
+func init() {
+	Register("required", newRequired)
+	Register("format", newFormat)
+	Register("max-size", newMaxSize)
+}
+
+type required struct {
+	headers []string
+}
+
+// newRequired rejects the messages without any of the headers in
+// "headers", a comma separated list. A binary header counts.
+func newRequired(params map[string]string) (Validator, error) {
+	ret := new(required)
+	for _, h := range strings.Split(params["headers"], ",") {
+		h = strings.TrimSpace(h)
+		if len(h) > 0 {
+			ret.headers = append(ret.headers, h)
+		}
+	}
+	if len(ret.headers) == 0 {
+		return nil, fmt.Errorf("required: no header")
+	}
+	return ret, nil
+}
+
+func (self *required) Validate(ctx *Context, msg *proto.Message) *proto.ValidationError {
+	for _, h := range self.headers {
+		if _, ok := msg.Header[h]; ok {
+			continue
+		}
+		if _, ok := msg.BinaryHeader[h]; ok {
+			continue
+		}
+		return &proto.ValidationError{Header: h, Reason: "missing"}
+	}
+	return nil
+}
+
+type format struct {
+	patterns map[string]*regexp.Regexp
+}
+
+// newFormat checks the values of the headers given as parameters.
+// The value of a parameter is a regular expression, or one of "int",
+// "bool", "email" and "uuid", which should match the whole value of
+// the header. Missing headers are not checked.
+func newFormat(params map[string]string) (Validator, error) {
+	if len(params) == 0 {
+		return nil, fmt.Errorf("format: no header")
+	}
+	ret := new(format)
+	ret.patterns = make(map[string]*regexp.Regexp, len(params))
+	for h, p := range params {
+		if named, ok := formats[p]; ok {
+			p = named
+		}
+		re, err := regexp.Compile(`^(?:` + p + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("format: [header=%v] %v", h, err)
+		}
+		ret.patterns[h] = re
+	}
+	return ret, nil
+}
+
+func (self *format) Validate(ctx *Context, msg *proto.Message) *proto.ValidationError {
+	for h, re := range self.patterns {
+		v, ok := msg.Header[h]
+		if !ok {
+			continue
+		}
+		if !re.MatchString(v) {
+			return &proto.ValidationError{Header: h, Reason: "bad format"}
+		}
+	}
+	return nil
+}
+
+type maxSize struct {
+	size int
+}
+
+// newMaxSize rejects the messages larger than "size" bytes,
+// counting the headers.
+func newMaxSize(params map[string]string) (Validator, error) {
+	n, err := strconv.Atoi(params["size"])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("max-size: bad size: %v", params["size"])
+	}
+	return &maxSize{n}, nil
+}
+
+func (self *maxSize) Validate(ctx *Context, msg *proto.Message) *proto.ValidationError {
+	if msg.Size() > self.size {
+		return &proto.ValidationError{Reason: fmt.Sprintf("larger than %v bytes", self.size)}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package validate checks the messages sent to the users of a
+// service, e.g. that they carry the required headers and that the
+// values are well formed, so that malformed messages are rejected
+// before reaching the backends or the clients.
+//
+// Validators are created by name, with the factories registered
+// by Register(). The built-in ones are "required", "format" and
+// "max-size".
+package validate
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/registry"
+	"github.com/uniqush/uniqush-conn/transform"
+)
+
+// Context is the one given to the transformers.
+type Context = transform.Context
+
+// Validator returns nil if the message is valid. It should not
+// modify msg.
+type Validator interface {
+	Validate(ctx *Context, msg *proto.Message) *proto.ValidationError
+}
+
+type ValidatorFunc func(ctx *Context, msg *proto.Message) *proto.ValidationError
+
+func (self ValidatorFunc) Validate(ctx *Context, msg *proto.Message) *proto.ValidationError {
+	return self(ctx, msg)
+}
+
+// Chain applies the validators in order and returns the first error.
+type Chain []Validator
+
+func (self Chain) Validate(ctx *Context, msg *proto.Message) *proto.ValidationError {
+	for _, v := range self {
+		if err := v.Validate(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Factory creates a validator out of its parameters.
+type Factory func(params map[string]string) (Validator, error)
+
+var factories = registry.New("validator")
+
+// Register makes a validator available by name. Registering a
+// name again replaces its factory.
+func Register(name string, f Factory) {
+	factories.Register(name, func(params map[string]string) (interface{}, error) {
+		return f(params)
+	})
+}
+
+// New creates the validator registered with name.
+func New(name string, params map[string]string) (v Validator, err error) {
+	p, err := factories.New(name, params)
+	if err != nil {
+		return
+	}
+	v, _ = p.(Validator)
+	return
+}
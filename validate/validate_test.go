@@ -0,0 +1,88 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package validate
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"testing"
+)
+
+func mustNew(name string, params map[string]string, t *testing.T) Validator {
+	v, err := New(name, params)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return v
+}
+
+func TestChain(t *testing.T) {
+	chain := Chain{
+		mustNew("required", map[string]string{"headers": "type, thumbnail"}, t),
+		mustNew("format", map[string]string{"type": "text|image", "count": "int"}, t),
+		mustNew("max-size", map[string]string{"size": "64"}, t),
+	}
+	ctx := &Context{Service: "srv", Receiver: "carol"}
+
+	msg := &proto.Message{
+		Header:       map[string]string{"type": "image", "count": "3"},
+		BinaryHeader: map[string][]byte{"thumbnail": []byte{0}},
+		Body:         []byte("hello"),
+	}
+	if err := chain.Validate(ctx, msg); err != nil {
+		t.Errorf("valid message rejected: %v", err)
+	}
+
+	bad := []struct {
+		msg    *proto.Message
+		header string
+	}{
+		{&proto.Message{Header: map[string]string{"thumbnail": "x"}}, "type"},
+		{&proto.Message{Header: map[string]string{"type": "text"}}, "thumbnail"},
+		{&proto.Message{Header: map[string]string{"type": "video", "thumbnail": "x"}}, "type"},
+		{&proto.Message{Header: map[string]string{"type": "text", "thumbnail": "x", "count": "3a"}}, "count"},
+		{&proto.Message{Header: map[string]string{"type": "text", "thumbnail": "x"}, Body: make([]byte, 64)}, ""},
+	}
+	for i, b := range bad {
+		err := chain.Validate(ctx, b.msg)
+		if err == nil {
+			t.Errorf("%vth message should be rejected", i)
+			continue
+		}
+		if err.Header != b.header {
+			t.Errorf("%vth message: wrong header: %v", i, err)
+		}
+	}
+}
+
+func TestBadParams(t *testing.T) {
+	bad := []struct {
+		name   string
+		params map[string]string
+	}{
+		{"required", map[string]string{"headers": " , "}},
+		{"format", map[string]string{}},
+		{"format", map[string]string{"type": "("}},
+		{"max-size", map[string]string{"size": "-1"}},
+		{"unknown", nil},
+	}
+	for _, b := range bad {
+		if _, err := New(b.name, b.params); err == nil {
+			t.Errorf("%v %v should be rejected", b.name, b.params)
+		}
+	}
+}